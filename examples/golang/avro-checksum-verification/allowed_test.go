@@ -0,0 +1,105 @@
+// Copyright 2023 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/binary"
+	"hash/crc32"
+	"strconv"
+	"testing"
+
+	"github.com/linkedin/goavro/v2"
+	"github.com/segmentio/kafka-go"
+	"github.com/stretchr/testify/require"
+)
+
+// testEnumSetSchema is the value schema of the table
+// `test`.`e` (id BIGINT PRIMARY KEY, e ENUM("a,b", "it's", "", "x"), s SET("it's", "x y", "", "z")),
+// the `allowed` is escaped by TiCDC as `escapeEnumAndSetOptions` of the avro encoder does.
+const testEnumSetSchema = `{
+  "type": "record",
+  "name": "e",
+  "namespace": "default.test",
+  "fields": [
+    {"name": "id", "type": {"type": "long", "connect.parameters": {"tidb_type": "BIGINT"}}},
+    {"name": "e", "type": ["null", {"type": "string", "connect.parameters": {"tidb_type": "ENUM", "allowed": "a\\,b,it's,,x"}}], "default": null},
+    {"name": "s", "type": ["null", {"type": "string", "connect.parameters": {"tidb_type": "SET", "allowed": "it's,x y,,z"}}], "default": null},
+    {"name": "_tidb_op", "type": "string", "default": ""},
+    {"name": "_tidb_commit_ts", "type": "long", "default": 0},
+    {"name": "_tidb_commit_physical_time", "type": "long", "default": 0},
+    {"name": "_tidb_row_level_checksum", "type": "string", "default": ""},
+    {"name": "_tidb_corrupted", "type": "boolean", "default": false},
+    {"name": "_tidb_checksum_version", "type": "int", "default": 0}
+  ]
+}`
+
+func TestSplitAllowedValues(t *testing.T) {
+	t.Parallel()
+
+	for _, c := range []struct {
+		allowed  string
+		expected []string
+	}{
+		{"a,b", []string{"a", "b"}},
+		{`a\,b,it's,,x`, []string{"a,b", "it's", "", "x"}},
+		{`,a\,`, []string{"", "a,"}},
+		{`\,\,`, []string{",,"}},
+		{`it\'s,a\b`, []string{`it\'s`, `a\b`}},
+		{"", []string{""}},
+	} {
+		require.Equal(t, c.expected, splitAllowedValues(c.allowed), c.allowed)
+	}
+}
+
+func TestAvroEnumSetChecksum(t *testing.T) {
+	t.Parallel()
+
+	registry := newTestRegistry(t, map[int]string{testSchemaID: testEnumSetSchema})
+	cfg := newDefaultConfig()
+	cfg.schemaRegistryURL = registry.URL
+	v, err := newMessageVerifier(cfg)
+	require.NoError(t, err)
+
+	// the checksum follows the TiDB rowcodec directly, the enum and set are encoded by the ordinals.
+	rowChecksum := func(id int64, e, s uint64) string {
+		buf := binary.LittleEndian.AppendUint64(nil, uint64(id))
+		buf = binary.LittleEndian.AppendUint64(buf, e)
+		buf = binary.LittleEndian.AppendUint64(buf, s)
+		return strconv.FormatUint(uint64(crc32.ChecksumIEEE(buf)), 10)
+	}
+	for i, c := range []struct {
+		e, s         string
+		enum, setVal uint64
+	}{
+		{"a,b", "it's", 1, 1},
+		{"it's", "it's,z", 2, 9},
+		{"", "x y,it's,z", 3, 11},
+		{"x", "", 4, 0},
+	} {
+		row := map[string]interface{}{
+			"id":                         int64(i),
+			"e":                          goavro.Union("string", c.e),
+			"s":                          goavro.Union("string", c.s),
+			"_tidb_op":                   "c",
+			"_tidb_commit_ts":            int64(400000000000000000),
+			"_tidb_commit_physical_time": int64(400000000000000000 >> 18),
+			"_tidb_row_level_checksum":   rowChecksum(int64(i), c.enum, c.setVal),
+			"_tidb_corrupted":            false,
+			"_tidb_checksum_version":     int32(0),
+		}
+		result, err := v.verify(kafka.Message{Value: encodeTestMessage(t, testSchemaID, testEnumSetSchema, row)})
+		require.NoError(t, err, "enum %q, set %q", c.e, c.s)
+		require.Equal(t, outcomeVerified, result.outcome)
+	}
+}
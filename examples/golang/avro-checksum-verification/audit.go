@@ -0,0 +1,339 @@
+// Copyright 2023 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"avro-checksum-sample/checksum"
+	"github.com/pingcap/log"
+	"github.com/pingcap/tidb/pkg/parser/mysql"
+	"go.uber.org/zap"
+)
+
+// valueSubjectSuffix is the suffix of the subject TiCDC registers the value schemas of a topic under.
+const valueSubjectSuffix = "-value"
+
+// auditVerdict is the verdict of a schema by the capabilities of the verifier.
+type auditVerdict string
+
+const (
+	verdictSupported   auditVerdict = "supported"
+	verdictCaveats     auditVerdict = "caveats"
+	verdictUnsupported auditVerdict = "unsupported"
+)
+
+// auditIssue is the reason why the verifier cannot handle a column, or handles it with a caveat,
+// the column is empty if the issue is of the whole schema.
+type auditIssue struct {
+	Column string `json:"column,omitempty"`
+	Reason string `json:"reason"`
+}
+
+// schemaAudit is the verdict of a value schema.
+type schemaAudit struct {
+	SchemaID int `json:"schemaId"`
+	// Source is where the schema is from, such as `avro-checksum-test-value@3` or the schema file.
+	Source      string       `json:"source"`
+	Table       string       `json:"table"`
+	Verdict     auditVerdict `json:"verdict"`
+	Caveats     []auditIssue `json:"caveats,omitempty"`
+	Unsupported []auditIssue `json:"unsupported,omitempty"`
+}
+
+// auditResult is the output of the `audit` command, the schemas are sorted by the schema ID.
+type auditResult struct {
+	Schemas     []schemaAudit `json:"schemas"`
+	Supported   int           `json:"supported"`
+	Caveats     int           `json:"caveats"`
+	Unsupported int           `json:"unsupported"`
+}
+
+// runAudit prints the verdict of each schema to be used by the verification,
+// the exit code is the decode error one if any schema cannot be handled.
+func runAudit(args []string, w io.Writer) int {
+	cfg := newDefaultConfig()
+	fs := flag.NewFlagSet(commandAudit, flag.ExitOnError)
+	cfg.bindFlags(fs)
+	_ = fs.Parse(args)
+	if err := cfg.validate(); err != nil {
+		log.Fatal("invalid configuration", zap.Error(err))
+	}
+	if cfg.protocol != protocolAvro {
+		log.Fatal("only the avro protocol is supported by the audit", zap.String("protocol", cfg.protocol))
+	}
+
+	result, err := auditSchemas(cfg)
+	if err != nil {
+		log.Error("audit the schemas failed", zap.Error(err))
+		return exitCodeOf(err)
+	}
+	if err := writeJSON(w, result); err != nil {
+		log.Error("write the result failed", zap.Error(err))
+		return exitCodeInfraError
+	}
+	if result.Unsupported > 0 {
+		return exitCodeDecodeError
+	}
+	return exitCodeClean
+}
+
+// preflight audits the schemas before the verification starts, it returns false along with the exit code
+// if the verification should not start, which is the case if any schema cannot be handled and not forced.
+func preflight(cfg *config) (int, bool) {
+	result, err := auditSchemas(cfg)
+	if err != nil {
+		log.Error("preflight audit failed", zap.Error(err))
+		return exitCodeOf(err), false
+	}
+	for _, s := range result.Schemas {
+		switch s.Verdict {
+		case verdictCaveats:
+			log.Warn("schema supported with caveats", zap.Int("schemaID", s.SchemaID), zap.String("source", s.Source),
+				zap.String("table", s.Table), zap.Any("caveats", s.Caveats))
+		case verdictUnsupported:
+			log.Error("schema not supported", zap.Int("schemaID", s.SchemaID), zap.String("source", s.Source),
+				zap.String("table", s.Table), zap.Any("unsupported", s.Unsupported))
+		}
+	}
+	log.Info("preflight audit finished", zap.Int("schemas", len(result.Schemas)),
+		zap.Int("supported", result.Supported), zap.Int("caveats", result.Caveats),
+		zap.Int("unsupported", result.Unsupported))
+	if result.Unsupported > 0 {
+		if !cfg.force {
+			log.Error("refuse to start the verification with the unsupported schemas, set --force to start anyway")
+			return exitCodeDecodeError, false
+		}
+		log.Warn("start the verification with the unsupported schemas since forced")
+	}
+	return exitCodeClean, true
+}
+
+// auditSource is a value schema to be audited, err is set if the schema cannot be loaded.
+type auditSource struct {
+	schemaID int
+	source   string
+	content  string
+	err      error
+}
+
+// auditSchemas audits the schemas in the schema dir if set, otherwise all the versions of the value subject of the topic
+// in the schema registry, the schemas of the tables filtered are omitted.
+func auditSchemas(cfg *config) (*auditResult, error) {
+	var (
+		sources []auditSource
+		err     error
+	)
+	if cfg.schemaDir != "" {
+		sources, err = localAuditSources(cfg.schemaDir)
+	} else {
+		sources, err = registryAuditSources(cfg.schemaRegistryURL, cfg.topic+valueSubjectSuffix)
+	}
+	if err != nil {
+		return nil, err
+	}
+	filter, err := newTableFilter(cfg.includeTables, cfg.excludeTables)
+	if err != nil {
+		return nil, err
+	}
+
+	result := &auditResult{Schemas: make([]schemaAudit, 0, len(sources))}
+	for _, source := range sources {
+		audit := auditSchema(source, cfg)
+		if filter.filtered(audit.Table) {
+			continue
+		}
+		switch audit.Verdict {
+		case verdictSupported:
+			result.Supported++
+		case verdictCaveats:
+			result.Caveats++
+		case verdictUnsupported:
+			result.Unsupported++
+		}
+		result.Schemas = append(result.Schemas, audit)
+	}
+	sort.Slice(result.Schemas, func(i, j int) bool { return result.Schemas[i].SchemaID < result.Schemas[j].SchemaID })
+	return result, nil
+}
+
+// auditSchema runs each column of the value schema through the mysql type mapping and the checksum calculation
+// capabilities, without any data. The column of the unknown TiDB type is a caveat if it's skipped by the policy,
+// and the column whose avro type contradicts its tidb_type is unsupported unless the schema check is skipped.
+func auditSchema(source auditSource, cfg *config) schemaAudit {
+	audit := schemaAudit{SchemaID: source.schemaID, Source: source.source}
+	schema := make(map[string]interface{})
+	err := source.err
+	if err == nil {
+		err = json.Unmarshal([]byte(source.content), &schema)
+	}
+	if err != nil {
+		audit.Verdict, audit.Unsupported = verdictUnsupported, []auditIssue{{Reason: err.Error()}}
+		return audit
+	}
+	audit.Table = avroTableName(schema)
+	fields, err := parseSchemaFields(schema)
+	if err != nil {
+		audit.Verdict, audit.Unsupported = verdictUnsupported, []auditIssue{{Reason: err.Error()}}
+		return audit
+	}
+
+	rawFields := make(map[string]map[string]interface{})
+	items, _ := schema["fields"].([]interface{})
+	for _, item := range items {
+		if field, ok := item.(map[string]interface{}); ok {
+			name, _ := field["name"].(string)
+			rawFields[name] = field
+		}
+	}
+	switch {
+	case avroLegacyFormat(schema):
+		audit.Caveats = append(audit.Caveats, auditIssue{
+			Reason: "the TiDB extension fields are not carried, such as by the older TiCDC, the messages are skipped",
+		})
+	case rawFields["_tidb_row_level_checksum"] == nil:
+		audit.Caveats = append(audit.Caveats, auditIssue{
+			Reason: "the checksum is not enabled, the messages are skipped",
+		})
+	}
+	for _, f := range fields {
+		if _, known := lookupMySQLType(f.TiDBType); f.TiDBType != "" && !known && cfg.onUnknownType != unknownTypeFail {
+			audit.Caveats = append(audit.Caveats, auditIssue{
+				Column: f.Name, Reason: f.Unsupported + ", skipped by the " + cfg.onUnknownType + " policy",
+			})
+			continue
+		}
+		if !cfg.skipSchemaCheck {
+			if err := checkAvroType(rawFields[f.Name]); err != nil {
+				audit.Unsupported = append(audit.Unsupported, auditIssue{Column: f.Name, Reason: err.Error()})
+				continue
+			}
+		}
+		if f.Unsupported != "" {
+			audit.Unsupported = append(audit.Unsupported, auditIssue{Column: f.Name, Reason: f.Unsupported})
+			continue
+		}
+		if !checksum.Supported(f.MySQLTypeCode) {
+			audit.Unsupported = append(audit.Unsupported, auditIssue{
+				Column: f.Name, Reason: "mysql type " + f.MySQLType + " not handled by the checksum calculation",
+			})
+			continue
+		}
+		parameters := avroParameters(rawFields[f.Name])
+		switch {
+		case f.MySQLTypeCode == mysql.TypeNull || f.MySQLTypeCode == mysql.TypeGeometry:
+			audit.Caveats = append(audit.Caveats, auditIssue{
+				Column: f.Name, Reason: "skipped by the checksum calculation",
+			})
+		case f.LogicalType != "" && parameters["fsp"] == nil:
+			audit.Caveats = append(audit.Caveats, auditIssue{
+				Column: f.Name, Reason: fmt.Sprintf("fsp not found in the connect.parameters, "+
+					"the fractional seconds are padded to the precision of %s, which may differ from the column", f.LogicalType),
+			})
+		case f.MySQLTypeCode == mysql.TypeEnum || f.MySQLTypeCode == mysql.TypeSet:
+			if allowed, _ := parameters["allowed"].(string); strings.Contains(allowed, `\,`) {
+				audit.Caveats = append(audit.Caveats, auditIssue{
+					Column: f.Name, Reason: "allowed values contain an escaped comma, " +
+						"an element ending with a backslash cannot be told from it",
+				})
+			}
+		}
+	}
+
+	switch {
+	case len(audit.Unsupported) > 0:
+		audit.Verdict = verdictUnsupported
+	case len(audit.Caveats) > 0:
+		audit.Verdict = verdictCaveats
+	default:
+		audit.Verdict = verdictSupported
+	}
+	return audit
+}
+
+// localAuditSources reads the schema files named `<schema ID>.avsc` in the schema dir.
+func localAuditSources(dir string) ([]auditSource, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, newInfraError(err)
+	}
+	var sources []auditSource
+	for _, entry := range entries {
+		name := entry.Name()
+		schemaID, err := strconv.Atoi(strings.TrimSuffix(name, localSchemaSuffix))
+		if entry.IsDir() || !strings.HasSuffix(name, localSchemaSuffix) || err != nil {
+			continue
+		}
+		// the schema which cannot be parsed is audited as unsupported.
+		source := auditSource{schemaID: schemaID, source: name}
+		if codec, err := loadLocalSchema(dir, schemaID); err != nil {
+			source.err = err
+		} else {
+			source.content = codec.Schema()
+		}
+		sources = append(sources, source)
+	}
+	return sources, nil
+}
+
+// registryAuditSources fetches all the versions of the subject from the schema registry.
+func registryAuditSources(registryURL, subject string) ([]auditSource, error) {
+	versions, err := getSubjectVersions(registryURL, subject)
+	if err != nil {
+		return nil, newInfraError(err)
+	}
+	sources := make([]auditSource, 0, len(versions))
+	for _, version := range versions {
+		schemaID, schema, err := getSchemaBySubject(registryURL, subject, strconv.Itoa(version))
+		if err != nil {
+			return nil, newInfraError(err)
+		}
+		sources = append(sources, auditSource{
+			schemaID: schemaID, source: subject + "@" + strconv.Itoa(version), content: schema,
+		})
+	}
+	return sources, nil
+}
+
+// getSubjectVersions returns the versions of the subject registered in the schema registry.
+func getSubjectVersions(registryURL, subject string) ([]int, error) {
+	resp, err := http.Get(registryURL + "/subjects/" + url.PathEscape(subject) + "/versions")
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to query the versions of the subject %s, status: %d, response: %s",
+			subject, resp.StatusCode, body)
+	}
+	var versions []int
+	if err := json.Unmarshal(body, &versions); err != nil {
+		return nil, err
+	}
+	return versions, nil
+}
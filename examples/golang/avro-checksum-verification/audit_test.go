@@ -0,0 +1,140 @@
+// Copyright 2023 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// testAuditSchemas are the versions of the subject `test-value`, registered as the schema ID 10 + version.
+var testAuditSchemas = map[int]string{
+	1: testValueSchema,
+	2: `{"type": "record", "name": "v", "namespace": "default.test", "fields": [
+    {"name": "id", "type": {"type": "long", "connect.parameters": {"tidb_type": "BIGINT"}}},
+    {"name": "embedding", "type": {"type": "string", "connect.parameters": {"tidb_type": "VECTOR"}}},
+    {"name": "_tidb_op", "type": "string"},
+    {"name": "_tidb_row_level_checksum", "type": "string"}]}`,
+	3: `{"type": "record", "name": "c", "namespace": "default.test", "fields": [
+    {"name": "ts", "type": {"type": "long", "logicalType": "timestamp-millis", "connect.parameters": {"tidb_type": "TIMESTAMP"}}},
+    {"name": "e", "type": {"type": "string", "connect.parameters": {"tidb_type": "ENUM", "allowed": "a\\,b,c"}}},
+    {"name": "_tidb_op", "type": "string"}]}`,
+}
+
+func newTestAuditRegistry(t *testing.T) *httptest.Server {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path := strings.TrimPrefix(r.URL.Path, "/subjects/test-value/versions")
+		if path == "" {
+			_ = json.NewEncoder(w).Encode([]int{1, 2, 3})
+			return
+		}
+		version, err := strconv.Atoi(strings.TrimPrefix(path, "/"))
+		if err != nil || testAuditSchemas[version] == "" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		_ = json.NewEncoder(w).Encode(lookupResponse{SchemaID: 10 + version, Schema: testAuditSchemas[version]})
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestAuditRegistry(t *testing.T) {
+	t.Parallel()
+
+	registry := newTestAuditRegistry(t)
+	var out bytes.Buffer
+	code := runAudit([]string{"--schema-registry-url", registry.URL, "--topic", "test"}, &out)
+	require.Equal(t, exitCodeDecodeError, code)
+
+	var result auditResult
+	require.NoError(t, json.Unmarshal(out.Bytes(), &result))
+	require.Equal(t, auditResult{
+		Schemas: []schemaAudit{
+			{SchemaID: 11, Source: "test-value@1", Table: "test.t", Verdict: verdictSupported},
+			{SchemaID: 12, Source: "test-value@2", Table: "test.v", Verdict: verdictUnsupported,
+				Unsupported: []auditIssue{{Column: "embedding", Reason: "unknown TiDB type VECTOR"}}},
+			{SchemaID: 13, Source: "test-value@3", Table: "test.c", Verdict: verdictCaveats, Caveats: []auditIssue{
+				{Reason: "the checksum is not enabled, the messages are skipped"},
+				{Column: "ts", Reason: "fsp not found in the connect.parameters, " +
+					"the fractional seconds are padded to the precision of timestamp-millis, which may differ from the column"},
+				{Column: "e", Reason: "allowed values contain an escaped comma, " +
+					"an element ending with a backslash cannot be told from it"},
+			}},
+		},
+		Supported: 1, Caveats: 1, Unsupported: 1,
+	}, result)
+
+	// the schemas of the tables filtered are omitted.
+	out.Reset()
+	code = runAudit([]string{
+		"--schema-registry-url", registry.URL, "--topic", "test", "--exclude-tables", "test.v",
+	}, &out)
+	require.Equal(t, exitCodeClean, code)
+
+	// the subject not found.
+	out.Reset()
+	code = runAudit([]string{"--schema-registry-url", registry.URL, "--topic", "other"}, &out)
+	require.Equal(t, exitCodeInfraError, code)
+	require.Empty(t, out.String())
+}
+
+func TestAuditSchemaDir(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "1.avsc"), []byte(testValueSchema), 0o644))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "2.avsc"), []byte(`{"type": "record"`), 0o644))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "README"), []byte("not a schema"), 0o644))
+	cfg := newDefaultConfig()
+	cfg.schemaDir = dir
+	result, err := auditSchemas(cfg)
+	require.NoError(t, err)
+	require.Len(t, result.Schemas, 2)
+	require.Equal(t, schemaAudit{SchemaID: 1, Source: "1.avsc", Table: "test.t", Verdict: verdictSupported},
+		result.Schemas[0])
+	require.Equal(t, verdictUnsupported, result.Schemas[1].Verdict)
+	require.Contains(t, result.Schemas[1].Unsupported[0].Reason, "parse the schema file")
+}
+
+func TestPreflight(t *testing.T) {
+	t.Parallel()
+
+	registry := newTestAuditRegistry(t)
+	cfg := newDefaultConfig()
+	cfg.schemaRegistryURL, cfg.topic, cfg.preflight = registry.URL, "test", true
+	require.NoError(t, cfg.validate())
+	code, ok := preflight(cfg)
+	require.False(t, ok)
+	require.Equal(t, exitCodeDecodeError, code)
+
+	cfg.force = true
+	code, ok = preflight(cfg)
+	require.True(t, ok)
+	require.Equal(t, exitCodeClean, code)
+
+	cfg.preflight = false
+	require.ErrorContains(t, cfg.validate(), "force is only for the preflight audit")
+	cfg.preflight, cfg.force, cfg.protocol = true, false, protocolCanalJSON
+	require.ErrorContains(t, cfg.validate(), "only the avro protocol is supported by the preflight audit")
+}
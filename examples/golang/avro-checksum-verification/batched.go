@@ -0,0 +1,120 @@
+// Copyright 2023 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	"github.com/pingcap/log"
+	"github.com/segmentio/kafka-go"
+	"go.uber.org/zap"
+)
+
+// verifyBatched verifies the records following the first one, since the events are batched into the message.
+// The message is verified only if all records pass, it stops at the first record failed.
+func (a *avroVerifier) verifyBatched(
+	message kafka.Message, value, rest []byte, keyChecked bool, first messageResult, opErr error,
+) (messageResult, error) {
+	result := first
+	result.events = 1
+	schemaID, _, _ := extractSchemaIDAndBinaryData(value)
+	// the framing is decided once for the message, since the record not framed may start with the magic byte,
+	// such as the NULL of the first column.
+	framed := a.framed(rest)
+	for len(rest) > 0 {
+		record, err := a.nextRecord(framed, schemaID, rest)
+		if err != nil {
+			return result, fmt.Errorf("record %d of the batched message: %w", result.events+1, err)
+		}
+		schemaID, _, _ = extractSchemaIDAndBinaryData(record)
+		next, remaining, err := a.verifyRecord(message, record, keyChecked)
+		result.merge(next)
+		if errors.Is(err, errOpInconsistent) {
+			if opErr == nil {
+				opErr = err
+			}
+		} else if err != nil {
+			// the failure is reported by the record failed.
+			result.checksum, result.mismatch, result.bisect = next.checksum, next.mismatch, next.bisect
+			log.Error("record of the batched message failed", zap.String("topic", message.Topic),
+				zap.Int("partition", message.Partition), zap.Int64("offset", message.Offset),
+				zap.Int("record", result.events), zap.Error(err))
+			return result, err
+		}
+		rest = remaining
+	}
+	log.Debug("batched message verified", zap.String("topic", message.Topic),
+		zap.Int("partition", message.Partition), zap.Int64("offset", message.Offset), zap.Int("records", result.events))
+	return result, opErr
+}
+
+// framed returns whether the record carries its own wire format header,
+// which starts with the magic byte and a schema ID already seen.
+func (a *avroVerifier) framed(record []byte) bool {
+	if len(record) < 5 || record[0] != magicByte {
+		return false
+	}
+	_, ok := a.tables.get(int(binary.BigEndian.Uint32(record[1:5])))
+	return ok
+}
+
+// nextRecord returns the next record of the batched value, framed by the wire format header.
+// If the first record following the first one is framed, so must be all of them,
+// otherwise each record follows the previous one directly, and shares its schema.
+func (a *avroVerifier) nextRecord(framed bool, schemaID int, rest []byte) ([]byte, error) {
+	if framed {
+		if !a.framed(rest) {
+			return nil, errors.New("record is not framed by the wire format header, while the first following record is")
+		}
+		return rest, nil
+	}
+	record := binary.BigEndian.AppendUint32([]byte{magicByte}, uint32(schemaID))
+	return append(record, rest...), nil
+}
+
+// merge merges the result of a record batched in the same message, the first record's row is kept to be exported,
+// and the failure is described by the failed record, see verifyBatched.
+func (r *messageResult) merge(other messageResult) {
+	r.add(other.outcome, other.commitTs)
+	for op, n := range other.ops {
+		if r.ops == nil {
+			r.ops = make(map[rowOp]int)
+		}
+		r.ops[op] += n
+	}
+	r.rows = append(r.rows, other.rows...)
+	r.columnErrors = append(r.columnErrors, other.columnErrors...)
+	if r.table == "" {
+		r.table = other.table
+	}
+	if r.schemaDrift == nil {
+		r.schemaDrift = other.schemaDrift
+	}
+	if r.decoded == nil {
+		r.decoded = other.decoded
+	}
+}
+
+// rowEvents returns the number of the row events in the message, more than one if batched.
+func (r *messageResult) rowEvents() int {
+	if r.outcome == outcomeSkippedNonRow {
+		return 0
+	}
+	if r.events > 1 {
+		return r.events
+	}
+	return 1
+}
@@ -0,0 +1,159 @@
+// Copyright 2023 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"strconv"
+	"testing"
+
+	"avro-checksum-sample/checksum"
+	"github.com/segmentio/kafka-go"
+	"github.com/stretchr/testify/require"
+)
+
+// batchTestMessages concatenates the values of the messages into one message,
+// the wire format header of the following ones is stripped if not framed.
+func batchTestMessages(offset int64, framed bool, messages ...kafka.Message) kafka.Message {
+	value := append([]byte{}, messages[0].Value...)
+	for _, m := range messages[1:] {
+		if framed {
+			value = append(value, m.Value...)
+		} else {
+			value = append(value, m.Value[5:]...)
+		}
+	}
+	return kafka.Message{Topic: "test", Offset: offset, Value: value}
+}
+
+func TestAvroBatchedMessage(t *testing.T) {
+	t.Parallel()
+
+	registry := newTestRegistry(t, map[int]string{testSchemaID: testValueSchema})
+	cfg := newDefaultConfig()
+	cfg.schemaRegistryURL = registry.URL
+	reader := &fakeReader{messages: []kafka.Message{
+		newVerifiedTestMessage(t, 0, 1, "a"),
+		batchTestMessages(1, false, newVerifiedTestMessage(t, 1, 2, "b"), newVerifiedTestMessage(t, 2, 3, "c")),
+		batchTestMessages(2, true, newVerifiedTestMessage(t, 2, 4, "d"),
+			newVerifiedTestMessage(t, 3, 5, "e"), newVerifiedTestMessage(t, 4, 6, "f")),
+	}}
+	v := newTestVerifier(cfg, reader)
+	err := v.run(context.Background())
+	require.Equal(t, exitCodeClean, v.finish(err))
+	require.Equal(t, counters{Messages: 3, Verified: 3}, v.counters)
+	require.Equal(t, uint64(6), v.report.Rows)
+	require.Equal(t, uint64(2), v.report.BatchedMessages)
+	require.Equal(t, map[rowOp]uint64{opInsert: 6}, v.report.Operations)
+	require.Equal(t, []int64{0, 1, 2}, reader.committedOffsets())
+}
+
+func TestAvroBatchedMessageFailed(t *testing.T) {
+	t.Parallel()
+
+	registry := newTestRegistry(t, map[int]string{testSchemaID: testValueSchema})
+	cfg := newDefaultConfig()
+	cfg.schemaRegistryURL = registry.URL
+	cfg.failFast = true
+	// only the second row of the message mismatches.
+	mismatch := newMismatchTestMessage(t, 1, 2, "b")
+	reader := &fakeReader{messages: []kafka.Message{
+		batchTestMessages(0, false, newVerifiedTestMessage(t, 0, 1, "a"), mismatch, newVerifiedTestMessage(t, 2, 3, "c")),
+	}}
+	v := newTestVerifier(cfg, reader)
+	err := v.run(context.Background())
+	require.Equal(t, exitCodeMismatch, v.finish(err))
+	require.Equal(t, counters{Messages: 1, Mismatches: 1}, v.counters)
+	require.Len(t, v.report.Failures, 1)
+	require.Equal(t, uint64(400000000000000001), v.report.Failures[0].CommitTs)
+	require.Empty(t, reader.committedOffsets())
+
+	// the trailing bytes which are not a record are not ignored.
+	garbage := newVerifiedTestMessage(t, 0, 1, "a")
+	garbage.Value = append(garbage.Value, 0xff)
+	reader = &fakeReader{messages: []kafka.Message{garbage}}
+	v = newTestVerifier(cfg, reader)
+	err = v.run(context.Background())
+	require.Equal(t, exitCodeDecodeError, v.finish(err))
+	require.Empty(t, reader.committedOffsets())
+}
+
+// testNullFirstSchema is the value schema of the table `test`.`t` whose first column is the nullable `name`.
+const testNullFirstSchema = `{
+  "type": "record",
+  "name": "t",
+  "namespace": "default.test",
+  "fields": [
+    {"name": "name", "type": ["null", {"type": "string", "connect.parameters": {"tidb_type": "TEXT"}}], "default": null},
+    {"name": "id", "type": {"type": "long", "connect.parameters": {"tidb_type": "BIGINT"}}},
+    {"name": "_tidb_op", "type": "string", "default": ""},
+    {"name": "_tidb_commit_ts", "type": "long", "default": 0},
+    {"name": "_tidb_commit_physical_time", "type": "long", "default": 0},
+    {"name": "_tidb_row_level_checksum", "type": "string", "default": ""},
+    {"name": "_tidb_corrupted", "type": "boolean", "default": false},
+    {"name": "_tidb_checksum_version", "type": "int", "default": 0}
+  ]
+}`
+
+// newNullFirstTestRecord returns the framed record of the table `test`.`t` whose first column is the nullable `name`.
+func newNullFirstTestRecord(t *testing.T, schemaID int, id int64, name *string) []byte {
+	row := newTestRow(id, name, 400000000000000000+id, "")
+	var valueSchema map[string]interface{}
+	require.NoError(t, json.Unmarshal([]byte(testNullFirstSchema), &valueSchema))
+	metas, values, err := checksumColumns(row, valueSchema)
+	require.NoError(t, err)
+	sum, err := checksum.Calculate(metas, values)
+	require.NoError(t, err)
+	row["_tidb_row_level_checksum"] = strconv.FormatUint(uint64(sum), 10)
+	return encodeTestMessage(t, schemaID, testNullFirstSchema, row)
+}
+
+func TestAvroBatchedNullFirstColumn(t *testing.T) {
+	t.Parallel()
+
+	// the record not framed starts with the magic byte by the NULL of the first column, and in the worst case,
+	// the bytes following it are the schema ID already seen.
+	null := newNullFirstTestRecord(t, 0, 3, nil)[5:]
+	require.Equal(t, magicByte, null[0])
+	schemaID := int(binary.BigEndian.Uint32(null[1:5]))
+	null = newNullFirstTestRecord(t, schemaID, 3, nil)[5:]
+
+	registry := newTestRegistry(t, map[int]string{schemaID: testNullFirstSchema})
+	cfg := newDefaultConfig()
+	cfg.schemaRegistryURL = registry.URL
+	a, b, c := "a", "b", "c"
+	value := newNullFirstTestRecord(t, schemaID, 1, &a)
+	value = append(value, newNullFirstTestRecord(t, schemaID, 2, &b)[5:]...)
+	value = append(value, null...)
+	reader := &fakeReader{messages: []kafka.Message{{Topic: "test", Offset: 0, Value: value}}}
+	v := newTestVerifier(cfg, reader)
+	err := v.run(context.Background())
+	require.Equal(t, exitCodeClean, v.finish(err))
+	require.Equal(t, counters{Messages: 1, Verified: 1}, v.counters)
+	require.Equal(t, uint64(3), v.report.Rows)
+
+	// the framing is decided by the first record following the first one, the record breaking it fails the message.
+	value = newNullFirstTestRecord(t, schemaID, 1, &a)
+	value = append(value, newNullFirstTestRecord(t, schemaID, 2, &b)...)
+	value = append(value, newNullFirstTestRecord(t, schemaID, 3, &c)[5:]...)
+	reader = &fakeReader{messages: []kafka.Message{{Topic: "test", Offset: 0, Value: value}}}
+	v = newTestVerifier(cfg, reader)
+	err = v.run(context.Background())
+	require.Equal(t, exitCodeDecodeError, v.finish(err))
+	require.ErrorContains(t, err, "record 3 of the batched message: record is not framed by the wire format header, "+
+		"while the first following record is")
+	require.Empty(t, reader.committedOffsets())
+}
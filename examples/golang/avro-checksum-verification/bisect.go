@@ -0,0 +1,242 @@
+// Copyright 2023 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"math/big"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"avro-checksum-sample/checksum"
+	"github.com/pingcap/tidb/pkg/parser/mysql"
+)
+
+// bisectHypothesis is a single systematic cause of the mismatch, such as the wrong time zone of the TIMESTAMP.
+type bisectHypothesis struct {
+	name string
+	// apply returns the value of the column under the hypothesis, false if the column is not changed by it.
+	apply func(meta *checksum.FieldMeta, value interface{}) (interface{}, bool)
+}
+
+// bisectResult is the hypothesis making the mismatched checksum match.
+type bisectResult struct {
+	// Hypothesis is the single change making the checksum match, empty if none does.
+	Hypothesis string `json:"hypothesis,omitempty"`
+	// Columns are the columns changed by the hypothesis.
+	Columns []string `json:"columns,omitempty"`
+	// Tried are the hypotheses which change any column of the row, in the order they are tried.
+	Tried []string `json:"tried"`
+}
+
+// bisector recomputes the checksum of the mismatched row under each hypothesis, only on the mismatch.
+type bisector struct {
+	hypotheses []bisectHypothesis
+}
+
+// newBisector returns the bisector trying the time zones, separated by the comma, and the other fixed hypotheses.
+func newBisector(timeZones string) (*bisector, error) {
+	b := &bisector{}
+	for _, name := range strings.Split(timeZones, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		loc, err := time.LoadLocation(name)
+		if err != nil {
+			return nil, err
+		}
+		b.hypotheses = append(b.hypotheses, bisectHypothesis{
+			name: "timezone=" + name,
+			apply: func(meta *checksum.FieldMeta, value interface{}) (interface{}, bool) {
+				if meta.MySQLType != mysql.TypeTimestamp {
+					return nil, false
+				}
+				meta.Location = loc
+				return value, true
+			},
+		})
+	}
+	b.hypotheses = append(b.hypotheses,
+		bisectHypothesis{name: "decimal=trimmed", apply: trimmedDecimal},
+		bisectHypothesis{name: "charset=raw", apply: rawCharset},
+		bisectHypothesis{name: "charset=transcoded", apply: transcodedCharset},
+		bisectHypothesis{name: "ints=unsigned", apply: unsignedInt},
+		bisectHypothesis{name: "ints=signed", apply: signedInt},
+	)
+	return b, nil
+}
+
+// bisect returns the first hypothesis making the checksum of the row equal to the expected one,
+// the checksum is calculated by the checksum version carried by the event.
+func (b *bisector) bisect(version int, metas []checksum.FieldMeta, values []interface{}, expected uint64) *bisectResult {
+	result := &bisectResult{Tried: []string{}}
+	for _, h := range b.hypotheses {
+		changedMetas := make([]checksum.FieldMeta, len(metas))
+		changedValues := make([]interface{}, len(values))
+		var columns []string
+		for i := range metas {
+			changedMetas[i], changedValues[i] = metas[i], values[i]
+			if values[i] == nil {
+				continue
+			}
+			if value, ok := h.apply(&changedMetas[i], values[i]); ok {
+				changedValues[i] = value
+				columns = append(columns, metas[i].Name)
+			}
+		}
+		if len(columns) == 0 {
+			continue
+		}
+		result.Tried = append(result.Tried, h.name)
+		actual, err := checksum.CalculateVersion(version, changedMetas, changedValues)
+		if err == nil && actual == expected {
+			result.Hypothesis, result.Columns = h.name, columns
+			return result
+		}
+	}
+	return result
+}
+
+// trimmedDecimal formats the decimal without the trailing zeros of the scale,
+// as if the changefeed and TiDB format it differently.
+func trimmedDecimal(meta *checksum.FieldMeta, value interface{}) (interface{}, bool) {
+	if meta.MySQLType != mysql.TypeNewDecimal {
+		return nil, false
+	}
+	var s string
+	switch v := value.(type) {
+	case string:
+		s = v
+	case *big.Rat:
+		s = v.FloatString(meta.Scale)
+	default:
+		return nil, false
+	}
+	if !strings.Contains(s, ".") {
+		return nil, false
+	}
+	trimmed := strings.TrimRight(strings.TrimRight(s, "0"), ".")
+	if trimmed == s {
+		return nil, false
+	}
+	meta.Handling = checksum.HandlingString
+	return trimmed, true
+}
+
+func isStringType(mysqlType byte) bool {
+	switch mysqlType {
+	case mysql.TypeVarchar, mysql.TypeVarString, mysql.TypeString,
+		mysql.TypeTinyBlob, mysql.TypeMediumBlob, mysql.TypeLongBlob, mysql.TypeBlob:
+		return true
+	}
+	return false
+}
+
+// rawCharset converts the UTF-8 string back to the latin1 bytes,
+// as if the upstream stores the raw bytes, but the changefeed transcodes them to UTF-8.
+func rawCharset(meta *checksum.FieldMeta, value interface{}) (interface{}, bool) {
+	s, ok := value.(string)
+	if !ok || !isStringType(meta.MySQLType) {
+		return nil, false
+	}
+	raw := make([]byte, 0, len(s))
+	for _, r := range s {
+		if r >= 256 {
+			return nil, false
+		}
+		raw = append(raw, byte(r))
+	}
+	if len(raw) == len(s) {
+		// all characters are ASCII, the same in both charsets.
+		return nil, false
+	}
+	return raw, true
+}
+
+// transcodedCharset converts the latin1 bytes to the UTF-8 string,
+// as if the upstream stores the UTF-8 string, but the changefeed sends the raw bytes.
+func transcodedCharset(meta *checksum.FieldMeta, value interface{}) (interface{}, bool) {
+	if !isStringType(meta.MySQLType) {
+		return nil, false
+	}
+	var raw []byte
+	switch v := value.(type) {
+	case string:
+		raw = []byte(v)
+	case []byte:
+		raw = v
+	default:
+		return nil, false
+	}
+	transcoded := make([]byte, 0, len(raw)*2)
+	for _, c := range raw {
+		transcoded = utf8.AppendRune(transcoded, rune(c))
+	}
+	if len(transcoded) == len(raw) {
+		return nil, false
+	}
+	return string(transcoded), true
+}
+
+// integerBits returns the bits of the integral type narrower than 64 bits, 0 for the others.
+func integerBits(mysqlType byte) int {
+	switch mysqlType {
+	case mysql.TypeTiny:
+		return 8
+	case mysql.TypeShort:
+		return 16
+	case mysql.TypeInt24:
+		return 24
+	case mysql.TypeLong:
+		return 32
+	}
+	return 0
+}
+
+func integerValue(value interface{}) (int64, bool) {
+	switch v := value.(type) {
+	case int32:
+		return int64(v), true
+	case int64:
+		return v, true
+	case uint32:
+		return int64(v), true
+	case uint64:
+		return int64(v), true
+	}
+	return 0, false
+}
+
+// unsignedInt reinterprets the negative integer as the unsigned one of the same width,
+// as if the column is unsigned in the upstream.
+func unsignedInt(meta *checksum.FieldMeta, value interface{}) (interface{}, bool) {
+	bits := integerBits(meta.MySQLType)
+	v, ok := integerValue(value)
+	if bits == 0 || !ok || v >= 0 {
+		return nil, false
+	}
+	return uint64(v) & (1<<bits - 1), true
+}
+
+// signedInt reinterprets the integer beyond the signed range as the signed one of the same width,
+// as if the column is signed in the upstream.
+func signedInt(meta *checksum.FieldMeta, value interface{}) (interface{}, bool) {
+	bits := integerBits(meta.MySQLType)
+	v, ok := integerValue(value)
+	if bits == 0 || !ok || v < 1<<(bits-1) || v >= 1<<bits {
+		return nil, false
+	}
+	return v - 1<<bits, true
+}
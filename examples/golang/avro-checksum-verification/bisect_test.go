@@ -0,0 +1,114 @@
+// Copyright 2023 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"math/big"
+	"strconv"
+	"testing"
+	"time"
+
+	"avro-checksum-sample/checksum"
+	"github.com/pingcap/tidb/pkg/parser/mysql"
+	"github.com/segmentio/kafka-go"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBisect(t *testing.T) {
+	t.Parallel()
+
+	b, err := newBisector("UTC, Asia/Shanghai")
+	require.NoError(t, err)
+	_, err = newBisector("Mars/Olympus")
+	require.Error(t, err)
+
+	shanghai, err := time.LoadLocation("Asia/Shanghai")
+	require.NoError(t, err)
+	metas := []checksum.FieldMeta{
+		{Name: "i", MySQLType: mysql.TypeLong},
+		{Name: "ts", MySQLType: mysql.TypeTimestamp},
+		{Name: "d", MySQLType: mysql.TypeNewDecimal, Handling: checksum.HandlingPrecise, Scale: 2},
+		{Name: "s", MySQLType: mysql.TypeVarchar},
+	}
+	values := []interface{}{int64(-1), "2023-12-01 10:00:00", big.NewRat(3, 2), "é"}
+	cases := []struct {
+		hypothesis string
+		column     int
+		meta       checksum.FieldMeta
+		value      interface{}
+	}{
+		{hypothesis: "timezone=Asia/Shanghai", column: 1,
+			meta: checksum.FieldMeta{MySQLType: mysql.TypeTimestamp, Location: shanghai}, value: values[1]},
+		{hypothesis: "decimal=trimmed", column: 2, meta: checksum.FieldMeta{MySQLType: mysql.TypeNewDecimal}, value: "1.5"},
+		{hypothesis: "charset=raw", column: 3, meta: metas[3], value: []byte{0xe9}},
+		{hypothesis: "charset=transcoded", column: 3, meta: metas[3], value: "Ã©"},
+		{hypothesis: "ints=unsigned", column: 0, meta: metas[0], value: uint64(4294967295)},
+	}
+	for _, c := range cases {
+		// the expected checksum is calculated with only the column of the hypothesis changed.
+		expectedMetas := append([]checksum.FieldMeta{}, metas...)
+		expectedValues := append([]interface{}{}, values...)
+		expectedMetas[c.column], expectedValues[c.column] = c.meta, c.value
+		expected, err := checksum.Calculate(expectedMetas, expectedValues)
+		require.NoError(t, err)
+
+		result := b.bisect(0, metas, values, uint64(expected))
+		require.Equal(t, c.hypothesis, result.Hypothesis)
+		require.Equal(t, []string{metas[c.column].Name}, result.Columns)
+		require.Contains(t, result.Tried, c.hypothesis)
+	}
+
+	// the signed hypothesis only applies to the value beyond the signed range.
+	values[0] = int64(4294967295)
+	expectedValues := append([]interface{}{}, values...)
+	expectedValues[0] = int64(-1)
+	expected, err := checksum.Calculate(metas, expectedValues)
+	require.NoError(t, err)
+	require.Equal(t, "ints=signed", b.bisect(0, metas, values, uint64(expected)).Hypothesis)
+
+	// no single change makes the checksum match.
+	result := b.bisect(0, metas, values, 0)
+	require.Empty(t, result.Hypothesis)
+	require.Empty(t, result.Columns)
+	require.Equal(t, []string{"timezone=UTC", "timezone=Asia/Shanghai", "decimal=trimmed",
+		"charset=raw", "charset=transcoded", "ints=signed"}, result.Tried)
+}
+
+func TestAvroBisectReported(t *testing.T) {
+	t.Parallel()
+
+	registry := newTestRegistry(t, map[int]string{testSchemaID: testValueSchema})
+	cfg := newDefaultConfig()
+	cfg.schemaRegistryURL = registry.URL
+	cfg.bisect = true
+	require.NoError(t, cfg.validate())
+	// the upstream stores the latin1 byte of `é`, but the changefeed sends the UTF-8 string.
+	raw, name := string([]byte{0xe9}), "é"
+	checksum := strconv.FormatUint(uint64(testRowChecksum(1, &raw)), 10)
+	value := encodeTestMessage(t, testSchemaID, testValueSchema, newTestRow(1, &name, 100, checksum))
+	reader := &fakeReader{messages: []kafka.Message{{Topic: "test", Value: value}, newVerifiedTestMessage(t, 1, 2, "b")}}
+	v := newTestVerifier(cfg, reader)
+	err := v.run(context.Background())
+	require.Equal(t, exitCodeMismatch, v.finish(err))
+	require.Len(t, v.report.Failures, 1)
+	require.Equal(t, &bisectResult{
+		Hypothesis: "charset=raw", Columns: []string{"name"}, Tried: []string{"charset=raw"},
+	}, v.report.Failures[0].Bisect)
+
+	cfg.protocol = protocolCanalJSON
+	require.ErrorContains(t, cfg.validate(), "only the avro protocol is supported by the bisection")
+	cfg.protocol, cfg.bisectTimeZones = protocolAvro, "UTC,Nowhere"
+	require.Error(t, cfg.validate())
+}
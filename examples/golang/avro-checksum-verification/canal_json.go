@@ -0,0 +1,398 @@
+// Copyright 2023 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"avro-checksum-sample/checksum"
+	"github.com/pingcap/log"
+	"github.com/pingcap/tidb/pkg/parser/mysql"
+	parsertypes "github.com/pingcap/tidb/pkg/parser/types"
+	"github.com/segmentio/kafka-go"
+	"go.uber.org/zap"
+	"golang.org/x/text/encoding/charmap"
+)
+
+const (
+	canalJSONTypeInsert    = "INSERT"
+	canalJSONTypeUpdate    = "UPDATE"
+	canalJSONTypeDelete    = "DELETE"
+	canalJSONTypeWatermark = "TIDB_WATERMARK"
+)
+
+// canalJSONMessage is the canal-json message with the TiDB extension,
+// only fields used by the verification are decoded.
+type canalJSONMessage struct {
+	Schema    string `json:"database"`
+	Table     string `json:"table"`
+	IsDDL     bool   `json:"isDdl"`
+	EventType string `json:"type"`
+	Query     string `json:"sql"`
+	// PKNames are the handle key columns.
+	PKNames []string `json:"pkNames"`
+	// only works for INSERT / UPDATE / DELETE events, records each column's mysql representation type.
+	MySQLType map[string]string `json:"mysqlType"`
+	// Data and Old keep the column order of the message, which is the order of the checksum calculation.
+	Data []canalJSONRow `json:"data"`
+	Old  []canalJSONRow `json:"old"`
+
+	Extensions *canalJSONExtension `json:"_tidb"`
+}
+
+type canalJSONExtension struct {
+	CommitTs      uint64 `json:"commitTs,omitempty"`
+	WatermarkTs   uint64 `json:"watermarkTs,omitempty"`
+	OnlyHandleKey bool   `json:"onlyHandleKey,omitempty"`
+	// Checksum is not written by the canal-json encoder of TiCDC, so it's nil for the messages produced by TiCDC,
+	// it's only verified if carried by the message, such as by the messages relayed with the checksum attached.
+	// Current is the checksum of the `data`, Previous is the checksum of the `old` for update events,
+	// and the checksum of the `data` for delete events, since the deleted row is in the `data`.
+	Checksum *rowChecksum `json:"_checksum,omitempty"`
+}
+
+// canalJSONRow is a row in the `data` or `old` field, column names are kept in the order of the message.
+type canalJSONRow struct {
+	names  []string
+	values map[string]interface{}
+}
+
+func (r *canalJSONRow) UnmarshalJSON(data []byte) error {
+	r.values = make(map[string]interface{})
+	return decodeOrderedObject(data, func(name string, raw json.RawMessage) error {
+		var value interface{}
+		if err := json.Unmarshal(raw, &value); err != nil {
+			return err
+		}
+		r.names = append(r.names, name)
+		r.values[name] = value
+		return nil
+	})
+}
+
+// canalJSONChecksumNote is reported for the canal-json protocol, so that the skipped rows are not over-trusted.
+const canalJSONChecksumNote = "the canal-json encoder of TiCDC does not write the `_checksum` of the `_tidb` extension, " +
+	"its rows are only validated structurally and counted as skippedNoChecksum, " +
+	"only the rows carrying the checksum are verified"
+
+// canalJSONVerifier verifies the message encoded by the canal-json protocol with the TiDB extension,
+// the column types are extracted from the message itself, no schema registry involved.
+type canalJSONVerifier struct {
+	// collectRows collects the verified rows into the result, to cross-check them against the database.
+	collectRows bool
+	filter      *tableFilter
+	window      *commitTsWindow
+	// columns asserts the columns carried by the row, nil if not set.
+	columns expectedColumns
+	ops     opFilter
+}
+
+func (c *canalJSONVerifier) setTableFilter(filter *tableFilter) { c.filter = filter }
+
+// verify verifies all canal-json messages in the kafka message value,
+// a value may contain multiple messages if they are batched.
+func (c *canalJSONVerifier) verify(message kafka.Message) (messageResult, error) {
+	decoder := json.NewDecoder(bytes.NewReader(message.Value))
+
+	var result messageResult
+	for {
+		var m canalJSONMessage
+		err := decoder.Decode(&m)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return result, err
+		}
+
+		if result.table == "" && m.Schema != "" {
+			result.table = m.Schema + "." + m.Table
+		}
+		if err := c.verifyAndCollect(&m, &result); err != nil {
+			return result, err
+		}
+	}
+	if result.events == 0 {
+		return result, errors.New("empty canal-json message")
+	}
+	return result, nil
+}
+
+// verifyAndCollect verifies the canal-json message, and merges the result into the message result.
+func (c *canalJSONVerifier) verifyAndCollect(m *canalJSONMessage, result *messageResult) error {
+	var commitTs uint64
+	if m.Extensions != nil {
+		commitTs = m.Extensions.CommitTs
+	}
+	if c.filter.filtered(m.Schema + "." + m.Table) {
+		result.add(outcomeFiltered, commitTs)
+		return nil
+	}
+	op := canalJSONOp(m.EventType)
+	result.addOp(op)
+	if c.ops.filtered(op) {
+		result.add(outcomeFiltered, commitTs)
+		return nil
+	}
+	if !m.IsDDL && m.EventType != canalJSONTypeWatermark {
+		if outside, err := c.window.outside(result, commitTs); err != nil || outside {
+			return err
+		}
+	}
+	o, err := c.verifyMessage(m)
+	if err != nil {
+		if c.collectRows && errors.Is(err, errChecksumMismatch) {
+			result.mismatch = c.mismatchedRow(m, commitTs)
+		}
+		return err
+	}
+	result.add(o, commitTs)
+	if m.EventType == canalJSONTypeWatermark && m.Extensions != nil {
+		result.resolve(m.Extensions.WatermarkTs)
+	}
+	if !c.collectRows || o != outcomeVerified {
+		return nil
+	}
+
+	// the deleted row is in the `data`, and the update event is cross-checked by the new value.
+	row, err := c.newRowEvent(m, m.Data[0], commitTs)
+	if err != nil {
+		return err
+	}
+	row.deleted = m.EventType == canalJSONTypeDelete
+	if row.deleted {
+		row.expected, row.readTs = m.Extensions.Checksum.Previous, commitTs-1
+	}
+	result.rows = append(result.rows, row)
+	return nil
+}
+
+// mismatchedRow returns the row whose checksum mismatches, nil if it cannot be decoded.
+func (c *canalJSONVerifier) mismatchedRow(m *canalJSONMessage, commitTs uint64) *rowEvent {
+	expected := m.Extensions.Checksum
+	image, expectedChecksum, readTs := m.Data[0], expected.Current, commitTs
+	switch m.EventType {
+	case canalJSONTypeUpdate:
+		// the new value matches, so the old value mismatches.
+		if fields, values, err := c.rowColumns(m, image); err == nil {
+			if actual, err := checksum.CalculateVersion(expected.Version, fields, values); err == nil && actual == expected.Current {
+				image, expectedChecksum, readTs = previousCanalJSONRow(m), expected.Previous, commitTs-1
+			}
+		}
+	case canalJSONTypeDelete:
+		expectedChecksum, readTs = expected.Previous, commitTs-1
+	}
+	row, err := c.newRowEvent(m, image, commitTs)
+	if err != nil {
+		return nil
+	}
+	row.expected, row.readTs = expectedChecksum, readTs
+	return row
+}
+
+// newRowEvent returns the row event of the new value, the image is the row in the message.
+func (c *canalJSONVerifier) newRowEvent(m *canalJSONMessage, image canalJSONRow, commitTs uint64) (*rowEvent, error) {
+	row := &rowEvent{schema: m.Schema, table: m.Table, commitTs: commitTs, readTs: commitTs}
+	if m.Extensions != nil && m.Extensions.Checksum != nil {
+		row.expected, row.checksumVersion = m.Extensions.Checksum.Current, m.Extensions.Checksum.Version
+	}
+	handles := make(map[string]struct{}, len(m.PKNames))
+	for _, name := range m.PKNames {
+		handles[name] = struct{}{}
+	}
+	fields, values, err := c.rowColumns(m, image)
+	if err != nil {
+		return nil, err
+	}
+	for i, field := range fields {
+		_, handle := handles[field.Name]
+		row.columns = append(row.columns, rowColumn{
+			name: field.Name, mysqlType: field.MySQLType, handle: handle, value: values[i],
+		})
+	}
+	return row, nil
+}
+
+func (c *canalJSONVerifier) verifyMessage(m *canalJSONMessage) (outcome, error) {
+	if m.IsDDL {
+		log.Info("DDL message received, skip", zap.String("DDL", m.Query))
+		return outcomeSkippedNonRow, nil
+	}
+	if m.EventType == canalJSONTypeWatermark {
+		return outcomeSkippedNonRow, nil
+	}
+	if m.Extensions == nil || m.Extensions.Checksum == nil {
+		if err := c.validateRows(m); err != nil {
+			return 0, err
+		}
+		return outcomeSkippedNoChecksum, nil
+	}
+	if m.Extensions.OnlyHandleKey {
+		// the checksum is calculated by all columns, cannot be verified by the handle key columns.
+		return outcomeSkippedHandleKeyOnly, nil
+	}
+	if len(m.Data) != 1 {
+		return 0, fmt.Errorf("canal-json message carries %d rows, the checksum cannot be attributed", len(m.Data))
+	}
+	if err := c.columns.check(m.Schema+"."+m.Table, m.Data[0].names); err != nil {
+		return 0, err
+	}
+
+	expected := m.Extensions.Checksum
+	switch m.EventType {
+	case canalJSONTypeInsert:
+		return outcomeVerified, c.verifyRow(m, m.Data[0], expected.Current)
+	case canalJSONTypeUpdate:
+		if err := c.verifyRow(m, m.Data[0], expected.Current); err != nil {
+			return 0, err
+		}
+		if len(m.Old) == 0 {
+			return outcomeVerified, nil
+		}
+		return outcomeVerified, c.verifyRow(m, previousCanalJSONRow(m), expected.Previous)
+	case canalJSONTypeDelete:
+		return outcomeVerified, c.verifyRow(m, m.Data[0], expected.Previous)
+	}
+	return 0, errors.New("unknown canal-json event type: " + m.EventType)
+}
+
+// validateRows checks that each column value of the `data` and `old` is decodable by its mysql type,
+// so that the rows without the checksum are still validated structurally.
+func (c *canalJSONVerifier) validateRows(m *canalJSONMessage) error {
+	for _, rows := range [][]canalJSONRow{m.Data, m.Old} {
+		for _, row := range rows {
+			if _, _, err := c.rowColumns(m, row); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// checksumNote states that the canal-json messages of TiCDC are not verified by the checksum.
+func (c *canalJSONVerifier) checksumNote() string { return canalJSONChecksumNote }
+
+// previousCanalJSONRow returns the old value of the update event,
+// `old` may only contain the updated columns, the others are the same as `data`.
+func previousCanalJSONRow(m *canalJSONMessage) canalJSONRow {
+	previous := canalJSONRow{names: m.Data[0].names, values: make(map[string]interface{}, len(m.Data[0].names))}
+	if len(m.Old) == 0 {
+		return canalJSONRow{names: m.Data[0].names, values: m.Data[0].values}
+	}
+	for _, name := range m.Data[0].names {
+		value, ok := m.Old[0].values[name]
+		if !ok {
+			value = m.Data[0].values[name]
+		}
+		previous.values[name] = value
+	}
+	return previous
+}
+
+func (c *canalJSONVerifier) verifyRow(m *canalJSONMessage, row canalJSONRow, expected uint64) error {
+	fields, values, err := c.rowColumns(m, row)
+	if err != nil {
+		return err
+	}
+	actual, err := checksum.CalculateVersion(m.Extensions.Checksum.Version, fields, values)
+	if err != nil {
+		return err
+	}
+	if actual != expected {
+		log.Error("checksum mismatch",
+			zap.String("schema", m.Schema), zap.String("table", m.Table),
+			zap.Uint64("expected", expected), zap.Uint64("actual", actual))
+		return errChecksumMismatch
+	}
+	log.Info("checksum verified", zap.Uint64("checksum", actual))
+	return nil
+}
+
+// rowColumns returns the column types and values of the row, in the order of the checksum calculation.
+func (c *canalJSONVerifier) rowColumns(
+	m *canalJSONMessage, row canalJSONRow,
+) ([]checksum.FieldMeta, []interface{}, error) {
+	fields := make([]checksum.FieldMeta, 0, len(row.names))
+	values := make([]interface{}, 0, len(row.names))
+	for _, name := range row.names {
+		mysqlTypeStr, ok := m.MySQLType[name]
+		if !ok {
+			return nil, nil, errors.New("mysql type not found for the column " + name)
+		}
+		mysqlType := mysqlTypeFromCanalJSON(mysqlTypeStr)
+		value, err := canalJSONColumnValue(row.values[name], mysqlTypeStr, mysqlType)
+		if err != nil {
+			return nil, nil, fmt.Errorf("invalid value of the column %s: %w", name, err)
+		}
+		fields = append(fields, checksum.FieldMeta{Name: name, MySQLType: mysqlType})
+		values = append(values, value)
+	}
+	return fields, values, nil
+}
+
+// mysqlTypeFromCanalJSON converts the mysql type in the message, such as `int(11) unsigned`, to the type code.
+func mysqlTypeFromCanalJSON(mysqlType string) byte {
+	mysqlType = strings.ToLower(mysqlType)
+	for i := 0; i < len(mysqlType); i++ {
+		if mysqlType[i] == '(' || mysqlType[i] == ' ' {
+			return parsertypes.StrToType(mysqlType[:i])
+		}
+	}
+	return parsertypes.StrToType(mysqlType)
+}
+
+// canalJSONColumnValue converts the value in the message, which is always a string or nil,
+// to the value accepted by the checksum calculation.
+// by follow the canal-json decoder of TiCDC.
+func canalJSONColumnValue(value interface{}, mysqlTypeStr string, mysqlType byte) (interface{}, error) {
+	if value == nil {
+		return nil, nil
+	}
+	data, ok := value.(string)
+	if !ok {
+		return nil, errors.New("canal-json encoded value should be a string")
+	}
+
+	// when encoding the binary column, the ISO8859_1 decoder is used, now reverse it back.
+	lowerType := strings.ToLower(mysqlTypeStr)
+	if strings.Contains(lowerType, "blob") || strings.Contains(lowerType, "binary") {
+		return charmap.ISO8859_1.NewEncoder().Bytes([]byte(data))
+	}
+
+	switch mysqlType {
+	case mysql.TypeTiny, mysql.TypeShort, mysql.TypeLong, mysql.TypeInt24, mysql.TypeLonglong, mysql.TypeYear:
+		if v, err := strconv.ParseInt(data, 10, 64); err == nil {
+			return v, nil
+		}
+		return strconv.ParseUint(data, 10, 64)
+	// enum and set are encoded as the ordinal number, bit is encoded as the number.
+	case mysql.TypeEnum, mysql.TypeSet, mysql.TypeBit:
+		return strconv.ParseUint(data, 10, 64)
+	case mysql.TypeFloat:
+		v, err := strconv.ParseFloat(data, 32)
+		if err != nil {
+			return nil, err
+		}
+		return float32(v), nil
+	case mysql.TypeDouble:
+		return strconv.ParseFloat(data, 64)
+	}
+	return data, nil
+}
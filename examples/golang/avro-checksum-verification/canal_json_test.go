@@ -0,0 +1,178 @@
+// Copyright 2023 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"testing"
+
+	"github.com/segmentio/kafka-go"
+	"github.com/stretchr/testify/require"
+)
+
+// testCanalJSONChecksum calculates the checksum of the row in the table `test`.`c` (id INT, name VARCHAR(32), data BLOB),
+// it follows the TiDB rowcodec directly, instead of the code under test.
+func testCanalJSONChecksum(id int64, name string, data []byte) uint64 {
+	buf := binary.LittleEndian.AppendUint64(nil, uint64(id))
+	buf = binary.LittleEndian.AppendUint32(buf, uint32(len(name)))
+	buf = append(buf, name...)
+	buf = binary.LittleEndian.AppendUint32(buf, uint32(len(data)))
+	buf = append(buf, data...)
+	return uint64(crc32.ChecksumIEEE(buf))
+}
+
+func newTestCanalJSONMessage(eventType string, data, old string, extension string) string {
+	return fmt.Sprintf(`{"id":0,"database":"test","table":"c","pkNames":["id"],"isDdl":false,"type":"%s",`+
+		`"es":1,"ts":1,"sql":"","sqlType":{"id":4,"name":12,"data":2004},`+
+		`"mysqlType":{"data":"blob","name":"varchar(32)","id":"int"},`+
+		`"data":%s,"old":%s,"_tidb":%s}`, eventType, data, old, extension)
+}
+
+func TestCanalJSONVerify(t *testing.T) {
+	t.Parallel()
+
+	// the blob value is encoded by the ISO8859_1 decoder, 0xe9 is `é`.
+	current := testCanalJSONChecksum(1, "b", []byte{0xe9, 0x01})
+	previous := testCanalJSONChecksum(1, "a", []byte{0xe9, 0x01})
+
+	cases := []struct {
+		name    string
+		value   string
+		outcome outcome
+		err     error
+	}{
+		{
+			name: "insert",
+			value: newTestCanalJSONMessage("INSERT", `[{"id":"1","name":"b","data":"é\u0001"}]`, `null`,
+				fmt.Sprintf(`{"commitTs":100,"_checksum":{"version":0,"current":%d}}`, current)),
+			outcome: outcomeVerified,
+		},
+		{
+			name: "update with the partial old value",
+			value: newTestCanalJSONMessage("UPDATE", `[{"id":"1","name":"b","data":"é\u0001"}]`, `[{"name":"a"}]`,
+				fmt.Sprintf(`{"commitTs":100,"_checksum":{"current":%d,"previous":%d}}`, current, previous)),
+			outcome: outcomeVerified,
+		},
+		{
+			name: "update with the wrong previous checksum",
+			value: newTestCanalJSONMessage("UPDATE", `[{"id":"1","name":"b","data":"é\u0001"}]`, `[{"name":"a"}]`,
+				fmt.Sprintf(`{"commitTs":100,"_checksum":{"current":%d,"previous":%d}}`, current, current)),
+			err: errChecksumMismatch,
+		},
+		{
+			name: "delete verified by the previous checksum",
+			value: newTestCanalJSONMessage("DELETE", `[{"id":"1","name":"a","data":"é\u0001"}]`, `null`,
+				fmt.Sprintf(`{"commitTs":100,"_checksum":{"current":0,"previous":%d}}`, previous)),
+			outcome: outcomeVerified,
+		},
+		{
+			name: "the column order of the data is kept",
+			value: newTestCanalJSONMessage("INSERT", `[{"name":"b","id":"1","data":"é\u0001"}]`, `null`,
+				fmt.Sprintf(`{"commitTs":100,"_checksum":{"current":%d}}`, current)),
+			err: errChecksumMismatch,
+		},
+		{
+			name:    "checksum not enabled",
+			value:   newTestCanalJSONMessage("INSERT", `[{"id":"1","name":"b","data":null}]`, `null`, `{"commitTs":100}`),
+			outcome: outcomeSkippedNoChecksum,
+		},
+		{
+			name: "only handle key",
+			value: newTestCanalJSONMessage("INSERT", `[{"id":"1"}]`, `null`,
+				fmt.Sprintf(`{"commitTs":100,"onlyHandleKey":true,"_checksum":{"current":%d}}`, current)),
+			outcome: outcomeSkippedHandleKeyOnly,
+		},
+		{
+			name:    "DDL",
+			value:   `{"database":"test","table":"c","isDdl":true,"type":"CREATE","sql":"create table c(id int primary key)","_tidb":{"commitTs":100}}`,
+			outcome: outcomeSkippedNonRow,
+		},
+		{
+			name:    "watermark",
+			value:   `{"isDdl":false,"type":"TIDB_WATERMARK","_tidb":{"watermarkTs":100}}`,
+			outcome: outcomeSkippedNonRow,
+		},
+		{
+			name: "batched messages",
+			value: `{"isDdl":false,"type":"TIDB_WATERMARK","_tidb":{"watermarkTs":90}}` + "\n" +
+				newTestCanalJSONMessage("INSERT", `[{"id":"1","name":"b","data":"é\u0001"}]`, `null`,
+					fmt.Sprintf(`{"commitTs":100,"_checksum":{"current":%d}}`, current)) + "\n" +
+				newTestCanalJSONMessage("DELETE", `[{"id":"1","name":"a","data":"é\u0001"}]`, `null`,
+					fmt.Sprintf(`{"commitTs":100,"_checksum":{"previous":%d}}`, previous)),
+			outcome: outcomeVerified,
+		},
+		{
+			name: "mismatch in the batched messages",
+			value: newTestCanalJSONMessage("INSERT", `[{"id":"1","name":"b","data":"é\u0001"}]`, `null`,
+				fmt.Sprintf(`{"commitTs":100,"_checksum":{"current":%d}}`, current)) +
+				newTestCanalJSONMessage("INSERT", `[{"id":"1","name":"c","data":"é\u0001"}]`, `null`,
+					fmt.Sprintf(`{"commitTs":100,"_checksum":{"current":%d}}`, current)),
+			err: errChecksumMismatch,
+		},
+	}
+
+	v := &canalJSONVerifier{}
+	for _, c := range cases {
+		result, err := v.verify(kafka.Message{Value: []byte(c.value)})
+		if c.err != nil {
+			require.ErrorIs(t, err, c.err, c.name)
+			continue
+		}
+		require.NoError(t, err, c.name)
+		require.Equal(t, c.outcome, result.outcome, c.name)
+	}
+
+	// multiple rows cannot share one checksum.
+	_, err := v.verify(kafka.Message{Value: []byte(newTestCanalJSONMessage("INSERT",
+		`[{"id":"1","name":"b","data":null},{"id":"2","name":"b","data":null}]`, `null`,
+		fmt.Sprintf(`{"commitTs":100,"_checksum":{"current":%d}}`, current)))})
+	require.Error(t, err)
+	require.Equal(t, exitCodeDecodeError, exitCodeOf(newDecodeError(err)))
+
+	// the rows without the checksum are still validated structurally, including the old values.
+	_, err = v.verify(kafka.Message{Value: []byte(newTestCanalJSONMessage("INSERT",
+		`[{"id":"a","name":"b","data":null}]`, `null`, `{"commitTs":100}`))})
+	require.ErrorContains(t, err, "invalid value of the column id")
+	_, err = v.verify(kafka.Message{Value: []byte(newTestCanalJSONMessage("UPDATE",
+		`[{"id":"1","name":"b","data":null}]`, `[{"id":"a"}]`, `{"commitTs":100}`))})
+	require.ErrorContains(t, err, "invalid value of the column id")
+}
+
+func TestCanalJSONVerifierShareThePolicy(t *testing.T) {
+	t.Parallel()
+
+	current := testCanalJSONChecksum(1, "b", nil)
+	verified := newTestCanalJSONMessage("INSERT", `[{"id":"1","name":"b","data":""}]`, `null`,
+		fmt.Sprintf(`{"commitTs":100,"_checksum":{"current":%d}}`, current))
+	mismatch := newTestCanalJSONMessage("INSERT", `[{"id":"1","name":"c","data":""}]`, `null`,
+		fmt.Sprintf(`{"commitTs":101,"_checksum":{"current":%d}}`, current))
+
+	cfg := newDefaultConfig()
+	cfg.protocol = protocolCanalJSON
+	cfg.mismatchBudget = 1
+	reader := &fakeReader{messages: []kafka.Message{
+		{Offset: 0, Value: []byte(verified)},
+		{Offset: 1, Value: []byte(mismatch)},
+		{Offset: 2, Value: []byte(verified)},
+	}}
+	v := newTestVerifier(cfg, reader)
+	err := v.run(context.Background())
+	require.Equal(t, exitCodeMismatch, v.finish(err))
+	require.Equal(t, []int64{0, 1, 2}, reader.committedOffsets())
+	require.Equal(t, counters{Messages: 3, Verified: 2, Mismatches: 1}, v.counters)
+	require.Equal(t, canalJSONChecksumNote, v.report.ChecksumNote)
+}
@@ -0,0 +1,202 @@
+// Copyright 2023 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const checkpointFileVersion = 1
+
+// errCorruptCheckpoint is returned if the checkpoint file cannot be trusted,
+// such as partially written or modified by hand.
+var errCorruptCheckpoint = errors.New("checkpoint file is corrupted")
+
+// checkpoint is the verification progress persisted to the checkpoint file.
+type checkpoint struct {
+	Topic string `json:"topic"`
+	// Partitions records the last fully verified position of each partition.
+	Partitions map[int]partitionCheckpoint `json:"partitions"`
+	Counters   counters                    `json:"counters"`
+	UpdatedAt  time.Time                   `json:"updatedAt"`
+}
+
+type partitionCheckpoint struct {
+	Offset   int64  `json:"offset"`
+	CommitTs uint64 `json:"commitTs"`
+	// ResolvedTs is the latest resolved ts of the partition, the ordering is checked against it after resume.
+	ResolvedTs uint64 `json:"resolvedTs,omitempty"`
+}
+
+// checkpointFile is the layout of the checkpoint file,
+// Checksum is the crc32 of the Data, used to detect the corrupted file.
+type checkpointFile struct {
+	Version  int             `json:"version"`
+	Checksum uint32          `json:"checksum"`
+	Data     json.RawMessage `json:"data"`
+}
+
+func newCheckpoint(topic string) *checkpoint {
+	return &checkpoint{
+		Topic:      topic,
+		Partitions: make(map[int]partitionCheckpoint),
+	}
+}
+
+// startOffsets returns the offset to resume consuming from of each partition.
+func (c *checkpoint) startOffsets() map[int]int64 {
+	result := make(map[int]int64, len(c.Partitions))
+	for partition, p := range c.Partitions {
+		result[partition] = p.Offset + 1
+	}
+	return result
+}
+
+// loadCheckpoint reads the checkpoint from the file, returns nil if the file does not exist.
+func loadCheckpoint(path string) (*checkpoint, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	var file checkpointFile
+	if err := json.Unmarshal(content, &file); err != nil {
+		return nil, fmt.Errorf("%w: %s", errCorruptCheckpoint, err)
+	}
+	if file.Version != checkpointFileVersion {
+		return nil, fmt.Errorf("unsupported checkpoint file version %d", file.Version)
+	}
+	if crc32.ChecksumIEEE(file.Data) != file.Checksum {
+		return nil, fmt.Errorf("%w: checksum mismatch", errCorruptCheckpoint)
+	}
+
+	var result checkpoint
+	if err := json.Unmarshal(file.Data, &result); err != nil {
+		return nil, fmt.Errorf("%w: %s", errCorruptCheckpoint, err)
+	}
+	if result.Partitions == nil {
+		result.Partitions = make(map[int]partitionCheckpoint)
+	}
+	return &result, nil
+}
+
+// saveCheckpoint writes the checkpoint to the file atomically,
+// the file is either the previous one or the new one, never partially written.
+func saveCheckpoint(path string, c *checkpoint) error {
+	data, err := json.Marshal(c)
+	if err != nil {
+		return err
+	}
+	content, err := json.Marshal(checkpointFile{
+		Version:  checkpointFileVersion,
+		Checksum: crc32.ChecksumIEEE(data),
+		Data:     data,
+	})
+	if err != nil {
+		return err
+	}
+
+	dir, name := filepath.Split(path)
+	if dir == "" {
+		dir = "."
+	}
+	tmp, err := os.CreateTemp(dir, name+".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(content); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return err
+	}
+
+	// sync the directory to make the rename durable.
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+// checkpointer keeps the latest verified position in memory, and persists it periodically.
+type checkpointer struct {
+	path     string
+	interval time.Duration
+
+	state     *checkpoint
+	lastSaved time.Time
+}
+
+func newCheckpointer(path string, interval time.Duration, state *checkpoint) *checkpointer {
+	return &checkpointer{
+		path:      path,
+		interval:  interval,
+		state:     state,
+		lastSaved: time.Now(),
+	}
+}
+
+// advance records the message at the given position is fully verified,
+// it must only be called after the verification of the message completed.
+// commitTs is 0 if the message does not carry it, such as the delete event, keep the previous one,
+// so as the resolvedTs if the message is not a watermark.
+func (c *checkpointer) advance(partition int, offset int64, commitTs, resolvedTs uint64, counters counters) {
+	previous := c.state.Partitions[partition]
+	if commitTs == 0 {
+		commitTs = previous.CommitTs
+	}
+	if resolvedTs < previous.ResolvedTs {
+		resolvedTs = previous.ResolvedTs
+	}
+	c.state.Partitions[partition] = partitionCheckpoint{Offset: offset, CommitTs: commitTs, ResolvedTs: resolvedTs}
+	c.state.Counters = counters
+}
+
+// maybeFlush persists the checkpoint if the interval elapsed since the last time.
+func (c *checkpointer) maybeFlush(now time.Time) error {
+	if now.Sub(c.lastSaved) < c.interval {
+		return nil
+	}
+	return c.flush(now)
+}
+
+func (c *checkpointer) flush(now time.Time) error {
+	c.state.UpdatedAt = now
+	if err := saveCheckpoint(c.path, c.state); err != nil {
+		return err
+	}
+	c.lastSaved = now
+	return nil
+}
@@ -0,0 +1,93 @@
+// Copyright 2023 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCheckpointSaveAndLoad(t *testing.T) {
+	t.Parallel()
+
+	path := filepath.Join(t.TempDir(), "checkpoint.json")
+
+	result, err := loadCheckpoint(path)
+	require.NoError(t, err)
+	require.Nil(t, result)
+
+	c := newCheckpointer(path, time.Hour, newCheckpoint("test"))
+	c.advance(0, 10, 100, 0, counters{Messages: 11, Verified: 10, SkippedDelete: 1})
+	c.advance(1, 4, 0, 80, counters{Messages: 16, Verified: 15, SkippedDelete: 1})
+	c.advance(1, 5, 90, 0, counters{Messages: 17, Verified: 16, SkippedDelete: 1})
+	// delete event does not carry the commit ts, the previous one is kept.
+	c.advance(1, 6, 0, 0, counters{Messages: 18, Verified: 16, SkippedDelete: 2})
+
+	// the interval is not elapsed yet.
+	require.NoError(t, c.maybeFlush(time.Now()))
+	_, err = os.Stat(path)
+	require.True(t, os.IsNotExist(err))
+
+	require.NoError(t, c.maybeFlush(time.Now().Add(2*time.Hour)))
+	result, err = loadCheckpoint(path)
+	require.NoError(t, err)
+	require.Equal(t, "test", result.Topic)
+	require.Equal(t, partitionCheckpoint{Offset: 10, CommitTs: 100}, result.Partitions[0])
+	require.Equal(t, partitionCheckpoint{Offset: 6, CommitTs: 90, ResolvedTs: 80}, result.Partitions[1])
+	require.Equal(t, counters{Messages: 18, Verified: 16, SkippedDelete: 2}, result.Counters)
+	require.Equal(t, map[int]int64{0: 11, 1: 7}, result.startOffsets())
+
+	// no temporary file left.
+	entries, err := os.ReadDir(filepath.Dir(path))
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+}
+
+func TestLoadCorruptCheckpoint(t *testing.T) {
+	t.Parallel()
+
+	path := filepath.Join(t.TempDir(), "checkpoint.json")
+	c := newCheckpoint("test")
+	c.Partitions[0] = partitionCheckpoint{Offset: 10, CommitTs: 100}
+	require.NoError(t, saveCheckpoint(path, c))
+
+	content, err := os.ReadFile(path)
+	require.NoError(t, err)
+
+	// partially written file.
+	require.NoError(t, os.WriteFile(path, content[:len(content)/2], 0o644))
+	_, err = loadCheckpoint(path)
+	require.ErrorIs(t, err, errCorruptCheckpoint)
+
+	// the data is modified but the checksum is not.
+	modified := []byte(string(content))
+	for i := len(modified) - 1; i >= 0; i-- {
+		if modified[i] == '1' {
+			modified[i] = '2'
+			break
+		}
+	}
+	require.NoError(t, os.WriteFile(path, modified, 0o644))
+	_, err = loadCheckpoint(path)
+	require.ErrorIs(t, err, errCorruptCheckpoint)
+
+	require.NoError(t, os.WriteFile(path, content, 0o644))
+	result, err := loadCheckpoint(path)
+	require.NoError(t, err)
+	require.Equal(t, partitionCheckpoint{Offset: 10, CommitTs: 100}, result.Partitions[0])
+}
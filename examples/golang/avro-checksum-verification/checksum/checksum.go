@@ -0,0 +1,501 @@
+// Copyright 2023 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package checksum calculates the row level checksum in the same way as TiDB,
+// the column values decoded from any protocol are converted to bytes and accumulated by the RowChecksum,
+// which is registered for the checksum version, crc32 for the version 0.
+package checksum
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"math"
+	"math/big"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/pingcap/log"
+	"github.com/pingcap/tidb/pkg/parser/mysql"
+	"go.uber.org/zap"
+)
+
+// FieldMeta is the type information of a column involved in the checksum calculation.
+type FieldMeta struct {
+	// Name is the column name.
+	Name string
+	// MySQLType is used to convert the column value to bytes.
+	MySQLType byte
+	// Handling is how the value is encoded by the changefeed, empty is the same as HandlingString.
+	Handling HandlingMode
+	// Scale is the number of the fractional digits of the decimal, only used by HandlingPrecise.
+	Scale int
+	// Location is the time zone the TIMESTAMP value is in, nil is the local one.
+	Location *time.Location
+}
+
+// HandlingMode is the decimal-handling-mode or the bigint-unsigned-handling-mode of the changefeed.
+type HandlingMode string
+
+const (
+	// HandlingString encodes the decimal and the unsigned bigint as the string.
+	HandlingString HandlingMode = "string"
+	// HandlingPrecise encodes the decimal as the bytes of the decimal logical type, decoded as *big.Rat.
+	HandlingPrecise HandlingMode = "precise"
+	// HandlingLong encodes the unsigned bigint as the long, the value over the max int64 wraps to the negative one.
+	HandlingLong HandlingMode = "long"
+)
+
+// RowChecksum accumulates the bytes of each column into the row level checksum,
+// the bytes of a column are built by the mysql type, the same for all implementations.
+type RowChecksum interface {
+	// Reset starts the checksum of a new row.
+	Reset()
+	// UpdateColumn accumulates the bytes of the column, which are empty for NULL.
+	UpdateColumn(meta FieldMeta, encoded []byte)
+	// Sum returns the checksum of the columns accumulated since the last Reset.
+	Sum() uint64
+}
+
+// crc32Checksum is the crc32 IEEE of the bytes of all columns, the one calculated by TiDB.
+type crc32Checksum struct {
+	sum uint32
+}
+
+func (c *crc32Checksum) Reset() { c.sum = 0 }
+
+func (c *crc32Checksum) UpdateColumn(_ FieldMeta, encoded []byte) {
+	c.sum = crc32.Update(c.sum, crc32.IEEETable, encoded)
+}
+
+func (c *crc32Checksum) UpdateColumnChunk(_ FieldMeta, chunk []byte) {
+	c.sum = crc32.Update(c.sum, crc32.IEEETable, chunk)
+}
+
+func (c *crc32Checksum) Sum() uint64 { return uint64(c.sum) }
+
+// ChunkedRowChecksum is implemented by the RowChecksum which accumulates the bytes of a column in chunks,
+// so that the large string or bytes value is fed to it directly, rather than copied into the bytes of the column.
+type ChunkedRowChecksum interface {
+	RowChecksum
+	// UpdateColumnChunk accumulates the next chunk of the bytes of the column,
+	// the chunks of a column concatenated are the bytes UpdateColumn accumulates.
+	UpdateColumnChunk(meta FieldMeta, chunk []byte)
+}
+
+// chunkSize is the size of the chunks the large string or bytes value is accumulated by,
+// the value not larger than it is built into the bytes of the column as the others.
+const chunkSize = 64 << 10
+
+// ErrUnsupportedVersion is returned for the checksum version not registered, whose checksum cannot be calculated.
+var ErrUnsupportedVersion = errors.New("unsupported checksum version")
+
+var (
+	registryMu sync.RWMutex
+	// registry is the RowChecksum of each checksum version, the crc32 one is of the version 0,
+	// the only one TiDB calculates, such as rowcodec rejecting any other version of the row.
+	registry = map[int]func() RowChecksum{
+		0: func() RowChecksum { return &crc32Checksum{} },
+	}
+)
+
+// Register sets the RowChecksum of the checksum version carried by the event, it replaces the registered one.
+// It returns the function restoring the previous registration of the version, such as by t.Cleanup in the tests.
+func Register(version int, newChecksum func() RowChecksum) (restore func()) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	previous, ok := registry[version]
+	registry[version] = newChecksum
+	return func() {
+		registryMu.Lock()
+		defer registryMu.Unlock()
+		if ok {
+			registry[version] = previous
+		} else {
+			delete(registry, version)
+		}
+	}
+}
+
+// New returns the RowChecksum of the checksum version, it returns ErrUnsupportedVersion if it's not registered.
+func New(version int) (RowChecksum, error) {
+	registryMu.RLock()
+	newChecksum, ok := registry[version]
+	registryMu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("%w: %d", ErrUnsupportedVersion, version)
+	}
+	return newChecksum(), nil
+}
+
+// Calculate returns the crc32 checksum of the row, fields and values must be sorted by the column ID,
+// the same as the checksum calculation order.
+// Enum and set values must be converted to the ordinal number before calling it.
+func Calculate(fields []FieldMeta, values []interface{}) (uint32, error) {
+	sum, err := CalculateBy(&crc32Checksum{}, fields, values)
+	return uint32(sum), err
+}
+
+// CalculateVersion returns the checksum of the row by the RowChecksum of the checksum version.
+func CalculateVersion(version int, fields []FieldMeta, values []interface{}) (uint64, error) {
+	sum, err := New(version)
+	if err != nil {
+		return 0, err
+	}
+	return CalculateBy(sum, fields, values)
+}
+
+// CalculateBy returns the checksum of the row accumulated by the RowChecksum,
+// the same as Calculate except for the accumulation, the large string or bytes value is accumulated in chunks
+// if the RowChecksum is a ChunkedRowChecksum.
+func CalculateBy(sum RowChecksum, fields []FieldMeta, values []interface{}) (uint64, error) {
+	return calculateBy(sum, fields, values, chunkSize)
+}
+
+func calculateBy(sum RowChecksum, fields []FieldMeta, values []interface{}, size int) (uint64, error) {
+	if len(fields) != len(values) {
+		return 0, errors.New("the number of fields and values not match")
+	}
+
+	sum.Reset()
+	chunked, _ := sum.(ChunkedRowChecksum)
+	buf := make([]byte, 0)
+	for i, field := range fields {
+		if len(buf) > 0 {
+			buf = buf[:0]
+		}
+		if chunked != nil && isRawValue(field, values[i]) {
+			var ok bool
+			if buf, ok = updateChunks(chunked, field, values[i], buf, size); ok {
+				continue
+			}
+		}
+
+		// generate a byte slice, and use it to update the checksum.
+		var err error
+		buf, err = buildChecksumBytes(buf, values[i], field)
+		if err != nil {
+			return 0, err
+		}
+		sum.UpdateColumn(field, buf)
+	}
+	return sum.Sum(), nil
+}
+
+// Bytes returns the bytes of the row accumulated by the checksum calculation,
+// the crc32 of it is the same as the one returned by Calculate, it's used to locate the different column.
+func Bytes(fields []FieldMeta, values []interface{}) ([]byte, error) {
+	if len(fields) != len(values) {
+		return nil, errors.New("the number of fields and values not match")
+	}
+
+	buf := make([]byte, 0)
+	for i, field := range fields {
+		var err error
+		buf, err = buildChecksumBytes(buf, values[i], field)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return buf, nil
+}
+
+// Supported returns true if the mysql type is handled by the checksum calculation.
+func Supported(mysqlType byte) bool {
+	switch mysqlType {
+	case mysql.TypeTiny, mysql.TypeShort, mysql.TypeLong, mysql.TypeLonglong, mysql.TypeInt24, mysql.TypeYear,
+		mysql.TypeFloat, mysql.TypeDouble, mysql.TypeEnum, mysql.TypeSet, mysql.TypeBit,
+		mysql.TypeVarchar, mysql.TypeVarString, mysql.TypeString,
+		mysql.TypeTinyBlob, mysql.TypeMediumBlob, mysql.TypeLongBlob, mysql.TypeBlob,
+		mysql.TypeTimestamp, mysql.TypeDatetime, mysql.TypeDate, mysql.TypeDuration, mysql.TypeNewDate,
+		mysql.TypeNewDecimal, mysql.TypeJSON, mysql.TypeNull, mysql.TypeGeometry:
+		return true
+	}
+	return false
+}
+
+// buildChecksumBytes append value the buf, the type of the field is used to convert value interface to concrete type.
+// by follow: https://github.com/pingcap/tidb/blob/e3417913f58cdd5a136259b902bf177eaf3aa637/util/rowcodec/common.go#L308
+func buildChecksumBytes(buf []byte, value interface{}, field FieldMeta) ([]byte, error) {
+	if value == nil {
+		return buf, nil
+	}
+	mysqlType := field.MySQLType
+
+	switch mysqlType {
+	// TypeTiny, TypeShort, TypeInt32 is encoded as int32
+	// TypeLong is encoded as int32 if signed, else int64.
+	// TypeLongLong is encoded as int64 if signed, else uint64,
+	// if bigintUnsignedHandlingMode set as string, encode as string,
+	// if set as long, encode as int64, which has the same bits as the uint64.
+	case mysql.TypeTiny, mysql.TypeShort, mysql.TypeLong, mysql.TypeLonglong, mysql.TypeInt24, mysql.TypeYear:
+		switch a := value.(type) {
+		case int32:
+			buf = binary.LittleEndian.AppendUint64(buf, uint64(a))
+		case uint32:
+			buf = binary.LittleEndian.AppendUint64(buf, uint64(a))
+		case int64:
+			buf = binary.LittleEndian.AppendUint64(buf, uint64(a))
+		case uint64:
+			buf = binary.LittleEndian.AppendUint64(buf, a)
+		case string:
+			v, err := strconv.ParseUint(a, 10, 64)
+			if err != nil {
+				return nil, err
+			}
+			buf = binary.LittleEndian.AppendUint64(buf, v)
+		default:
+			return nil, unexpectedType("integral", field, value)
+		}
+	// TypeFloat encoded as float32, TypeDouble encoded as float64
+	case mysql.TypeFloat, mysql.TypeDouble:
+		var v float64
+		switch a := value.(type) {
+		case float32:
+			v = float64(a)
+		case float64:
+			v = a
+		default:
+			return nil, unexpectedType("float", field, value)
+		}
+		if math.IsInf(v, 0) || math.IsNaN(v) {
+			v = 0
+		}
+		buf = binary.LittleEndian.AppendUint64(buf, math.Float64bits(v))
+	// TypeEnum, TypeSet encoded as string
+	// but convert to int by the getColumnValue function
+	case mysql.TypeEnum, mysql.TypeSet:
+		v, ok := value.(uint64)
+		if !ok {
+			return nil, unexpectedType("enum or set", field, value)
+		}
+		buf = binary.LittleEndian.AppendUint64(buf, v)
+	// TypeBit encoded as bytes
+	case mysql.TypeBit:
+		switch a := value.(type) {
+		// bit is store as bytes, convert to uint64.
+		case []byte:
+			v, err := binaryLiteralToInt(a)
+			if err != nil {
+				return nil, err
+			}
+			buf = binary.LittleEndian.AppendUint64(buf, v)
+		// some protocols, such as canal-json, encode bit as the number.
+		case uint64:
+			buf = binary.LittleEndian.AppendUint64(buf, a)
+		default:
+			return nil, unexpectedType("bit", field, value)
+		}
+	// encoded as bytes if binary flag set to true, else string
+	case mysql.TypeVarchar, mysql.TypeVarString, mysql.TypeString, mysql.TypeTinyBlob, mysql.TypeMediumBlob, mysql.TypeLongBlob, mysql.TypeBlob:
+		switch a := value.(type) {
+		case string:
+			buf = appendLengthValue(buf, []byte(a))
+		case []byte:
+			buf = appendLengthValue(buf, a)
+		default:
+			return nil, unexpectedType("string", field, value)
+		}
+	// all encoded as string
+	case mysql.TypeTimestamp:
+		timestamp, ok := value.(string)
+		if !ok {
+			return nil, unexpectedType("timestamp", field, value)
+		}
+		loc := field.Location
+		if loc == nil {
+			var err error
+			if loc, err = time.LoadLocation("Local"); err != nil {
+				return nil, err
+			}
+		}
+		t, err := ParseTimestamp(timestamp, loc)
+		if err != nil {
+			return nil, err
+		}
+		timestamp = t.UTC().Format(timestampLayout)
+		buf = appendLengthValue(buf, []byte(timestamp))
+	case mysql.TypeDatetime, mysql.TypeDate, mysql.TypeDuration, mysql.TypeNewDate:
+		v, ok := value.(string)
+		if !ok {
+			return nil, unexpectedType("temporal", field, value)
+		}
+		buf = appendLengthValue(buf, []byte(v))
+	// encoded as string if decimalHandlingMode set to string, it's required to enable checksum.
+	// if set to precise, it's formatted by the scale of the column, the same as TiDB.
+	case mysql.TypeNewDecimal:
+		if field.Handling == HandlingPrecise {
+			v, ok := value.(*big.Rat)
+			if !ok {
+				return nil, fmt.Errorf("precise decimal value of %s should be *big.Rat, but got %T", field.Name, value)
+			}
+			buf = appendLengthValue(buf, []byte(v.FloatString(field.Scale)))
+			break
+		}
+		v, ok := value.(string)
+		if !ok {
+			return nil, unexpectedType("decimal", field, value)
+		}
+		buf = appendLengthValue(buf, []byte(v))
+	// encoded as string
+	case mysql.TypeJSON:
+		v, ok := value.(string)
+		if !ok {
+			return nil, unexpectedType("json", field, value)
+		}
+		buf = appendLengthValue(buf, []byte(v))
+	// this should not happen, does not take into the checksum calculation.
+	case mysql.TypeNull, mysql.TypeGeometry:
+		// do nothing
+	default:
+		return buf, errors.New("invalid type for the checksum calculation")
+	}
+	return buf, nil
+}
+
+// isRawValue returns true if the value is accumulated as is following its length, such as TEXT and BLOB,
+// the same as buildChecksumBytes appends it.
+func isRawValue(field FieldMeta, value interface{}) bool {
+	switch field.MySQLType {
+	case mysql.TypeVarchar, mysql.TypeVarString, mysql.TypeString, mysql.TypeTinyBlob, mysql.TypeMediumBlob, mysql.TypeLongBlob, mysql.TypeBlob:
+		switch value.(type) {
+		case string, []byte:
+			return true
+		}
+	case mysql.TypeDatetime, mysql.TypeDate, mysql.TypeDuration, mysql.TypeNewDate, mysql.TypeJSON:
+		_, ok := value.(string)
+		return ok
+	case mysql.TypeNewDecimal:
+		_, ok := value.(string)
+		return ok && field.Handling != HandlingPrecise
+	}
+	return false
+}
+
+// updateChunks accumulates the raw value larger than the size in chunks, the length first, then the value,
+// the bytes value is fed as is, and the string one is copied through the buf chunk by chunk,
+// so that the memory is bounded by the size no matter how large the value is.
+// It returns false if the value is not larger than the size, which is built into the bytes of the column instead.
+func updateChunks(sum ChunkedRowChecksum, field FieldMeta, value interface{}, buf []byte, size int) ([]byte, bool) {
+	switch v := value.(type) {
+	case []byte:
+		if len(v) <= size {
+			return buf, false
+		}
+		buf = binary.LittleEndian.AppendUint32(buf[:0], uint32(len(v)))
+		sum.UpdateColumnChunk(field, buf)
+		for len(v) > 0 {
+			n := min(size, len(v))
+			sum.UpdateColumnChunk(field, v[:n])
+			v = v[n:]
+		}
+	case string:
+		if len(v) <= size {
+			return buf, false
+		}
+		buf = binary.LittleEndian.AppendUint32(buf[:0], uint32(len(v)))
+		sum.UpdateColumnChunk(field, buf)
+		for len(v) > 0 {
+			n := min(size, len(v))
+			buf = append(buf[:0], v[:n]...)
+			sum.UpdateColumnChunk(field, buf)
+			v = v[n:]
+		}
+	default:
+		return buf, false
+	}
+	return buf, true
+}
+
+const (
+	timestampLayout = "2006-01-02 15:04:05"
+	// maxDSTShift is the farthest a nonexistent local time is moved to the zone transition, the same as TiDB.
+	maxDSTShift = 4 * time.Hour
+)
+
+// ParseTimestamp parses the wall clock of the TIMESTAMP value in loc, by the rule of `CoreTime.AdjustedGoTime` of TiDB,
+// see https://github.com/pingcap/tidb/issues/28739, so that the value in a DST transition is the same instant as TiDB:
+//   - the ambiguous time in the overlap, where the clock is set back, is resolved by `time.Date` as TiDB does,
+//     which is the earlier instant, such as `2024-11-03 01:30:00` is PDT in America/Los_Angeles.
+//   - the nonexistent time in the gap, where the clock is set forward, is moved to the closest transition,
+//     such as `2024-03-10 02:30:00` is `03:00:00` PDT in America/Los_Angeles, instead of `01:30:00` PST by `time.Date`.
+func ParseTimestamp(value string, loc *time.Location) (time.Time, error) {
+	wall, err := time.Parse(timestampLayout, value)
+	if err != nil {
+		return time.Time{}, err
+	}
+	t := time.Date(wall.Year(), wall.Month(), wall.Day(), wall.Hour(), wall.Minute(), wall.Second(), wall.Nanosecond(), loc)
+	year, month, day := t.Date()
+	hour, minute, second := t.Clock()
+	if year == wall.Year() && month == wall.Month() && day == wall.Day() &&
+		hour == wall.Hour() && minute == wall.Minute() && second == wall.Second() {
+		return t, nil
+	}
+	start, end := t.ZoneBounds()
+	if start.Sub(t).Abs() > maxDSTShift && end.Sub(t).Abs() > maxDSTShift {
+		return time.Time{}, fmt.Errorf("timestamp %s does not exist in %s", value, loc)
+	}
+	if t.Sub(start).Abs() <= t.Sub(end).Abs() {
+		return start, nil
+	}
+	return end, nil
+}
+
+// unexpectedType returns the error of the value whose golang type cannot be handled by the mysql type of the field.
+func unexpectedType(kind string, field FieldMeta, value interface{}) error {
+	return fmt.Errorf("unknown golang type %T for the %s value of %s", value, kind, field.Name)
+}
+
+func appendLengthValue(buf []byte, val []byte) []byte {
+	buf = binary.LittleEndian.AppendUint32(buf, uint32(len(val)))
+	buf = append(buf, val...)
+	return buf
+}
+
+// binaryLiteralToInt convert bytes into uint64,
+// by follow https://github.com/pingcap/tidb/blob/e3417913f58cdd5a136259b902bf177eaf3aa637/types/binary_literal.go#L105
+func binaryLiteralToInt(bytes []byte) (uint64, error) {
+	bytes = trimLeadingZeroBytes(bytes)
+	length := len(bytes)
+
+	if length > 8 {
+		log.Error("invalid bit value found", zap.ByteString("value", bytes))
+		return math.MaxUint64, errors.New("invalid bit value")
+	}
+
+	if length == 0 {
+		return 0, nil
+	}
+
+	// Note: the byte-order is BigEndian.
+	val := uint64(bytes[0])
+	for i := 1; i < length; i++ {
+		val = (val << 8) | uint64(bytes[i])
+	}
+	return val, nil
+}
+
+func trimLeadingZeroBytes(bytes []byte) []byte {
+	if len(bytes) == 0 {
+		return bytes
+	}
+	pos, posMax := 0, len(bytes)-1
+	for ; pos < posMax; pos++ {
+		if bytes[pos] != 0 {
+			break
+		}
+	}
+	return bytes[pos:]
+}
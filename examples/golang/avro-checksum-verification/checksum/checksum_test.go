@@ -0,0 +1,378 @@
+// Copyright 2023 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package checksum
+
+import (
+	"encoding/binary"
+	"hash/crc32"
+	"math"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/pingcap/tidb/pkg/parser/mysql"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCalculate(t *testing.T) {
+	t.Parallel()
+
+	fields := []FieldMeta{
+		{Name: "a", MySQLType: mysql.TypeLong},
+		{Name: "b", MySQLType: mysql.TypeLonglong},
+		{Name: "c", MySQLType: mysql.TypeDouble},
+		{Name: "d", MySQLType: mysql.TypeVarchar},
+		{Name: "e", MySQLType: mysql.TypeBit},
+		{Name: "f", MySQLType: mysql.TypeEnum},
+		{Name: "g", MySQLType: mysql.TypeNewDecimal},
+		{Name: "h", MySQLType: mysql.TypeBlob},
+	}
+	values := []interface{}{int32(-1), "18446744073709551615", 1.5, "abc", []byte{0, 1, 0}, uint64(2), "1.23", nil}
+
+	// each column is encoded independently, and accumulated by crc32.
+	var expected uint32
+	for _, buf := range [][]byte{
+		binary.LittleEndian.AppendUint64(nil, math.MaxUint64),
+		binary.LittleEndian.AppendUint64(nil, math.MaxUint64),
+		binary.LittleEndian.AppendUint64(nil, math.Float64bits(1.5)),
+		append(binary.LittleEndian.AppendUint32(nil, 3), "abc"...),
+		binary.LittleEndian.AppendUint64(nil, 256),
+		binary.LittleEndian.AppendUint64(nil, 2),
+		append(binary.LittleEndian.AppendUint32(nil, 4), "1.23"...),
+		nil,
+	} {
+		expected = crc32.Update(expected, crc32.IEEETable, buf)
+	}
+
+	actual, err := Calculate(fields, values)
+	require.NoError(t, err)
+	require.Equal(t, expected, actual)
+
+	// bit encoded as the number is the same as the bytes.
+	values[4] = uint64(256)
+	actual, err = Calculate(fields, values)
+	require.NoError(t, err)
+	require.Equal(t, expected, actual)
+
+	_, err = Calculate(fields, values[1:])
+	require.Error(t, err)
+
+	// the checksum of the row bytes is the same as the accumulated one.
+	buf, err := Bytes(fields, values)
+	require.NoError(t, err)
+	require.Equal(t, expected, crc32.ChecksumIEEE(buf))
+}
+
+func TestTimestamp(t *testing.T) {
+	t.Parallel()
+
+	// the TIMESTAMP value is in the local time zone, and converted to UTC before the checksum calculation.
+	value := "2023-12-01 10:00:00"
+	local, err := time.ParseInLocation("2006-01-02 15:04:05", value, time.Local)
+	require.NoError(t, err)
+	utc := local.UTC().Format("2006-01-02 15:04:05")
+	expected := crc32.ChecksumIEEE(append(binary.LittleEndian.AppendUint32(nil, uint32(len(utc))), utc...))
+
+	fields := []FieldMeta{{Name: "ts", MySQLType: mysql.TypeTimestamp}}
+	actual, err := Calculate(fields, []interface{}{value})
+	require.NoError(t, err)
+	require.Equal(t, expected, actual)
+
+	_, err = Calculate(fields, []interface{}{"2023-12-01T10:00:00Z"})
+	require.Error(t, err)
+}
+
+func TestTimestampDST(t *testing.T) {
+	t.Parallel()
+
+	la, err := time.LoadLocation("America/Los_Angeles")
+	require.NoError(t, err)
+	fields := []FieldMeta{{Name: "ts", MySQLType: mysql.TypeTimestamp, Location: la}}
+	for value, utc := range map[string]string{
+		"2024-07-01 12:00:00": "2024-07-01 19:00:00",
+		// the clock is set forward from 02:00 PST to 03:00 PDT, the time in the gap is moved to the transition.
+		"2024-03-10 02:30:00": "2024-03-10 10:00:00",
+		"2024-03-10 02:00:00": "2024-03-10 10:00:00",
+		"2024-03-10 03:00:00": "2024-03-10 10:00:00",
+		// the clock is set back from 02:00 PDT to 01:00 PST, the time in the overlap is the earlier one in PDT.
+		"2024-11-03 01:30:00": "2024-11-03 08:30:00",
+		"2024-11-03 02:00:00": "2024-11-03 10:00:00",
+	} {
+		ts, err := ParseTimestamp(value, la)
+		require.NoError(t, err, value)
+		require.Equal(t, utc, ts.UTC().Format("2006-01-02 15:04:05"), value)
+
+		expected := crc32.ChecksumIEEE(append(binary.LittleEndian.AppendUint32(nil, uint32(len(utc))), utc...))
+		actual, err := Calculate(fields, []interface{}{value})
+		require.NoError(t, err, value)
+		require.Equal(t, expected, actual, value)
+	}
+}
+
+func TestHandlingMode(t *testing.T) {
+	t.Parallel()
+
+	stringMode := []FieldMeta{{Name: "id", MySQLType: mysql.TypeLonglong}, {Name: "d", MySQLType: mysql.TypeNewDecimal}}
+	expected, err := Calculate(stringMode, []interface{}{"18446744073709551615", "-1.20"})
+	require.NoError(t, err)
+
+	// the precise decimal is formatted by the scale, and the unsigned bigint as long wraps to the negative.
+	fields := []FieldMeta{
+		{Name: "id", MySQLType: mysql.TypeLonglong, Handling: HandlingLong},
+		{Name: "d", MySQLType: mysql.TypeNewDecimal, Handling: HandlingPrecise, Scale: 2},
+	}
+	actual, err := Calculate(fields, []interface{}{int64(-1), big.NewRat(-6, 5)})
+	require.NoError(t, err)
+	require.Equal(t, expected, actual)
+
+	_, err = Calculate(fields, []interface{}{int64(-1), "-1.20"})
+	require.ErrorContains(t, err, "precise decimal value of d should be *big.Rat")
+}
+
+// lengthChecksum sums the length of the bytes of each column, to prove any RowChecksum is pluggable.
+type lengthChecksum struct {
+	columns []string
+	sum     uint64
+}
+
+func (l *lengthChecksum) Reset() { l.columns, l.sum = nil, 0 }
+
+func (l *lengthChecksum) UpdateColumn(meta FieldMeta, encoded []byte) {
+	l.columns = append(l.columns, meta.Name)
+	l.sum += uint64(len(encoded))
+}
+
+func (l *lengthChecksum) Sum() uint64 { return l.sum }
+
+func TestRowChecksum(t *testing.T) {
+	t.Parallel()
+
+	fields := []FieldMeta{
+		{Name: "a", MySQLType: mysql.TypeLonglong},
+		{Name: "b", MySQLType: mysql.TypeVarchar},
+		{Name: "c", MySQLType: mysql.TypeVarchar},
+	}
+	values := []interface{}{int64(1), "abc", nil}
+
+	sum := &lengthChecksum{columns: []string{"stale"}, sum: 100}
+	actual, err := CalculateBy(sum, fields, values)
+	require.NoError(t, err)
+	// 8 bytes of the integer, 4 bytes of the length and 3 bytes of the string, nothing for NULL.
+	require.Equal(t, uint64(15), actual)
+	require.Equal(t, []string{"a", "b", "c"}, sum.columns)
+
+	crc, err := Calculate(fields, values)
+	require.NoError(t, err)
+	actual, err = CalculateVersion(0, fields, values)
+	require.NoError(t, err)
+	require.Equal(t, uint64(crc), actual)
+
+	restore := Register(-100, func() RowChecksum { return &lengthChecksum{} })
+	actual, err = CalculateVersion(-100, fields, values)
+	require.NoError(t, err)
+	require.Equal(t, uint64(15), actual)
+	// the version not registered is never calculated by another checksum.
+	_, err = New(-101)
+	require.ErrorIs(t, err, ErrUnsupportedVersion)
+	_, err = CalculateVersion(-101, fields, values)
+	require.EqualError(t, err, "unsupported checksum version: -101")
+
+	// the registration is restored, the replaced one comes back.
+	restoreCRC := Register(-100, func() RowChecksum { return &crc32Checksum{} })
+	registered, err := New(-100)
+	require.NoError(t, err)
+	require.IsType(t, &crc32Checksum{}, registered)
+	restoreCRC()
+	registered, err = New(-100)
+	require.NoError(t, err)
+	require.IsType(t, &lengthChecksum{}, registered)
+	restore()
+	_, err = New(-100)
+	require.ErrorIs(t, err, ErrUnsupportedVersion)
+}
+
+func TestUnexpectedType(t *testing.T) {
+	t.Parallel()
+
+	for _, c := range []struct {
+		mysqlType byte
+		value     interface{}
+	}{
+		{mysql.TypeLonglong, 1.5},
+		{mysql.TypeBit, "1"},
+		{mysql.TypeVarchar, int64(1)},
+		{mysql.TypeEnum, "a"},
+		{mysql.TypeTimestamp, int64(1)},
+		{mysql.TypeDatetime, int64(1)},
+		{mysql.TypeNewDecimal, 1.5},
+		{mysql.TypeJSON, map[string]interface{}{}},
+	} {
+		_, err := Bytes([]FieldMeta{{Name: "a", MySQLType: c.mysqlType}}, []interface{}{c.value})
+		require.ErrorContains(t, err, "unknown golang type", "mysql type %d", c.mysqlType)
+	}
+}
+
+// chunkCounter is the crc32 checksum counting the chunks of each column.
+type chunkCounter struct {
+	crc32Checksum
+	chunks map[string]int
+}
+
+func (c *chunkCounter) UpdateColumnChunk(meta FieldMeta, chunk []byte) {
+	c.chunks[meta.Name]++
+	c.crc32Checksum.UpdateColumnChunk(meta, chunk)
+}
+
+func TestChunkedChecksum(t *testing.T) {
+	t.Parallel()
+
+	// each type branch, the raw values are longer than the chunk size of 3 bytes.
+	fields := []FieldMeta{
+		{Name: "int", MySQLType: mysql.TypeLong},
+		{Name: "ubigint", MySQLType: mysql.TypeLonglong},
+		{Name: "double", MySQLType: mysql.TypeDouble},
+		{Name: "enum", MySQLType: mysql.TypeEnum},
+		{Name: "bit", MySQLType: mysql.TypeBit},
+		{Name: "varchar", MySQLType: mysql.TypeVarchar},
+		{Name: "text", MySQLType: mysql.TypeBlob},
+		{Name: "blob", MySQLType: mysql.TypeLongBlob},
+		{Name: "short_blob", MySQLType: mysql.TypeBlob},
+		{Name: "empty", MySQLType: mysql.TypeString},
+		{Name: "timestamp", MySQLType: mysql.TypeTimestamp, Location: time.UTC},
+		{Name: "datetime", MySQLType: mysql.TypeDatetime},
+		{Name: "date", MySQLType: mysql.TypeDate},
+		{Name: "time", MySQLType: mysql.TypeDuration},
+		{Name: "decimal", MySQLType: mysql.TypeNewDecimal},
+		{Name: "precise", MySQLType: mysql.TypeNewDecimal, Handling: HandlingPrecise, Scale: 2},
+		{Name: "json", MySQLType: mysql.TypeJSON},
+		{Name: "null", MySQLType: mysql.TypeBlob},
+		{Name: "geometry", MySQLType: mysql.TypeGeometry},
+	}
+	values := []interface{}{
+		int32(-1), "18446744073709551615", 1.5, uint64(2), []byte{1, 0}, "abcdefg", "測試的文字", []byte("0123456789"),
+		[]byte{0xff}, "", "2023-01-02 03:04:05", "2023-01-02 03:04:05.123456", "2023-01-02", "-838:59:59.000000",
+		"12345.6789", big.NewRat(1234, 100), `{"a": [1, 2, 3]}`, nil, []byte("ignored"),
+	}
+	rowBytes, err := Bytes(fields, values)
+	require.NoError(t, err)
+	expected := crc32.ChecksumIEEE(rowBytes)
+
+	for _, size := range []int{1, 3, 7, 16, chunkSize} {
+		sum := &chunkCounter{chunks: make(map[string]int)}
+		actual, err := calculateBy(sum, fields, values, size)
+		require.NoError(t, err)
+		require.Equal(t, uint64(expected), actual, "size %d", size)
+		// the chunked one is the same as the buffered one column by column.
+		for i, field := range fields {
+			sum.chunks = make(map[string]int)
+			actual, err := calculateBy(sum, fields[i:i+1], values[i:i+1], size)
+			require.NoError(t, err)
+			columnBytes, err := Bytes(fields[i:i+1], values[i:i+1])
+			require.NoError(t, err)
+			require.Equal(t, uint64(crc32.ChecksumIEEE(columnBytes)), actual, "size %d column %s", size, field.Name)
+		}
+	}
+
+	// only the raw values larger than the size are chunked, the length first.
+	sum := &chunkCounter{chunks: make(map[string]int)}
+	_, err = calculateBy(sum, fields, values, 3)
+	require.NoError(t, err)
+	require.Equal(t, map[string]int{
+		"varchar": 4, "text": 6, "blob": 5, "datetime": 10, "date": 5, "time": 7, "decimal": 5, "json": 7,
+	}, sum.chunks)
+
+	// the RowChecksum not chunked accumulates the bytes of each column as a whole.
+	length := &lengthChecksum{}
+	actual, err := calculateBy(length, fields, values, 3)
+	require.NoError(t, err)
+	require.Equal(t, uint64(len(rowBytes)), actual)
+	require.Len(t, length.columns, len(fields))
+
+	// the unexpected type is still reported.
+	_, err = calculateBy(&crc32Checksum{}, fields[12:13], []interface{}{[]byte("2023-01-02")}, 3)
+	require.ErrorContains(t, err, "unknown golang type []uint8 for the temporal value of date")
+}
+
+// largeValueSize is the size of the large BLOB and TEXT values of the benchmarks.
+const largeValueSize = 16 << 20
+
+// BenchmarkCalculateLargeValue shows the memory of the chunked calculation is bounded by the chunk size,
+// while the buffered one copies the whole value.
+func BenchmarkCalculateLargeValue(b *testing.B) {
+	blob := make([]byte, largeValueSize)
+	for i := range blob {
+		blob[i] = byte(i)
+	}
+	for _, c := range []struct {
+		name  string
+		field FieldMeta
+		value interface{}
+	}{
+		{"blob", FieldMeta{Name: "blob", MySQLType: mysql.TypeLongBlob}, blob},
+		{"text", FieldMeta{Name: "text", MySQLType: mysql.TypeLongBlob}, string(blob)},
+	} {
+		fields := []FieldMeta{{Name: "id", MySQLType: mysql.TypeLonglong}, c.field}
+		values := []interface{}{int64(1), c.value}
+		b.Run(c.name+"/chunked", func(b *testing.B) {
+			b.ReportAllocs()
+			b.SetBytes(largeValueSize)
+			for i := 0; i < b.N; i++ {
+				if _, err := Calculate(fields, values); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+		b.Run(c.name+"/buffered", func(b *testing.B) {
+			b.ReportAllocs()
+			b.SetBytes(largeValueSize)
+			for i := 0; i < b.N; i++ {
+				if _, err := CalculateBy(&lengthChecksum{}, fields, values); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// BenchmarkCalculateWideRow calculates the row of 500 columns, every tenth one is a TEXT of 1MB.
+func BenchmarkCalculateWideRow(b *testing.B) {
+	text := string(make([]byte, 1<<20))
+	fields := make([]FieldMeta, 0, 500)
+	values := make([]interface{}, 0, 500)
+	for i := 0; i < 500; i++ {
+		switch i % 10 {
+		case 0:
+			fields = append(fields, FieldMeta{Name: "text", MySQLType: mysql.TypeBlob})
+			values = append(values, text)
+		case 1, 2, 3:
+			fields = append(fields, FieldMeta{Name: "bigint", MySQLType: mysql.TypeLonglong})
+			values = append(values, int64(i))
+		case 4, 5:
+			fields = append(fields, FieldMeta{Name: "double", MySQLType: mysql.TypeDouble})
+			values = append(values, float64(i))
+		case 6, 7:
+			fields = append(fields, FieldMeta{Name: "varchar", MySQLType: mysql.TypeVarchar})
+			values = append(values, "value of a short column")
+		default:
+			fields = append(fields, FieldMeta{Name: "datetime", MySQLType: mysql.TypeDatetime})
+			values = append(values, "2023-01-02 03:04:05.123456")
+		}
+	}
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if _, err := Calculate(fields, values); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
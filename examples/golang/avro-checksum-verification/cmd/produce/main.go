@@ -0,0 +1,230 @@
+// Copyright 2023 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// The produce command generates the avro messages the same as TiCDC with the row level checksum enabled,
+// and writes them to the kafka topic or the local directory, to test the verifier and the consumers end to end.
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"time"
+
+	"avro-checksum-sample/generator"
+	"github.com/pingcap/log"
+	"github.com/segmentio/kafka-go"
+	"go.uber.org/zap"
+)
+
+// produceBatchSize is the number of messages written to kafka at once.
+const produceBatchSize = 100
+
+type config struct {
+	kafkaAddr         string
+	schemaRegistryURL string
+	topic             string
+	namespace         string
+
+	// tableFile is the JSON file of the table definition, rowsFile is the JSON lines file of the rows.
+	// The rows are generated randomly if rowsFile is empty.
+	tableFile string
+	rowsFile  string
+	count     int
+	seed      int64
+	// startCommitTs is the commit ts of the first row, each following row is committed 1 logical ts later.
+	startCommitTs uint64
+
+	// outputDir is the local directory to write the messages, instead of the kafka topic.
+	outputDir string
+
+	// corruptRate is the ratio of the messages corrupted by corruptMode.
+	corruptRate float64
+	corruptMode string
+}
+
+func main() {
+	cfg := &config{}
+	flag.StringVar(&cfg.kafkaAddr, "kafka-addr", "127.0.0.1:9092", "kafka broker address")
+	flag.StringVar(&cfg.schemaRegistryURL, "schema-registry-url", "http://127.0.0.1:8081",
+		"schema registry url to register the schemas")
+	flag.StringVar(&cfg.topic, "topic", "avro-checksum-test", "kafka topic to produce")
+	flag.StringVar(&cfg.namespace, "namespace", "default", "namespace of the changefeed, the prefix of the avro namespace")
+	flag.StringVar(&cfg.tableFile, "table", "", "JSON file of the table definition")
+	flag.StringVar(&cfg.rowsFile, "rows", "",
+		"JSON lines file of the rows, each line is an object of the column values, generate random rows if empty")
+	flag.IntVar(&cfg.count, "count", 100, "number of the random rows generated")
+	flag.Int64Var(&cfg.seed, "seed", 0, "seed of the random rows and corruptions, the current time if 0")
+	flag.Uint64Var(&cfg.startCommitTs, "start-commit-ts", 0, "commit ts of the first row, the current time if 0")
+	flag.StringVar(&cfg.outputDir, "output-dir", "",
+		"local directory to write the messages and schemas, instead of the kafka topic and schema registry")
+	flag.Float64Var(&cfg.corruptRate, "corrupt", 0, "ratio of the messages corrupted, in [0, 1]")
+	flag.StringVar(&cfg.corruptMode, "corrupt-mode", generator.CorruptChecksum,
+		"how the message is corrupted, `checksum` to change the checksum, or `byte` to flip a byte of the column data")
+	flag.Parse()
+
+	if err := produce(context.Background(), cfg); err != nil {
+		log.Fatal("produce messages failed", zap.Error(err))
+	}
+}
+
+func produce(ctx context.Context, cfg *config) error {
+	if cfg.tableFile == "" {
+		return errors.New("table definition must be set")
+	}
+	if cfg.corruptRate < 0 || cfg.corruptRate > 1 {
+		return errors.New("corrupt ratio must be in [0, 1]")
+	}
+	if cfg.corruptMode != generator.CorruptChecksum && cfg.corruptMode != generator.CorruptByte {
+		return errors.New("unknown corruption mode: " + cfg.corruptMode)
+	}
+	table, err := generator.LoadTable(cfg.tableFile)
+	if err != nil {
+		return err
+	}
+	rows, err := loadRows(cfg, table)
+	if err != nil {
+		return err
+	}
+	if cfg.seed == 0 {
+		cfg.seed = time.Now().UnixNano()
+	}
+	if cfg.startCommitTs == 0 {
+		cfg.startCommitTs = uint64(time.Now().UnixMilli()) << 18
+	}
+
+	var registry generator.Registry = generator.NewHTTPRegistry(cfg.schemaRegistryURL)
+	memory := generator.NewMemoryRegistry()
+	if cfg.outputDir != "" {
+		registry = memory
+	}
+	encoder, err := generator.NewEncoder(table, cfg.namespace, cfg.topic, registry)
+	if err != nil {
+		return err
+	}
+
+	r := rand.New(rand.NewSource(cfg.seed))
+	messages := make([]kafka.Message, 0, len(rows))
+	var corrupted int
+	for i, row := range rows {
+		if row == nil {
+			row = table.RandomRow(r)
+		}
+		m, err := encoder.Encode(row, cfg.startCommitTs+uint64(i))
+		if err != nil {
+			return fmt.Errorf("row %d: %w", i, err)
+		}
+		if cfg.corruptRate > 0 && r.Float64() < cfg.corruptRate {
+			if err := encoder.Corrupt(m, cfg.corruptMode, r); err != nil {
+				return err
+			}
+			corrupted++
+			log.Info("message corrupted", zap.Int("index", i), zap.String("mode", m.Corrupted))
+		}
+		messages = append(messages, kafka.Message{Key: m.Key, Value: m.Value})
+	}
+
+	if cfg.outputDir != "" {
+		err = writeFiles(cfg.outputDir, messages, memory.Schemas())
+	} else {
+		err = writeKafka(ctx, cfg, messages)
+	}
+	if err != nil {
+		return err
+	}
+	log.Info("messages produced", zap.String("table", table.Schema+"."+table.Name),
+		zap.Int("messages", len(messages)), zap.Int("corrupted", corrupted), zap.Int64("seed", cfg.seed))
+	return nil
+}
+
+// loadRows returns the rows of the rows file, or count nil rows which are generated randomly.
+func loadRows(cfg *config, table *generator.Table) ([]generator.Row, error) {
+	if cfg.rowsFile == "" {
+		if cfg.count <= 0 {
+			return nil, errors.New("count must be positive")
+		}
+		return make([]generator.Row, cfg.count), nil
+	}
+	file, err := os.Open(cfg.rowsFile)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var rows []generator.Row
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(nil, 16<<20)
+	for line := 1; scanner.Scan(); line++ {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		row, err := table.ParseRow(scanner.Bytes())
+		if err != nil {
+			return nil, fmt.Errorf("invalid row at line %d: %w", line, err)
+		}
+		rows = append(rows, row)
+	}
+	return rows, scanner.Err()
+}
+
+// writeFiles writes the value and key of each message as `{index}.value` and `{index}.key`,
+// and the schemas as `schemas/{id}.avsc`.
+func writeFiles(dir string, messages []kafka.Message, schemas map[int]string) error {
+	if err := os.MkdirAll(filepath.Join(dir, "schemas"), 0o755); err != nil {
+		return err
+	}
+	for id, schema := range schemas {
+		if err := os.WriteFile(filepath.Join(dir, "schemas", fmt.Sprintf("%d.avsc", id)), []byte(schema), 0o644); err != nil {
+			return err
+		}
+	}
+	for i, m := range messages {
+		if err := os.WriteFile(filepath.Join(dir, fmt.Sprintf("%08d.value", i)), m.Value, 0o644); err != nil {
+			return err
+		}
+		if m.Key == nil {
+			continue
+		}
+		if err := os.WriteFile(filepath.Join(dir, fmt.Sprintf("%08d.key", i)), m.Key, 0o644); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func writeKafka(ctx context.Context, cfg *config, messages []kafka.Message) error {
+	writer := &kafka.Writer{
+		Addr:  kafka.TCP(cfg.kafkaAddr),
+		Topic: cfg.topic,
+		// the rows of the same key are in the same partition, the same as TiCDC dispatching by the handle key.
+		Balancer:     &kafka.Hash{},
+		BatchSize:    produceBatchSize,
+		RequiredAcks: kafka.RequireAll,
+	}
+	defer writer.Close()
+	for start := 0; start < len(messages); start += produceBatchSize {
+		end := start + produceBatchSize
+		if end > len(messages) {
+			end = len(messages)
+		}
+		if err := writer.WriteMessages(ctx, messages[start:end]...); err != nil {
+			return err
+		}
+	}
+	return nil
+}
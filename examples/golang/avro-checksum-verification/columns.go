@@ -0,0 +1,113 @@
+// Copyright 2023 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// errUnexpectedColumns is returned if the columns carried by the message are different from the expected ones,
+// such as the column selector of the changefeed is misconfigured.
+var errUnexpectedColumns = errors.New("column set differs from the expected one")
+
+// expectedColumns is the column set expected in the message of each table, keyed by the lower case `schema.table`,
+// the column names are in lower case, since they are case-insensitive.
+type expectedColumns map[string]map[string]struct{}
+
+// parseExpectedColumns parses the `db.table=col1,col2` assertions separated by `;`, it returns nil if empty.
+func parseExpectedColumns(s string) (expectedColumns, error) {
+	if strings.TrimSpace(s) == "" {
+		return nil, nil
+	}
+	result := make(expectedColumns)
+	for _, item := range strings.Split(s, ";") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		table, columns, ok := strings.Cut(item, "=")
+		table = strings.ToLower(strings.TrimSpace(table))
+		if !ok || !strings.Contains(table, ".") {
+			return nil, fmt.Errorf("invalid expected columns %q, should be `db.table=col1,col2`", item)
+		}
+		if _, ok := result[table]; ok {
+			return nil, fmt.Errorf("expected columns of %s set more than once", table)
+		}
+		set := make(map[string]struct{})
+		for _, column := range strings.Split(columns, ",") {
+			column = strings.ToLower(strings.TrimSpace(column))
+			if column != "" {
+				set[column] = struct{}{}
+			}
+		}
+		if len(set) == 0 {
+			return nil, fmt.Errorf("no column expected of %s", table)
+		}
+		result[table] = set
+	}
+	return result, nil
+}
+
+// check returns errUnexpectedColumns if the columns of the table are different from the expected ones,
+// the table without the assertion is not checked.
+func (e expectedColumns) check(table string, columns []string) error {
+	expected, ok := e[strings.ToLower(table)]
+	if !ok {
+		return nil
+	}
+	observed := make(map[string]struct{}, len(columns))
+	var unexpected []string
+	for _, column := range columns {
+		name := strings.ToLower(column)
+		observed[name] = struct{}{}
+		if _, ok := expected[name]; !ok {
+			unexpected = append(unexpected, column)
+		}
+	}
+	var missing []string
+	for column := range expected {
+		if _, ok := observed[column]; !ok {
+			missing = append(missing, column)
+		}
+	}
+	if len(missing) == 0 && len(unexpected) == 0 {
+		return nil
+	}
+	sort.Strings(missing)
+	sort.Strings(unexpected)
+	return fmt.Errorf("%w of %s, missing: [%s], unexpected: [%s]", errUnexpectedColumns, table,
+		strings.Join(missing, ", "), strings.Join(unexpected, ", "))
+}
+
+// avroColumnNames returns the names of the columns carried by the avro value schema,
+// which are the fields before `_tidb_op`, the same as those in the checksum calculation.
+func avroColumnNames(valueSchema map[string]interface{}) []string {
+	fields, _ := valueSchema["fields"].([]interface{})
+	names := make([]string, 0, len(fields))
+	for _, item := range fields {
+		field, ok := item.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		name, _ := field["name"].(string)
+		if name == "_tidb_op" {
+			break
+		}
+		names = append(names, name)
+	}
+	return names
+}
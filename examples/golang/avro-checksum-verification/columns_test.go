@@ -0,0 +1,202 @@
+// Copyright 2023 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/segmentio/kafka-go"
+	"github.com/stretchr/testify/require"
+)
+
+// testProjectedSchema is the value schema of the table `test`.`t`, only the `id` column is selected by the column selector.
+var testProjectedSchema = strings.Replace(testValueSchema,
+	`{"name": "name", "type": ["null", {"type": "string", "connect.parameters": {"tidb_type": "TEXT"}}], "default": null},`,
+	"", 1)
+
+func TestParseExpectedColumns(t *testing.T) {
+	t.Parallel()
+
+	columns, err := parseExpectedColumns("")
+	require.NoError(t, err)
+	require.Nil(t, columns)
+	require.NoError(t, columns.check("test.t", []string{"id"}))
+
+	columns, err = parseExpectedColumns("Test.T = ID, name; test.u=id;")
+	require.NoError(t, err)
+	require.NoError(t, columns.check("test.t", []string{"name", "id"}))
+	require.NoError(t, columns.check("test.T", []string{"Id", "Name"}))
+	// the table without the assertion is not checked.
+	require.NoError(t, columns.check("test.v", []string{"id"}))
+
+	err = columns.check("test.t", []string{"id", "age"})
+	require.ErrorIs(t, err, errUnexpectedColumns)
+	require.ErrorContains(t, err, "of test.t, missing: [name], unexpected: [age]")
+
+	for _, s := range []string{"test.t", "test=id", "test.t=", "test.t=id;test.t=name"} {
+		_, err := parseExpectedColumns(s)
+		require.Error(t, err, s)
+	}
+}
+
+func TestAvroProjectedColumns(t *testing.T) {
+	t.Parallel()
+
+	registry := newTestRegistry(t, map[int]string{testSchemaID: testProjectedSchema})
+	// the checksum is calculated by the projected columns only.
+	native := newTestRow(1, nil, 100, strconv.FormatUint(uint64(testRowChecksum(1, nil)), 10))
+	delete(native, "name")
+	message := kafka.Message{Value: encodeTestMessage(t, testSchemaID, testProjectedSchema, native)}
+
+	cases := []struct {
+		expected string
+		err      error
+	}{
+		{expected: "", err: nil},
+		{expected: "test.t=id", err: nil},
+		// the misconfigured selector is not reported as a checksum mismatch.
+		{expected: "test.t=id,name", err: errUnexpectedColumns},
+		{expected: "other.t=id,name", err: nil},
+	}
+	for _, c := range cases {
+		cfg := newDefaultConfig()
+		cfg.schemaRegistryURL = registry.URL
+		cfg.expectedColumns = c.expected
+		require.NoError(t, cfg.validate())
+		v, err := newMessageVerifier(cfg)
+		require.NoError(t, err)
+
+		result, err := v.verify(message)
+		if c.err != nil {
+			require.ErrorIs(t, err, c.err, c.expected)
+			require.Equal(t, exitCodeDecodeError, exitCodeOf(newDecodeError(err)))
+			continue
+		}
+		require.NoError(t, err, c.expected)
+		require.Equal(t, outcomeVerified, result.outcome)
+	}
+}
+
+// testGeneratedSchema is the value schema of the table `test`.`t` with the stored generated column,
+// (id BIGINT PRIMARY KEY, name TEXT, g BIGINT AS (id + 1) STORED, v BIGINT AS (id + 2) VIRTUAL).
+var testGeneratedSchema = strings.Replace(testValueSchema,
+	`{"name": "_tidb_op",`,
+	`{"name": "g", "type": {"type": "long", "connect.parameters": {"tidb_type": "BIGINT"}}},
+    {"name": "_tidb_op",`, 1)
+
+func TestAvroGeneratedColumnSkipped(t *testing.T) {
+	t.Parallel()
+
+	registry := newTestRegistry(t, map[int]string{testSchemaID: testGeneratedSchema})
+	name := "a"
+	newMessage := func(checksum uint32) kafka.Message {
+		native := newTestRow(1, &name, 100, strconv.FormatUint(uint64(checksum), 10))
+		native["g"] = int64(2)
+		return kafka.Message{Value: encodeTestMessage(t, testSchemaID, testGeneratedSchema, native)}
+	}
+	// the stored generated column is sent and involved in the checksum calculation like others,
+	// the virtual one is neither sent nor involved, so it's skipped by the message schema itself.
+	withStored := crc32.Update(testRowChecksum(1, &name), crc32.IEEETable, binary.LittleEndian.AppendUint64(nil, 2))
+	require.NotEqual(t, testRowChecksum(1, &name), withStored)
+
+	cases := []struct {
+		checksum uint32
+		expected string
+		err      error
+	}{
+		{checksum: withStored, expected: "test.t=id,name,g", err: nil},
+		// the checksum calculated without the stored generated column mismatches.
+		{checksum: testRowChecksum(1, &name), expected: "test.t=id,name,g", err: errChecksumMismatch},
+		// listing the virtual generated column fails, since it's never carried by the message.
+		{checksum: withStored, expected: "test.t=id,name,g,v", err: errUnexpectedColumns},
+		// omitting the stored generated column fails, since it's carried by the message.
+		{checksum: withStored, expected: "test.t=id,name", err: errUnexpectedColumns},
+	}
+	for _, c := range cases {
+		cfg := newDefaultConfig()
+		cfg.schemaRegistryURL = registry.URL
+		cfg.expectedColumns = c.expected
+		v, err := newMessageVerifier(cfg)
+		require.NoError(t, err)
+		result, err := v.verify(newMessage(c.checksum))
+		if c.err != nil {
+			require.ErrorIs(t, err, c.err, c.expected)
+			continue
+		}
+		require.NoError(t, err, c.expected)
+		require.Equal(t, outcomeVerified, result.outcome)
+	}
+}
+
+func TestAvroHandleKeyOnlyNotChecked(t *testing.T) {
+	t.Parallel()
+
+	registry := newTestRegistry(t, map[int]string{testSchemaID: testValueSchema, testKeySchemaID: testKeySchema})
+	cfg := newDefaultConfig()
+	cfg.schemaRegistryURL = registry.URL
+	cfg.expectedColumns = "test.t=id,name"
+	v, err := newMessageVerifier(cfg)
+	require.NoError(t, err)
+
+	// the delete event only carries the handle key columns in the key, the column set is not checked.
+	key := encodeTestMessage(t, testKeySchemaID, testKeySchema, map[string]interface{}{"id": int64(1)})
+	result, err := v.verify(kafka.Message{Key: key})
+	require.NoError(t, err)
+	require.Equal(t, outcomeSkippedDelete, result.outcome)
+
+	message := newVerifiedTestMessage(t, 0, 1, "a")
+	message.Key = key
+	result, err = v.verify(message)
+	require.NoError(t, err)
+	require.Equal(t, outcomeVerified, result.outcome)
+}
+
+func TestCanalJSONExpectedColumns(t *testing.T) {
+	t.Parallel()
+
+	cfg := newDefaultConfig()
+	cfg.protocol = protocolCanalJSON
+	cfg.expectedColumns = "test.c=id,name,data"
+	require.NoError(t, cfg.validate())
+	v, err := newMessageVerifier(cfg)
+	require.NoError(t, err)
+
+	current := testCanalJSONChecksum(1, "b", []byte{0xe9, 0x01})
+	value := newTestCanalJSONMessage("INSERT", `[{"id":"1","name":"b","data":"é\u0001"}]`, `null`,
+		fmt.Sprintf(`{"commitTs":100,"_checksum":{"current":%d}}`, current))
+	result, err := v.verify(kafka.Message{Value: []byte(value)})
+	require.NoError(t, err)
+	require.Equal(t, outcomeVerified, result.outcome)
+
+	// the handle key only message carries a part of the columns on purpose, it's not checked.
+	value = newTestCanalJSONMessage("INSERT", `[{"id":"1"}]`, `null`,
+		fmt.Sprintf(`{"commitTs":100,"onlyHandleKey":true,"_checksum":{"current":%d}}`, current))
+	result, err = v.verify(kafka.Message{Value: []byte(value)})
+	require.NoError(t, err)
+	require.Equal(t, outcomeSkippedHandleKeyOnly, result.outcome)
+
+	value = newTestCanalJSONMessage("INSERT", `[{"id":"1","name":"b"}]`, `null`,
+		fmt.Sprintf(`{"commitTs":100,"_checksum":{"current":%d}}`, testCanalJSONChecksum(1, "b", nil)))
+	_, err = v.verify(kafka.Message{Value: []byte(value)})
+	require.ErrorIs(t, err, errUnexpectedColumns)
+	require.ErrorContains(t, err, "missing: [data]")
+
+	cfg.protocol = protocolOpen
+	require.ErrorContains(t, cfg.validate(), "only the avro and canal-json protocols")
+}
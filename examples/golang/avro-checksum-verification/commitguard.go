@@ -0,0 +1,119 @@
+// Copyright 2023 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"github.com/pingcap/log"
+	"github.com/segmentio/kafka-go"
+	"go.uber.org/zap"
+)
+
+// partitionKey identifies the partition of a topic.
+type partitionKey struct {
+	topic     string
+	partition int
+}
+
+func partitionKeyOf(message kafka.Message) partitionKey {
+	return partitionKey{topic: message.Topic, partition: message.Partition}
+}
+
+type offsetState int
+
+const (
+	offsetPending offsetState = iota
+	// offsetSettled is the offset verified, or failed but released by the policy, such as the mismatch budget.
+	offsetSettled
+	// offsetFailed is the offset failed and not released, it's never committed, so that it's verified again after restart.
+	offsetFailed
+)
+
+// commitGuard enforces that no offset is committed past an unverified message of the same partition,
+// whatever order the messages are settled in, such as by the asynchronous rechecks.
+// Each message is dispatched in the order of the partition, and settled or failed later,
+// the committable offset of the partition is the highest one whose preceding dispatched offsets are all settled.
+// The offsets are not assumed to be contiguous, since some may be compacted or be the transaction markers.
+type commitGuard struct {
+	partitions map[partitionKey]*partitionGuard
+}
+
+type partitionGuard struct {
+	// offsets are the dispatched offsets not committable yet, in the order of dispatch.
+	offsets []int64
+	states  map[int64]offsetState
+	// committable is the highest committable offset, -1 if none.
+	committable int64
+}
+
+func newCommitGuard() *commitGuard {
+	return &commitGuard{partitions: make(map[partitionKey]*partitionGuard)}
+}
+
+func (g *commitGuard) partition(message kafka.Message) *partitionGuard {
+	key := partitionKeyOf(message)
+	p, ok := g.partitions[key]
+	if !ok {
+		p = &partitionGuard{states: make(map[int64]offsetState), committable: -1}
+		g.partitions[key] = p
+	}
+	return p
+}
+
+// dispatch records the message is being verified, the messages of a partition are dispatched in the order of the offset.
+// The partition rewound, such as after the rebalance, forgets the offsets since the rewound one.
+func (g *commitGuard) dispatch(message kafka.Message) {
+	p := g.partition(message)
+	for n := len(p.offsets); n > 0 && p.offsets[n-1] >= message.Offset; n = len(p.offsets) {
+		delete(p.states, p.offsets[n-1])
+		p.offsets = p.offsets[:n-1]
+	}
+	p.offsets = append(p.offsets, message.Offset)
+	p.states[message.Offset] = offsetPending
+}
+
+// settle records the message is verified, or its failure is released by the policy.
+func (g *commitGuard) settle(message kafka.Message) {
+	g.finish(message, offsetSettled)
+}
+
+// fail records the message failed without being released, the partition is never committed since then.
+func (g *commitGuard) fail(message kafka.Message) {
+	g.finish(message, offsetFailed)
+}
+
+func (g *commitGuard) finish(message kafka.Message, state offsetState) {
+	p := g.partition(message)
+	current, ok := p.states[message.Offset]
+	if !ok {
+		log.Warn("settle the message not dispatched, ignore it", zap.String("topic", message.Topic),
+			zap.Int("partition", message.Partition), zap.Int64("offset", message.Offset))
+		return
+	}
+	// the failure is never overridden.
+	if current == offsetFailed {
+		return
+	}
+	p.states[message.Offset] = state
+	for len(p.offsets) > 0 && p.states[p.offsets[0]] == offsetSettled {
+		p.committable = p.offsets[0]
+		delete(p.states, p.offsets[0])
+		p.offsets = p.offsets[1:]
+	}
+}
+
+// committable returns true if the message can be committed.
+func (g *commitGuard) committable(message kafka.Message) bool {
+	p, ok := g.partitions[partitionKeyOf(message)]
+	return ok && message.Offset <= p.committable
+}
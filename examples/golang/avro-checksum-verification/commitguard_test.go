@@ -0,0 +1,172 @@
+// Copyright 2023 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"math/rand"
+	"testing"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCommitGuard(t *testing.T) {
+	t.Parallel()
+
+	message := func(partition int, offset int64) kafka.Message {
+		return kafka.Message{Topic: "test", Partition: partition, Offset: offset}
+	}
+	g := newCommitGuard()
+	require.False(t, g.committable(message(0, 0)))
+	// the offsets are not contiguous.
+	for _, offset := range []int64{0, 1, 3, 4, 7} {
+		g.dispatch(message(0, offset))
+	}
+	g.dispatch(message(1, 0))
+
+	g.settle(message(0, 1))
+	require.False(t, g.committable(message(0, 1)))
+	g.settle(message(0, 0))
+	require.True(t, g.committable(message(0, 1)))
+	require.False(t, g.committable(message(0, 3)))
+	// the failure blocks the partition, even if the following ones are settled.
+	g.fail(message(0, 3))
+	g.settle(message(0, 4))
+	g.settle(message(0, 7))
+	g.settle(message(0, 3))
+	require.False(t, g.committable(message(0, 4)))
+	require.False(t, g.committable(message(0, 7)))
+	// the other partition is not affected.
+	g.settle(message(1, 0))
+	require.True(t, g.committable(message(1, 0)))
+
+	// the rewound partition forgets the offsets since the rewound one.
+	g.dispatch(message(0, 3))
+	g.settle(message(0, 3))
+	require.True(t, g.committable(message(0, 3)))
+	require.False(t, g.committable(message(0, 4)))
+	// the message not dispatched is ignored.
+	g.settle(message(0, 9))
+	require.False(t, g.committable(message(0, 9)))
+}
+
+// TestCommitGuardStress settles the messages in a random order with the failures injected,
+// and checks no offset is committable past an unsettled or failed one, against a model of the partitions.
+func TestCommitGuardStress(t *testing.T) {
+	t.Parallel()
+
+	seed := time.Now().UnixNano()
+	t.Logf("seed %d", seed)
+	r := rand.New(rand.NewSource(seed))
+
+	const partitions = 4
+	type dispatched struct {
+		message kafka.Message
+		state   offsetState
+	}
+	for round := 0; round < 50; round++ {
+		g := newCommitGuard()
+		model := make([][]*dispatched, partitions)
+		var inflight []*dispatched
+		next := make([]int64, partitions)
+		for step := 0; step < 500; step++ {
+			// dispatch the messages more often at first, then drain the inflight ones.
+			if len(inflight) == 0 || (step < 400 && r.Intn(2) == 0) {
+				partition := r.Intn(partitions)
+				// some offsets are skipped, such as the transaction markers.
+				next[partition] += 1 + int64(r.Intn(3))
+				d := &dispatched{message: kafka.Message{Topic: "test", Partition: partition, Offset: next[partition]}}
+				g.dispatch(d.message)
+				model[partition] = append(model[partition], d)
+				inflight = append(inflight, d)
+				continue
+			}
+			// the worker completes in a random order, and fails by chance,
+			// the failure is settled if the policy releases it.
+			i := r.Intn(len(inflight))
+			d := inflight[i]
+			inflight = append(inflight[:i], inflight[i+1:]...)
+			if r.Intn(50) == 0 {
+				d.state = offsetFailed
+				g.fail(d.message)
+			} else {
+				d.state = offsetSettled
+				g.settle(d.message)
+			}
+
+			for _, ds := range model {
+				contiguous := true
+				for _, d := range ds {
+					contiguous = contiguous && d.state == offsetSettled
+					if contiguous != g.committable(d.message) {
+						require.Failf(t, "unexpected committable", "round %d, step %d, partition %d, offset %d, expected %v",
+							round, step, d.message.Partition, d.message.Offset, contiguous)
+					}
+				}
+			}
+		}
+	}
+}
+
+func TestVerifierCommitGuard(t *testing.T) {
+	t.Parallel()
+
+	registry := newTestRegistry(t, map[int]string{testSchemaID: testValueSchema})
+	cfg := newDefaultConfig()
+	cfg.schemaRegistryURL = registry.URL
+	cfg.mismatchBudget = 1
+	reader := &fakeReader{messages: []kafka.Message{
+		newVerifiedTestMessage(t, 0, 1, "a"),
+		// the mismatch is released by the budget.
+		newMismatchTestMessage(t, 1, 2, "b"),
+		newVerifiedTestMessage(t, 2, 3, "c"),
+		newMismatchTestMessage(t, 3, 4, "d"),
+		newVerifiedTestMessage(t, 4, 5, "e"),
+	}}
+	v := newTestVerifier(cfg, reader)
+	err := v.run(context.Background())
+	require.Equal(t, exitCodeMismatch, v.finish(err))
+	require.Equal(t, []int64{0, 1, 2}, reader.committedOffsets())
+}
+
+func TestVerifierCommitGuardRecheck(t *testing.T) {
+	t.Parallel()
+
+	cfg := newDefaultConfig()
+	cfg.failFast = true
+	reader := &fakeReader{}
+	v := newTestVerifier(cfg, reader)
+	v.downstream = newDownstreamCheckerWithDB(nil, cfg)
+	message := func(partition int, offset int64) kafka.Message {
+		return kafka.Message{Topic: "test", Partition: partition, Offset: offset}
+	}
+	// the row of the offset 1 is being rechecked, it may fail later.
+	v.downstream.pending["1"] = []*downstreamRecheck{{message: message(0, 1)}}
+	for _, m := range []kafka.Message{message(0, 0), message(1, 0), message(0, 1), message(0, 2), message(1, 1)} {
+		v.guard.dispatch(m)
+		v.guard.settle(m)
+		v.held = append(v.held, heldMessage{message: m})
+	}
+	require.NoError(t, v.commitHeld(context.Background()))
+	require.Equal(t, []int64{0, 0, 1}, reader.committedOffsets())
+	require.Len(t, v.held, 2)
+
+	// the recheck passes.
+	delete(v.downstream.pending, "1")
+	require.NoError(t, v.commitHeld(context.Background()))
+	require.Equal(t, []int64{0, 0, 1, 1, 2}, reader.committedOffsets())
+	require.Empty(t, v.held)
+}
@@ -0,0 +1,557 @@
+// Copyright 2023 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"container/list"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"sort"
+	"strconv"
+	"syscall"
+	"time"
+
+	"avro-checksum-sample/checksum"
+	"github.com/pingcap/log"
+	"github.com/segmentio/kafka-go"
+	"go.uber.org/zap"
+)
+
+const (
+	compareSideA = 0
+	compareSideB = 1
+)
+
+const (
+	// differenceKindMissing means the event is only found in one side within the matching window.
+	differenceKindMissing = "missing"
+	// differenceKindEvicted means the event is evicted by the pending cap before it's matched.
+	differenceKindEvicted = "evicted"
+	// differenceKindValue means the column values of the matched events are different.
+	differenceKindValue = "value"
+	// differenceKindChecksum means the checksums carried by the matched events are different.
+	differenceKindChecksum = "checksum"
+)
+
+// compareConfig is the configuration of the `compare` command, each flag of the two sides has the `-a` or `-b` suffix.
+type compareConfig struct {
+	kafkaAddr         string
+	schemaRegistryURL string
+	topics            [2]string
+	protocols         [2]string
+	// startOffset is the offset both topics are consumed from, `earliest` or `latest`.
+	startOffset string
+	// window is the commit ts window to wait for the event of the other side, before it's reported missing.
+	window time.Duration
+	// maxPending is the maximum number of the events waiting for the other side, the oldest one is evicted beyond it.
+	maxPending int
+	// idleTimeout stops the comparison if neither side has any message for the duration, disabled if 0.
+	idleTimeout time.Duration
+	reportFile  string
+}
+
+func newDefaultCompareConfig() *compareConfig {
+	return &compareConfig{
+		kafkaAddr:         "127.0.0.1:9092",
+		schemaRegistryURL: "http://127.0.0.1:8081",
+		protocols:         [2]string{protocolAvro, protocolAvro},
+		startOffset:       startOffsetEarliest,
+		window:            time.Minute,
+		maxPending:        1 << 20,
+	}
+}
+
+func (c *compareConfig) bindFlags(fs *flag.FlagSet) {
+	fs.StringVar(&c.kafkaAddr, "kafka-addr", c.kafkaAddr, "kafka address of both topics")
+	fs.StringVar(&c.schemaRegistryURL, "schema-registry-url", c.schemaRegistryURL, "schema registry url")
+	fs.StringVar(&c.topics[compareSideA], "topic-a", "", "topic of the side A")
+	fs.StringVar(&c.topics[compareSideB], "topic-b", "", "topic of the side B")
+	fs.StringVar(&c.protocols[compareSideA], "protocol-a", c.protocols[compareSideA],
+		"protocol of the side A, `avro` or `canal-json`")
+	fs.StringVar(&c.protocols[compareSideB], "protocol-b", c.protocols[compareSideB],
+		"protocol of the side B, `avro` or `canal-json`")
+	fs.StringVar(&c.startOffset, "start-offset", c.startOffset, "consume both topics from `earliest` or `latest`")
+	fs.DurationVar(&c.window, "match-window", c.window,
+		"commit ts window to wait for the event of the other side, before reporting it missing")
+	fs.IntVar(&c.maxPending, "max-pending", c.maxPending,
+		"maximum number of the events waiting for the other side, the oldest one is evicted and reported beyond it")
+	fs.DurationVar(&c.idleTimeout, "idle-timeout", c.idleTimeout,
+		"stop if neither topic has any message for the duration, such as `1m`, disabled if 0")
+	fs.StringVar(&c.reportFile, "report-file", c.reportFile, "file to write the report in JSON format, disabled if empty")
+}
+
+func (c *compareConfig) validate() error {
+	for side, topic := range c.topics {
+		if topic == "" {
+			return errors.New("both topics must be set")
+		}
+		if p := c.protocols[side]; p != protocolAvro && p != protocolCanalJSON {
+			return errors.New("only the avro and canal-json protocols are supported by the comparison")
+		}
+	}
+	if _, err := parseStartOffset(c.startOffset); err != nil {
+		return err
+	}
+	if c.window <= 0 || c.maxPending <= 0 {
+		return errors.New("match window and max pending must be positive")
+	}
+	if c.idleTimeout < 0 {
+		return errors.New("idle timeout must not be negative")
+	}
+	return nil
+}
+
+// sideConfig returns the verifier config of the side.
+func (c *compareConfig) sideConfig(side int) *config {
+	cfg := newDefaultConfig()
+	cfg.kafkaAddr, cfg.schemaRegistryURL = c.kafkaAddr, c.schemaRegistryURL
+	cfg.topic, cfg.protocol = c.topics[side], c.protocols[side]
+	return cfg
+}
+
+// newCompareVerifier returns the message verifier of the side, which collects the decoded rows.
+func newCompareVerifier(cfg *config) (messageVerifier, error) {
+	v, err := newMessageVerifier(cfg)
+	if err != nil {
+		return nil, err
+	}
+	switch t := v.(type) {
+	case *avroVerifier:
+		t.collectRows = true
+	case *canalJSONVerifier:
+		t.collectRows = true
+	default:
+		return nil, errors.New("only the avro and canal-json protocols are supported by the comparison")
+	}
+	return v, nil
+}
+
+// comparePosition is the position of the event in the topic.
+type comparePosition struct {
+	Topic     string `json:"topic"`
+	Partition int    `json:"partition"`
+	Offset    int64  `json:"offset"`
+}
+
+// compareDifference is an event which is not equivalent in the two sides.
+type compareDifference struct {
+	Kind     string `json:"kind"`
+	Table    string `json:"table"`
+	Key      string `json:"key"`
+	CommitTs uint64 `json:"commitTs"`
+	// A and B are the positions of the event in each side, nil if it's missing in the side.
+	A *comparePosition `json:"a,omitempty"`
+	B *comparePosition `json:"b,omitempty"`
+	// Columns are the columns whose values differ, or carried by only one side.
+	Columns []string `json:"columns,omitempty"`
+	// ChecksumA and ChecksumB are the checksums carried by each side, only for the checksum difference.
+	ChecksumA uint64 `json:"checksumA,omitempty"`
+	ChecksumB uint64 `json:"checksumB,omitempty"`
+}
+
+type compareCounters struct {
+	// EventsA and EventsB are the number of the row events decoded from each side.
+	EventsA uint64 `json:"eventsA"`
+	EventsB uint64 `json:"eventsB"`
+	Matched uint64 `json:"matched"`
+	// Equal is the number of the matched events which have the same values and checksums.
+	Equal         uint64 `json:"equal"`
+	ValueDiffs    uint64 `json:"valueDiffs"`
+	ChecksumDiffs uint64 `json:"checksumDiffs"`
+	MissingInA    uint64 `json:"missingInA"`
+	MissingInB    uint64 `json:"missingInB"`
+	// Evicted is the number of the events evicted by the pending cap, they are not compared.
+	Evicted uint64 `json:"evicted"`
+	// Unmatchable is the number of the events without the commit ts, such as the avro delete event.
+	Unmatchable uint64 `json:"unmatchable,omitempty"`
+}
+
+type compareReport struct {
+	StartTime  time.Time       `json:"startTime"`
+	FinishTime time.Time       `json:"finishTime"`
+	Counters   compareCounters `json:"counters"`
+	// Differences are the first maxReportedFailures differences found.
+	Differences          []compareDifference `json:"differences"`
+	DifferencesTruncated bool                `json:"differencesTruncated,omitempty"`
+	// WindowExceeded notes the pending cap is reached, the events evicted are reported as the differences.
+	WindowExceeded string `json:"windowExceeded,omitempty"`
+	StopReason     string `json:"stopReason,omitempty"`
+	ExitCode       int    `json:"exitCode"`
+}
+
+// compareEvent is a row event waiting for the other side.
+type compareEvent struct {
+	side     int
+	key      string
+	table    string
+	row      *rowEvent
+	position comparePosition
+}
+
+// abComparer matches the row events of the two sides by the table, the handle key and the commit ts.
+// The events waiting for the other side are kept in the order they are seen, bounded by the max pending.
+type abComparer struct {
+	window     time.Duration
+	maxPending int
+	pending    [2]*list.List
+	entries    [2]map[string]*list.Element
+	// latest is the largest commit ts seen by each side.
+	latest [2]uint64
+	report *compareReport
+}
+
+func newABComparer(window time.Duration, maxPending int) *abComparer {
+	c := &abComparer{
+		window: window, maxPending: maxPending,
+		report: &compareReport{StartTime: time.Now(), Differences: []compareDifference{}},
+	}
+	for side := range c.pending {
+		c.pending[side] = list.New()
+		c.entries[side] = make(map[string]*list.Element)
+	}
+	return c
+}
+
+// compareKey returns the key of the row, the handle key columns are encoded as the checksum bytes,
+// so that the same value decoded by different protocols has the same key.
+func compareKey(table string, row *rowEvent) (string, error) {
+	var b bytes.Buffer
+	b.WriteString(table)
+	for _, column := range row.handleColumns() {
+		data, err := checksum.Bytes([]checksum.FieldMeta{{Name: column.name, MySQLType: column.mysqlType}},
+			[]interface{}{column.value})
+		if err != nil {
+			return "", err
+		}
+		b.WriteString("/" + column.name + "=" + hex.EncodeToString(data))
+	}
+	b.WriteString("@" + strconv.FormatUint(row.commitTs, 10))
+	return b.String(), nil
+}
+
+// observe matches the row of the side against the pending ones of the other side.
+func (c *abComparer) observe(side int, message kafka.Message, row *rowEvent) error {
+	if side == compareSideA {
+		c.report.Counters.EventsA++
+	} else {
+		c.report.Counters.EventsB++
+	}
+	if row.commitTs == 0 {
+		c.report.Counters.Unmatchable++
+		return nil
+	}
+	table := row.schema + "." + row.table
+	key, err := compareKey(table, row)
+	if err != nil {
+		return err
+	}
+	event := &compareEvent{
+		side: side, key: key, table: table, row: row,
+		position: comparePosition{Topic: message.Topic, Partition: message.Partition, Offset: message.Offset},
+	}
+	if row.commitTs > c.latest[side] {
+		c.latest[side] = row.commitTs
+	}
+	other := 1 - side
+	if element, ok := c.entries[other][key]; ok {
+		c.remove(other, element)
+		c.match(event, element.Value.(*compareEvent))
+	} else if _, ok := c.entries[side][key]; !ok {
+		// the duplicate event of the same side is not tracked twice.
+		c.entries[side][key] = c.pending[side].PushBack(event)
+	}
+	c.expire()
+	for c.pending[compareSideA].Len()+c.pending[compareSideB].Len() > c.maxPending {
+		longer := compareSideA
+		if c.pending[compareSideB].Len() > c.pending[compareSideA].Len() {
+			longer = compareSideB
+		}
+		front := c.pending[longer].Front()
+		c.remove(longer, front)
+		c.report.Counters.Evicted++
+		c.report.WindowExceeded = fmt.Sprintf("more than %d events wait for the other side, "+
+			"the oldest ones are evicted without comparison, increase the max pending or reduce the match window",
+			c.maxPending)
+		c.addMissing(front.Value.(*compareEvent), differenceKindEvicted)
+	}
+	return nil
+}
+
+func (c *abComparer) remove(side int, element *list.Element) {
+	c.pending[side].Remove(element)
+	delete(c.entries[side], element.Value.(*compareEvent).key)
+}
+
+// expire reports the pending events missing in the other side, if the other side is past them by the window.
+func (c *abComparer) expire() {
+	for side := range c.pending {
+		other := c.latest[1-side]
+		for c.pending[side].Len() > 0 {
+			front := c.pending[side].Front()
+			event := front.Value.(*compareEvent)
+			if !physicalTime(event.row.commitTs).Add(c.window).Before(physicalTime(other)) {
+				break
+			}
+			c.remove(side, front)
+			c.addMissing(event, differenceKindMissing)
+		}
+	}
+}
+
+// flush reports all pending events missing in the other side.
+func (c *abComparer) flush() {
+	for side := range c.pending {
+		for c.pending[side].Len() > 0 {
+			front := c.pending[side].Front()
+			c.remove(side, front)
+			c.addMissing(front.Value.(*compareEvent), differenceKindMissing)
+		}
+	}
+}
+
+func (c *abComparer) addMissing(event *compareEvent, kind string) {
+	d := compareDifference{Kind: kind, Table: event.table, Key: event.key, CommitTs: event.row.commitTs}
+	position := event.position
+	if event.side == compareSideA {
+		d.A = &position
+		if kind == differenceKindMissing {
+			c.report.Counters.MissingInB++
+		}
+	} else {
+		d.B = &position
+		if kind == differenceKindMissing {
+			c.report.Counters.MissingInA++
+		}
+	}
+	c.addDifference(d)
+}
+
+func (c *abComparer) addDifference(d compareDifference) {
+	if len(c.report.Differences) >= maxReportedFailures {
+		c.report.DifferencesTruncated = true
+		return
+	}
+	c.report.Differences = append(c.report.Differences, d)
+}
+
+// match compares the column values and the checksums of the matched events.
+func (c *abComparer) match(x, y *compareEvent) {
+	a, b := x, y
+	if a.side != compareSideA {
+		a, b = y, x
+	}
+	c.report.Counters.Matched++
+	positionA, positionB := a.position, b.position
+	d := compareDifference{Table: a.table, Key: a.key, CommitTs: a.row.commitTs, A: &positionA, B: &positionB}
+	if columns := differentColumns(a.row, b.row); len(columns) > 0 {
+		c.report.Counters.ValueDiffs++
+		d.Kind, d.Columns = differenceKindValue, columns
+		c.addDifference(d)
+		return
+	}
+	// the checksum is compared only if both sides carry it.
+	if a.row.expected != 0 && b.row.expected != 0 && a.row.expected != b.row.expected {
+		c.report.Counters.ChecksumDiffs++
+		d.Kind, d.ChecksumA, d.ChecksumB = differenceKindChecksum, a.row.expected, b.row.expected
+		c.addDifference(d)
+		return
+	}
+	c.report.Counters.Equal++
+}
+
+// differentColumns returns the columns whose values differ, the values are compared by the checksum bytes,
+// so that the same value decoded by different protocols is equal. Only the handle key columns are compared
+// if either row is deleted, since the deleted row may only carry them.
+func differentColumns(a, b *rowEvent) []string {
+	values := func(row *rowEvent, handleOnly bool) map[string][]byte {
+		result := make(map[string][]byte, len(row.columns))
+		for _, column := range row.columns {
+			if handleOnly && !column.handle {
+				continue
+			}
+			data, err := checksum.Bytes([]checksum.FieldMeta{{Name: column.name, MySQLType: column.mysqlType}},
+				[]interface{}{column.value})
+			if err != nil {
+				data = []byte(fmt.Sprintf("%T:%v", column.value, column.value))
+			}
+			result[column.name] = data
+		}
+		return result
+	}
+	handleOnly := a.deleted || b.deleted
+	valuesA, valuesB := values(a, handleOnly), values(b, handleOnly)
+	var result []string
+	for name, data := range valuesA {
+		if other, ok := valuesB[name]; !ok || !bytes.Equal(data, other) {
+			result = append(result, name)
+		}
+	}
+	for name := range valuesB {
+		if _, ok := valuesA[name]; !ok {
+			result = append(result, name)
+		}
+	}
+	sort.Strings(result)
+	return result
+}
+
+// sideMessage is the message fetched from a side.
+type sideMessage struct {
+	side    int
+	message kafka.Message
+	err     error
+}
+
+// runComparison consumes both sides concurrently until the context is done, or both are idle for the idle timeout.
+func runComparison(
+	ctx context.Context, readers [2]messageReader, verifiers [2]messageVerifier, c *abComparer, idleTimeout time.Duration,
+) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	messages := make(chan sideMessage)
+	for side, reader := range readers {
+		go func(side int, reader messageReader) {
+			for {
+				message, err := reader.FetchMessage(ctx)
+				select {
+				case messages <- sideMessage{side: side, message: message, err: err}:
+				case <-ctx.Done():
+					return
+				}
+				if err != nil {
+					return
+				}
+			}
+		}(side, reader)
+	}
+
+	var idle <-chan time.Time
+	done := 0
+	for done < len(readers) {
+		if idleTimeout > 0 {
+			idle = time.After(idleTimeout)
+		}
+		var m sideMessage
+		select {
+		case m = <-messages:
+		case <-idle:
+			log.Info("both topics are idle, stop the comparison", zap.Duration("idleTimeout", idleTimeout))
+			return nil
+		}
+		if m.err != nil {
+			if errors.Is(m.err, context.Canceled) || errors.Is(m.err, io.EOF) {
+				done++
+				continue
+			}
+			return newInfraError(m.err)
+		}
+		result, err := verifiers[m.side].verify(m.message)
+		if err != nil && !errors.Is(err, errChecksumMismatch) {
+			log.Error("decode the message failed", zap.Int("side", m.side), zap.String("topic", m.message.Topic),
+				zap.Int("partition", m.message.Partition), zap.Int64("offset", m.message.Offset), zap.Error(err))
+			return newDecodeError(err)
+		}
+		// the row whose own checksum mismatches is still compared, the other side may carry the same checksum.
+		rows := result.rows
+		if result.mismatch != nil {
+			rows = append(rows, result.mismatch)
+		}
+		for _, row := range rows {
+			if err := c.observe(m.side, m.message, row); err != nil {
+				return newDecodeError(err)
+			}
+		}
+	}
+	return nil
+}
+
+// finish reports the pending events if the comparison is not stopped by any error, and fills the final result.
+func (c *abComparer) finish(stopErr error) {
+	r := c.report
+	if stopErr == nil {
+		c.flush()
+	} else {
+		r.StopReason = stopErr.Error()
+	}
+	r.FinishTime = time.Now()
+	r.ExitCode = exitCodeOf(stopErr)
+	if r.ExitCode == exitCodeClean && len(r.Differences) > 0 {
+		r.ExitCode = exitCodeMismatch
+	}
+	log.Info("comparison finished", zap.Any("counters", r.Counters), zap.Int("exitCode", r.ExitCode))
+}
+
+func (r *compareReport) writeFile(path string) error {
+	content, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, content, 0o644)
+}
+
+// runCompare runs the `compare` command.
+func runCompare(args []string) int {
+	cfg := newDefaultCompareConfig()
+	fs := flag.NewFlagSet(commandCompare, flag.ExitOnError)
+	cfg.bindFlags(fs)
+	_ = fs.Parse(args)
+	if err := cfg.validate(); err != nil {
+		log.Fatal("invalid configuration", zap.Error(err))
+	}
+
+	ctx, cancel := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer cancel()
+
+	offset, _ := parseStartOffset(cfg.startOffset)
+	var (
+		readers   [2]messageReader
+		verifiers [2]messageVerifier
+	)
+	for side := range readers {
+		sideCfg := cfg.sideConfig(side)
+		v, err := newCompareVerifier(sideCfg)
+		if err != nil {
+			log.Error("create verifier failed", zap.Error(err))
+			return exitCodeOf(err)
+		}
+		reader, err := newPartitionReader(ctx, sideCfg, sideCfg.topic, nil, offset)
+		if err != nil {
+			log.Error("create reader failed", zap.String("topic", sideCfg.topic), zap.Error(err))
+			return exitCodeInfraError
+		}
+		defer reader.Close()
+		readers[side], verifiers[side] = reader, v
+	}
+
+	c := newABComparer(cfg.window, cfg.maxPending)
+	err := runComparison(ctx, readers, verifiers, c, cfg.idleTimeout)
+	if err != nil {
+		log.Error("comparison stopped", zap.Error(err))
+	}
+	c.finish(err)
+	if cfg.reportFile != "" {
+		if err := c.report.writeFile(cfg.reportFile); err != nil {
+			log.Warn("write report file failed", zap.String("file", cfg.reportFile), zap.Error(err))
+		}
+	}
+	return c.report.ExitCode
+}
@@ -0,0 +1,142 @@
+// Copyright 2023 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/pingcap/tidb/pkg/parser/mysql"
+	"github.com/segmentio/kafka-go"
+	"github.com/stretchr/testify/require"
+)
+
+// newCompareAvroMessage returns the avro message of the table `test`.`t` with the avro key, at the commit ts.
+func newCompareAvroMessage(t *testing.T, offset int64, id int64, name string, commitTs uint64) kafka.Message {
+	checksum := strconv.FormatUint(uint64(testRowChecksum(id, &name)), 10)
+	value := encodeTestMessage(t, testSchemaID, testValueSchema, newTestRow(id, &name, int64(commitTs), checksum))
+	key := encodeTestMessage(t, testKeySchemaID, testKeySchema, map[string]interface{}{"id": id})
+	return kafka.Message{Topic: "a", Offset: offset, Key: key, Value: value}
+}
+
+// newCompareCanalJSONMessage returns the canal-json message of the table `test`.`t`, at the commit ts.
+func newCompareCanalJSONMessage(offset int64, id int64, name string, commitTs uint64, checksum uint64) kafka.Message {
+	value := fmt.Sprintf(`{"id":0,"database":"test","table":"t","pkNames":["id"],"isDdl":false,"type":"INSERT",`+
+		`"es":1,"ts":1,"sql":"","sqlType":{"id":-5,"name":2005},"mysqlType":{"id":"bigint","name":"text"},`+
+		`"data":[{"id":"%d","name":"%s"}],"old":null,"_tidb":{"commitTs":%d,"_checksum":{"current":%d}}}`,
+		id, name, commitTs, checksum)
+	return kafka.Message{Topic: "b", Offset: offset, Value: []byte(value)}
+}
+
+func newTestCompareVerifiers(t *testing.T) [2]messageVerifier {
+	registry := newTestRegistry(t, map[int]string{testSchemaID: testValueSchema, testKeySchemaID: testKeySchema})
+	cfg := newDefaultCompareConfig()
+	cfg.schemaRegistryURL = registry.URL
+	cfg.protocols[compareSideB] = protocolCanalJSON
+	var result [2]messageVerifier
+	for side := range result {
+		v, err := newCompareVerifier(cfg.sideConfig(side))
+		require.NoError(t, err)
+		result[side] = v
+	}
+	return result
+}
+
+func TestCompare(t *testing.T) {
+	t.Parallel()
+
+	checksumOf := func(id int64, name string) uint64 { return uint64(testRowChecksum(id, &name)) }
+	second := uint64(1000) << 18
+	base := testTs(time.Date(2023, 12, 1, 0, 0, 0, 0, time.UTC))
+	a := &fakeReader{messages: []kafka.Message{
+		newCompareAvroMessage(t, 0, 1, "a", base),
+		newCompareAvroMessage(t, 1, 2, "b", base+1),
+		newCompareAvroMessage(t, 2, 3, "c", base+2),
+		newCompareAvroMessage(t, 3, 4, "d", base+3),
+	}}
+	b := &fakeReader{messages: []kafka.Message{
+		newCompareCanalJSONMessage(0, 1, "a", base, checksumOf(1, "a")),
+		newCompareCanalJSONMessage(1, 2, "x", base+1, checksumOf(2, "x")),
+		newCompareCanalJSONMessage(2, 3, "c", base+2, checksumOf(3, "c")+1),
+		// the event of the side A is expired by this one, which is past it by the window.
+		newCompareCanalJSONMessage(3, 5, "e", base+3+2*second, checksumOf(5, "e")),
+	}}
+
+	c := newABComparer(time.Second, 100)
+	err := runComparison(context.Background(), [2]messageReader{a, b}, newTestCompareVerifiers(t), c, 0)
+	require.NoError(t, err)
+	c.finish(nil)
+
+	r := c.report
+	require.Equal(t, compareCounters{
+		EventsA: 4, EventsB: 4, Matched: 3, Equal: 1, ValueDiffs: 1, ChecksumDiffs: 1, MissingInA: 1, MissingInB: 1,
+	}, r.Counters)
+	require.Equal(t, exitCodeMismatch, r.ExitCode)
+	kinds := make(map[string][]string)
+	for _, d := range r.Differences {
+		kinds[d.Kind] = append(kinds[d.Kind], fmt.Sprintf("%s a=%v b=%v", d.Table, d.A != nil, d.B != nil))
+		if d.Kind == differenceKindValue {
+			require.Equal(t, []string{"name"}, d.Columns)
+		}
+		if d.Kind == differenceKindChecksum {
+			require.Equal(t, checksumOf(3, "c"), d.ChecksumA)
+			require.Equal(t, checksumOf(3, "c")+1, d.ChecksumB)
+		}
+	}
+	require.Equal(t, map[string][]string{
+		differenceKindValue:    {"test.t a=true b=true"},
+		differenceKindChecksum: {"test.t a=true b=true"},
+		differenceKindMissing:  {"test.t a=true b=false", "test.t a=false b=true"},
+	}, kinds)
+}
+
+func TestCompareEviction(t *testing.T) {
+	t.Parallel()
+
+	c := newABComparer(time.Hour, 2)
+	for i := 0; i < 3; i++ {
+		row := &rowEvent{schema: "test", table: "t", commitTs: uint64(100 + i), columns: []rowColumn{
+			{name: "id", mysqlType: mysql.TypeLonglong, handle: true, value: int64(i)},
+		}}
+		require.NoError(t, c.observe(compareSideA, kafka.Message{Offset: int64(i)}, row))
+	}
+	// the event without the commit ts, such as the avro delete event, cannot be matched.
+	require.NoError(t, c.observe(compareSideB, kafka.Message{}, &rowEvent{deleted: true}))
+	require.Equal(t, uint64(1), c.report.Counters.Evicted)
+	require.Equal(t, uint64(1), c.report.Counters.Unmatchable)
+	require.NotEmpty(t, c.report.WindowExceeded)
+	require.Equal(t, differenceKindEvicted, c.report.Differences[0].Kind)
+	require.Equal(t, int64(0), c.report.Differences[0].A.Offset)
+
+	c.finish(nil)
+	require.Equal(t, uint64(2), c.report.Counters.MissingInB)
+	require.Equal(t, exitCodeMismatch, c.report.ExitCode)
+}
+
+func TestCompareConfigValidate(t *testing.T) {
+	t.Parallel()
+
+	cfg := newDefaultCompareConfig()
+	require.ErrorContains(t, cfg.validate(), "both topics must be set")
+	cfg.topics = [2]string{"a", "b"}
+	require.NoError(t, cfg.validate())
+	cfg.protocols[compareSideB] = protocolDebezium
+	require.ErrorContains(t, cfg.validate(), "only the avro and canal-json protocols")
+	cfg.protocols[compareSideB] = protocolCanalJSON
+	cfg.maxPending = 0
+	require.ErrorContains(t, cfg.validate(), "must be positive")
+}
@@ -0,0 +1,654 @@
+// Copyright 2023 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"errors"
+	"flag"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+)
+
+const (
+	startOffsetEarliest = "earliest"
+	startOffsetLatest   = "latest"
+)
+
+// unlimitedMismatchBudget tolerates all mismatches, the verification never stops on them.
+const unlimitedMismatchBudget = -1
+
+type config struct {
+	kafkaAddr         string
+	schemaRegistryURL string
+
+	topic           string
+	consumerGroupID string
+	// ddlTopic is the topic of the DDL events, consumed from the same kafka to track the schema changes if set.
+	ddlTopic string
+	// protocol is the protocol used by the changefeed to encode the messages.
+	protocol string
+	// simpleEncoding is the encoding of the simple protocol, `json` or `avro`.
+	simpleEncoding string
+	// simpleSchemaCacheSize is the maximum number of table schemas kept for the simple protocol.
+	simpleSchemaCacheSize int
+
+	// includeTables and excludeTables are the comma-separated `db.table` patterns with `*` wildcards,
+	// the messages of the tables not included, or excluded, are committed without verification.
+	includeTables string
+	excludeTables string
+
+	// sampleRate is the ratio of the messages verified, decided by the partition and offset, in (0, 1].
+	sampleRate float64
+	// sampleEveryN verifies the message whose offset is a multiple of it, disabled if 0.
+	sampleEveryN int
+
+	// keyFilters and keyFiltersHex are the `col=value` conditions ANDed, only the events matching them are verified,
+	// the value of the hex ones is the hex encoded bytes, for the binary columns.
+	keyFilters    stringsFlag
+	keyFiltersHex stringsFlag
+	// ops are the comma-separated operations to verify, `insert`, `update` or `delete`, all operations if empty.
+	ops string
+
+	// checkKeyPartition checks all events of a key are sent to the same partition, keyPartitionCapacity keys are tracked.
+	checkKeyPartition    bool
+	keyPartitionCapacity int
+	// dedupWindow is the commit ts window in which the duplicate events are counted, disabled if 0,
+	// at most dedupCapacity events are tracked.
+	dedupWindow   time.Duration
+	dedupCapacity int
+	// stateDir is the directory of the on-disk store of the dedup, key partition and debezium ordering tracking,
+	// which survives the restart, they are tracked in memory if it's empty. The entries not seen within stateTTL are removed.
+	stateDir string
+	stateTTL time.Duration
+	// freezeSchema fails the message whose table changes the schema ID, for the pipelines not expecting schema changes.
+	freezeSchema bool
+	// export writes each decoded row to exportFile, in the `jsonl` or `csv` format, disabled if empty,
+	// the file is rotated once it reaches exportRotateSize bytes, never rotated if 0.
+	export           string
+	exportFile       string
+	exportRotateSize int64
+	// bisect recomputes the checksum of the mismatched row under the alternative hypotheses,
+	// bisectTimeZones are the comma-separated time zones tried for the TIMESTAMP columns.
+	bisect          bool
+	bisectTimeZones string
+	// salvage reports the row whose columns cannot be handled as not computable, along with the columns failed,
+	// instead of failing the message as a decode error.
+	salvage bool
+	// onUnknownType is how the column of the unknown TiDB type is handled, `fail`, `skip-column` or `skip-table`.
+	onUnknownType string
+	// skipSchemaCheck skips checking the avro type of each column against its tidb_type, once the schema is first used
+	// and by the audit, for the valid combinations not known by the verifier.
+	skipSchemaCheck bool
+	// preflight audits the schemas to be used before the verification, which refuses to start on the unsupported ones
+	// unless force is set.
+	preflight bool
+	force     bool
+	// expectedColumns asserts the columns carried by the message of the tables, `db.table=col1,col2` separated by `;`,
+	// such as those projected by the column selector of the changefeed.
+	expectedColumns string
+
+	// startCommitTs and endCommitTs are the inclusive commit ts window to verify, a TSO or an RFC3339 timestamp,
+	// events outside it are committed without verification. Unbounded if empty.
+	startCommitTs string
+	endCommitTs   string
+	// commitTsMissing is how the event without the commit ts is handled in the window, `lenient` or `strict`.
+	commitTsMissing string
+	// bounded stops the verification once every partition is past the end commit ts.
+	bounded bool
+
+	// startOffset is the position to start consuming from, one of `earliest`, `latest` or an offset number.
+	// If it's empty, the consumer group is used, and the consumption starts from the group committed offset.
+	// Otherwise, each partition is consumed explicitly, and no offset is committed to the consumer group.
+	startOffset string
+
+	// checkpointFile is the path of the file to persist the verification progress. Disabled if it's empty.
+	checkpointFile     string
+	checkpointInterval time.Duration
+	// resume seeds the start position of each partition and the counters from the checkpoint file.
+	resume bool
+
+	// failFast stops the verification on the first mismatch or decode error.
+	failFast bool
+	// mismatchBudget is the number of mismatches tolerated, the verification stops if it's exceeded.
+	// None is tolerated if 0, and unlimited if unlimitedMismatchBudget.
+	mismatchBudget int
+	// reportFile is the path to write the final report in JSON format. Disabled if it's empty.
+	reportFile string
+	// resolvedTsStall is the threshold to alert if the resolved ts of a partition does not advance. Disabled if 0.
+	resolvedTsStall time.Duration
+	// resolvedTsJump is the threshold to warn if a resolved ts jumps far ahead of the last event of the partition,
+	// which is reported as a gap of the commit ts coverage. Disabled if 0.
+	resolvedTsJump time.Duration
+	// progressInterval is the interval to log the counters and the latency. Disabled if 0.
+	progressInterval time.Duration
+	// kafkaTimestampType is the type of the kafka message timestamp, `create-time` or `log-append-time`,
+	// which is stated in the report of the skew against the commit.
+	kafkaTimestampType string
+	// maxSkew is the skew of the kafka message timestamp allowed beyond the commit,
+	// the event whose timestamp is earlier than the commit or later beyond it is an ordering violation. Disabled if 0.
+	maxSkew time.Duration
+
+	// storageDir is the local directory of the storage sink output, a path or a `file://` URI,
+	// the files are verified offline if it's set, no kafka or schema registry involved.
+	storageDir string
+	// replay is the directory or the line file of the dumped messages, they are verified instead of consuming kafka,
+	// replayEncoding is how the key and value are encoded in the line file, `base64` or `hex`.
+	replay         string
+	replayEncoding string
+	// schemaDir is the directory of the local avro schema files named `<schema ID>.avsc`, used instead of the schema
+	// registry if set.
+	schemaDir string
+	// schemaRefreshInterval is the minimum interval to fetch the schema of an ID again, once the cached one fails to
+	// decode the value, since the schema may be updated in the registry. Disabled if 0.
+	schemaRefreshInterval time.Duration
+
+	// downstreamDSN is the DSN of the downstream MySQL or TiDB, the verified rows are cross-checked against it if set.
+	downstreamDSN string
+	// downstreamSampleRate is the ratio of the verified rows to be cross-checked, in (0, 1].
+	downstreamSampleRate float64
+	// downstreamGrace is the time to wait for the downstream to apply the row, before reporting the difference.
+	downstreamGrace time.Duration
+
+	// upstreamDSN is the DSN of the upstream TiDB, the mismatched rows are compared against its snapshot if set.
+	upstreamDSN string
+	// upstreamSampleRate is the ratio of the verified rows to be compared against the upstream for calibration.
+	upstreamSampleRate float64
+}
+
+func newDefaultConfig() *config {
+	return &config{
+		kafkaAddr:             "127.0.0.1:9092",
+		schemaRegistryURL:     "http://127.0.0.1:8081",
+		topic:                 "avro-checksum-test",
+		consumerGroupID:       "avro-checksum-test",
+		protocol:              protocolAvro,
+		simpleEncoding:        simpleEncodingJSON,
+		simpleSchemaCacheSize: 4096,
+		keyPartitionCapacity:  1 << 20,
+		dedupCapacity:         1 << 20,
+		stateTTL:              7 * 24 * time.Hour,
+		bisectTimeZones:       "UTC,Asia/Shanghai,America/New_York,Europe/London",
+		commitTsMissing:       commitTsMissingLenient,
+		onUnknownType:         unknownTypeFail,
+		checkpointInterval:    10 * time.Second,
+		progressInterval:      time.Minute,
+		kafkaTimestampType:    timestampCreateTime,
+		replayEncoding:        replayEncodingBase64,
+		schemaRefreshInterval: time.Minute,
+		resolvedTsJump:        5 * time.Minute,
+		sampleRate:            1,
+		downstreamSampleRate:  1,
+		downstreamGrace:       10 * time.Second,
+	}
+}
+
+func (c *config) bindFlags(fs *flag.FlagSet) {
+	fs.StringVar(&c.kafkaAddr, "kafka-addr", c.kafkaAddr, "kafka broker address")
+	fs.StringVar(&c.schemaRegistryURL, "schema-registry-url", c.schemaRegistryURL, "schema registry url")
+	fs.StringVar(&c.topic, "topic", c.topic, "kafka topic to consume")
+	fs.StringVar(&c.consumerGroupID, "group-id", c.consumerGroupID, "kafka consumer group id")
+	fs.StringVar(&c.ddlTopic, "ddl-topic", c.ddlTopic,
+		"kafka topic of the DDL events, consume it from the beginning to track the schema changes, disabled if empty")
+	fs.StringVar(&c.protocol, "protocol", c.protocol,
+		"protocol of the messages, `avro`, `canal-json`, `open`, `simple` or `debezium`")
+	fs.StringVar(&c.simpleEncoding, "simple-encoding", c.simpleEncoding,
+		"encoding of the simple protocol, `json` or `avro`")
+	fs.IntVar(&c.simpleSchemaCacheSize, "simple-schema-cache-size", c.simpleSchemaCacheSize,
+		"maximum number of table schemas kept for the simple protocol, the least recently used one is evicted")
+	fs.StringVar(&c.includeTables, "include-tables", c.includeTables,
+		"comma-separated `db.table` patterns of the tables to verify, `*` matches any characters, all tables if empty")
+	fs.StringVar(&c.excludeTables, "exclude-tables", c.excludeTables,
+		"comma-separated `db.table` patterns of the tables not to verify, `*` matches any characters")
+	fs.Float64Var(&c.sampleRate, "sample-rate", c.sampleRate,
+		"ratio of the messages verified, in (0, 1], the unsampled messages are committed with only the commit ts read, "+
+			"only for the avro protocol")
+	fs.IntVar(&c.sampleEveryN, "sample-every-n", c.sampleEveryN,
+		"verify the message whose offset is a multiple of n, the others are committed with only the commit ts read, "+
+			"disabled if 0, only for the avro protocol")
+	fs.Var(&c.keyFilters, "key-filter",
+		"verify only the events whose column matches, such as `id=1`, matched against the handle columns in the key, "+
+			"or the value if the key is not avro, can be set more than once and all must match, only for the avro protocol")
+	fs.Var(&c.keyFiltersHex, "key-filter-hex",
+		"the same as key-filter, but the value is the hex encoded bytes, such as `k=0a1b`, for the binary columns")
+	fs.StringVar(&c.ops, "ops", c.ops,
+		"comma-separated operations to verify, `insert`, `update` or `delete`, all operations if empty")
+	fs.BoolVar(&c.checkKeyPartition, "check-key-partition", c.checkKeyPartition,
+		"check all events of a key are sent to the same partition, as the default key dispatcher does, "+
+			"do not set it if the table or ts dispatcher is used, only for the avro protocol")
+	fs.IntVar(&c.keyPartitionCapacity, "key-partition-capacity", c.keyPartitionCapacity,
+		"maximum number of keys tracked by the key partition check, the least recently seen one is evicted")
+	fs.DurationVar(&c.dedupWindow, "dedup-window", c.dedupWindow,
+		"count the events delivered more than once in the window of the commit ts, such as `10m`, "+
+			"the same event carrying a different checksum fails, disabled if 0, only for the avro protocol")
+	fs.IntVar(&c.dedupCapacity, "dedup-capacity", c.dedupCapacity,
+		"maximum number of events tracked by the dedup window, the oldest one is evicted")
+	fs.StringVar(&c.stateDir, "state-dir", c.stateDir,
+		"directory to keep the dedup, key partition and debezium ordering tracking on disk instead of the memory, "+
+			"the tracking survives the restart and is not bounded by the capacity, only one verifier of a topic can use it")
+	fs.DurationVar(&c.stateTTL, "state-ttl", c.stateTTL,
+		"remove the key tracked in the state dir if it's not seen within the duration")
+	fs.BoolVar(&c.freezeSchema, "freeze-schema", c.freezeSchema,
+		"fail the message whose table changes the schema ID, as a decode error, only for the avro protocol")
+	fs.StringVar(&c.export, "export", c.export,
+		"export each decoded row in the canonical form for external diffing, `jsonl` or `csv`, "+
+			"the CSV file is split by the table, disabled if empty, only for the avro protocol")
+	fs.StringVar(&c.exportFile, "export-file", c.exportFile,
+		"file to export the decoded rows to, the table and the rotation index are inserted before the extension")
+	fs.Int64Var(&c.exportRotateSize, "export-rotate-size", c.exportRotateSize,
+		"rotate the export file once it reaches the size in bytes, never rotated if 0")
+	fs.BoolVar(&c.bisect, "bisect", c.bisect,
+		"recompute the checksum of the mismatched row under the alternative time zones, decimal formatting, "+
+			"charsets and signedness, and report the one making it match, only for the avro protocol")
+	fs.StringVar(&c.bisectTimeZones, "bisect-timezones", c.bisectTimeZones,
+		"comma-separated time zones tried for the TIMESTAMP columns by the bisection")
+	fs.BoolVar(&c.salvage, "salvage", c.salvage,
+		"report the row whose columns cannot be handled as not computable, along with the raw value of each column failed, "+
+			"and go on verifying, only for the avro protocol")
+	fs.StringVar(&c.onUnknownType, "on-unknown-type", c.onUnknownType,
+		"how the column of the unknown TiDB type is handled, `fail` the message as a decode error, "+
+			"`skip-column` to leave it out of the checksum calculation, or `skip-table` to skip the whole table, "+
+			"only the avro protocol supports the skipping")
+	fs.BoolVar(&c.skipSchemaCheck, "skip-schema-check", c.skipSchemaCheck,
+		"skip checking the avro type of each column against its tidb_type in the connect.parameters, "+
+			"which fails the schema contradicting itself before any message of it is verified, "+
+			"set it for the valid combinations not known by the verifier")
+	fs.BoolVar(&c.preflight, "preflight", c.preflight,
+		"audit the schemas of the topic, or in the schema dir, before the verification, "+
+			"refuse to start if any of them cannot be handled, only for the avro protocol")
+	fs.BoolVar(&c.force, "force", c.force,
+		"start the verification even if the preflight audit finds the unsupported schemas")
+	fs.StringVar(&c.expectedColumns, "expected-columns", c.expectedColumns,
+		"columns expected in the message of the tables, such as `db.t1=c1,c2;db.t2=c1`, "+
+			"fail the message carrying a different column set, only for the avro and canal-json protocols")
+	fs.StringVar(&c.startCommitTs, "start-commit-ts", c.startCommitTs,
+		"verify the events whose commit ts is not smaller than it, a TSO or an RFC3339 timestamp")
+	fs.StringVar(&c.endCommitTs, "end-commit-ts", c.endCommitTs,
+		"verify the events whose commit ts is not larger than it, a TSO or an RFC3339 timestamp")
+	fs.StringVar(&c.commitTsMissing, "commit-ts-missing", c.commitTsMissing,
+		"handle the event without the commit ts in the commit ts window, "+
+			"`lenient` to verify it, or `strict` to fail it")
+	fs.BoolVar(&c.bounded, "bounded", c.bounded,
+		"exit once every partition has an event or a resolved ts past the end commit ts")
+	fs.StringVar(&c.startOffset, "start-offset", c.startOffset,
+		"consume each partition explicitly from `earliest`, `latest` or the given offset, "+
+			"instead of the consumer group committed offset")
+	fs.StringVar(&c.checkpointFile, "checkpoint-file", c.checkpointFile,
+		"file to persist the verification progress, disabled if empty")
+	fs.DurationVar(&c.checkpointInterval, "checkpoint-interval", c.checkpointInterval,
+		"interval to persist the checkpoint file")
+	fs.BoolVar(&c.resume, "resume", c.resume,
+		"resume the start position and counters from the checkpoint file")
+	fs.BoolVar(&c.failFast, "fail-fast", c.failFast,
+		"exit immediately on the first mismatch or decode error, without committing the message")
+	fs.IntVar(&c.mismatchBudget, "mismatch-budget", c.mismatchBudget,
+		"number of checksum mismatches tolerated before the verification stops, stop on the first one if 0, "+
+			"unlimited if -1, the exit code is still non-zero if any mismatch found")
+	fs.StringVar(&c.reportFile, "report-file", c.reportFile,
+		"file to write the final report in JSON format, disabled if empty")
+	fs.DurationVar(&c.resolvedTsStall, "resolved-ts-stall", c.resolvedTsStall,
+		"alert if the resolved ts of a partition does not advance for the duration, such as `5m`, disabled if 0")
+	fs.DurationVar(&c.resolvedTsJump, "resolved-ts-jump", c.resolvedTsJump,
+		"warn if a resolved ts jumps ahead of the last event of the partition by more than the duration, "+
+			"reported as a gap of the commit ts coverage, disabled if 0")
+	fs.DurationVar(&c.progressInterval, "progress-interval", c.progressInterval,
+		"interval to log the counters and the p50 and p99 end-to-end latency, disabled if 0")
+	fs.StringVar(&c.kafkaTimestampType, "kafka-timestamp-type", c.kafkaTimestampType,
+		"type of the kafka message timestamp set by the topic, `create-time` or `log-append-time`, "+
+			"stated in the report of the skew against the commit")
+	fs.DurationVar(&c.maxSkew, "max-skew", c.maxSkew,
+		"report the event whose kafka message timestamp is earlier than the commit, "+
+			"or later by more than the duration, as an ordering violation, such as `1m`, disabled if 0")
+	fs.StringVar(&c.storageDir, "storage-dir", c.storageDir,
+		"local directory of the storage sink output, a path or a `file://` URI, "+
+			"verify the canal-json files in it offline instead of consuming kafka, "+
+			"the external storage such as `s3://` is not supported, sync the bucket prefix to the local disk first")
+	fs.StringVar(&c.replay, "replay", c.replay,
+		"directory or line file of the dumped messages, such as by kcat, verify them instead of consuming kafka, "+
+			"each file of the directory is a message value, each line of the file is `[<key> ]<value>`")
+	fs.StringVar(&c.replayEncoding, "replay-encoding", c.replayEncoding,
+		"encoding of the key and value in the line file of the replay, `base64` or `hex`")
+	fs.StringVar(&c.schemaDir, "schema-dir", c.schemaDir,
+		"directory of the avro schema files named `<schema ID>.avsc`, used instead of the schema registry if set")
+	fs.DurationVar(&c.schemaRefreshInterval, "schema-refresh-interval", c.schemaRefreshInterval,
+		"minimum interval to fetch the schema of an ID again once the cached one fails to decode the value, "+
+			"the value is decoded once more by the schema fetched, disabled if 0")
+	fs.StringVar(&c.downstreamDSN, "downstream-dsn", c.downstreamDSN,
+		"DSN of the downstream MySQL or TiDB, such as `root@tcp(127.0.0.1:3306)/`, "+
+			"cross-check the verified rows against it if set")
+	fs.Float64Var(&c.downstreamSampleRate, "downstream-sample-rate", c.downstreamSampleRate,
+		"ratio of the verified rows to be cross-checked against the downstream, in (0, 1]")
+	fs.DurationVar(&c.downstreamGrace, "downstream-grace", c.downstreamGrace,
+		"time to wait for the downstream to apply the row, before reporting the difference")
+	fs.StringVar(&c.upstreamDSN, "upstream-dsn", c.upstreamDSN,
+		"DSN of the upstream TiDB, compare the mismatched rows against the snapshot at the commit ts if set")
+	fs.Float64Var(&c.upstreamSampleRate, "upstream-sample-rate", c.upstreamSampleRate,
+		"ratio of the verified rows also compared against the upstream for calibration, in [0, 1]")
+}
+
+func (c *config) validate() error {
+	if c.downstreamDSN != "" {
+		if c.protocol != protocolAvro && c.protocol != protocolCanalJSON {
+			return errors.New("only the avro and canal-json protocols are supported by the downstream cross-check")
+		}
+		if c.downstreamSampleRate <= 0 || c.downstreamSampleRate > 1 {
+			return errors.New("downstream sample rate must be in (0, 1]")
+		}
+		if c.downstreamGrace < 0 {
+			return errors.New("downstream grace must not be negative")
+		}
+	}
+	if c.ddlTopic != "" && c.protocol != protocolAvro {
+		return errors.New("only the avro protocol is supported by the DDL topic")
+	}
+	if c.upstreamDSN != "" {
+		if c.protocol != protocolAvro && c.protocol != protocolCanalJSON {
+			return errors.New("only the avro and canal-json protocols are supported by the upstream comparison")
+		}
+		if c.upstreamSampleRate < 0 || c.upstreamSampleRate > 1 {
+			return errors.New("upstream sample rate must be in [0, 1]")
+		}
+	}
+	if _, err := newTableFilter(c.includeTables, c.excludeTables); err != nil {
+		return err
+	}
+	if _, err := parseOps(c.ops); err != nil {
+		return err
+	}
+	if err := c.validateSampling(); err != nil {
+		return err
+	}
+	if len(c.keyFilters) > 0 || len(c.keyFiltersHex) > 0 {
+		if c.protocol != protocolAvro {
+			return errors.New("only the avro protocol is supported by the key filter")
+		}
+		if c.sampleRate < 1 || c.sampleEveryN > 1 {
+			return errors.New("key filter and sampling cannot be set at the same time")
+		}
+		if _, err := newKeyFilter(c.keyFilters, c.keyFiltersHex); err != nil {
+			return err
+		}
+	}
+	if c.checkKeyPartition {
+		if c.protocol != protocolAvro {
+			return errors.New("only the avro protocol is supported by the key partition check")
+		}
+		if c.keyPartitionCapacity <= 0 {
+			return errors.New("key partition capacity must be positive")
+		}
+	}
+	if c.dedupWindow != 0 {
+		if c.protocol != protocolAvro {
+			return errors.New("only the avro protocol is supported by the dedup window")
+		}
+		if c.dedupWindow < 0 || c.dedupCapacity <= 0 {
+			return errors.New("dedup window and capacity must be positive")
+		}
+	}
+	if c.stateDir != "" {
+		if c.dedupWindow == 0 && !c.checkKeyPartition && c.protocol != protocolDebezium {
+			return errors.New("state dir is only used by the dedup window, the key partition check or the debezium protocol")
+		}
+		if c.stateTTL <= 0 {
+			return errors.New("state TTL must be positive")
+		}
+	}
+	if c.freezeSchema && c.protocol != protocolAvro {
+		return errors.New("only the avro protocol is supported by the schema freezing")
+	}
+	if c.export != "" {
+		if c.protocol != protocolAvro {
+			return errors.New("only the avro protocol is supported by the export")
+		}
+		if c.export != exportFormatJSONL && c.export != exportFormatCSV {
+			return errors.New("unknown export format: " + c.export)
+		}
+		if c.exportFile == "" {
+			return errors.New("export file must be set")
+		}
+		if c.exportRotateSize < 0 {
+			return errors.New("export rotate size must not be negative")
+		}
+	}
+	if c.bisect {
+		if c.protocol != protocolAvro {
+			return errors.New("only the avro protocol is supported by the bisection")
+		}
+		if _, err := newBisector(c.bisectTimeZones); err != nil {
+			return err
+		}
+	}
+	if c.salvage && c.protocol != protocolAvro {
+		return errors.New("only the avro protocol is supported by the salvage mode")
+	}
+	switch c.onUnknownType {
+	case unknownTypeFail:
+	case unknownTypeSkipColumn, unknownTypeSkipTable:
+		if c.protocol != protocolAvro {
+			return errors.New("only the avro protocol supports skipping the unknown TiDB types")
+		}
+	default:
+		return errors.New("unknown policy of the unknown TiDB type: " + c.onUnknownType)
+	}
+	if c.skipSchemaCheck && c.protocol != protocolAvro {
+		return errors.New("only the avro protocol checks the schemas")
+	}
+	if c.preflight && c.protocol != protocolAvro {
+		return errors.New("only the avro protocol is supported by the preflight audit")
+	}
+	if c.force && !c.preflight {
+		return errors.New("force is only for the preflight audit")
+	}
+	if c.expectedColumns != "" {
+		if c.protocol != protocolAvro && c.protocol != protocolCanalJSON {
+			return errors.New("only the avro and canal-json protocols are supported by the expected columns")
+		}
+		if _, err := parseExpectedColumns(c.expectedColumns); err != nil {
+			return err
+		}
+	}
+	if _, err := c.commitTsWindow(); err != nil {
+		return err
+	}
+	if c.bounded && c.endCommitTs == "" {
+		return errors.New("bounded run requires the end commit ts to be set")
+	}
+	if c.resolvedTsStall < 0 {
+		return errors.New("resolved ts stall must not be negative")
+	}
+	if c.resolvedTsJump < 0 {
+		return errors.New("resolved ts jump must not be negative")
+	}
+	if c.progressInterval < 0 {
+		return errors.New("progress interval must not be negative")
+	}
+	switch c.kafkaTimestampType {
+	case timestampCreateTime, timestampLogAppendTime:
+	default:
+		return errors.New("unknown kafka timestamp type: " + c.kafkaTimestampType)
+	}
+	if c.maxSkew < 0 {
+		return errors.New("max skew must not be negative")
+	}
+	if c.schemaRefreshInterval < 0 {
+		return errors.New("schema refresh interval must not be negative")
+	}
+	if c.schemaDir != "" && c.protocol != protocolAvro {
+		return errors.New("only the avro protocol is supported by the schema dir")
+	}
+	if c.storageDir != "" && c.replay != "" {
+		return errors.New("storage directory and replay cannot be set at the same time")
+	}
+	if c.storageDir != "" {
+		return c.validateOffline()
+	}
+	if c.replay != "" {
+		return c.validateReplay()
+	}
+	if c.topic == "" {
+		return errors.New("topic must be set")
+	}
+	switch c.protocol {
+	case protocolAvro, protocolCanalJSON, protocolOpen, protocolSimple, protocolDebezium:
+	default:
+		return errors.New("unknown protocol: " + c.protocol)
+	}
+	if c.simpleEncoding != simpleEncodingJSON && c.simpleEncoding != simpleEncodingAvro {
+		return errors.New("unknown simple encoding: " + c.simpleEncoding)
+	}
+	if c.simpleSchemaCacheSize <= 0 {
+		return errors.New("simple schema cache size must be positive")
+	}
+	if c.startOffset != "" {
+		if _, err := parseStartOffset(c.startOffset); err != nil {
+			return err
+		}
+	}
+	if c.resume && c.checkpointFile == "" {
+		return errors.New("resume requires the checkpoint file to be set")
+	}
+	if c.mismatchBudget < unlimitedMismatchBudget {
+		return errors.New("mismatch budget must not be negative, except -1 for unlimited")
+	}
+	if c.checkpointFile != "" && c.checkpointInterval <= 0 {
+		return errors.New("checkpoint interval must be positive")
+	}
+	return nil
+}
+
+func (c *config) validateSampling() error {
+	if c.sampleRate <= 0 || c.sampleRate > 1 {
+		return errors.New("sample rate must be in (0, 1]")
+	}
+	if c.sampleEveryN < 0 {
+		return errors.New("sample every n must not be negative")
+	}
+	if c.sampleRate < 1 && c.sampleEveryN > 0 {
+		return errors.New("sample rate and sample every n cannot be set at the same time")
+	}
+	if (c.sampleRate < 1 || c.sampleEveryN > 1) && c.protocol != protocolAvro {
+		return errors.New("only the avro protocol is supported by the sampling")
+	}
+	return nil
+}
+
+// validateOffline validates the configuration of verifying the storage directory offline.
+func (c *config) validateOffline() error {
+	if c.protocol != protocolCanalJSON {
+		return errors.New("only the canal-json protocol is supported by the storage directory")
+	}
+	if _, err := localStorageDir(c.storageDir); err != nil {
+		return err
+	}
+	if c.startOffset != "" || c.checkpointFile != "" || c.resume {
+		return errors.New("start offset and checkpoint are not supported by the storage directory")
+	}
+	if c.resolvedTsStall > 0 {
+		return errors.New("resolved ts stall is not supported by the storage directory, which carries no watermark")
+	}
+	if c.maxSkew > 0 {
+		return errors.New("max skew is not supported by the storage directory, which carries no kafka timestamp")
+	}
+	if c.bounded {
+		return errors.New("bounded run is not supported by the storage directory, which ends once all files are verified")
+	}
+	if c.mismatchBudget < unlimitedMismatchBudget {
+		return errors.New("mismatch budget must not be negative, except -1 for unlimited")
+	}
+	return nil
+}
+
+// validateReplay validates the configuration of replaying the dumped messages.
+func (c *config) validateReplay() error {
+	if c.replayEncoding != replayEncodingBase64 && c.replayEncoding != replayEncodingHex {
+		return errors.New("unknown replay encoding: " + c.replayEncoding)
+	}
+	if c.startOffset != "" || c.checkpointFile != "" || c.resume {
+		return errors.New("start offset and checkpoint are not supported by the replay")
+	}
+	if c.ddlTopic != "" {
+		return errors.New("DDL topic is not supported by the replay")
+	}
+	if c.resolvedTsStall > 0 || c.checkKeyPartition || c.bounded {
+		return errors.New("resolved ts stall, key partition check and bounded run are not supported by the replay, " +
+			"whose messages may not be in the order of the topic partitions")
+	}
+	if c.maxSkew > 0 {
+		return errors.New("max skew is not supported by the replay, whose messages carry no kafka timestamp")
+	}
+	if c.mismatchBudget < unlimitedMismatchBudget {
+		return errors.New("mismatch budget must not be negative, except -1 for unlimited")
+	}
+	return nil
+}
+
+// commitTsWindow returns the commit ts window to verify, nil if unbounded.
+func (c *config) commitTsWindow() (*commitTsWindow, error) {
+	if c.commitTsMissing != commitTsMissingLenient && c.commitTsMissing != commitTsMissingStrict {
+		return nil, errors.New("unknown commit ts missing policy: " + c.commitTsMissing)
+	}
+	if c.startCommitTs == "" && c.endCommitTs == "" {
+		return nil, nil
+	}
+	w := &commitTsWindow{strict: c.commitTsMissing == commitTsMissingStrict}
+	var err error
+	if c.startCommitTs != "" {
+		if w.start, err = parseCommitTs(c.startCommitTs); err != nil {
+			return nil, err
+		}
+	}
+	if c.endCommitTs != "" {
+		if w.end, err = parseCommitTs(c.endCommitTs); err != nil {
+			return nil, err
+		}
+		if w.end < w.start {
+			return nil, errors.New("end commit ts must not be smaller than the start commit ts")
+		}
+	}
+	return w, nil
+}
+
+// explicitOffset returns true if each partition should be consumed from an explicit offset,
+// instead of the consumer group committed offset.
+func (c *config) explicitOffset() bool {
+	return c.startOffset != "" || c.resume
+}
+
+func parseStartOffset(s string) (int64, error) {
+	switch s {
+	case "", startOffsetEarliest:
+		return kafka.FirstOffset, nil
+	case startOffsetLatest:
+		return kafka.LastOffset, nil
+	}
+	offset, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || offset < 0 {
+		return 0, errors.New("invalid start offset, should be `earliest`, `latest` or a non-negative number")
+	}
+	return offset, nil
+}
+
+// stringsFlag is the flag which can be set more than once, each value is appended.
+type stringsFlag []string
+
+func (f *stringsFlag) String() string {
+	return strings.Join(*f, ",")
+}
+
+func (f *stringsFlag) Set(value string) error {
+	*f = append(*f, value)
+	return nil
+}
@@ -0,0 +1,168 @@
+// Copyright 2023 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"time"
+
+	"github.com/pingcap/log"
+	"go.uber.org/zap"
+)
+
+// commitTsRange is the range of the commit ts of the verified row events.
+type commitTsRange struct {
+	MinCommitTs uint64 `json:"minCommitTs"`
+	MaxCommitTs uint64 `json:"maxCommitTs"`
+	Verified    uint64 `json:"verified"`
+}
+
+func (r *commitTsRange) add(commitTs uint64) {
+	if r.Verified == 0 || commitTs < r.MinCommitTs {
+		r.MinCommitTs = commitTs
+	}
+	if commitTs > r.MaxCommitTs {
+		r.MaxCommitTs = commitTs
+	}
+	r.Verified++
+}
+
+// resolvedGap is a resolved ts jumping far ahead of the last event of the partition, no event between them is seen,
+// which usually means a filter or a dispatcher sends some tables elsewhere, or the messages are lost.
+type resolvedGap struct {
+	Partition int `json:"partition"`
+	// FromTs is the larger one of the commit ts of the last event and the previous resolved ts of the partition.
+	FromTs     uint64 `json:"fromTs"`
+	ResolvedTs uint64 `json:"resolvedTs"`
+	// Jump is the physical time between them, such as `5m0s`.
+	Jump string `json:"jump"`
+}
+
+// coverageReport is the commit ts coverage of the verification, so that the verification is stated by the TSO.
+type coverageReport struct {
+	// FromTs and ToTs bound the commit ts (FromTs, ToTs] of the events delivered completely to all partitions seen,
+	// FromTs is the largest first resolved ts of them, and ToTs the smallest last one, both 0 if there is no such range.
+	FromTs uint64 `json:"fromTs,omitempty"`
+	ToTs   uint64 `json:"toTs,omitempty"`
+	// Tables and Partitions are the commit ts ranges of the verified row events of each table and partition.
+	Tables     map[string]commitTsRange `json:"tables,omitempty"`
+	Partitions map[int]commitTsRange    `json:"partitions,omitempty"`
+	// Gaps are the first maxReportedFailures gaps found, GapCount counts all of them.
+	Gaps     []resolvedGap `json:"gaps,omitempty"`
+	GapCount uint64        `json:"gapCount,omitempty"`
+}
+
+// partitionCoverage is the coverage of a partition.
+type partitionCoverage struct {
+	verified commitTsRange
+	// firstResolvedTs is the first resolved ts received in the run, 0 if none.
+	firstResolvedTs uint64
+	// lastResolvedTs is the largest resolved ts received in the run.
+	lastResolvedTs uint64
+	// lastTs is the larger one of the commit ts of the last event and the resolved ts.
+	lastTs uint64
+}
+
+// commitTsCoverage tracks the commit ts coverage of each table and partition, it's guarded by the resolvedTracker.
+type commitTsCoverage struct {
+	// jump is the physical time a resolved ts can advance past the last event, the gap is not detected if 0.
+	jump       time.Duration
+	tables     map[string]*commitTsRange
+	partitions map[int]*partitionCoverage
+	gaps       []resolvedGap
+	gapCount   uint64
+}
+
+func newCommitTsCoverage(jump time.Duration) *commitTsCoverage {
+	return &commitTsCoverage{
+		jump: jump, tables: make(map[string]*commitTsRange), partitions: make(map[int]*partitionCoverage),
+	}
+}
+
+// observe records the event of the message, the message failed is not observed.
+func (c *commitTsCoverage) observe(partition int, result messageResult) {
+	p, ok := c.partitions[partition]
+	if !ok {
+		p = &partitionCoverage{}
+		c.partitions[partition] = p
+	}
+	if result.commitTs != 0 {
+		if result.outcome == outcomeVerified || result.outcome == outcomeVerifiedWithCaveats {
+			p.verified.add(result.commitTs)
+			if result.table != "" {
+				table, ok := c.tables[result.table]
+				if !ok {
+					table = &commitTsRange{}
+					c.tables[result.table] = table
+				}
+				table.add(result.commitTs)
+			}
+		}
+		p.lastTs = max(p.lastTs, result.commitTs)
+	}
+	if result.resolvedTs == 0 {
+		return
+	}
+	if p.firstResolvedTs == 0 {
+		p.firstResolvedTs = result.resolvedTs
+	}
+	if c.jump > 0 && p.lastTs != 0 && result.resolvedTs > p.lastTs {
+		if jump := physicalTime(result.resolvedTs).Sub(physicalTime(p.lastTs)); jump > c.jump {
+			gap := resolvedGap{Partition: partition, FromTs: p.lastTs, ResolvedTs: result.resolvedTs, Jump: jump.String()}
+			log.Warn("resolved ts jumps far ahead of the last event of the partition, "+
+				"a filter or a dispatcher may send some tables elsewhere", zap.Int("partition", partition),
+				zap.Uint64("fromTs", gap.FromTs), zap.Uint64("resolvedTs", gap.ResolvedTs), zap.Duration("jump", jump))
+			c.gapCount++
+			if len(c.gaps) < maxReportedFailures {
+				c.gaps = append(c.gaps, gap)
+			}
+		}
+	}
+	p.lastResolvedTs = max(p.lastResolvedTs, result.resolvedTs)
+	p.lastTs = max(p.lastTs, result.resolvedTs)
+}
+
+// snapshot returns the coverage, nil if neither verified event nor resolved ts is observed.
+func (c *commitTsCoverage) snapshot() *coverageReport {
+	report := &coverageReport{GapCount: c.gapCount, Gaps: append([]resolvedGap(nil), c.gaps...)}
+	complete := len(c.partitions) > 0
+	for partition, p := range c.partitions {
+		if p.verified.Verified > 0 {
+			if report.Partitions == nil {
+				report.Partitions = make(map[int]commitTsRange)
+			}
+			report.Partitions[partition] = p.verified
+		}
+		if p.firstResolvedTs == 0 {
+			complete = false
+			continue
+		}
+		report.FromTs = max(report.FromTs, p.firstResolvedTs)
+		if report.ToTs == 0 || p.lastResolvedTs < report.ToTs {
+			report.ToTs = p.lastResolvedTs
+		}
+	}
+	if !complete || report.FromTs >= report.ToTs {
+		report.FromTs, report.ToTs = 0, 0
+	}
+	for table, r := range c.tables {
+		if report.Tables == nil {
+			report.Tables = make(map[string]commitTsRange)
+		}
+		report.Tables[table] = *r
+	}
+	if report.Partitions == nil && report.ToTs == 0 && report.GapCount == 0 {
+		return nil
+	}
+	return report
+}
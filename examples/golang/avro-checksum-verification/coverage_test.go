@@ -0,0 +1,115 @@
+// Copyright 2023 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+	"github.com/stretchr/testify/require"
+)
+
+// secondTs returns the TSO whose physical time is the seconds since the epoch.
+func secondTs(seconds int64) uint64 {
+	return testTs(time.Unix(seconds, 0))
+}
+
+func TestCommitTsCoverage(t *testing.T) {
+	t.Parallel()
+
+	coverage := newCommitTsCoverage(time.Minute)
+	require.Nil(t, coverage.snapshot())
+
+	coverage.observe(0, messageResult{outcome: outcomeVerified, table: "test.a", commitTs: secondTs(10)})
+	coverage.observe(0, messageResult{outcome: outcomeSkippedNonRow, resolvedTs: secondTs(20)})
+	coverage.observe(0, messageResult{outcome: outcomeVerified, table: "test.b", commitTs: secondTs(30)})
+	// the events not verified are not in the ranges.
+	coverage.observe(0, messageResult{outcome: outcomeSkippedNoChecksum, table: "test.a", commitTs: secondTs(40)})
+	coverage.observe(1, messageResult{outcome: outcomeVerified, table: "test.a", commitTs: secondTs(5)})
+	// the partition 1 has no resolved ts yet, the range delivered completely is unknown.
+	report := coverage.snapshot()
+	require.Zero(t, report.FromTs)
+	require.Zero(t, report.ToTs)
+	require.Equal(t, map[string]commitTsRange{
+		"test.a": {MinCommitTs: secondTs(5), MaxCommitTs: secondTs(10), Verified: 2},
+		"test.b": {MinCommitTs: secondTs(30), MaxCommitTs: secondTs(30), Verified: 1},
+	}, report.Tables)
+	require.Equal(t, map[int]commitTsRange{
+		0: {MinCommitTs: secondTs(10), MaxCommitTs: secondTs(30), Verified: 2},
+		1: {MinCommitTs: secondTs(5), MaxCommitTs: secondTs(5), Verified: 1},
+	}, report.Partitions)
+
+	// the jump is measured from the last event, not the previous resolved ts.
+	coverage.observe(0, messageResult{outcome: outcomeSkippedNonRow, resolvedTs: secondTs(90)})
+	coverage.observe(1, messageResult{outcome: outcomeSkippedNonRow, resolvedTs: secondTs(15)})
+	// the periodic resolved ts of an idle partition is not a gap.
+	coverage.observe(1, messageResult{outcome: outcomeSkippedNonRow, resolvedTs: secondTs(60)})
+	coverage.observe(1, messageResult{outcome: outcomeSkippedNonRow, resolvedTs: secondTs(100)})
+	coverage.observe(1, messageResult{outcome: outcomeSkippedNonRow, resolvedTs: secondTs(200)})
+	report = coverage.snapshot()
+	require.Equal(t, secondTs(20), report.FromTs)
+	require.Equal(t, secondTs(90), report.ToTs)
+	require.Equal(t, uint64(1), report.GapCount)
+	require.Equal(t, []resolvedGap{
+		{Partition: 1, FromTs: secondTs(100), ResolvedTs: secondTs(200), Jump: "1m40s"},
+	}, report.Gaps)
+
+	// the gap detection is disabled.
+	coverage = newCommitTsCoverage(0)
+	coverage.observe(0, messageResult{outcome: outcomeVerified, table: "test.a", commitTs: secondTs(10)})
+	coverage.observe(0, messageResult{outcome: outcomeSkippedNonRow, resolvedTs: secondTs(1000)})
+	report = coverage.snapshot()
+	require.Zero(t, report.GapCount)
+	require.Zero(t, report.FromTs)
+	require.Zero(t, report.ToTs)
+}
+
+func TestCoverageReport(t *testing.T) {
+	t.Parallel()
+
+	cfg := newDefaultConfig()
+	cfg.protocol = protocolCanalJSON
+	cfg.resolvedTsJump = time.Minute
+	row := func(offset int64, commitTs uint64) kafka.Message {
+		value := newTestCanalJSONMessage("INSERT", `[{"id":"1","name":"b","data":"é\u0001"}]`, `null`,
+			fmt.Sprintf(`{"commitTs":%d,"_checksum":{"current":%d}}`, commitTs, testCanalJSONChecksum(1, "b", []byte{0xe9, 0x01})))
+		return kafka.Message{Topic: "test", Offset: offset, Value: []byte(value)}
+	}
+	watermark := func(offset int64, ts uint64) kafka.Message {
+		return kafka.Message{Topic: "test", Offset: offset, Value: []byte(newTestCanalJSONWatermark(ts))}
+	}
+	reader := &fakeReader{messages: []kafka.Message{
+		watermark(0, secondTs(10)),
+		row(1, secondTs(20)),
+		row(2, secondTs(30)),
+		watermark(3, secondTs(40)),
+		watermark(4, secondTs(300)),
+	}}
+	v := newTestVerifier(cfg, reader)
+
+	err := v.run(context.Background())
+	require.Equal(t, exitCodeClean, v.finish(err))
+	coverage := v.report.Coverage
+	require.NotNil(t, coverage)
+	require.Equal(t, secondTs(10), coverage.FromTs)
+	require.Equal(t, secondTs(300), coverage.ToTs)
+	require.Equal(t, map[string]commitTsRange{
+		"test.c": {MinCommitTs: secondTs(20), MaxCommitTs: secondTs(30), Verified: 2},
+	}, coverage.Tables)
+	require.Equal(t, uint64(1), coverage.GapCount)
+	require.Equal(t, resolvedGap{FromTs: secondTs(40), ResolvedTs: secondTs(300), Jump: "4m20s"}, coverage.Gaps[0])
+}
@@ -0,0 +1,200 @@
+// Copyright 2023 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/pingcap/log"
+	"github.com/segmentio/kafka-go"
+	"go.uber.org/zap"
+)
+
+// the first byte of the avro message value, which is not a row.
+const (
+	avroDDLByte        = uint8(1)
+	avroCheckpointByte = uint8(2)
+)
+
+// ddlBoundaryWindow is the physical time around a DDL, a failure in it is annotated with the schema change.
+const ddlBoundaryWindow = time.Minute
+
+// avroDDLEvent is the DDL event encoded by the avro protocol with the TiDB extension and watermark enabled,
+// the value is the ddl byte followed by the JSON.
+type avroDDLEvent struct {
+	Query    string `json:"query"`
+	Type     int    `json:"type"`
+	Schema   string `json:"schema"`
+	Table    string `json:"table"`
+	CommitTs uint64 `json:"commitTs"`
+}
+
+func decodeAvroDDLEvent(value []byte) (*avroDDLEvent, error) {
+	if len(value) == 0 || value[0] != avroDDLByte {
+		return nil, errors.New("not an avro DDL event")
+	}
+	event := &avroDDLEvent{}
+	if err := json.Unmarshal(value[1:], event); err != nil {
+		return nil, err
+	}
+	return event, nil
+}
+
+// ddlRecord is a DDL observed in the run, each one is a new schema version of the table.
+type ddlRecord struct {
+	CommitTs uint64 `json:"commitTs"`
+	// Type is the action type of the DDL, such as 5 for adding column.
+	Type  int    `json:"type"`
+	Query string `json:"query"`
+}
+
+// ddlHistory keeps the DDLs of each table in the order of the commit ts, it's shared by the DDL consumer and the report.
+type ddlHistory struct {
+	mu sync.Mutex
+	// tables are keyed by `schema.table`, or `schema` for the database level DDL.
+	tables map[string][]ddlRecord
+}
+
+func newDDLHistory() *ddlHistory {
+	return &ddlHistory{tables: make(map[string][]ddlRecord)}
+}
+
+func ddlTableKey(schema, table string) string {
+	if table == "" {
+		return schema
+	}
+	return schema + "." + table
+}
+
+// add records the DDL, it returns false if it's observed already,
+// since the DDL is sent to all partitions of the topic.
+func (h *ddlHistory) add(event *avroDDLEvent) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	key := ddlTableKey(event.Schema, event.Table)
+	records := h.tables[key]
+	for _, record := range records {
+		if record.CommitTs == event.CommitTs && record.Query == event.Query {
+			return false
+		}
+	}
+	i := sort.Search(len(records), func(i int) bool { return records[i].CommitTs > event.CommitTs })
+	records = append(records, ddlRecord{})
+	copy(records[i+1:], records[i:])
+	records[i] = ddlRecord{CommitTs: event.CommitTs, Type: event.Type, Query: event.Query}
+	h.tables[key] = records
+	return true
+}
+
+// near returns the DDL of the table nearest to the commit ts, nil if none in the boundary window.
+func (h *ddlHistory) near(table string, commitTs uint64) *ddlRecord {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	var (
+		result  *ddlRecord
+		minDiff time.Duration
+	)
+	for i, record := range h.tables[table] {
+		diff := physicalTime(record.CommitTs).Sub(physicalTime(commitTs))
+		if diff < 0 {
+			diff = -diff
+		}
+		if diff <= ddlBoundaryWindow && (result == nil || diff < minDiff) {
+			result, minDiff = &h.tables[table][i], diff
+		}
+	}
+	if result == nil {
+		return nil
+	}
+	record := *result
+	return &record
+}
+
+func (h *ddlHistory) snapshot() map[string][]ddlRecord {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	result := make(map[string][]ddlRecord, len(h.tables))
+	for table, records := range h.tables {
+		result[table] = append([]ddlRecord(nil), records...)
+	}
+	return result
+}
+
+// physicalTime returns the physical part of the TSO.
+func physicalTime(ts uint64) time.Time {
+	return time.UnixMilli(int64(ts >> 18))
+}
+
+// schemaChangeNote returns the annotation of the failure near the DDL.
+func schemaChangeNote(record *ddlRecord) string {
+	return fmt.Sprintf("schema changed at ts %d (%s)", record.CommitTs, record.Query)
+}
+
+// ddlConsumer consumes the DDL topic along with the row verification,
+// the consumption does not affect the verification result, undecodable messages are logged and skipped.
+type ddlConsumer struct {
+	reader  messageReader
+	history *ddlHistory
+}
+
+func newDDLConsumer(ctx context.Context, cfg *config, history *ddlHistory) (*ddlConsumer, error) {
+	// the whole history of the DDL topic is consumed, nothing is committed.
+	reader, err := newPartitionReader(ctx, cfg, cfg.ddlTopic, nil, kafka.FirstOffset)
+	if err != nil {
+		return nil, err
+	}
+	log.Info("start consuming the DDL topic ...", zap.String("kafka", cfg.kafkaAddr), zap.String("topic", cfg.ddlTopic))
+	return &ddlConsumer{reader: reader, history: history}, nil
+}
+
+func (c *ddlConsumer) run(ctx context.Context) {
+	for {
+		message, err := c.reader.FetchMessage(ctx)
+		if err != nil {
+			if !errors.Is(err, context.Canceled) {
+				log.Warn("read DDL topic failed, stop consuming it", zap.Error(err))
+			}
+			return
+		}
+		if len(message.Value) == 0 || message.Value[0] != avroDDLByte {
+			// the checkpoint event is sent to the DDL topic as well.
+			continue
+		}
+		event, err := decodeAvroDDLEvent(message.Value)
+		if err != nil {
+			log.Warn("decode DDL event failed, skip it", zap.Int("partition", message.Partition),
+				zap.Int64("offset", message.Offset), zap.Error(err))
+			continue
+		}
+		if c.history.add(event) {
+			log.Info("DDL received", zap.String("schema", event.Schema), zap.String("table", event.Table),
+				zap.Uint64("commitTs", event.CommitTs), zap.String("query", event.Query))
+		}
+	}
+}
+
+func (c *ddlConsumer) close() {
+	if err := c.reader.Close(); err != nil {
+		log.Warn("close DDL topic reader failed", zap.Error(err))
+	}
+}
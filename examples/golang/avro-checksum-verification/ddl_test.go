@@ -0,0 +1,102 @@
+// Copyright 2023 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestDDLMessage(partition int, commitTs uint64, query string) kafka.Message {
+	value := append([]byte{avroDDLByte},
+		fmt.Sprintf(`{"query":%q,"type":5,"schema":"test","table":"t","commitTs":%d}`, query, commitTs)...)
+	return kafka.Message{Topic: "ddl", Partition: partition, Value: value}
+}
+
+// testTs returns the TSO of the physical time.
+func testTs(physical time.Time) uint64 {
+	return uint64(physical.UnixMilli()) << 18
+}
+
+func TestDDLHistory(t *testing.T) {
+	t.Parallel()
+
+	base := time.Date(2023, 12, 1, 10, 0, 0, 0, time.UTC)
+	history := newDDLHistory()
+	require.True(t, history.add(&avroDDLEvent{Schema: "test", Table: "t", CommitTs: testTs(base.Add(time.Hour)), Query: "ALTER 2"}))
+	require.True(t, history.add(&avroDDLEvent{Schema: "test", Table: "t", CommitTs: testTs(base), Query: "ALTER 1"}))
+	// the same DDL from another partition.
+	require.False(t, history.add(&avroDDLEvent{Schema: "test", Table: "t", CommitTs: testTs(base), Query: "ALTER 1"}))
+	require.True(t, history.add(&avroDDLEvent{Schema: "test", CommitTs: testTs(base), Query: "CREATE DATABASE test"}))
+
+	ddls := history.snapshot()
+	require.Len(t, ddls["test.t"], 2)
+	require.Equal(t, "ALTER 1", ddls["test.t"][0].Query)
+	require.Equal(t, "ALTER 2", ddls["test.t"][1].Query)
+	require.Len(t, ddls["test"], 1)
+
+	require.Equal(t, "ALTER 1", history.near("test.t", testTs(base.Add(30*time.Second))).Query)
+	require.Equal(t, "ALTER 2", history.near("test.t", testTs(base.Add(59*time.Minute))).Query)
+	require.Nil(t, history.near("test.t", testTs(base.Add(30*time.Minute))))
+	require.Nil(t, history.near("test.x", testTs(base)))
+}
+
+func TestDDLAnnotatesFailure(t *testing.T) {
+	t.Parallel()
+
+	registry := newTestRegistry(t, map[int]string{testSchemaID: testValueSchema})
+	cfg := newDefaultConfig()
+	cfg.schemaRegistryURL = registry.URL
+	cfg.mismatchBudget = 2
+
+	// the commit ts of the test message is 400000000000000000 plus the offset.
+	near := uint64(400000000000000000)
+	far := testTs(physicalTime(near).Add(time.Hour))
+	checkpoint := binary.BigEndian.AppendUint64([]byte{avroCheckpointByte}, near)
+	ddlReader := &fakeReader{messages: []kafka.Message{
+		newTestDDLMessage(0, near, "ALTER TABLE t ADD COLUMN c INT"),
+		newTestDDLMessage(1, near, "ALTER TABLE t ADD COLUMN c INT"),
+		{Topic: "ddl", Value: checkpoint},
+		{Topic: "ddl", Value: []byte{avroDDLByte, '{'}},
+	}}
+	reader := &fakeReader{messages: []kafka.Message{
+		newMismatchTestMessage(t, 0, 1, "a"),
+		newTestDDLMessage(0, near, "ALTER TABLE t ADD COLUMN c INT"),
+		newVerifiedTestMessage(t, 2, 2, "b"),
+	}}
+	v := newTestVerifier(cfg, reader)
+	v.ddlHistory = newDDLHistory()
+	v.ddl = &ddlConsumer{reader: ddlReader, history: v.ddlHistory}
+	// the DDL far from the failure is not annotated.
+	v.ddlHistory.add(&avroDDLEvent{Schema: "test", Table: "t", CommitTs: far, Query: "ALTER TABLE t DROP COLUMN c"})
+
+	err := v.run(context.Background())
+	require.Equal(t, exitCodeMismatch, v.finish(err))
+	require.Equal(t, counters{Messages: 3, Verified: 1, SkippedNonRow: 1, Mismatches: 1}, v.counters)
+
+	require.Len(t, v.report.Failures, 1)
+	require.Equal(t, "test.t", v.report.Failures[0].Table)
+	require.Equal(t, fmt.Sprintf("schema changed at ts %d (ALTER TABLE t ADD COLUMN c INT)", near),
+		v.report.Failures[0].SchemaChange)
+	require.Equal(t, []ddlRecord{
+		{CommitTs: near, Type: 5, Query: "ALTER TABLE t ADD COLUMN c INT"},
+		{CommitTs: far, Query: "ALTER TABLE t DROP COLUMN c"},
+	}, v.report.DDLs["test.t"])
+}
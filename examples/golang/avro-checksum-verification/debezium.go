@@ -0,0 +1,424 @@
+// Copyright 2023 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"container/list"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pingcap/tidb/pkg/parser/mysql"
+	"github.com/pingcap/tidb/pkg/types"
+	"github.com/segmentio/kafka-go"
+)
+
+const (
+	debeziumOpCreate = "c"
+	debeziumOpUpdate = "u"
+	debeziumOpDelete = "d"
+	debeziumOpRead   = "r"
+)
+
+// debeziumMessage is the debezium envelope, the schema is absent if disabled by the changefeed.
+type debeziumMessage struct {
+	Schema  *debeziumField   `json:"schema"`
+	Payload *debeziumPayload `json:"payload"`
+}
+
+// debeziumField is the connect schema of a field, a struct field has nested fields.
+type debeziumField struct {
+	Type       string            `json:"type"`
+	Optional   bool              `json:"optional"`
+	Name       string            `json:"name"`
+	Field      string            `json:"field"`
+	Parameters map[string]string `json:"parameters"`
+	Fields     []debeziumField   `json:"fields"`
+}
+
+// nested returns the nested field of the struct by the name, nil if not found.
+func (f *debeziumField) nested(name string) *debeziumField {
+	for i := range f.Fields {
+		if f.Fields[i].Field == name {
+			return &f.Fields[i]
+		}
+	}
+	return nil
+}
+
+type debeziumPayload struct {
+	Source *debeziumSource `json:"source"`
+	Op     string          `json:"op"`
+	// Before and After are null or the row, keyed by the column name.
+	Before map[string]interface{} `json:"before"`
+	After  map[string]interface{} `json:"after"`
+}
+
+// debeziumSource is the source block, CommitTs is the TiDB extended field.
+type debeziumSource struct {
+	TsMs     int64  `json:"ts_ms"`
+	DB       string `json:"db"`
+	Table    string `json:"table"`
+	CommitTs uint64 `json:"commit_ts"`
+}
+
+// debeziumOrderingKeys is the maximum number of keys whose last commit ts is kept to check the ordering.
+const debeziumOrderingKeys = 1 << 20
+
+// debeziumVerifier verifies the message encoded by the debezium protocol.
+// The debezium protocol of TiCDC does not carry the row level checksum, so the messages are only validated structurally,
+// the column values against the declared connect schema if present, and the commit ts must not regress per key.
+type debeziumVerifier struct {
+	lastCommitTs *commitTsLRU
+	filter       *tableFilter
+	window       *commitTsWindow
+	ops          opFilter
+}
+
+func (d *debeziumVerifier) setTableFilter(filter *tableFilter) { d.filter = filter }
+
+func newDebeziumVerifier(orderingKeys int) *debeziumVerifier {
+	return &debeziumVerifier{lastCommitTs: newCommitTsLRU(orderingKeys)}
+}
+
+// commitTsLRU keeps the last commit ts of each key, it evicts the least recently seen key once the capacity is reached,
+// so the ordering of the evicted key is not checked until it's seen again.
+// The commit ts are kept in the state store instead if it's set.
+type commitTsLRU struct {
+	capacity int
+	lru      *list.List
+	entries  map[string]*list.Element
+	state    *trackerState
+}
+
+type commitTsEntry struct {
+	key      string
+	commitTs uint64
+}
+
+func newCommitTsLRU(capacity int) *commitTsLRU {
+	return &commitTsLRU{capacity: capacity, lru: list.New(), entries: make(map[string]*list.Element)}
+}
+
+// advance records the commit ts of the key, and returns the last one if it regresses, 0 otherwise.
+// The regressed commit ts is not recorded, the following events of the key are checked against the larger one.
+func (c *commitTsLRU) advance(key string, commitTs uint64) (uint64, error) {
+	if c.state != nil {
+		return c.advanceState(key, commitTs)
+	}
+	if element, ok := c.entries[key]; ok {
+		c.lru.MoveToFront(element)
+		entry := element.Value.(*commitTsEntry)
+		if commitTs < entry.commitTs {
+			return entry.commitTs, nil
+		}
+		entry.commitTs = commitTs
+		return 0, nil
+	}
+	c.entries[key] = c.lru.PushFront(&commitTsEntry{key: key, commitTs: commitTs})
+	for c.lru.Len() > c.capacity {
+		evicted := c.lru.Remove(c.lru.Back()).(*commitTsEntry)
+		delete(c.entries, evicted.key)
+	}
+	return 0, nil
+}
+
+// advanceState is the advance of the commit ts kept in the state store.
+func (c *commitTsLRU) advanceState(key string, commitTs uint64) (uint64, error) {
+	if err := c.state.compact(); err != nil {
+		return 0, err
+	}
+	value, ok, err := c.state.get([]byte(key))
+	if err != nil {
+		return 0, err
+	}
+	if ok && len(value) == 8 {
+		if last := binary.BigEndian.Uint64(value); commitTs < last {
+			return last, nil
+		} else if commitTs == last {
+			return 0, c.state.touch([]byte(key), value)
+		}
+	}
+	return 0, c.state.put([]byte(key), binary.BigEndian.AppendUint64(nil, commitTs))
+}
+
+func (c *commitTsLRU) len() int {
+	return c.lru.Len()
+}
+
+func (d *debeziumVerifier) verify(message kafka.Message) (messageResult, error) {
+	var result messageResult
+	if len(message.Value) == 0 {
+		// the tombstone message follows the delete event if enabled, it does not carry the row.
+		result.add(outcomeSkippedDelete, 0)
+		return result, nil
+	}
+
+	var m debeziumMessage
+	decoder := json.NewDecoder(bytes.NewReader(message.Value))
+	decoder.UseNumber()
+	if err := decoder.Decode(&m); err != nil {
+		return result, err
+	}
+	if err := validateDebeziumMessage(&m); err != nil {
+		return result, err
+	}
+	source := m.Payload.Source
+	if d.filter.filtered(source.DB + "." + source.Table) {
+		result.add(outcomeFiltered, source.CommitTs)
+		return result, nil
+	}
+	op := debeziumOp(m.Payload.Op)
+	result.addOp(op)
+	if d.ops.filtered(op) {
+		result.add(outcomeFiltered, source.CommitTs)
+		return result, nil
+	}
+	if outside, err := d.window.outside(&result, source.CommitTs); err != nil || outside {
+		return result, err
+	}
+	result.sourceTs = source.TsMs
+
+	// the key is absent if not set by the changefeed, then the ordering is checked per table.
+	// The row is still validated if the commit ts regresses, the regression is reported as the ordering violation.
+	var orderingErr error
+	key := fmt.Sprintf("%d/%s.%s/%s", message.Partition, source.DB, source.Table, message.Key)
+	last, err := d.lastCommitTs.advance(key, source.CommitTs)
+	if err != nil {
+		return result, newInfraError(err)
+	}
+	if last != 0 {
+		orderingErr = fmt.Errorf("%w: commit ts regressed from %d to %d, schema: %s, table: %s",
+			errOrderingViolation, last, source.CommitTs, source.DB, source.Table)
+	}
+
+	if m.Schema != nil {
+		err = validateDebeziumRow(m.Schema, "after", m.Payload.After)
+		if err == nil {
+			err = validateDebeziumRow(m.Schema, "before", m.Payload.Before)
+		}
+		if err != nil {
+			result.commitTs = source.CommitTs
+			return result, err
+		}
+	}
+	result.add(outcomeSkippedNoChecksum, source.CommitTs)
+	return result, orderingErr
+}
+
+// validateDebeziumMessage checks the required fields are present, and the row images match the operation.
+func validateDebeziumMessage(m *debeziumMessage) error {
+	if m.Payload == nil {
+		return errors.New("debezium payload not found")
+	}
+	source := m.Payload.Source
+	if source == nil {
+		return errors.New("debezium source not found")
+	}
+	if source.DB == "" || source.Table == "" || source.TsMs == 0 {
+		return errors.New("debezium source must carry the db, table and ts_ms")
+	}
+
+	hasBefore, hasAfter := m.Payload.Before != nil, m.Payload.After != nil
+	switch m.Payload.Op {
+	case debeziumOpCreate, debeziumOpRead:
+		if hasBefore || !hasAfter {
+			return errors.New("debezium create event must only carry the after")
+		}
+	case debeziumOpUpdate:
+		if !hasBefore || !hasAfter {
+			return errors.New("debezium update event must carry both the before and after")
+		}
+	case debeziumOpDelete:
+		if !hasBefore || hasAfter {
+			return errors.New("debezium delete event must only carry the before")
+		}
+	default:
+		return errors.New("unknown debezium operation: " + m.Payload.Op)
+	}
+	return nil
+}
+
+// validateDebeziumRow checks each column of the row image is present, and its value matches the declared connect type.
+func validateDebeziumRow(schema *debeziumField, name string, row map[string]interface{}) error {
+	if row == nil {
+		return nil
+	}
+	image := schema.nested(name)
+	if image == nil {
+		return errors.New("debezium schema not found for the " + name)
+	}
+	for i := range image.Fields {
+		field := &image.Fields[i]
+		value, ok := row[field.Field]
+		if !ok {
+			return errors.New("value not found for the column " + field.Field)
+		}
+		if _, _, err := debeziumColumnValue(field, value); err != nil {
+			return fmt.Errorf("invalid value of the column %s: %w", field.Field, err)
+		}
+	}
+	return nil
+}
+
+// debeziumColumnValue maps the declared connect type to the mysql type,
+// and converts the value by it, by following the debezium encoder of TiCDC.
+// Some types are encoded lossy, such as the decimal as the double, their values are returned as they are.
+func debeziumColumnValue(field *debeziumField, value interface{}) (byte, interface{}, error) {
+	mysqlType, err := debeziumMySQLType(field)
+	if err != nil || value == nil {
+		return mysqlType, nil, err
+	}
+
+	switch mysqlType {
+	case mysql.TypeNewDecimal, mysql.TypeDatetime, mysql.TypeDuration:
+		if v, ok := value.(json.Number); ok {
+			return mysqlType, v, nil
+		}
+	case mysql.TypeBit:
+		switch v := value.(type) {
+		case bool:
+			if v {
+				return mysqlType, uint64(1), nil
+			}
+			return mysqlType, uint64(0), nil
+		case string:
+			// the bits are in the little-endian form.
+			data, err := base64.StdEncoding.DecodeString(v)
+			if err != nil {
+				return mysqlType, nil, err
+			}
+			var buf [8]byte
+			copy(buf[:], data)
+			return mysqlType, binary.LittleEndian.Uint64(buf[:]), nil
+		}
+	case mysql.TypeBlob:
+		if v, ok := value.(string); ok {
+			data, err := base64.StdEncoding.DecodeString(v)
+			return mysqlType, data, err
+		}
+	case mysql.TypeEnum:
+		if v, ok := value.(string); ok {
+			enum, err := types.ParseEnum(strings.Split(field.Parameters["allowed"], ","), v, "")
+			return mysqlType, enum.Value, err
+		}
+	case mysql.TypeSet:
+		if v, ok := value.(string); ok {
+			set, err := types.ParseSet(strings.Split(field.Parameters["allowed"], ","), v, "")
+			return mysqlType, set.Value, err
+		}
+	case mysql.TypeTimestamp:
+		// the timestamp is converted to UTC, such as `2023-01-01T00:00:00.123Z`, convert it back to the local.
+		if v, ok := value.(string); ok {
+			t, err := time.Parse(time.RFC3339Nano, v)
+			if err != nil {
+				return mysqlType, nil, err
+			}
+			layout := "2006-01-02 15:04:05"
+			if i := strings.IndexByte(v, '.'); i > 0 {
+				layout += "." + strings.Repeat("0", len(v)-i-2)
+			}
+			return mysqlType, t.In(time.Local).Format(layout), nil
+		}
+	case mysql.TypeDate:
+		if v, ok := value.(json.Number); ok {
+			days, err := v.Int64()
+			if err != nil {
+				return mysqlType, nil, err
+			}
+			return mysqlType, time.Unix(days*24*60*60, 0).UTC().Format("2006-01-02"), nil
+		}
+	case mysql.TypeLonglong, mysql.TypeYear:
+		if v, ok := value.(json.Number); ok {
+			// the unsigned bigint is encoded as int64, both are the same in the checksum calculation.
+			number, err := strconv.ParseInt(v.String(), 10, 64)
+			return mysqlType, number, err
+		}
+	case mysql.TypeFloat:
+		if v, ok := value.(json.Number); ok {
+			number, err := strconv.ParseFloat(v.String(), 32)
+			return mysqlType, float32(number), err
+		}
+	case mysql.TypeDouble:
+		if v, ok := value.(json.Number); ok {
+			number, err := v.Float64()
+			return mysqlType, number, err
+		}
+	case mysql.TypeVarchar, mysql.TypeJSON:
+		if v, ok := value.(string); ok {
+			return mysqlType, v, nil
+		}
+	}
+	return mysqlType, nil, fmt.Errorf("unexpected value %v for the connect type %s", value, field.Type)
+}
+
+// debeziumMySQLType maps the declared connect type and the logical name to the mysql type.
+// The binary string is declared as the string, and the decimal is declared as the double,
+// the `tidb_type` parameter is respected to tell them apart if present.
+func debeziumMySQLType(field *debeziumField) (byte, error) {
+	if tidbType, ok := field.Parameters["tidb_type"]; ok {
+		mysqlType := mysqlTypeFromCanalJSON(tidbType)
+		lowerType := strings.ToLower(tidbType)
+		if strings.Contains(lowerType, "blob") || strings.Contains(lowerType, "binary") {
+			return mysql.TypeBlob, nil
+		}
+		if mysqlType == mysql.TypeNewDecimal {
+			return mysqlType, nil
+		}
+	}
+
+	switch field.Name {
+	case "io.debezium.data.Bits":
+		return mysql.TypeBit, nil
+	case "io.debezium.data.Enum":
+		return mysql.TypeEnum, nil
+	case "io.debezium.data.EnumSet":
+		return mysql.TypeSet, nil
+	case "io.debezium.data.Json":
+		return mysql.TypeJSON, nil
+	case "io.debezium.time.Date":
+		return mysql.TypeDate, nil
+	case "io.debezium.time.Timestamp", "io.debezium.time.MicroTimestamp":
+		return mysql.TypeDatetime, nil
+	case "io.debezium.time.ZonedTimestamp":
+		return mysql.TypeTimestamp, nil
+	case "io.debezium.time.MicroTime":
+		return mysql.TypeDuration, nil
+	case "io.debezium.time.Year":
+		return mysql.TypeYear, nil
+	}
+
+	switch field.Type {
+	case "boolean":
+		return mysql.TypeBit, nil
+	case "bytes":
+		return mysql.TypeBlob, nil
+	case "string":
+		return mysql.TypeVarchar, nil
+	// all integral types are encoded as 8 bytes in the checksum calculation.
+	case "int8", "int16", "int32", "int64":
+		return mysql.TypeLonglong, nil
+	case "float":
+		return mysql.TypeFloat, nil
+	case "double":
+		return mysql.TypeDouble, nil
+	}
+	return 0, errors.New("unknown debezium connect type: " + field.Type)
+}
@@ -0,0 +1,173 @@
+// Copyright 2023 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/segmentio/kafka-go"
+	"github.com/stretchr/testify/require"
+)
+
+// testDebeziumFields is the schema of the table `test`.`d` (id INT, name VARCHAR(32), e ENUM('a','b'), data BLOB).
+const testDebeziumFields = `[{"type":"int32","optional":false,"field":"id"},` +
+	`{"type":"string","optional":true,"field":"name"},` +
+	`{"type":"string","optional":true,"name":"io.debezium.data.Enum","version":1,"parameters":{"allowed":"a,b"},"field":"e"},` +
+	`{"type":"string","optional":true,"parameters":{"tidb_type":"BLOB"},"field":"data"}]`
+
+func newTestDebeziumMessage(op string, commitTs uint64, before, after string) string {
+	return fmt.Sprintf(`{"payload":{"source":{"version":"2.4.0.Final","connector":"TiCDC","name":"default",`+
+		`"ts_ms":1701326309000,"snapshot":"false","db":"test","table":"d","commit_ts":%d,"cluster_id":"default"},`+
+		`"ts_ms":1701326309001,"transaction":null,"op":"%s","before":%s,"after":%s},`+
+		`"schema":{"type":"struct","optional":false,"fields":[`+
+		`{"type":"struct","optional":true,"field":"before","fields":%s},`+
+		`{"type":"struct","optional":true,"field":"after","fields":%s}]}}`,
+		commitTs, op, before, after, testDebeziumFields, testDebeziumFields)
+}
+
+func TestDebeziumVerify(t *testing.T) {
+	t.Parallel()
+
+	after := `{"id":1,"name":"b","e":"b","data":"6QE="}`
+	before := `{"id":1,"name":"a","e":"a","data":"6QE="}`
+
+	cases := []struct {
+		name    string
+		value   string
+		outcome outcome
+		err     string
+	}{
+		{
+			name:    "create",
+			value:   newTestDebeziumMessage("c", 100, `null`, after),
+			outcome: outcomeSkippedNoChecksum,
+		},
+		{
+			name:    "update",
+			value:   newTestDebeziumMessage("u", 101, before, after),
+			outcome: outcomeSkippedNoChecksum,
+		},
+		{
+			name:    "delete",
+			value:   newTestDebeziumMessage("d", 102, before, `null`),
+			outcome: outcomeSkippedNoChecksum,
+		},
+		{
+			name:  "value not matching the connect type",
+			value: newTestDebeziumMessage("c", 103, `null`, `{"id":1,"name":"b","e":"b","data":"not base64"}`),
+			err:   "invalid value of the column data",
+		},
+		{
+			name:  "column absent",
+			value: newTestDebeziumMessage("u", 104, `{"id":1,"name":"a","e":"a"}`, after),
+			err:   "value not found for the column data",
+		},
+		{
+			name:    "tombstone",
+			value:   "",
+			outcome: outcomeSkippedDelete,
+		},
+	}
+
+	v := newDebeziumVerifier(debeziumOrderingKeys)
+	for _, c := range cases {
+		result, err := v.verify(kafka.Message{Value: []byte(c.value)})
+		if c.err != "" {
+			require.ErrorContains(t, err, c.err, c.name)
+			continue
+		}
+		require.NoError(t, err, c.name)
+		require.Equal(t, c.outcome, result.outcome, c.name)
+		if c.value != "" {
+			require.Equal(t, int64(1701326309000), result.sourceTs, c.name)
+		}
+	}
+
+	// the commit ts regressed, the row is still validated.
+	result, err := v.verify(kafka.Message{Value: []byte(newTestDebeziumMessage("c", 99, `null`, after))})
+	require.ErrorIs(t, err, errOrderingViolation)
+	require.ErrorContains(t, err, "commit ts regressed")
+	require.Equal(t, exitCodeOrderingError, exitCodeOf(newDecodeError(err)))
+	require.Equal(t, outcomeSkippedNoChecksum, result.outcome)
+	// but not for another key.
+	_, err = v.verify(kafka.Message{Key: []byte("1"), Value: []byte(newTestDebeziumMessage("c", 99, `null`, after))})
+	require.NoError(t, err)
+
+	// the row images do not match the operation.
+	_, err = v.verify(kafka.Message{Value: []byte(newTestDebeziumMessage("c", 200, before, after))})
+	require.Error(t, err)
+	_, err = v.verify(kafka.Message{Value: []byte(newTestDebeziumMessage("x", 200, before, after))})
+	require.Error(t, err)
+	_, err = v.verify(kafka.Message{Value: []byte(`{"payload":{"op":"c","after":{}}}`)})
+	require.Error(t, err)
+}
+
+func TestDebeziumLossyColumns(t *testing.T) {
+	t.Parallel()
+
+	// the decimal is encoded as the double, it's validated as the number.
+	value := `{"payload":{"source":{"ts_ms":1701326309000,"db":"test","table":"d","commit_ts":100},` +
+		`"op":"c","before":null,"after":{"price":1.2}},` +
+		`"schema":{"type":"struct","fields":[{"type":"struct","field":"after","fields":` +
+		`[{"type":"double","optional":true,"parameters":{"tidb_type":"DECIMAL"},"field":"price"}]}]}}`
+	result, err := newDebeziumVerifier(debeziumOrderingKeys).verify(kafka.Message{Value: []byte(value)})
+	require.NoError(t, err)
+	require.Equal(t, outcomeSkippedNoChecksum, result.outcome)
+	require.Equal(t, uint64(100), result.commitTs)
+
+	_, err = newDebeziumVerifier(debeziumOrderingKeys).verify(
+		kafka.Message{Value: []byte(strings.Replace(value, "1.2", `"1.2"`, 1))})
+	require.ErrorContains(t, err, "unexpected value 1.2 for the connect type double")
+}
+
+func TestDebeziumFailureMetadata(t *testing.T) {
+	t.Parallel()
+
+	invalid := newTestDebeziumMessage("c", 100, `null`, `{"id":1,"name":"c","e":"c","data":"6QE="}`)
+
+	cfg := newDefaultConfig()
+	cfg.protocol = protocolDebezium
+	reader := &fakeReader{messages: []kafka.Message{{Topic: "test", Offset: 0, Value: []byte(invalid)}}}
+	v := newTestVerifier(cfg, reader)
+	err := v.run(context.Background())
+	require.Equal(t, exitCodeDecodeError, v.finish(err))
+	require.Len(t, v.report.Failures, 1)
+	require.Contains(t, v.report.Failures[0].Error, "invalid value of the column e")
+	require.Equal(t, uint64(100), v.report.Failures[0].CommitTs)
+	require.Equal(t, int64(1701326309000), v.report.Failures[0].SourceTs)
+}
+
+func TestDebeziumOrderingKeysBounded(t *testing.T) {
+	t.Parallel()
+
+	lru := newCommitTsLRU(2)
+	advance := func(key string, commitTs uint64) uint64 {
+		last, err := lru.advance(key, commitTs)
+		require.NoError(t, err)
+		return last
+	}
+	require.Zero(t, advance("a", 100))
+	require.Zero(t, advance("b", 100))
+	require.Equal(t, uint64(100), advance("a", 99))
+	// the least recently seen key is evicted, its ordering is not checked any more.
+	require.Zero(t, advance("c", 100))
+	require.Equal(t, 2, lru.len())
+	require.Zero(t, advance("b", 99))
+	// the regressed commit ts is not recorded.
+	require.Equal(t, uint64(100), advance("c", 98))
+	require.Zero(t, advance("c", 100))
+}
@@ -0,0 +1,182 @@
+// Copyright 2023 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"io"
+	"os"
+	"strings"
+
+	"avro-checksum-sample/checksum"
+	"github.com/linkedin/goavro/v2"
+	"github.com/pingcap/log"
+	"go.uber.org/zap"
+)
+
+type decodeConfig struct {
+	// message is the hex encoded bytes of the message value, file is the file of the raw bytes, only one is set.
+	message string
+	file    string
+
+	schemaRegistryURL string
+	// schemaFile is the file of the schema to decode the message offline, instead of the schema registry.
+	schemaFile string
+}
+
+func (c *decodeConfig) bindFlags(fs *flag.FlagSet) {
+	fs.StringVar(&c.message, "message", "", "hex encoded bytes of the message value, such as `0000000001...`")
+	fs.StringVar(&c.file, "file", "", "file of the raw bytes of the message value")
+	fs.StringVar(&c.schemaRegistryURL, "schema-registry-url", "http://127.0.0.1:8081", "schema registry url")
+	fs.StringVar(&c.schemaFile, "schema-file", "",
+		"file of the schema to decode the message offline, instead of the one in the schema registry")
+}
+
+func (c *decodeConfig) validate() error {
+	if (c.message == "") == (c.file == "") {
+		return errors.New("exactly one of message and file should be set")
+	}
+	return nil
+}
+
+// data returns the raw bytes of the message value.
+func (c *decodeConfig) data() ([]byte, error) {
+	if c.file != "" {
+		return os.ReadFile(c.file)
+	}
+	message := strings.TrimPrefix(strings.Join(strings.Fields(c.message), ""), "0x")
+	data, err := hex.DecodeString(message)
+	if err != nil {
+		return nil, newDecodeError(err)
+	}
+	return data, nil
+}
+
+// decodeResult is the output of the `decode` command.
+type decodeResult struct {
+	SchemaID int    `json:"schemaId"`
+	Table    string `json:"table,omitempty"`
+	// Value is the decoded value in the avro JSON encoding.
+	Value   json.RawMessage `json:"value"`
+	Columns []schemaField   `json:"columns"`
+	// ExpectedChecksum is the checksum carried by the message, nil if the checksum is not enabled.
+	ExpectedChecksum *uint64 `json:"expectedChecksum,omitempty"`
+	// ActualChecksum is the checksum calculated by the verifier, nil if any column cannot be handled.
+	ActualChecksum *uint64 `json:"actualChecksum,omitempty"`
+	// Error is the reason why the message is not verified.
+	Error string `json:"error,omitempty"`
+}
+
+// runDecode decodes one message and prints it with the checksums, the exit code is the same as the verifier.
+func runDecode(args []string, w io.Writer) int {
+	cfg := &decodeConfig{}
+	fs := flag.NewFlagSet(commandDecode, flag.ExitOnError)
+	cfg.bindFlags(fs)
+	_ = fs.Parse(args)
+	if err := cfg.validate(); err != nil {
+		log.Fatal("invalid configuration", zap.Error(err))
+	}
+
+	result, err := decodeMessage(cfg)
+	if result != nil {
+		if err := writeJSON(w, result); err != nil {
+			log.Error("write the result failed", zap.Error(err))
+			return exitCodeInfraError
+		}
+	}
+	if err != nil {
+		log.Error("decode message failed", zap.Error(err))
+	}
+	return exitCodeOf(err)
+}
+
+// decodeMessage decodes the message and calculates its checksum, the result is returned along with the error
+// once the message is decoded, such as the checksum mismatch.
+func decodeMessage(cfg *decodeConfig) (*decodeResult, error) {
+	data, err := cfg.data()
+	if err != nil {
+		return nil, err
+	}
+	schemaID, binary, err := extractSchemaIDAndBinaryData(data)
+	if err != nil {
+		return nil, newDecodeError(err)
+	}
+
+	var codec *goavro.Codec
+	if cfg.schemaFile != "" {
+		schema, err := os.ReadFile(cfg.schemaFile)
+		if err != nil {
+			return nil, err
+		}
+		if codec, err = goavro.NewCodec(string(schema)); err != nil {
+			return nil, err
+		}
+	} else if codec, err = GetSchema(cfg.schemaRegistryURL, schemaID); err != nil {
+		return nil, newInfraError(err)
+	}
+
+	native, _, err := codec.NativeFromBinary(binary)
+	if err != nil {
+		return nil, newDecodeError(err)
+	}
+	valueMap, ok := native.(map[string]interface{})
+	if !ok {
+		return nil, newDecodeError(errors.New("raw avro message is not a map"))
+	}
+	valueSchema := make(map[string]interface{})
+	if err := json.Unmarshal([]byte(codec.Schema()), &valueSchema); err != nil {
+		return nil, err
+	}
+	result := &decodeResult{SchemaID: schemaID, Table: avroTableName(valueSchema)}
+	if result.Value, err = codec.TextualFromNative(nil, native); err != nil {
+		return nil, newDecodeError(err)
+	}
+	if result.Columns, err = parseSchemaFields(valueSchema); err != nil {
+		return nil, newDecodeError(err)
+	}
+
+	expected, ok, err := getExpectedChecksum(valueMap)
+	if err != nil {
+		return result, newDecodeError(err)
+	}
+	if ok {
+		result.ExpectedChecksum = &expected
+	}
+	// the column which cannot be handled panics the checksum calculation.
+	for _, f := range result.Columns {
+		if f.Unsupported != "" {
+			result.Error = "column " + f.Name + ": " + f.Unsupported
+			return result, newDecodeError(errors.New(result.Error))
+		}
+	}
+	metas, values, err := checksumColumns(valueMap, valueSchema)
+	if err != nil {
+		result.Error = err.Error()
+		return result, newDecodeError(err)
+	}
+	actual, err := checksum.CalculateVersion(getChecksumVersion(valueMap), metas, values)
+	if err != nil {
+		result.Error = err.Error()
+		return result, newDecodeError(err)
+	}
+	result.ActualChecksum = &actual
+	if ok && actual != expected {
+		result.Error = errChecksumMismatch.Error()
+		return result, errChecksumMismatch
+	}
+	return result, nil
+}
@@ -0,0 +1,134 @@
+// Copyright 2023 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"avro-checksum-sample/checksum"
+	"github.com/segmentio/kafka-go"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDecode(t *testing.T) {
+	t.Parallel()
+
+	registry := newTestRegistry(t, map[int]string{testSchemaID: testValueSchema})
+	message := newVerifiedTestMessage(t, 0, 1, "a")
+	var out bytes.Buffer
+	code := runDecode([]string{
+		"--schema-registry-url", registry.URL, "--message", "0x" + hex.EncodeToString(message.Value),
+	}, &out)
+	require.Equal(t, exitCodeClean, code)
+
+	var result decodeResult
+	require.NoError(t, json.Unmarshal(out.Bytes(), &result))
+	require.Equal(t, testSchemaID, result.SchemaID)
+	require.Equal(t, "test.t", result.Table)
+	require.Equal(t, []schemaField{
+		{Name: "id", TiDBType: "BIGINT", MySQLType: "bigint", MySQLTypeCode: 8},
+		{Name: "name", TiDBType: "TEXT", MySQLType: "varchar", MySQLTypeCode: 15},
+	}, result.Columns)
+	name := "a"
+	expected := uint64(testRowChecksum(1, &name))
+	require.Equal(t, &expected, result.ExpectedChecksum)
+	require.Equal(t, uint64(*result.ActualChecksum), expected)
+	require.Empty(t, result.Error)
+	var value map[string]interface{}
+	require.NoError(t, json.Unmarshal(result.Value, &value))
+	require.Equal(t, map[string]interface{}{"string": "a"}, value["name"])
+
+	// decode offline by the schema file, the mismatch is printed with both checksums.
+	dir := t.TempDir()
+	schemaFile := filepath.Join(dir, "schema.avsc")
+	require.NoError(t, os.WriteFile(schemaFile, []byte(testValueSchema), 0o644))
+	messageFile := filepath.Join(dir, "message")
+	require.NoError(t, os.WriteFile(messageFile, newMismatchTestMessage(t, 0, 1, "a").Value, 0o644))
+	out.Reset()
+	code = runDecode([]string{
+		"--schema-registry-url", "http://127.0.0.1:0", "--schema-file", schemaFile, "--file", messageFile,
+	}, &out)
+	require.Equal(t, exitCodeMismatch, code)
+	result = decodeResult{}
+	require.NoError(t, json.Unmarshal(out.Bytes(), &result))
+	require.Equal(t, expected+1, *result.ExpectedChecksum)
+	require.Equal(t, uint64(*result.ActualChecksum), expected)
+	require.Equal(t, errChecksumMismatch.Error(), result.Error)
+
+	// nothing is printed if the message cannot be decoded.
+	out.Reset()
+	code = runDecode([]string{"--schema-file", schemaFile, "--message", "00000000"}, &out)
+	require.Equal(t, exitCodeDecodeError, code)
+	require.Empty(t, out.String())
+}
+
+// testChecksumVersion is the checksum version whose RowChecksum is the columnCountChecksum in the tests.
+const testChecksumVersion = 100
+
+// columnCountChecksum is the number of columns, a trivial RowChecksum registered for testChecksumVersion.
+type columnCountChecksum struct{ n uint64 }
+
+func (c *columnCountChecksum) Reset() { c.n = 0 }
+
+func (c *columnCountChecksum) UpdateColumn(_ checksum.FieldMeta, _ []byte) { c.n++ }
+
+func (c *columnCountChecksum) Sum() uint64 { return c.n }
+
+func TestChecksumVersion(t *testing.T) {
+	t.Parallel()
+
+	t.Cleanup(checksum.Register(testChecksumVersion, func() checksum.RowChecksum { return &columnCountChecksum{} }))
+
+	registry := newTestRegistry(t, map[int]string{testSchemaID: testValueSchema})
+	cfg := newDefaultConfig()
+	cfg.schemaRegistryURL = registry.URL
+	v, err := newMessageVerifier(cfg)
+	require.NoError(t, err)
+	name := "a"
+	for _, c := range []struct {
+		version  int32
+		checksum string
+		err      error
+	}{
+		{testChecksumVersion, "2", nil},
+		{testChecksumVersion, strconv.FormatUint(uint64(testRowChecksum(1, &name)), 10), errChecksumMismatch},
+		{0, strconv.FormatUint(uint64(testRowChecksum(1, &name)), 10), nil},
+		// the version not registered is never calculated by the crc32 one, even if it matches.
+		{1, strconv.FormatUint(uint64(testRowChecksum(1, &name)), 10), checksum.ErrUnsupportedVersion},
+	} {
+		row := newTestRow(1, &name, 400000000000000000, c.checksum)
+		row["_tidb_checksum_version"] = c.version
+		result, err := v.verify(kafka.Message{Value: encodeTestMessage(t, testSchemaID, testValueSchema, row)})
+		require.ErrorIs(t, err, c.err, "version %d", c.version)
+		if c.err == nil {
+			require.Equal(t, outcomeVerified, result.outcome)
+		}
+	}
+
+	cfg.protocol = protocolCanalJSON
+	v, err = newMessageVerifier(cfg)
+	require.NoError(t, err)
+	value := newTestCanalJSONMessage("INSERT", `[{"id":"1","name":"b","data":null}]`, `null`,
+		fmt.Sprintf(`{"commitTs":100,"_checksum":{"version":%d,"current":3}}`, testChecksumVersion))
+	result, err := v.verify(kafka.Message{Value: []byte(value)})
+	require.NoError(t, err)
+	require.Equal(t, outcomeVerified, result.outcome)
+}
@@ -0,0 +1,162 @@
+// Copyright 2023 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"container/list"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+)
+
+// errDuplicateConflict is returned if two events of the same key and commit ts carry different checksums,
+// which is never legal even if TiCDC delivers the event more than once.
+var errDuplicateConflict = errors.New("duplicate events carry different checksums")
+
+// dedupTracker counts the events delivered more than once, which is legal for TiCDC as at-least-once,
+// but a large number of them usually means the changefeed is restarting repeatedly.
+// The events are tracked in the sliding window of the commit ts, and at most capacity of them are kept,
+// or in the state store if it's set, where they are kept until the TTL instead.
+type dedupTracker struct {
+	window   time.Duration
+	capacity int
+	// fifo keeps the tracked events in the order they are seen, the oldest ones are evicted first.
+	fifo    *list.List
+	entries map[uint64]*list.Element
+	// latest is the largest commit ts seen, the events older than it by the window are evicted.
+	latest uint64
+	state  *trackerState
+}
+
+type dedupEntry struct {
+	hash      uint64
+	commitTs  uint64
+	checksum  uint64
+	partition int
+	offset    int64
+}
+
+func newDedupTracker(window time.Duration, capacity int) *dedupTracker {
+	return &dedupTracker{window: window, capacity: capacity, fifo: list.New(), entries: make(map[uint64]*list.Element)}
+}
+
+// dedupHash returns the hash of the event by the avro key, which identifies the table and the handle key,
+// the commit ts and the operation. It returns false if the event cannot be tracked.
+func dedupHash(message kafka.Message, result messageResult) (uint64, bool) {
+	if result.commitTs == 0 || len(message.Key) < 5 || message.Key[0] != magicByte {
+		return 0, false
+	}
+	h := fnv.New64a()
+	_, _ = h.Write(message.Key)
+	_, _ = h.Write(binary.BigEndian.AppendUint64(nil, result.commitTs))
+	for op := range result.ops {
+		_, _ = h.Write([]byte(op))
+	}
+	return h.Sum64(), true
+}
+
+// observe returns true if the event is seen before with the same checksum,
+// and errDuplicateConflict as a decode error if it's seen with a different one, which stops the verification.
+func (d *dedupTracker) observe(message kafka.Message, result messageResult) (bool, error) {
+	switch result.outcome {
+	case outcomeVerified, outcomeVerifiedWithCaveats, outcomeSkippedNoChecksum:
+	default:
+		return false, nil
+	}
+	hash, ok := dedupHash(message, result)
+	if !ok {
+		return false, nil
+	}
+	if d.state != nil {
+		return d.observeState(hash, message, result)
+	}
+	if element, ok := d.entries[hash]; ok {
+		entry := element.Value.(*dedupEntry)
+		if entry.checksum != result.checksum {
+			return false, duplicateConflict(entry, message, result)
+		}
+		return true, nil
+	}
+	d.entries[hash] = d.fifo.PushBack(&dedupEntry{
+		hash: hash, commitTs: result.commitTs, checksum: result.checksum,
+		partition: message.Partition, offset: message.Offset,
+	})
+	if result.commitTs > d.latest {
+		d.latest = result.commitTs
+	}
+	d.evict()
+	return false, nil
+}
+
+func duplicateConflict(entry *dedupEntry, message kafka.Message, result messageResult) error {
+	err := fmt.Errorf("%w, table: %s, commitTs: %d, checksum %d at partition %d offset %d, "+
+		"checksum %d at partition %d offset %d", errDuplicateConflict, result.table, result.commitTs,
+		entry.checksum, entry.partition, entry.offset, result.checksum, message.Partition, message.Offset)
+	return newDecodeError(err)
+}
+
+// observeState is the observe of the events tracked in the state store.
+func (d *dedupTracker) observeState(hash uint64, message kafka.Message, result messageResult) (bool, error) {
+	if err := d.state.compact(); err != nil {
+		return false, newInfraError(err)
+	}
+	if result.commitTs > d.latest {
+		d.latest = result.commitTs
+	}
+	key := binary.BigEndian.AppendUint64(nil, hash)
+	value, ok, err := d.state.get(key)
+	if err != nil {
+		return false, newInfraError(err)
+	}
+	if ok && len(value) == 32 {
+		entry := &dedupEntry{
+			hash: hash, commitTs: binary.BigEndian.Uint64(value), checksum: binary.BigEndian.Uint64(value[8:]),
+			partition: int(binary.BigEndian.Uint64(value[16:])), offset: int64(binary.BigEndian.Uint64(value[24:])),
+		}
+		switch {
+		case entry.partition == message.Partition && entry.offset == message.Offset:
+			// the message is consumed again after restart, since it's not committed before.
+			return false, nil
+		case entry.checksum != result.checksum:
+			return false, duplicateConflict(entry, message, result)
+		case !physicalTime(entry.commitTs).Before(physicalTime(d.latest).Add(-d.window)):
+			return true, nil
+		}
+	}
+	value = binary.BigEndian.AppendUint64(nil, result.commitTs)
+	value = binary.BigEndian.AppendUint64(value, result.checksum)
+	value = binary.BigEndian.AppendUint64(value, uint64(message.Partition))
+	value = binary.BigEndian.AppendUint64(value, uint64(message.Offset))
+	if err := d.state.put(key, value); err != nil {
+		return false, newInfraError(err)
+	}
+	return false, nil
+}
+
+// evict removes the events out of the window, or beyond the capacity.
+func (d *dedupTracker) evict() {
+	oldest := physicalTime(d.latest).Add(-d.window)
+	for d.fifo.Len() > 0 {
+		front := d.fifo.Front().Value.(*dedupEntry)
+		if d.fifo.Len() <= d.capacity && !physicalTime(front.commitTs).Before(oldest) {
+			return
+		}
+		d.fifo.Remove(d.fifo.Front())
+		delete(d.entries, front.hash)
+	}
+}
@@ -0,0 +1,105 @@
+// Copyright 2023 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDedupTracker(t *testing.T) {
+	t.Parallel()
+
+	key := encodeTestMessage(t, testKeySchemaID, testKeySchema, map[string]interface{}{"id": int64(1)})
+	message := kafka.Message{Key: key}
+	event := func(commitTs uint64, checksum uint64) messageResult {
+		return messageResult{commitTs: commitTs, checksum: checksum, ops: map[rowOp]int{opInsert: 1}}
+	}
+	d := newDedupTracker(time.Second, 3)
+	duplicate, err := d.observe(message, event(100<<18, 1))
+	require.NoError(t, err)
+	require.False(t, duplicate)
+	duplicate, err = d.observe(message, event(100<<18, 1))
+	require.NoError(t, err)
+	require.True(t, duplicate)
+
+	// the other operation of the same commit ts is another event.
+	update := event(100<<18, 2)
+	update.ops = map[rowOp]int{opUpdate: 1}
+	duplicate, err = d.observe(message, update)
+	require.NoError(t, err)
+	require.False(t, duplicate)
+
+	_, err = d.observe(message, event(100<<18, 2))
+	require.ErrorIs(t, err, errDuplicateConflict)
+	require.Equal(t, exitCodeDecodeError, exitCodeOf(err))
+
+	// the events out of the commit ts window are evicted.
+	_, err = d.observe(message, event(1200<<18, 1))
+	require.NoError(t, err)
+	require.Equal(t, 1, d.fifo.Len())
+	duplicate, err = d.observe(message, event(100<<18, 2))
+	require.NoError(t, err)
+	require.False(t, duplicate)
+
+	// the skipped events and the message without the avro key are not tracked.
+	_, ok := dedupHash(kafka.Message{}, event(100, 1))
+	require.False(t, ok)
+	duplicate, err = d.observe(message, messageResult{outcome: outcomeFiltered, commitTs: 1200 << 18})
+	require.NoError(t, err)
+	require.False(t, duplicate)
+}
+
+func TestDuplicatesReported(t *testing.T) {
+	t.Parallel()
+
+	registry := newTestRegistry(t, map[int]string{testSchemaID: testValueSchema, testKeySchemaID: testKeySchema})
+	cfg := newDefaultConfig()
+	cfg.schemaRegistryURL = registry.URL
+	cfg.dedupWindow = time.Minute
+	require.NoError(t, cfg.validate())
+
+	keyed := func(message kafka.Message, offset int64) kafka.Message {
+		message.Offset = offset
+		message.Key = encodeTestMessage(t, testKeySchemaID, testKeySchema, map[string]interface{}{"id": int64(1)})
+		return message
+	}
+	first := newVerifiedTestMessage(t, 0, 1, "a")
+	reader := &fakeReader{messages: []kafka.Message{
+		keyed(first, 0),
+		// the changefeed restarts, and delivers the event again.
+		keyed(first, 1),
+		keyed(first, 2),
+		// the same commit ts carrying another row is never legal.
+		keyed(newVerifiedTestMessage(t, 0, 1, "b"), 3),
+	}}
+	v := newTestVerifier(cfg, reader)
+	v.dedup = newDedupTracker(cfg.dedupWindow, cfg.dedupCapacity)
+
+	err := v.run(context.Background())
+	require.ErrorIs(t, err, errDuplicateConflict)
+	require.Equal(t, exitCodeDecodeError, v.finish(err))
+	require.Equal(t, []int64{0, 1, 2}, reader.committedOffsets())
+	require.Equal(t, counters{Messages: 4, Verified: 4, Duplicates: 2, DecodeErrors: 1}, v.counters)
+	require.Equal(t, uint64(2), v.report.Tables["test.t"].Duplicates)
+
+	cfg.dedupCapacity = 0
+	require.ErrorContains(t, cfg.validate(), "dedup window and capacity must be positive")
+	cfg.protocol = protocolCanalJSON
+	require.ErrorContains(t, cfg.validate(), "only the avro protocol is supported by the dedup window")
+}
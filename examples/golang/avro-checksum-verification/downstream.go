@@ -0,0 +1,472 @@
+// Copyright 2023 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/rand"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	_ "github.com/go-sql-driver/mysql" // register the mysql driver
+	"github.com/pingcap/log"
+	"github.com/pingcap/tidb/pkg/parser/mysql"
+	"github.com/pingcap/tidb/pkg/types"
+	"github.com/segmentio/kafka-go"
+	"go.uber.org/zap"
+)
+
+// downstreamRetryInterval is the interval to query the downstream again, if the row is not applied yet.
+const downstreamRetryInterval = 200 * time.Millisecond
+
+// downstreamRecheckQueueSize is the maximum number of different rows rechecked asynchronously,
+// the verification waits once it's full, so that the rechecks never fall behind too far.
+const downstreamRecheckQueueSize = 1024
+
+// rowEvent is a row decoded from the message, to be cross-checked against the database.
+type rowEvent struct {
+	schema   string
+	table    string
+	commitTs uint64
+	// deleted is true if the row is deleted by the event, then the columns are the deleted row.
+	deleted bool
+	// expected is the checksum carried by the event for the columns.
+	expected uint64
+	// checksumVersion is the checksum version carried by the event, which the expected checksum is calculated by.
+	checksumVersion int
+	// readTs is the ts to read the columns from the upstream, which is the commit ts for the new value,
+	// and the one just before it for the old value.
+	readTs uint64
+	// columns are in the order of the checksum calculation.
+	columns []rowColumn
+}
+
+type rowColumn struct {
+	name      string
+	mysqlType byte
+	// handle is true if the column is one of the handle key columns.
+	handle bool
+	// value is the value accepted by the checksum calculation.
+	value interface{}
+}
+
+func (r *rowEvent) handleColumns() []rowColumn {
+	var result []rowColumn
+	for _, column := range r.columns {
+		if column.handle {
+			result = append(result, column)
+		}
+	}
+	return result
+}
+
+// key returns the identity of the row by the table and the handle key values.
+func (r *rowEvent) key(handles []rowColumn) string {
+	var b strings.Builder
+	b.WriteString(quoteName(r.schema) + "." + quoteName(r.table))
+	for _, column := range handles {
+		fmt.Fprintf(&b, "/%v", column.value)
+	}
+	return b.String()
+}
+
+// downstreamChecker queries the downstream database by the handle key of the verified row,
+// and compares the column values against the decoded event.
+// The row different from the downstream is rechecked asynchronously until the grace window ends,
+// so that the verification is not blocked by the downstream lag.
+type downstreamChecker struct {
+	db         *sql.DB
+	sampleRate float64
+	// grace is the time to wait for the downstream to apply the event, since it's applied asynchronously.
+	grace         time.Duration
+	retryInterval time.Duration
+	random        *rand.Rand
+	// startTime is the time the verification starts, the events committed before it may be replayed.
+	startTime time.Time
+
+	rechecks chan *downstreamRecheck
+	wg       sync.WaitGroup
+
+	mu sync.Mutex
+	// pending are the rows being rechecked, keyed by the row key, to find those superseded by the later events.
+	pending map[string][]*downstreamRecheck
+	results []downstreamResult
+}
+
+// downstreamRecheck is a row different from the downstream, it's rechecked until the deadline.
+type downstreamRecheck struct {
+	message  kafka.Message
+	table    string
+	row      *rowEvent
+	key      string
+	query    string
+	args     []interface{}
+	deadline time.Time
+	// superseded is true if a later event of the same row is consumed, then the downstream may have applied it.
+	superseded bool
+}
+
+// downstreamResult is the result of the asynchronous recheck, err is nil if the row is superseded.
+type downstreamResult struct {
+	message    kafka.Message
+	table      string
+	commitTs   uint64
+	superseded bool
+	err        error
+}
+
+func newDownstreamChecker(ctx context.Context, cfg *config) (*downstreamChecker, error) {
+	db, err := sql.Open("mysql", cfg.downstreamDSN)
+	if err != nil {
+		return nil, err
+	}
+	if err := db.PingContext(ctx); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return newDownstreamCheckerWithDB(db, cfg), nil
+}
+
+func newDownstreamCheckerWithDB(db *sql.DB, cfg *config) *downstreamChecker {
+	return &downstreamChecker{
+		db:            db,
+		sampleRate:    cfg.downstreamSampleRate,
+		grace:         cfg.downstreamGrace,
+		retryInterval: downstreamRetryInterval,
+		random:        rand.New(rand.NewSource(time.Now().UnixNano())),
+		startTime:     time.Now(),
+		rechecks:      make(chan *downstreamRecheck, downstreamRecheckQueueSize),
+		pending:       make(map[string][]*downstreamRecheck),
+	}
+}
+
+// start rechecks the different rows in the background, until stop is called or the context is done.
+func (d *downstreamChecker) start(ctx context.Context) {
+	d.wg.Add(1)
+	go func() {
+		defer d.wg.Done()
+		for r := range d.rechecks {
+			d.recheck(ctx, r)
+		}
+	}()
+}
+
+// stop waits for the queued rows to be rechecked, it must be called after start, by the goroutine calling check.
+func (d *downstreamChecker) stop() {
+	close(d.rechecks)
+	d.wg.Wait()
+}
+
+// takeResults returns the results of the rechecks finished since the last call.
+func (d *downstreamChecker) takeResults() []downstreamResult {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	results := d.results
+	d.results = nil
+	return results
+}
+
+// supersede marks the rows being rechecked of the key as superseded, since a later event of the same row is consumed.
+func (d *downstreamChecker) supersede(row *rowEvent) {
+	handles := row.handleColumns()
+	if len(handles) == 0 {
+		return
+	}
+	key := row.key(handles)
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for _, r := range d.pending[key] {
+		r.superseded = true
+	}
+	delete(d.pending, key)
+}
+
+// pendingOffsets returns the lowest offset of each partition whose rows are being rechecked.
+func (d *downstreamChecker) pendingOffsets() map[partitionKey]int64 {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	result := make(map[partitionKey]int64)
+	for _, rechecks := range d.pending {
+		for _, r := range rechecks {
+			key := partitionKeyOf(r.message)
+			if offset, ok := result[key]; !ok || r.message.Offset < offset {
+				result[key] = r.message.Offset
+			}
+		}
+	}
+	return result
+}
+
+// sampled returns true if the row should be cross-checked.
+func (d *downstreamChecker) sampled() bool {
+	return d.sampleRate >= 1 || d.random.Float64() < d.sampleRate
+}
+
+// check cross-checks the row against the downstream, the row without the handle key is not checked.
+// If they are different, the row is queued to be rechecked until the grace window ends,
+// the difference is returned by takeResults later. It returns errDownstreamDiff at once if the grace is 0.
+func (d *downstreamChecker) check(ctx context.Context, message kafka.Message, table string, row *rowEvent) (bool, error) {
+	handles := row.handleColumns()
+	if len(handles) == 0 {
+		log.Debug("row has no handle key, skip the downstream check",
+			zap.String("schema", row.schema), zap.String("table", row.table))
+		return false, nil
+	}
+	query, args := downstreamQuery(row, handles)
+	diff, err := d.compare(ctx, row, query, args)
+	if err != nil {
+		log.Error("query downstream failed", zap.String("query", query), zap.Error(err))
+		return true, newInfraError(err)
+	}
+	if diff == "" {
+		return true, nil
+	}
+	if d.grace <= 0 {
+		return true, d.diffError(row, diff)
+	}
+
+	r := &downstreamRecheck{
+		message: message, table: table, row: row, key: row.key(handles),
+		query: query, args: args, deadline: time.Now().Add(d.grace),
+	}
+	d.mu.Lock()
+	d.pending[r.key] = append(d.pending[r.key], r)
+	d.mu.Unlock()
+	select {
+	case d.rechecks <- r:
+	case <-ctx.Done():
+		return true, ctx.Err()
+	}
+	return true, nil
+}
+
+// recheck queries the downstream until the row is the same, or the grace window ends.
+func (d *downstreamChecker) recheck(ctx context.Context, r *downstreamRecheck) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(d.retryInterval):
+		}
+		diff, err := d.compare(ctx, r.row, r.query, r.args)
+		if err != nil {
+			log.Error("query downstream failed", zap.String("query", r.query), zap.Error(err))
+			d.finishRecheck(r, newInfraError(err))
+			return
+		}
+		if diff == "" {
+			d.finishRecheck(r, nil)
+			return
+		}
+		if time.Now().Add(d.retryInterval).After(r.deadline) {
+			d.finishRecheck(r, d.diffError(r.row, diff))
+			return
+		}
+	}
+}
+
+// finishRecheck records the result of the recheck, the difference of the superseded row is not reported.
+func (d *downstreamChecker) finishRecheck(r *downstreamRecheck, err error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	pending := d.pending[r.key]
+	for i := range pending {
+		if pending[i] == r {
+			pending = append(pending[:i], pending[i+1:]...)
+			break
+		}
+	}
+	if len(pending) == 0 {
+		delete(d.pending, r.key)
+	} else {
+		d.pending[r.key] = pending
+	}
+	if err == nil {
+		return
+	}
+	result := downstreamResult{message: r.message, table: r.table, commitTs: r.row.commitTs}
+	if r.superseded && errors.Is(err, errDownstreamDiff) {
+		log.Info("downstream row is different from the event, but superseded by a later event",
+			zap.String("schema", r.row.schema), zap.String("table", r.row.table),
+			zap.Uint64("commitTs", r.row.commitTs))
+		result.superseded = true
+	} else {
+		result.err = err
+	}
+	d.results = append(d.results, result)
+}
+
+// diffError returns the difference of the row, the event committed before the verification starts is noted,
+// since the downstream may have applied a later change of the row which is not consumed yet.
+func (d *downstreamChecker) diffError(row *rowEvent, diff string) error {
+	log.Error("downstream row is different from the event",
+		zap.String("schema", row.schema), zap.String("table", row.table),
+		zap.Uint64("commitTs", row.commitTs), zap.String("diff", diff))
+	if row.commitTs != 0 && physicalTime(row.commitTs).Before(d.startTime.Add(-d.grace)) {
+		diff += ", the event is committed before the verification starts, " +
+			"the downstream may have applied a later change of the row not consumed yet"
+	}
+	return fmt.Errorf("%w: %s.%s: %s", errDownstreamDiff, row.schema, row.table, diff)
+}
+
+// downstreamQuery returns the query to fetch the row by the handle key,
+// enum, set and bit columns are selected as numbers, the same as the values in the event.
+func downstreamQuery(row *rowEvent, handles []rowColumn) (string, []interface{}) {
+	selected := make([]string, 0, len(row.columns))
+	for _, column := range row.columns {
+		name := quoteName(column.name)
+		switch column.mysqlType {
+		case mysql.TypeEnum, mysql.TypeSet, mysql.TypeBit:
+			name += "+0"
+		}
+		selected = append(selected, name)
+	}
+	conditions := make([]string, 0, len(handles))
+	args := make([]interface{}, 0, len(handles))
+	for _, column := range handles {
+		conditions = append(conditions, quoteName(column.name)+" = ?")
+		value := column.value
+		if v, ok := value.(float32); ok {
+			value = float64(v)
+		}
+		args = append(args, value)
+	}
+	query := fmt.Sprintf("SELECT %s FROM %s.%s WHERE %s", strings.Join(selected, ", "),
+		quoteName(row.schema), quoteName(row.table), strings.Join(conditions, " AND "))
+	return query, args
+}
+
+func quoteName(name string) string {
+	return "`" + strings.ReplaceAll(name, "`", "``") + "`"
+}
+
+// compare queries the downstream, and returns the difference, empty if the same.
+func (d *downstreamChecker) compare(ctx context.Context, row *rowEvent, query string, args []interface{}) (string, error) {
+	rows, err := d.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return "", err
+	}
+	defer rows.Close()
+
+	if !rows.Next() {
+		if err := rows.Err(); err != nil {
+			return "", err
+		}
+		if row.deleted {
+			return "", nil
+		}
+		return "row not found", nil
+	}
+	if row.deleted {
+		return "deleted row still exists", nil
+	}
+
+	values := make([]sql.RawBytes, len(row.columns))
+	dest := make([]interface{}, len(values))
+	for i := range values {
+		dest[i] = &values[i]
+	}
+	if err := rows.Scan(dest...); err != nil {
+		return "", err
+	}
+	var diffs []string
+	for i, column := range row.columns {
+		if !equalDownstreamValue(column, values[i]) {
+			diffs = append(diffs, fmt.Sprintf("column %s: event %v, downstream %s",
+				column.name, column.value, formatDownstreamValue(values[i])))
+		}
+	}
+	return strings.Join(diffs, "; "), rows.Err()
+}
+
+func formatDownstreamValue(value sql.RawBytes) string {
+	if value == nil {
+		return "NULL"
+	}
+	return strconv.Quote(string(value))
+}
+
+// equalDownstreamValue compares the event value with the downstream one by the type,
+// so that the different representations of the same value are equal, such as the decimal scale.
+func equalDownstreamValue(column rowColumn, downstream sql.RawBytes) bool {
+	if column.value == nil || downstream == nil {
+		return column.value == nil && downstream == nil
+	}
+	data := string(downstream)
+	switch column.mysqlType {
+	case mysql.TypeBit:
+		// the bit column is selected as the number, the avro protocol encodes it as the big endian bytes.
+		if v, ok := column.value.([]byte); ok && len(v) <= 8 {
+			return strconv.FormatUint(binary.BigEndian.Uint64(append(make([]byte, 8-len(v)), v...)), 10) == data
+		}
+	case mysql.TypeFloat:
+		v, err := strconv.ParseFloat(data, 32)
+		return err == nil && reflect.DeepEqual(column.value, float32(v))
+	case mysql.TypeDouble:
+		v, err := strconv.ParseFloat(data, 64)
+		return err == nil && reflect.DeepEqual(column.value, v)
+	case mysql.TypeNewDecimal:
+		expected, ok := column.value.(string)
+		if !ok {
+			return false
+		}
+		var a, b types.MyDecimal
+		if a.FromString([]byte(expected)) != nil || b.FromString(downstream) != nil {
+			return false
+		}
+		return a.Compare(&b) == 0
+	case mysql.TypeDate, mysql.TypeDatetime, mysql.TypeTimestamp, mysql.TypeDuration:
+		expected, ok := column.value.(string)
+		return ok && trimFraction(expected) == trimFraction(data)
+	case mysql.TypeJSON:
+		var a, b interface{}
+		expected, ok := column.value.(string)
+		if !ok || json.Unmarshal([]byte(expected), &a) != nil || json.Unmarshal(downstream, &b) != nil {
+			return false
+		}
+		return reflect.DeepEqual(a, b)
+	}
+
+	switch v := column.value.(type) {
+	case []byte:
+		return bytes.Equal(v, downstream)
+	case string:
+		return v == data
+	}
+	return fmt.Sprint(column.value) == data
+}
+
+// trimFraction removes the trailing zeros of the fractional seconds,
+// since the fsp of the downstream column may be different.
+func trimFraction(s string) string {
+	if !strings.Contains(s, ".") {
+		return s
+	}
+	return strings.TrimSuffix(strings.TrimRight(s, "0"), ".")
+}
+
+func (d *downstreamChecker) close() {
+	if err := d.db.Close(); err != nil {
+		log.Warn("close downstream failed", zap.Error(err))
+	}
+}
@@ -0,0 +1,274 @@
+// Copyright 2023 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/pingcap/tidb/pkg/parser/mysql"
+	"github.com/segmentio/kafka-go"
+	"github.com/stretchr/testify/require"
+)
+
+const testDownstreamQuery = "SELECT `id`, `name`, `data` FROM `test`.`c` WHERE `id` = ?"
+
+func TestEqualDownstreamValue(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		mysqlType  byte
+		value      interface{}
+		downstream sql.RawBytes
+		equal      bool
+	}{
+		{mysqlType: mysql.TypeLong, value: int64(-1), downstream: sql.RawBytes("-1"), equal: true},
+		{mysqlType: mysql.TypeLonglong, value: uint64(18446744073709551615), downstream: sql.RawBytes("18446744073709551615"), equal: true},
+		{mysqlType: mysql.TypeLong, value: int64(1), downstream: sql.RawBytes("2")},
+		{mysqlType: mysql.TypeNewDecimal, value: "1.2", downstream: sql.RawBytes("1.20"), equal: true},
+		{mysqlType: mysql.TypeNewDecimal, value: "1.2", downstream: sql.RawBytes("1.21")},
+		{mysqlType: mysql.TypeDatetime, value: "2023-12-01 10:00:00", downstream: sql.RawBytes("2023-12-01 10:00:00.000"), equal: true},
+		{mysqlType: mysql.TypeTimestamp, value: "2023-12-01 10:00:00.1", downstream: sql.RawBytes("2023-12-01 10:00:00.100000"), equal: true},
+		{mysqlType: mysql.TypeFloat, value: float32(1.1), downstream: sql.RawBytes("1.1"), equal: true},
+		{mysqlType: mysql.TypeJSON, value: `{"a": 1, "b": [1, 2]}`, downstream: sql.RawBytes(`{"b":[1,2],"a":1}`), equal: true},
+		{mysqlType: mysql.TypeBlob, value: []byte{0xe9, 0x01}, downstream: sql.RawBytes{0xe9, 0x01}, equal: true},
+		{mysqlType: mysql.TypeBlob, value: []byte{0xe9}, downstream: sql.RawBytes{0xe9, 0x00}},
+		{mysqlType: mysql.TypeEnum, value: uint64(2), downstream: sql.RawBytes("2"), equal: true},
+		{mysqlType: mysql.TypeVarchar, value: nil, downstream: nil, equal: true},
+		{mysqlType: mysql.TypeVarchar, value: "", downstream: nil},
+	}
+	for _, c := range cases {
+		column := rowColumn{name: "c", mysqlType: c.mysqlType, value: c.value}
+		require.Equal(t, c.equal, equalDownstreamValue(column, c.downstream), "%v", c)
+	}
+}
+
+func newTestDownstreamRow() *rowEvent {
+	return &rowEvent{schema: "test", table: "c", columns: []rowColumn{
+		{name: "id", mysqlType: mysql.TypeLong, handle: true, value: int64(1)},
+		{name: "name", mysqlType: mysql.TypeVarchar, value: "b"},
+		{name: "data", mysqlType: mysql.TypeBlob, value: []byte{0xe9, 0x01}},
+	}}
+}
+
+func TestDownstreamCheck(t *testing.T) {
+	t.Parallel()
+
+	db, mock, err := sqlmock.New()
+	require.NoError(t, err)
+	cfg := newDefaultConfig()
+	// the different row is rechecked exactly once.
+	cfg.downstreamGrace = time.Millisecond
+	newChecker := func() *downstreamChecker {
+		checker := newDownstreamCheckerWithDB(db, cfg)
+		checker.retryInterval = time.Millisecond
+		return checker
+	}
+
+	row := newTestDownstreamRow()
+	columns := []string{"id", "name", "data"}
+	query := regexp.QuoteMeta(testDownstreamQuery)
+	message := kafka.Message{Topic: "test", Offset: 10}
+
+	// the row is the same.
+	checker := newChecker()
+	mock.ExpectQuery(query).WithArgs(int64(1)).
+		WillReturnRows(sqlmock.NewRows(columns).AddRow("1", "b", []byte{0xe9, 0x01}))
+	checked, err := checker.check(context.Background(), message, "test.c", row)
+	require.True(t, checked)
+	require.NoError(t, err)
+
+	// the deleted row must be absent.
+	row.deleted = true
+	mock.ExpectQuery(query).WithArgs(int64(1)).WillReturnRows(sqlmock.NewRows(columns))
+	_, err = checker.check(context.Background(), message, "test.c", row)
+	require.NoError(t, err)
+	row.deleted = false
+
+	// the row is not applied yet, then applied within the grace window, the recheck is asynchronous.
+	mock.ExpectQuery(query).WithArgs(int64(1)).WillReturnRows(sqlmock.NewRows(columns))
+	mock.ExpectQuery(query).WithArgs(int64(1)).
+		WillReturnRows(sqlmock.NewRows(columns).AddRow("1", "b", []byte{0xe9, 0x01}))
+	checked, err = checker.check(context.Background(), message, "test.c", row)
+	require.True(t, checked)
+	require.NoError(t, err)
+	checker.start(context.Background())
+	checker.stop()
+	require.Empty(t, checker.takeResults())
+
+	// the difference is reported after the grace window.
+	checker = newChecker()
+	mock.ExpectQuery(query).WithArgs(int64(1)).
+		WillReturnRows(sqlmock.NewRows(columns).AddRow("1", "c", []byte{0xe9, 0x01}))
+	mock.ExpectQuery(query).WithArgs(int64(1)).
+		WillReturnRows(sqlmock.NewRows(columns).AddRow("1", "c", []byte{0xe9, 0x01}))
+	_, err = checker.check(context.Background(), message, "test.c", row)
+	require.NoError(t, err)
+	checker.start(context.Background())
+	checker.stop()
+	results := checker.takeResults()
+	require.Len(t, results, 1)
+	require.Equal(t, message, results[0].message)
+	require.ErrorIs(t, results[0].err, errDownstreamDiff)
+	require.ErrorContains(t, results[0].err, `column name: event b, downstream "c"`)
+
+	// the difference of the row superseded by a later event is not reported.
+	checker = newChecker()
+	mock.ExpectQuery(query).WithArgs(int64(1)).
+		WillReturnRows(sqlmock.NewRows(columns).AddRow("1", "c", []byte{0xe9, 0x01}))
+	mock.ExpectQuery(query).WithArgs(int64(1)).
+		WillReturnRows(sqlmock.NewRows(columns).AddRow("1", "c", []byte{0xe9, 0x01}))
+	_, err = checker.check(context.Background(), message, "test.c", row)
+	require.NoError(t, err)
+	checker.supersede(newTestDownstreamRow())
+	checker.start(context.Background())
+	checker.stop()
+	results = checker.takeResults()
+	require.Len(t, results, 1)
+	require.True(t, results[0].superseded)
+	require.NoError(t, results[0].err)
+	require.Empty(t, checker.pending)
+
+	// the difference is returned at once without the grace window,
+	// and the event committed before the verification starts is noted.
+	checker = newChecker()
+	checker.grace = 0
+	row.commitTs = uint64(checker.startTime.Add(-time.Hour).UnixMilli()) << 18
+	mock.ExpectQuery(query).WithArgs(int64(1)).
+		WillReturnRows(sqlmock.NewRows(columns).AddRow("1", "c", []byte{0xe9, 0x01}))
+	_, err = checker.check(context.Background(), message, "test.c", row)
+	require.ErrorIs(t, err, errDownstreamDiff)
+	require.ErrorContains(t, err, "committed before the verification starts")
+	require.NoError(t, mock.ExpectationsWereMet())
+
+	// the row without the handle key is not checked.
+	checked, err = checker.check(context.Background(), message, "test.c", &rowEvent{schema: "test", table: "c"})
+	require.False(t, checked)
+	require.NoError(t, err)
+}
+
+func TestDownstreamDiffReported(t *testing.T) {
+	t.Parallel()
+
+	db, mock, err := sqlmock.New()
+	require.NoError(t, err)
+	cfg := newDefaultConfig()
+	cfg.protocol = protocolCanalJSON
+	cfg.downstreamDSN = "root@tcp(127.0.0.1:3306)/"
+	cfg.downstreamGrace = 0
+	require.NoError(t, cfg.validate())
+
+	current := testCanalJSONChecksum(1, "b", []byte{0xe9, 0x01})
+	value := newTestCanalJSONMessage("INSERT", `[{"id":"1","name":"b","data":"é\u0001"}]`, `null`,
+		fmt.Sprintf(`{"commitTs":100,"_checksum":{"current":%d}}`, current))
+	reader := &fakeReader{messages: []kafka.Message{
+		{Topic: "test", Offset: 0, Value: []byte(value)},
+		{Topic: "test", Offset: 1, Value: []byte(value)},
+	}}
+	v := newTestVerifier(cfg, reader)
+	v.downstream = newDownstreamCheckerWithDB(db, cfg)
+
+	query := regexp.QuoteMeta(testDownstreamQuery)
+	columns := []string{"id", "name", "data"}
+	mock.ExpectQuery(query).WillReturnRows(sqlmock.NewRows(columns))
+	mock.ExpectQuery(query).WillReturnRows(sqlmock.NewRows(columns).AddRow("1", "b", []byte{0xe9, 0x01}))
+
+	err = v.run(context.Background())
+	require.Equal(t, exitCodeDownstreamDiff, v.finish(err))
+	// the difference does not stop the verification.
+	require.Equal(t, []int64{0, 1}, reader.committedOffsets())
+	require.Equal(t, counters{Messages: 2, Verified: 2, DownstreamChecked: 2, DownstreamDiffs: 1}, v.counters)
+	require.Len(t, v.report.Failures, 1)
+	require.Equal(t, failureKindDownstream, v.report.Failures[0].Kind)
+	require.Equal(t, uint64(100), v.report.Failures[0].CommitTs)
+}
+
+func TestDownstreamRecheckSuperseded(t *testing.T) {
+	t.Parallel()
+
+	db, mock, err := sqlmock.New()
+	require.NoError(t, err)
+	cfg := newDefaultConfig()
+	cfg.protocol = protocolCanalJSON
+	cfg.downstreamDSN = "root@tcp(127.0.0.1:3306)/"
+	cfg.downstreamGrace = 60 * time.Millisecond
+	require.NoError(t, cfg.validate())
+
+	first := newTestCanalJSONMessage("INSERT", `[{"id":"1","name":"b","data":"é\u0001"}]`, `null`,
+		fmt.Sprintf(`{"commitTs":100,"_checksum":{"current":%d}}`, testCanalJSONChecksum(1, "b", []byte{0xe9, 0x01})))
+	second := newTestCanalJSONMessage("UPDATE", `[{"id":"1","name":"c","data":"é\u0001"}]`,
+		`[{"name":"b"}]`, fmt.Sprintf(`{"commitTs":200,"_checksum":{"current":%d,"previous":%d}}`,
+			testCanalJSONChecksum(1, "c", []byte{0xe9, 0x01}), testCanalJSONChecksum(1, "b", []byte{0xe9, 0x01})))
+	reader := &fakeReader{messages: []kafka.Message{
+		{Topic: "test", Offset: 0, Value: []byte(first)},
+		{Topic: "test", Offset: 1, Value: []byte(second)},
+	}}
+	v := newTestVerifier(cfg, reader)
+	v.downstream = newDownstreamCheckerWithDB(db, cfg)
+	v.downstream.retryInterval = 50 * time.Millisecond
+
+	// the downstream has applied the second event already, the first one is rechecked without blocking the second.
+	query := regexp.QuoteMeta(testDownstreamQuery)
+	columns := []string{"id", "name", "data"}
+	mock.ExpectQuery(query).WillReturnRows(sqlmock.NewRows(columns).AddRow("1", "c", []byte{0xe9, 0x01}))
+	mock.ExpectQuery(query).WillReturnRows(sqlmock.NewRows(columns).AddRow("1", "c", []byte{0xe9, 0x01}))
+	mock.ExpectQuery(query).WillReturnRows(sqlmock.NewRows(columns).AddRow("1", "c", []byte{0xe9, 0x01}))
+
+	err = v.run(context.Background())
+	require.Equal(t, exitCodeClean, v.finish(err))
+	require.Equal(t, []int64{0, 1}, reader.committedOffsets())
+	require.Equal(t, counters{Messages: 2, Verified: 2, DownstreamChecked: 2, DownstreamSuperseded: 1}, v.counters)
+	require.Empty(t, v.report.Failures)
+	require.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestAvroDownstreamCheck(t *testing.T) {
+	t.Parallel()
+
+	db, mock, err := sqlmock.New()
+	require.NoError(t, err)
+	registry := newTestRegistry(t, map[int]string{testSchemaID: testValueSchema, testKeySchemaID: testKeySchema})
+	cfg := newDefaultConfig()
+	cfg.schemaRegistryURL = registry.URL
+	cfg.downstreamDSN = "root@tcp(127.0.0.1:3306)/"
+	cfg.downstreamGrace = 0
+	require.NoError(t, cfg.validate())
+
+	updated := newVerifiedTestMessage(t, 0, 1, "a")
+	updated.Key = encodeTestMessage(t, testKeySchemaID, testKeySchema, map[string]interface{}{"id": int64(1)})
+	// the delete event carries the key only.
+	deleted := kafka.Message{
+		Topic: "test", Offset: 1,
+		Key: encodeTestMessage(t, testKeySchemaID, testKeySchema, map[string]interface{}{"id": int64(2)}),
+	}
+	reader := &fakeReader{messages: []kafka.Message{updated, deleted}}
+	v := newTestVerifier(cfg, reader)
+	v.downstream = newDownstreamCheckerWithDB(db, cfg)
+
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT `id`, `name` FROM `test`.`t` WHERE `id` = ?")).
+		WithArgs(int64(1)).WillReturnRows(sqlmock.NewRows([]string{"id", "name"}).AddRow(int64(1), "a"))
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT `id` FROM `test`.`t` WHERE `id` = ?")).
+		WithArgs(int64(2)).WillReturnRows(sqlmock.NewRows([]string{"id"}))
+
+	err = v.run(context.Background())
+	require.Equal(t, exitCodeClean, v.finish(err))
+	require.Equal(t, []int64{0, 1}, reader.committedOffsets())
+	require.Equal(t, counters{Messages: 2, Verified: 1, SkippedDelete: 1, DownstreamChecked: 2}, v.counters)
+	require.NoError(t, mock.ExpectationsWereMet())
+}
@@ -0,0 +1,115 @@
+// Copyright 2023 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"errors"
+)
+
+// Exit codes of the verifier.
+// CI scripts depend on them, so never change the value of an existing one.
+const (
+	// exitCodeClean means all messages are verified, or skipped on purpose.
+	exitCodeClean = 0
+	// exitCodeMismatch means at least one checksum mismatch is found.
+	exitCodeMismatch = 10
+	// exitCodeDecodeError means at least one message cannot be decoded.
+	exitCodeDecodeError = 11
+	// exitCodeInfraError means the verification is stopped by the kafka or the schema registry.
+	exitCodeInfraError = 12
+	// exitCodeDownstreamDiff means at least one row is different in the downstream database.
+	exitCodeDownstreamDiff = 13
+	// exitCodeOrderingError means at least one event carries a commit ts smaller than the resolved ts already seen.
+	exitCodeOrderingError = 14
+	// exitCodeOpInconsistent means at least one event carries an operation inconsistent with the message shape.
+	exitCodeOpInconsistent = 15
+)
+
+// errChecksumMismatch is returned if the calculated checksum does not match the expected one.
+var errChecksumMismatch = errors.New("checksum mismatch")
+
+// errDownstreamDiff is returned if the downstream row is different from the verified event.
+var errDownstreamDiff = errors.New("downstream row differs")
+
+// errOrderingViolation is returned if the event is behind the resolved ts of the partition.
+var errOrderingViolation = errors.New("event behind the resolved ts")
+
+// errOpInconsistent is returned if the operation of the event is unknown, or inconsistent with the message shape.
+var errOpInconsistent = errors.New("operation inconsistent with the message")
+
+// decodeError is the error caused by the message itself, which cannot be decoded or verified.
+type decodeError struct {
+	err error
+}
+
+func newDecodeError(err error) error {
+	if err == nil || errors.Is(err, errChecksumMismatch) || errors.Is(err, errDownstreamDiff) ||
+		errors.Is(err, errOrderingViolation) || errors.Is(err, errOpInconsistent) {
+		return err
+	}
+	var (
+		d *decodeError
+		i *infraError
+	)
+	if errors.As(err, &d) || errors.As(err, &i) {
+		return err
+	}
+	return &decodeError{err: err}
+}
+
+func (e *decodeError) Error() string { return "decode message failed: " + e.err.Error() }
+
+func (e *decodeError) Unwrap() error { return e.err }
+
+// infraError is the error caused by the infrastructure, such as kafka and the schema registry,
+// instead of the message itself.
+type infraError struct {
+	err error
+}
+
+func newInfraError(err error) error {
+	if err == nil {
+		return nil
+	}
+	return &infraError{err: err}
+}
+
+func (e *infraError) Error() string { return "infrastructure error: " + e.err.Error() }
+
+func (e *infraError) Unwrap() error { return e.err }
+
+// exitCodeOf returns the exit code of the error which stopped the verification.
+// Errors not caused by the message itself are treated as infrastructure errors.
+func exitCodeOf(err error) int {
+	if err == nil {
+		return exitCodeClean
+	}
+	if errors.Is(err, errChecksumMismatch) {
+		return exitCodeMismatch
+	}
+	if errors.Is(err, errDownstreamDiff) {
+		return exitCodeDownstreamDiff
+	}
+	if errors.Is(err, errOrderingViolation) {
+		return exitCodeOrderingError
+	}
+	if errors.Is(err, errOpInconsistent) {
+		return exitCodeOpInconsistent
+	}
+	var d *decodeError
+	if errors.As(err, &d) {
+		return exitCodeDecodeError
+	}
+	return exitCodeInfraError
+}
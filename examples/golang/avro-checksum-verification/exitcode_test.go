@@ -0,0 +1,202 @@
+// Copyright 2023 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/segmentio/kafka-go"
+	"github.com/stretchr/testify/require"
+)
+
+func TestExitCodeStable(t *testing.T) {
+	t.Parallel()
+
+	// CI scripts hard-code these values, never change them.
+	require.Equal(t, 0, exitCodeClean)
+	require.Equal(t, 10, exitCodeMismatch)
+	require.Equal(t, 11, exitCodeDecodeError)
+	require.Equal(t, 12, exitCodeInfraError)
+	require.Equal(t, 13, exitCodeDownstreamDiff)
+	require.Equal(t, 14, exitCodeOrderingError)
+	require.Equal(t, 15, exitCodeOpInconsistent)
+}
+
+func TestExitCodeOf(t *testing.T) {
+	t.Parallel()
+
+	require.Equal(t, exitCodeClean, exitCodeOf(nil))
+	require.Equal(t, exitCodeMismatch, exitCodeOf(errChecksumMismatch))
+	require.Equal(t, exitCodeMismatch, exitCodeOf(fmt.Errorf("wrapped: %w", errChecksumMismatch)))
+	require.Equal(t, exitCodeMismatch, exitCodeOf(newDecodeError(errChecksumMismatch)))
+	require.Equal(t, exitCodeDecodeError, exitCodeOf(newDecodeError(errors.New("bad data"))))
+	require.Equal(t, exitCodeInfraError, exitCodeOf(newInfraError(errors.New("kafka down"))))
+	// the infrastructure error is not reclassified by the decode path.
+	require.Equal(t, exitCodeInfraError, exitCodeOf(newDecodeError(newInfraError(errors.New("registry down")))))
+	require.Equal(t, exitCodeInfraError, exitCodeOf(errors.New("unknown")))
+	require.Equal(t, exitCodeDownstreamDiff, exitCodeOf(fmt.Errorf("%w: test.t", errDownstreamDiff)))
+	require.Equal(t, exitCodeOrderingError, exitCodeOf(fmt.Errorf("%w: partition 0", errOrderingViolation)))
+	require.Equal(t, exitCodeOpInconsistent, exitCodeOf(newDecodeError(fmt.Errorf("%w: unknown", errOpInconsistent))))
+}
+
+func TestVerifierExitCode(t *testing.T) {
+	t.Parallel()
+
+	registry := newTestRegistry(t, map[int]string{testSchemaID: testValueSchema})
+
+	cfg := newDefaultConfig()
+	cfg.mismatchBudget = -2
+	require.ErrorContains(t, cfg.validate(), "mismatch budget must not be negative, except -1 for unlimited")
+
+	cases := []struct {
+		name           string
+		failFast       bool
+		mismatchBudget int
+		messages       func(t *testing.T) []kafka.Message
+
+		exitCode  int
+		committed []int64
+		counters  counters
+	}{
+		{
+			name: "clean",
+			messages: func(t *testing.T) []kafka.Message {
+				return []kafka.Message{
+					newVerifiedTestMessage(t, 0, 1, "a"),
+					{Topic: "test", Offset: 1},
+					newVerifiedTestMessage(t, 2, 2, "b"),
+				}
+			},
+			exitCode:  exitCodeClean,
+			committed: []int64{0, 1, 2},
+			counters:  counters{Messages: 3, Verified: 2, SkippedDelete: 1},
+		},
+		{
+			name: "stop on the first mismatch by default",
+			messages: func(t *testing.T) []kafka.Message {
+				return []kafka.Message{
+					newVerifiedTestMessage(t, 0, 1, "a"),
+					newMismatchTestMessage(t, 1, 2, "b"),
+					newVerifiedTestMessage(t, 2, 3, "c"),
+				}
+			},
+			exitCode:  exitCodeMismatch,
+			committed: []int64{0},
+			counters:  counters{Messages: 2, Verified: 1, Mismatches: 1},
+		},
+		{
+			name:           "report all mismatches by the unlimited budget",
+			mismatchBudget: unlimitedMismatchBudget,
+			messages: func(t *testing.T) []kafka.Message {
+				return []kafka.Message{
+					newVerifiedTestMessage(t, 0, 1, "a"),
+					newMismatchTestMessage(t, 1, 2, "b"),
+					newMismatchTestMessage(t, 2, 3, "c"),
+					newVerifiedTestMessage(t, 3, 4, "d"),
+				}
+			},
+			exitCode:  exitCodeMismatch,
+			committed: []int64{0, 1, 2, 3},
+			counters:  counters{Messages: 4, Verified: 2, Mismatches: 2},
+		},
+		{
+			name:           "mismatches within the budget",
+			mismatchBudget: 2,
+			messages: func(t *testing.T) []kafka.Message {
+				return []kafka.Message{
+					newMismatchTestMessage(t, 0, 1, "a"),
+					newMismatchTestMessage(t, 1, 2, "b"),
+					newVerifiedTestMessage(t, 2, 3, "c"),
+				}
+			},
+			exitCode:  exitCodeMismatch,
+			committed: []int64{0, 1, 2},
+			counters:  counters{Messages: 3, Verified: 1, Mismatches: 2},
+		},
+		{
+			name:           "mismatches exceed the budget",
+			mismatchBudget: 1,
+			messages: func(t *testing.T) []kafka.Message {
+				return []kafka.Message{
+					newMismatchTestMessage(t, 0, 1, "a"),
+					newMismatchTestMessage(t, 1, 2, "b"),
+					newVerifiedTestMessage(t, 2, 3, "c"),
+				}
+			},
+			exitCode:  exitCodeMismatch,
+			committed: []int64{0},
+			counters:  counters{Messages: 2, Mismatches: 2},
+		},
+		{
+			name:           "fail fast ignores the budget",
+			failFast:       true,
+			mismatchBudget: 10,
+			messages: func(t *testing.T) []kafka.Message {
+				return []kafka.Message{
+					newVerifiedTestMessage(t, 0, 1, "a"),
+					newMismatchTestMessage(t, 1, 2, "b"),
+				}
+			},
+			exitCode:  exitCodeMismatch,
+			committed: []int64{0},
+			counters:  counters{Messages: 2, Verified: 1, Mismatches: 1},
+		},
+		{
+			name:           "decode error",
+			mismatchBudget: 10,
+			messages: func(t *testing.T) []kafka.Message {
+				return []kafka.Message{
+					newVerifiedTestMessage(t, 0, 1, "a"),
+					{Topic: "test", Offset: 1, Value: []byte{1, 2, 3, 4, 5, 6}},
+					newVerifiedTestMessage(t, 2, 3, "c"),
+				}
+			},
+			exitCode:  exitCodeDecodeError,
+			committed: []int64{0},
+			counters:  counters{Messages: 2, Verified: 1, DecodeErrors: 1},
+		},
+		{
+			name: "schema not found in the registry",
+			messages: func(t *testing.T) []kafka.Message {
+				value := encodeTestMessage(t, 100, testValueSchema, newTestRow(1, nil, 1, ""))
+				return []kafka.Message{{Topic: "test", Offset: 0, Value: value}}
+			},
+			exitCode:  exitCodeInfraError,
+			committed: []int64{},
+			counters:  counters{Messages: 1},
+		},
+	}
+
+	for _, c := range cases {
+		c := c
+		t.Run(c.name, func(t *testing.T) {
+			t.Parallel()
+
+			cfg := newDefaultConfig()
+			cfg.schemaRegistryURL = registry.URL
+			cfg.failFast = c.failFast
+			cfg.mismatchBudget = c.mismatchBudget
+
+			reader := &fakeReader{messages: c.messages(t)}
+			v := newTestVerifier(cfg, reader)
+			err := v.run(context.Background())
+			require.Equal(t, c.exitCode, v.finish(err))
+			require.Equal(t, c.committed, reader.committedOffsets())
+			require.Equal(t, c.counters, v.counters)
+		})
+	}
+}
@@ -0,0 +1,279 @@
+// Copyright 2023 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"avro-checksum-sample/checksum"
+	"github.com/pingcap/tidb/pkg/parser/mysql"
+	"github.com/segmentio/kafka-go"
+)
+
+const (
+	exportFormatJSONL = "jsonl"
+	exportFormatCSV   = "csv"
+)
+
+// exportNull is the CSV field of the NULL value, the same as `LOAD DATA`.
+const exportNull = `\N`
+
+// exportMetaColumns are the metadata columns written before the columns of the row.
+var exportMetaColumns = []string{"_tidb_op", "_commit_ts", "_topic", "_partition", "_offset", "_result"}
+
+// exporter writes the decoded rows in the canonical form, so that they can be diffed against another system.
+// The rows are streamed to the file, which is rotated once it reaches the rotate size.
+type exporter struct {
+	format     string
+	path       string
+	rotateSize int64
+	// files are the files being written, keyed by the table for CSV, since the columns differ, or empty for JSONL.
+	files map[string]*exportFile
+}
+
+type exportFile struct {
+	file    *os.File
+	writer  *bufio.Writer
+	written int64
+	// index is the number of times the file is rotated.
+	index int
+	// header is the columns of the CSV file, a new file is started if the columns of the table change.
+	header []string
+}
+
+func newExporter(format, path string, rotateSize int64) *exporter {
+	return &exporter{format: format, path: path, rotateSize: rotateSize, files: make(map[string]*exportFile)}
+}
+
+// exportResult returns the verification result of the message written along with the row.
+func exportResult(result messageResult, err error) string {
+	switch {
+	case err == nil:
+		return result.outcome.String()
+	case errors.Is(err, errChecksumMismatch):
+		return "mismatch"
+	}
+	return "failed"
+}
+
+// exportOp returns the `_tidb_op` of the operation.
+func exportOp(op rowOp) string {
+	switch op {
+	case opInsert:
+		return "c"
+	case opUpdate:
+		return "u"
+	case opDelete:
+		return "d"
+	}
+	return ""
+}
+
+// write writes the decoded row of the message.
+func (e *exporter) write(message kafka.Message, result messageResult, err error) error {
+	row := result.decoded
+	var op rowOp
+	for o := range result.ops {
+		op = o
+	}
+	meta := []interface{}{
+		exportOp(op), result.commitTs, message.Topic, message.Partition, message.Offset, exportResult(result, err),
+	}
+	values := make([]interface{}, 0, len(row.columns))
+	for _, column := range row.columns {
+		values = append(values, exportValue(column))
+	}
+	table := row.schema + "." + row.table
+	if e.format == exportFormatCSV {
+		return e.writeCSV(table, row, meta, values)
+	}
+	var b bytes.Buffer
+	b.WriteString(`{"_table":`)
+	writeJSONValue(&b, table)
+	for i, name := range exportMetaColumns {
+		b.WriteByte(',')
+		writeJSONValue(&b, name)
+		b.WriteByte(':')
+		writeJSONValue(&b, meta[i])
+	}
+	// the columns are in the order of the schema, rather than the sorted one of the map.
+	b.WriteString(`,"columns":{`)
+	for i, column := range row.columns {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		writeJSONValue(&b, column.name)
+		b.WriteByte(':')
+		writeJSONValue(&b, values[i])
+	}
+	b.WriteString("}}\n")
+	return e.append("", nil, b.Bytes())
+}
+
+func writeJSONValue(b *bytes.Buffer, value interface{}) {
+	data, err := json.Marshal(value)
+	if err != nil {
+		// such as the NaN of the float, which is not valid in JSON.
+		data = []byte("null")
+	}
+	b.Write(data)
+}
+
+func (e *exporter) writeCSV(table string, row *rowEvent, meta, values []interface{}) error {
+	header := append([]string{}, exportMetaColumns...)
+	for _, column := range row.columns {
+		header = append(header, column.name)
+	}
+	record := make([]string, 0, len(header))
+	for _, value := range append(meta, values...) {
+		record = append(record, csvField(value))
+	}
+	var b bytes.Buffer
+	w := csv.NewWriter(&b)
+	if err := w.Write(record); err != nil {
+		return err
+	}
+	w.Flush()
+	return e.append(table, header, b.Bytes())
+}
+
+func csvField(value interface{}) string {
+	switch v := value.(type) {
+	case nil:
+		return exportNull
+	case string:
+		return v
+	}
+	return fmt.Sprint(value)
+}
+
+// append appends the data to the file of the table, the file is rotated before it if it's full,
+// or the header of the CSV file is changed.
+func (e *exporter) append(table string, header []string, data []byte) error {
+	f, ok := e.files[table]
+	if ok && (e.rotateSize > 0 && f.written >= e.rotateSize || !equalStrings(f.header, header)) {
+		if err := f.close(); err != nil {
+			return err
+		}
+		ok = false
+		f = &exportFile{index: f.index + 1}
+	}
+	if !ok {
+		if f == nil {
+			f = &exportFile{}
+		}
+		file, err := os.Create(exportFileName(e.path, table, f.index))
+		if err != nil {
+			return err
+		}
+		f.file, f.writer, f.header = file, bufio.NewWriter(file), header
+		e.files[table] = f
+		if header != nil {
+			var b bytes.Buffer
+			w := csv.NewWriter(&b)
+			_ = w.Write(header)
+			w.Flush()
+			if err := f.write(b.Bytes()); err != nil {
+				return err
+			}
+		}
+	}
+	return f.write(data)
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// exportFileName returns the name of the file, the table and the rotation index are inserted before the extension,
+// such as `export.test.t.1.csv`.
+func exportFileName(path, table string, index int) string {
+	ext := filepath.Ext(path)
+	name := strings.TrimSuffix(path, ext)
+	if table != "" {
+		name += "." + table
+	}
+	if index > 0 {
+		name += "." + strconv.Itoa(index)
+	}
+	return name + ext
+}
+
+func (f *exportFile) write(data []byte) error {
+	n, err := f.writer.Write(data)
+	f.written += int64(n)
+	return err
+}
+
+func (f *exportFile) close() error {
+	if err := f.writer.Flush(); err != nil {
+		_ = f.file.Close()
+		return err
+	}
+	return f.file.Close()
+}
+
+// close flushes and closes all files.
+func (e *exporter) close() error {
+	var result error
+	for table, f := range e.files {
+		if err := f.close(); err != nil && result == nil {
+			result = err
+		}
+		delete(e.files, table)
+	}
+	return result
+}
+
+// exportValue returns the canonical value of the column, the temporal value is normalized to UTC RFC3339,
+// and the binary value is encoded by base64.
+func exportValue(column rowColumn) interface{} {
+	switch v := column.value.(type) {
+	case []byte:
+		return base64.StdEncoding.EncodeToString(v)
+	case string:
+		switch column.mysqlType {
+		case mysql.TypeTimestamp:
+			// the TIMESTAMP value is in the local time zone, the same as the checksum calculation.
+			if t, err := checksum.ParseTimestamp(v, time.Local); err == nil {
+				return t.UTC().Format(time.RFC3339Nano)
+			}
+		case mysql.TypeDatetime:
+			// the DATETIME value has no time zone, it's taken as UTC as is.
+			if t, err := time.ParseInLocation("2006-01-02 15:04:05", v, time.UTC); err == nil {
+				return t.Format(time.RFC3339Nano)
+			}
+		}
+	}
+	return column.value
+}
@@ -0,0 +1,110 @@
+// Copyright 2023 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/pingcap/tidb/pkg/parser/mysql"
+	"github.com/segmentio/kafka-go"
+	"github.com/stretchr/testify/require"
+)
+
+func TestExportValue(t *testing.T) {
+	t.Parallel()
+
+	local := time.Date(2023, 12, 1, 10, 0, 0, 500000000, time.Local)
+	cases := []struct {
+		column   rowColumn
+		expected interface{}
+	}{
+		{column: rowColumn{mysqlType: mysql.TypeTimestamp, value: local.Format("2006-01-02 15:04:05.000000")},
+			expected: local.UTC().Format(time.RFC3339Nano)},
+		{column: rowColumn{mysqlType: mysql.TypeDatetime, value: "2023-12-01 10:00:00"}, expected: "2023-12-01T10:00:00Z"},
+		{column: rowColumn{mysqlType: mysql.TypeDate, value: "2023-12-01"}, expected: "2023-12-01"},
+		{column: rowColumn{mysqlType: mysql.TypeBlob, value: []byte{0xe9, 0x01}}, expected: "6QE="},
+		{column: rowColumn{mysqlType: mysql.TypeVarchar, value: nil}, expected: nil},
+		{column: rowColumn{mysqlType: mysql.TypeLonglong, value: int64(1)}, expected: int64(1)},
+	}
+	for _, c := range cases {
+		require.Equal(t, c.expected, exportValue(c.column), c.column)
+	}
+	require.Equal(t, "out.test.t.2.csv", exportFileName("out.csv", "test.t", 2))
+	require.Equal(t, "out.jsonl", exportFileName("out.jsonl", "", 0))
+}
+
+func TestExport(t *testing.T) {
+	t.Parallel()
+
+	registry := newTestRegistry(t, map[int]string{testSchemaID: testValueSchema, testKeySchemaID: testKeySchema})
+	dir := t.TempDir()
+	messages := func() []kafka.Message {
+		deleted := kafka.Message{
+			Topic: "test", Offset: 2,
+			Key: encodeTestMessage(t, testKeySchemaID, testKeySchema, map[string]interface{}{"id": int64(2)}),
+		}
+		return []kafka.Message{newVerifiedTestMessage(t, 0, 1, "a"), newMismatchTestMessage(t, 1, 2, "b,\"c"), deleted}
+	}
+
+	cfg := newDefaultConfig()
+	cfg.schemaRegistryURL = registry.URL
+	cfg.mismatchBudget = unlimitedMismatchBudget
+	cfg.export, cfg.exportFile = exportFormatJSONL, filepath.Join(dir, "out.jsonl")
+	require.NoError(t, cfg.validate())
+	v := newTestVerifier(cfg, &fakeReader{messages: messages()})
+	v.exporter = newExporter(cfg.export, cfg.exportFile, cfg.exportRotateSize)
+	err := v.run(context.Background())
+	require.Equal(t, exitCodeMismatch, v.finish(err))
+	v.close()
+	data, err := os.ReadFile(cfg.exportFile)
+	require.NoError(t, err)
+	require.Equal(t,
+		`{"_table":"test.t","_tidb_op":"c","_commit_ts":400000000000000000,"_topic":"test","_partition":0,"_offset":0,`+
+			`"_result":"verified","columns":{"id":1,"name":"a"}}`+"\n"+
+			`{"_table":"test.t","_tidb_op":"c","_commit_ts":400000000000000001,"_topic":"test","_partition":0,"_offset":1,`+
+			`"_result":"mismatch","columns":{"id":2,"name":"b,\"c"}}`+"\n"+
+			`{"_table":"test.t","_tidb_op":"d","_commit_ts":0,"_topic":"test","_partition":0,"_offset":2,`+
+			`"_result":"skippedDelete","columns":{"id":2}}`+"\n",
+		string(data))
+
+	// the CSV file is split by the table, and rotated once it's full, each file has the header.
+	cfg.export, cfg.exportFile, cfg.exportRotateSize = exportFormatCSV, filepath.Join(dir, "out.csv"), 1
+	require.NoError(t, cfg.validate())
+	v = newTestVerifier(cfg, &fakeReader{messages: messages()})
+	v.exporter = newExporter(cfg.export, cfg.exportFile, cfg.exportRotateSize)
+	err = v.run(context.Background())
+	require.Equal(t, exitCodeMismatch, v.finish(err))
+	v.close()
+	header := "_tidb_op,_commit_ts,_topic,_partition,_offset,_result,id,name\n"
+	for i, expected := range []string{
+		header + "c,400000000000000000,test,0,0,verified,1,a\n",
+		header + "c,400000000000000001,test,0,1,mismatch,2,\"b,\"\"c\"\n",
+		"_tidb_op,_commit_ts,_topic,_partition,_offset,_result,id\nd,0,test,0,2,skippedDelete,2\n",
+	} {
+		data, err := os.ReadFile(exportFileName(cfg.exportFile, "test.t", i))
+		require.NoError(t, err)
+		require.Equal(t, expected, string(data))
+	}
+
+	cfg.export = "xml"
+	require.ErrorContains(t, cfg.validate(), "unknown export format: xml")
+	cfg.export, cfg.exportFile = exportFormatCSV, ""
+	require.ErrorContains(t, cfg.validate(), "export file must be set")
+	cfg.exportFile, cfg.protocol = "out.csv", protocolCanalJSON
+	require.ErrorContains(t, cfg.validate(), "only the avro protocol is supported by the export")
+}
@@ -0,0 +1,133 @@
+// Copyright 2023 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// tableFilter decides whether the table is verified by the include and exclude patterns,
+// a nil filter includes all tables.
+type tableFilter struct {
+	include []*regexp.Regexp
+	exclude []*regexp.Regexp
+}
+
+// newTableFilter parses the comma-separated `db.table` patterns, `*` matches any characters,
+// it returns nil if no pattern is set.
+func newTableFilter(include, exclude string) (*tableFilter, error) {
+	if include == "" && exclude == "" {
+		return nil, nil
+	}
+	f := &tableFilter{}
+	var err error
+	if f.include, err = parseTablePatterns(include); err != nil {
+		return nil, err
+	}
+	if f.exclude, err = parseTablePatterns(exclude); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func parseTablePatterns(s string) ([]*regexp.Regexp, error) {
+	var result []*regexp.Regexp
+	for _, pattern := range strings.Split(s, ",") {
+		pattern = strings.TrimSpace(pattern)
+		if pattern == "" {
+			continue
+		}
+		if !strings.Contains(pattern, ".") {
+			return nil, fmt.Errorf("invalid table pattern %q, should be `db.table`", pattern)
+		}
+		// the table name is case-insensitive, the same as the TiCDC filter rules by default.
+		expr := "(?i)^" + strings.ReplaceAll(regexp.QuoteMeta(pattern), `\*`, ".*") + "$"
+		result = append(result, regexp.MustCompile(expr))
+	}
+	return result, nil
+}
+
+// filtered returns true if the `schema.table` should not be verified,
+// the message of the unknown table, such as the watermark, is never filtered.
+func (f *tableFilter) filtered(table string) bool {
+	if f == nil || table == "" || table == "." {
+		return false
+	}
+	if len(f.include) > 0 && !matchAny(f.include, table) {
+		return true
+	}
+	return matchAny(f.exclude, table)
+}
+
+func matchAny(patterns []*regexp.Regexp, table string) bool {
+	for _, pattern := range patterns {
+		if pattern.MatchString(table) {
+			return true
+		}
+	}
+	return false
+}
+
+const (
+	// commitTsMissingLenient verifies the event without the commit ts as if it's in the window.
+	commitTsMissingLenient = "lenient"
+	// commitTsMissingStrict fails the event without the commit ts, since it cannot be placed in the window.
+	commitTsMissingStrict = "strict"
+)
+
+// errMissingCommitTs is returned by the strict commit ts window if the event does not carry the commit ts.
+var errMissingCommitTs = errors.New("event carries no commit ts, cannot be placed in the commit ts window")
+
+// commitTsWindow is the inclusive range of the commit ts to verify, a nil window includes all events.
+type commitTsWindow struct {
+	start uint64
+	// end is 0 if the window is not bounded.
+	end    uint64
+	strict bool
+}
+
+// outside returns true if the event is outside the window, then it's added to the result as out of range.
+func (w *commitTsWindow) outside(result *messageResult, commitTs uint64) (bool, error) {
+	if w == nil {
+		return false, nil
+	}
+	if commitTs == 0 {
+		if w.strict {
+			return false, errMissingCommitTs
+		}
+		return false, nil
+	}
+	if commitTs >= w.start && (w.end == 0 || commitTs <= w.end) {
+		return false, nil
+	}
+	result.add(outcomeOutOfRange, commitTs)
+	return true, nil
+}
+
+// parseCommitTs parses the raw TSO, or the RFC3339 timestamp which is converted to the TSO of the physical time.
+func parseCommitTs(s string) (uint64, error) {
+	if ts, err := strconv.ParseUint(s, 10, 64); err == nil {
+		return ts, nil
+	}
+	t, err := time.Parse(time.RFC3339Nano, s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid commit ts %q, should be a TSO or an RFC3339 timestamp", s)
+	}
+	return uint64(t.UnixMilli()) << 18, nil
+}
@@ -0,0 +1,193 @@
+// Copyright 2023 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTableFilter(t *testing.T) {
+	t.Parallel()
+
+	f, err := newTableFilter("", "")
+	require.NoError(t, err)
+	require.Nil(t, f)
+	require.False(t, f.filtered("test.t"))
+
+	f, err = newTableFilter("test.*, app.order_*", "test.tmp_*")
+	require.NoError(t, err)
+	require.False(t, f.filtered("test.t"))
+	require.False(t, f.filtered("TEST.T"))
+	require.False(t, f.filtered("app.order_items"))
+	require.True(t, f.filtered("app.user"))
+	require.True(t, f.filtered("test.tmp_1"))
+	// the message of the unknown table is never filtered.
+	require.False(t, f.filtered(""))
+	require.False(t, f.filtered("."))
+
+	f, err = newTableFilter("", "*.t")
+	require.NoError(t, err)
+	require.True(t, f.filtered("test.t"))
+	require.False(t, f.filtered("test.t1"))
+
+	_, err = newTableFilter("test", "")
+	require.ErrorContains(t, err, "invalid table pattern")
+}
+
+func TestAvroFilter(t *testing.T) {
+	t.Parallel()
+
+	otherSchema := strings.Replace(testValueSchema, `"default.test"`, `"default.other"`, 1)
+	registry := newTestRegistry(t, map[int]string{testSchemaID: testValueSchema, 2: otherSchema})
+	cfg := newDefaultConfig()
+	cfg.schemaRegistryURL = registry.URL
+	cfg.excludeTables = "other.*"
+
+	// the value of the filtered table is not decoded.
+	filtered := binary.BigEndian.AppendUint32([]byte{magicByte}, 2)
+	filtered = append(filtered, 0xff, 0xff)
+	reader := &fakeReader{messages: []kafka.Message{
+		newVerifiedTestMessage(t, 0, 1, "a"),
+		{Topic: "test", Offset: 1, Value: filtered},
+		{Topic: "test", Offset: 2, Value: filtered},
+		newVerifiedTestMessage(t, 3, 2, "b"),
+	}}
+	v := newTestVerifier(cfg, reader)
+
+	err := v.run(context.Background())
+	require.Equal(t, exitCodeClean, v.finish(err))
+	require.Equal(t, []int64{0, 1, 2, 3}, reader.committedOffsets())
+	require.Equal(t, counters{Messages: 4, Verified: 2, Filtered: 2}, v.counters)
+	require.Equal(t, []schemaTable{
+		{SchemaID: testSchemaID, Database: "test", Table: "t", Version: 1},
+		{SchemaID: 2, Database: "other", Table: "t", Version: 1},
+	}, v.messageVerifier.(*avroVerifier).schemaTables())
+	// the filtered tables are not reported.
+	require.Len(t, v.report.Tables, 1)
+	require.Contains(t, v.report.Tables, "test.t")
+}
+
+func TestCanalJSONFilter(t *testing.T) {
+	t.Parallel()
+
+	cfg := newDefaultConfig()
+	cfg.protocol = protocolCanalJSON
+	cfg.includeTables = "test.x"
+	// the checksum is wrong, but it's never verified.
+	value := newTestCanalJSONMessage("INSERT", `[{"id":"1","name":"b","data":"é\u0001"}]`, `null`,
+		fmt.Sprintf(`{"commitTs":100,"_checksum":{"current":%d}}`, testCanalJSONChecksum(1, "a", []byte{0xe9, 0x01})))
+	reader := &fakeReader{messages: []kafka.Message{
+		{Topic: "test", Offset: 0, Value: []byte(value)},
+		{Topic: "test", Offset: 1, Value: []byte(newTestCanalJSONWatermark(200))},
+	}}
+	v := newTestVerifier(cfg, reader)
+
+	err := v.run(context.Background())
+	require.Equal(t, exitCodeClean, v.finish(err))
+	require.Equal(t, counters{Messages: 2, Filtered: 1, SkippedNonRow: 1}, v.counters)
+	require.Empty(t, v.report.Tables)
+}
+
+func TestParseCommitTs(t *testing.T) {
+	t.Parallel()
+
+	ts, err := parseCommitTs("447542839151575041")
+	require.NoError(t, err)
+	require.Equal(t, uint64(447542839151575041), ts)
+
+	ts, err = parseCommitTs("2023-12-01T10:00:00.5Z")
+	require.NoError(t, err)
+	require.Equal(t, time.Date(2023, 12, 1, 10, 0, 0, 5e8, time.UTC), physicalTime(ts).UTC())
+	require.Zero(t, ts&(1<<18-1))
+
+	_, err = parseCommitTs("yesterday")
+	require.ErrorContains(t, err, "invalid commit ts")
+
+	cfg := newDefaultConfig()
+	cfg.startCommitTs, cfg.endCommitTs = "200", "100"
+	require.ErrorContains(t, cfg.validate(), "end commit ts must not be smaller")
+	cfg.startCommitTs, cfg.endCommitTs, cfg.commitTsMissing = "100", "200", "loose"
+	require.ErrorContains(t, cfg.validate(), "unknown commit ts missing policy")
+	cfg.endCommitTs, cfg.commitTsMissing, cfg.bounded = "", commitTsMissingStrict, true
+	require.ErrorContains(t, cfg.validate(), "bounded run requires the end commit ts")
+}
+
+func TestCommitTsWindowBoundedRun(t *testing.T) {
+	t.Parallel()
+
+	registry := newTestRegistry(t, map[int]string{testSchemaID: testValueSchema})
+	cfg := newDefaultConfig()
+	cfg.schemaRegistryURL = registry.URL
+	// the commit ts of the test message is 400000000000000000 plus the offset.
+	cfg.startCommitTs = "400000000000000001"
+	cfg.endCommitTs = "400000000000000002"
+	cfg.bounded = true
+	require.NoError(t, cfg.validate())
+
+	other := newVerifiedTestMessage(t, 1, 1, "a")
+	other.Partition = 1
+	watermark := kafka.Message{
+		Topic: "test", Partition: 1, Offset: 2,
+		Value: binary.BigEndian.AppendUint64([]byte{avroCheckpointByte}, 400000000000000002),
+	}
+	reader := &fakeReader{messages: []kafka.Message{
+		// the checksum is wrong, but it's never verified.
+		newMismatchTestMessage(t, 0, 1, "a"),
+		newVerifiedTestMessage(t, 1, 2, "b"),
+		other,
+		newMismatchTestMessage(t, 3, 3, "c"),
+		watermark,
+		// not consumed after all partitions are past the end commit ts.
+		newVerifiedTestMessage(t, 4, 4, "d"),
+	}}
+	v := newTestVerifier(cfg, reader)
+	v.partitions = []int{0, 1}
+	v.pastEnd = make(map[int]struct{})
+	v.endTs = 400000000000000002
+
+	err := v.run(context.Background())
+	require.Equal(t, exitCodeClean, v.finish(err))
+	require.Equal(t, []int64{0, 1, 1, 3, 2}, reader.committedOffsets())
+	require.Equal(t, counters{Messages: 5, Verified: 2, OutOfRange: 2, SkippedNonRow: 1}, v.counters)
+}
+
+func TestCommitTsMissing(t *testing.T) {
+	t.Parallel()
+
+	value := newTestCanalJSONMessage("INSERT", `[{"id":"1","name":"b","data":"é\u0001"}]`, `null`, `null`)
+	message := kafka.Message{Value: []byte(value)}
+
+	cfg := newDefaultConfig()
+	cfg.protocol = protocolCanalJSON
+	cfg.startCommitTs = "100"
+	v, err := newMessageVerifier(cfg)
+	require.NoError(t, err)
+	result, err := v.verify(message)
+	require.NoError(t, err)
+	require.Equal(t, outcomeSkippedNoChecksum, result.outcome)
+
+	cfg.commitTsMissing = commitTsMissingStrict
+	v, err = newMessageVerifier(cfg)
+	require.NoError(t, err)
+	_, err = v.verify(message)
+	require.ErrorIs(t, err, errMissingCommitTs)
+}
@@ -0,0 +1,83 @@
+// Copyright 2023 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"strconv"
+	"testing"
+
+	"github.com/linkedin/goavro/v2"
+	"github.com/stretchr/testify/require"
+)
+
+func FuzzExtractSchemaID(f *testing.F) {
+	f.Add([]byte{magicByte, 0, 0, 0, 1, 2, 3})
+	f.Add([]byte{magicByte, 0, 0, 0})
+	f.Add([]byte{1, 0, 0, 0, 1})
+	f.Add([]byte{})
+	f.Fuzz(func(t *testing.T, data []byte) {
+		schemaID, binary, err := extractSchemaIDAndBinaryData(data)
+		if err != nil {
+			return
+		}
+		require.Len(t, binary, len(data)-5)
+		require.GreaterOrEqual(t, schemaID, 0)
+	})
+}
+
+// fuzzValueMap decodes the value by the test schema if it's valid, otherwise by JSON,
+// so that the fuzzer reaches both the avro native values and the arbitrary ones.
+func fuzzValueMap(codec *goavro.Codec, value []byte) (map[string]interface{}, bool) {
+	if native, _, err := codec.NativeFromBinary(value); err == nil {
+		valueMap, ok := native.(map[string]interface{})
+		return valueMap, ok
+	}
+	var valueMap map[string]interface{}
+	if err := json.Unmarshal(value, &valueMap); err != nil {
+		return nil, false
+	}
+	return valueMap, true
+}
+
+func FuzzVerifyChecksum(f *testing.F) {
+	codec, err := goavro.NewCodec(testValueSchema)
+	require.NoError(f, err)
+	name := "a"
+	checksum := strconv.FormatUint(uint64(testRowChecksum(1, &name)), 10)
+	valid, err := codec.BinaryFromNative(nil, newTestRow(1, &name, 1, checksum))
+	require.NoError(f, err)
+	f.Add([]byte(testValueSchema), valid)
+	f.Add([]byte(testValueSchema), []byte(`{"id": 1, "name": {"string": "a"}, "_tidb_row_level_checksum": "1"}`))
+	f.Add([]byte(testSalvageSchema), []byte(`{"v": "[1]", "n": "abc", "_tidb_row_level_checksum": "1"}`))
+	// the regression cases, which panicked or were taken as 0 before.
+	f.Add([]byte(`{"fields": [{"name": 1}]}`), []byte(`{}`))
+	f.Add([]byte(testValueSchema), []byte(`{"id": 1, "name": null, "_tidb_row_level_checksum": 1}`))
+	f.Add([]byte(`{"fields": [{"name": "e", "type": {"type": "string", "connect.parameters": {"tidb_type": "ENUM"}}}]}`),
+		[]byte(`{"e": "x", "_tidb_row_level_checksum": "1"}`))
+	f.Add([]byte(`{"fields": [{"name": "f", "type": {"type": "float", "connect.parameters": {"tidb_type": "FLOAT"}}}]}`),
+		[]byte(`{"f": "x", "_tidb_row_level_checksum": "1"}`))
+	f.Fuzz(func(t *testing.T, schema, value []byte) {
+		var valueSchema map[string]interface{}
+		if err := json.Unmarshal(schema, &valueSchema); err != nil {
+			return
+		}
+		valueMap, ok := fuzzValueMap(codec, value)
+		if !ok {
+			return
+		}
+		_ = CalculateAndVerifyChecksum(valueMap, valueSchema)
+		_, _ = salvageAvroColumns(valueMap, valueSchema)
+	})
+}
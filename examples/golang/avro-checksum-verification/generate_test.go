@@ -0,0 +1,110 @@
+// Copyright 2023 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"math/rand"
+	"net/http/httptest"
+	"testing"
+
+	"avro-checksum-sample/generator"
+	"github.com/segmentio/kafka-go"
+	"github.com/stretchr/testify/require"
+)
+
+// newTestGeneratedTable returns a table of all types supported by the generator.
+func newTestGeneratedTable() *generator.Table {
+	return &generator.Table{Schema: "test", Name: "all_types", Columns: []generator.Column{
+		{Name: "id", TiDBType: "BIGINT", Handle: true},
+		{Name: "c_int", TiDBType: "INT", Nullable: true},
+		{Name: "c_uint", TiDBType: "INT UNSIGNED", Nullable: true},
+		{Name: "c_ubigint", TiDBType: "BIGINT UNSIGNED", Nullable: true},
+		{Name: "c_float", TiDBType: "FLOAT", Nullable: true},
+		{Name: "c_double", TiDBType: "DOUBLE", Nullable: true},
+		{Name: "c_decimal", TiDBType: "DECIMAL", Nullable: true},
+		{Name: "c_bit", TiDBType: "BIT", Nullable: true},
+		{Name: "c_text", TiDBType: "TEXT", Nullable: true},
+		{Name: "c_blob", TiDBType: "BLOB", Nullable: true},
+		{Name: "c_enum", TiDBType: "ENUM", Nullable: true, Allowed: []string{"a", "b", "c"}},
+		{Name: "c_set", TiDBType: "SET", Nullable: true, Allowed: []string{"x", "y", "z"}},
+		{Name: "c_json", TiDBType: "JSON", Nullable: true},
+		{Name: "c_date", TiDBType: "DATE", Nullable: true},
+		{Name: "c_datetime", TiDBType: "DATETIME", Nullable: true},
+		{Name: "c_timestamp", TiDBType: "TIMESTAMP", Nullable: true},
+		{Name: "c_time", TiDBType: "TIME", Nullable: true},
+		{Name: "c_year", TiDBType: "YEAR", Nullable: true},
+	}}
+}
+
+// generateTestMessages encodes the random rows of the table, and corrupts the messages by the mode at the ratio,
+// it returns the messages and the offsets of the corrupted ones.
+func generateTestMessages(
+	t *testing.T, registry generator.Registry, count int, ratio float64, mode string,
+) ([]kafka.Message, map[int64]bool) {
+	table := newTestGeneratedTable()
+	encoder, err := generator.NewEncoder(table, "default", "test", registry)
+	require.NoError(t, err)
+
+	r := rand.New(rand.NewSource(1))
+	messages := make([]kafka.Message, 0, count)
+	corrupted := make(map[int64]bool)
+	for i := 0; i < count; i++ {
+		m, err := encoder.Encode(table.RandomRow(r), 400000000000000000+uint64(i))
+		require.NoError(t, err)
+		if r.Float64() < ratio {
+			require.NoError(t, encoder.Corrupt(m, mode, r))
+			corrupted[int64(i)] = true
+		}
+		messages = append(messages, kafka.Message{Topic: "test", Offset: int64(i), Key: m.Key, Value: m.Value})
+	}
+	return messages, corrupted
+}
+
+func TestVerifyGeneratedMessages(t *testing.T) {
+	t.Parallel()
+
+	registry := generator.NewMemoryRegistry()
+	server := httptest.NewServer(registry)
+	t.Cleanup(server.Close)
+	cfg := newDefaultConfig()
+	cfg.schemaRegistryURL = server.URL
+	cfg.mismatchBudget = 1000
+
+	// all types are encoded the same as TiCDC, so every message carries the correct checksum.
+	messages, _ := generateTestMessages(t, registry, 200, 0, "")
+	v := newTestVerifier(cfg, &fakeReader{messages: messages})
+	err := v.run(context.Background())
+	require.Equal(t, exitCodeClean, v.finish(err))
+	require.Equal(t, counters{Messages: 200, Verified: 200}, v.counters)
+
+	messages, corrupted := generateTestMessages(t, registry, 200, 0.1, generator.CorruptChecksum)
+	require.NotEmpty(t, corrupted)
+	v = newTestVerifier(cfg, &fakeReader{messages: messages})
+	err = v.run(context.Background())
+	require.Equal(t, exitCodeMismatch, v.finish(err))
+	require.Equal(t, counters{
+		Messages: 200, Verified: uint64(200 - len(corrupted)), Mismatches: uint64(len(corrupted)),
+	}, v.counters)
+
+	// a flipped byte may break the decoding which stops the run, but only the corrupted messages fail.
+	messages, corrupted = generateTestMessages(t, registry, 200, 0.1, generator.CorruptByte)
+	v = newTestVerifier(cfg, &fakeReader{messages: messages})
+	err = v.run(context.Background())
+	require.NotEqual(t, exitCodeClean, v.finish(err))
+	require.NotEmpty(t, v.report.Failures)
+	for _, f := range v.report.Failures {
+		require.True(t, corrupted[f.Offset], "offset %d", f.Offset)
+	}
+}
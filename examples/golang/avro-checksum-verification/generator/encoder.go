@@ -0,0 +1,180 @@
+// Copyright 2023 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package generator
+
+import (
+	"encoding/binary"
+	"errors"
+	"math/rand"
+	"strconv"
+
+	"avro-checksum-sample/checksum"
+	"github.com/linkedin/goavro/v2"
+)
+
+const (
+	// confluent avro wire format, the first byte is always 0, followed by the schema ID in 4 bytes.
+	magicByte  = uint8(0)
+	headerSize = 5
+)
+
+const (
+	// CorruptChecksum changes the checksum carried by the message, the verifier reports a mismatch.
+	CorruptChecksum = "checksum"
+	// CorruptByte flips a byte of the column data, the verifier reports a mismatch or a decode error.
+	CorruptByte = "byte"
+)
+
+// Encoder encodes the rows of the table into the confluent framed avro messages, the same as TiCDC.
+type Encoder struct {
+	table   *Table
+	valueID int
+	value   *goavro.Codec
+	// columns encodes the columns only, to locate the column data in the value.
+	columns *goavro.Codec
+	// keyID and key are 0 and nil if the table has no handle column.
+	keyID int
+	key   *goavro.Codec
+}
+
+// Message is an encoded row.
+type Message struct {
+	Key   []byte
+	Value []byte
+	// Checksum is the row level checksum of the row, the one carried by the message differs if corrupted.
+	Checksum uint32
+	// Corrupted is the corruption applied to the message, empty if not corrupted.
+	Corrupted string
+
+	native map[string]interface{}
+	// columnsEnd is the end offset of the column data in the value.
+	columnsEnd int
+}
+
+// NewEncoder registers the key and value schemas of the topic, by the topic name strategy the same as TiCDC.
+func NewEncoder(table *Table, namespace, topic string, registry Registry) (*Encoder, error) {
+	if err := table.Validate(); err != nil {
+		return nil, err
+	}
+	e := &Encoder{table: table}
+	valueSchema, err := table.ValueSchema(namespace)
+	if err != nil {
+		return nil, err
+	}
+	if e.value, err = goavro.NewCodec(valueSchema); err != nil {
+		return nil, err
+	}
+	if e.valueID, err = registry.Register(topic+"-value", valueSchema); err != nil {
+		return nil, err
+	}
+	columnsSchema, err := table.avroRecord(namespace, table.avroFields(func(Column) bool { return true }))
+	if err != nil {
+		return nil, err
+	}
+	if e.columns, err = goavro.NewCodec(columnsSchema); err != nil {
+		return nil, err
+	}
+
+	keySchema, err := table.KeySchema(namespace)
+	if err != nil || keySchema == "" {
+		return e, err
+	}
+	if e.key, err = goavro.NewCodec(keySchema); err != nil {
+		return nil, err
+	}
+	if e.keyID, err = registry.Register(topic+"-key", keySchema); err != nil {
+		return nil, err
+	}
+	return e, nil
+}
+
+// Encode encodes the row committed at the commit ts, the checksum is calculated by the column values.
+func (e *Encoder) Encode(row Row, commitTs uint64) (*Message, error) {
+	native := make(map[string]interface{}, len(e.table.Columns)+6)
+	keyNative := make(map[string]interface{})
+	fields := make([]checksum.FieldMeta, 0, len(e.table.Columns))
+	values := make([]interface{}, 0, len(e.table.Columns))
+	for _, column := range e.table.Columns {
+		value, checksumValue, err := columnValue(column, row[column.Name])
+		if err != nil {
+			return nil, err
+		}
+		if column.Handle {
+			keyNative[column.Name] = value
+		}
+		if column.Nullable && value != nil {
+			value = goavro.Union(avroType(column.TiDBType), value)
+		}
+		native[column.Name] = value
+		fields = append(fields, checksum.FieldMeta{Name: column.Name, MySQLType: mysqlTypes[column.TiDBType]})
+		values = append(values, checksumValue)
+	}
+	for name := range row {
+		if _, ok := native[name]; !ok {
+			return nil, errors.New("unknown column " + name)
+		}
+	}
+	rowChecksum, err := checksum.Calculate(fields, values)
+	if err != nil {
+		return nil, err
+	}
+
+	columns, err := e.columns.BinaryFromNative(nil, native)
+	if err != nil {
+		return nil, err
+	}
+	native["_tidb_op"] = "c"
+	native["_tidb_commit_ts"] = int64(commitTs)
+	native["_tidb_commit_physical_time"] = int64(commitTs >> 18)
+	native["_tidb_row_level_checksum"] = strconv.FormatUint(uint64(rowChecksum), 10)
+	native["_tidb_corrupted"] = false
+	native["_tidb_checksum_version"] = int32(0)
+
+	m := &Message{Checksum: rowChecksum, native: native, columnsEnd: headerSize + len(columns)}
+	if m.Value, err = encode(e.value, e.valueID, native); err != nil {
+		return nil, err
+	}
+	if e.key != nil {
+		if m.Key, err = encode(e.key, e.keyID, keyNative); err != nil {
+			return nil, err
+		}
+	}
+	return m, nil
+}
+
+// Corrupt corrupts the encoded message by the mode, so that the verifier should report it.
+func (e *Encoder) Corrupt(m *Message, mode string, r *rand.Rand) error {
+	switch mode {
+	case CorruptChecksum:
+		m.native["_tidb_row_level_checksum"] = strconv.FormatUint(uint64(m.Checksum+1+uint32(r.Intn(1000))), 10)
+		value, err := encode(e.value, e.valueID, m.native)
+		if err != nil {
+			return err
+		}
+		m.Value = value
+	case CorruptByte:
+		// only the column data is corrupted, since the checksum does not cover the other fields.
+		m.Value[headerSize+r.Intn(m.columnsEnd-headerSize)] ^= byte(1 + r.Intn(255))
+	default:
+		return errors.New("unknown corruption mode: " + mode)
+	}
+	m.Corrupted = mode
+	return nil
+}
+
+func encode(codec *goavro.Codec, schemaID int, native map[string]interface{}) ([]byte, error) {
+	buf := []byte{magicByte}
+	buf = binary.BigEndian.AppendUint32(buf, uint32(schemaID))
+	return codec.BinaryFromNative(buf, native)
+}
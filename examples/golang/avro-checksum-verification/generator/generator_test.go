@@ -0,0 +1,181 @@
+// Copyright 2023 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package generator
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"hash/crc32"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+
+	"github.com/linkedin/goavro/v2"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestTable() *Table {
+	return &Table{Schema: "test", Name: "t", Columns: []Column{
+		{Name: "id", TiDBType: "BIGINT", Handle: true},
+		{Name: "name", TiDBType: "TEXT", Nullable: true},
+		{Name: "color", TiDBType: "ENUM", Allowed: []string{"red", "green"}},
+	}}
+}
+
+func TestEncode(t *testing.T) {
+	t.Parallel()
+
+	registry := NewMemoryRegistry()
+	encoder, err := NewEncoder(newTestTable(), "default", "topic", registry)
+	require.NoError(t, err)
+
+	m, err := encoder.Encode(Row{"id": int64(1), "name": "a", "color": "green"}, 400000000000000000)
+	require.NoError(t, err)
+	// the checksum follows the TiDB rowcodec directly, the enum is the ordinal number.
+	buf := binary.LittleEndian.AppendUint64(nil, 1)
+	buf = append(binary.LittleEndian.AppendUint32(buf, 1), 'a')
+	buf = binary.LittleEndian.AppendUint64(buf, 2)
+	require.Equal(t, crc32.ChecksumIEEE(buf), m.Checksum)
+
+	schemas := registry.Schemas()
+	require.Len(t, schemas, 2)
+	require.Equal(t, byte(0), m.Value[0])
+	codec, err := goavro.NewCodec(schemas[int(binary.BigEndian.Uint32(m.Value[1:5]))])
+	require.NoError(t, err)
+	native, _, err := codec.NativeFromBinary(m.Value[5:])
+	require.NoError(t, err)
+	value := native.(map[string]interface{})
+	require.Equal(t, int64(1), value["id"])
+	require.Equal(t, map[string]interface{}{"string": "a"}, value["name"])
+	require.Equal(t, "green", value["color"])
+	require.Equal(t, int64(400000000000000000), value["_tidb_commit_ts"])
+	require.Equal(t, strconv.FormatUint(uint64(m.Checksum), 10), value["_tidb_row_level_checksum"])
+
+	keyCodec, err := goavro.NewCodec(schemas[int(binary.BigEndian.Uint32(m.Key[1:5]))])
+	require.NoError(t, err)
+	native, _, err = keyCodec.NativeFromBinary(m.Key[5:])
+	require.NoError(t, err)
+	require.Equal(t, map[string]interface{}{"id": int64(1)}, native)
+
+	// the corruption keeps the message decodable, but the checksum differs.
+	require.NoError(t, encoder.Corrupt(m, CorruptChecksum, rand.New(rand.NewSource(1))))
+	require.Equal(t, CorruptChecksum, m.Corrupted)
+	native, _, err = codec.NativeFromBinary(m.Value[5:])
+	require.NoError(t, err)
+	require.NotEqual(t, strconv.FormatUint(uint64(m.Checksum), 10),
+		native.(map[string]interface{})["_tidb_row_level_checksum"])
+	raw := append([]byte(nil), m.Value...)
+	require.NoError(t, encoder.Corrupt(m, CorruptByte, rand.New(rand.NewSource(1))))
+	require.NotEqual(t, raw, m.Value)
+	require.Len(t, m.Value, len(raw))
+	require.ErrorContains(t, encoder.Corrupt(m, "zero", rand.New(rand.NewSource(1))), "unknown corruption mode")
+
+	_, err = encoder.Encode(Row{"id": int64(1), "color": "blue"}, 1)
+	require.ErrorContains(t, err, "not an allowed enum value: blue")
+	_, err = encoder.Encode(Row{"name": "a", "color": "red"}, 1)
+	require.ErrorContains(t, err, "column id is not nullable")
+	_, err = encoder.Encode(Row{"id": int64(1), "color": "red", "x": 1}, 1)
+	require.ErrorContains(t, err, "unknown column x")
+}
+
+func TestTableValidate(t *testing.T) {
+	t.Parallel()
+
+	table := newTestTable()
+	require.NoError(t, table.Validate())
+	table.Columns[0].TiDBType = "VARCHAR"
+	require.ErrorContains(t, table.Validate(), `unknown tidb type "VARCHAR"`)
+	table = newTestTable()
+	table.Columns[2].Allowed = nil
+	require.ErrorContains(t, table.Validate(), "allowed values must be set for the enum and set column only")
+	table = newTestTable()
+	table.Columns[1].Name = "id"
+	require.ErrorContains(t, table.Validate(), "column id defined more than once")
+	table = newTestTable()
+	table.Columns[0].Nullable = true
+	require.ErrorContains(t, table.Validate(), "handle column id must not be nullable")
+	table = newTestTable()
+	table.Columns[2].TiDBType = "SET"
+	table.Columns[2].Allowed = []string{"red", "green,blue"}
+	require.ErrorContains(t, table.Validate(), "set column color has the value containing a comma")
+}
+
+func TestParseRow(t *testing.T) {
+	t.Parallel()
+
+	table := &Table{Schema: "test", Name: "t", Columns: []Column{
+		{Name: "id", TiDBType: "BIGINT UNSIGNED"},
+		{Name: "doc", TiDBType: "JSON", Nullable: true},
+		{Name: "tags", TiDBType: "SET", Allowed: []string{"a", "b", "c"}},
+	}}
+	row, err := table.ParseRow([]byte(`{"id":18446744073709551615,"doc":{"k":1},"tags":"a,c"}`))
+	require.NoError(t, err)
+	require.Equal(t, Row{"id": json.Number("18446744073709551615"), "doc": `{"k":1}`, "tags": "a,c"}, row)
+
+	native, checksumValue, err := columnValue(table.Columns[0], row["id"])
+	require.NoError(t, err)
+	require.Equal(t, "18446744073709551615", native)
+	require.Equal(t, "18446744073709551615", checksumValue)
+	_, checksumValue, err = columnValue(table.Columns[2], row["tags"])
+	require.NoError(t, err)
+	require.Equal(t, uint64(5), checksumValue)
+
+	_, err = table.ParseRow([]byte(`{"x":1}`))
+	require.ErrorContains(t, err, "unknown column x")
+
+	// the random rows are always encodable.
+	encoder, err := NewEncoder(table, "default", "topic", NewMemoryRegistry())
+	require.NoError(t, err)
+	r := rand.New(rand.NewSource(1))
+	for i := 0; i < 100; i++ {
+		_, err := encoder.Encode(table.RandomRow(r), uint64(i))
+		require.NoError(t, err)
+	}
+}
+
+func TestMemoryRegistry(t *testing.T) {
+	t.Parallel()
+
+	registry := NewMemoryRegistry()
+	server := httptest.NewServer(registry)
+	defer server.Close()
+
+	client := NewHTTPRegistry(server.URL + "/")
+	id, err := client.Register("topic-value", `"string"`)
+	require.NoError(t, err)
+	require.Equal(t, 1, id)
+	// the same schema gets the same ID.
+	id, err = client.Register("other-value", `"string"`)
+	require.NoError(t, err)
+	require.Equal(t, 1, id)
+	id, err = registry.Register("topic-key", `"long"`)
+	require.NoError(t, err)
+	require.Equal(t, 2, id)
+
+	resp, err := http.Get(server.URL + "/schemas/ids/2")
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	var body struct {
+		Schema string `json:"schema"`
+	}
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&body))
+	require.Equal(t, `"long"`, body.Schema)
+
+	resp, err = http.Get(server.URL + "/schemas/ids/3")
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusNotFound, resp.StatusCode)
+}
@@ -0,0 +1,142 @@
+// Copyright 2023 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package generator
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Registry registers the avro schema of the subject, and returns the schema ID.
+type Registry interface {
+	Register(subject, schema string) (int, error)
+}
+
+// HTTPRegistry registers the schema to the confluent schema registry.
+type HTTPRegistry struct {
+	url    string
+	client *http.Client
+}
+
+// NewHTTPRegistry returns the registry of the url, such as `http://127.0.0.1:8081`.
+func NewHTTPRegistry(url string) *HTTPRegistry {
+	return &HTTPRegistry{url: strings.TrimSuffix(url, "/"), client: &http.Client{}}
+}
+
+// Register registers the schema under the subject, the existing schema returns the same ID.
+func (r *HTTPRegistry) Register(subject, schema string) (int, error) {
+	body, err := json.Marshal(map[string]string{"schema": schema})
+	if err != nil {
+		return 0, err
+	}
+	resp, err := r.client.Post(r.url+"/subjects/"+subject+"/versions",
+		"application/vnd.schemaregistry.v1+json", bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	content, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return 0, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("register the schema of %s failed, status: %d, response: %s", subject, resp.StatusCode, content)
+	}
+	var result struct {
+		ID int `json:"id"`
+	}
+	if err := json.Unmarshal(content, &result); err != nil {
+		return 0, err
+	}
+	return result.ID, nil
+}
+
+// MemoryRegistry is the schema registry in memory, it serves the registration and the lookup by ID
+// the same as the confluent schema registry, so that the verifier can be tested without deploying one.
+type MemoryRegistry struct {
+	mu      sync.Mutex
+	schemas map[int]string
+	ids     map[string]int
+}
+
+// NewMemoryRegistry returns an empty registry, the schema ID starts from 1.
+func NewMemoryRegistry() *MemoryRegistry {
+	return &MemoryRegistry{schemas: make(map[int]string), ids: make(map[string]int)}
+}
+
+// Register returns the ID of the schema, the same schema gets the same ID under any subject.
+func (r *MemoryRegistry) Register(_, schema string) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if id, ok := r.ids[schema]; ok {
+		return id, nil
+	}
+	id := len(r.schemas) + 1
+	r.schemas[id] = schema
+	r.ids[schema] = id
+	return id, nil
+}
+
+// Schemas returns all registered schemas keyed by ID.
+func (r *MemoryRegistry) Schemas() map[int]string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	result := make(map[int]string, len(r.schemas))
+	for id, schema := range r.schemas {
+		result[id] = schema
+	}
+	return result
+}
+
+// ServeHTTP serves `GET /schemas/ids/{id}` and `POST /subjects/{subject}/versions`.
+func (r *MemoryRegistry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	switch {
+	case req.Method == http.MethodGet && strings.HasPrefix(req.URL.Path, "/schemas/ids/"):
+		id, err := strconv.Atoi(strings.TrimPrefix(req.URL.Path, "/schemas/ids/"))
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		r.mu.Lock()
+		schema, ok := r.schemas[id]
+		r.mu.Unlock()
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{"id": id, "schema": schema})
+	case req.Method == http.MethodPost && strings.HasPrefix(req.URL.Path, "/subjects/") &&
+		strings.HasSuffix(req.URL.Path, "/versions"):
+		var body struct {
+			Schema string `json:"schema"`
+		}
+		if err := json.NewDecoder(req.Body).Decode(&body); err != nil || body.Schema == "" {
+			w.WriteHeader(http.StatusUnprocessableEntity)
+			return
+		}
+		id, _ := r.Register(strings.TrimSuffix(strings.TrimPrefix(req.URL.Path, "/subjects/"), "/versions"), body.Schema)
+		_ = json.NewEncoder(w).Encode(map[string]int{"id": id})
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
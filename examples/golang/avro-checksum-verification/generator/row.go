@@ -0,0 +1,311 @@
+// Copyright 2023 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package generator
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"math"
+	"math/big"
+	"math/rand"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Row is the values of a row keyed by the column name, a missing column is null.
+// The value is one of the integers, float64, string, []byte, json.Number or nil, converted by the column type.
+type Row map[string]interface{}
+
+// ParseRow parses the row from the JSON object, the JSON column accepts the object as is.
+func (t *Table) ParseRow(data []byte) (Row, error) {
+	raws := make(map[string]json.RawMessage)
+	if err := json.Unmarshal(data, &raws); err != nil {
+		return nil, err
+	}
+	columns := make(map[string]Column, len(t.Columns))
+	for _, column := range t.Columns {
+		columns[column.Name] = column
+	}
+	row := make(Row, len(raws))
+	for name, raw := range raws {
+		column, ok := columns[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown column %s", name)
+		}
+		if string(raw) == "null" {
+			row[name] = nil
+			continue
+		}
+		if column.TiDBType == "JSON" && raw[0] != '"' {
+			row[name] = string(raw)
+			continue
+		}
+		decoder := json.NewDecoder(bytes.NewReader(raw))
+		// keep the number as is, the big unsigned integer cannot be represented by float64.
+		decoder.UseNumber()
+		var value interface{}
+		if err := decoder.Decode(&value); err != nil {
+			return nil, err
+		}
+		row[name] = value
+	}
+	return row, nil
+}
+
+// RandomRow generates a row of random values, the nullable column is null in about 10% of the rows.
+func (t *Table) RandomRow(r *rand.Rand) Row {
+	row := make(Row, len(t.Columns))
+	for _, column := range t.Columns {
+		if column.Nullable && r.Intn(10) == 0 {
+			row[column.Name] = nil
+			continue
+		}
+		row[column.Name] = randomValue(column, r)
+	}
+	return row
+}
+
+func randomValue(column Column, r *rand.Rand) interface{} {
+	// the time is truncated to seconds, since the fraction is not carried by the message.
+	at := time.Unix(r.Int63n(2e9), 0)
+	switch column.TiDBType {
+	case "INT":
+		return int64(r.Int31()) - math.MaxInt32/2
+	case "INT UNSIGNED":
+		return uint64(r.Uint32())
+	case "BIGINT":
+		return r.Int63() - math.MaxInt64/2
+	case "BIGINT UNSIGNED", "BIT":
+		return r.Uint64()
+	case "FLOAT":
+		return float64(float32(r.NormFloat64() * 1000))
+	case "DOUBLE":
+		return r.NormFloat64() * 1e6
+	case "DECIMAL":
+		return fmt.Sprintf("%d.%02d", r.Int63n(1e9)-5e8, r.Intn(100))
+	case "TEXT":
+		return randomString(r, 1+r.Intn(32))
+	case "BLOB":
+		value := make([]byte, r.Intn(64))
+		r.Read(value)
+		return value
+	case "ENUM":
+		return column.Allowed[r.Intn(len(column.Allowed))]
+	case "SET":
+		var elems []string
+		for _, elem := range column.Allowed {
+			if r.Intn(2) == 0 {
+				elems = append(elems, elem)
+			}
+		}
+		return strings.Join(elems, ",")
+	case "JSON":
+		return fmt.Sprintf(`{"k": %d, "v": %q}`, r.Intn(1000), randomString(r, 8))
+	case "DATE":
+		return at.Format("2006-01-02")
+	case "DATETIME", "TIMESTAMP":
+		return at.Format("2006-01-02 15:04:05")
+	case "TIME":
+		return fmt.Sprintf("%02d:%02d:%02d", r.Intn(839), r.Intn(60), r.Intn(60))
+	case "YEAR":
+		return int64(1901 + r.Intn(255))
+	}
+	return nil
+}
+
+func randomString(r *rand.Rand, n int) string {
+	const letters = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789"
+	var b strings.Builder
+	for i := 0; i < n; i++ {
+		b.WriteByte(letters[r.Intn(len(letters))])
+	}
+	return b.String()
+}
+
+// columnValue converts the value to the avro native value of the column, and the value for the checksum calculation,
+// which is the value decoded by the consumer, except that the enum and set are converted to the ordinal number.
+func columnValue(column Column, value interface{}) (interface{}, interface{}, error) {
+	if value == nil {
+		if !column.Nullable {
+			return nil, nil, fmt.Errorf("column %s is not nullable", column.Name)
+		}
+		return nil, nil, nil
+	}
+	native, checksumValue, err := columnValueOf(column, value)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid value %v of the column %s: %w", value, column.Name, err)
+	}
+	return native, checksumValue, nil
+}
+
+func columnValueOf(column Column, value interface{}) (interface{}, interface{}, error) {
+	switch column.TiDBType {
+	case "INT", "YEAR":
+		v, err := toInt64(value)
+		if err == nil && (v < math.MinInt32 || v > math.MaxInt32) {
+			err = fmt.Errorf("%d overflows int32", v)
+		}
+		return int32(v), int32(v), err
+	case "INT UNSIGNED":
+		v, err := toUint64(value)
+		if err == nil && v > math.MaxUint32 {
+			err = fmt.Errorf("%d overflows uint32", v)
+		}
+		return int64(v), int64(v), err
+	case "BIGINT":
+		v, err := toInt64(value)
+		return v, v, err
+	case "BIGINT UNSIGNED":
+		v, err := toUint64(value)
+		s := strconv.FormatUint(v, 10)
+		return s, s, err
+	case "FLOAT":
+		v, err := toFloat64(value)
+		return float32(v), float32(v), err
+	case "DOUBLE":
+		v, err := toFloat64(value)
+		return v, v, err
+	case "BIT":
+		v, err := toUint64(value)
+		b := binary.BigEndian.AppendUint64(nil, v)
+		return b, b, err
+	case "DECIMAL":
+		v, err := toString(value)
+		if _, ok := new(big.Rat).SetString(v); err == nil && !ok {
+			err = fmt.Errorf("not a decimal: %s", v)
+		}
+		return v, v, err
+	case "BLOB":
+		v, err := toBytes(value)
+		return v, v, err
+	case "ENUM":
+		v, err := toString(value)
+		if err != nil {
+			return nil, nil, err
+		}
+		i := indexOf(column.Allowed, v)
+		if i < 0 {
+			return nil, nil, fmt.Errorf("not an allowed enum value: %s", v)
+		}
+		return v, uint64(i + 1), nil
+	case "SET":
+		v, err := toString(value)
+		if err != nil {
+			return nil, nil, err
+		}
+		var bits uint64
+		for _, elem := range strings.Split(v, ",") {
+			if elem == "" {
+				continue
+			}
+			i := indexOf(column.Allowed, elem)
+			if i < 0 {
+				return nil, nil, fmt.Errorf("not an allowed set value: %s", elem)
+			}
+			bits |= 1 << i
+		}
+		return v, bits, nil
+	}
+	// the others are encoded as string.
+	v, err := toString(value)
+	return v, v, err
+}
+
+func indexOf(elems []string, elem string) int {
+	for i, e := range elems {
+		if e == elem {
+			return i
+		}
+	}
+	return -1
+}
+
+func toInt64(value interface{}) (int64, error) {
+	switch v := value.(type) {
+	case int:
+		return int64(v), nil
+	case int32:
+		return int64(v), nil
+	case int64:
+		return v, nil
+	case uint64:
+		if v > math.MaxInt64 {
+			return 0, fmt.Errorf("%d overflows int64", v)
+		}
+		return int64(v), nil
+	case json.Number:
+		return strconv.ParseInt(string(v), 10, 64)
+	case string:
+		return strconv.ParseInt(v, 10, 64)
+	}
+	return 0, fmt.Errorf("unexpected type %T", value)
+}
+
+func toUint64(value interface{}) (uint64, error) {
+	switch v := value.(type) {
+	case int, int32, int64:
+		i, _ := toInt64(v)
+		if i < 0 {
+			return 0, fmt.Errorf("%d is negative", i)
+		}
+		return uint64(i), nil
+	case uint64:
+		return v, nil
+	case json.Number:
+		return strconv.ParseUint(string(v), 10, 64)
+	case string:
+		return strconv.ParseUint(v, 10, 64)
+	}
+	return 0, fmt.Errorf("unexpected type %T", value)
+}
+
+func toFloat64(value interface{}) (float64, error) {
+	switch v := value.(type) {
+	case float32:
+		return float64(v), nil
+	case float64:
+		return v, nil
+	case int, int32, int64:
+		i, _ := toInt64(v)
+		return float64(i), nil
+	case json.Number:
+		return strconv.ParseFloat(string(v), 64)
+	case string:
+		return strconv.ParseFloat(v, 64)
+	}
+	return 0, fmt.Errorf("unexpected type %T", value)
+}
+
+func toString(value interface{}) (string, error) {
+	switch v := value.(type) {
+	case string:
+		return v, nil
+	case json.Number:
+		return string(v), nil
+	}
+	return "", fmt.Errorf("unexpected type %T", value)
+}
+
+func toBytes(value interface{}) ([]byte, error) {
+	switch v := value.(type) {
+	case []byte:
+		return v, nil
+	case string:
+		return []byte(v), nil
+	}
+	return nil, fmt.Errorf("unexpected type %T", value)
+}
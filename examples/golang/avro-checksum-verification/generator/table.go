@@ -0,0 +1,200 @@
+// Copyright 2023 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package generator produces the avro messages the same as TiCDC with the row level checksum enabled,
+// so that the verifier and the consumers can be tested end to end without a TiDB cluster.
+package generator
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/pingcap/tidb/pkg/parser/mysql"
+)
+
+// Column is a column of the table definition, in the order of the column ID,
+// which is the order of the checksum calculation.
+type Column struct {
+	Name string `json:"name"`
+	// TiDBType is the `tidb_type` of the column in the avro schema, such as `INT`, `BIGINT UNSIGNED` or `TEXT`.
+	TiDBType string `json:"tidbType"`
+	Nullable bool   `json:"nullable,omitempty"`
+	// Handle is true if the column is a part of the handle key, carried by the message key.
+	Handle bool `json:"handle,omitempty"`
+	// Allowed are the values of the enum and set column.
+	Allowed []string `json:"allowed,omitempty"`
+}
+
+// Table is the table definition of the generated messages.
+type Table struct {
+	Schema  string   `json:"schema"`
+	Name    string   `json:"table"`
+	Columns []Column `json:"columns"`
+}
+
+// LoadTable loads the table definition from the JSON file.
+func LoadTable(path string) (*Table, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var table Table
+	if err := json.Unmarshal(content, &table); err != nil {
+		return nil, fmt.Errorf("invalid table definition %s: %w", path, err)
+	}
+	if err := table.Validate(); err != nil {
+		return nil, err
+	}
+	return &table, nil
+}
+
+// Validate checks the table definition can be encoded.
+func (t *Table) Validate() error {
+	if t.Schema == "" || t.Name == "" {
+		return errors.New("schema and table must be set")
+	}
+	if len(t.Columns) == 0 {
+		return errors.New("table must have at least one column")
+	}
+	names := make(map[string]struct{}, len(t.Columns))
+	for _, column := range t.Columns {
+		if column.Name == "" || strings.HasPrefix(column.Name, "_tidb_") {
+			return fmt.Errorf("invalid column name %q", column.Name)
+		}
+		if _, ok := names[column.Name]; ok {
+			return fmt.Errorf("column %s defined more than once", column.Name)
+		}
+		names[column.Name] = struct{}{}
+		if _, ok := mysqlTypes[column.TiDBType]; !ok {
+			return fmt.Errorf("unknown tidb type %q of the column %s", column.TiDBType, column.Name)
+		}
+		isEnumOrSet := column.TiDBType == "ENUM" || column.TiDBType == "SET"
+		if isEnumOrSet != (len(column.Allowed) > 0) {
+			return fmt.Errorf("allowed values must be set for the enum and set column only, column: %s", column.Name)
+		}
+		if column.TiDBType == "SET" && len(column.Allowed) > 64 {
+			return fmt.Errorf("set column %s has more than 64 values", column.Name)
+		}
+		if column.TiDBType == "SET" && strings.Contains(strings.Join(column.Allowed, ""), ",") {
+			return fmt.Errorf("set column %s has the value containing a comma", column.Name)
+		}
+		if column.Handle && column.Nullable {
+			return fmt.Errorf("handle column %s must not be nullable", column.Name)
+		}
+	}
+	return nil
+}
+
+// mysqlTypes maps the `tidb_type` to the mysql type used by the checksum calculation,
+// the same as the verifier.
+var mysqlTypes = map[string]byte{
+	"INT":             mysql.TypeLong,
+	"INT UNSIGNED":    mysql.TypeLong,
+	"BIGINT":          mysql.TypeLonglong,
+	"BIGINT UNSIGNED": mysql.TypeLonglong,
+	"FLOAT":           mysql.TypeFloat,
+	"DOUBLE":          mysql.TypeDouble,
+	"BIT":             mysql.TypeBit,
+	"DECIMAL":         mysql.TypeNewDecimal,
+	"TEXT":            mysql.TypeVarchar,
+	"BLOB":            mysql.TypeLongBlob,
+	"ENUM":            mysql.TypeEnum,
+	"SET":             mysql.TypeSet,
+	"JSON":            mysql.TypeJSON,
+	"DATE":            mysql.TypeDate,
+	"DATETIME":        mysql.TypeDatetime,
+	"TIMESTAMP":       mysql.TypeTimestamp,
+	"TIME":            mysql.TypeDuration,
+	"YEAR":            mysql.TypeYear,
+}
+
+// avroType returns the avro primitive type of the column, the decimal and the unsigned bigint are encoded as string,
+// which is required by TiCDC to enable the checksum.
+func avroType(tidbType string) string {
+	switch tidbType {
+	case "INT", "YEAR":
+		return "int"
+	case "INT UNSIGNED", "BIGINT":
+		return "long"
+	case "FLOAT":
+		return "float"
+	case "DOUBLE":
+		return "double"
+	case "BIT", "BLOB":
+		return "bytes"
+	}
+	return "string"
+}
+
+// ValueSchema returns the avro value schema of the table, the namespace is the one of the changefeed.
+func (t *Table) ValueSchema(namespace string) (string, error) {
+	fields := t.avroFields(func(Column) bool { return true })
+	fields = append(fields,
+		map[string]interface{}{"name": "_tidb_op", "type": "string", "default": ""},
+		map[string]interface{}{"name": "_tidb_commit_ts", "type": "long", "default": 0},
+		map[string]interface{}{"name": "_tidb_commit_physical_time", "type": "long", "default": 0},
+		map[string]interface{}{"name": "_tidb_row_level_checksum", "type": "string", "default": ""},
+		map[string]interface{}{"name": "_tidb_corrupted", "type": "boolean", "default": false},
+		map[string]interface{}{"name": "_tidb_checksum_version", "type": "int", "default": 0},
+	)
+	return t.avroRecord(namespace, fields)
+}
+
+// KeySchema returns the avro key schema of the handle columns, empty if no handle column.
+func (t *Table) KeySchema(namespace string) (string, error) {
+	fields := t.avroFields(func(c Column) bool { return c.Handle })
+	if len(fields) == 0 {
+		return "", nil
+	}
+	return t.avroRecord(namespace, fields)
+}
+
+func (t *Table) avroFields(include func(Column) bool) []interface{} {
+	var fields []interface{}
+	for _, column := range t.Columns {
+		if !include(column) {
+			continue
+		}
+		parameters := map[string]interface{}{"tidb_type": column.TiDBType}
+		if len(column.Allowed) > 0 {
+			// the comma in the value is escaped as TiCDC does.
+			allowed := make([]string, 0, len(column.Allowed))
+			for _, elem := range column.Allowed {
+				allowed = append(allowed, strings.ReplaceAll(elem, ",", "\\,"))
+			}
+			parameters["allowed"] = strings.Join(allowed, ",")
+		}
+		var ty interface{} = map[string]interface{}{"type": avroType(column.TiDBType), "connect.parameters": parameters}
+		field := map[string]interface{}{"name": column.Name}
+		if column.Nullable {
+			ty = []interface{}{"null", ty}
+			field["default"] = nil
+		}
+		field["type"] = ty
+		fields = append(fields, field)
+	}
+	return fields
+}
+
+func (t *Table) avroRecord(namespace string, fields []interface{}) (string, error) {
+	schema, err := json.Marshal(map[string]interface{}{
+		"type":      "record",
+		"name":      t.Name,
+		"namespace": namespace + "." + t.Schema,
+		"fields":    fields,
+	})
+	return string(schema), err
+}
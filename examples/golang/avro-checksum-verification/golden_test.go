@@ -0,0 +1,218 @@
+// Copyright 2023 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"avro-checksum-sample/checksum"
+	"github.com/linkedin/goavro/v2"
+	"github.com/segmentio/kafka-go"
+	"github.com/stretchr/testify/require"
+)
+
+const (
+	// goldenDir has the golden messages `messages/{index}.value` and `messages/{index}.key`,
+	// along with the schemas `messages/schemas/{id}.avsc`, and the expected checksums `expected.json`,
+	// all of them are dumped from TiDB and the avro encoder of TiCDC by `generate.sh`.
+	goldenDir = "testdata/golden"
+	// goldenTimeZone is the time zone the TIMESTAMP values of the golden messages are converted in.
+	goldenTimeZone = "UTC"
+)
+
+// goldenColumn is the bytes of a column accumulated by the checksum calculation, the value is for the readability,
+// the expected ones are encoded by the rowcodec of TiDB.
+type goldenColumn struct {
+	Name     string `json:"name"`
+	TiDBType string `json:"tidbType"`
+	Value    string `json:"value"`
+	Bytes    string `json:"bytes"`
+}
+
+// goldenMessage is the expected checksum of a golden message.
+type goldenMessage struct {
+	File     string         `json:"file"`
+	Table    string         `json:"table"`
+	CommitTs uint64         `json:"commitTs"`
+	Checksum uint64         `json:"checksum"`
+	Columns  []goldenColumn `json:"columns"`
+}
+
+type goldenFile struct {
+	TimeZone string          `json:"timeZone"`
+	Messages []goldenMessage `json:"messages"`
+}
+
+// readGoldenMessages reads the golden messages in the order of the file names.
+func readGoldenMessages(t *testing.T) ([]string, []kafka.Message) {
+	paths, err := filepath.Glob(filepath.Join(goldenDir, "messages", "*.value"))
+	require.NoError(t, err)
+	require.NotEmpty(t, paths, "no golden message, run %s/generate.sh", goldenDir)
+	sort.Strings(paths)
+	names := make([]string, 0, len(paths))
+	messages := make([]kafka.Message, 0, len(paths))
+	for i, path := range paths {
+		value, err := os.ReadFile(path)
+		require.NoError(t, err)
+		key, err := os.ReadFile(strings.TrimSuffix(path, ".value") + ".key")
+		if !os.IsNotExist(err) {
+			require.NoError(t, err)
+		}
+		names = append(names, filepath.Base(path))
+		messages = append(messages, kafka.Message{Topic: "golden", Offset: int64(i), Key: key, Value: value})
+	}
+	return names, messages
+}
+
+// decodeGoldenMessage decodes the value by the schemas of the golden dir, and returns the bytes of each column.
+func decodeGoldenMessage(t *testing.T, name string, value []byte) (map[string]interface{}, map[string]interface{}, goldenMessage) {
+	valueMap, valueSchema, rest, err := getValueMapAndSchema(value, func(schemaID int) (*goavro.Codec, error) {
+		return loadLocalSchema(filepath.Join(goldenDir, "messages", "schemas"), schemaID)
+	})
+	require.NoError(t, err, name)
+	require.Empty(t, rest, name)
+	expected, ok, err := getExpectedChecksum(valueMap)
+	require.NoError(t, err, name)
+	require.True(t, ok, "%s does not carry the checksum", name)
+
+	fields, err := avroFields(valueSchema)
+	require.NoError(t, err, name)
+	tidbTypes := make(map[string]string, len(fields))
+	for _, field := range fields {
+		fieldName, _ := field["name"].(string)
+		tidbTypes[fieldName], _ = avroParameters(field)["tidb_type"].(string)
+	}
+	metas, values, err := checksumColumns(valueMap, valueSchema)
+	require.NoError(t, err, name)
+	message := goldenMessage{
+		File: name, Table: avroTableName(valueSchema), CommitTs: getCommitTs(valueMap), Checksum: expected,
+	}
+	for i, meta := range metas {
+		bytes, err := checksum.Bytes([]checksum.FieldMeta{meta}, []interface{}{values[i]})
+		require.NoError(t, err, "%s column %s", name, meta.Name)
+		message.Columns = append(message.Columns, goldenColumn{
+			Name: meta.Name, TiDBType: tidbTypes[meta.Name], Value: goldenValue(values[i], meta), Bytes: hex.EncodeToString(bytes),
+		})
+	}
+	return valueMap, valueSchema, message
+}
+
+// goldenValue renders the value of the checksum calculation.
+func goldenValue(value interface{}, meta checksum.FieldMeta) string {
+	switch v := value.(type) {
+	case nil:
+		return "NULL"
+	case []byte:
+		return "0x" + hex.EncodeToString(v)
+	case *big.Rat:
+		return v.FloatString(meta.Scale)
+	}
+	return fmt.Sprint(value)
+}
+
+// diffGoldenColumns returns the columns whose bytes differ from the expected ones, one line for each.
+func diffGoldenColumns(expected, actual []goldenColumn) []string {
+	var diffs []string
+	actualColumns := make(map[string]goldenColumn, len(actual))
+	for _, c := range actual {
+		actualColumns[c.Name] = c
+	}
+	for _, e := range expected {
+		a, ok := actualColumns[e.Name]
+		delete(actualColumns, e.Name)
+		switch {
+		case !ok:
+			diffs = append(diffs, fmt.Sprintf("  %s (%s): missing, expected %s [%s]", e.Name, e.TiDBType, e.Value, e.Bytes))
+		case a.Bytes != e.Bytes:
+			diffs = append(diffs, fmt.Sprintf("  %s (%s):\n    expected %s [%s]\n    actual   %s [%s]",
+				e.Name, e.TiDBType, e.Value, e.Bytes, a.Value, a.Bytes))
+		}
+	}
+	for _, a := range actual {
+		if _, ok := actualColumns[a.Name]; ok {
+			diffs = append(diffs, fmt.Sprintf("  %s (%s): unexpected %s [%s]", a.Name, a.TiDBType, a.Value, a.Bytes))
+		}
+	}
+	return diffs
+}
+
+// TestGoldenMessages verifies the golden messages, regenerate them by `testdata/golden/generate.sh`.
+// It's not parallel, since the TIMESTAMP values are converted in the local time zone, which is replaced.
+func TestGoldenMessages(t *testing.T) {
+	loc, err := time.LoadLocation(goldenTimeZone)
+	require.NoError(t, err)
+	local := time.Local
+	time.Local = loc
+	defer func() { time.Local = local }()
+
+	names, messages := readGoldenMessages(t)
+	content, err := os.ReadFile(filepath.Join(goldenDir, "expected.json"))
+	require.NoError(t, err)
+	var golden goldenFile
+	require.NoError(t, json.Unmarshal(content, &golden))
+	require.Equal(t, goldenTimeZone, golden.TimeZone)
+	require.Len(t, golden.Messages, len(names))
+	for i, name := range names {
+		expected := golden.Messages[i]
+		require.Equal(t, expected.File, name)
+		valueMap, valueSchema, actual := decodeGoldenMessage(t, name, messages[i].Value)
+		require.Equal(t, expected.Table, actual.Table, name)
+		require.Equal(t, expected.CommitTs, actual.CommitTs, name)
+		require.Equal(t, expected.Checksum, actual.Checksum, "%s carries another checksum", name)
+		if diffs := diffGoldenColumns(expected.Columns, actual.Columns); len(diffs) > 0 {
+			t.Errorf("%s of %s: the bytes of %d columns differ from the golden ones\n%s",
+				name, expected.Table, len(diffs), strings.Join(diffs, "\n"))
+			continue
+		}
+		require.NoError(t, CalculateAndVerifyChecksum(valueMap, valueSchema), name)
+	}
+
+	// the golden messages are verified end to end by the verifier, with the schemas of the golden dir.
+	cfg := newDefaultConfig()
+	cfg.schemaDir = filepath.Join(goldenDir, "messages", "schemas")
+	v := newTestVerifier(cfg, &fakeReader{messages: messages})
+	err = v.run(context.Background())
+	require.Equal(t, exitCodeClean, v.finish(err))
+	require.Equal(t, counters{Messages: uint64(len(messages)), Verified: uint64(len(messages))}, v.counters)
+}
+
+func TestDiffGoldenColumns(t *testing.T) {
+	t.Parallel()
+
+	expected := []goldenColumn{
+		{Name: "id", TiDBType: "BIGINT", Value: "1", Bytes: "0100000000000000"},
+		{Name: "d", TiDBType: "DECIMAL", Value: "1.50", Bytes: "04000000312e3530"},
+		{Name: "gone", TiDBType: "TEXT", Value: "a", Bytes: "0100000061"},
+	}
+	actual := []goldenColumn{
+		{Name: "id", TiDBType: "BIGINT", Value: "1", Bytes: "0100000000000000"},
+		{Name: "d", TiDBType: "DECIMAL", Value: "1.5", Bytes: "03000000312e35"},
+		{Name: "new", TiDBType: "INT", Value: "NULL", Bytes: ""},
+	}
+	require.Equal(t, []string{
+		"  d (DECIMAL):\n    expected 1.50 [04000000312e3530]\n    actual   1.5 [03000000312e35]",
+		"  gone (TEXT): missing, expected a [0100000061]",
+		"  new (INT): unexpected NULL []",
+	}, diffGoldenColumns(expected, actual))
+}
@@ -0,0 +1,52 @@
+// Copyright 2023 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+
+	"avro-checksum-sample/checksum"
+)
+
+// detectHandlingMode sets the decimal-handling-mode or the bigint-unsigned-handling-mode of the column
+// by the avro type, it fails if the column is encoded in the way the verifier cannot handle.
+func detectHandlingMode(meta *checksum.FieldMeta, tidbType string, field map[string]interface{}) error {
+	fieldType := avroFieldType(field)
+	avroType, _ := fieldType["type"].(string)
+	switch tidbType {
+	case "DECIMAL":
+		switch {
+		case avroType == "string":
+			meta.Handling = checksum.HandlingString
+		case avroType == "bytes" && fieldType["logicalType"] == "decimal":
+			// the scale is 0 if omitted, as defined by the avro specification.
+			scale, _ := fieldType["scale"].(float64)
+			meta.Handling, meta.Scale = checksum.HandlingPrecise, int(scale)
+		default:
+			return fmt.Errorf("DECIMAL encoded as the avro %q is not supported, "+
+				"set decimal-handling-mode to string in the changefeed", avroType)
+		}
+	case "BIGINT UNSIGNED":
+		switch avroType {
+		case "string":
+			meta.Handling = checksum.HandlingString
+		case "long":
+			meta.Handling = checksum.HandlingLong
+		default:
+			return fmt.Errorf("BIGINT UNSIGNED encoded as the avro %q is not supported, "+
+				"set bigint-unsigned-handling-mode to string in the changefeed", avroType)
+		}
+	}
+	return nil
+}
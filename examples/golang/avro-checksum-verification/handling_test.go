@@ -0,0 +1,119 @@
+// Copyright 2023 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"math/big"
+	"strconv"
+	"strings"
+	"testing"
+
+	"avro-checksum-sample/checksum"
+	"github.com/linkedin/goavro/v2"
+	"github.com/pingcap/tidb/pkg/parser/mysql"
+	"github.com/segmentio/kafka-go"
+	"github.com/stretchr/testify/require"
+)
+
+// testPreciseSchema is the value schema of the table `test`.`p` (id BIGINT UNSIGNED PRIMARY KEY, d DECIMAL(10, 2)),
+// sent by the changefeed with decimal-handling-mode=precise and bigint-unsigned-handling-mode=long.
+const testPreciseSchema = `{
+  "type": "record",
+  "name": "p",
+  "namespace": "default.test",
+  "fields": [
+    {"name": "id", "type": {"type": "long", "connect.parameters": {"tidb_type": "BIGINT UNSIGNED"}}},
+    {"name": "d", "type": ["null", {"type": "bytes", "logicalType": "decimal", "precision": 10, "scale": 2,
+      "connect.parameters": {"tidb_type": "DECIMAL"}}], "default": null},
+    {"name": "_tidb_op", "type": "string", "default": ""},
+    {"name": "_tidb_commit_ts", "type": "long", "default": 0},
+    {"name": "_tidb_row_level_checksum", "type": "string", "default": ""}
+  ]
+}`
+
+func TestDetectHandlingMode(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		tidbType  string
+		fieldType string
+		handling  checksum.HandlingMode
+		scale     int
+		err       string
+	}{
+		{tidbType: "DECIMAL", fieldType: `{"type": "string"}`, handling: checksum.HandlingString},
+		{tidbType: "DECIMAL", fieldType: `["null", {"type": "bytes", "logicalType": "decimal", "scale": 3}]`,
+			handling: checksum.HandlingPrecise, scale: 3},
+		{tidbType: "DECIMAL", fieldType: `{"type": "bytes", "logicalType": "decimal"}`, handling: checksum.HandlingPrecise},
+		{tidbType: "DECIMAL", fieldType: `{"type": "bytes"}`, err: "set decimal-handling-mode to string"},
+		{tidbType: "DECIMAL", fieldType: `{"type": "double"}`, err: "set decimal-handling-mode to string"},
+		{tidbType: "BIGINT UNSIGNED", fieldType: `{"type": "string"}`, handling: checksum.HandlingString},
+		{tidbType: "BIGINT UNSIGNED", fieldType: `{"type": "long"}`, handling: checksum.HandlingLong},
+		{tidbType: "BIGINT UNSIGNED", fieldType: `{"type": "int"}`, err: "set bigint-unsigned-handling-mode to string"},
+		{tidbType: "BIGINT", fieldType: `{"type": "long"}`},
+	}
+	for _, c := range cases {
+		var field map[string]interface{}
+		require.NoError(t, json.Unmarshal([]byte(`{"name": "c", "type": `+c.fieldType+`}`), &field))
+		meta := checksum.FieldMeta{Name: "c"}
+		err := detectHandlingMode(&meta, c.tidbType, field)
+		if c.err != "" {
+			require.ErrorContains(t, err, c.err, c.fieldType)
+			continue
+		}
+		require.NoError(t, err, c.fieldType)
+		require.Equal(t, c.handling, meta.Handling, c.fieldType)
+		require.Equal(t, c.scale, meta.Scale, c.fieldType)
+	}
+}
+
+func TestAvroPreciseHandling(t *testing.T) {
+	t.Parallel()
+
+	unsupported := strings.Replace(testPreciseSchema, `"logicalType": "decimal", `, "", 1)
+	registry := newTestRegistry(t, map[int]string{testSchemaID: testPreciseSchema, 3: unsupported})
+	cfg := newDefaultConfig()
+	cfg.schemaRegistryURL = registry.URL
+	v, err := newMessageVerifier(cfg)
+	require.NoError(t, err)
+	v.(*avroVerifier).collectRows = true
+
+	// the checksum is calculated by TiDB from the unsigned value and the decimal string formatted by the scale.
+	fields := []checksum.FieldMeta{{MySQLType: mysql.TypeLonglong}, {MySQLType: mysql.TypeNewDecimal}}
+	expected, err := checksum.Calculate(fields, []interface{}{uint64(18446744073709551615), "1.20"})
+	require.NoError(t, err)
+	native := map[string]interface{}{
+		"id":                       int64(-1),
+		"d":                        goavro.Union("bytes.decimal", big.NewRat(6, 5)),
+		"_tidb_op":                 "c",
+		"_tidb_commit_ts":          int64(100),
+		"_tidb_row_level_checksum": strconv.FormatUint(uint64(expected), 10),
+	}
+	result, err := v.verify(kafka.Message{Value: encodeTestMessage(t, testSchemaID, testPreciseSchema, native)})
+	require.NoError(t, err)
+	require.Equal(t, outcomeVerified, result.outcome)
+	require.Len(t, result.rows, 1)
+	require.Equal(t, "1.20", result.rows[0].columns[1].value)
+	columns := v.(*avroVerifier).schemaColumns[testSchemaID]
+	require.Equal(t, checksum.HandlingLong, columns[0].meta.Handling)
+	require.Equal(t, checksum.HandlingPrecise, columns[1].meta.Handling)
+	require.Equal(t, 2, columns[1].meta.Scale)
+
+	// the decimal bytes without the logical type cannot be handled, it fails by the schema naming the column.
+	native["d"] = goavro.Union("bytes", []byte{0x78})
+	_, err = v.verify(kafka.Message{Value: encodeTestMessage(t, 3, unsupported, native)})
+	require.ErrorContains(t, err, "column d: DECIMAL encoded as the avro \"bytes\" is not supported")
+	require.ErrorContains(t, err, "decimal-handling-mode")
+}
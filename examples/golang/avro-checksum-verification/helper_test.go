@@ -0,0 +1,171 @@
+// Copyright 2023 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"hash/crc32"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/linkedin/goavro/v2"
+	"github.com/segmentio/kafka-go"
+	"github.com/stretchr/testify/require"
+)
+
+// testValueSchema is the value schema of the table `test`.`t` (id BIGINT PRIMARY KEY, name TEXT),
+// encoded by TiCDC with the checksum enabled.
+const testValueSchema = `{
+  "type": "record",
+  "name": "t",
+  "namespace": "default.test",
+  "fields": [
+    {"name": "id", "type": {"type": "long", "connect.parameters": {"tidb_type": "BIGINT"}}},
+    {"name": "name", "type": ["null", {"type": "string", "connect.parameters": {"tidb_type": "TEXT"}}], "default": null},
+    {"name": "_tidb_op", "type": "string", "default": ""},
+    {"name": "_tidb_commit_ts", "type": "long", "default": 0},
+    {"name": "_tidb_commit_physical_time", "type": "long", "default": 0},
+    {"name": "_tidb_row_level_checksum", "type": "string", "default": ""},
+    {"name": "_tidb_corrupted", "type": "boolean", "default": false},
+    {"name": "_tidb_checksum_version", "type": "int", "default": 0}
+  ]
+}`
+
+const testSchemaID = 1
+
+// newTestRegistry starts a fake schema registry serving the given schemas by id.
+func newTestRegistry(t *testing.T, schemas map[int]string) *httptest.Server {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id, err := strconv.Atoi(strings.TrimPrefix(r.URL.Path, "/schemas/ids/"))
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		schema, ok := schemas[id]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		_ = json.NewEncoder(w).Encode(lookupResponse{SchemaID: id, Schema: schema})
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+// testRowChecksum calculates the checksum of the row in the table `test`.`t`,
+// it follows the TiDB rowcodec directly, instead of the code under test.
+func testRowChecksum(id int64, name *string) uint32 {
+	buf := binary.LittleEndian.AppendUint64(nil, uint64(id))
+	if name != nil {
+		buf = binary.LittleEndian.AppendUint32(buf, uint32(len(*name)))
+		buf = append(buf, *name...)
+	}
+	return crc32.ChecksumIEEE(buf)
+}
+
+// newTestRow returns the avro native value of the row in the table `test`.`t`,
+// checksum is the checksum carried by the row, empty if the checksum is not enabled.
+func newTestRow(id int64, name *string, commitTs int64, checksum string) map[string]interface{} {
+	var nameValue interface{}
+	if name != nil {
+		nameValue = goavro.Union("string", *name)
+	}
+	return map[string]interface{}{
+		"id":                         id,
+		"name":                       nameValue,
+		"_tidb_op":                   "c",
+		"_tidb_commit_ts":            commitTs,
+		"_tidb_commit_physical_time": commitTs >> 18,
+		"_tidb_row_level_checksum":   checksum,
+		"_tidb_corrupted":            false,
+		"_tidb_checksum_version":     int32(0),
+	}
+}
+
+// encodeTestMessage encodes the native value in the confluent wire format.
+func encodeTestMessage(t *testing.T, schemaID int, schema string, native map[string]interface{}) []byte {
+	codec, err := goavro.NewCodec(schema)
+	require.NoError(t, err)
+
+	buf := []byte{magicByte}
+	buf = binary.BigEndian.AppendUint32(buf, uint32(schemaID))
+	buf, err = codec.BinaryFromNative(buf, native)
+	require.NoError(t, err)
+	return buf
+}
+
+// newVerifiedTestMessage returns a message of the table `test`.`t` carrying the correct checksum.
+func newVerifiedTestMessage(t *testing.T, offset int64, id int64, name string) kafka.Message {
+	checksum := strconv.FormatUint(uint64(testRowChecksum(id, &name)), 10)
+	value := encodeTestMessage(t, testSchemaID, testValueSchema, newTestRow(id, &name, 400000000000000000+offset, checksum))
+	return kafka.Message{Topic: "test", Offset: offset, Value: value}
+}
+
+// newMismatchTestMessage returns a message of the table `test`.`t` carrying a wrong checksum.
+func newMismatchTestMessage(t *testing.T, offset int64, id int64, name string) kafka.Message {
+	checksum := strconv.FormatUint(uint64(testRowChecksum(id, &name)+1), 10)
+	value := encodeTestMessage(t, testSchemaID, testValueSchema, newTestRow(id, &name, 400000000000000000+offset, checksum))
+	return kafka.Message{Topic: "test", Offset: offset, Value: value}
+}
+
+// fakeReader returns the messages in order, and returns context.Canceled after all consumed,
+// which ends the verification as if it's interrupted.
+type fakeReader struct {
+	messages  []kafka.Message
+	next      int
+	committed []kafka.Message
+}
+
+func (r *fakeReader) FetchMessage(_ context.Context) (kafka.Message, error) {
+	if r.next >= len(r.messages) {
+		return kafka.Message{}, context.Canceled
+	}
+	message := r.messages[r.next]
+	r.next++
+	return message, nil
+}
+
+func (r *fakeReader) CommitMessages(_ context.Context, messages ...kafka.Message) error {
+	r.committed = append(r.committed, messages...)
+	return nil
+}
+
+func (r *fakeReader) Close() error { return nil }
+
+func (r *fakeReader) committedOffsets() []int64 {
+	result := make([]int64, 0, len(r.committed))
+	for _, message := range r.committed {
+		result = append(result, message.Offset)
+	}
+	return result
+}
+
+// newTestVerifier creates a verifier consuming from the fake reader.
+func newTestVerifier(cfg *config, reader *fakeReader) *verifier {
+	messageVerifier, err := newMessageVerifier(cfg)
+	if err != nil {
+		panic(err)
+	}
+	return &verifier{
+		cfg: cfg, reader: reader, messageVerifier: messageVerifier, report: newReport(),
+		resolved: newResolvedTracker(cfg.resolvedTsStall, cfg.resolvedTsJump, nil, time.Now()), latency: newLatencyTracker(),
+		skew: newSkewTracker(cfg.kafkaTimestampType, cfg.maxSkew), guard: newCommitGuard(),
+	}
+}
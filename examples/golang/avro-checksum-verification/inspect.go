@@ -0,0 +1,238 @@
+// Copyright 2023 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+
+	"avro-checksum-sample/checksum"
+	"github.com/pingcap/log"
+	"github.com/pingcap/tidb/pkg/parser/mysql"
+	parsertypes "github.com/pingcap/tidb/pkg/parser/types"
+	"go.uber.org/zap"
+)
+
+// schemaField is a column of the avro schema as parsed by the verifier for the checksum calculation.
+type schemaField struct {
+	Name     string `json:"name"`
+	TiDBType string `json:"tidbType"`
+	// MySQLType and MySQLTypeCode are the name and the value of the FieldMeta.MySQLType.
+	MySQLType     string `json:"mysqlType,omitempty"`
+	MySQLTypeCode byte   `json:"mysqlTypeCode,omitempty"`
+	// Handling is the detected handling mode of the decimal or the unsigned bigint column.
+	Handling checksum.HandlingMode `json:"handling,omitempty"`
+	// LogicalType is the avro logical type of the temporal column, empty if it's encoded as the string.
+	LogicalType string `json:"logicalType,omitempty"`
+	// Unsupported is the reason why the verifier cannot handle the column, empty if it can.
+	Unsupported string `json:"unsupported,omitempty"`
+}
+
+// parseSchemaFields parses the columns of the avro schema, in the order of the checksum calculation.
+func parseSchemaFields(schema map[string]interface{}) ([]schemaField, error) {
+	fields, ok := schema["fields"].([]interface{})
+	if !ok {
+		return nil, errors.New("schema fields not found")
+	}
+	result := make([]schemaField, 0, len(fields))
+	for _, item := range fields {
+		field, ok := item.(map[string]interface{})
+		if !ok {
+			return nil, errors.New("schema field should be a map")
+		}
+		name, _ := field["name"].(string)
+		if name == "_tidb_op" {
+			break
+		}
+
+		f := schemaField{Name: name, TiDBType: avroTiDBType(field)}
+		mysqlType, ok := lookupMySQLType(f.TiDBType)
+		switch {
+		case f.TiDBType == "":
+			f.Unsupported = "tidb_type not found in the connect.parameters"
+		case !ok:
+			f.Unsupported = "unknown TiDB type " + f.TiDBType
+		case mysqlType == mysql.TypeEnum || mysqlType == mysql.TypeSet:
+			if _, ok := avroParameters(field)["allowed"].(string); !ok {
+				f.Unsupported = "allowed values not found in the connect.parameters"
+			}
+		default:
+			meta := checksum.FieldMeta{Name: name, MySQLType: mysqlType}
+			if err := detectHandlingMode(&meta, f.TiDBType, field); err != nil {
+				f.Unsupported = err.Error()
+			}
+			f.Handling = meta.Handling
+			temporal, err := detectTemporalEncoding(f.TiDBType, field, avroParameters(field))
+			switch {
+			case err != nil:
+				f.Unsupported = err.Error()
+			case temporal != nil:
+				f.LogicalType = temporal.logicalType
+			}
+		}
+		if ok {
+			charset := ""
+			if f.TiDBType == "BLOB" {
+				charset = "binary"
+			}
+			f.MySQLType, f.MySQLTypeCode = parsertypes.TypeToStr(mysqlType, charset), mysqlType
+		}
+		result = append(result, f)
+	}
+	return result, nil
+}
+
+type inspectSchemaConfig struct {
+	schemaRegistryURL string
+	// the schema is fetched by schemaID, or the version of the subject, or read from schemaFile.
+	schemaID   int
+	subject    string
+	version    string
+	schemaFile string
+}
+
+func (c *inspectSchemaConfig) bindFlags(fs *flag.FlagSet) {
+	fs.StringVar(&c.schemaRegistryURL, "schema-registry-url", "http://127.0.0.1:8081", "schema registry url")
+	fs.IntVar(&c.schemaID, "schema-id", 0, "ID of the schema to inspect")
+	fs.StringVar(&c.subject, "subject", "", "subject of the schema to inspect, such as `avro-checksum-test-value`")
+	fs.StringVar(&c.version, "version", "latest", "version of the subject")
+	fs.StringVar(&c.schemaFile, "schema-file", "", "file of the schema to inspect, instead of the schema registry")
+}
+
+func (c *inspectSchemaConfig) validate() error {
+	var sources int
+	for _, set := range []bool{c.schemaID > 0, c.subject != "", c.schemaFile != ""} {
+		if set {
+			sources++
+		}
+	}
+	if sources != 1 {
+		return errors.New("exactly one of schema ID, subject and schema file should be set")
+	}
+	return nil
+}
+
+// inspectResult is the output of the `inspect-schema` command.
+type inspectResult struct {
+	SchemaID int    `json:"schemaId,omitempty"`
+	Table    string `json:"table,omitempty"`
+	// Fields are the columns involved in the checksum calculation.
+	Fields []schemaField `json:"fields"`
+	// Unsupported is the number of the columns the verifier cannot handle.
+	Unsupported int `json:"unsupported"`
+}
+
+// runInspectSchema prints the columns of the schema parsed by the verifier,
+// the exit code is the decode error one if any column cannot be handled.
+func runInspectSchema(args []string, w io.Writer) int {
+	cfg := &inspectSchemaConfig{}
+	fs := flag.NewFlagSet(commandInspectSchema, flag.ExitOnError)
+	cfg.bindFlags(fs)
+	_ = fs.Parse(args)
+	if err := cfg.validate(); err != nil {
+		log.Fatal("invalid configuration", zap.Error(err))
+	}
+
+	result, err := inspectSchema(cfg)
+	if err != nil {
+		log.Error("inspect schema failed", zap.Error(err))
+		return exitCodeOf(err)
+	}
+	if err := writeJSON(w, result); err != nil {
+		log.Error("write the result failed", zap.Error(err))
+		return exitCodeInfraError
+	}
+	if result.Unsupported > 0 {
+		return exitCodeDecodeError
+	}
+	return exitCodeClean
+}
+
+func inspectSchema(cfg *inspectSchemaConfig) (*inspectResult, error) {
+	result := &inspectResult{SchemaID: cfg.schemaID}
+	var content string
+	switch {
+	case cfg.schemaFile != "":
+		data, err := os.ReadFile(cfg.schemaFile)
+		if err != nil {
+			return nil, err
+		}
+		content = string(data)
+	case cfg.subject != "":
+		id, schema, err := getSchemaBySubject(cfg.schemaRegistryURL, cfg.subject, cfg.version)
+		if err != nil {
+			return nil, newInfraError(err)
+		}
+		result.SchemaID, content = id, schema
+	default:
+		codec, err := GetSchema(cfg.schemaRegistryURL, cfg.schemaID)
+		if err != nil {
+			return nil, newInfraError(err)
+		}
+		content = codec.Schema()
+	}
+
+	schema := make(map[string]interface{})
+	if err := json.Unmarshal([]byte(content), &schema); err != nil {
+		return nil, newDecodeError(err)
+	}
+	fields, err := parseSchemaFields(schema)
+	if err != nil {
+		return nil, newDecodeError(err)
+	}
+	result.Table, result.Fields = avroTableName(schema), fields
+	for _, f := range fields {
+		if f.Unsupported != "" {
+			result.Unsupported++
+		}
+	}
+	return result, nil
+}
+
+// getSchemaBySubject fetches the schema of the subject version from the schema registry,
+// the version is a number or `latest`.
+func getSchemaBySubject(registryURL, subject, version string) (int, string, error) {
+	requestURI := registryURL + "/subjects/" + url.PathEscape(subject) + "/versions/" + url.PathEscape(version)
+	resp, err := http.Get(requestURI)
+	if err != nil {
+		return 0, "", err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return 0, "", err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return 0, "", fmt.Errorf("failed to query the schema of the subject %s version %s, status: %d, response: %s",
+			subject, version, resp.StatusCode, body)
+	}
+	var jsonResp lookupResponse
+	if err := json.Unmarshal(body, &jsonResp); err != nil {
+		return 0, "", err
+	}
+	return jsonResp.SchemaID, jsonResp.Schema, nil
+}
+
+func writeJSON(w io.Writer, v interface{}) error {
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(v)
+}
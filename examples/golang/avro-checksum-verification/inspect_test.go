@@ -0,0 +1,92 @@
+// Copyright 2023 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestInspectSchema(t *testing.T) {
+	t.Parallel()
+
+	registry := newTestRegistry(t, map[int]string{testSchemaID: testValueSchema})
+	var out bytes.Buffer
+	code := runInspectSchema([]string{"--schema-registry-url", registry.URL, "--schema-id", strconv.Itoa(testSchemaID)}, &out)
+	require.Equal(t, exitCodeClean, code)
+	var result inspectResult
+	require.NoError(t, json.Unmarshal(out.Bytes(), &result))
+	require.Equal(t, inspectResult{SchemaID: testSchemaID, Table: "test.t", Fields: []schemaField{
+		{Name: "id", TiDBType: "BIGINT", MySQLType: "bigint", MySQLTypeCode: 8},
+		{Name: "name", TiDBType: "TEXT", MySQLType: "varchar", MySQLTypeCode: 15},
+	}}, result)
+
+	// the columns which the verifier cannot handle are flagged.
+	schema := `{
+  "type": "record",
+  "name": "u",
+  "namespace": "default.test",
+  "fields": [
+    {"name": "id", "type": {"type": "long", "connect.parameters": {"tidb_type": "BIGINT"}}},
+    {"name": "data", "type": {"type": "bytes", "connect.parameters": {"tidb_type": "BLOB"}}},
+    {"name": "g", "type": {"type": "string", "connect.parameters": {"tidb_type": "GEOMETRY"}}},
+    {"name": "e", "type": ["null", {"type": "string", "connect.parameters": {"tidb_type": "ENUM"}}]},
+    {"name": "raw", "type": "string"},
+    {"name": "_tidb_op", "type": "string"}
+  ]
+}`
+	subjects := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/subjects/test-value/versions/latest" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		_ = json.NewEncoder(w).Encode(lookupResponse{SchemaID: 3, Schema: schema})
+	}))
+	t.Cleanup(subjects.Close)
+	out.Reset()
+	code = runInspectSchema([]string{"--schema-registry-url", subjects.URL, "--subject", "test-value"}, &out)
+	require.Equal(t, exitCodeDecodeError, code)
+	result = inspectResult{}
+	require.NoError(t, json.Unmarshal(out.Bytes(), &result))
+	require.Equal(t, inspectResult{SchemaID: 3, Table: "test.u", Unsupported: 3, Fields: []schemaField{
+		{Name: "id", TiDBType: "BIGINT", MySQLType: "bigint", MySQLTypeCode: 8},
+		{Name: "data", TiDBType: "BLOB", MySQLType: "longblob", MySQLTypeCode: 251},
+		{Name: "g", TiDBType: "GEOMETRY", Unsupported: "unknown TiDB type GEOMETRY"},
+		{Name: "e", TiDBType: "ENUM", MySQLType: "enum", MySQLTypeCode: 247,
+			Unsupported: "allowed values not found in the connect.parameters"},
+		{Name: "raw", Unsupported: "tidb_type not found in the connect.parameters"},
+	}}, result)
+
+	out.Reset()
+	code = runInspectSchema([]string{"--schema-registry-url", subjects.URL, "--subject", "other-value"}, &out)
+	require.Equal(t, exitCodeInfraError, code)
+	require.Empty(t, out.String())
+
+	schemaFile := filepath.Join(t.TempDir(), "schema.avsc")
+	require.NoError(t, os.WriteFile(schemaFile, []byte(testValueSchema), 0o644))
+	out.Reset()
+	code = runInspectSchema([]string{"--schema-file", schemaFile}, &out)
+	require.Equal(t, exitCodeClean, code)
+
+	cfg := &inspectSchemaConfig{schemaID: 1, schemaFile: schemaFile}
+	require.ErrorContains(t, cfg.validate(), "exactly one of schema ID, subject and schema file should be set")
+}
@@ -0,0 +1,208 @@
+// Copyright 2023 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"math/big"
+	"strconv"
+	"strings"
+)
+
+// keyCondition matches a column of the row against the value, by the mysql type of the column.
+type keyCondition struct {
+	// column is in lower case, since it's case-insensitive.
+	column string
+	value  string
+	// raw is the decoded value of the hex condition, nil if the value is not hex.
+	raw []byte
+}
+
+// keyFilter verifies only the events whose columns match all conditions, a nil filter matches all events.
+type keyFilter struct {
+	conditions []keyCondition
+}
+
+// newKeyFilter parses the `col=value` conditions, the value of the hex ones is the hex encoded bytes,
+// it returns nil if no condition is set.
+func newKeyFilter(conditions, hexConditions []string) (*keyFilter, error) {
+	if len(conditions) == 0 && len(hexConditions) == 0 {
+		return nil, nil
+	}
+	f := &keyFilter{}
+	for _, s := range conditions {
+		column, value, err := parseKeyCondition(s)
+		if err != nil {
+			return nil, err
+		}
+		f.conditions = append(f.conditions, keyCondition{column: column, value: value})
+	}
+	for _, s := range hexConditions {
+		column, value, err := parseKeyCondition(s)
+		if err != nil {
+			return nil, err
+		}
+		raw, err := hex.DecodeString(strings.TrimPrefix(strings.ToLower(value), "0x"))
+		if err != nil {
+			return nil, fmt.Errorf("invalid hex key filter %q: %v", s, err)
+		}
+		f.conditions = append(f.conditions, keyCondition{column: column, value: value, raw: raw})
+	}
+	return f, nil
+}
+
+func parseKeyCondition(s string) (string, string, error) {
+	column, value, ok := strings.Cut(s, "=")
+	column = strings.ToLower(strings.TrimSpace(column))
+	if !ok || column == "" {
+		return "", "", fmt.Errorf("invalid key filter %q, should be `col=value`", s)
+	}
+	return column, value, nil
+}
+
+// match returns true if the columns of the row match all conditions, the row is the avro native value of the schema.
+// The second return value is false if any column of the conditions is not carried by the row,
+// such as the key only carries the handle columns.
+func (f *keyFilter) match(row, schema map[string]interface{}) (bool, bool) {
+	fields := make(map[string]map[string]interface{})
+	items, _ := schema["fields"].([]interface{})
+	for _, item := range items {
+		if field, ok := item.(map[string]interface{}); ok {
+			name, _ := field["name"].(string)
+			fields[strings.ToLower(name)] = field
+		}
+	}
+	matched := true
+	for _, c := range f.conditions {
+		field, ok := fields[c.column]
+		if !ok {
+			return false, false
+		}
+		name, _ := field["name"].(string)
+		if !c.matches(row[name], avroTiDBType(field)) {
+			matched = false
+		}
+	}
+	return matched, true
+}
+
+// matches compares the avro native value of the column in the type of the column,
+// the numeric columns are compared by the number, and the others by the string or the bytes.
+func (c *keyCondition) matches(value interface{}, tidbType string) bool {
+	// for nullable columns, the value is encoded as a map with one pair.
+	if union, ok := value.(map[string]interface{}); ok {
+		for _, v := range union {
+			value = v
+		}
+	}
+	if value == nil {
+		return false
+	}
+	if c.raw != nil {
+		switch v := value.(type) {
+		case []byte:
+			return bytes.Equal(v, c.raw)
+		case string:
+			return v == string(c.raw)
+		}
+		return false
+	}
+
+	switch tidbType {
+	case "INT", "INT UNSIGNED", "BIGINT", "YEAR":
+		expected, err := strconv.ParseInt(c.value, 10, 64)
+		if err != nil {
+			return false
+		}
+		switch v := value.(type) {
+		case int32:
+			return int64(v) == expected
+		case int64:
+			return v == expected
+		}
+	case "BIGINT UNSIGNED":
+		// the unsigned bigint is encoded as the long of the same bits.
+		expected, err := strconv.ParseUint(c.value, 10, 64)
+		if v, ok := value.(int64); ok && err == nil {
+			return uint64(v) == expected
+		}
+	case "BIT":
+		expected, err := strconv.ParseUint(c.value, 0, 64)
+		if v, ok := value.([]byte); ok && err == nil && len(v) <= 8 {
+			return binary.BigEndian.Uint64(append(make([]byte, 8-len(v)), v...)) == expected
+		}
+	case "FLOAT":
+		expected, err := strconv.ParseFloat(c.value, 32)
+		if v, ok := value.(float32); ok && err == nil {
+			return v == float32(expected)
+		}
+	case "DOUBLE":
+		expected, err := strconv.ParseFloat(c.value, 64)
+		if v, ok := value.(float64); ok && err == nil {
+			return v == expected
+		}
+	case "DECIMAL":
+		expected, ok := new(big.Rat).SetString(c.value)
+		if !ok {
+			return false
+		}
+		switch v := value.(type) {
+		case *big.Rat:
+			return v.Cmp(expected) == 0
+		case string:
+			actual, ok := new(big.Rat).SetString(v)
+			return ok && actual.Cmp(expected) == 0
+		}
+	default:
+		switch v := value.(type) {
+		case string:
+			return v == c.value
+		case []byte:
+			return string(v) == c.value
+		}
+	}
+	return false
+}
+
+// avroTiDBType returns the TiDB type of the field carried by the `connect.parameters`, empty if not found.
+func avroTiDBType(field map[string]interface{}) string {
+	tidbType, _ := avroParameters(field)["tidb_type"].(string)
+	return tidbType
+}
+
+// avroParameters returns the `connect.parameters` of the field, nil if not found.
+func avroParameters(field map[string]interface{}) map[string]interface{} {
+	holder, _ := avroFieldType(field)["connect.parameters"].(map[string]interface{})
+	return holder
+}
+
+// avroFieldType returns the type of the field, or the non-null type of the union if the column is nullable,
+// nil if the type is the primitive name only.
+func avroFieldType(field map[string]interface{}) map[string]interface{} {
+	switch ty := field["type"].(type) {
+	// if the column is nullable, type info is store in the slice
+	case []interface{}:
+		for _, item := range ty {
+			if m, ok := item.(map[string]interface{}); ok {
+				return m
+			}
+		}
+	case map[string]interface{}:
+		return ty
+	}
+	return nil
+}
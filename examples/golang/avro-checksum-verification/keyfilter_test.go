@@ -0,0 +1,169 @@
+// Copyright 2023 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"math/big"
+	"testing"
+
+	"github.com/segmentio/kafka-go"
+	"github.com/stretchr/testify/require"
+)
+
+// testKeySchema is the key schema of the table `test`.`t`, which carries the handle columns.
+const testKeySchema = `{
+  "type": "record",
+  "name": "t",
+  "namespace": "default.test",
+  "fields": [
+    {"name": "id", "type": {"type": "long", "connect.parameters": {"tidb_type": "BIGINT"}}}
+  ]
+}`
+
+const testKeySchemaID = 2
+
+func TestKeyFilter(t *testing.T) {
+	t.Parallel()
+
+	f, err := newKeyFilter(nil, nil)
+	require.NoError(t, err)
+	require.Nil(t, f)
+	_, err = newKeyFilter([]string{"id"}, nil)
+	require.ErrorContains(t, err, "should be `col=value`")
+	_, err = newKeyFilter(nil, []string{"k=xyz"})
+	require.ErrorContains(t, err, "invalid hex key filter")
+
+	cases := []struct {
+		tidbType string
+		value    interface{}
+		filter   string
+		matched  bool
+	}{
+		{"BIGINT", int64(10), "10", true},
+		{"BIGINT", int64(10), "010", true},
+		{"BIGINT", int64(10), "1", false},
+		{"BIGINT", int64(10), "abc", false},
+		{"INT", int32(-3), "-3", true},
+		{"BIGINT UNSIGNED", int64(-1), "18446744073709551615", true},
+		{"DOUBLE", 1.5, "1.50", true},
+		{"FLOAT", float32(0.1), "0.1", true},
+		{"DECIMAL", "12.30", "12.3", true},
+		{"DECIMAL", big.NewRat(123, 10), "12.3", true},
+		{"BIT", []byte{1, 0}, "256", true},
+		{"TEXT", "010", "10", false},
+		{"TEXT", "010", "010", true},
+		{"TEXT", map[string]interface{}{"string": "a"}, "a", true},
+		{"TEXT", nil, "", false},
+		{"DATETIME", "2023-12-01 10:00:00", "2023-12-01 10:00:00", true},
+	}
+	for _, c := range cases {
+		condition := keyCondition{value: c.filter}
+		require.Equal(t, c.matched, condition.matches(c.value, c.tidbType), "%s %v %s", c.tidbType, c.value, c.filter)
+	}
+
+	f, err = newKeyFilter(nil, []string{"k=0x0A1b"})
+	require.NoError(t, err)
+	require.True(t, f.conditions[0].matches([]byte{0x0a, 0x1b}, "BLOB"))
+	require.False(t, f.conditions[0].matches([]byte{0x0a}, "BLOB"))
+
+	// all conditions must match, the column name is case-insensitive.
+	schema := map[string]interface{}{"fields": []interface{}{
+		map[string]interface{}{"name": "ID", "type": map[string]interface{}{
+			"type": "long", "connect.parameters": map[string]interface{}{"tidb_type": "BIGINT"},
+		}},
+		map[string]interface{}{"name": "name", "type": []interface{}{"null", map[string]interface{}{
+			"type": "string", "connect.parameters": map[string]interface{}{"tidb_type": "TEXT"},
+		}}},
+	}}
+	row := map[string]interface{}{"ID": int64(1), "name": map[string]interface{}{"string": "a"}}
+	f, err = newKeyFilter([]string{"id=1", "name=a"}, nil)
+	require.NoError(t, err)
+	matched, checked := f.match(row, schema)
+	require.True(t, matched)
+	require.True(t, checked)
+	f, err = newKeyFilter([]string{"id=1", "name=b"}, nil)
+	require.NoError(t, err)
+	matched, checked = f.match(row, schema)
+	require.False(t, matched)
+	require.True(t, checked)
+	f, err = newKeyFilter([]string{"id=1", "k=b"}, nil)
+	require.NoError(t, err)
+	_, checked = f.match(row, schema)
+	require.False(t, checked)
+}
+
+func TestAvroKeyFilter(t *testing.T) {
+	t.Parallel()
+
+	registry := newTestRegistry(t, map[int]string{testSchemaID: testValueSchema, testKeySchemaID: testKeySchema})
+	keyed := func(message kafka.Message, id int64) kafka.Message {
+		message.Key = encodeTestMessage(t, testKeySchemaID, testKeySchema, map[string]interface{}{"id": id})
+		return message
+	}
+	cfg := newDefaultConfig()
+	cfg.schemaRegistryURL = registry.URL
+	cfg.keyFilters = stringsFlag{"id=2"}
+	cfg.mismatchBudget = 1
+	require.NoError(t, cfg.validate())
+
+	reader := &fakeReader{messages: []kafka.Message{
+		// the mismatch of the unmatched key is not found.
+		keyed(newMismatchTestMessage(t, 0, 1, "a"), 1),
+		keyed(newMismatchTestMessage(t, 1, 2, "b"), 2),
+		// the key is not avro, matched against the value.
+		newVerifiedTestMessage(t, 2, 2, "c"),
+		newMismatchTestMessage(t, 3, 3, "d"),
+		// the delete events are matched against the key, and filtered without the avro key.
+		keyed(kafka.Message{Topic: "test", Offset: 4}, 1),
+		keyed(kafka.Message{Topic: "test", Offset: 5}, 2),
+		{Topic: "test", Offset: 6},
+	}}
+	v := newTestVerifier(cfg, reader)
+	err := v.run(context.Background())
+	require.Equal(t, exitCodeMismatch, v.finish(err))
+	require.Equal(t, counters{Messages: 7, Verified: 1, SkippedDelete: 1, Filtered: 4, Mismatches: 1}, v.counters)
+	require.Equal(t, []int64{0, 1, 2, 3, 4, 5, 6}, reader.committedOffsets())
+	// the key schema is fetched from the registry once.
+	require.Len(t, v.messageVerifier.(*avroVerifier).keySchemas, 1)
+
+	// the column not carried by the key is matched against the value.
+	cfg.keyFilters = stringsFlag{"id=2", "name=b"}
+	reader = &fakeReader{messages: []kafka.Message{
+		keyed(newVerifiedTestMessage(t, 0, 2, "a"), 2),
+		keyed(newVerifiedTestMessage(t, 1, 2, "b"), 2),
+	}}
+	v = newTestVerifier(cfg, reader)
+	err = v.run(context.Background())
+	require.Equal(t, exitCodeClean, v.finish(err))
+	require.Equal(t, counters{Messages: 2, Verified: 1, Filtered: 1}, v.counters)
+
+	// the key filter works together with the commit ts window.
+	cfg.keyFilters = stringsFlag{"id=2"}
+	cfg.endCommitTs = "400000000000000000"
+	reader = &fakeReader{messages: []kafka.Message{
+		keyed(newVerifiedTestMessage(t, 0, 2, "a"), 2),
+		keyed(newMismatchTestMessage(t, 1, 2, "b"), 2),
+	}}
+	v = newTestVerifier(cfg, reader)
+	err = v.run(context.Background())
+	require.Equal(t, exitCodeClean, v.finish(err))
+	require.Equal(t, counters{Messages: 2, Verified: 1, OutOfRange: 1}, v.counters)
+
+	cfg.sampleEveryN = 2
+	require.ErrorContains(t, cfg.validate(), "key filter and sampling cannot be set at the same time")
+	cfg.sampleEveryN = 0
+	cfg.protocol = protocolCanalJSON
+	require.ErrorContains(t, cfg.validate(), "only the avro protocol is supported by the key filter")
+}
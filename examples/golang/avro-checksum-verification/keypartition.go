@@ -0,0 +1,150 @@
+// Copyright 2023 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"container/list"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"hash/fnv"
+
+	"github.com/segmentio/kafka-go"
+)
+
+// keyPartitionNote states the accuracy of the check, so that the result is not over-trusted.
+const keyPartitionNote = "keys are tracked by the 64-bit hash, a collision of two keys may be reported as a violation falsely; " +
+	"the least recently seen keys are evicted once the capacity is reached, a violation of the evicted key is not found"
+
+// keyPartitionStateNote is the keyPartitionNote if the keys are tracked in the state store.
+const keyPartitionStateNote = "keys are tracked by the 64-bit hash in the state store, a collision of two keys may be reported " +
+	"as a violation falsely; the keys not seen within the state TTL are evicted, a violation of the evicted key is not found"
+
+// keyPartitionChecker checks that all events of a key are sent to the same partition, as the default key dispatcher does.
+// It keeps the partition each key is first seen in a LRU of the key hash, so the memory is bounded by the capacity,
+// or in the state store if it's set.
+type keyPartitionChecker struct {
+	capacity int
+	lru      *list.List
+	entries  map[uint64]*list.Element
+	// evicted is the number of keys evicted from the LRU.
+	evicted uint64
+	state   *trackerState
+	// added is the number of keys added to the state store in this run.
+	added int
+}
+
+type keyPartitionEntry struct {
+	hash      uint64
+	partition int
+	offset    int64
+}
+
+func newKeyPartitionChecker(capacity int) *keyPartitionChecker {
+	return &keyPartitionChecker{capacity: capacity, lru: list.New(), entries: make(map[uint64]*list.Element)}
+}
+
+// keyHash returns the hash of the avro message key, which carries the handle key columns,
+// the key schema ID identifies the table, since the record name and namespace are the table.
+// It returns false if the key is not avro.
+func keyHash(key []byte) (uint64, bool) {
+	if len(key) < 5 || key[0] != magicByte {
+		return 0, false
+	}
+	h := fnv.New64a()
+	_, _ = h.Write(key)
+	return h.Sum64(), true
+}
+
+// observe records the partition of the message key, it returns the errOrderingViolation
+// if the key is seen in another partition before.
+func (c *keyPartitionChecker) observe(message kafka.Message, result messageResult) error {
+	// the non-row messages, such as the watermark, are broadcast to all partitions.
+	if result.outcome == outcomeSkippedNonRow {
+		return nil
+	}
+	hash, ok := keyHash(message.Key)
+	if !ok {
+		return nil
+	}
+	if c.state != nil {
+		return c.observeState(hash, message)
+	}
+	if element, ok := c.entries[hash]; ok {
+		c.lru.MoveToFront(element)
+		return checkKeyPartition(element.Value.(*keyPartitionEntry), message)
+	}
+	c.entries[hash] = c.lru.PushFront(&keyPartitionEntry{hash: hash, partition: message.Partition, offset: message.Offset})
+	for c.lru.Len() > c.capacity {
+		evicted := c.lru.Remove(c.lru.Back()).(*keyPartitionEntry)
+		delete(c.entries, evicted.hash)
+		c.evicted++
+	}
+	return nil
+}
+
+func checkKeyPartition(entry *keyPartitionEntry, message kafka.Message) error {
+	if entry.partition != message.Partition {
+		return fmt.Errorf("%w: key 0x%s is seen in partition %d at offset %d, "+
+			"but sent to partition %d at offset %d", errOrderingViolation, hex.EncodeToString(message.Key),
+			entry.partition, entry.offset, message.Partition, message.Offset)
+	}
+	return nil
+}
+
+// observeState is the observe of the keys tracked in the state store.
+func (c *keyPartitionChecker) observeState(hash uint64, message kafka.Message) error {
+	if err := c.state.compact(); err != nil {
+		return newInfraError(err)
+	}
+	key := binary.BigEndian.AppendUint64(nil, hash)
+	value, ok, err := c.state.get(key)
+	if err != nil {
+		return newInfraError(err)
+	}
+	if ok && len(value) == 16 {
+		entry := &keyPartitionEntry{
+			hash: hash, partition: int(binary.BigEndian.Uint64(value)), offset: int64(binary.BigEndian.Uint64(value[8:])),
+		}
+		if err := checkKeyPartition(entry, message); err != nil {
+			return err
+		}
+		if err := c.state.touch(key, value); err != nil {
+			return newInfraError(err)
+		}
+		return nil
+	}
+	value = binary.BigEndian.AppendUint64(nil, uint64(message.Partition))
+	value = binary.BigEndian.AppendUint64(value, uint64(message.Offset))
+	if err := c.state.put(key, value); err != nil {
+		return newInfraError(err)
+	}
+	c.added++
+	return nil
+}
+
+// keyPartitionReport is the summary of the key partition check.
+type keyPartitionReport struct {
+	TrackedKeys int    `json:"trackedKeys"`
+	Capacity    int    `json:"capacity"`
+	EvictedKeys uint64 `json:"evictedKeys"`
+	Note        string `json:"note"`
+}
+
+func (c *keyPartitionChecker) snapshot() *keyPartitionReport {
+	if c.state != nil {
+		return &keyPartitionReport{TrackedKeys: c.added, EvictedKeys: c.state.expired, Note: keyPartitionStateNote}
+	}
+	return &keyPartitionReport{TrackedKeys: c.lru.Len(), Capacity: c.capacity, EvictedKeys: c.evicted, Note: keyPartitionNote}
+}
@@ -0,0 +1,85 @@
+// Copyright 2023 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/segmentio/kafka-go"
+	"github.com/stretchr/testify/require"
+)
+
+func TestKeyPartitionChecker(t *testing.T) {
+	t.Parallel()
+
+	key := func(id int64) []byte {
+		return encodeTestMessage(t, testKeySchemaID, testKeySchema, map[string]interface{}{"id": id})
+	}
+	c := newKeyPartitionChecker(2)
+	require.NoError(t, c.observe(kafka.Message{Partition: 0, Offset: 0, Key: key(1)}, messageResult{}))
+	require.NoError(t, c.observe(kafka.Message{Partition: 0, Offset: 1, Key: key(1)}, messageResult{}))
+	require.NoError(t, c.observe(kafka.Message{Partition: 1, Offset: 0, Key: key(2)}, messageResult{}))
+	// the message without the avro key and the non-row message are not checked.
+	require.NoError(t, c.observe(kafka.Message{Partition: 1, Offset: 1}, messageResult{}))
+	require.NoError(t, c.observe(kafka.Message{Partition: 1, Offset: 2, Key: key(1)},
+		messageResult{outcome: outcomeSkippedNonRow}))
+
+	err := c.observe(kafka.Message{Partition: 1, Offset: 3, Key: key(1)}, messageResult{})
+	require.ErrorIs(t, err, errOrderingViolation)
+	require.ErrorContains(t, err, "is seen in partition 0 at offset 0, but sent to partition 1 at offset 3")
+	require.Equal(t, exitCodeOrderingError, exitCodeOf(err))
+
+	// the least recently seen key 2 is evicted, its violation is not found.
+	require.NoError(t, c.observe(kafka.Message{Partition: 0, Offset: 2, Key: key(3)}, messageResult{}))
+	require.NoError(t, c.observe(kafka.Message{Partition: 0, Offset: 3, Key: key(2)}, messageResult{}))
+	require.Equal(t, &keyPartitionReport{TrackedKeys: 2, Capacity: 2, EvictedKeys: 2, Note: keyPartitionNote}, c.snapshot())
+}
+
+func TestKeyPartitionReported(t *testing.T) {
+	t.Parallel()
+
+	registry := newTestRegistry(t, map[int]string{testSchemaID: testValueSchema, testKeySchemaID: testKeySchema})
+	cfg := newDefaultConfig()
+	cfg.schemaRegistryURL = registry.URL
+	cfg.checkKeyPartition = true
+	require.NoError(t, cfg.validate())
+
+	keyed := func(message kafka.Message, partition int, id int64) kafka.Message {
+		message.Partition = partition
+		message.Key = encodeTestMessage(t, testKeySchemaID, testKeySchema, map[string]interface{}{"id": id})
+		return message
+	}
+	reader := &fakeReader{messages: []kafka.Message{
+		keyed(newVerifiedTestMessage(t, 0, 1, "a"), 0, 1),
+		keyed(newVerifiedTestMessage(t, 0, 2, "b"), 1, 2),
+		keyed(newVerifiedTestMessage(t, 1, 1, "c"), 1, 1),
+	}}
+	v := newTestVerifier(cfg, reader)
+	v.keyPartitions = newKeyPartitionChecker(cfg.keyPartitionCapacity)
+
+	err := v.run(context.Background())
+	require.Equal(t, exitCodeOrderingError, v.finish(err))
+	// the violation does not stop the verification, the row itself is verified.
+	require.Equal(t, counters{Messages: 3, Verified: 3, OrderingErrors: 1}, v.counters)
+	require.Len(t, v.report.Failures, 1)
+	require.Equal(t, failureKindOrdering, v.report.Failures[0].Kind)
+	require.Equal(t, 1, v.report.Failures[0].Partition)
+	require.Equal(t, 2, v.report.KeyPartition.TrackedKeys)
+
+	cfg.keyPartitionCapacity = 0
+	require.ErrorContains(t, cfg.validate(), "key partition capacity must be positive")
+	cfg.protocol = protocolCanalJSON
+	require.ErrorContains(t, cfg.validate(), "only the avro protocol is supported by the key partition check")
+}
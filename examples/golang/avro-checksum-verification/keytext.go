@@ -0,0 +1,86 @@
+// Copyright 2023 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/hex"
+	"fmt"
+	"math/big"
+	"strings"
+
+	"avro-checksum-sample/checksum"
+)
+
+// maxKeyHexPrefix is the number of the leading bytes of the key rendered as the hex prefix.
+const maxKeyHexPrefix = 32
+
+// keyRenderingVerifier is implemented by the message verifier which renders the key in a human-readable form,
+// the key of the other ones is rendered as the hex prefix.
+type keyRenderingVerifier interface {
+	keyText(key []byte) string
+}
+
+// keyText renders the handle columns carried by the avro key as the `col=value` pairs in the order of the key schema,
+// such as `id=1, name=a`, the value is converted the same as the checksum calculation, the binary one is hex encoded.
+// The key which is not avro, such as the key encoding is disabled, or cannot be decoded, falls back to the hex prefix.
+func (a *avroVerifier) keyText(key []byte) string {
+	if len(key) < 5 || key[0] != magicByte {
+		return hexKeyPrefix(key)
+	}
+	keyMap, keySchema, err := a.decodeKey(key)
+	if err != nil {
+		return hexKeyPrefix(key)
+	}
+	metas, values, err := checksumColumns(keyMap, keySchema)
+	if err != nil {
+		return hexKeyPrefix(key)
+	}
+	return formatKeyColumns(metas, values)
+}
+
+// formatKeyColumns renders the columns as the `col=value` pairs, the nil value is `NULL`.
+func formatKeyColumns(metas []checksum.FieldMeta, values []interface{}) string {
+	var b strings.Builder
+	for i, meta := range metas {
+		if i > 0 {
+			b.WriteString(", ")
+		}
+		b.WriteString(meta.Name)
+		b.WriteByte('=')
+		switch v := values[i].(type) {
+		case nil:
+			b.WriteString("NULL")
+		case []byte:
+			b.WriteString("0x")
+			b.WriteString(hex.EncodeToString(v))
+		case *big.Rat:
+			b.WriteString(v.FloatString(meta.Scale))
+		default:
+			fmt.Fprint(&b, v)
+		}
+	}
+	return b.String()
+}
+
+// hexKeyPrefix renders the leading bytes of the key in hex, such as `0x0a0b`, followed by `...` if truncated,
+// empty if no key.
+func hexKeyPrefix(key []byte) string {
+	switch {
+	case len(key) == 0:
+		return ""
+	case len(key) <= maxKeyHexPrefix:
+		return "0x" + hex.EncodeToString(key)
+	}
+	return "0x" + hex.EncodeToString(key[:maxKeyHexPrefix]) + "..."
+}
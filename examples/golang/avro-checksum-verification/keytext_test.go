@@ -0,0 +1,86 @@
+// Copyright 2023 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	"github.com/linkedin/goavro/v2"
+	"github.com/segmentio/kafka-go"
+	"github.com/stretchr/testify/require"
+)
+
+// testCompositeKeySchema is the key schema of a table whose handle is (id BIGINT, code VARBINARY, name VARCHAR NULL).
+const testCompositeKeySchema = `{
+  "type": "record",
+  "name": "k",
+  "namespace": "default.test",
+  "fields": [
+    {"name": "id", "type": {"type": "long", "connect.parameters": {"tidb_type": "BIGINT"}}},
+    {"name": "code", "type": {"type": "bytes", "connect.parameters": {"tidb_type": "BLOB"}}},
+    {"name": "name", "type": ["null", {"type": "string", "connect.parameters": {"tidb_type": "TEXT"}}], "default": null}
+  ]
+}`
+
+const testCompositeKeySchemaID = 3
+
+func TestKeyText(t *testing.T) {
+	t.Parallel()
+
+	registry := newTestRegistry(t, map[int]string{testCompositeKeySchemaID: testCompositeKeySchema})
+	cfg := newDefaultConfig()
+	cfg.schemaRegistryURL = registry.URL
+	v, err := newMessageVerifier(cfg)
+	require.NoError(t, err)
+	a := v.(*avroVerifier)
+
+	key := encodeTestMessage(t, testCompositeKeySchemaID, testCompositeKeySchema, map[string]interface{}{
+		"id": int64(1), "code": []byte{0x0a, 0x0b}, "name": goavro.Union("string", "a"),
+	})
+	require.Equal(t, "id=1, code=0x0a0b, name=a", a.keyText(key))
+	key = encodeTestMessage(t, testCompositeKeySchemaID, testCompositeKeySchema, map[string]interface{}{
+		"id": int64(-2), "code": []byte{}, "name": nil,
+	})
+	require.Equal(t, "id=-2, code=0x, name=NULL", a.keyText(key))
+
+	// the key which is not avro falls back to the hex prefix.
+	require.Equal(t, "", a.keyText(nil))
+	require.Equal(t, "0x6b6579", a.keyText([]byte("key")))
+	long := bytes.Repeat([]byte{0xff}, maxKeyHexPrefix+1)
+	require.Equal(t, "0x"+string(bytes.Repeat([]byte("ff"), maxKeyHexPrefix))+"...", a.keyText(long))
+	// the schema is not found.
+	require.Equal(t, "0x000000000901", a.keyText([]byte{magicByte, 0, 0, 0, 9, 1}))
+}
+
+func TestFailureKey(t *testing.T) {
+	t.Parallel()
+
+	registry := newTestRegistry(t, map[int]string{testSchemaID: testValueSchema, testKeySchemaID: testKeySchema})
+	cfg := newDefaultConfig()
+	cfg.schemaRegistryURL = registry.URL
+	cfg.mismatchBudget = unlimitedMismatchBudget
+	withKey := newMismatchTestMessage(t, 0, 1, "a")
+	withKey.Key = encodeTestMessage(t, testKeySchemaID, testKeySchema, map[string]interface{}{"id": int64(1)})
+	plainKey := newMismatchTestMessage(t, 1, 2, "b")
+	plainKey.Key = []byte("2")
+	reader := &fakeReader{messages: []kafka.Message{withKey, plainKey}}
+	v := newTestVerifier(cfg, reader)
+	err := v.run(context.Background())
+	require.Equal(t, exitCodeMismatch, v.finish(err))
+	require.Len(t, v.report.Failures, 2)
+	require.Equal(t, "id=1", v.report.Failures[0].Key)
+	require.Equal(t, "0x32", v.report.Failures[1].Key)
+}
@@ -0,0 +1,176 @@
+// Copyright 2023 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// latencyBuckets are the upper bounds of the latency histogram in milliseconds, the last bucket is unbounded.
+var latencyBuckets = []int64{
+	5, 10, 25, 50, 100, 250, 500, 1000, 2500, 5000, 10000, 30000, 60000, 300000, 900000, 3600000,
+}
+
+// latencyHistogram is the histogram of the end-to-end latency, the percentiles are the upper bound of the bucket.
+type latencyHistogram struct {
+	// counts are the number of samples of each bucket, the last one is beyond all bounds.
+	counts []uint64
+	count  uint64
+	// clamped is the number of negative samples taken as 0, since the clocks are skewed.
+	clamped uint64
+	maxMs   int64
+	// sum is the sum of the samples, exported along with the histogram in the metrics.
+	sum time.Duration
+}
+
+func newLatencyHistogram() *latencyHistogram {
+	return &latencyHistogram{counts: make([]uint64, len(latencyBuckets)+1)}
+}
+
+func (h *latencyHistogram) observe(latency time.Duration) {
+	if latency < 0 {
+		h.clamped++
+		latency = 0
+	}
+	ms := latency.Milliseconds()
+	i := 0
+	for i < len(latencyBuckets) && ms > latencyBuckets[i] {
+		i++
+	}
+	h.counts[i]++
+	h.count++
+	h.sum += latency
+	if ms > h.maxMs {
+		h.maxMs = ms
+	}
+}
+
+// quantile returns the upper bound of the bucket the quantile falls in, the maximum if it's beyond all bounds.
+func (h *latencyHistogram) quantile(q float64) int64 {
+	if h.count == 0 {
+		return 0
+	}
+	rank := uint64(math.Ceil(q * float64(h.count)))
+	var seen uint64
+	for i, bound := range latencyBuckets {
+		seen += h.counts[i]
+		if seen >= rank {
+			return bound
+		}
+	}
+	return h.maxMs
+}
+
+// latencySummary is the percentiles of the latency in milliseconds.
+type latencySummary struct {
+	Count uint64 `json:"count"`
+	// Clamped is the number of events committed later than consumed, which are taken as 0.
+	Clamped uint64 `json:"clamped,omitempty"`
+	P50Ms   int64  `json:"p50Ms"`
+	P99Ms   int64  `json:"p99Ms"`
+	MaxMs   int64  `json:"maxMs"`
+}
+
+func (h *latencyHistogram) summary() *latencySummary {
+	return &latencySummary{
+		Count: h.count, Clamped: h.clamped, P50Ms: h.quantile(0.5), P99Ms: h.quantile(0.99), MaxMs: h.maxMs,
+	}
+}
+
+// latencyBucket is the cumulative number of samples not larger than the bound in milliseconds, `+Inf` for all.
+type latencyBucket struct {
+	Le    string `json:"le"`
+	Count uint64 `json:"count"`
+}
+
+// latencyReport is the end-to-end latency of the events, from the commit in the upstream to the consumption.
+type latencyReport struct {
+	*latencySummary
+	Buckets []latencyBucket `json:"buckets"`
+	// Tables are the percentiles of each table, keyed by `schema.table`.
+	Tables map[string]*latencySummary `json:"tables,omitempty"`
+}
+
+// latencyTracker records the latency of the events carrying the commit ts, overall and of each table.
+type latencyTracker struct {
+	total  *latencyHistogram
+	tables map[string]*latencyHistogram
+}
+
+func newLatencyTracker() *latencyTracker {
+	return &latencyTracker{total: newLatencyHistogram(), tables: make(map[string]*latencyHistogram)}
+}
+
+// observe records the latency of the event consumed at now,
+// the event without the commit ts or not carrying any row is not counted.
+func (t *latencyTracker) observe(result messageResult, now time.Time) {
+	if result.commitTs == 0 || result.outcome == outcomeSkippedNonRow || result.outcome == outcomeFiltered {
+		return
+	}
+	latency := now.Sub(physicalTime(result.commitTs))
+	t.total.observe(latency)
+	if result.table == "" {
+		return
+	}
+	h, ok := t.tables[result.table]
+	if !ok {
+		h = newLatencyHistogram()
+		t.tables[result.table] = h
+	}
+	h.observe(latency)
+}
+
+// snapshot returns the report of the latency, nil if no event is counted.
+func (t *latencyTracker) snapshot() *latencyReport {
+	if t.total.count == 0 {
+		return nil
+	}
+	r := &latencyReport{latencySummary: t.total.summary(), Buckets: make([]latencyBucket, 0, len(t.total.counts))}
+	var cumulative uint64
+	for i, n := range t.total.counts {
+		cumulative += n
+		le := "+Inf"
+		if i < len(latencyBuckets) {
+			le = strconv.FormatInt(latencyBuckets[i], 10)
+		}
+		r.Buckets = append(r.Buckets, latencyBucket{Le: le, Count: cumulative})
+	}
+	if len(t.tables) > 0 {
+		r.Tables = make(map[string]*latencySummary, len(t.tables))
+		for table, h := range t.tables {
+			r.Tables[table] = h.summary()
+		}
+	}
+	return r
+}
+
+// fields returns the percentiles of the latency overall and of each table, to be logged.
+func (t *latencyTracker) fields() []zap.Field {
+	if t.total.count == 0 {
+		return nil
+	}
+	tables := make(map[string]string, len(t.tables))
+	for table, h := range t.tables {
+		tables[table] = fmt.Sprintf("p50=%dms p99=%dms", h.quantile(0.5), h.quantile(0.99))
+	}
+	return []zap.Field{
+		zap.Int64("latencyP50Ms", t.total.quantile(0.5)), zap.Int64("latencyP99Ms", t.total.quantile(0.99)),
+		zap.Uint64("latencyClamped", t.total.clamped), zap.Any("tableLatency", tables),
+	}
+}
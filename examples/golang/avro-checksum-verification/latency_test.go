@@ -0,0 +1,93 @@
+// Copyright 2023 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+	"github.com/stretchr/testify/require"
+)
+
+// commitTsAt returns the TSO whose physical time is t.
+func commitTsAt(t time.Time) uint64 {
+	return uint64(t.UnixMilli()) << 18
+}
+
+func TestLatencyHistogram(t *testing.T) {
+	t.Parallel()
+
+	h := newLatencyHistogram()
+	require.Zero(t, h.quantile(0.5))
+	for i := 0; i < 98; i++ {
+		h.observe(7 * time.Millisecond)
+	}
+	h.observe(2 * time.Second)
+	h.observe(2 * time.Hour)
+	require.Equal(t, uint64(100), h.count)
+	require.Equal(t, int64(10), h.quantile(0.5))
+	require.Equal(t, int64(2500), h.quantile(0.99))
+	// beyond all bounds, the maximum is the percentile.
+	require.Equal(t, (2 * time.Hour).Milliseconds(), h.quantile(1))
+
+	h.observe(-time.Second)
+	require.Equal(t, uint64(1), h.clamped)
+	require.Equal(t, uint64(1), h.counts[0])
+}
+
+func TestLatencyTracker(t *testing.T) {
+	t.Parallel()
+
+	now := time.Now()
+	ago := func(d time.Duration) uint64 { return commitTsAt(now.Add(-d)) }
+	tracker := newLatencyTracker()
+	require.Nil(t, tracker.snapshot())
+	tracker.observe(messageResult{outcome: outcomeVerified, table: "test.t1", commitTs: ago(80 * time.Millisecond)}, now)
+	tracker.observe(messageResult{outcome: outcomeDeferred, table: "test.t2", commitTs: ago(3 * time.Second)}, now)
+	// the clock of the upstream is ahead.
+	tracker.observe(messageResult{outcome: outcomeVerified, table: "test.t2", commitTs: ago(-time.Second)}, now)
+	// the events without the commit ts or any row are excluded.
+	tracker.observe(messageResult{outcome: outcomeVerified, table: "test.t1"}, now)
+	tracker.observe(messageResult{outcome: outcomeSkippedNonRow, commitTs: ago(time.Hour)}, now)
+
+	r := tracker.snapshot()
+	require.Equal(t, uint64(3), r.Count)
+	require.Equal(t, uint64(1), r.Clamped)
+	require.Equal(t, int64(100), r.P50Ms)
+	require.Equal(t, int64(5000), r.P99Ms)
+	require.Equal(t, latencyBucket{Le: "5", Count: 1}, r.Buckets[0])
+	require.Equal(t, latencyBucket{Le: "+Inf", Count: 3}, r.Buckets[len(r.Buckets)-1])
+	require.Len(t, r.Tables, 2)
+	require.Equal(t, uint64(1), r.Tables["test.t1"].Count)
+	require.Equal(t, int64(100), r.Tables["test.t1"].P99Ms)
+	require.Equal(t, uint64(1), r.Tables["test.t2"].Clamped)
+}
+
+func TestVerifierLatency(t *testing.T) {
+	t.Parallel()
+
+	registry := newTestRegistry(t, map[int]string{testSchemaID: testValueSchema})
+	cfg := newDefaultConfig()
+	cfg.schemaRegistryURL = registry.URL
+	v := newTestVerifier(cfg, &fakeReader{messages: []kafka.Message{
+		newVerifiedTestMessage(t, 0, 1, "a"), newVerifiedTestMessage(t, 1, 2, "b"),
+	}})
+	require.NoError(t, v.run(context.Background()))
+	require.Equal(t, exitCodeClean, v.finish(nil))
+	// the commit ts of the test messages are far in the past.
+	require.Equal(t, uint64(2), v.report.Latency.Count)
+	require.Equal(t, v.report.Latency.MaxMs, v.report.Latency.P99Ms)
+}
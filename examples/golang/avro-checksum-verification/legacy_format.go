@@ -0,0 +1,38 @@
+// Copyright 2023 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+// avroExtensionFields are the TiDB extension fields of the value schema,
+// `_tidb_op` and `_tidb_commit_ts` are sent along with the enable-tidb-extension, and the checksum if enabled.
+var avroExtensionFields = []string{"_tidb_op", "_tidb_commit_ts", "_tidb_row_level_checksum"}
+
+// avroLegacyFormat returns true if the value schema carries none of the TiDB extension fields,
+// such as of the older TiCDC avro format, or the changefeed without the enable-tidb-extension.
+// The format never carries the checksum.
+func avroLegacyFormat(valueSchema map[string]interface{}) bool {
+	fields, _ := valueSchema["fields"].([]interface{})
+	for _, item := range fields {
+		field, ok := item.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		name, _ := field["name"].(string)
+		for _, extension := range avroExtensionFields {
+			if name == extension {
+				return false
+			}
+		}
+	}
+	return true
+}
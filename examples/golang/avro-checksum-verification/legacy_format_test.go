@@ -0,0 +1,79 @@
+// Copyright 2023 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/linkedin/goavro/v2"
+	"github.com/pingcap/tidb/pkg/parser/mysql"
+	"github.com/segmentio/kafka-go"
+	"github.com/stretchr/testify/require"
+)
+
+// testLegacyValueSchema is the value schema of the table `test`.`t` without the TiDB extension fields,
+// such as of the older TiCDC avro format, neither the operation, the commit ts nor the checksum are sent.
+const testLegacyValueSchema = `{
+  "type": "record",
+  "name": "t",
+  "namespace": "default.test",
+  "fields": [
+    {"name": "id", "type": {"type": "long", "connect.parameters": {"tidb_type": "BIGINT"}}},
+    {"name": "name", "type": ["null", {"type": "string", "connect.parameters": {"tidb_type": "TEXT"}}], "default": null}
+  ]
+}`
+
+const testLegacySchemaID = 3
+
+func TestAvroLegacyFormat(t *testing.T) {
+	t.Parallel()
+
+	var legacy, current map[string]interface{}
+	require.NoError(t, json.Unmarshal([]byte(testLegacyValueSchema), &legacy))
+	require.NoError(t, json.Unmarshal([]byte(testValueSchema), &current))
+	require.True(t, avroLegacyFormat(legacy))
+	require.False(t, avroLegacyFormat(current))
+	// both formats are decoded to the same columns, only the schema ID is changed on upgrade.
+	require.Equal(t, &schemaDiff{}, diffAvroSchemas(legacy, current))
+
+	registry := newTestRegistry(t, map[int]string{testSchemaID: testValueSchema, testLegacySchemaID: testLegacyValueSchema})
+	cfg := newDefaultConfig()
+	cfg.schemaRegistryURL = registry.URL
+	v, err := newMessageVerifier(cfg)
+	require.NoError(t, err)
+	v.(*avroVerifier).collectRows = true
+
+	value := encodeTestMessage(t, testLegacySchemaID, testLegacyValueSchema, map[string]interface{}{
+		"id": int64(1), "name": goavro.Union("string", "a"),
+	})
+	result, err := v.verify(kafka.Message{Value: value})
+	require.NoError(t, err)
+	require.Equal(t, outcomeSkippedLegacyFormat, result.outcome)
+	require.Equal(t, "test.t", result.table)
+	require.Len(t, result.rows, 1)
+	row := result.rows[0]
+	require.Len(t, row.columns, 2)
+	require.Equal(t, mysql.TypeLonglong, row.columns[0].mysqlType)
+	require.Equal(t, mysql.TypeVarchar, row.columns[1].mysqlType)
+
+	// the current format is still verified after the upgrade.
+	result, err = v.verify(newVerifiedTestMessage(t, 1, 1, "a"))
+	require.NoError(t, err)
+	require.Equal(t, outcomeVerified, result.outcome)
+
+	var c counters
+	c.addOutcome(outcomeSkippedLegacyFormat)
+	require.Equal(t, uint64(1), c.SkippedLegacyFormat)
+}
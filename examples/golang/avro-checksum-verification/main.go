@@ -18,19 +18,21 @@ import (
 	"encoding/binary"
 	"encoding/json"
 	"errors"
-	"hash/crc32"
+	"flag"
+	"fmt"
 	"io"
-	"math"
 	"net/http"
+	"os"
+	"os/signal"
 	"strconv"
 	"strings"
-	"time"
+	"syscall"
 
+	"avro-checksum-sample/checksum"
 	"github.com/linkedin/goavro/v2"
 	"github.com/pingcap/log"
 	"github.com/pingcap/tidb/pkg/parser/mysql"
 	"github.com/pingcap/tidb/pkg/types"
-	"github.com/segmentio/kafka-go"
 	"go.uber.org/zap"
 )
 
@@ -40,82 +42,110 @@ const (
 	magicByte = uint8(0)
 )
 
-func main() {
-	var (
-		kafkaAddr         = "127.0.0.1:9092"
-		schemaRegistryURL = "http://127.0.0.1:8081"
+const (
+	commandConsume       = "consume"
+	commandDecode        = "decode"
+	commandInspectSchema = "inspect-schema"
+	commandAudit         = "audit"
+	commandCompare       = "compare"
+	commandServe         = "serve"
+	commandMulti         = "multi"
+)
 
-		topic           = "avro-checksum-test"
-		consumerGroupID = "avro-checksum-test"
-	)
+func main() {
+	os.Exit(runMain(os.Args[1:]))
+}
 
-	consumer := kafka.NewReader(kafka.ReaderConfig{
-		Brokers:  []string{kafkaAddr},
-		GroupID:  consumerGroupID,
-		Topic:    topic,
-		MaxBytes: 10e6, // 10MB
-	})
-	defer consumer.Close()
-
-	ctx := context.Background()
-	log.Info("start consuming ...", zap.String("kafka", kafkaAddr), zap.String("topic", topic), zap.String("groupID", consumerGroupID))
-	for {
-		message, err := consumer.FetchMessage(ctx)
-		if err != nil {
-			log.Error("read kafka message failed", zap.Error(err))
-			break
-		}
+// runMain runs the subcommand and returns the exit code, the subcommand is `consume` if omitted.
+func runMain(args []string) int {
+	command := commandConsume
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		command, args = args[0], args[1:]
+	}
+	switch command {
+	case commandConsume:
+		return runConsume(args)
+	case commandDecode:
+		return runDecode(args, os.Stdout)
+	case commandInspectSchema:
+		return runInspectSchema(args, os.Stdout)
+	case commandAudit:
+		return runAudit(args, os.Stdout)
+	case commandServe:
+		return runServe(args)
+	case commandCompare:
+		return runCompare(args)
+	case commandMulti:
+		return runMulti(args)
+	}
+	log.Fatal("unknown command, should be one of consume, serve, multi, decode, inspect-schema, audit or compare",
+		zap.String("command", command))
+	return 0
+}
 
-		value := message.Value
-		if len(value) == 0 {
-			log.Info("delete event does not have value, skip checksum verification", zap.String("topic", topic))
-			continue
+// runConsume runs the verifier consuming the messages continuously.
+func runConsume(args []string) int {
+	cfg := newDefaultConfig()
+	fs := flag.NewFlagSet(commandConsume, flag.ExitOnError)
+	cfg.bindFlags(fs)
+	_ = fs.Parse(args)
+	if err := cfg.validate(); err != nil {
+		log.Fatal("invalid configuration", zap.Error(err))
+	}
+	if cfg.preflight {
+		if code, ok := preflight(cfg); !ok {
+			return code
 		}
+	}
 
-		valueMap, valueSchema, err := getValueMapAndSchema(value, schemaRegistryURL)
-		if err != nil {
-			log.Panic("decode kafka value failed", zap.String("topic", topic), zap.ByteString("value", value), zap.Error(err))
-		}
+	ctx, cancel := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer cancel()
 
-		err = CalculateAndVerifyChecksum(valueMap, valueSchema)
-		if err != nil {
-			log.Panic("calculate checksum failed", zap.String("topic", topic), zap.ByteString("value", value), zap.Error(err))
-		}
+	v, err := newVerifier(ctx, cfg)
+	if err != nil {
+		log.Error("create verifier failed", zap.Error(err))
+		return exitCodeOf(err)
+	}
+	defer v.close()
 
-		if err := consumer.CommitMessages(ctx, message); err != nil {
-			log.Error("commit kafka message failed", zap.Error(err))
-			break
-		}
+	err = v.run(ctx)
+	if err != nil {
+		log.Error("verification stopped", zap.Error(err))
 	}
+	return v.finish(err)
 }
 
-func getValueMapAndSchema(data []byte, url string) (map[string]interface{}, map[string]interface{}, error) {
+// getValueMapAndSchema decodes the first record of the data, the bytes following it are returned as well,
+// which are not empty if the events are batched into one message.
+func getValueMapAndSchema(
+	data []byte, getSchema func(schemaID int) (*goavro.Codec, error),
+) (map[string]interface{}, map[string]interface{}, []byte, error) {
 	schemaID, binary, err := extractSchemaIDAndBinaryData(data)
 	if err != nil {
-		return nil, nil, err
+		return nil, nil, nil, err
 	}
 
-	codec, err := GetSchema(url, schemaID)
+	codec, err := getSchema(schemaID)
 	if err != nil {
-		return nil, nil, err
+		return nil, nil, nil, newInfraError(err)
 	}
 
-	native, _, err := codec.NativeFromBinary(binary)
+	native, rest, err := codec.NativeFromBinary(binary)
 	if err != nil {
-		return nil, nil, err
+		return nil, nil, nil, err
 	}
 
 	result, ok := native.(map[string]interface{})
 	if !ok {
-		return nil, nil, errors.New("raw avro message is not a map")
+		return nil, nil, nil, errors.New("raw avro message is not a map")
 	}
 
 	schema := make(map[string]interface{})
 	if err := json.Unmarshal([]byte(codec.Schema()), &schema); err != nil {
-		return nil, nil, err
+		return nil, nil, nil, err
 	}
 
-	return result, schema, nil
+	return result, schema, rest, nil
 }
 
 func extractSchemaIDAndBinaryData(data []byte) (int, []byte, error) {
@@ -131,137 +161,283 @@ func extractSchemaIDAndBinaryData(data []byte) (int, []byte, error) {
 // CalculateAndVerifyChecksum calculates the checksum of the value and compares it with the expected checksum.
 // return error if not matched.
 func CalculateAndVerifyChecksum(valueMap, valueSchema map[string]interface{}) error {
-	// fields store the type information of all columns, sorted by column ID, the same as the checksum calculation order.
-	fields, ok := valueSchema["fields"].([]interface{})
-	if !ok {
-		return errors.New("schema fields should be a map")
+	columns, err := parseAvroColumns(valueSchema)
+	if err != nil {
+		return err
 	}
+	return verifyAvroChecksum(valueMap, columns)
+}
 
+// verifyAvroChecksum is CalculateAndVerifyChecksum by the parsed columns of the value schema.
+func verifyAvroChecksum(valueMap map[string]interface{}, columns []avroColumn) error {
 	// if cannot found the expected checksum, just return.
 	// This may happen when sending the event, the TiCDC does not enable checksum.
-	o, ok := valueMap["_tidb_row_level_checksum"]
-	if !ok {
-		return nil
+	expectedChecksum, ok, err := getExpectedChecksum(valueMap)
+	if err != nil {
+		return err
 	}
-	expected := o.(string)
-	if expected == "" {
+	if !ok {
 		return nil
 	}
 
-	expectedChecksum, err := strconv.ParseUint(expected, 10, 64)
+	metas, values, err := avroColumnValues(valueMap, columns)
+	if err != nil {
+		return err
+	}
+	actualChecksum, err := checksum.CalculateVersion(getChecksumVersion(valueMap), metas, values)
 	if err != nil {
 		return err
 	}
 
-	// iterate over each field to calculate the actual checksum value by update the crc32 checksum.
-	var actualChecksum uint32
-	buf := make([]byte, 0)
-	for _, item := range fields {
-		field, ok := item.(map[string]interface{})
-		if !ok {
-			return errors.New("schema field should be a map")
-		}
+	if actualChecksum != expectedChecksum {
+		log.Error("checksum mismatch",
+			zap.Uint64("expected", expectedChecksum),
+			zap.Uint64("actual", actualChecksum))
+		return errChecksumMismatch
+	}
+
+	log.Info("checksum verified", zap.Uint64("checksum", actualChecksum))
+	return nil
+}
+
+// checksumColumns collects the type and the value of the columns, in the order of the checksum calculation.
+func checksumColumns(valueMap, valueSchema map[string]interface{}) ([]checksum.FieldMeta, []interface{}, error) {
+	columns, err := parseAvroColumns(valueSchema)
+	if err != nil {
+		return nil, nil, err
+	}
+	return avroColumnValues(valueMap, columns)
+}
+
+// avroColumn is a column of the avro schema involved in the checksum calculation.
+type avroColumn struct {
+	meta checksum.FieldMeta
+	// holder store column type information, the connect.parameters of the field type.
+	holder map[string]interface{}
+	// temporal is the avro logical type of the temporal column, nil if it's encoded as the string.
+	temporal *temporalEncoding
+	// nullable is true if the field accepts null, the column absent from the decoded value map is NULL then.
+	nullable bool
+}
+
+// parseAvroColumns parses the columns of the schema, in the order of the checksum calculation.
+// The handling mode of the decimal and the unsigned bigint is detected by the avro type of the column.
+func parseAvroColumns(valueSchema map[string]interface{}) ([]avroColumn, error) {
+	columns, _, err := parseAvroColumnsSkipping(valueSchema, false)
+	return columns, err
+}
 
+// parseAvroColumnsSkipping is parseAvroColumns, but the columns of the unknown TiDB types are skipped and returned
+// if skipUnknown is set, rather than failing the parse.
+func parseAvroColumnsSkipping(
+	valueSchema map[string]interface{}, skipUnknown bool,
+) ([]avroColumn, []columnError, error) {
+	// fields store the type information of all columns, sorted by column ID, the same as the checksum calculation order.
+	fields, err := avroFields(valueSchema)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var skipped []columnError
+	columns := make([]avroColumn, 0, len(fields))
+	for _, field := range fields {
 		// `_tidb_op` and subsequent columns are not involved in the checksum calculation,
 		// since they are some columns used to assist data consumption, not real TiDB column data
-		colName := field["name"].(string)
+		colName, ok := field["name"].(string)
+		if !ok {
+			return nil, nil, errors.New("schema field name should be a string")
+		}
 		if colName == "_tidb_op" {
 			break
 		}
-
-		// holder store column type information.
-		var holder map[string]interface{}
-		switch ty := field["type"].(type) {
-		// if the column is nullable, type info is store in the slice
-		case []interface{}:
-			for _, item := range ty {
-				if m, ok := item.(map[string]interface{}); ok {
-					holder = m["connect.parameters"].(map[string]interface{})
-					break
-				}
-			}
-		// if the column is not nullable, type info is store in the map
-		case map[string]interface{}:
-			holder = ty["connect.parameters"].(map[string]interface{})
-		default:
-			log.Panic("type info is anything else", zap.Any("typeInfo", field["type"]))
+		column, err := parseAvroColumn(colName, field)
+		if skipUnknown && errors.Is(err, errUnknownTiDBType) {
+			tidbType, _ := avroParameters(field)["tidb_type"].(string)
+			skipped = append(skipped, columnError{Column: colName, TiDBType: tidbType, Error: err.Error()})
+			continue
 		}
-		tidbType := holder["tidb_type"].(string)
-
-		mysqlType := mysqlTypeFromTiDBType(tidbType)
+		if err != nil {
+			return nil, nil, err
+		}
+		columns = append(columns, column)
+	}
+	return columns, skipped, nil
+}
 
-		// get the column value from the decoded value map by column name, it's an interface.
-		value, ok := valueMap[colName]
+// avroFields returns the fields of the record schema.
+func avroFields(valueSchema map[string]interface{}) ([]map[string]interface{}, error) {
+	items, ok := valueSchema["fields"].([]interface{})
+	if !ok {
+		return nil, errors.New("schema fields should be a list")
+	}
+	fields := make([]map[string]interface{}, 0, len(items))
+	for _, item := range items {
+		field, ok := item.(map[string]interface{})
 		if !ok {
-			return errors.New("value not found")
+			return nil, errors.New("schema field should be a map")
 		}
-		value, err := getColumnValue(value, holder, mysqlType)
+		fields = append(fields, field)
+	}
+	return fields, nil
+}
+
+// parseAvroColumn parses the column by its field of the schema.
+func parseAvroColumn(colName string, field map[string]interface{}) (avroColumn, error) {
+	holder := avroParameters(field)
+	tidbType, _ := holder["tidb_type"].(string)
+	if tidbType == "" {
+		return avroColumn{}, fmt.Errorf("tidb_type not found in the connect.parameters of the column %s", colName)
+	}
+	mysqlType, err := mysqlTypeFromTiDBType(tidbType)
+	if err != nil {
+		return avroColumn{}, fmt.Errorf("column %s: %w", colName, err)
+	}
+	meta := checksum.FieldMeta{Name: colName, MySQLType: mysqlType}
+	if err := detectHandlingMode(&meta, tidbType, field); err != nil {
+		return avroColumn{}, fmt.Errorf("column %s: %w", colName, err)
+	}
+	temporal, err := detectTemporalEncoding(tidbType, field, holder)
+	if err != nil {
+		return avroColumn{}, fmt.Errorf("column %s: %w", colName, err)
+	}
+	return avroColumn{meta: meta, holder: holder, temporal: temporal, nullable: avroFieldNullable(field)}, nil
+}
+
+// avroColumnValues collects the value of the parsed columns from the decoded value map.
+func avroColumnValues(
+	valueMap map[string]interface{}, columns []avroColumn,
+) ([]checksum.FieldMeta, []interface{}, error) {
+	metas := make([]checksum.FieldMeta, 0, len(columns))
+	values := make([]interface{}, 0, len(columns))
+	for _, column := range columns {
+		value, err := avroColumnValue(valueMap, column)
 		if err != nil {
-			return err
+			return nil, nil, err
 		}
+		metas = append(metas, column.meta)
+		values = append(values, value)
+	}
+	return metas, values, nil
+}
 
-		if len(buf) > 0 {
-			buf = buf[:0]
+// avroColumnValue returns the value of the column accepted by the checksum calculation.
+func avroColumnValue(valueMap map[string]interface{}, column avroColumn) (interface{}, error) {
+	// get the column value from the decoded value map by column name, it's an interface.
+	value, ok := valueMap[column.meta.Name]
+	if !ok {
+		// goavro may leave the null out of the decoded map for some union and default combinations.
+		if column.nullable {
+			return nil, nil
 		}
+		return nil, errors.New("value not found for the column " + column.meta.Name)
+	}
+	value, err := getColumnValue(value, column.holder, column.meta.MySQLType)
+	if err != nil || column.temporal == nil {
+		return value, err
+	}
+	return temporalString(value, column.meta.MySQLType, column.temporal, column.meta.Location)
+}
 
-		// generate a byte slice, and use it to update the checksum.
-		buf, err = buildChecksumBytes(buf, value, mysqlType)
-		if err != nil {
-			return err
+// getExpectedChecksum returns the checksum carried by the `_tidb_row_level_checksum` column,
+// the second return value is false if the checksum is not found.
+func getExpectedChecksum(valueMap map[string]interface{}) (uint64, bool, error) {
+	o, ok := valueMap["_tidb_row_level_checksum"]
+	if !ok {
+		return 0, false, nil
+	}
+	expected, ok := o.(string)
+	if !ok {
+		return 0, false, fmt.Errorf("_tidb_row_level_checksum should be a string, but got %T", o)
+	}
+	if expected == "" {
+		return 0, false, nil
+	}
+
+	expectedChecksum, err := strconv.ParseUint(expected, 10, 64)
+	if err != nil {
+		return 0, false, err
+	}
+	return expectedChecksum, true, nil
+}
+
+// getChecksumVersion returns the checksum version carried by the `_tidb_checksum_version` column, 0 if not found.
+func getChecksumVersion(valueMap map[string]interface{}) int {
+	switch v := valueMap["_tidb_checksum_version"].(type) {
+	case int32:
+		return int(v)
+	case map[string]interface{}:
+		// the column is nullable, the value is wrapped by the union.
+		for _, item := range v {
+			if version, ok := item.(int32); ok {
+				return int(version)
+			}
 		}
-		actualChecksum = crc32.Update(actualChecksum, crc32.IEEETable, buf)
 	}
+	return 0
+}
 
-	if uint64(actualChecksum) != expectedChecksum {
-		log.Error("checksum mismatch",
-			zap.Uint64("expected", expectedChecksum),
-			zap.Uint64("actual", uint64(actualChecksum)))
-		return errors.New("checksum mismatch")
+// getCommitTs returns the commit ts carried by the `_tidb_commit_ts` column, 0 if not found.
+func getCommitTs(valueMap map[string]interface{}) uint64 {
+	switch v := valueMap["_tidb_commit_ts"].(type) {
+	case int64:
+		return uint64(v)
+	case map[string]interface{}:
+		// the column is nullable, the value is wrapped by the union.
+		for _, item := range v {
+			if ts, ok := item.(int64); ok {
+				return uint64(ts)
+			}
+		}
 	}
+	return 0
+}
 
-	log.Info("checksum verified", zap.Uint64("checksum", uint64(actualChecksum)))
-	return nil
+// mysqlTypeFromTiDBType returns the mysql type of the TiDB type, the error if the verifier cannot handle it.
+func mysqlTypeFromTiDBType(tidbType string) (byte, error) {
+	result, ok := lookupMySQLType(tidbType)
+	if !ok {
+		return 0, fmt.Errorf("%w %s", errUnknownTiDBType, tidbType)
+	}
+	return result, nil
 }
 
-func mysqlTypeFromTiDBType(tidbType string) byte {
-	var result byte
+// lookupMySQLType returns the mysql type of the TiDB type, false if the verifier cannot handle it.
+func lookupMySQLType(tidbType string) (byte, bool) {
 	switch tidbType {
 	case "INT", "INT UNSIGNED":
-		result = mysql.TypeLong
+		return mysql.TypeLong, true
 	case "BIGINT", "BIGINT UNSIGNED":
-		result = mysql.TypeLonglong
+		return mysql.TypeLonglong, true
 	case "FLOAT":
-		result = mysql.TypeFloat
+		return mysql.TypeFloat, true
 	case "DOUBLE":
-		result = mysql.TypeDouble
+		return mysql.TypeDouble, true
 	case "BIT":
-		result = mysql.TypeBit
+		return mysql.TypeBit, true
 	case "DECIMAL":
-		result = mysql.TypeNewDecimal
+		return mysql.TypeNewDecimal, true
 	case "TEXT":
-		result = mysql.TypeVarchar
+		return mysql.TypeVarchar, true
 	case "BLOB":
-		result = mysql.TypeLongBlob
+		return mysql.TypeLongBlob, true
 	case "ENUM":
-		result = mysql.TypeEnum
+		return mysql.TypeEnum, true
 	case "SET":
-		result = mysql.TypeSet
+		return mysql.TypeSet, true
 	case "JSON":
-		result = mysql.TypeJSON
+		return mysql.TypeJSON, true
 	case "DATE":
-		result = mysql.TypeDate
+		return mysql.TypeDate, true
 	case "DATETIME":
-		result = mysql.TypeDatetime
+		return mysql.TypeDatetime, true
 	case "TIMESTAMP":
-		result = mysql.TypeTimestamp
+		return mysql.TypeTimestamp, true
 	case "TIME":
-		result = mysql.TypeDuration
+		return mysql.TypeDuration, true
 	case "YEAR":
-		result = mysql.TypeYear
-	default:
-		log.Panic("this should not happen, unknown TiDB type", zap.String("type", tidbType))
+		return mysql.TypeYear, true
 	}
-	return result
+	return 0, false
 }
 
 // value is an interface, need to convert it to the real value with the help of type info.
@@ -280,9 +456,12 @@ func getColumnValue(value interface{}, holder map[string]interface{}, mysqlType
 	case mysql.TypeEnum:
 		// enum type is encoded as string,
 		// we need to convert it to int by the order of the enum values definition.
-		allowed := strings.Split(holder["allowed"].(string), ",")
 		switch t := value.(type) {
 		case string:
+			allowed, err := allowedValues(holder)
+			if err != nil {
+				return nil, err
+			}
 			enum, err := types.ParseEnum(allowed, t, "")
 			if err != nil {
 				return nil, err
@@ -294,9 +473,12 @@ func getColumnValue(value interface{}, holder map[string]interface{}, mysqlType
 	case mysql.TypeSet:
 		// set type is encoded as string,
 		// we need to convert it to int by the order of the set values definition.
-		elems := strings.Split(holder["allowed"].(string), ",")
 		switch t := value.(type) {
 		case string:
+			elems, err := allowedValues(holder)
+			if err != nil {
+				return nil, err
+			}
 			s, err := types.ParseSet(elems, t, "")
 			if err != nil {
 				return nil, err
@@ -309,146 +491,36 @@ func getColumnValue(value interface{}, holder map[string]interface{}, mysqlType
 	return value, nil
 }
 
-// buildChecksumBytes append value the buf, mysqlType is used to convert value interface to concrete type.
-// by follow: https://github.com/pingcap/tidb/blob/e3417913f58cdd5a136259b902bf177eaf3aa637/util/rowcodec/common.go#L308
-func buildChecksumBytes(buf []byte, value interface{}, mysqlType byte) ([]byte, error) {
-	if value == nil {
-		return buf, nil
-	}
-
-	switch mysqlType {
-	// TypeTiny, TypeShort, TypeInt32 is encoded as int32
-	// TypeLong is encoded as int32 if signed, else int64.
-	// TypeLongLong is encoded as int64 if signed, else uint64,
-	// if bigintUnsignedHandlingMode set as string, encode as string.
-	case mysql.TypeTiny, mysql.TypeShort, mysql.TypeLong, mysql.TypeLonglong, mysql.TypeInt24, mysql.TypeYear:
-		switch a := value.(type) {
-		case int32:
-			buf = binary.LittleEndian.AppendUint64(buf, uint64(a))
-		case uint32:
-			buf = binary.LittleEndian.AppendUint64(buf, uint64(a))
-		case int64:
-			buf = binary.LittleEndian.AppendUint64(buf, uint64(a))
-		case uint64:
-			buf = binary.LittleEndian.AppendUint64(buf, a)
-		case string:
-			v, err := strconv.ParseUint(a, 10, 64)
-			if err != nil {
-				return nil, err
-			}
-			buf = binary.LittleEndian.AppendUint64(buf, v)
-		default:
-			log.Panic("unknown golang type for the integral value",
-				zap.Any("value", value), zap.Any("mysqlType", mysqlType))
-		}
-	// TypeFloat encoded as float32, TypeDouble encoded as float64
-	case mysql.TypeFloat, mysql.TypeDouble:
-		var v float64
-		switch a := value.(type) {
-		case float32:
-			v = float64(a)
-		case float64:
-			v = a
-		}
-		if math.IsInf(v, 0) || math.IsNaN(v) {
-			v = 0
-		}
-		buf = binary.LittleEndian.AppendUint64(buf, math.Float64bits(v))
-	// TypeEnum, TypeSet encoded as string
-	// but convert to int by the getColumnValue function
-	case mysql.TypeEnum, mysql.TypeSet:
-		buf = binary.LittleEndian.AppendUint64(buf, value.(uint64))
-	// TypeBit encoded as bytes
-	case mysql.TypeBit:
-		// bit is store as bytes, convert to uint64.
-		v, err := binaryLiteralToInt(value.([]byte))
-		if err != nil {
-			return nil, err
-		}
-		buf = binary.LittleEndian.AppendUint64(buf, v)
-	// encoded as bytes if binary flag set to true, else string
-	case mysql.TypeVarchar, mysql.TypeVarString, mysql.TypeString, mysql.TypeTinyBlob, mysql.TypeMediumBlob, mysql.TypeLongBlob, mysql.TypeBlob:
-		switch a := value.(type) {
-		case string:
-			buf = appendLengthValue(buf, []byte(a))
-		case []byte:
-			buf = appendLengthValue(buf, a)
-		default:
-			log.Panic("unknown golang type for the string value",
-				zap.Any("value", value), zap.Any("mysqlType", mysqlType))
-		}
-	// all encoded as string
-	case mysql.TypeTimestamp:
-		location := "local"
-		timestamp := value.(string)
-		loc, err := time.LoadLocation(location)
-		if err != nil {
-			return nil, err
-		}
-		t, err := time.ParseInLocation("2006-01-02 15:04:05", timestamp, loc)
-		if err != nil {
-			return nil, err
-		}
-		timestamp = t.UTC().Format("2006-01-02 15:04:05")
-		buf = appendLengthValue(buf, []byte(timestamp))
-	case mysql.TypeDatetime, mysql.TypeDate, mysql.TypeDuration, mysql.TypeNewDate:
-		v := value.(string)
-		buf = appendLengthValue(buf, []byte(v))
-	// encoded as string if decimalHandlingMode set to string, it's required to enable checksum.
-	case mysql.TypeNewDecimal:
-		buf = appendLengthValue(buf, []byte(value.(string)))
-	// encoded as string
-	case mysql.TypeJSON:
-		buf = appendLengthValue(buf, []byte(value.(string)))
-	// this should not happen, does not take into the checksum calculation.
-	case mysql.TypeNull, mysql.TypeGeometry:
-		// do nothing
-	default:
-		return buf, errors.New("invalid type for the checksum calculation")
-	}
-	return buf, nil
-}
-
-func appendLengthValue(buf []byte, val []byte) []byte {
-	buf = binary.LittleEndian.AppendUint32(buf, uint32(len(val)))
-	buf = append(buf, val...)
-	return buf
-}
-
-// binaryLiteralToInt convert bytes into uint64,
-// by follow https://github.com/pingcap/tidb/blob/e3417913f58cdd5a136259b902bf177eaf3aa637/types/binary_literal.go#L105
-func binaryLiteralToInt(bytes []byte) (uint64, error) {
-	bytes = trimLeadingZeroBytes(bytes)
-	length := len(bytes)
-
-	if length > 8 {
-		log.Error("invalid bit value found", zap.ByteString("value", bytes))
-		return math.MaxUint64, errors.New("invalid bit value")
-	}
-
-	if length == 0 {
-		return 0, nil
-	}
-
-	// Note: the byte-order is BigEndian.
-	val := uint64(bytes[0])
-	for i := 1; i < length; i++ {
-		val = (val << 8) | uint64(bytes[i])
+// allowedValues returns the enum or set values defined by the `allowed` of the connect.parameters.
+func allowedValues(holder map[string]interface{}) ([]string, error) {
+	allowed, ok := holder["allowed"].(string)
+	if !ok {
+		return nil, errors.New("allowed values not found in the connect.parameters")
 	}
-	return val, nil
+	return splitAllowedValues(allowed), nil
 }
 
-func trimLeadingZeroBytes(bytes []byte) []byte {
-	if len(bytes) == 0 {
-		return bytes
-	}
-	pos, posMax := 0, len(bytes)-1
-	for ; pos < posMax; pos++ {
-		if bytes[pos] != 0 {
-			break
+// splitAllowedValues splits the `allowed` serialized by TiCDC, which follows the Debezium MySQL connector,
+// the comma in the element is escaped as `\,`, and the quotes are written as is, such as `a\,b,it's,` for
+// ENUM("a,b", "it's", ""). An element ending with a backslash cannot be told from an escaped comma, it's not supported.
+func splitAllowedValues(allowed string) []string {
+	var (
+		elems []string
+		elem  strings.Builder
+	)
+	for i := 0; i < len(allowed); i++ {
+		switch {
+		case allowed[i] == '\\' && i+1 < len(allowed) && allowed[i+1] == ',':
+			elem.WriteByte(',')
+			i++
+		case allowed[i] == ',':
+			elems = append(elems, elem.String())
+			elem.Reset()
+		default:
+			elem.WriteByte(allowed[i])
 		}
 	}
-	return bytes[pos:]
+	return append(elems, elem.String())
 }
 
 // GetSchema query the schema registry to fetch the schema by the schema id.
@@ -0,0 +1,119 @@
+// Copyright 2023 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const metricsNamespace = "avro_checksum_verification"
+
+// metricsCollector exports the end-to-end latency and the resolved ts of the verifiers as the prometheus metrics.
+// Nothing is recorded twice, the metrics are collected from the trackers of the verifiers at each scrape.
+type metricsCollector struct {
+	// verifiers returns the running verifiers keyed by the source name, the name is not exported if not labeled.
+	verifiers func() map[string]*verifier
+	// labeled is true if the metrics are labeled by the source name, only for the multi mode.
+	labeled bool
+
+	latency         *prometheus.Desc
+	latencyClamped  *prometheus.Desc
+	resolvedTs      *prometheus.Desc
+	resolvedStalled *prometheus.Desc
+	resolvedStalls  *prometheus.Desc
+}
+
+func newMetricsCollector(verifiers func() map[string]*verifier, labeled bool) *metricsCollector {
+	var labels []string
+	if labeled {
+		labels = []string{"source"}
+	}
+	partitionLabels := append(append([]string(nil), labels...), "partition")
+	return &metricsCollector{
+		verifiers: verifiers,
+		labeled:   labeled,
+		latency: prometheus.NewDesc(metricsNamespace+"_latency_seconds",
+			"end-to-end latency of the events from the commit in the upstream to the consumption", labels, nil),
+		latencyClamped: prometheus.NewDesc(metricsNamespace+"_latency_clamped_total",
+			"number of the events committed later than consumed, whose latency is taken as 0", labels, nil),
+		resolvedTs: prometheus.NewDesc(metricsNamespace+"_resolved_ts_milliseconds",
+			"physical time of the resolved ts of the partition in unix milliseconds", partitionLabels, nil),
+		resolvedStalled: prometheus.NewDesc(metricsNamespace+"_resolved_ts_stalled",
+			"1 if the resolved ts of the partition does not advance within the stall threshold", partitionLabels, nil),
+		resolvedStalls: prometheus.NewDesc(metricsNamespace+"_resolved_ts_stalls_total",
+			"number of times the resolved ts of any partition stalls", labels, nil),
+	}
+}
+
+func (c *metricsCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.latency
+	ch <- c.latencyClamped
+	ch <- c.resolvedTs
+	ch <- c.resolvedStalled
+	ch <- c.resolvedStalls
+}
+
+func (c *metricsCollector) Collect(ch chan<- prometheus.Metric) {
+	for name, v := range c.verifiers() {
+		var labels []string
+		if c.labeled {
+			labels = []string{name}
+		}
+		c.collectLatency(ch, v, labels)
+
+		resolved, stalls := v.resolved.snapshot()
+		ch <- prometheus.MustNewConstMetric(c.resolvedStalls, prometheus.CounterValue, float64(stalls), labels...)
+		for partition, p := range resolved {
+			partitionLabels := append(append([]string(nil), labels...), strconv.Itoa(partition))
+			if p.ResolvedTs != 0 {
+				ch <- prometheus.MustNewConstMetric(c.resolvedTs, prometheus.GaugeValue,
+					float64(physicalTime(p.ResolvedTs).UnixMilli()), partitionLabels...)
+			}
+			var stalled float64
+			if p.Stalled {
+				stalled = 1
+			}
+			ch <- prometheus.MustNewConstMetric(c.resolvedStalled, prometheus.GaugeValue, stalled, partitionLabels...)
+		}
+	}
+}
+
+// collectLatency exports the latency histogram of the verifier, which is read under the lock of the verifier.
+func (c *metricsCollector) collectLatency(ch chan<- prometheus.Metric, v *verifier, labels []string) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if v.latency == nil {
+		return
+	}
+	h := v.latency.total
+	buckets := make(map[float64]uint64, len(latencyBuckets))
+	var cumulative uint64
+	for i, bound := range latencyBuckets {
+		cumulative += h.counts[i]
+		buckets[float64(bound)/1000] = cumulative
+	}
+	ch <- prometheus.MustNewConstHistogram(c.latency, h.count, h.sum.Seconds(), buckets, labels...)
+	ch <- prometheus.MustNewConstMetric(c.latencyClamped, prometheus.CounterValue, float64(h.clamped), labels...)
+}
+
+// metricsHandler serves the metrics of the verifiers in the prometheus text format.
+func metricsHandler(c *metricsCollector) http.Handler {
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(c)
+	return promhttp.HandlerFor(registry, promhttp.HandlerOpts{})
+}
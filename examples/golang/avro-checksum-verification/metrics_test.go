@@ -0,0 +1,73 @@
+// Copyright 2023 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+	"github.com/stretchr/testify/require"
+)
+
+// getTestMetrics returns the metrics served in the prometheus text format.
+func getTestMetrics(t *testing.T, server *httptest.Server, token string) (int, string) {
+	req, err := http.NewRequest(http.MethodGet, server.URL+"/metrics", nil)
+	require.NoError(t, err)
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	return resp.StatusCode, string(body)
+}
+
+func TestServeMetrics(t *testing.T) {
+	t.Parallel()
+
+	registry := newTestRegistry(t, map[int]string{testSchemaID: testValueSchema})
+	cfg := newDefaultConfig()
+	cfg.schemaRegistryURL = registry.URL
+	v := newTestVerifier(cfg, &fakeReader{messages: []kafka.Message{
+		newVerifiedTestMessage(t, 0, 1, "a"), newVerifiedTestMessage(t, 1, 2, "b"),
+	}})
+	require.NoError(t, v.run(context.Background()))
+	resolvedAt := time.Date(2023, 5, 1, 0, 0, 0, 0, time.UTC)
+	require.NoError(t, v.resolved.observe(1, messageResult{resolvedTs: commitTsAt(resolvedAt)}, time.Now()))
+	server := httptest.NewServer(newController(v, "secret").handler())
+	t.Cleanup(server.Close)
+
+	code, _ := getTestMetrics(t, server, "")
+	require.Equal(t, http.StatusUnauthorized, code)
+	code, body := getTestMetrics(t, server, "secret")
+	require.Equal(t, http.StatusOK, code)
+	// the commit ts of the test messages are far in the past, beyond all bounds.
+	require.Contains(t, body, `avro_checksum_verification_latency_seconds_bucket{le="3600"} 0`)
+	require.Contains(t, body, `avro_checksum_verification_latency_seconds_bucket{le="+Inf"} 2`)
+	require.Contains(t, body, "avro_checksum_verification_latency_seconds_count 2")
+	require.Contains(t, body, "avro_checksum_verification_latency_clamped_total 0")
+	require.Contains(t, body, `avro_checksum_verification_resolved_ts_milliseconds{partition="1"} 1.6828992e+12`)
+	require.Contains(t, body, `avro_checksum_verification_resolved_ts_stalled{partition="1"} 0`)
+	require.Contains(t, body, "avro_checksum_verification_resolved_ts_stalls_total 0")
+	// the partition without the watermark has no resolved ts.
+	require.Contains(t, body, `avro_checksum_verification_resolved_ts_stalled{partition="0"} 0`)
+	require.NotContains(t, body, `avro_checksum_verification_resolved_ts_milliseconds{partition="0"}`)
+}
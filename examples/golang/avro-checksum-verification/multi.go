@@ -0,0 +1,343 @@
+// Copyright 2023 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/pingcap/log"
+	"go.uber.org/zap"
+)
+
+// multiConfig is the configuration of the `multi` command, which verifies several sources in one process.
+type multiConfig struct {
+	sourcesFile string
+	reportFile  string
+	// failTogether stops all sources once any of them stops with a failure.
+	failTogether bool
+	// listenAddr is the address of the status API of all sources, disabled if empty.
+	listenAddr string
+	tokenFile  string
+}
+
+func (c *multiConfig) bindFlags(fs *flag.FlagSet) {
+	fs.StringVar(&c.sourcesFile, "sources-file", "",
+		"JSON file of the sources to verify, each has the name and the flags of the consume command")
+	fs.StringVar(&c.reportFile, "report-file", "", "path to write the report of all sources in JSON format")
+	fs.BoolVar(&c.failTogether, "fail-together", false,
+		"stop all sources once any of them stops with a failure, the others keep verifying if not set")
+	fs.StringVar(&c.listenAddr, "listen-addr", "", "address of the status API of all sources, disabled if empty")
+	fs.StringVar(&c.tokenFile, "api-token-file", "",
+		"file carrying the token required by the status API as `Authorization: Bearer <token>`, disabled if empty")
+}
+
+// multiSource is a source of the sources file, such as
+// `{"name": "cf-1", "args": ["--kafka-addr=127.0.0.1:9092", "--topic=cf-1"]}`.
+type multiSource struct {
+	Name string   `json:"name"`
+	Args []string `json:"args"`
+}
+
+type multiSourcesFile struct {
+	Sources []multiSource `json:"sources"`
+}
+
+// sourceConfig is the configuration of a named source.
+type sourceConfig struct {
+	name string
+	cfg  *config
+}
+
+// loadSources reads and validates the sources of the file, the name of each source must be unique.
+func loadSources(path string) ([]sourceConfig, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var file multiSourcesFile
+	if err := json.Unmarshal(content, &file); err != nil {
+		return nil, err
+	}
+	if len(file.Sources) == 0 {
+		return nil, errors.New("no source in the sources file: " + path)
+	}
+	names := make(map[string]struct{}, len(file.Sources))
+	sources := make([]sourceConfig, 0, len(file.Sources))
+	for _, source := range file.Sources {
+		if source.Name == "" {
+			return nil, errors.New("source name must be set")
+		}
+		if _, ok := names[source.Name]; ok {
+			return nil, errors.New("duplicate source name: " + source.Name)
+		}
+		names[source.Name] = struct{}{}
+		cfg := newDefaultConfig()
+		fs := flag.NewFlagSet(source.Name, flag.ContinueOnError)
+		cfg.bindFlags(fs)
+		if err := fs.Parse(source.Args); err != nil {
+			return nil, errors.New("source " + source.Name + ": " + err.Error())
+		}
+		if err := cfg.validate(); err != nil {
+			return nil, errors.New("source " + source.Name + ": " + err.Error())
+		}
+		sources = append(sources, sourceConfig{name: source.Name, cfg: cfg})
+	}
+	return sources, nil
+}
+
+// sourceReport is the report of a source, along with where its events come from,
+// so that each failure can be told which changefeed it belongs to.
+type sourceReport struct {
+	Name              string `json:"name"`
+	KafkaAddr         string `json:"kafkaAddr,omitempty"`
+	Topic             string `json:"topic,omitempty"`
+	Protocol          string `json:"protocol"`
+	SchemaRegistryURL string `json:"schemaRegistryURL,omitempty"`
+	StorageDir        string `json:"storageDir,omitempty"`
+	Replay            string `json:"replay,omitempty"`
+	ExitCode          int    `json:"exitCode"`
+	// Error is the reason the source failed to start, the report is absent then.
+	Error string `json:"error,omitempty"`
+	// StoppedBy is the source whose failure stops this one, only if `--fail-together` is set.
+	StoppedBy string  `json:"stoppedBy,omitempty"`
+	Report    *report `json:"report,omitempty"`
+}
+
+func newSourceReport(source sourceConfig) *sourceReport {
+	r := &sourceReport{Name: source.name, Protocol: source.cfg.protocol}
+	if source.cfg.storageDir != "" {
+		r.StorageDir = source.cfg.storageDir
+	} else if source.cfg.replay != "" {
+		r.Replay = source.cfg.replay
+	} else {
+		r.KafkaAddr, r.Topic = source.cfg.kafkaAddr, source.cfg.topic
+	}
+	if source.cfg.protocol == protocolAvro {
+		r.SchemaRegistryURL = source.cfg.schemaRegistryURL
+	}
+	return r
+}
+
+// multiReport is the report of all sources, in the order of the sources file.
+type multiReport struct {
+	StartTime  time.Time       `json:"startTime"`
+	FinishTime time.Time       `json:"finishTime"`
+	Sources    []*sourceReport `json:"sources"`
+	// ExitCode is the exit code of the first source not exiting cleanly, in the order of the sources file.
+	ExitCode int `json:"exitCode"`
+}
+
+func (r *multiReport) writeFile(path string) error {
+	content, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, content, 0o644)
+}
+
+// multiRunner runs the sources concurrently, each has its own verifier, and nothing is shared between them.
+type multiRunner struct {
+	sources      []sourceConfig
+	failTogether bool
+	// newVerifier creates the verifier of the source.
+	newVerifier func(ctx context.Context, cfg *config) (*verifier, error)
+
+	mu sync.Mutex
+	// controllers are the status of the running sources, keyed by the name.
+	controllers map[string]*controller
+	// stoppedBy is the first source stopping with a failure.
+	stoppedBy string
+}
+
+func newMultiRunner(sources []sourceConfig, failTogether bool) *multiRunner {
+	return &multiRunner{
+		sources: sources, failTogether: failTogether, newVerifier: newVerifier,
+		controllers: make(map[string]*controller),
+	}
+}
+
+// run verifies all sources until they stop, and returns the report of them.
+func (m *multiRunner) run(ctx context.Context) *multiReport {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	result := &multiReport{StartTime: time.Now(), Sources: make([]*sourceReport, len(m.sources))}
+	var wg sync.WaitGroup
+	for i, source := range m.sources {
+		result.Sources[i] = newSourceReport(source)
+		wg.Add(1)
+		go func(source sourceConfig, r *sourceReport) {
+			defer wg.Done()
+			m.runSource(ctx, source, r)
+			if r.ExitCode == exitCodeClean {
+				return
+			}
+			m.mu.Lock()
+			defer m.mu.Unlock()
+			if m.failTogether && m.stoppedBy == "" {
+				m.stoppedBy = source.name
+				log.Warn("stop all sources since the source fails", zap.String("source", source.name))
+				cancel()
+			}
+		}(source, result.Sources[i])
+	}
+	wg.Wait()
+
+	result.FinishTime = time.Now()
+	for _, r := range result.Sources {
+		if m.stoppedBy != "" && r.Name != m.stoppedBy && r.ExitCode == exitCodeClean {
+			r.StoppedBy = m.stoppedBy
+		}
+		if result.ExitCode == exitCodeClean {
+			result.ExitCode = r.ExitCode
+		}
+	}
+	return result
+}
+
+func (m *multiRunner) runSource(ctx context.Context, source sourceConfig, r *sourceReport) {
+	v, err := m.newVerifier(ctx, source.cfg)
+	if err != nil {
+		log.Error("create verifier of the source failed", zap.String("source", source.name), zap.Error(err))
+		r.ExitCode, r.Error = exitCodeOf(err), err.Error()
+		return
+	}
+	defer v.close()
+	m.mu.Lock()
+	m.controllers[source.name] = newController(v, "")
+	m.mu.Unlock()
+
+	err = v.run(ctx)
+	if err != nil {
+		log.Error("verification of the source stopped", zap.String("source", source.name), zap.Error(err))
+	}
+	r.ExitCode = v.finish(err)
+	r.Report = v.report
+	log.Info("verification of the source finished",
+		zap.String("source", source.name), zap.String("topic", r.Topic),
+		zap.String("schemaRegistryURL", r.SchemaRegistryURL), zap.Int("exitCode", r.ExitCode))
+}
+
+// sourceStatus is the status of a source in the response of `/status`.
+type sourceStatus struct {
+	Topic             string `json:"topic,omitempty"`
+	SchemaRegistryURL string `json:"schemaRegistryURL,omitempty"`
+	*serveStatus
+}
+
+// status returns the status of the running sources, keyed by the name.
+func (m *multiRunner) status() map[string]*sourceStatus {
+	m.mu.Lock()
+	controllers := make(map[string]*controller, len(m.controllers))
+	for name, c := range m.controllers {
+		controllers[name] = c
+	}
+	m.mu.Unlock()
+	result := make(map[string]*sourceStatus, len(controllers))
+	for name, c := range controllers {
+		status := &sourceStatus{Topic: c.v.cfg.topic, serveStatus: c.status()}
+		if c.v.cfg.protocol == protocolAvro {
+			status.SchemaRegistryURL = c.v.cfg.schemaRegistryURL
+		}
+		result[name] = status
+	}
+	return result
+}
+
+// verifiers returns the verifiers of the running sources, keyed by the name.
+func (m *multiRunner) verifiers() map[string]*verifier {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	result := make(map[string]*verifier, len(m.controllers))
+	for name, c := range m.controllers {
+		result[name] = c.v
+	}
+	return result
+}
+
+func (m *multiRunner) handler(token string) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/status", authorizedHandler(token, http.MethodGet, func(w http.ResponseWriter, _ *http.Request) {
+		writeAPIResponse(w, http.StatusOK, map[string]interface{}{"sources": m.status()})
+	}))
+	metrics := metricsHandler(newMetricsCollector(m.verifiers, true))
+	mux.HandleFunc("/metrics", authorizedHandler(token, http.MethodGet, metrics.ServeHTTP))
+	return mux
+}
+
+// runMulti runs the verifiers of all sources in the sources file concurrently.
+func runMulti(args []string) int {
+	multiCfg := &multiConfig{}
+	fs := flag.NewFlagSet(commandMulti, flag.ExitOnError)
+	multiCfg.bindFlags(fs)
+	_ = fs.Parse(args)
+	if multiCfg.sourcesFile == "" {
+		log.Fatal("invalid configuration", zap.Error(errors.New("sources file must be set")))
+	}
+	sources, err := loadSources(multiCfg.sourcesFile)
+	if err != nil {
+		log.Fatal("invalid sources file", zap.String("file", multiCfg.sourcesFile), zap.Error(err))
+	}
+	token, err := (&serveConfig{tokenFile: multiCfg.tokenFile}).token()
+	if err != nil {
+		log.Fatal("read api token failed", zap.String("file", multiCfg.tokenFile), zap.Error(err))
+	}
+
+	ctx, cancel := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer cancel()
+
+	runner := newMultiRunner(sources, multiCfg.failTogether)
+	if multiCfg.listenAddr != "" {
+		listener, err := net.Listen("tcp", multiCfg.listenAddr)
+		if err != nil {
+			log.Error("listen the status API failed", zap.String("addr", multiCfg.listenAddr), zap.Error(err))
+			return exitCodeInfraError
+		}
+		server := &http.Server{Handler: runner.handler(token), ReadHeaderTimeout: 10 * time.Second}
+		go func() {
+			if err := server.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+				log.Warn("status API stopped", zap.Error(err))
+			}
+		}()
+		defer func() {
+			shutdownCtx, shutdownCancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer shutdownCancel()
+			_ = server.Shutdown(shutdownCtx)
+		}()
+		if host, _, _ := net.SplitHostPort(multiCfg.listenAddr); token == "" && !isLoopback(host) {
+			log.Warn("the status API is exposed beyond the localhost without the api token",
+				zap.String("addr", multiCfg.listenAddr))
+		}
+		log.Info("status API started", zap.String("addr", listener.Addr().String()))
+	}
+
+	result := runner.run(ctx)
+	log.Info("verification of all sources finished", zap.Int("sources", len(result.Sources)),
+		zap.Int("exitCode", result.ExitCode))
+	if multiCfg.reportFile != "" {
+		if err := result.writeFile(multiCfg.reportFile); err != nil {
+			log.Warn("write report file failed", zap.String("file", multiCfg.reportFile), zap.Error(err))
+		}
+	}
+	return result.ExitCode
+}
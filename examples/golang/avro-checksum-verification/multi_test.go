@@ -0,0 +1,141 @@
+// Copyright 2023 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/segmentio/kafka-go"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoadSources(t *testing.T) {
+	t.Parallel()
+
+	load := func(content string) ([]sourceConfig, error) {
+		path := filepath.Join(t.TempDir(), "sources.json")
+		require.NoError(t, os.WriteFile(path, []byte(content), 0o644))
+		return loadSources(path)
+	}
+	sources, err := load(`{"sources": [
+		{"name": "a", "args": ["--topic=t1", "--schema-registry-url=http://r1:8081"]},
+		{"name": "b", "args": ["--topic=t2", "--protocol=canal-json"]}
+	]}`)
+	require.NoError(t, err)
+	require.Len(t, sources, 2)
+	require.Equal(t, "t1", sources[0].cfg.topic)
+	require.Equal(t, "http://r1:8081", sources[0].cfg.schemaRegistryURL)
+	require.Equal(t, protocolCanalJSON, sources[1].cfg.protocol)
+
+	_, err = load(`{"sources": []}`)
+	require.ErrorContains(t, err, "no source in the sources file")
+	_, err = load(`{"sources": [{"args": []}]}`)
+	require.ErrorContains(t, err, "source name must be set")
+	_, err = load(`{"sources": [{"name": "a"}, {"name": "a"}]}`)
+	require.ErrorContains(t, err, "duplicate source name: a")
+	_, err = load(`{"sources": [{"name": "a", "args": ["--unknown"]}]}`)
+	require.ErrorContains(t, err, "source a: flag provided but not defined")
+	_, err = load(`{"sources": [{"name": "a", "args": ["--protocol=unknown"]}]}`)
+	require.ErrorContains(t, err, "source a:")
+}
+
+// blockingReader returns the messages, then blocks until the context is done.
+type blockingReader struct {
+	*fakeReader
+}
+
+func (r *blockingReader) FetchMessage(ctx context.Context) (kafka.Message, error) {
+	if r.next < len(r.messages) {
+		return r.fakeReader.FetchMessage(ctx)
+	}
+	<-ctx.Done()
+	return kafka.Message{}, ctx.Err()
+}
+
+func TestMultiRunner(t *testing.T) {
+	t.Parallel()
+
+	registry := newTestRegistry(t, map[int]string{testSchemaID: testValueSchema})
+	newSource := func(name, topic string, failFast bool) sourceConfig {
+		cfg := newDefaultConfig()
+		cfg.topic, cfg.schemaRegistryURL, cfg.failFast = topic, registry.URL, failFast
+		return sourceConfig{name: name, cfg: cfg}
+	}
+	run := func(failTogether bool, readers map[string]messageReader) (*multiRunner, *multiReport) {
+		m := newMultiRunner([]sourceConfig{newSource("a", "t1", false), newSource("b", "t2", true)}, failTogether)
+		m.newVerifier = func(_ context.Context, cfg *config) (*verifier, error) {
+			v := newTestVerifier(cfg, &fakeReader{})
+			v.reader = readers[cfg.topic]
+			return v, nil
+		}
+		return m, m.run(context.Background())
+	}
+
+	// the failed source does not stop the others.
+	m, result := run(false, map[string]messageReader{
+		"t1": &fakeReader{messages: []kafka.Message{newVerifiedTestMessage(t, 0, 1, "a")}},
+		"t2": &fakeReader{messages: []kafka.Message{newMismatchTestMessage(t, 0, 1, "a")}},
+	})
+	require.Equal(t, exitCodeMismatch, result.ExitCode)
+	require.Len(t, result.Sources, 2)
+	a, b := result.Sources[0], result.Sources[1]
+	require.Equal(t, "a", a.Name)
+	require.Equal(t, exitCodeClean, a.ExitCode)
+	require.Equal(t, uint64(1), a.Report.Counters.Verified)
+	require.Empty(t, a.StoppedBy)
+	require.Equal(t, "b", b.Name)
+	require.Equal(t, "t2", b.Topic)
+	require.Equal(t, registry.URL, b.SchemaRegistryURL)
+	require.Equal(t, exitCodeMismatch, b.ExitCode)
+	require.Len(t, b.Report.Failures, 1)
+
+	// the status of each source is labeled by the name.
+	server := httptest.NewServer(m.handler(""))
+	defer server.Close()
+	resp, err := http.Get(server.URL + "/status")
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	var status struct {
+		Sources map[string]struct {
+			Topic    string   `json:"topic"`
+			Counters counters `json:"counters"`
+		} `json:"sources"`
+	}
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&status))
+	require.Equal(t, "t1", status.Sources["a"].Topic)
+	require.Equal(t, uint64(1), status.Sources["a"].Counters.Verified)
+	require.Equal(t, uint64(1), status.Sources["b"].Counters.Mismatches)
+
+	// the metrics of each source are labeled by the name.
+	code, body := getTestMetrics(t, server, "")
+	require.Equal(t, http.StatusOK, code)
+	require.Contains(t, body, `avro_checksum_verification_latency_seconds_count{source="a"} 1`)
+	require.Contains(t, body, `avro_checksum_verification_resolved_ts_stalls_total{source="b"} 0`)
+
+	// the failed source stops the others if they fail together.
+	_, result = run(true, map[string]messageReader{
+		"t1": &blockingReader{&fakeReader{messages: []kafka.Message{newVerifiedTestMessage(t, 0, 1, "a")}}},
+		"t2": &fakeReader{messages: []kafka.Message{newMismatchTestMessage(t, 0, 1, "a")}},
+	})
+	require.Equal(t, exitCodeMismatch, result.ExitCode)
+	require.Equal(t, "b", result.Sources[0].StoppedBy)
+	require.Equal(t, exitCodeClean, result.Sources[0].ExitCode)
+	require.Empty(t, result.Sources[1].StoppedBy)
+}
@@ -0,0 +1,44 @@
+// Copyright 2023 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+// avroFieldNullable returns true if the field accepts null, either its type is a union having the null branch,
+// or its default is null.
+func avroFieldNullable(field map[string]interface{}) bool {
+	if def, ok := field["default"]; ok && def == nil {
+		return true
+	}
+	switch ty := field["type"].(type) {
+	case []interface{}:
+		for _, item := range ty {
+			if isAvroNull(item) {
+				return true
+			}
+		}
+	default:
+		return isAvroNull(ty)
+	}
+	return false
+}
+
+// isAvroNull returns true if the avro type is null, by the name or the type of the definition.
+func isAvroNull(ty interface{}) bool {
+	switch t := ty.(type) {
+	case string:
+		return t == "null"
+	case map[string]interface{}:
+		return t["type"] == "null"
+	}
+	return false
+}
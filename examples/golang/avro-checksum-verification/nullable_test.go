@@ -0,0 +1,88 @@
+// Copyright 2023 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"strconv"
+	"testing"
+
+	"avro-checksum-sample/checksum"
+	"github.com/pingcap/tidb/pkg/parser/mysql"
+	"github.com/stretchr/testify/require"
+)
+
+// testNullableSchema has the nullable columns of several shapes, the union with or without the null default,
+// and the primitive type with the null default.
+const testNullableSchema = `{
+  "type": "record",
+  "name": "n",
+  "namespace": "default.test",
+  "fields": [
+    {"name": "id", "type": {"type": "long", "connect.parameters": {"tidb_type": "BIGINT"}}},
+    {"name": "name", "type": ["null", {"type": "string", "connect.parameters": {"tidb_type": "TEXT"}}], "default": null},
+    {"name": "score", "type": [{"type": "double", "connect.parameters": {"tidb_type": "DOUBLE"}}, "null"]},
+    {"name": "born", "type": ["null", {"type": "string", "connect.parameters": {"tidb_type": "DATE"}}]},
+    {"name": "note", "type": {"type": "string", "connect.parameters": {"tidb_type": "TEXT"}}, "default": null},
+    {"name": "code", "type": {"type": "bytes", "connect.parameters": {"tidb_type": "BLOB"}}},
+    {"name": "_tidb_op", "type": "string", "default": ""},
+    {"name": "_tidb_commit_ts", "type": "long", "default": 0},
+    {"name": "_tidb_row_level_checksum", "type": "string", "default": ""}
+  ]
+}`
+
+func TestAbsentNullColumns(t *testing.T) {
+	t.Parallel()
+
+	var valueSchema map[string]interface{}
+	require.NoError(t, json.Unmarshal([]byte(testNullableSchema), &valueSchema))
+
+	fields, err := avroFields(valueSchema)
+	require.NoError(t, err)
+	nullable := make(map[string]bool, len(fields))
+	for _, field := range fields {
+		nullable[field["name"].(string)] = avroFieldNullable(field)
+	}
+	require.Equal(t, map[string]bool{
+		"id": false, "name": true, "score": true, "born": true, "note": true, "code": false,
+		"_tidb_op": false, "_tidb_commit_ts": false, "_tidb_row_level_checksum": false,
+	}, nullable)
+
+	// the row whose nullable columns are NULL, the checksum of id 1 and code 0x0a.
+	expected, err := checksum.Calculate([]checksum.FieldMeta{
+		{Name: "id", MySQLType: mysql.TypeLonglong}, {Name: "code", MySQLType: mysql.TypeBlob},
+	}, []interface{}{int64(1), []byte{0x0a}})
+	require.NoError(t, err)
+	present := map[string]interface{}{
+		"id": int64(1), "name": nil, "score": nil, "born": nil, "note": nil, "code": []byte{0x0a},
+		"_tidb_op": "c", "_tidb_commit_ts": int64(1), "_tidb_row_level_checksum": strconv.FormatUint(uint64(expected), 10),
+	}
+	absent := map[string]interface{}{
+		"id": int64(1), "code": []byte{0x0a},
+		"_tidb_op": "c", "_tidb_commit_ts": int64(1), "_tidb_row_level_checksum": strconv.FormatUint(uint64(expected), 10),
+	}
+	for _, valueMap := range []map[string]interface{}{present, absent} {
+		metas, values, err := checksumColumns(valueMap, valueSchema)
+		require.NoError(t, err)
+		actual, err := checksum.Calculate(metas, values)
+		require.NoError(t, err)
+		require.Equal(t, expected, actual)
+		require.NoError(t, CalculateAndVerifyChecksum(valueMap, valueSchema))
+	}
+
+	// the column which is not nullable is still required.
+	delete(absent, "code")
+	err = CalculateAndVerifyChecksum(absent, valueSchema)
+	require.EqualError(t, err, "value not found for the column code")
+}
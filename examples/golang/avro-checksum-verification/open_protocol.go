@@ -0,0 +1,304 @@
+// Copyright 2023 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+
+	"avro-checksum-sample/checksum"
+	"github.com/pingcap/log"
+	"github.com/pingcap/tidb/pkg/parser/mysql"
+	"github.com/segmentio/kafka-go"
+	"go.uber.org/zap"
+)
+
+// openProtocolBatchVersion is the version header of the batched key.
+const openProtocolBatchVersion uint64 = 1
+
+const (
+	openProtocolTypeRow      = 1
+	openProtocolTypeDDL      = 2
+	openProtocolTypeResolved = 3
+)
+
+// the column flags used by the verification, by follow the model.ColumnFlagType of TiCDC.
+const (
+	openProtocolFlagBinary   uint64 = 1 << 0
+	openProtocolFlagUnsigned uint64 = 1 << 7
+)
+
+// openProtocolKey is the key of each event in the batch.
+type openProtocolKey struct {
+	Ts            uint64 `json:"ts"`
+	Schema        string `json:"scm,omitempty"`
+	Table         string `json:"tbl,omitempty"`
+	Type          int    `json:"t"`
+	OnlyHandleKey bool   `json:"ohk,omitempty"`
+}
+
+// openProtocolRow is the value of the row event.
+type openProtocolRow struct {
+	Update    openProtocolColumns `json:"u,omitempty"`
+	PreColumn openProtocolColumns `json:"p,omitempty"`
+	Delete    openProtocolColumns `json:"d,omitempty"`
+}
+
+type openProtocolColumn struct {
+	Type  byte        `json:"t"`
+	Flag  uint64      `json:"f"`
+	Value interface{} `json:"v"`
+}
+
+// openProtocolColumns keeps the column order of the message, which is the order of the checksum calculation.
+type openProtocolColumns struct {
+	names   []string
+	columns map[string]openProtocolColumn
+}
+
+func (c *openProtocolColumns) UnmarshalJSON(data []byte) error {
+	c.columns = make(map[string]openProtocolColumn)
+	return decodeOrderedObject(data, func(name string, raw json.RawMessage) error {
+		var column openProtocolColumn
+		decoder := json.NewDecoder(bytes.NewReader(raw))
+		// keep the number as is, the big unsigned integer cannot be represented by float64.
+		decoder.UseNumber()
+		if err := decoder.Decode(&column); err != nil {
+			return err
+		}
+		c.names = append(c.names, name)
+		c.columns[name] = column
+		return nil
+	})
+}
+
+// openProtocolVerifier verifies the message encoded by the open protocol,
+// the column types are carried by the message itself, no schema registry involved.
+// The open protocol of TiCDC does not carry the row level checksum,
+// so the row events are only decoded and validated structurally, then counted as skipped without the checksum.
+type openProtocolVerifier struct {
+	filter *tableFilter
+	window *commitTsWindow
+	ops    opFilter
+}
+
+func (o *openProtocolVerifier) setTableFilter(filter *tableFilter) { o.filter = filter }
+
+// verify verifies all events in the batched kafka message,
+// the message is failed as a whole by any invalid event, and never committed past under the default policy.
+func (o *openProtocolVerifier) verify(message kafka.Message) (messageResult, error) {
+	var result messageResult
+	keys, values, err := splitOpenProtocolBatch(message.Key, message.Value)
+	if err != nil {
+		return result, err
+	}
+
+	for i := range keys {
+		var key openProtocolKey
+		if err := json.Unmarshal(keys[i], &key); err != nil {
+			return result, err
+		}
+		if key.Type == openProtocolTypeRow {
+			outside, err := o.window.outside(&result, key.Ts)
+			if err != nil {
+				return result, fmt.Errorf("event %d in the batch: %w", i, err)
+			}
+			if outside {
+				continue
+			}
+		}
+		outcome, err := o.verifyEvent(&key, values[i], &result)
+		if err != nil {
+			return result, fmt.Errorf("event %d in the batch: %w", i, err)
+		}
+		var commitTs uint64
+		switch key.Type {
+		case openProtocolTypeRow:
+			commitTs = key.Ts
+		case openProtocolTypeResolved:
+			result.resolve(key.Ts)
+		}
+		result.add(outcome, commitTs)
+	}
+	return result, nil
+}
+
+// splitOpenProtocolBatch splits the batched key and value into events,
+// the key starts with the version, followed by the length prefixed events, so does the value without the version.
+func splitOpenProtocolBatch(key, value []byte) ([][]byte, [][]byte, error) {
+	if len(key) < 8 {
+		return nil, nil, errors.New("open protocol key too short")
+	}
+	version := binary.BigEndian.Uint64(key[:8])
+	if version != openProtocolBatchVersion {
+		return nil, nil, fmt.Errorf("unexpected open protocol batch version %d", version)
+	}
+	keys, err := splitLengthPrefixed(key[8:])
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid open protocol key: %w", err)
+	}
+	values, err := splitLengthPrefixed(value)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid open protocol value: %w", err)
+	}
+	if len(keys) == 0 {
+		return nil, nil, errors.New("empty open protocol message")
+	}
+	if len(keys) != len(values) {
+		return nil, nil, fmt.Errorf("open protocol message carries %d keys but %d values", len(keys), len(values))
+	}
+	return keys, values, nil
+}
+
+func splitLengthPrefixed(data []byte) ([][]byte, error) {
+	var result [][]byte
+	for len(data) > 0 {
+		if len(data) < 8 {
+			return nil, errors.New("length truncated")
+		}
+		length := binary.BigEndian.Uint64(data[:8])
+		data = data[8:]
+		if length > uint64(len(data)) {
+			return nil, errors.New("data truncated")
+		}
+		result = append(result, data[:length])
+		data = data[length:]
+	}
+	return result, nil
+}
+
+// verifyEvent verifies the event in the batch, the operation of the row event is recorded into the result.
+func (o *openProtocolVerifier) verifyEvent(key *openProtocolKey, value []byte, result *messageResult) (outcome, error) {
+	switch key.Type {
+	case openProtocolTypeResolved:
+		return outcomeSkippedNonRow, nil
+	case openProtocolTypeDDL:
+		log.Info("DDL event received, skip", zap.ByteString("DDL", value))
+		return outcomeSkippedNonRow, nil
+	case openProtocolTypeRow:
+	default:
+		return 0, fmt.Errorf("unknown open protocol event type %d", key.Type)
+	}
+	// the key carries the table, the value is not decoded if filtered.
+	if o.filter.filtered(key.Schema + "." + key.Table) {
+		return outcomeFiltered, nil
+	}
+
+	var row openProtocolRow
+	if err := json.Unmarshal(value, &row); err != nil {
+		return 0, err
+	}
+	// the operation is carried by the images of the value.
+	op := openProtocolOp(&row)
+	result.addOp(op)
+	if o.ops.filtered(op) {
+		return outcomeFiltered, nil
+	}
+	for _, columns := range []openProtocolColumns{row.Update, row.PreColumn, row.Delete} {
+		if err := validateOpenProtocolColumns(columns); err != nil {
+			return 0, err
+		}
+	}
+	if key.OnlyHandleKey {
+		return outcomeSkippedHandleKeyOnly, nil
+	}
+	return outcomeSkippedNoChecksum, nil
+}
+
+// validateOpenProtocolColumns checks each column value can be converted by its type,
+// and the type is one of those handled by the checksum calculation.
+func validateOpenProtocolColumns(columns openProtocolColumns) error {
+	for _, name := range columns.names {
+		column := columns.columns[name]
+		if _, err := openProtocolColumnValue(column); err != nil {
+			return fmt.Errorf("invalid value of the column %s: %w", name, err)
+		}
+		if !checksum.Supported(column.Type) {
+			return fmt.Errorf("unsupported type %d of the column %s", column.Type, name)
+		}
+	}
+	return nil
+}
+
+// openProtocolColumnValue converts the value in the message to the value accepted by the checksum calculation,
+// the column type is the mysql type code already, by follow the open protocol decoder of TiCDC.
+func openProtocolColumnValue(column openProtocolColumn) (interface{}, error) {
+	if column.Value == nil {
+		return nil, nil
+	}
+
+	switch column.Type {
+	case mysql.TypeString, mysql.TypeVarString, mysql.TypeVarchar:
+		data, ok := column.Value.(string)
+		if !ok {
+			return nil, errors.New("string value expected")
+		}
+		// the binary string is quoted when encoding, now reverse it back.
+		if column.Flag&openProtocolFlagBinary != 0 {
+			unquoted, err := strconv.Unquote("\"" + data + "\"")
+			if err != nil {
+				return nil, err
+			}
+			return []byte(unquoted), nil
+		}
+		return data, nil
+	case mysql.TypeTinyBlob, mysql.TypeMediumBlob, mysql.TypeLongBlob, mysql.TypeBlob:
+		data, ok := column.Value.(string)
+		if !ok {
+			return nil, errors.New("base64 encoded value expected")
+		}
+		return base64.StdEncoding.DecodeString(data)
+	}
+
+	number, isNumber := column.Value.(json.Number)
+	switch column.Type {
+	case mysql.TypeTiny, mysql.TypeShort, mysql.TypeLong, mysql.TypeInt24, mysql.TypeLonglong, mysql.TypeYear:
+		if !isNumber {
+			return nil, errors.New("integral value expected")
+		}
+		if column.Flag&openProtocolFlagUnsigned != 0 {
+			return strconv.ParseUint(number.String(), 10, 64)
+		}
+		return strconv.ParseInt(number.String(), 10, 64)
+	// enum and set are encoded as the ordinal number, bit is encoded as the number.
+	case mysql.TypeEnum, mysql.TypeSet, mysql.TypeBit:
+		if !isNumber {
+			return nil, errors.New("integral value expected")
+		}
+		return strconv.ParseUint(number.String(), 10, 64)
+	case mysql.TypeFloat:
+		if !isNumber {
+			return nil, errors.New("float value expected")
+		}
+		v, err := strconv.ParseFloat(number.String(), 32)
+		if err != nil {
+			return nil, err
+		}
+		return float32(v), nil
+	case mysql.TypeDouble:
+		if !isNumber {
+			return nil, errors.New("float value expected")
+		}
+		return number.Float64()
+	}
+	if data, ok := column.Value.(string); ok {
+		return data, nil
+	}
+	return nil, fmt.Errorf("unexpected value %v for the type %d", column.Value, column.Type)
+}
@@ -0,0 +1,155 @@
+// Copyright 2023 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"testing"
+
+	"github.com/segmentio/kafka-go"
+	"github.com/stretchr/testify/require"
+)
+
+// newTestOpenProtocolMessage batches the events in the open protocol, each event is a pair of key and value.
+func newTestOpenProtocolMessage(offset int64, events ...string) kafka.Message {
+	key := binary.BigEndian.AppendUint64(nil, openProtocolBatchVersion)
+	var value []byte
+	for i := 0; i < len(events); i += 2 {
+		key = binary.BigEndian.AppendUint64(key, uint64(len(events[i])))
+		key = append(key, events[i]...)
+		value = binary.BigEndian.AppendUint64(value, uint64(len(events[i+1])))
+		value = append(value, events[i+1]...)
+	}
+	return kafka.Message{Offset: offset, Key: key, Value: value}
+}
+
+// newTestOpenProtocolColumns returns the columns of the table `test`.`o` (id INT, name VARBINARY(32), data BLOB),
+// the binary string is quoted and the blob is base64 encoded.
+func newTestOpenProtocolColumns(name string) string {
+	return fmt.Sprintf(`{"id":{"t":3,"h":true,"f":11,"v":1},"name":{"t":15,"f":65,"v":"%s"},`+
+		`"data":{"t":252,"f":65,"v":"6QE="}}`, name)
+}
+
+func TestOpenProtocolVerify(t *testing.T) {
+	t.Parallel()
+
+	rowKey := `{"ts":100,"scm":"test","tbl":"o","t":1}`
+	resolvedKey := `{"ts":110,"t":3}`
+
+	cases := []struct {
+		name    string
+		events  []string
+		outcome outcome
+		err     string
+	}{
+		{
+			name:    "insert",
+			events:  []string{rowKey, fmt.Sprintf(`{"u":%s}`, newTestOpenProtocolColumns(`b\\x00`))},
+			outcome: outcomeSkippedNoChecksum,
+		},
+		{
+			name: "update",
+			events: []string{rowKey, fmt.Sprintf(`{"u":%s,"p":%s}`,
+				newTestOpenProtocolColumns(`b\\x00`), newTestOpenProtocolColumns("a"))},
+			outcome: outcomeSkippedNoChecksum,
+		},
+		{
+			name:    "delete",
+			events:  []string{rowKey, fmt.Sprintf(`{"d":%s}`, newTestOpenProtocolColumns("a"))},
+			outcome: outcomeSkippedNoChecksum,
+		},
+		{
+			name:   "invalid value of the previous image",
+			events: []string{rowKey, fmt.Sprintf(`{"u":%s,"p":{"id":{"t":3,"f":11,"v":"x"}}}`, newTestOpenProtocolColumns("a"))},
+			err:    "invalid value of the column id",
+		},
+		{
+			name:   "unsupported type",
+			events: []string{rowKey, `{"u":{"id":{"t":3,"f":11,"v":1},"v":{"t":100,"f":0,"v":"x"}}}`},
+			err:    "unsupported type 100 of the column v",
+		},
+		{
+			name:    "only handle key",
+			events:  []string{`{"ts":100,"scm":"test","tbl":"o","t":1,"ohk":true}`, `{"u":{"id":{"t":3,"h":true,"f":11,"v":1}}}`},
+			outcome: outcomeSkippedHandleKeyOnly,
+		},
+		{
+			name:    "resolved",
+			events:  []string{resolvedKey, ""},
+			outcome: outcomeSkippedNonRow,
+		},
+		{
+			name:    "DDL",
+			events:  []string{`{"ts":100,"scm":"test","tbl":"o","t":2}`, `{"q":"create table o(id int primary key)","t":3}`},
+			outcome: outcomeSkippedNonRow,
+		},
+		{
+			name: "batched events with the resolved",
+			events: []string{
+				resolvedKey, "",
+				rowKey, fmt.Sprintf(`{"u":%s}`, newTestOpenProtocolColumns(`b\\x00`)),
+			},
+			outcome: outcomeSkippedNonRow,
+		},
+		{
+			name: "invalid event in the batched events",
+			events: []string{
+				rowKey, fmt.Sprintf(`{"u":%s}`, newTestOpenProtocolColumns(`b\\x00`)),
+				rowKey, `{"u":{"id":{"t":3,"f":11,"v":"x"}}}`,
+			},
+			err: "event 1 in the batch",
+		},
+	}
+
+	v := &openProtocolVerifier{}
+	for _, c := range cases {
+		result, err := v.verify(newTestOpenProtocolMessage(0, c.events...))
+		if c.err != "" {
+			require.ErrorContains(t, err, c.err, c.name)
+			continue
+		}
+		require.NoError(t, err, c.name)
+		require.Equal(t, c.outcome, result.outcome, c.name)
+	}
+
+	// the value does not match the key.
+	message := newTestOpenProtocolMessage(0, rowKey, "{}")
+	message.Value = nil
+	_, err := v.verify(message)
+	require.Error(t, err)
+	require.Equal(t, exitCodeDecodeError, exitCodeOf(newDecodeError(err)))
+}
+
+func TestOpenProtocolInvalidEventInBatchNotCommitted(t *testing.T) {
+	t.Parallel()
+
+	rowKey := `{"ts":100,"scm":"test","tbl":"o","t":1}`
+	valid := fmt.Sprintf(`{"u":%s}`, newTestOpenProtocolColumns(`b\\x00`))
+	invalid := `{"u":{"id":{"t":3,"f":11,"v":"x"}}}`
+
+	cfg := newDefaultConfig()
+	cfg.protocol = protocolOpen
+	reader := &fakeReader{messages: []kafka.Message{
+		newTestOpenProtocolMessage(0, rowKey, valid),
+		newTestOpenProtocolMessage(1, rowKey, valid, rowKey, invalid, rowKey, valid),
+		newTestOpenProtocolMessage(2, rowKey, valid),
+	}}
+	v := newTestVerifier(cfg, reader)
+	err := v.run(context.Background())
+	require.Equal(t, exitCodeDecodeError, v.finish(err))
+	require.Equal(t, []int64{0}, reader.committedOffsets())
+	require.Equal(t, counters{Messages: 2, SkippedNoChecksum: 1, DecodeErrors: 1}, v.counters)
+}
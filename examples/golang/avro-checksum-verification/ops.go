@@ -0,0 +1,135 @@
+// Copyright 2023 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// rowOp is the operation of the row event, carried by the `_tidb_op` column of the avro protocol,
+// or by the envelope of the other protocols. It's empty if unknown.
+type rowOp string
+
+const (
+	opInsert rowOp = "insert"
+	opUpdate rowOp = "update"
+	opDelete rowOp = "delete"
+)
+
+// opFilter is the set of the operations to verify, a nil filter verifies all operations.
+type opFilter map[rowOp]struct{}
+
+// parseOps parses the comma-separated operations, it returns nil if empty.
+func parseOps(s string) (opFilter, error) {
+	if strings.TrimSpace(s) == "" {
+		return nil, nil
+	}
+	result := make(opFilter)
+	for _, item := range strings.Split(s, ",") {
+		op := rowOp(strings.ToLower(strings.TrimSpace(item)))
+		switch op {
+		case opInsert, opUpdate, opDelete:
+			result[op] = struct{}{}
+		case "":
+		default:
+			return nil, fmt.Errorf("unknown operation %q, should be `insert`, `update` or `delete`", item)
+		}
+	}
+	return result, nil
+}
+
+// filtered returns true if the event of the operation should not be verified,
+// the event of the unknown operation is never filtered.
+func (f opFilter) filtered(op rowOp) bool {
+	if f == nil || op == "" {
+		return false
+	}
+	_, ok := f[op]
+	return !ok
+}
+
+// parseAvroOp returns the operation of the `_tidb_op` column, it's empty if the column is absent,
+// since the TiDB extension is not enabled by the changefeed.
+// The delete event is sent as the tombstone without the value, or carries the `d` marker,
+// so the value without the operation, or of an unknown one, is inconsistent.
+func parseAvroOp(valueMap map[string]interface{}) (rowOp, error) {
+	code, ok := valueMap["_tidb_op"]
+	if !ok {
+		return "", nil
+	}
+	switch code {
+	case "c":
+		return opInsert, nil
+	case "u":
+		return opUpdate, nil
+	case "d":
+		return opDelete, nil
+	case "":
+		return "", fmt.Errorf("%w: the value carries no operation, the delete event should be sent as the tombstone",
+			errOpInconsistent)
+	}
+	return "", fmt.Errorf("%w: unknown operation code %v", errOpInconsistent, code)
+}
+
+// canalJSONOp returns the operation of the canal-json event type, empty for the non-row events.
+func canalJSONOp(eventType string) rowOp {
+	switch eventType {
+	case canalJSONTypeInsert:
+		return opInsert
+	case canalJSONTypeUpdate:
+		return opUpdate
+	case canalJSONTypeDelete:
+		return opDelete
+	}
+	return ""
+}
+
+// openProtocolOp returns the operation by the images of the row, the update event is the same as the insert one
+// if the old value is not enabled by the changefeed.
+func openProtocolOp(row *openProtocolRow) rowOp {
+	if len(row.Delete.names) != 0 {
+		return opDelete
+	}
+	if len(row.PreColumn.names) != 0 {
+		return opUpdate
+	}
+	return opInsert
+}
+
+// simpleOp returns the operation of the simple event type, empty for the non-row events.
+func simpleOp(eventType string) rowOp {
+	switch eventType {
+	case simpleTypeInsert:
+		return opInsert
+	case simpleTypeUpdate:
+		return opUpdate
+	case simpleTypeDelete:
+		return opDelete
+	}
+	return ""
+}
+
+// debeziumOp returns the operation of the debezium event, the snapshot read is an insert.
+func debeziumOp(op string) rowOp {
+	switch op {
+	case debeziumOpCreate, debeziumOpRead:
+		return opInsert
+	case debeziumOpUpdate:
+		return opUpdate
+	case debeziumOpDelete:
+		return opDelete
+	}
+	return ""
+}
@@ -0,0 +1,191 @@
+// Copyright 2023 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/segmentio/kafka-go"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseOps(t *testing.T) {
+	t.Parallel()
+
+	ops, err := parseOps("")
+	require.NoError(t, err)
+	require.Nil(t, ops)
+	require.False(t, ops.filtered(opDelete))
+
+	ops, err = parseOps(" Insert, delete,")
+	require.NoError(t, err)
+	require.Equal(t, opFilter{opInsert: {}, opDelete: {}}, ops)
+	require.False(t, ops.filtered(opInsert))
+	require.True(t, ops.filtered(opUpdate))
+	// the unknown operation is never filtered.
+	require.False(t, ops.filtered(""))
+
+	_, err = parseOps("insert,replace")
+	require.ErrorContains(t, err, `unknown operation "replace"`)
+	cfg := newDefaultConfig()
+	cfg.ops = "upsert"
+	require.ErrorContains(t, cfg.validate(), `unknown operation "upsert"`)
+}
+
+func TestAvroOpsFilter(t *testing.T) {
+	t.Parallel()
+
+	registry := newTestRegistry(t, map[int]string{testSchemaID: testValueSchema})
+	cfg := newDefaultConfig()
+	cfg.schemaRegistryURL = registry.URL
+	cfg.ops = "delete"
+	require.NoError(t, cfg.validate())
+
+	reader := &fakeReader{messages: []kafka.Message{
+		newVerifiedTestMessage(t, 0, 1, "a"),
+		// the mismatch of the filtered operation is not found.
+		newMismatchTestMessage(t, 1, 2, "b"),
+		{Topic: "test", Offset: 2},
+	}}
+	v := newTestVerifier(cfg, reader)
+	err := v.run(context.Background())
+	require.Equal(t, exitCodeClean, v.finish(err))
+	require.Equal(t, counters{Messages: 3, SkippedDelete: 1, Filtered: 2}, v.counters)
+	require.Equal(t, []int64{0, 1, 2}, reader.committedOffsets())
+	require.Equal(t, map[rowOp]uint64{opInsert: 2, opDelete: 1}, v.report.Operations)
+
+	// the operations are reported without the filter.
+	cfg.ops = ""
+	reader = &fakeReader{messages: []kafka.Message{newVerifiedTestMessage(t, 0, 1, "a"), {Topic: "test", Offset: 1}}}
+	v = newTestVerifier(cfg, reader)
+	err = v.run(context.Background())
+	require.Equal(t, exitCodeClean, v.finish(err))
+	require.Equal(t, counters{Messages: 2, Verified: 1, SkippedDelete: 1}, v.counters)
+	require.Equal(t, map[rowOp]uint64{opInsert: 1, opDelete: 1}, v.report.Operations)
+}
+
+func TestParseAvroOp(t *testing.T) {
+	t.Parallel()
+
+	for code, expected := range map[interface{}]rowOp{"c": opInsert, "u": opUpdate, "d": opDelete} {
+		op, err := parseAvroOp(map[string]interface{}{"_tidb_op": code})
+		require.NoError(t, err)
+		require.Equal(t, expected, op)
+	}
+	// the TiDB extension is not enabled.
+	op, err := parseAvroOp(map[string]interface{}{"id": int64(1)})
+	require.NoError(t, err)
+	require.Empty(t, op)
+
+	_, err = parseAvroOp(map[string]interface{}{"_tidb_op": ""})
+	require.ErrorIs(t, err, errOpInconsistent)
+	require.ErrorContains(t, err, "should be sent as the tombstone")
+	_, err = parseAvroOp(map[string]interface{}{"_tidb_op": "r"})
+	require.ErrorIs(t, err, errOpInconsistent)
+	require.ErrorContains(t, err, "unknown operation code r")
+}
+
+func TestAvroOpInconsistent(t *testing.T) {
+	t.Parallel()
+
+	registry := newTestRegistry(t, map[int]string{testSchemaID: testValueSchema})
+	cfg := newDefaultConfig()
+	cfg.schemaRegistryURL = registry.URL
+	message := func(offset int64, code string) kafka.Message {
+		name := "a"
+		checksum := fmt.Sprint(testRowChecksum(1, &name))
+		row := newTestRow(1, &name, 400000000000000000+offset, checksum)
+		row["_tidb_op"] = code
+		return kafka.Message{Topic: "test", Offset: offset, Value: encodeTestMessage(t, testSchemaID, testValueSchema, row)}
+	}
+	reader := &fakeReader{messages: []kafka.Message{
+		message(0, "u"),
+		// the delete marker is accepted.
+		message(1, "d"),
+		message(2, ""),
+		message(3, "x"),
+		newVerifiedTestMessage(t, 4, 1, "a"),
+	}}
+	v := newTestVerifier(cfg, reader)
+	err := v.run(context.Background())
+	require.Equal(t, exitCodeOpInconsistent, v.finish(err))
+	// the rows are verified besides the inconsistency.
+	require.Equal(t, counters{Messages: 5, Verified: 5, OpInconsistencies: 2}, v.counters)
+	require.Equal(t, map[rowOp]uint64{opInsert: 1, opUpdate: 1, opDelete: 1}, v.report.Operations)
+	require.Len(t, v.report.Failures, 2)
+	require.Equal(t, failureKindOp, v.report.Failures[0].Kind)
+	require.Equal(t, int64(2), v.report.Failures[0].Offset)
+	require.Contains(t, v.report.Failures[1].Error, "unknown operation code x")
+	require.Equal(t, []int64{0, 1, 2, 3, 4}, reader.committedOffsets())
+
+	// the inconsistency stops the verification if fail fast.
+	cfg.failFast = true
+	reader = &fakeReader{messages: []kafka.Message{message(0, "x"), newVerifiedTestMessage(t, 1, 1, "a")}}
+	v = newTestVerifier(cfg, reader)
+	err = v.run(context.Background())
+	require.Equal(t, exitCodeOpInconsistent, v.finish(err))
+	require.Empty(t, reader.committedOffsets())
+}
+
+func TestCanalJSONOpsFilter(t *testing.T) {
+	t.Parallel()
+
+	current := testCanalJSONChecksum(1, "b", []byte{0xe9, 0x01})
+	previous := testCanalJSONChecksum(1, "a", []byte{0xe9, 0x01})
+	cfg := newDefaultConfig()
+	cfg.protocol = protocolCanalJSON
+	cfg.ops = "update"
+	require.NoError(t, cfg.validate())
+
+	reader := &fakeReader{messages: []kafka.Message{
+		{Topic: "test", Offset: 0, Value: []byte(newTestCanalJSONMessage("INSERT",
+			`[{"id":"1","name":"b","data":"é\u0001"}]`, `null`,
+			fmt.Sprintf(`{"commitTs":100,"_checksum":{"current":%d}}`, current+1)))},
+		{Topic: "test", Offset: 1, Value: []byte(newTestCanalJSONMessage("UPDATE",
+			`[{"id":"1","name":"b","data":"é\u0001"}]`, `[{"name":"a"}]`,
+			fmt.Sprintf(`{"commitTs":101,"_checksum":{"current":%d,"previous":%d}}`, current, previous)))},
+		{Topic: "test", Offset: 2, Value: []byte(newTestCanalJSONWatermark(102))},
+	}}
+	v := newTestVerifier(cfg, reader)
+	err := v.run(context.Background())
+	require.Equal(t, exitCodeClean, v.finish(err))
+	require.Equal(t, counters{Messages: 3, Verified: 1, SkippedNonRow: 1, Filtered: 1}, v.counters)
+	require.Equal(t, map[rowOp]uint64{opInsert: 1, opUpdate: 1}, v.report.Operations)
+	// the filtered operation is not in the per table counters.
+	require.Equal(t, &counters{Messages: 1, Verified: 1}, v.report.Tables["test.c"])
+}
+
+func TestOpenProtocolOpsFilter(t *testing.T) {
+	t.Parallel()
+
+	rowKey := `{"ts":100,"scm":"test","tbl":"o","t":1}`
+	cfg := newDefaultConfig()
+	cfg.protocol = protocolOpen
+	cfg.ops = "insert"
+	v, err := newMessageVerifier(cfg)
+	require.NoError(t, err)
+
+	// the operation is taken from the images of the value, the update carrying an invalid value is filtered.
+	result, err := v.verify(newTestOpenProtocolMessage(0,
+		rowKey, fmt.Sprintf(`{"u":%s}`, newTestOpenProtocolColumns(`b\\x00`)),
+		rowKey, fmt.Sprintf(`{"u":%s,"p":{"id":{"t":3,"f":11,"v":"x"}}}`, newTestOpenProtocolColumns(`b\\x00`)),
+		rowKey, fmt.Sprintf(`{"d":%s}`, newTestOpenProtocolColumns("a")),
+	))
+	require.NoError(t, err)
+	require.Equal(t, outcomeSkippedNoChecksum, result.outcome)
+	require.Equal(t, 3, result.events)
+	require.Equal(t, map[rowOp]int{opInsert: 1, opUpdate: 1, opDelete: 1}, result.ops)
+}
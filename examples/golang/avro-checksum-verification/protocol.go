@@ -0,0 +1,836 @@
+// Copyright 2023 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+
+	"github.com/linkedin/goavro/v2"
+	"github.com/pingcap/log"
+	"github.com/segmentio/kafka-go"
+	"go.uber.org/zap"
+)
+
+const (
+	protocolAvro      = "avro"
+	protocolCanalJSON = "canal-json"
+	protocolOpen      = "open"
+	protocolSimple    = "simple"
+	protocolDebezium  = "debezium"
+)
+
+// outcome is the result of a message which is verified or skipped on purpose.
+type outcome int
+
+const (
+	outcomeVerified outcome = iota
+	// outcomeSkippedDelete means the delete event does not carry the row to be verified.
+	outcomeSkippedDelete
+	// outcomeSkippedNoChecksum means the checksum is not enabled by the changefeed.
+	outcomeSkippedNoChecksum
+	// outcomeSkippedHandleKeyOnly means only the handle key columns are sent, such as the large message.
+	outcomeSkippedHandleKeyOnly
+	// outcomeSkippedNonRow means the message is not a row event, such as DDL and watermark.
+	outcomeSkippedNonRow
+	// outcomeDeferred means the verification of the row is deferred, such as awaiting the table schema.
+	outcomeDeferred
+	// outcomeFiltered means the message is filtered out by the include and exclude table patterns,
+	// the key filter or the operations.
+	outcomeFiltered
+	// outcomeOutOfRange means the commit ts is outside the window to verify.
+	outcomeOutOfRange
+	// outcomeUnsampled means the message is not sampled, only committed without verification.
+	outcomeUnsampled
+	// outcomeSkippedLegacyFormat means the message carries none of the TiDB extension fields,
+	// such as of the older TiCDC avro format, which never carries the checksum.
+	outcomeSkippedLegacyFormat
+	// outcomeNotComputable means some columns cannot be handled, so the checksum is not computable, by the salvage mode,
+	// or the checksum mismatches without the columns skipped by the skip-column policy.
+	outcomeNotComputable
+	// outcomeVerifiedWithCaveats means the checksum matches without the columns skipped by the skip-column policy.
+	outcomeVerifiedWithCaveats
+)
+
+// String returns the name of the outcome, the same as its counter.
+func (o outcome) String() string {
+	switch o {
+	case outcomeVerified:
+		return "verified"
+	case outcomeSkippedDelete:
+		return "skippedDelete"
+	case outcomeSkippedNoChecksum:
+		return "skippedNoChecksum"
+	case outcomeSkippedHandleKeyOnly:
+		return "skippedHandleKeyOnly"
+	case outcomeSkippedNonRow:
+		return "skippedNonRow"
+	case outcomeDeferred:
+		return "deferred"
+	case outcomeFiltered:
+		return "filtered"
+	case outcomeOutOfRange:
+		return "outOfRange"
+	case outcomeUnsampled:
+		return "unsampled"
+	case outcomeSkippedLegacyFormat:
+		return "skippedLegacyFormat"
+	case outcomeNotComputable:
+		return "notComputable"
+	case outcomeVerifiedWithCaveats:
+		return "verifiedWithCaveats"
+	}
+	return "unknown"
+}
+
+// messageResult is the verification result of a message.
+type messageResult struct {
+	outcome outcome
+	// commitTs is 0 if the message does not carry it.
+	commitTs uint64
+	// resolvedTs is the watermark carried by the message, 0 if it's not a watermark.
+	resolvedTs uint64
+	// sourceTs is the unix milliseconds the change was made in the upstream, 0 if the message does not carry it.
+	sourceTs int64
+	// events is the number of events in the message, a message may carry multiple events if batched.
+	events int
+	// table is the `schema.table` the message belongs to, empty if unknown, used by the per-table report.
+	table string
+	// ops are the number of row events of each operation, including the filtered ones.
+	ops map[rowOp]int
+	// rows are the verified rows in the message, only collected if they are cross-checked against the database.
+	rows []*rowEvent
+	// mismatch is the row whose checksum mismatches, only collected if it's compared against the upstream.
+	mismatch *rowEvent
+	// upstream is the comparison of the mismatched row against the upstream snapshot, if any.
+	upstream *upstreamComparison
+	// decoded is the decoded row of the message, only collected if it's exported.
+	decoded *rowEvent
+	// bisect is the cause of the mismatch found by the bisection, if any.
+	bisect *bisectResult
+	// schemaDrift is the change of the schema ID of the table found by the message, if any.
+	schemaDrift *schemaDrift
+	// checksum is the checksum carried by the event, 0 if not found, only for the avro protocol.
+	checksum uint64
+	// columnErrors are the columns failed of the row not computable, only by the salvage mode.
+	columnErrors []columnError
+	// key is the human-readable key of the message, see keyText, not rendered for the filtered or unsampled one.
+	key string
+}
+
+// add merges the result of an event into the message, the message is verified if any event in it is verified,
+// with caveats if any of them is, otherwise it's skipped by the reason of the first one.
+func (r *messageResult) add(o outcome, commitTs uint64) {
+	if r.events == 0 || o == outcomeVerifiedWithCaveats || (o == outcomeVerified && r.outcome != outcomeVerifiedWithCaveats) {
+		r.outcome = o
+	}
+	if commitTs > r.commitTs {
+		r.commitTs = commitTs
+	}
+	r.events++
+}
+
+// resolve records the watermark carried by the message.
+func (r *messageResult) resolve(ts uint64) {
+	if ts > r.resolvedTs {
+		r.resolvedTs = ts
+	}
+}
+
+// addOp records the operation of a row event, the unknown operation is not recorded.
+func (r *messageResult) addOp(op rowOp) {
+	if op == "" {
+		return
+	}
+	if r.ops == nil {
+		r.ops = make(map[rowOp]int)
+	}
+	r.ops[op]++
+}
+
+// rowChecksum is the row level checksum calculated by TiCDC, carried by the JSON based protocols.
+type rowChecksum struct {
+	Version   int    `json:"version"`
+	Corrupted bool   `json:"corrupted"`
+	Current   uint64 `json:"current"`
+	Previous  uint64 `json:"previous"`
+}
+
+// decodeOrderedObject decodes the JSON object, and calls fn for each member in the order of the data,
+// which is lost if decoded into a map.
+func decodeOrderedObject(data []byte, fn func(name string, raw json.RawMessage) error) error {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	token, err := decoder.Token()
+	if err != nil {
+		return err
+	}
+	if token != json.Delim('{') {
+		return errors.New("JSON object expected")
+	}
+	for decoder.More() {
+		token, err = decoder.Token()
+		if err != nil {
+			return err
+		}
+		// the object member name is always a string.
+		name := token.(string)
+		var raw json.RawMessage
+		if err := decoder.Decode(&raw); err != nil {
+			return err
+		}
+		if err := fn(name, raw); err != nil {
+			return err
+		}
+	}
+	_, err = decoder.Token()
+	return err
+}
+
+// messageVerifier decodes the message encoded by the specific protocol, and verifies the row checksum.
+// It returns errChecksumMismatch if the checksum does not match,
+// the kafka plumbing, failure policy and reporting are shared by all protocols.
+type messageVerifier interface {
+	verify(message kafka.Message) (messageResult, error)
+}
+
+// deferringVerifier is implemented by the message verifier which may defer the verification of rows,
+// messages are not committed while any row is pending, so that they are verified again after restart.
+type deferringVerifier interface {
+	pendingRows() int
+}
+
+// filteringVerifier is implemented by the message verifier filtering the tables by the patterns,
+// the filter is replaced between the messages by the control API of the serve mode.
+type filteringVerifier interface {
+	setTableFilter(filter *tableFilter)
+}
+
+// notingVerifier is implemented by the message verifier whose protocol is not verified by the checksum in general,
+// the note is reported so that the skipped rows are not over-trusted.
+type notingVerifier interface {
+	checksumNote() string
+}
+
+func newMessageVerifier(cfg *config) (messageVerifier, error) {
+	filter, err := newTableFilter(cfg.includeTables, cfg.excludeTables)
+	if err != nil {
+		return nil, err
+	}
+	window, err := cfg.commitTsWindow()
+	if err != nil {
+		return nil, err
+	}
+	columns, err := parseExpectedColumns(cfg.expectedColumns)
+	if err != nil {
+		return nil, err
+	}
+	keys, err := newKeyFilter(cfg.keyFilters, cfg.keyFiltersHex)
+	if err != nil {
+		return nil, err
+	}
+	ops, err := parseOps(cfg.ops)
+	if err != nil {
+		return nil, err
+	}
+	switch cfg.protocol {
+	case protocolAvro:
+		var bisector *bisector
+		if cfg.bisect {
+			if bisector, err = newBisector(cfg.bisectTimeZones); err != nil {
+				return nil, err
+			}
+		}
+		return &avroVerifier{
+			schemaRegistryURL: cfg.schemaRegistryURL, schemaDir: cfg.schemaDir, codecs: make(map[int]*goavro.Codec),
+			filter: filter, window: window, columns: columns, refresher: newSchemaRefresher(cfg.schemaRefreshInterval),
+			keys: keys, ops: ops, sampler: newSampler(cfg), tables: newSchemaTableMap(),
+			valueSchemas: make(map[int]map[string]interface{}), keySchemas: make(map[int]*avroKeySchema),
+			collectRows: cfg.downstreamDSN != "" || cfg.upstreamDSN != "",
+			drift:       newSchemaDriftTracker(), freezeSchema: cfg.freezeSchema,
+			legacyTables: make(map[string]struct{}), schemaColumns: make(map[int][]avroColumn),
+			bisector: bisector, exportRows: cfg.export != "", salvage: cfg.salvage,
+			unknown: newUnknownTypeTracker(cfg.onUnknownType), unknownColumns: make(map[int][]columnError),
+			checkSchema: !cfg.skipSchemaCheck,
+		}, nil
+	case protocolCanalJSON:
+		return &canalJSONVerifier{
+			collectRows: cfg.downstreamDSN != "" || cfg.upstreamDSN != "", filter: filter, window: window,
+			columns: columns, ops: ops,
+		}, nil
+	case protocolOpen:
+		return &openProtocolVerifier{filter: filter, window: window, ops: ops}, nil
+	case protocolSimple:
+		v, err := newSimpleVerifier(cfg.simpleEncoding, cfg.simpleSchemaCacheSize)
+		if err != nil {
+			return nil, err
+		}
+		v.filter, v.window, v.ops = filter, window, ops
+		return v, nil
+	case protocolDebezium:
+		v := newDebeziumVerifier(debeziumOrderingKeys)
+		v.filter, v.window, v.ops = filter, window, ops
+		return v, nil
+	}
+	return nil, errors.New("unknown protocol: " + cfg.protocol)
+}
+
+// avroVerifier verifies the message encoded by the avro protocol,
+// the schema is fetched from the schema registry, or read from the schema dir.
+type avroVerifier struct {
+	schemaRegistryURL string
+	// schemaDir is the directory of the local schema files, the schema registry is not involved if set.
+	schemaDir string
+	// codecs caches the value schema of each schema ID, refresher fetches it again once it fails to decode the value.
+	codecs    map[int]*goavro.Codec
+	refresher *schemaRefresher
+	filter    *tableFilter
+	window    *commitTsWindow
+	// columns asserts the columns carried by the value schema, nil if not set.
+	columns expectedColumns
+	// keys verifies only the events matching the conditions, nil if not set.
+	keys    *keyFilter
+	ops     opFilter
+	sampler *sampler
+	// tables maps each schema ID to the table, to filter and sample the message without decoding the value.
+	tables *schemaTableMap
+	// valueSchemas caches the value schema of each schema ID, to read the commit ts of the unsampled message.
+	valueSchemas map[int]map[string]interface{}
+	// schemaColumns caches the parsed columns of each value schema ID, along with the detected handling mode,
+	// unknownColumns caches the columns of the unknown TiDB types skipped.
+	schemaColumns  map[int][]avroColumn
+	unknownColumns map[int][]columnError
+	// keySchemas caches the key schema of each schema ID, the key is decoded for every message by the key filter.
+	keySchemas map[int]*avroKeySchema
+	// legacyTables are the tables whose messages carry none of the TiDB extension fields, which is warned once.
+	legacyTables map[string]struct{}
+	// drift tracks the schema ID of each table, freezeSchema fails the message if it changes.
+	drift        *schemaDriftTracker
+	freezeSchema bool
+	// collectRows collects the verified rows into the result, to cross-check them against the database.
+	collectRows bool
+	// exportRows decodes the row of every message into the result, to export it.
+	exportRows bool
+	// bisector finds the cause of the mismatch, nil if disabled.
+	bisector *bisector
+	// salvage reports the row whose columns cannot be handled as not computable.
+	salvage bool
+	// unknown handles the columns of the unknown TiDB types by the policy, and records them.
+	unknown *unknownTypeTracker
+	// checkSchema checks the avro types of the value schema against the tidb_type once the schema ID is first used.
+	checkSchema bool
+}
+
+func (a *avroVerifier) setTableFilter(filter *tableFilter) { a.filter = filter }
+
+// getSchema returns the schema of the ID, from the schema dir if set, otherwise from the schema registry,
+// the schema is only fetched on the first time.
+func (a *avroVerifier) getSchema(schemaID int) (*goavro.Codec, error) {
+	if codec, ok := a.codecs[schemaID]; ok {
+		return codec, nil
+	}
+	var (
+		codec *goavro.Codec
+		err   error
+	)
+	if a.schemaDir == "" {
+		codec, err = GetSchema(a.schemaRegistryURL, schemaID)
+	} else {
+		codec, err = loadLocalSchema(a.schemaDir, schemaID)
+	}
+	if err != nil {
+		return nil, err
+	}
+	a.codecs[schemaID] = codec
+	return codec, nil
+}
+
+// tableOf returns the table of the message by the schema ID, the schema is only fetched on the first time.
+func (a *avroVerifier) tableOf(value []byte) (*schemaTable, error) {
+	schemaID, _, err := extractSchemaIDAndBinaryData(value)
+	if err != nil {
+		return nil, err
+	}
+	if table, ok := a.tables.get(schemaID); ok {
+		return table, nil
+	}
+	codec, err := a.getSchema(schemaID)
+	if err != nil {
+		return nil, newInfraError(err)
+	}
+	schema := make(map[string]interface{})
+	if err := json.Unmarshal([]byte(codec.Schema()), &schema); err != nil {
+		return nil, err
+	}
+	// the value schema is cached as well, to read the commit ts of the unsampled message.
+	a.valueSchemas[schemaID] = schema
+	return a.tables.add(schemaID, schema), nil
+}
+
+func (a *avroVerifier) schemaTables() []schemaTable { return a.tables.snapshot() }
+
+// commitTsOf reads the commit ts of the value without decoding the columns.
+func (a *avroVerifier) commitTsOf(value []byte) (uint64, error) {
+	schemaID, data, err := extractSchemaIDAndBinaryData(value)
+	if err != nil {
+		return 0, err
+	}
+	schema, ok := a.valueSchemas[schemaID]
+	if !ok {
+		codec, err := a.getSchema(schemaID)
+		if err != nil {
+			return 0, newInfraError(err)
+		}
+		schema = make(map[string]interface{})
+		if err := json.Unmarshal([]byte(codec.Schema()), &schema); err != nil {
+			return 0, err
+		}
+		a.valueSchemas[schemaID] = schema
+	}
+	return avroCommitTs(schema, data)
+}
+
+// columnsOf returns the parsed columns of the value schema, the schema is only parsed on the first time,
+// so that the column encoded in the way the verifier cannot handle fails once the schema is loaded.
+// The columns of the unknown TiDB types are returned as well, they fail the parse by the fail policy,
+// otherwise they are skipped.
+func (a *avroVerifier) columnsOf(value []byte, valueSchema map[string]interface{}) ([]avroColumn, []columnError, error) {
+	schemaID, _, err := extractSchemaIDAndBinaryData(value)
+	if err != nil {
+		return nil, nil, err
+	}
+	if columns, ok := a.schemaColumns[schemaID]; ok {
+		return columns, a.unknownColumns[schemaID], nil
+	}
+	if a.checkSchema {
+		if err := checkAvroSchemaTypes(valueSchema); err != nil {
+			return nil, nil, fmt.Errorf("check the value schema %d of %s failed: %w",
+				schemaID, avroTableName(valueSchema), err)
+		}
+	}
+	columns, unknown, err := parseAvroColumnsSkipping(valueSchema, true)
+	if err == nil && len(unknown) > 0 && a.unknown.policy == unknownTypeFail {
+		// parse again for the error of the first column failed, the same as no column is skipped.
+		_, err = parseAvroColumns(valueSchema)
+	}
+	if err != nil {
+		return nil, unknown, fmt.Errorf("parse the value schema %d of %s failed: %w",
+			schemaID, avroTableName(valueSchema), err)
+	}
+	a.schemaColumns[schemaID] = columns
+	a.unknownColumns[schemaID] = unknown
+	return columns, unknown, nil
+}
+
+// observeSchema tracks the schema ID of the table, the drift is logged with the field level difference.
+func (a *avroVerifier) observeSchema(value []byte, valueSchema map[string]interface{}, result *messageResult) error {
+	schemaID, _, err := extractSchemaIDAndBinaryData(value)
+	if err != nil {
+		return err
+	}
+	a.valueSchemas[schemaID] = valueSchema
+	drift := a.drift.observe(result.table, schemaID)
+	if drift == nil {
+		return nil
+	}
+	if previous, ok := a.valueSchemas[drift.FromSchemaID]; ok {
+		drift.Diff = diffAvroSchemas(previous, valueSchema)
+	}
+	result.schemaDrift = drift
+	if drift.Flapping {
+		log.Warn("schema ID of the table flaps between two IDs, the producer may be misbehaving",
+			zap.String("table", drift.Table), zap.Int("from", drift.FromSchemaID), zap.Int("to", drift.ToSchemaID),
+			zap.Any("diff", drift.Diff))
+	} else {
+		log.Warn("schema of the table drifts", zap.String("table", drift.Table),
+			zap.Int("from", drift.FromSchemaID), zap.Int("to", drift.ToSchemaID), zap.Any("diff", drift.Diff))
+	}
+	if a.freezeSchema {
+		return driftError(drift)
+	}
+	return nil
+}
+
+// avroKeySchema is the cached key schema.
+type avroKeySchema struct {
+	codec  *goavro.Codec
+	schema map[string]interface{}
+}
+
+// decodeKey decodes the avro key by the cached key schema.
+func (a *avroVerifier) decodeKey(key []byte) (map[string]interface{}, map[string]interface{}, error) {
+	schemaID, data, err := extractSchemaIDAndBinaryData(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	keySchema, ok := a.keySchemas[schemaID]
+	if !ok {
+		codec, err := a.getSchema(schemaID)
+		if err != nil {
+			return nil, nil, newInfraError(err)
+		}
+		keySchema = &avroKeySchema{codec: codec, schema: make(map[string]interface{})}
+		if err := json.Unmarshal([]byte(codec.Schema()), &keySchema.schema); err != nil {
+			return nil, nil, err
+		}
+		a.keySchemas[schemaID] = keySchema
+	}
+	native, _, err := keySchema.codec.NativeFromBinary(data)
+	if err != nil {
+		return nil, nil, err
+	}
+	keyMap, ok := native.(map[string]interface{})
+	if !ok {
+		return nil, nil, errors.New("raw avro key is not a map")
+	}
+	return keyMap, keySchema.schema, nil
+}
+
+// matchKey matches the handle columns carried by the key against the key filter,
+// the second return value is false if the key is not avro, or does not carry all columns of the conditions.
+func (a *avroVerifier) matchKey(key []byte) (bool, bool, error) {
+	if len(key) < 5 || key[0] != magicByte {
+		return false, false, nil
+	}
+	keyMap, keySchema, err := a.decodeKey(key)
+	if err != nil {
+		return false, false, err
+	}
+	matched, checked := a.keys.match(keyMap, keySchema)
+	return matched, checked, nil
+}
+
+// avroTableName returns the `schema.table` of the value schema, the record name is the table,
+// and the namespace is `{changefeed namespace}.{schema}`.
+func avroTableName(valueSchema map[string]interface{}) string {
+	name, _ := valueSchema["name"].(string)
+	namespace, _ := valueSchema["namespace"].(string)
+	if name == "" || namespace == "" {
+		return ""
+	}
+	if i := strings.LastIndexByte(namespace, '.'); i >= 0 {
+		namespace = namespace[i+1:]
+	}
+	return namespace + "." + name
+}
+
+func (a *avroVerifier) verify(message kafka.Message) (messageResult, error) {
+	value := message.Value
+	if len(value) == 0 {
+		result := messageResult{outcome: outcomeSkippedDelete}
+		result.addOp(opDelete)
+		if a.ops.filtered(opDelete) {
+			result.outcome = outcomeFiltered
+			return result, nil
+		}
+		if a.keys != nil {
+			// the delete event only has the key, it's filtered if the key cannot be matched.
+			matched, checked, err := a.matchKey(message.Key)
+			if err != nil {
+				return messageResult{}, err
+			}
+			if !checked || !matched {
+				result.outcome = outcomeFiltered
+				return result, nil
+			}
+		}
+		log.Info("delete event does not have value, skip checksum verification", zap.String("topic", message.Topic))
+		if a.collectRows || a.exportRows {
+			// the deleted row is asserted absent in the downstream by the handle key columns.
+			row, err := a.deletedRow(message.Key)
+			if err != nil {
+				return result, err
+			}
+			if row != nil {
+				result.table = row.schema + "." + row.table
+				if a.collectRows {
+					result.rows = append(result.rows, row)
+				}
+				result.decoded = row
+			}
+		}
+		return result, nil
+	}
+	if value[0] == avroDDLByte {
+		event, err := decodeAvroDDLEvent(value)
+		if err != nil {
+			return messageResult{}, err
+		}
+		log.Info("DDL message received, skip", zap.Uint64("commitTs", event.CommitTs), zap.String("DDL", event.Query))
+		return messageResult{outcome: outcomeSkippedNonRow, commitTs: event.CommitTs}, nil
+	}
+	if value[0] == avroCheckpointByte {
+		if len(value) != 9 {
+			return messageResult{}, fmt.Errorf("invalid avro checkpoint event of %d bytes", len(value))
+		}
+		return messageResult{outcome: outcomeSkippedNonRow, resolvedTs: binary.BigEndian.Uint64(value[1:])}, nil
+	}
+
+	table, err := a.tableOf(value)
+	if err != nil {
+		return messageResult{}, err
+	}
+	if a.filter != nil && a.filter.filtered(table.name()) {
+		return messageResult{outcome: outcomeFiltered}, nil
+	}
+	if skipped, err := a.skipUnknownTable(value, table.name()); err != nil || skipped {
+		return messageResult{outcome: outcomeFiltered}, err
+	}
+	// the key is checked first, so that the unmatched message is skipped without decoding the value.
+	var keyChecked bool
+	if a.keys != nil {
+		matched, checked, err := a.matchKey(message.Key)
+		if err != nil {
+			return messageResult{}, err
+		}
+		if checked && !matched {
+			return messageResult{outcome: outcomeFiltered}, nil
+		}
+		keyChecked = checked
+	}
+	if !a.sampler.sampled(message.Partition, message.Offset) {
+		// the value is not decoded, only the commit ts is read to advance the progress,
+		// such as the end commit ts and the ordering of the partition.
+		commitTs, err := a.commitTsOf(value)
+		if err != nil {
+			return messageResult{}, err
+		}
+		return messageResult{outcome: outcomeUnsampled, commitTs: commitTs, table: table.name()}, nil
+	}
+
+	result, rest, err := a.verifyRecord(message, value, keyChecked)
+	if len(rest) == 0 || (err != nil && !errors.Is(err, errOpInconsistent)) {
+		return result, err
+	}
+	return a.verifyBatched(message, value, rest, keyChecked, result, err)
+}
+
+// verifyRecord verifies the first record of the value, the bytes following it are returned as well.
+func (a *avroVerifier) verifyRecord(message kafka.Message, value []byte, keyChecked bool) (messageResult, []byte, error) {
+	valueMap, valueSchema, rest, err := a.decodeValue(value)
+	if err != nil {
+		return messageResult{}, nil, err
+	}
+	result := messageResult{commitTs: getCommitTs(valueMap), table: avroTableName(valueSchema)}
+	if err := a.observeSchema(value, valueSchema, &result); err != nil {
+		return result, rest, err
+	}
+	op, opErr := parseAvroOp(valueMap)
+	result.addOp(op)
+	if a.ops.filtered(op) {
+		result.outcome = outcomeFiltered
+		return result, rest, nil
+	}
+	if a.keys != nil {
+		if !keyChecked {
+			if matched, checked := a.keys.match(valueMap, valueSchema); !checked || !matched {
+				result.outcome = outcomeFiltered
+				return result, rest, nil
+			}
+		}
+		log.Info("event matches the key filter", zap.String("topic", message.Topic),
+			zap.Int("partition", message.Partition), zap.Int64("offset", message.Offset),
+			zap.String("table", result.table), zap.Uint64("commitTs", result.commitTs), zap.Any("row", valueMap))
+	}
+	result, err = a.verifyValue(message, value, valueMap, valueSchema, result)
+	// the row is verified even if the operation is inconsistent, the inconsistency is reported besides the outcome.
+	if err == nil {
+		err = opErr
+	}
+	return result, rest, err
+}
+
+// verifyValue verifies the checksum of the row carried by the value.
+func (a *avroVerifier) verifyValue(
+	message kafka.Message, value []byte, valueMap, valueSchema map[string]interface{}, result messageResult,
+) (messageResult, error) {
+	// the checksum is not calculated for the event outside the window.
+	if outside, err := a.window.outside(&result, result.commitTs); err != nil || outside {
+		return result, err
+	}
+
+	if a.exportRows {
+		row, err := a.newRowEvent(message.Key, valueMap, valueSchema, result.commitTs)
+		if err != nil {
+			return a.salvageRow(result, valueMap, valueSchema, err)
+		}
+		result.decoded = row
+	}
+	if avroLegacyFormat(valueSchema) {
+		// the checksum is not carried along with the other extension fields.
+		if _, ok := a.legacyTables[result.table]; !ok {
+			a.legacyTables[result.table] = struct{}{}
+			log.Warn("the message carries none of the TiDB extension fields, such as of the older TiCDC avro format, "+
+				"it cannot be verified", zap.String("table", result.table))
+		}
+		result.outcome = outcomeSkippedLegacyFormat
+		if a.collectRows {
+			// the row is still decoded, so that it's compared against the downstream.
+			row, err := a.newRowEvent(message.Key, valueMap, valueSchema, result.commitTs)
+			if err != nil {
+				return result, err
+			}
+			result.rows = append(result.rows, row)
+		}
+		return result, nil
+	}
+	expected, ok, err := getExpectedChecksum(valueMap)
+	if err != nil {
+		return result, err
+	}
+	result.checksum = expected
+	if !ok {
+		result.outcome = outcomeSkippedNoChecksum
+		return result, nil
+	}
+	// the column selector projects the columns, and the checksum is calculated by the projected ones,
+	// check the column set first, so that the misconfiguration is not reported as a mismatch.
+	if err := a.columns.check(result.table, avroColumnNames(valueSchema)); err != nil {
+		return result, err
+	}
+
+	schemaColumns, unknown, err := a.columnsOf(value, valueSchema)
+	if len(unknown) > 0 {
+		a.unknown.observe(result.table, unknown)
+	}
+	if err != nil {
+		return a.salvageRow(result, valueMap, valueSchema, err)
+	}
+	if len(unknown) > 0 && a.unknown.policy == unknownTypeSkipTable {
+		// the record of another schema batched after the first one.
+		result.outcome = outcomeFiltered
+		return result, nil
+	}
+	if err := verifyAvroChecksum(valueMap, schemaColumns); err != nil {
+		if errors.Is(err, errChecksumMismatch) && len(unknown) > 0 {
+			return a.inconclusiveRow(result, valueMap, unknown), nil
+		}
+		if errors.Is(err, errChecksumMismatch) && a.collectRows {
+			// the mismatched row is compared against the upstream, nil if it cannot be decoded.
+			if row, rowErr := a.newRowEvent(message.Key, valueMap, valueSchema, result.commitTs); rowErr == nil {
+				result.mismatch = row
+			}
+		}
+		if errors.Is(err, errChecksumMismatch) && a.bisector != nil {
+			if metas, values, valuesErr := avroColumnValues(valueMap, schemaColumns); valuesErr == nil {
+				result.bisect = a.bisector.bisect(getChecksumVersion(valueMap), metas, values, result.checksum)
+				log.Info("mismatched row bisected", zap.String("table", result.table), zap.Any("bisect", result.bisect))
+			}
+		}
+		if !errors.Is(err, errChecksumMismatch) {
+			return a.salvageRow(result, valueMap, valueSchema, err)
+		}
+		return result, err
+	}
+	if len(unknown) > 0 {
+		result.outcome = outcomeVerifiedWithCaveats
+	}
+	if a.collectRows {
+		row, err := a.newRowEvent(message.Key, valueMap, valueSchema, result.commitTs)
+		if err != nil {
+			return result, err
+		}
+		result.rows = append(result.rows, row)
+	}
+	return result, nil
+}
+
+// avroSchemaAndTable returns the schema and the table of the avro record, see avroTableName.
+func avroSchemaAndTable(schema map[string]interface{}) (string, string) {
+	name := avroTableName(schema)
+	if i := strings.IndexByte(name, '.'); i >= 0 {
+		return name[:i], name[i+1:]
+	}
+	return "", ""
+}
+
+// handleColumnNames returns the names of the handle key columns carried by the avro key,
+// nil if the key is not avro.
+func (a *avroVerifier) handleColumnNames(key []byte) (map[string]struct{}, error) {
+	if len(key) < 5 || key[0] != magicByte {
+		return nil, nil
+	}
+	_, keySchema, err := a.decodeKey(key)
+	if err != nil {
+		return nil, err
+	}
+	names := make(map[string]struct{})
+	for _, name := range avroColumnNames(keySchema) {
+		names[name] = struct{}{}
+	}
+	return names, nil
+}
+
+// newRowEvent returns the row of the avro value, the handle key columns are those carried by the avro key,
+// the row without the avro key has no handle key, so it's not cross-checked.
+func (a *avroVerifier) newRowEvent(
+	key []byte, valueMap, valueSchema map[string]interface{}, commitTs uint64,
+) (*rowEvent, error) {
+	handles, err := a.handleColumnNames(key)
+	if err != nil {
+		return nil, err
+	}
+	metas, values, err := a.rowColumns(valueMap, valueSchema)
+	if err != nil {
+		return nil, err
+	}
+	expected, _, err := getExpectedChecksum(valueMap)
+	if err != nil {
+		return nil, err
+	}
+	row := &rowEvent{
+		commitTs: commitTs, readTs: commitTs, expected: expected, checksumVersion: getChecksumVersion(valueMap),
+	}
+	row.schema, row.table = avroSchemaAndTable(valueSchema)
+	for i, meta := range metas {
+		_, handle := handles[meta.Name]
+		value := values[i]
+		if rat, ok := value.(*big.Rat); ok {
+			// the precise decimal is compared by the string formatted by the scale, the same as the string mode.
+			value = rat.FloatString(meta.Scale)
+		}
+		row.columns = append(row.columns, rowColumn{
+			name: meta.Name, mysqlType: meta.MySQLType, handle: handle, value: value,
+		})
+	}
+	return row, nil
+}
+
+// deletedRow returns the deleted row only carrying the handle key columns of the avro key,
+// nil if the key is not avro.
+func (a *avroVerifier) deletedRow(key []byte) (*rowEvent, error) {
+	if len(key) < 5 || key[0] != magicByte {
+		return nil, nil
+	}
+	keyMap, keySchema, err := a.decodeKey(key)
+	if err != nil {
+		return nil, err
+	}
+	metas, values, err := checksumColumns(keyMap, keySchema)
+	if err != nil {
+		return nil, err
+	}
+	row := &rowEvent{deleted: true}
+	row.schema, row.table = avroSchemaAndTable(keySchema)
+	for i, meta := range metas {
+		row.columns = append(row.columns, rowColumn{
+			name: meta.Name, mysqlType: meta.MySQLType, handle: true, value: values[i],
+		})
+	}
+	return row, nil
+}
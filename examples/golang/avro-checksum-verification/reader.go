@@ -0,0 +1,149 @@
+// Copyright 2023 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"sync"
+
+	"github.com/pingcap/log"
+	"github.com/segmentio/kafka-go"
+	"go.uber.org/zap"
+)
+
+// messageReader is the source of the kafka messages to be verified.
+// It's satisfied by the *kafka.Reader which consumes by the consumer group.
+type messageReader interface {
+	FetchMessage(ctx context.Context) (kafka.Message, error)
+	CommitMessages(ctx context.Context, messages ...kafka.Message) error
+	Close() error
+}
+
+func newGroupReader(cfg *config) messageReader {
+	return kafka.NewReader(kafka.ReaderConfig{
+		Brokers:  []string{cfg.kafkaAddr},
+		GroupID:  cfg.consumerGroupID,
+		Topic:    cfg.topic,
+		MaxBytes: 10e6, // 10MB
+	})
+}
+
+// partitionReader consumes all partitions of the topic, each one starts from an explicit offset.
+// It does not join any consumer group, so commit is a no-op,
+// the progress can only be kept by the checkpoint file.
+type partitionReader struct {
+	readers []*kafka.Reader
+
+	messageCh chan kafka.Message
+	errCh     chan error
+
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+// newPartitionReader creates a partitionReader of the topic, offsets is the start offset of each partition,
+// partitions not in the offsets start from the defaultOffset.
+func newPartitionReader(
+	ctx context.Context, cfg *config, topic string, offsets map[int]int64, defaultOffset int64,
+) (*partitionReader, error) {
+	partitions, err := readPartitions(ctx, cfg, topic)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	r := &partitionReader{
+		messageCh: make(chan kafka.Message, 128),
+		errCh:     make(chan error, len(partitions)),
+		cancel:    cancel,
+	}
+	for _, p := range partitions {
+		reader := kafka.NewReader(kafka.ReaderConfig{
+			Brokers:   []string{cfg.kafkaAddr},
+			Topic:     topic,
+			Partition: p.ID,
+			MaxBytes:  10e6, // 10MB
+		})
+		offset, ok := offsets[p.ID]
+		if !ok {
+			offset = defaultOffset
+		}
+		if err := reader.SetOffset(offset); err != nil {
+			reader.Close()
+			r.Close()
+			return nil, err
+		}
+		log.Info("consume partition from the explicit offset",
+			zap.String("topic", topic), zap.Int("partition", p.ID), zap.Int64("offset", offset))
+
+		r.readers = append(r.readers, reader)
+		r.wg.Add(1)
+		go r.fetch(ctx, reader)
+	}
+	return r, nil
+}
+
+// readPartitions returns the partitions of the topic.
+func readPartitions(ctx context.Context, cfg *config, topic string) ([]kafka.Partition, error) {
+	conn, err := kafka.DialContext(ctx, "tcp", cfg.kafkaAddr)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	return conn.ReadPartitions(topic)
+}
+
+func (r *partitionReader) fetch(ctx context.Context, reader *kafka.Reader) {
+	defer r.wg.Done()
+	for {
+		message, err := reader.FetchMessage(ctx)
+		if err != nil {
+			r.errCh <- err
+			return
+		}
+		select {
+		case r.messageCh <- message:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// FetchMessage returns the next message, messages of the same partition are returned in order.
+func (r *partitionReader) FetchMessage(ctx context.Context) (kafka.Message, error) {
+	select {
+	case message := <-r.messageCh:
+		return message, nil
+	case err := <-r.errCh:
+		return kafka.Message{}, err
+	case <-ctx.Done():
+		return kafka.Message{}, ctx.Err()
+	}
+}
+
+// CommitMessages is a no-op, since there is no consumer group.
+func (r *partitionReader) CommitMessages(_ context.Context, _ ...kafka.Message) error {
+	return nil
+}
+
+func (r *partitionReader) Close() error {
+	r.cancel()
+	r.wg.Wait()
+	for _, reader := range r.readers {
+		if err := reader.Close(); err != nil {
+			log.Warn("close partition reader failed", zap.Error(err))
+		}
+	}
+	return nil
+}
@@ -0,0 +1,232 @@
+// Copyright 2023 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/linkedin/goavro/v2"
+	"github.com/pingcap/log"
+	"github.com/segmentio/kafka-go"
+	"go.uber.org/zap"
+)
+
+const (
+	replayEncodingBase64 = "base64"
+	replayEncodingHex    = "hex"
+
+	// replayKeySuffix is the suffix of the file carrying the key of the message file of the same name.
+	replayKeySuffix = ".key"
+	// localSchemaSuffix is the suffix of the schema file `<schema ID>.avsc` in the schema dir.
+	localSchemaSuffix = ".avsc"
+)
+
+// replayError is a file or line of the dump which cannot be parsed, it's skipped without stopping the replay.
+type replayError struct {
+	// Source is the file, followed by the line number for the line file, such as `dump.txt:3`.
+	Source string `json:"source"`
+	Error  string `json:"error"`
+}
+
+// replayReport is the summary of the replay, the ordering is not checked since the dump may not be in the topic order.
+type replayReport struct {
+	Source string `json:"source"`
+	// Messages is the number of messages replayed, excluding the unparsable ones.
+	Messages        int           `json:"messages"`
+	OrderingChecked bool          `json:"orderingChecked"`
+	Unparsable      []replayError `json:"unparsable,omitempty"`
+}
+
+// replayReader reads the messages dumped to the files, such as by kcat, each message is returned as a kafka message,
+// the topic is the path of the file, and the offset is the line number in the line file,
+// or the ordinal of the file in the directory.
+// The dump is either a directory, each file carries the raw bytes of a message value, and the key if any is in the
+// file of the same name with the `.key` suffix, or a line file, each line is `[<key> ]<value>` in base64 or hex.
+// Nothing is committed, since the dump is replayed from scratch each time.
+type replayReader struct {
+	source string
+	decode func(string) ([]byte, error)
+	// files are the message files of the directory in the order of the name, nil if the source is a line file.
+	files []string
+	next  int
+
+	lines []string
+	line  int
+
+	messages   int
+	unparsable []replayError
+}
+
+func newReplayReader(source, encoding string) (*replayReader, error) {
+	r := &replayReader{source: source, decode: base64.StdEncoding.DecodeString}
+	if encoding == replayEncodingHex {
+		r.decode = hex.DecodeString
+	}
+	info, err := os.Stat(source)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		content, err := os.ReadFile(source)
+		if err != nil {
+			return nil, err
+		}
+		r.lines = strings.Split(string(content), "\n")
+		return r, nil
+	}
+	entries, err := os.ReadDir(source)
+	if err != nil {
+		return nil, err
+	}
+	r.files = []string{}
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || strings.HasPrefix(name, ".") || strings.HasSuffix(name, replayKeySuffix) {
+			continue
+		}
+		r.files = append(r.files, filepath.Join(source, name))
+	}
+	sort.Strings(r.files)
+	return r, nil
+}
+
+// FetchMessage returns the next message, io.EOF if all messages are replayed,
+// the file or line which cannot be parsed is recorded and skipped.
+func (r *replayReader) FetchMessage(ctx context.Context) (kafka.Message, error) {
+	for {
+		if err := ctx.Err(); err != nil {
+			return kafka.Message{}, err
+		}
+		var (
+			message kafka.Message
+			source  string
+			err     error
+		)
+		switch {
+		case r.files != nil && r.next < len(r.files):
+			source = r.files[r.next]
+			r.next++
+			message, err = r.readFile(source)
+			message.Offset = int64(r.next)
+		case r.files == nil && r.line < len(r.lines):
+			r.line++
+			line := strings.TrimSpace(r.lines[r.line-1])
+			// the empty line and the comment are skipped.
+			if line == "" || strings.HasPrefix(line, "#") {
+				continue
+			}
+			source = r.source + ":" + strconv.Itoa(r.line)
+			message, err = r.parseLine(line)
+			message.Topic, message.Offset = r.source, int64(r.line)
+		default:
+			return kafka.Message{}, io.EOF
+		}
+		if err != nil {
+			log.Warn("skip the message which cannot be parsed", zap.String("source", source), zap.Error(err))
+			r.unparsable = append(r.unparsable, replayError{Source: source, Error: err.Error()})
+			continue
+		}
+		r.messages++
+		return message, nil
+	}
+}
+
+// readFile reads the message value of the file, and the key of the `.key` file if it exists.
+func (r *replayReader) readFile(path string) (kafka.Message, error) {
+	value, err := os.ReadFile(path)
+	if err != nil {
+		return kafka.Message{}, err
+	}
+	key, err := os.ReadFile(path + replayKeySuffix)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return kafka.Message{}, err
+	}
+	return kafka.Message{Topic: path, Key: key, Value: value}, nil
+}
+
+// parseLine decodes the line of `[<key> ]<value>`.
+func (r *replayReader) parseLine(line string) (kafka.Message, error) {
+	fields := strings.Fields(line)
+	if len(fields) > 2 {
+		return kafka.Message{}, fmt.Errorf("expect the value, or the key and the value, but got %d fields", len(fields))
+	}
+	value, err := r.decode(fields[len(fields)-1])
+	if err != nil {
+		return kafka.Message{}, fmt.Errorf("decode the value failed: %w", err)
+	}
+	var key []byte
+	if len(fields) == 2 {
+		if key, err = r.decode(fields[0]); err != nil {
+			return kafka.Message{}, fmt.Errorf("decode the key failed: %w", err)
+		}
+	}
+	return kafka.Message{Key: key, Value: value}, nil
+}
+
+func (r *replayReader) CommitMessages(_ context.Context, _ ...kafka.Message) error {
+	return nil
+}
+
+func (r *replayReader) Close() error {
+	return nil
+}
+
+func (r *replayReader) snapshot() *replayReport {
+	return &replayReport{Source: r.source, Messages: r.messages, Unparsable: r.unparsable}
+}
+
+// newReplayVerifier verifies the messages of the dump, instead of consuming kafka.
+func newReplayVerifier(cfg *config, v *verifier) (*verifier, error) {
+	reader, err := newReplayReader(cfg.replay, cfg.replayEncoding)
+	if err != nil {
+		log.Error("open the replay source failed", zap.String("source", cfg.replay), zap.Error(err))
+		return nil, newInfraError(err)
+	}
+	log.Info("start replaying ...", zap.String("source", cfg.replay), zap.Int("files", len(reader.files)))
+	v.reader, v.replay = reader, reader
+	return v, nil
+}
+
+// loadLocalSchema reads the schema of the ID from `<dir>/<schema ID>.avsc`, which is the avro schema itself,
+// or the response of the schema registry carrying it in the `schema` field.
+func loadLocalSchema(dir string, schemaID int) (*goavro.Codec, error) {
+	path := filepath.Join(dir, strconv.Itoa(schemaID)+localSchemaSuffix)
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var response struct {
+		Type   interface{} `json:"type"`
+		Schema string      `json:"schema"`
+	}
+	if err := json.Unmarshal(content, &response); err == nil && response.Type == nil && response.Schema != "" {
+		content = []byte(response.Schema)
+	}
+	codec, err := goavro.NewCodec(string(content))
+	if err != nil {
+		return nil, fmt.Errorf("parse the schema file %s failed: %w", path, err)
+	}
+	return codec, nil
+}
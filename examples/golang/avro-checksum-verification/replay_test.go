@@ -0,0 +1,178 @@
+// Copyright 2023 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// newTestSchemaDir returns the schema dir carrying the test value schema, the registry is not involved.
+func newTestSchemaDir(t *testing.T) string {
+	dir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(dir, strconv.Itoa(testSchemaID)+".avsc"), []byte(testValueSchema), 0o644))
+	return dir
+}
+
+func newTestReplayConfig(t *testing.T, source string) *config {
+	cfg := newDefaultConfig()
+	// the schema registry is unreachable, the schemas are read from the schema dir.
+	cfg.schemaRegistryURL = "http://127.0.0.1:1"
+	cfg.replay, cfg.schemaDir = source, newTestSchemaDir(t)
+	require.NoError(t, cfg.validate())
+	return cfg
+}
+
+func TestReplayLineFile(t *testing.T) {
+	t.Parallel()
+
+	verified, mismatch := newVerifiedTestMessage(t, 0, 1, "a"), newMismatchTestMessage(t, 0, 2, "b")
+	path := filepath.Join(t.TempDir(), "dump.txt")
+	content := strings.Join([]string{
+		"# captured by kcat",
+		base64.StdEncoding.EncodeToString(verified.Value),
+		"",
+		"not-base64!",
+		base64.StdEncoding.EncodeToString([]byte("key")) + " " + base64.StdEncoding.EncodeToString(mismatch.Value),
+		"a b c",
+	}, "\n")
+	require.NoError(t, os.WriteFile(path, []byte(content), 0o644))
+
+	cfg := newTestReplayConfig(t, path)
+	cfg.mismatchBudget = unlimitedMismatchBudget
+	v, err := newVerifier(context.Background(), cfg)
+	require.NoError(t, err)
+	defer v.close()
+	err = v.run(context.Background())
+	require.Equal(t, exitCodeMismatch, v.finish(err))
+
+	require.Equal(t, counters{Messages: 2, Verified: 1, Mismatches: 1}, v.report.Counters)
+	require.Len(t, v.report.Failures, 1)
+	require.Equal(t, path, v.report.Failures[0].Topic)
+	require.Equal(t, int64(5), v.report.Failures[0].Offset)
+	require.Nil(t, v.report.Latency)
+	r := v.report.Replay
+	require.Equal(t, path, r.Source)
+	require.Equal(t, 2, r.Messages)
+	require.False(t, r.OrderingChecked)
+	require.Len(t, r.Unparsable, 2)
+	require.Equal(t, path+":4", r.Unparsable[0].Source)
+	require.Contains(t, r.Unparsable[0].Error, "decode the value failed")
+	require.Equal(t, path+":6", r.Unparsable[1].Source)
+	require.Contains(t, r.Unparsable[1].Error, "got 3 fields")
+}
+
+func TestReplayDirectory(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	write := func(name string, content []byte) {
+		require.NoError(t, os.WriteFile(filepath.Join(dir, name), content, 0o644))
+	}
+	write("0002", newVerifiedTestMessage(t, 0, 2, "b").Value)
+	write("0001", newVerifiedTestMessage(t, 0, 1, "a").Value)
+	write("0001.key", []byte("key"))
+	write(".DS_Store", []byte("junk"))
+	require.NoError(t, os.Mkdir(filepath.Join(dir, "nested"), 0o755))
+
+	reader, err := newReplayReader(dir, replayEncodingBase64)
+	require.NoError(t, err)
+	message, err := reader.FetchMessage(context.Background())
+	require.NoError(t, err)
+	require.Equal(t, filepath.Join(dir, "0001"), message.Topic)
+	require.Equal(t, []byte("key"), message.Key)
+	message, err = reader.FetchMessage(context.Background())
+	require.NoError(t, err)
+	require.Equal(t, filepath.Join(dir, "0002"), message.Topic)
+	require.Nil(t, message.Key)
+	_, err = reader.FetchMessage(context.Background())
+	require.ErrorIs(t, err, io.EOF)
+
+	v, err := newVerifier(context.Background(), newTestReplayConfig(t, dir))
+	require.NoError(t, err)
+	defer v.close()
+	err = v.run(context.Background())
+	require.Equal(t, exitCodeClean, v.finish(err))
+	require.Equal(t, uint64(2), v.report.Counters.Verified)
+	require.Equal(t, 2, v.report.Replay.Messages)
+}
+
+func TestReplayUnparsableOnly(t *testing.T) {
+	t.Parallel()
+
+	path := filepath.Join(t.TempDir(), "dump.hex")
+	content := hex.EncodeToString(newVerifiedTestMessage(t, 0, 1, "a").Value) + "\nzz\n"
+	require.NoError(t, os.WriteFile(path, []byte(content), 0o644))
+	cfg := newTestReplayConfig(t, path)
+	cfg.replayEncoding = replayEncodingHex
+
+	v, err := newVerifier(context.Background(), cfg)
+	require.NoError(t, err)
+	defer v.close()
+	err = v.run(context.Background())
+	// the verified messages are clean, but the unparsable one is not verified.
+	require.Equal(t, exitCodeDecodeError, v.finish(err))
+	require.Equal(t, uint64(1), v.report.Counters.Verified)
+	require.Len(t, v.report.Replay.Unparsable, 1)
+}
+
+func TestLoadLocalSchema(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	response, err := json.Marshal(map[string]string{"schema": testKeySchema})
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "2.avsc"), response, 0o644))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "3.avsc"), []byte(`{"type": "unknown"}`), 0o644))
+
+	// the response of the schema registry is accepted as well.
+	codec, err := loadLocalSchema(dir, 2)
+	require.NoError(t, err)
+	require.Contains(t, codec.Schema(), "BIGINT")
+	_, err = loadLocalSchema(dir, 3)
+	require.ErrorContains(t, err, "parse the schema file")
+	_, err = loadLocalSchema(dir, 4)
+	require.ErrorIs(t, err, os.ErrNotExist)
+}
+
+func TestReplayConfig(t *testing.T) {
+	t.Parallel()
+
+	for _, c := range []struct {
+		update   func(cfg *config)
+		expected string
+	}{
+		{func(cfg *config) { cfg.replayEncoding = "raw" }, "unknown replay encoding: raw"},
+		{func(cfg *config) { cfg.checkpointFile = "checkpoint.json" }, "not supported by the replay"},
+		{func(cfg *config) { cfg.checkKeyPartition = true }, "not supported by the replay"},
+		{func(cfg *config) { cfg.ddlTopic = "ddl" }, "DDL topic is not supported by the replay"},
+		{func(cfg *config) { cfg.protocol = protocolCanalJSON }, "only the avro protocol is supported by the schema dir"},
+		{func(cfg *config) { cfg.storageDir = "output" }, "cannot be set at the same time"},
+	} {
+		cfg := newDefaultConfig()
+		cfg.replay, cfg.schemaDir = "dump.txt", "schemas"
+		c.update(cfg)
+		require.ErrorContains(t, cfg.validate(), c.expected)
+	}
+}
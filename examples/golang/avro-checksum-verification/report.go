@@ -0,0 +1,285 @@
+// Copyright 2023 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+)
+
+// maxReportedFailures limits the failures kept in the report, the counters are always accurate.
+const maxReportedFailures = 1000
+
+const (
+	failureKindMismatch = "mismatch"
+	failureKindDecode   = "decode"
+	failureKindInfra    = "infra"
+	// failureKindDownstream means the row in the downstream database is different from the event.
+	failureKindDownstream = "downstream"
+	// failureKindOrdering means the event is behind the resolved ts of the partition.
+	failureKindOrdering = "ordering"
+	// failureKindOp means the operation of the event is unknown, or inconsistent with the message shape.
+	failureKindOp = "op"
+	// failureKindNotComputable means the checksum is not computable since some columns cannot be handled,
+	// only by the salvage mode.
+	failureKindNotComputable = "notComputable"
+)
+
+// failure records one message failed the verification.
+type failure struct {
+	Kind      string `json:"kind"`
+	Topic     string `json:"topic"`
+	Partition int    `json:"partition"`
+	Offset    int64  `json:"offset"`
+	// Table is the `schema.table` of the message, if the protocol carries it.
+	Table string `json:"table,omitempty"`
+	// Key is the handle columns of the message key, such as `id=1`, or the hex prefix of the key which is not avro.
+	Key string `json:"key,omitempty"`
+	// CommitTs and SourceTs are the event metadata decoded before the failure, if any.
+	CommitTs uint64 `json:"commitTs,omitempty"`
+	SourceTs int64  `json:"sourceTs,omitempty"`
+	Error    string `json:"error"`
+	// Upstream is the comparison against the upstream snapshot, only for the mismatch if the upstream is set.
+	Upstream *upstreamComparison `json:"upstream,omitempty"`
+	// Bisect is the hypothesis making the mismatched checksum match, only for the mismatch if the bisection is set.
+	Bisect *bisectResult `json:"bisect,omitempty"`
+	// SchemaChange notes the DDL of the table near the commit ts, since the failure may be caused by it.
+	SchemaChange string `json:"schemaChange,omitempty"`
+	// Columns are the columns failed, only for the row not computable.
+	Columns []columnError `json:"columns,omitempty"`
+}
+
+// report is the summary of the whole verification run.
+type report struct {
+	StartTime  time.Time `json:"startTime"`
+	FinishTime time.Time `json:"finishTime"`
+
+	Counters counters `json:"counters"`
+	// Tables are the counters of each table, keyed by `schema.table`, only if the protocol carries the table name.
+	Tables map[string]*counters `json:"tables,omitempty"`
+	// Operations are the number of row events of each operation, including those filtered out by the operation.
+	Operations map[rowOp]uint64 `json:"operations,omitempty"`
+	// Rows is the number of row events of the messages counted by the outcomes, more than the messages if batched,
+	// BatchedMessages is the number of messages carrying more than one row event.
+	Rows            uint64 `json:"rows"`
+	BatchedMessages uint64 `json:"batchedMessages,omitempty"`
+
+	Failures []failure `json:"failures"`
+	// FailuresTruncated is true if there are more failures than the reported ones.
+	FailuresTruncated bool `json:"failuresTruncated,omitempty"`
+	// DDLs are the DDLs consumed from the DDL topic of each table, in the order of the commit ts.
+	DDLs map[string][]ddlRecord `json:"ddls,omitempty"`
+	// SchemaDrifts are the changes of the schema ID of each table, in the order they are found.
+	SchemaDrifts []*schemaDrift `json:"schemaDrifts,omitempty"`
+	// SkippedFiles are the data files not verified since they are still in progress, only for the offline mode.
+	SkippedFiles []string `json:"skippedFiles,omitempty"`
+	// Sampling states the sampling of the run, nil if all messages are verified.
+	Sampling *samplingReport `json:"sampling,omitempty"`
+	// Partitions are the resolved ts of each partition, ResolvedTsStalls is the number of times any of them stalls.
+	Partitions       map[int]partitionResolved `json:"partitions,omitempty"`
+	ResolvedTsStalls uint64                    `json:"resolvedTsStalls,omitempty"`
+	// Coverage is the commit ts coverage of the verified row events, nil if nothing is covered.
+	Coverage *coverageReport `json:"coverage,omitempty"`
+	// KeyPartition is the summary of the key partition check, nil if disabled.
+	KeyPartition *keyPartitionReport `json:"keyPartition,omitempty"`
+	// Latency is the end-to-end latency of the events carrying the commit ts, nil if none.
+	Latency *latencyReport `json:"latency,omitempty"`
+	// KafkaSkew is the skew of the kafka message timestamps against the commit of the events, nil if none.
+	KafkaSkew *skewReport `json:"kafkaSkew,omitempty"`
+	// SchemaTables are the tables of the schema IDs seen, only for the avro protocol.
+	SchemaTables []schemaTable `json:"schemaTables,omitempty"`
+	// UnknownTypes are the columns of the unknown TiDB types found, handled by the --on-unknown-type policy.
+	UnknownTypes []unknownType `json:"unknownTypes,omitempty"`
+	// SchemaRefresh is the summary of the schemas fetched again since the cached ones fail to decode, nil if none.
+	SchemaRefresh *schemaRefreshReport `json:"schemaRefresh,omitempty"`
+	// Replay is the summary of the replay of the dumped messages, nil if not replaying.
+	Replay *replayReport `json:"replay,omitempty"`
+	// ChecksumNote states the limits of the checksum verification of the protocol, empty if none.
+	ChecksumNote string `json:"checksumNote,omitempty"`
+
+	StopReason string `json:"stopReason,omitempty"`
+	ExitCode   int    `json:"exitCode"`
+}
+
+func newReport() *report {
+	return &report{StartTime: time.Now()}
+}
+
+// tableCounters returns the counters of the table, nil if the table is unknown.
+func (r *report) tableCounters(table string) *counters {
+	if table == "" {
+		return nil
+	}
+	if r.Tables == nil {
+		r.Tables = make(map[string]*counters)
+	}
+	c, ok := r.Tables[table]
+	if !ok {
+		c = &counters{}
+		r.Tables[table] = c
+	}
+	return c
+}
+
+// addRows records the row events of the message.
+func (r *report) addRows(result messageResult) {
+	r.Rows += uint64(result.rowEvents())
+	if result.events > 1 {
+		r.BatchedMessages++
+	}
+}
+
+// addOps records the operations of the row events in the message.
+func (r *report) addOps(ops map[rowOp]int) {
+	for op, n := range ops {
+		if r.Operations == nil {
+			r.Operations = make(map[rowOp]uint64)
+		}
+		r.Operations[op] += uint64(n)
+	}
+}
+
+func (r *report) addFailure(message kafka.Message, result messageResult, err error) {
+	if len(r.Failures) >= maxReportedFailures {
+		r.FailuresTruncated = true
+		return
+	}
+	r.Failures = append(r.Failures, failure{
+		Kind:      failureKindOf(err),
+		Topic:     message.Topic,
+		Partition: message.Partition,
+		Offset:    message.Offset,
+		Table:     result.table,
+		Key:       result.key,
+		CommitTs:  result.commitTs,
+		SourceTs:  result.sourceTs,
+		Error:     err.Error(),
+		Upstream:  result.upstream,
+		Bisect:    result.bisect,
+	})
+}
+
+// addNotComputable records the row not computable along with the columns failed, by the salvage mode.
+func (r *report) addNotComputable(message kafka.Message, result messageResult) {
+	if len(r.Failures) >= maxReportedFailures {
+		r.FailuresTruncated = true
+		return
+	}
+	r.Failures = append(r.Failures, failure{
+		Kind:      failureKindNotComputable,
+		Topic:     message.Topic,
+		Partition: message.Partition,
+		Offset:    message.Offset,
+		Table:     result.table,
+		Key:       result.key,
+		CommitTs:  result.commitTs,
+		SourceTs:  result.sourceTs,
+		Error:     "checksum not computable",
+		Columns:   result.columnErrors,
+	})
+}
+
+// addSchemaDrift records the drift at the message, the same transition of the table is counted only.
+func (r *report) addSchemaDrift(message kafka.Message, result messageResult) {
+	drift := result.schemaDrift
+	for _, recorded := range r.SchemaDrifts {
+		if recorded.Table == drift.Table &&
+			recorded.FromSchemaID == drift.FromSchemaID && recorded.ToSchemaID == drift.ToSchemaID {
+			recorded.Count++
+			recorded.Flapping = recorded.Flapping || drift.Flapping
+			return
+		}
+	}
+	drift.Topic, drift.Partition, drift.Offset = message.Topic, message.Partition, message.Offset
+	drift.CommitTs = result.commitTs
+	r.SchemaDrifts = append(r.SchemaDrifts, drift)
+}
+
+// addDDLs records the DDL history, and annotates the failures near a DDL of the same table.
+func (r *report) addDDLs(history *ddlHistory) {
+	r.DDLs = history.snapshot()
+	for i := range r.Failures {
+		f := &r.Failures[i]
+		if f.Table == "" || f.CommitTs == 0 {
+			continue
+		}
+		if record := history.near(f.Table, f.CommitTs); record != nil {
+			f.SchemaChange = schemaChangeNote(record)
+		}
+	}
+}
+
+// addResolved records the resolved ts of each partition, along with the commit ts coverage.
+func (r *report) addResolved(tracker *resolvedTracker) {
+	r.Partitions, r.ResolvedTsStalls = tracker.snapshot()
+	r.Coverage = tracker.coverageSnapshot()
+}
+
+// finish fills the final result, stopErr is the error which stopped the verification, if any.
+func (r *report) finish(stopErr error, c counters) {
+	r.FinishTime = time.Now()
+	r.Counters = c
+	if stopErr != nil {
+		r.StopReason = stopErr.Error()
+	}
+	r.ExitCode = exitCodeOf(stopErr)
+	// the verification is not stopped by any failure, but some of them are tolerated.
+	if r.ExitCode == exitCodeClean && c.Mismatches > 0 {
+		r.ExitCode = exitCodeMismatch
+	}
+	if r.ExitCode == exitCodeClean && c.DownstreamDiffs > 0 {
+		r.ExitCode = exitCodeDownstreamDiff
+	}
+	if r.ExitCode == exitCodeClean && c.OrderingErrors > 0 {
+		r.ExitCode = exitCodeOrderingError
+	}
+	if r.ExitCode == exitCodeClean && c.OpInconsistencies > 0 {
+		r.ExitCode = exitCodeOpInconsistent
+	}
+	// the row not computable is salvaged, but it's not verified either.
+	if r.ExitCode == exitCodeClean && c.NotComputable > 0 {
+		r.ExitCode = exitCodeDecodeError
+	}
+	// so is the dumped message which cannot be parsed.
+	if r.ExitCode == exitCodeClean && r.Replay != nil && len(r.Replay.Unparsable) > 0 {
+		r.ExitCode = exitCodeDecodeError
+	}
+}
+
+func (r *report) writeFile(path string) error {
+	content, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, content, 0o644)
+}
+
+func failureKindOf(err error) string {
+	switch exitCodeOf(err) {
+	case exitCodeMismatch:
+		return failureKindMismatch
+	case exitCodeDecodeError:
+		return failureKindDecode
+	case exitCodeDownstreamDiff:
+		return failureKindDownstream
+	case exitCodeOrderingError:
+		return failureKindOrdering
+	case exitCodeOpInconsistent:
+		return failureKindOp
+	}
+	return failureKindInfra
+}
@@ -0,0 +1,140 @@
+// Copyright 2023 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/pingcap/log"
+	"go.uber.org/zap"
+)
+
+// resolvedTsCheckInterval is the maximum interval to check whether the resolved ts stalls.
+const resolvedTsCheckInterval = time.Second
+
+// partitionResolved is the resolved ts of a partition, which is the watermark sent by TiCDC,
+// all events after it on the same partition must have a larger commit ts.
+type partitionResolved struct {
+	ResolvedTs uint64 `json:"resolvedTs"`
+	// AdvancedAt is the time the resolved ts advanced the last time,
+	// or the time the partition is first observed if no watermark is received yet.
+	AdvancedAt time.Time `json:"advancedAt"`
+	// Stalled is true if the resolved ts does not advance within the stall threshold.
+	Stalled bool `json:"stalled,omitempty"`
+}
+
+// resolvedTracker tracks the resolved ts of each partition, it's shared by the verification and the stall detection.
+type resolvedTracker struct {
+	mu sync.Mutex
+	// stall is the threshold to alert if the resolved ts does not advance, disabled if 0.
+	stall      time.Duration
+	partitions map[int]*partitionResolved
+	// stalls is the number of times any partition stalls.
+	stalls uint64
+	// coverage tracks the commit ts coverage of the run along with the resolved ts.
+	coverage *commitTsCoverage
+}
+
+// newResolvedTracker returns the tracker seeded by the resolved ts of the checkpoint,
+// jump is the threshold to detect the resolved ts jumping far ahead of the last event, see commitTsCoverage.
+func newResolvedTracker(stall, jump time.Duration, state *checkpoint, now time.Time) *resolvedTracker {
+	t := &resolvedTracker{
+		stall: stall, partitions: make(map[int]*partitionResolved), coverage: newCommitTsCoverage(jump),
+	}
+	if state == nil {
+		return t
+	}
+	for partition, p := range state.Partitions {
+		t.partitions[partition] = &partitionResolved{ResolvedTs: p.ResolvedTs, AdvancedAt: now}
+	}
+	return t
+}
+
+// observe checks the commit ts of the message against the resolved ts of the partition,
+// then advances the resolved ts if the message is a watermark.
+// It returns errOrderingViolation if the commit ts is not larger than the resolved ts already seen,
+// since every event of the commit ts must be sent before the watermark resolving it.
+func (t *resolvedTracker) observe(partition int, result messageResult, now time.Time) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	p, ok := t.partitions[partition]
+	if !ok {
+		p = &partitionResolved{AdvancedAt: now}
+		t.partitions[partition] = p
+	}
+	if result.commitTs != 0 && result.commitTs <= p.ResolvedTs {
+		return fmt.Errorf("%w: commit ts %d is not larger than the resolved ts %d of partition %d",
+			errOrderingViolation, result.commitTs, p.ResolvedTs, partition)
+	}
+	t.coverage.observe(partition, result)
+	if result.resolvedTs > p.ResolvedTs {
+		if p.Stalled {
+			log.Info("resolved ts advances again", zap.Int("partition", partition),
+				zap.Uint64("resolvedTs", result.resolvedTs), zap.Duration("stalledFor", now.Sub(p.AdvancedAt)))
+		}
+		p.ResolvedTs, p.AdvancedAt, p.Stalled = result.resolvedTs, now, false
+	}
+	return nil
+}
+
+// detectStalls alerts the partitions whose resolved ts does not advance within the threshold,
+// each stall is alerted once until the resolved ts advances again.
+func (t *resolvedTracker) detectStalls(now time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.stall <= 0 {
+		return
+	}
+	for partition, p := range t.partitions {
+		if p.Stalled || now.Sub(p.AdvancedAt) < t.stall {
+			continue
+		}
+		p.Stalled = true
+		t.stalls++
+		log.Error("resolved ts stalls, the changefeed may be stuck", zap.Int("partition", partition),
+			zap.Uint64("resolvedTs", p.ResolvedTs), zap.Time("advancedAt", p.AdvancedAt),
+			zap.Duration("threshold", t.stall))
+	}
+}
+
+// checkInterval returns the interval to detect the stalls.
+func (t *resolvedTracker) checkInterval() time.Duration {
+	if t.stall < resolvedTsCheckInterval {
+		return t.stall
+	}
+	return resolvedTsCheckInterval
+}
+
+// snapshot returns the resolved ts of all partitions and the number of stalls.
+func (t *resolvedTracker) snapshot() (map[int]partitionResolved, uint64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	result := make(map[int]partitionResolved, len(t.partitions))
+	for partition, p := range t.partitions {
+		result[partition] = *p
+	}
+	return result, t.stalls
+}
+
+// coverageSnapshot returns the commit ts coverage, nil if nothing is covered.
+func (t *resolvedTracker) coverageSnapshot() *coverageReport {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.coverage.snapshot()
+}
@@ -0,0 +1,118 @@
+// Copyright 2023 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestCanalJSONWatermark(ts uint64) string {
+	return fmt.Sprintf(`{"id":0,"database":"","table":"","pkNames":null,"isDdl":false,"type":"TIDB_WATERMARK",`+
+		`"es":1,"ts":1,"sql":"","sqlType":null,"mysqlType":null,"data":null,"old":null,"_tidb":{"watermarkTs":%d}}`, ts)
+}
+
+func TestAvroCheckpointEvent(t *testing.T) {
+	t.Parallel()
+
+	value := binary.BigEndian.AppendUint64([]byte{avroCheckpointByte}, 100)
+	result, err := (&avroVerifier{}).verify(kafka.Message{Value: value})
+	require.NoError(t, err)
+	require.Equal(t, outcomeSkippedNonRow, result.outcome)
+	require.Equal(t, uint64(100), result.resolvedTs)
+
+	_, err = (&avroVerifier{}).verify(kafka.Message{Value: value[:5]})
+	require.Error(t, err)
+}
+
+func TestResolvedOrdering(t *testing.T) {
+	t.Parallel()
+
+	cfg := newDefaultConfig()
+	cfg.protocol = protocolCanalJSON
+	row := func(offset int64, partition int, commitTs uint64) kafka.Message {
+		value := newTestCanalJSONMessage("INSERT", `[{"id":"1","name":"b","data":"é\u0001"}]`, `null`,
+			fmt.Sprintf(`{"commitTs":%d,"_checksum":{"current":%d}}`, commitTs, testCanalJSONChecksum(1, "b", []byte{0xe9, 0x01})))
+		return kafka.Message{Topic: "test", Partition: partition, Offset: offset, Value: []byte(value)}
+	}
+	watermark := func(offset int64, partition int, ts uint64) kafka.Message {
+		return kafka.Message{Topic: "test", Partition: partition, Offset: offset, Value: []byte(newTestCanalJSONWatermark(ts))}
+	}
+	reader := &fakeReader{messages: []kafka.Message{
+		row(0, 0, 100),
+		row(1, 0, 200),
+		watermark(2, 0, 200),
+		// the same commit ts as the resolved ts, arriving after the watermark, is also a violation.
+		row(3, 0, 200),
+		row(4, 0, 150),
+		// the resolved ts never goes back.
+		watermark(5, 0, 120),
+		// the resolved ts is tracked by the partition.
+		row(0, 1, 150),
+	}}
+	v := newTestVerifier(cfg, reader)
+
+	err := v.run(context.Background())
+	require.Equal(t, exitCodeOrderingError, v.finish(err))
+	// the violated message is verified and committed.
+	require.Equal(t, []int64{0, 1, 2, 3, 4, 5, 0}, reader.committedOffsets())
+	require.Equal(t, counters{Messages: 7, Verified: 5, SkippedNonRow: 2, OrderingErrors: 2}, v.counters)
+	require.Len(t, v.report.Failures, 2)
+	require.Equal(t, failureKindOrdering, v.report.Failures[0].Kind)
+	require.Equal(t, int64(3), v.report.Failures[0].Offset)
+	require.Contains(t, v.report.Failures[0].Error, "commit ts 200 is not larger than the resolved ts 200 of partition 0")
+	require.Equal(t, int64(4), v.report.Failures[1].Offset)
+	require.Contains(t, v.report.Failures[1].Error, "commit ts 150 is not larger than the resolved ts 200 of partition 0")
+	require.Equal(t, uint64(200), v.report.Partitions[0].ResolvedTs)
+	require.Equal(t, uint64(0), v.report.Partitions[1].ResolvedTs)
+}
+
+func TestResolvedStall(t *testing.T) {
+	t.Parallel()
+
+	now := time.Now()
+	state := newCheckpoint("test")
+	state.Partitions[0] = partitionCheckpoint{Offset: 10, CommitTs: 100, ResolvedTs: 90}
+	tracker := newResolvedTracker(time.Minute, 0, state, now)
+	require.NoError(t, tracker.observe(1, messageResult{resolvedTs: 100}, now))
+	// the resolved ts of the checkpoint is checked after resume.
+	require.ErrorIs(t, tracker.observe(0, messageResult{commitTs: 80}, now), errOrderingViolation)
+
+	tracker.detectStalls(now.Add(30 * time.Second))
+	require.NoError(t, tracker.observe(1, messageResult{resolvedTs: 110}, now.Add(40*time.Second)))
+	tracker.detectStalls(now.Add(time.Minute))
+	// each stall is alerted once.
+	tracker.detectStalls(now.Add(2 * time.Minute))
+	partitions, stalls := tracker.snapshot()
+	require.Equal(t, uint64(2), stalls)
+	require.True(t, partitions[0].Stalled)
+	require.True(t, partitions[1].Stalled)
+
+	require.NoError(t, tracker.observe(0, messageResult{resolvedTs: 120}, now.Add(2*time.Minute)))
+	partitions, _ = tracker.snapshot()
+	require.False(t, partitions[0].Stalled)
+	require.Equal(t, uint64(120), partitions[0].ResolvedTs)
+
+	// the stall detection is disabled.
+	tracker = newResolvedTracker(0, 0, state, now)
+	tracker.detectStalls(now.Add(time.Hour))
+	_, stalls = tracker.snapshot()
+	require.Zero(t, stalls)
+}
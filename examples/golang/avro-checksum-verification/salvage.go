@@ -0,0 +1,100 @@
+// Copyright 2023 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+
+	"avro-checksum-sample/checksum"
+	"github.com/pingcap/log"
+	"go.uber.org/zap"
+)
+
+// maxSalvagedRawValue limits the length of the raw value reported for the column failed.
+const maxSalvagedRawValue = 256
+
+// columnError is a column the checksum calculation cannot handle, found by the salvage mode.
+type columnError struct {
+	Column   string `json:"column"`
+	TiDBType string `json:"tidbType,omitempty"`
+	// RawType and RawValue are the golang type and the value decoded by avro, empty if the value is not found.
+	RawType  string `json:"rawType,omitempty"`
+	RawValue string `json:"rawValue,omitempty"`
+	Error    string `json:"error"`
+}
+
+// withRawValue returns the column failed along with the value decoded by avro, truncated if it's too long.
+func (c columnError) withRawValue(valueMap map[string]interface{}) columnError {
+	if raw, ok := valueMap[c.Column]; ok {
+		c.RawType, c.RawValue = fmt.Sprintf("%T", raw), fmt.Sprintf("%v", raw)
+		if len(c.RawValue) > maxSalvagedRawValue {
+			c.RawValue = c.RawValue[:maxSalvagedRawValue] + "..."
+		}
+	}
+	return c
+}
+
+// salvageAvroColumns handles each column of the row in isolation, and returns those failed,
+// the error is returned if the schema itself cannot be parsed.
+func salvageAvroColumns(valueMap, valueSchema map[string]interface{}) ([]columnError, error) {
+	fields, err := avroFields(valueSchema)
+	if err != nil {
+		return nil, err
+	}
+	var result []columnError
+	for _, field := range fields {
+		name, _ := field["name"].(string)
+		if name == "_tidb_op" {
+			break
+		}
+		tidbType, _ := avroParameters(field)["tidb_type"].(string)
+		failed := func(err error) {
+			c := columnError{Column: name, TiDBType: tidbType, Error: err.Error()}
+			result = append(result, c.withRawValue(valueMap))
+		}
+
+		column, err := parseAvroColumn(name, field)
+		if err != nil {
+			failed(err)
+			continue
+		}
+		value, err := avroColumnValue(valueMap, column)
+		if err != nil {
+			failed(err)
+			continue
+		}
+		if _, err := checksum.Bytes([]checksum.FieldMeta{column.meta}, []interface{}{value}); err != nil {
+			failed(err)
+		}
+	}
+	return result, nil
+}
+
+// salvageRow reports the row as not computable if any column fails in isolation, in the salvage mode,
+// so that the verification goes on. Otherwise, the error is returned as is.
+func (a *avroVerifier) salvageRow(
+	result messageResult, valueMap, valueSchema map[string]interface{}, err error,
+) (messageResult, error) {
+	if !a.salvage {
+		return result, err
+	}
+	columns, salvageErr := salvageAvroColumns(valueMap, valueSchema)
+	if salvageErr != nil || len(columns) == 0 {
+		return result, err
+	}
+	log.Warn("checksum not computable, the columns failed are reported",
+		zap.String("table", result.table), zap.Uint64("commitTs", result.commitTs), zap.Any("columns", columns))
+	result.outcome, result.columnErrors = outcomeNotComputable, columns
+	return result, nil
+}
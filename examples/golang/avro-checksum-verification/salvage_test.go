@@ -0,0 +1,89 @@
+// Copyright 2023 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/segmentio/kafka-go"
+	"github.com/stretchr/testify/require"
+)
+
+// testSalvageSchema is the value schema of the table `test`.`t` with the columns the verifier cannot handle,
+// `v` is of an unknown TiDB type, and `n` is an INT encoded as the string.
+var testSalvageSchema = strings.Replace(testValueSchema,
+	`{"name": "_tidb_op"`,
+	`{"name": "v", "type": {"type": "string", "connect.parameters": {"tidb_type": "VECTOR"}}},
+    {"name": "n", "type": {"type": "string", "connect.parameters": {"tidb_type": "INT"}}},
+    {"name": "_tidb_op"`, 1)
+
+const testSalvageSchemaID = 4
+
+func newSalvageTestMessage(t *testing.T, offset int64) kafka.Message {
+	name := "a"
+	row := newTestRow(1, &name, 400000000000000000+offset, "1")
+	row["v"], row["n"] = "[1,2]", "abc"
+	value := encodeTestMessage(t, testSalvageSchemaID, testSalvageSchema, row)
+	return kafka.Message{Topic: "test", Offset: offset, Value: value}
+}
+
+func TestSalvage(t *testing.T) {
+	t.Parallel()
+
+	registry := newTestRegistry(t, map[int]string{testSchemaID: testValueSchema, testSalvageSchemaID: testSalvageSchema})
+	cfg := newDefaultConfig()
+	cfg.schemaRegistryURL = registry.URL
+	v, err := newMessageVerifier(cfg)
+	require.NoError(t, err)
+	_, err = v.verify(newSalvageTestMessage(t, 0))
+	require.ErrorContains(t, err, `column n: avro type "string" contradicts the tidb_type INT`)
+	// the INT encoded as the string is left to the parse of the column to be salvaged.
+	cfg.skipSchemaCheck = true
+	v, err = newMessageVerifier(cfg)
+	require.NoError(t, err)
+	_, err = v.verify(newSalvageTestMessage(t, 0))
+	require.ErrorContains(t, err, "unknown TiDB type VECTOR")
+
+	cfg.salvage = true
+	reader := &fakeReader{messages: []kafka.Message{
+		newSalvageTestMessage(t, 0), newVerifiedTestMessage(t, 1, 1, "a"),
+	}}
+	verifier := newTestVerifier(cfg, reader)
+	require.NoError(t, verifier.run(context.Background()))
+	require.Equal(t, exitCodeDecodeError, verifier.finish(nil))
+	// the verification goes on after the row not computable.
+	require.Equal(t, []int64{0, 1}, reader.committedOffsets())
+	require.Equal(t, uint64(1), verifier.counters.NotComputable)
+	require.Equal(t, uint64(1), verifier.counters.Verified)
+	require.Zero(t, verifier.counters.DecodeErrors)
+	require.Zero(t, verifier.counters.Mismatches)
+
+	require.Len(t, verifier.report.Failures, 1)
+	f := verifier.report.Failures[0]
+	require.Equal(t, failureKindNotComputable, f.Kind)
+	require.Equal(t, "test.t", f.Table)
+	require.Len(t, f.Columns, 2)
+	require.Equal(t, columnError{
+		Column: "v", TiDBType: "VECTOR", RawType: "string", RawValue: "[1,2]",
+		Error: "column v: unknown TiDB type VECTOR",
+	}, f.Columns[0])
+	require.Equal(t, "n", f.Columns[1].Column)
+	require.Equal(t, "abc", f.Columns[1].RawValue)
+	require.Contains(t, f.Columns[1].Error, "invalid syntax")
+
+	cfg.protocol = protocolCanalJSON
+	require.ErrorContains(t, cfg.validate(), "only the avro protocol is supported by the salvage mode")
+}
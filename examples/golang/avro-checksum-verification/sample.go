@@ -0,0 +1,217 @@
+// Copyright 2023 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// sampler decides whether the message is verified by its position, a nil sampler verifies all messages.
+// The decision is deterministic, so that the reruns verify the same messages.
+type sampler struct {
+	// rate is the ratio of the messages verified, in (0, 1].
+	rate float64
+	// everyN verifies the message whose offset is a multiple of it, disabled if 0.
+	everyN int64
+}
+
+// newSampler returns nil if all messages are verified.
+func newSampler(cfg *config) *sampler {
+	if cfg.sampleEveryN > 1 {
+		return &sampler{everyN: int64(cfg.sampleEveryN)}
+	}
+	if cfg.sampleRate < 1 {
+		return &sampler{rate: cfg.sampleRate}
+	}
+	return nil
+}
+
+func (s *sampler) sampled(partition int, offset int64) bool {
+	if s == nil {
+		return true
+	}
+	if s.everyN > 0 {
+		return offset%s.everyN == 0
+	}
+	h := mix64(mix64(uint64(partition)) ^ uint64(offset))
+	// the top 53 bits are uniformly distributed in [0, 1) as a float64.
+	return float64(h>>11)/(1<<53) < s.rate
+}
+
+// mix64 is the finalizer of splitmix64, which spreads the sequential offsets over the whole range.
+func mix64(x uint64) uint64 {
+	x += 0x9e3779b97f4a7c15
+	x = (x ^ (x >> 30)) * 0xbf58476d1ce4e5b9
+	x = (x ^ (x >> 27)) * 0x94d049bb133111eb
+	return x ^ (x >> 31)
+}
+
+// avroCommitTs reads the `_tidb_commit_ts` of the avro value without decoding the other fields,
+// the fields before it are skipped by their encoded length. It returns 0 if the schema does not have it.
+func avroCommitTs(valueSchema map[string]interface{}, data []byte) (uint64, error) {
+	fields, _ := valueSchema["fields"].([]interface{})
+	for _, item := range fields {
+		field, ok := item.(map[string]interface{})
+		if !ok {
+			return 0, errors.New("schema field should be a map")
+		}
+		if field["name"] == "_tidb_commit_ts" {
+			ts, _, err := readAvroLong(field["type"], data)
+			return uint64(ts), err
+		}
+		var err error
+		if data, err = skipAvro(field["type"], data); err != nil {
+			return 0, err
+		}
+	}
+	return 0, nil
+}
+
+// readAvroLong reads the long value, or the long branch of the union, 0 if it's null.
+func readAvroLong(schema interface{}, data []byte) (int64, []byte, error) {
+	switch t := schema.(type) {
+	case []interface{}:
+		index, data, err := readAvroVarint(data)
+		if err != nil {
+			return 0, nil, err
+		}
+		if index < 0 || int(index) >= len(t) {
+			return 0, nil, fmt.Errorf("invalid avro union index %d", index)
+		}
+		if t[index] == "null" {
+			return 0, data, nil
+		}
+		return readAvroLong(t[index], data)
+	case map[string]interface{}:
+		return readAvroLong(t["type"], data)
+	case string:
+		if t == "long" || t == "int" {
+			return readAvroVarint(data)
+		}
+	}
+	return 0, nil, fmt.Errorf("invalid avro type %v of the commit ts", schema)
+}
+
+// skipAvro skips the value of the avro type, returns the remaining data.
+func skipAvro(schema interface{}, data []byte) ([]byte, error) {
+	switch t := schema.(type) {
+	case string:
+		switch t {
+		case "null":
+			return data, nil
+		case "boolean":
+			return skipAvroBytes(data, 1)
+		case "int", "long", "enum":
+			_, data, err := readAvroVarint(data)
+			return data, err
+		case "float":
+			return skipAvroBytes(data, 4)
+		case "double":
+			return skipAvroBytes(data, 8)
+		case "bytes", "string":
+			length, data, err := readAvroVarint(data)
+			if err != nil {
+				return nil, err
+			}
+			return skipAvroBytes(data, length)
+		}
+	case []interface{}:
+		index, data, err := readAvroVarint(data)
+		if err != nil {
+			return nil, err
+		}
+		if index < 0 || int(index) >= len(t) {
+			return nil, fmt.Errorf("invalid avro union index %d", index)
+		}
+		return skipAvro(t[index], data)
+	case map[string]interface{}:
+		switch t["type"] {
+		case "record":
+			fields, _ := t["fields"].([]interface{})
+			for _, item := range fields {
+				field, _ := item.(map[string]interface{})
+				var err error
+				if data, err = skipAvro(field["type"], data); err != nil {
+					return nil, err
+				}
+			}
+			return data, nil
+		case "enum":
+			return skipAvro("enum", data)
+		case "fixed":
+			size, _ := t["size"].(float64)
+			return skipAvroBytes(data, int64(size))
+		case "array", "map":
+			return nil, fmt.Errorf("unsupported avro type %v", t["type"])
+		}
+		// the primitive type with the logical type or the connect parameters.
+		return skipAvro(t["type"], data)
+	}
+	return nil, fmt.Errorf("unsupported avro type %v", schema)
+}
+
+func readAvroVarint(data []byte) (int64, []byte, error) {
+	// avro encodes the int and long as the zigzag varint, the same as binary.Varint.
+	v, n := binary.Varint(data)
+	if n <= 0 {
+		return 0, nil, errors.New("invalid avro varint")
+	}
+	return v, data[n:], nil
+}
+
+func skipAvroBytes(data []byte, n int64) ([]byte, error) {
+	if n < 0 || int64(len(data)) < n {
+		return nil, errors.New("avro data is truncated")
+	}
+	return data[n:], nil
+}
+
+// samplingReport states the sampling of the run, so that the result is not mistaken for a full verification.
+type samplingReport struct {
+	// Mode is `rate` or `every-n`.
+	Mode   string  `json:"mode"`
+	Rate   float64 `json:"rate,omitempty"`
+	EveryN int     `json:"everyN,omitempty"`
+	// SampledMessages are those went through the full verification, UnsampledMessages are only committed.
+	SampledMessages   uint64 `json:"sampledMessages"`
+	UnsampledMessages uint64 `json:"unsampledMessages"`
+	// EffectiveRate is the ratio of the sampled messages in all consumed messages.
+	EffectiveRate float64 `json:"effectiveRate"`
+	Note          string  `json:"note"`
+}
+
+// newSamplingReport returns nil if all messages are verified.
+func newSamplingReport(cfg *config, c counters) *samplingReport {
+	s := newSampler(cfg)
+	if s == nil {
+		return nil
+	}
+	result := &samplingReport{
+		SampledMessages:   c.Messages - c.Unsampled,
+		UnsampledMessages: c.Unsampled,
+	}
+	if s.everyN > 0 {
+		result.Mode, result.EveryN = "every-n", cfg.sampleEveryN
+	} else {
+		result.Mode, result.Rate = "rate", s.rate
+	}
+	if c.Messages > 0 {
+		result.EffectiveRate = float64(result.SampledMessages) / float64(c.Messages)
+	}
+	result.Note = fmt.Sprintf("partial verification, only %.2f%% of the messages are verified, "+
+		"mismatches in the unsampled messages are not found", result.EffectiveRate*100)
+	return result
+}
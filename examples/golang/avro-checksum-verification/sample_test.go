@@ -0,0 +1,149 @@
+// Copyright 2023 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/segmentio/kafka-go"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSampler(t *testing.T) {
+	t.Parallel()
+
+	cfg := newDefaultConfig()
+	require.Nil(t, newSampler(cfg))
+	cfg.sampleEveryN = 1
+	require.Nil(t, newSampler(cfg))
+
+	cfg.sampleEveryN = 0
+	cfg.sampleRate = 0.1
+	s := newSampler(cfg)
+	var sampled int
+	for offset := int64(0); offset < 100000; offset++ {
+		if s.sampled(3, offset) {
+			sampled++
+		}
+		// the decision is deterministic by the position.
+		require.Equal(t, s.sampled(3, offset), newSampler(cfg).sampled(3, offset))
+	}
+	require.InDelta(t, 10000, sampled, 500)
+
+	cfg.sampleRate = 1
+	cfg.sampleEveryN = 3
+	s = newSampler(cfg)
+	require.True(t, s.sampled(0, 0))
+	require.False(t, s.sampled(0, 1))
+	require.True(t, s.sampled(1, 3))
+
+	cfg.sampleRate = 0.5
+	require.ErrorContains(t, cfg.validate(), "cannot be set at the same time")
+	cfg.sampleEveryN = 0
+	cfg.sampleRate = 0
+	require.ErrorContains(t, cfg.validate(), "sample rate must be in (0, 1]")
+	cfg.sampleRate = 0.5
+	cfg.protocol = protocolCanalJSON
+	require.ErrorContains(t, cfg.validate(), "only the avro protocol is supported by the sampling")
+}
+
+func TestSamplingReported(t *testing.T) {
+	t.Parallel()
+
+	registry := newTestRegistry(t, map[int]string{testSchemaID: testValueSchema})
+	cfg := newDefaultConfig()
+	cfg.schemaRegistryURL = registry.URL
+	cfg.sampleEveryN = 2
+	require.NoError(t, cfg.validate())
+
+	reader := &fakeReader{messages: []kafka.Message{
+		newVerifiedTestMessage(t, 0, 1, "a"),
+		// the mismatch in the unsampled message is not found.
+		newMismatchTestMessage(t, 1, 2, "b"),
+		newVerifiedTestMessage(t, 2, 3, "c"),
+		newMismatchTestMessage(t, 3, 4, "d"),
+	}}
+	v := newTestVerifier(cfg, reader)
+	err := v.run(context.Background())
+	require.Equal(t, exitCodeClean, v.finish(err))
+	require.Equal(t, []int64{0, 1, 2, 3}, reader.committedOffsets())
+	require.Equal(t, counters{Messages: 4, Verified: 2, Unsampled: 2}, v.counters)
+	require.Equal(t, &samplingReport{
+		Mode:              "every-n",
+		EveryN:            2,
+		SampledMessages:   2,
+		UnsampledMessages: 2,
+		EffectiveRate:     0.5,
+		Note:              "partial verification, only 50.00% of the messages are verified, mismatches in the unsampled messages are not found",
+	}, v.report.Sampling)
+
+	// the header of the unsampled message is still validated.
+	reader = &fakeReader{messages: []kafka.Message{{Topic: "test", Offset: 1, Value: []byte{0xff, 0, 0, 0, 1}}}}
+	v = newTestVerifier(cfg, reader)
+	err = v.run(context.Background())
+	require.Equal(t, exitCodeDecodeError, v.finish(err))
+
+	// all messages are verified without sampling.
+	cfg.sampleEveryN = 0
+	v = newTestVerifier(cfg, &fakeReader{})
+	v.finish(v.run(context.Background()))
+	require.Nil(t, v.report.Sampling)
+}
+
+func TestAvroCommitTs(t *testing.T) {
+	t.Parallel()
+
+	schema := make(map[string]interface{})
+	require.NoError(t, json.Unmarshal([]byte(testValueSchema), &schema))
+	name := "a"
+	for _, native := range []map[string]interface{}{newTestRow(1, &name, 400000000000000001, ""), newTestRow(-7, nil, 3, "1")} {
+		value := encodeTestMessage(t, testSchemaID, testValueSchema, native)
+		commitTs, err := avroCommitTs(schema, value[5:])
+		require.NoError(t, err)
+		require.Equal(t, uint64(native["_tidb_commit_ts"].(int64)), commitTs)
+	}
+	value := encodeTestMessage(t, testSchemaID, testValueSchema, newTestRow(1, &name, 100, ""))
+	_, err := avroCommitTs(schema, value[5:8])
+	require.Error(t, err)
+}
+
+func TestUnsampledReachEnd(t *testing.T) {
+	t.Parallel()
+
+	registry := newTestRegistry(t, map[int]string{testSchemaID: testValueSchema})
+	cfg := newDefaultConfig()
+	cfg.schemaRegistryURL = registry.URL
+	cfg.sampleEveryN = 2
+	cfg.endCommitTs = "400000000000000000"
+	cfg.bounded = true
+	require.NoError(t, cfg.validate())
+
+	reader := &fakeReader{messages: []kafka.Message{
+		newVerifiedTestMessage(t, 0, 1, "a"),
+		// the unsampled message past the end commit ts ends the run by its commit ts.
+		newMismatchTestMessage(t, 1, 2, "b"),
+		newVerifiedTestMessage(t, 2, 3, "c"),
+	}}
+	v := newTestVerifier(cfg, reader)
+	v.partitions = []int{0}
+	v.pastEnd = make(map[int]struct{})
+	v.endTs = 400000000000000000
+
+	err := v.run(context.Background())
+	require.Equal(t, exitCodeClean, v.finish(err))
+	require.Equal(t, []int64{0, 1}, reader.committedOffsets())
+	require.Equal(t, counters{Messages: 2, Verified: 1, Unsampled: 1}, v.counters)
+}
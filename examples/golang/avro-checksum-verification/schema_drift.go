@@ -0,0 +1,144 @@
+// Copyright 2023 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+)
+
+// errSchemaDrift is returned by `--freeze-schema` if the schema ID of a table changes.
+var errSchemaDrift = errors.New("schema of the table drifts")
+
+// schemaDiff is the field level difference between two value schemas of a table.
+type schemaDiff struct {
+	Added   []string `json:"added,omitempty"`
+	Removed []string `json:"removed,omitempty"`
+	// Retyped are the columns whose tidb_type changes, such as `age: INT -> BIGINT`.
+	Retyped []string `json:"retyped,omitempty"`
+	// ParametersChanged are the columns whose other connect.parameters change, such as the allowed enum values.
+	ParametersChanged []string `json:"parametersChanged,omitempty"`
+}
+
+// diffAvroSchemas returns the difference of the columns from the old value schema to the new one.
+func diffAvroSchemas(oldSchema, newSchema map[string]interface{}) *schemaDiff {
+	oldFields, newFields := avroColumnFields(oldSchema), avroColumnFields(newSchema)
+	diff := &schemaDiff{}
+	for _, name := range sortedFieldNames(newFields) {
+		newField := newFields[name]
+		oldField, ok := oldFields[name]
+		if !ok {
+			diff.Added = append(diff.Added, name)
+			continue
+		}
+		if oldType, newType := avroTiDBType(oldField), avroTiDBType(newField); oldType != newType {
+			diff.Retyped = append(diff.Retyped, fmt.Sprintf("%s: %s -> %s", name, oldType, newType))
+			continue
+		}
+		oldParameters, newParameters := avroParameters(oldField), avroParameters(newField)
+		if !reflect.DeepEqual(oldParameters, newParameters) {
+			oldJSON, _ := json.Marshal(oldParameters)
+			newJSON, _ := json.Marshal(newParameters)
+			diff.ParametersChanged = append(diff.ParametersChanged, fmt.Sprintf("%s: %s -> %s", name, oldJSON, newJSON))
+		}
+	}
+	for _, name := range sortedFieldNames(oldFields) {
+		if _, ok := newFields[name]; !ok {
+			diff.Removed = append(diff.Removed, name)
+		}
+	}
+	return diff
+}
+
+// avroColumnFields returns the column fields of the value schema by name, the fields since `_tidb_op` are not columns.
+func avroColumnFields(schema map[string]interface{}) map[string]map[string]interface{} {
+	fields, _ := schema["fields"].([]interface{})
+	result := make(map[string]map[string]interface{}, len(fields))
+	for _, item := range fields {
+		field, ok := item.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		name, _ := field["name"].(string)
+		if name == "_tidb_op" {
+			break
+		}
+		result[name] = field
+	}
+	return result
+}
+
+func sortedFieldNames(fields map[string]map[string]interface{}) []string {
+	names := make([]string, 0, len(fields))
+	for name := range fields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// schemaDrift records the change of the schema ID of a table, at the first message carrying the new one.
+type schemaDrift struct {
+	Table        string `json:"table"`
+	FromSchemaID int    `json:"fromSchemaId"`
+	ToSchemaID   int    `json:"toSchemaId"`
+	Topic        string `json:"topic"`
+	Partition    int    `json:"partition"`
+	Offset       int64  `json:"offset"`
+	CommitTs     uint64 `json:"commitTs,omitempty"`
+	// Diff is nil if the old schema is not available.
+	Diff *schemaDiff `json:"diff,omitempty"`
+	// Flapping means the schema ID changes back to the previous one, which may indicate a misbehaving producer.
+	Flapping bool `json:"flapping,omitempty"`
+	// Count is the number of times the same transition happens, only the first one is located.
+	Count uint64 `json:"count"`
+}
+
+// schemaDriftTracker tracks the current schema ID of each table.
+type schemaDriftTracker struct {
+	current map[string]int
+	// previous is the schema ID before the current one, the table flaps if it changes back to it.
+	previous map[string]int
+}
+
+func newSchemaDriftTracker() *schemaDriftTracker {
+	return &schemaDriftTracker{current: make(map[string]int), previous: make(map[string]int)}
+}
+
+// observe records the schema ID of the table, and returns the drift if it changes, nil otherwise.
+// The position and the diff of the drift are filled by the caller.
+func (t *schemaDriftTracker) observe(table string, schemaID int) *schemaDrift {
+	if table == "" {
+		return nil
+	}
+	current, ok := t.current[table]
+	t.current[table] = schemaID
+	if !ok || current == schemaID {
+		return nil
+	}
+	previous, ok := t.previous[table]
+	t.previous[table] = current
+	return &schemaDrift{
+		Table: table, FromSchemaID: current, ToSchemaID: schemaID, Flapping: ok && previous == schemaID, Count: 1,
+	}
+}
+
+// driftError returns the error reported by `--freeze-schema`.
+func driftError(drift *schemaDrift) error {
+	return fmt.Errorf("%w, schema ID of %s changes from %d to %d", errSchemaDrift,
+		drift.Table, drift.FromSchemaID, drift.ToSchemaID)
+}
@@ -0,0 +1,117 @@
+// Copyright 2023 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/segmentio/kafka-go"
+	"github.com/stretchr/testify/require"
+)
+
+// testAlteredSchema is the value schema of the table `test`.`t` after
+// `ALTER TABLE t MODIFY name VARCHAR(10), ADD COLUMN age INT`, the name is still a TEXT to TiCDC with the new length.
+var testAlteredSchema = strings.Replace(testValueSchema,
+	`{"name": "name", "type": ["null", {"type": "string", "connect.parameters": {"tidb_type": "TEXT"}}], "default": null},`,
+	`{"name": "name", "type": ["null", {"type": "string", "connect.parameters": {"tidb_type": "TEXT", "length": "10"}}], "default": null},
+    {"name": "age", "type": ["null", {"type": "int", "connect.parameters": {"tidb_type": "INT"}}], "default": null},`, 1)
+
+const testAlteredSchemaID = 3
+
+func TestDiffAvroSchemas(t *testing.T) {
+	t.Parallel()
+
+	parse := func(schema string) map[string]interface{} {
+		result := make(map[string]interface{})
+		require.NoError(t, json.Unmarshal([]byte(schema), &result))
+		return result
+	}
+	diff := diffAvroSchemas(parse(testValueSchema), parse(testAlteredSchema))
+	require.Equal(t, &schemaDiff{
+		Added:             []string{"age"},
+		ParametersChanged: []string{`name: {"tidb_type":"TEXT"} -> {"length":"10","tidb_type":"TEXT"}`},
+	}, diff)
+
+	retyped := strings.Replace(testValueSchema, `"tidb_type": "BIGINT"`, `"tidb_type": "INT"`, 1)
+	diff = diffAvroSchemas(parse(testAlteredSchema), parse(retyped))
+	require.Equal(t, &schemaDiff{
+		Removed:           []string{"age"},
+		Retyped:           []string{"id: BIGINT -> INT"},
+		ParametersChanged: []string{`name: {"length":"10","tidb_type":"TEXT"} -> {"tidb_type":"TEXT"}`},
+	}, diff)
+}
+
+func TestSchemaDriftReported(t *testing.T) {
+	t.Parallel()
+
+	registry := newTestRegistry(t, map[int]string{testSchemaID: testValueSchema, testAlteredSchemaID: testAlteredSchema})
+	altered := func(offset int64) kafka.Message {
+		name := "a"
+		native := newTestRow(1, &name, 400000000000000000+offset, strconv.FormatUint(uint64(testRowChecksum(1, &name)), 10))
+		native["age"] = nil
+		return kafka.Message{Topic: "test", Offset: offset,
+			Value: encodeTestMessage(t, testAlteredSchemaID, testAlteredSchema, native)}
+	}
+	messages := []kafka.Message{
+		newVerifiedTestMessage(t, 0, 1, "a"),
+		newVerifiedTestMessage(t, 1, 1, "a"),
+		altered(2),
+		// the schema ID changes back and forth.
+		newVerifiedTestMessage(t, 3, 1, "a"),
+		altered(4),
+	}
+	cfg := newDefaultConfig()
+	cfg.schemaRegistryURL = registry.URL
+	require.NoError(t, cfg.validate())
+
+	reader := &fakeReader{messages: messages}
+	v := newTestVerifier(cfg, reader)
+	err := v.run(context.Background())
+	require.Equal(t, exitCodeClean, v.finish(err))
+	require.Equal(t, counters{Messages: 5, Verified: 5}, v.counters)
+	require.Len(t, v.report.SchemaDrifts, 2)
+	drift := v.report.SchemaDrifts[0]
+	require.Equal(t, "test.t", drift.Table)
+	require.Equal(t, testSchemaID, drift.FromSchemaID)
+	require.Equal(t, testAlteredSchemaID, drift.ToSchemaID)
+	require.Equal(t, int64(2), drift.Offset)
+	require.Equal(t, uint64(400000000000000002), drift.CommitTs)
+	require.Equal(t, []string{"age"}, drift.Diff.Added)
+	// the same transition is counted, and called out as flapping.
+	require.Equal(t, uint64(2), drift.Count)
+	require.True(t, drift.Flapping)
+	drift = v.report.SchemaDrifts[1]
+	require.Equal(t, testAlteredSchemaID, drift.FromSchemaID)
+	require.Equal(t, int64(3), drift.Offset)
+	require.Equal(t, []string{"age"}, drift.Diff.Removed)
+	require.True(t, drift.Flapping)
+
+	// the drift fails the message if the schema is frozen.
+	cfg.freezeSchema = true
+	require.NoError(t, cfg.validate())
+	reader = &fakeReader{messages: messages}
+	v = newTestVerifier(cfg, reader)
+	err = v.run(context.Background())
+	require.ErrorIs(t, err, errSchemaDrift)
+	require.Equal(t, exitCodeDecodeError, v.finish(err))
+	require.Equal(t, []int64{0, 1}, reader.committedOffsets())
+	require.Len(t, v.report.SchemaDrifts, 1)
+
+	cfg.protocol = protocolCanalJSON
+	require.ErrorContains(t, cfg.validate(), "only the avro protocol is supported by the schema freezing")
+}
@@ -0,0 +1,83 @@
+// Copyright 2023 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// avroPhysicalTypes are the avro types each TiDB type is encoded as by TiCDC, in any of the handling modes,
+// including the ones of the temporal logical types.
+var avroPhysicalTypes = map[string][]string{
+	"INT":             {"int", "long"},
+	"INT UNSIGNED":    {"int", "long"},
+	"BIGINT":          {"long"},
+	"BIGINT UNSIGNED": {"long", "string"},
+	"FLOAT":           {"float", "double"},
+	"DOUBLE":          {"double"},
+	"BIT":             {"bytes"},
+	"DECIMAL":         {"bytes", "string"},
+	"TEXT":            {"string", "bytes"},
+	"BLOB":            {"bytes", "string"},
+	"ENUM":            {"string"},
+	"SET":             {"string"},
+	"JSON":            {"string"},
+	"DATE":            {"string", "int"},
+	"DATETIME":        {"string", "long"},
+	"TIMESTAMP":       {"string", "long"},
+	"TIME":            {"string", "int", "long"},
+	"YEAR":            {"int", "long"},
+}
+
+// checkAvroSchemaTypes checks the avro type of each column of the value schema is one its tidb_type is encoded as,
+// so that the schema contradicting itself fails before any value of it is verified,
+// rather than the bytes of the column are garbage and reported as a mismatch.
+func checkAvroSchemaTypes(valueSchema map[string]interface{}) error {
+	fields, err := avroFields(valueSchema)
+	if err != nil {
+		return err
+	}
+	for _, field := range fields {
+		colName, _ := field["name"].(string)
+		if colName == "_tidb_op" {
+			break
+		}
+		if err := checkAvroType(field); err != nil {
+			return fmt.Errorf("column %s: %w", colName, err)
+		}
+	}
+	return nil
+}
+
+// checkAvroType returns the error if the avro type of the field contradicts its tidb_type,
+// the field without the tidb_type or of the unknown TiDB type is left to the parse of the column.
+func checkAvroType(field map[string]interface{}) error {
+	tidbType, _ := avroParameters(field)["tidb_type"].(string)
+	allowed, ok := avroPhysicalTypes[tidbType]
+	if !ok {
+		return nil
+	}
+	avroType, _ := avroFieldType(field)["type"].(string)
+	quoted := make([]string, 0, len(allowed))
+	for _, t := range allowed {
+		if t == avroType {
+			return nil
+		}
+		quoted = append(quoted, strconv.Quote(t))
+	}
+	return fmt.Errorf("avro type %q contradicts the tidb_type %s, which is encoded as %s, "+
+		"set --skip-schema-check if the combination is valid", avroType, tidbType, strings.Join(quoted, " or "))
+}
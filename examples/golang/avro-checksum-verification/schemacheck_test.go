@@ -0,0 +1,143 @@
+// Copyright 2023 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"hash/crc32"
+	"strconv"
+	"strings"
+	"testing"
+
+	"avro-checksum-sample/checksum"
+	"github.com/segmentio/kafka-go"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCheckAvroType(t *testing.T) {
+	t.Parallel()
+
+	// every TiDB type handled by the verifier is checked.
+	for tidbType := range avroPhysicalTypes {
+		_, ok := lookupMySQLType(tidbType)
+		require.True(t, ok, tidbType)
+	}
+
+	for _, c := range []struct {
+		field string
+		err   string
+	}{
+		{field: `{"name": "a", "type": {"type": "long", "connect.parameters": {"tidb_type": "BIGINT"}}}`},
+		{field: `{"name": "a", "type": ["null", {"type": "int", "connect.parameters": {"tidb_type": "INT"}}]}`},
+		{field: `{"name": "a", "type": {"type": "long", "logicalType": "timestamp-micros",
+			"connect.parameters": {"tidb_type": "DATETIME"}}}`},
+		{field: `{"name": "a", "type": {"type": "bytes", "logicalType": "decimal", "scale": 2,
+			"connect.parameters": {"tidb_type": "DECIMAL"}}}`},
+		// the unknown TiDB type and the missing tidb_type are left to the parse.
+		{field: `{"name": "a", "type": {"type": "string", "connect.parameters": {"tidb_type": "VECTOR"}}}`},
+		{field: `{"name": "a", "type": "long"}`},
+		{
+			field: `{"name": "a", "type": {"type": "long", "connect.parameters": {"tidb_type": "DECIMAL"}}}`,
+			err: `avro type "long" contradicts the tidb_type DECIMAL, which is encoded as "bytes" or "string", ` +
+				"set --skip-schema-check if the combination is valid",
+		},
+		{
+			field: `{"name": "a", "type": ["null", {"type": "float", "connect.parameters": {"tidb_type": "DOUBLE"}}]}`,
+			err:   `avro type "float" contradicts the tidb_type DOUBLE, which is encoded as "double"`,
+		},
+		{
+			field: `{"name": "a", "type": {"type": "boolean", "connect.parameters": {"tidb_type": "BIT"}}}`,
+			err:   `avro type "boolean" contradicts the tidb_type BIT`,
+		},
+	} {
+		var field map[string]interface{}
+		require.NoError(t, json.Unmarshal([]byte(c.field), &field))
+		err := checkAvroType(field)
+		if c.err == "" {
+			require.NoError(t, err, c.field)
+		} else {
+			require.ErrorContains(t, err, c.err, c.field)
+		}
+	}
+}
+
+// testContradictSchema is the value schema of the table `test`.`t` whose column `n` is an INT encoded as the string.
+var testContradictSchema = strings.Replace(testValueSchema,
+	`{"name": "_tidb_op"`,
+	`{"name": "n", "type": {"type": "string", "connect.parameters": {"tidb_type": "INT"}}},
+    {"name": "_tidb_op"`, 1)
+
+const testContradictSchemaID = 6
+
+func newContradictTestMessage(t *testing.T, offset int64) kafka.Message {
+	name := "a"
+	row := newTestRow(1, &name, 400000000000000000+offset, "")
+	row["n"] = "7"
+	var valueSchema map[string]interface{}
+	require.NoError(t, json.Unmarshal([]byte(testContradictSchema), &valueSchema))
+	// the INT encoded as the string is converted as the number.
+	metas, values, err := checksumColumns(row, valueSchema)
+	require.NoError(t, err)
+	sum, err := checksum.Calculate(metas, values)
+	require.NoError(t, err)
+	require.Equal(t, crc32.Update(testRowChecksum(1, &name), crc32.IEEETable,
+		binary.LittleEndian.AppendUint64(nil, 7)), sum)
+	row["_tidb_row_level_checksum"] = strconv.FormatUint(uint64(sum), 10)
+	value := encodeTestMessage(t, testContradictSchemaID, testContradictSchema, row)
+	return kafka.Message{Topic: "test", Offset: offset, Value: value}
+}
+
+func TestSchemaCheck(t *testing.T) {
+	t.Parallel()
+
+	registry := newTestRegistry(t, map[int]string{testContradictSchemaID: testContradictSchema})
+	cfg := newDefaultConfig()
+	cfg.schemaRegistryURL = registry.URL
+	reader := &fakeReader{messages: []kafka.Message{newContradictTestMessage(t, 0)}}
+	v := newTestVerifier(cfg, reader)
+	err := v.run(context.Background())
+	// the schema fails once it's first used, before the message is verified.
+	require.Equal(t, exitCodeDecodeError, v.finish(err))
+	require.ErrorContains(t, err,
+		`check the value schema 6 of test.t failed: column n: avro type "string" contradicts the tidb_type INT`)
+	require.Zero(t, v.counters.Verified)
+	require.Zero(t, v.counters.Mismatches)
+
+	// the combination is valid, since the string is parsed as the number.
+	cfg.skipSchemaCheck = true
+	reader = &fakeReader{messages: []kafka.Message{newContradictTestMessage(t, 0)}}
+	v = newTestVerifier(cfg, reader)
+	err = v.run(context.Background())
+	require.Equal(t, exitCodeClean, v.finish(err))
+	require.Equal(t, uint64(1), v.counters.Verified)
+}
+
+func TestAuditSchemaCheck(t *testing.T) {
+	t.Parallel()
+
+	cfg := newDefaultConfig()
+	source := auditSource{schemaID: testContradictSchemaID, source: "test-value@6", content: testContradictSchema}
+	audit := auditSchema(source, cfg)
+	require.Equal(t, verdictUnsupported, audit.Verdict)
+	require.Equal(t, []auditIssue{{Column: "n", Reason: `avro type "string" contradicts the tidb_type INT, ` +
+		`which is encoded as "int" or "long", set --skip-schema-check if the combination is valid`}}, audit.Unsupported)
+
+	cfg.skipSchemaCheck = true
+	require.Equal(t, verdictSupported, auditSchema(source, cfg).Verdict)
+
+	cfg.protocol = protocolCanalJSON
+	require.ErrorContains(t, cfg.validate(), "only the avro protocol checks the schemas")
+}
@@ -0,0 +1,143 @@
+// Copyright 2023 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"sort"
+	"time"
+
+	"github.com/pingcap/log"
+	"go.uber.org/zap"
+)
+
+// schemaRefreshReport is the summary of the schemas fetched again since the cached ones fail to decode the value,
+// such as the subject is re-registered, or the registry is restored from a backup, so the ID points elsewhere.
+type schemaRefreshReport struct {
+	// Refetches is the number of times a schema is fetched again, Recovered is those the value is decoded by then.
+	Refetches uint64 `json:"refetches"`
+	Recovered uint64 `json:"recovered"`
+	// Changed is the number of schemas fetched different from the cached ones, which means the registry drifts.
+	Changed uint64 `json:"changed"`
+	// RateLimited is the number of decode failures not retried, since the schema is fetched again recently.
+	RateLimited uint64 `json:"rateLimited"`
+	// SchemaIDs are the schema IDs fetched again.
+	SchemaIDs []int `json:"schemaIds,omitempty"`
+}
+
+// schemaRefresher limits the schema of each ID to be fetched again at most once in the interval,
+// so that a genuinely corrupted stream does not hammer the schema registry.
+type schemaRefresher struct {
+	interval time.Duration
+	last     map[int]time.Time
+	report   schemaRefreshReport
+}
+
+func newSchemaRefresher(interval time.Duration) *schemaRefresher {
+	return &schemaRefresher{interval: interval, last: make(map[int]time.Time)}
+}
+
+// allow returns true if the schema of the ID can be fetched again now, it's always false if disabled.
+func (r *schemaRefresher) allow(schemaID int, now time.Time) bool {
+	if r.interval <= 0 {
+		return false
+	}
+	last, ok := r.last[schemaID]
+	if ok && now.Sub(last) < r.interval {
+		r.report.RateLimited++
+		return false
+	}
+	if !ok {
+		r.report.SchemaIDs = append(r.report.SchemaIDs, schemaID)
+		sort.Ints(r.report.SchemaIDs)
+	}
+	r.last[schemaID] = now
+	r.report.Refetches++
+	return true
+}
+
+// snapshot returns the summary, nil if no schema is fetched again.
+func (r *schemaRefresher) snapshot() *schemaRefreshReport {
+	if r.report.Refetches == 0 && r.report.RateLimited == 0 {
+		return nil
+	}
+	report := r.report
+	report.SchemaIDs = append([]int(nil), r.report.SchemaIDs...)
+	return &report
+}
+
+// refreshingVerifier is implemented by the message verifier fetching the cached schemas again.
+type refreshingVerifier interface {
+	schemaRefreshes() *schemaRefreshReport
+}
+
+func (a *avroVerifier) schemaRefreshes() *schemaRefreshReport { return a.refresher.snapshot() }
+
+// decodeValue decodes the first record of the value, see getValueMapAndSchema.
+// If the cached schema fails to decode it, the schema may be updated in the registry,
+// the cache is invalidated and the schema is fetched again, then the value is decoded once more.
+func (a *avroVerifier) decodeValue(value []byte) (map[string]interface{}, map[string]interface{}, []byte, error) {
+	valueMap, valueSchema, rest, err := getValueMapAndSchema(value, a.getSchema)
+	if err == nil {
+		return valueMap, valueSchema, rest, nil
+	}
+	schemaID, _, idErr := extractSchemaIDAndBinaryData(value)
+	if idErr != nil {
+		return nil, nil, nil, err
+	}
+	// the schema is not cached if it cannot be fetched, which is not a decode error.
+	cached, ok := a.codecs[schemaID]
+	if !ok || !a.refresher.allow(schemaID, time.Now()) {
+		return nil, nil, nil, err
+	}
+
+	delete(a.codecs, schemaID)
+	codec, fetchErr := a.getSchema(schemaID)
+	if fetchErr != nil {
+		log.Error("fetch the schema again failed", zap.Int("schemaID", schemaID), zap.Error(fetchErr))
+		return nil, nil, nil, newInfraError(fetchErr)
+	}
+	changed := codec.CanonicalSchema() != cached.CanonicalSchema()
+	if changed {
+		a.refresher.report.Changed++
+		a.invalidateSchema(schemaID, codec.Schema())
+	}
+	valueMap, valueSchema, rest, retryErr := getValueMapAndSchema(value, a.getSchema)
+	if retryErr != nil {
+		log.Warn("value still fails to decode by the schema fetched again", zap.Int("schemaID", schemaID),
+			zap.Bool("schemaChanged", changed), zap.NamedError("cachedError", err), zap.Error(retryErr))
+		return nil, nil, nil, retryErr
+	}
+	a.refresher.report.Recovered++
+	log.Warn("value decoded by the schema fetched again, the schema registry may drift",
+		zap.Int("schemaID", schemaID), zap.Bool("schemaChanged", changed), zap.NamedError("cachedError", err))
+	return valueMap, valueSchema, rest, nil
+}
+
+// invalidateSchema drops the caches derived from the previous schema of the ID, and maps the ID to the table again
+// if the schema is of another table now.
+func (a *avroVerifier) invalidateSchema(schemaID int, schema string) {
+	delete(a.valueSchemas, schemaID)
+	delete(a.schemaColumns, schemaID)
+	delete(a.unknownColumns, schemaID)
+	valueSchema := make(map[string]interface{})
+	if err := json.Unmarshal([]byte(schema), &valueSchema); err != nil {
+		return
+	}
+	if table, ok := a.tables.get(schemaID); ok && table.name() != avroTableName(valueSchema) {
+		log.Warn("schema ID is mapped to another table", zap.Int("schemaID", schemaID),
+			zap.String("from", table.name()), zap.String("to", avroTableName(valueSchema)))
+		a.tables.add(schemaID, valueSchema)
+	}
+}
@@ -0,0 +1,133 @@
+// Copyright 2023 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+	"github.com/stretchr/testify/require"
+)
+
+// testRestoredSchema is the schema the test schema ID points to after the registry is restored from a backup.
+const testRestoredSchema = `{"type": "record", "name": "t2", "namespace": "default.test", "fields": [{"name": "id", "type": "long"}]}`
+
+// mutableRegistry is the schema registry serving the test schema ID, whose schema can be replaced.
+type mutableRegistry struct {
+	mu       sync.Mutex
+	schema   string
+	requests int
+}
+
+func newMutableRegistry(t *testing.T, schema string) (*mutableRegistry, *httptest.Server) {
+	r := &mutableRegistry{schema: schema}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		r.requests++
+		_ = json.NewEncoder(w).Encode(lookupResponse{SchemaID: testSchemaID, Schema: r.schema})
+	}))
+	t.Cleanup(server.Close)
+	return r, server
+}
+
+func (r *mutableRegistry) replace(schema string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.schema = schema
+}
+
+func (r *mutableRegistry) requestCount() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.requests
+}
+
+func TestSchemaRefresher(t *testing.T) {
+	t.Parallel()
+
+	now := time.Now()
+	r := newSchemaRefresher(time.Minute)
+	require.Nil(t, r.snapshot())
+	require.True(t, r.allow(3, now))
+	require.True(t, r.allow(1, now))
+	require.False(t, r.allow(3, now.Add(time.Second)))
+	require.True(t, r.allow(3, now.Add(time.Minute)))
+	require.Equal(t, &schemaRefreshReport{Refetches: 3, RateLimited: 1, SchemaIDs: []int{1, 3}}, r.snapshot())
+
+	// disabled.
+	r = newSchemaRefresher(0)
+	require.False(t, r.allow(1, now))
+	require.Nil(t, r.snapshot())
+}
+
+func TestSchemaRefreshRecovery(t *testing.T) {
+	t.Parallel()
+
+	registry, server := newMutableRegistry(t, testValueSchema)
+	cfg := newDefaultConfig()
+	cfg.schemaRegistryURL = server.URL
+	restored := kafka.Message{Topic: "test", Offset: 1,
+		Value: encodeTestMessage(t, testSchemaID, testRestoredSchema, map[string]interface{}{"id": int64(1)})}
+	// the value cannot be decoded by either schema.
+	corrupted := kafka.Message{Topic: "test", Offset: 2, Value: []byte{magicByte, 0, 0, 0, testSchemaID}}
+	reader := &fakeReader{messages: []kafka.Message{newVerifiedTestMessage(t, 0, 1, "a"), restored, corrupted}}
+	v := newTestVerifier(cfg, reader)
+
+	_, err := v.process(context.Background(), reader.messages[0])
+	require.NoError(t, err)
+	registry.replace(testRestoredSchema)
+	reader.next = 1
+	err = v.run(context.Background())
+	require.Equal(t, exitCodeDecodeError, v.finish(err))
+
+	require.Equal(t, counters{Messages: 3, Verified: 1, SkippedLegacyFormat: 1, DecodeErrors: 1}, v.counters)
+	require.Equal(t, []int64{0, 1}, reader.committedOffsets())
+	// the corrupted value is not retried, since the schema is just fetched again.
+	require.Equal(t, &schemaRefreshReport{Refetches: 1, Recovered: 1, Changed: 1, RateLimited: 1, SchemaIDs: []int{1}},
+		v.report.SchemaRefresh)
+	require.Equal(t, 2, registry.requestCount())
+	// the schema ID is mapped to the table of the schema fetched again.
+	require.Equal(t, "test.t2", v.report.SchemaTables[0].name())
+}
+
+func TestSchemaRefreshDisabled(t *testing.T) {
+	t.Parallel()
+
+	registry, server := newMutableRegistry(t, testValueSchema)
+	cfg := newDefaultConfig()
+	cfg.schemaRegistryURL = server.URL
+	cfg.schemaRefreshInterval = 0
+	restored := kafka.Message{Topic: "test", Offset: 1,
+		Value: encodeTestMessage(t, testSchemaID, testRestoredSchema, map[string]interface{}{"id": int64(1)})}
+	reader := &fakeReader{messages: []kafka.Message{newVerifiedTestMessage(t, 0, 1, "a"), restored}}
+	v := newTestVerifier(cfg, reader)
+	_, err := v.process(context.Background(), reader.messages[0])
+	require.NoError(t, err)
+	registry.replace(testRestoredSchema)
+	reader.next = 1
+	err = v.run(context.Background())
+	require.Equal(t, exitCodeDecodeError, v.finish(err))
+	require.Nil(t, v.report.SchemaRefresh)
+	require.Equal(t, 1, registry.requestCount())
+
+	cfg.schemaRefreshInterval = -time.Second
+	require.ErrorContains(t, cfg.validate(), "schema refresh interval must not be negative")
+}
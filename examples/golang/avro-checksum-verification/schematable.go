@@ -0,0 +1,85 @@
+// Copyright 2023 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"sort"
+	"strings"
+)
+
+// schemaTable is the table a value schema ID belongs to, derived from the record name and namespace of the schema.
+type schemaTable struct {
+	SchemaID int    `json:"schemaId"`
+	Database string `json:"database"`
+	Table    string `json:"table"`
+	// Version is the ordinal of the schema ID among those of the table seen in the run, starting from 1.
+	Version int `json:"version"`
+}
+
+// name returns the `schema.table`, empty if the schema is not of a table.
+func (t *schemaTable) name() string {
+	if t.Database == "" || t.Table == "" {
+		return ""
+	}
+	return t.Database + "." + t.Table
+}
+
+// schemaTableMap maps the value schema ID to the table, each ID is mapped once on the first time it's seen,
+// so that the message is routed by its schema ID without decoding the value.
+type schemaTableMap struct {
+	ids map[int]*schemaTable
+	// versions are the number of schema IDs of each table.
+	versions map[string]int
+}
+
+func newSchemaTableMap() *schemaTableMap {
+	return &schemaTableMap{ids: make(map[int]*schemaTable), versions: make(map[string]int)}
+}
+
+func (m *schemaTableMap) get(schemaID int) (*schemaTable, bool) {
+	t, ok := m.ids[schemaID]
+	return t, ok
+}
+
+// add maps the schema ID to the table of the value schema.
+func (m *schemaTableMap) add(schemaID int, valueSchema map[string]interface{}) *schemaTable {
+	t := &schemaTable{SchemaID: schemaID}
+	t.Table, _ = valueSchema["name"].(string)
+	t.Database, _ = valueSchema["namespace"].(string)
+	// the namespace is `<namespace>.<schema>`, the leading one is the namespace of the changefeed.
+	if i := strings.LastIndexByte(t.Database, '.'); i >= 0 {
+		t.Database = t.Database[i+1:]
+	}
+	if name := t.name(); name != "" {
+		m.versions[name]++
+		t.Version = m.versions[name]
+	}
+	m.ids[schemaID] = t
+	return t
+}
+
+// snapshot returns the mapping in the order of the schema ID.
+func (m *schemaTableMap) snapshot() []schemaTable {
+	result := make([]schemaTable, 0, len(m.ids))
+	for _, t := range m.ids {
+		result = append(result, *t)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].SchemaID < result[j].SchemaID })
+	return result
+}
+
+// mappingVerifier is implemented by the message verifier mapping the schema IDs to the tables.
+type mappingVerifier interface {
+	schemaTables() []schemaTable
+}
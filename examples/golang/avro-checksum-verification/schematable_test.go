@@ -0,0 +1,79 @@
+// Copyright 2023 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/segmentio/kafka-go"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSchemaTableMap(t *testing.T) {
+	t.Parallel()
+
+	m := newSchemaTableMap()
+	_, ok := m.get(1)
+	require.False(t, ok)
+	require.Equal(t, &schemaTable{SchemaID: 3, Database: "test", Table: "t", Version: 1},
+		m.add(3, map[string]interface{}{"name": "t", "namespace": "default.test"}))
+	require.Equal(t, &schemaTable{SchemaID: 5, Database: "test", Table: "t", Version: 2},
+		m.add(5, map[string]interface{}{"name": "t", "namespace": "test"}))
+	// the schema not of a table is mapped to no table.
+	unknown := m.add(1, map[string]interface{}{"name": "t"})
+	require.Empty(t, unknown.name())
+	require.Zero(t, unknown.Version)
+
+	table, ok := m.get(5)
+	require.True(t, ok)
+	require.Equal(t, "test.t", table.name())
+	snapshot := m.snapshot()
+	require.Len(t, snapshot, 3)
+	require.Equal(t, []int{1, 3, 5}, []int{snapshot[0].SchemaID, snapshot[1].SchemaID, snapshot[2].SchemaID})
+}
+
+func TestSchemaTableRouting(t *testing.T) {
+	t.Parallel()
+
+	otherSchema := strings.Replace(testValueSchema, `"default.test"`, `"default.other"`, 1)
+	registry := newTestRegistry(t, map[int]string{testSchemaID: testValueSchema, 2: otherSchema})
+	cfg := newDefaultConfig()
+	cfg.schemaRegistryURL = registry.URL
+	cfg.sampleEveryN = 2
+
+	// the unsampled message is counted to its table without decoding the columns.
+	unsampled := encodeTestMessage(t, 2, otherSchema, newTestRow(1, nil, 400000000000000001, ""))
+	v := newTestVerifier(cfg, &fakeReader{messages: []kafka.Message{
+		newVerifiedTestMessage(t, 0, 1, "a"),
+		{Topic: "test", Offset: 1, Value: unsampled},
+		newVerifiedTestMessage(t, 2, 1, "a"),
+		// the value is not decoded, so the mismatch is not found.
+		newMismatchTestMessage(t, 3, 1, "a"),
+	}})
+	c := newController(v, "")
+	err := v.run(context.Background())
+	require.Equal(t, exitCodeClean, v.finish(err))
+	require.Equal(t, uint64(2), v.report.Tables["test.t"].Verified)
+	require.Equal(t, uint64(1), v.report.Tables["test.t"].Unsampled)
+	require.Equal(t, uint64(1), v.report.Tables["other.t"].Unsampled)
+
+	expected := []schemaTable{
+		{SchemaID: testSchemaID, Database: "test", Table: "t", Version: 1},
+		{SchemaID: 2, Database: "other", Table: "t", Version: 1},
+	}
+	require.Equal(t, expected, v.report.SchemaTables)
+	require.Equal(t, expected, c.status().SchemaTables)
+}
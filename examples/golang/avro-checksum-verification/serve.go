@@ -0,0 +1,407 @@
+// Copyright 2023 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"flag"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/pingcap/log"
+	"github.com/segmentio/kafka-go"
+	"go.uber.org/zap"
+)
+
+const (
+	serveStateRunning = "running"
+	serveStatePaused  = "paused"
+)
+
+// serveConfig is the configuration of the control API, besides the flags of the `consume` command.
+type serveConfig struct {
+	listenAddr string
+	// tokenFile is the file carrying the token required by the API, the API is not authenticated if empty.
+	tokenFile string
+}
+
+func (c *serveConfig) bindFlags(fs *flag.FlagSet) {
+	fs.StringVar(&c.listenAddr, "listen-addr", "127.0.0.1:9099", "address of the control API")
+	fs.StringVar(&c.tokenFile, "api-token-file", "",
+		"file carrying the token required by the control API as `Authorization: Bearer <token>`, disabled if empty")
+}
+
+func (c *serveConfig) validate(cfg *config) error {
+	if cfg.storageDir != "" {
+		return errors.New("the offline verification of the storage sink output cannot be served")
+	}
+	if _, _, err := net.SplitHostPort(c.listenAddr); err != nil {
+		return err
+	}
+	return nil
+}
+
+// token reads the token of the API, empty if the token file is not set.
+func (c *serveConfig) token() (string, error) {
+	if c.tokenFile == "" {
+		return "", nil
+	}
+	content, err := os.ReadFile(c.tokenFile)
+	if err != nil {
+		return "", err
+	}
+	token := strings.TrimSpace(string(content))
+	if token == "" {
+		return "", errors.New("api token file is empty: " + c.tokenFile)
+	}
+	return token, nil
+}
+
+// partitionLag is the consumer lag of the partition by the last message fetched.
+type partitionLag struct {
+	Offset int64 `json:"offset"`
+	// Lag is the number of messages behind the high watermark of the partition.
+	Lag int64 `json:"lag"`
+	// ResolvedTs is the resolved ts of the partition, 0 if no watermark is received.
+	ResolvedTs uint64 `json:"resolvedTs,omitempty"`
+	Stalled    bool   `json:"stalled,omitempty"`
+}
+
+// serveStatus is the response of `/status`.
+type serveStatus struct {
+	State      string                `json:"state"`
+	StartTime  time.Time             `json:"startTime"`
+	Counters   counters              `json:"counters"`
+	Tables     map[string]counters   `json:"tables,omitempty"`
+	Operations map[rowOp]uint64      `json:"operations,omitempty"`
+	Failures   int                   `json:"failures"`
+	Partitions map[int]*partitionLag `json:"partitions,omitempty"`
+	// Latency is the histogram of the end-to-end latency so far.
+	Latency *latencyReport `json:"latency,omitempty"`
+	// KafkaSkew is the skew of the kafka message timestamps against the commit so far.
+	KafkaSkew *skewReport `json:"kafkaSkew,omitempty"`
+	// SchemaTables are the tables of the schema IDs seen so far, only for the avro protocol.
+	SchemaTables []schemaTable `json:"schemaTables,omitempty"`
+	// IncludeTables and ExcludeTables are the table patterns in effect.
+	IncludeTables string `json:"includeTables,omitempty"`
+	ExcludeTables string `json:"excludeTables,omitempty"`
+}
+
+// reloadFiltersRequest is the body of `/reload-filters`, the patterns replace the current ones as a whole.
+type reloadFiltersRequest struct {
+	IncludeTables string `json:"includeTables"`
+	ExcludeTables string `json:"excludeTables"`
+}
+
+// controller serves the control API of the verifier. The verifier state is only read or changed under the lock
+// of the verifier, so that the API never observes or interrupts a message half verified or committed.
+type controller struct {
+	v     *verifier
+	token string
+
+	mu     sync.Mutex
+	paused bool
+	// resumed is closed once the verification is resumed.
+	resumed chan struct{}
+	// lags are the consumer lags of each partition, updated under the lock of the verifier.
+	lags map[int]*partitionLag
+}
+
+func newController(v *verifier, token string) *controller {
+	c := &controller{v: v, token: token, lags: make(map[int]*partitionLag)}
+	v.control = c
+	return c
+}
+
+// observe records the lag of the partition by the message.
+func (c *controller) observe(message kafka.Message) {
+	lag, ok := c.lags[message.Partition]
+	if !ok {
+		lag = &partitionLag{}
+		c.lags[message.Partition] = lag
+	}
+	lag.Offset = message.Offset
+	// the high watermark is the offset of the next message to be written, 0 if the reader does not report it.
+	if message.HighWaterMark > message.Offset {
+		lag.Lag = message.HighWaterMark - message.Offset - 1
+	} else {
+		lag.Lag = 0
+	}
+}
+
+// waitResumed blocks until the verification is resumed, or the context is done.
+func (c *controller) waitResumed(ctx context.Context) error {
+	c.mu.Lock()
+	if !c.paused {
+		c.mu.Unlock()
+		return nil
+	}
+	resumed := c.resumed
+	c.mu.Unlock()
+	select {
+	case <-resumed:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (c *controller) pause() {
+	c.mu.Lock()
+	if !c.paused {
+		c.paused, c.resumed = true, make(chan struct{})
+	}
+	c.mu.Unlock()
+	// wait for the message being verified and committed, nothing is verified once it returns.
+	c.v.mu.Lock()
+	defer c.v.mu.Unlock()
+}
+
+func (c *controller) resume() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.paused {
+		c.paused = false
+		close(c.resumed)
+	}
+}
+
+func (c *controller) state() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.paused {
+		return serveStatePaused
+	}
+	return serveStateRunning
+}
+
+func (c *controller) status() *serveStatus {
+	status := &serveStatus{State: c.state(), Partitions: make(map[int]*partitionLag)}
+	resolved, _ := c.v.resolved.snapshot()
+
+	c.v.mu.Lock()
+	defer c.v.mu.Unlock()
+	r := c.v.report
+	status.StartTime, status.Counters, status.Failures = r.StartTime, c.v.counters, len(r.Failures)
+	status.IncludeTables, status.ExcludeTables = c.v.cfg.includeTables, c.v.cfg.excludeTables
+	if len(r.Tables) > 0 {
+		status.Tables = make(map[string]counters, len(r.Tables))
+		for table, tableCounters := range r.Tables {
+			status.Tables[table] = *tableCounters
+		}
+	}
+	if len(r.Operations) > 0 {
+		status.Operations = make(map[rowOp]uint64, len(r.Operations))
+		for op, n := range r.Operations {
+			status.Operations[op] = n
+		}
+	}
+	if c.v.latency != nil {
+		status.Latency = c.v.latency.snapshot()
+	}
+	if c.v.skew != nil {
+		status.KafkaSkew = c.v.skew.snapshot()
+	}
+	if m, ok := c.v.messageVerifier.(mappingVerifier); ok {
+		status.SchemaTables = m.schemaTables()
+	}
+	for partition, lag := range c.lags {
+		copied := *lag
+		status.Partitions[partition] = &copied
+	}
+	for partition, p := range resolved {
+		lag, ok := status.Partitions[partition]
+		if !ok {
+			lag = &partitionLag{}
+			status.Partitions[partition] = lag
+		}
+		lag.ResolvedTs, lag.Stalled = p.ResolvedTs, p.Stalled
+	}
+	return status
+}
+
+// resetCounters resets the counters, the counters of each table and the operations, the failures are kept.
+func (c *controller) resetCounters() {
+	c.v.mu.Lock()
+	defer c.v.mu.Unlock()
+	c.v.counters = counters{}
+	c.v.report.Tables, c.v.report.Operations = nil, nil
+	log.Info("counters reset by the control API")
+}
+
+// reloadFilters replaces the table patterns, it takes effect from the next message.
+func (c *controller) reloadFilters(req reloadFiltersRequest) error {
+	filter, err := newTableFilter(req.IncludeTables, req.ExcludeTables)
+	if err != nil {
+		return err
+	}
+	f, ok := c.v.messageVerifier.(filteringVerifier)
+	if !ok {
+		return errors.New("the table filter of the protocol cannot be reloaded")
+	}
+	c.v.mu.Lock()
+	defer c.v.mu.Unlock()
+	f.setTableFilter(filter)
+	c.v.cfg.includeTables, c.v.cfg.excludeTables = req.IncludeTables, req.ExcludeTables
+	log.Info("table filter reloaded by the control API",
+		zap.String("includeTables", req.IncludeTables), zap.String("excludeTables", req.ExcludeTables))
+	return nil
+}
+
+func (c *controller) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/status", c.handle(http.MethodGet, func(w http.ResponseWriter, _ *http.Request) {
+		writeAPIResponse(w, http.StatusOK, c.status())
+	}))
+	metrics := metricsHandler(newMetricsCollector(func() map[string]*verifier {
+		return map[string]*verifier{"": c.v}
+	}, false))
+	mux.HandleFunc("/metrics", c.handle(http.MethodGet, metrics.ServeHTTP))
+	mux.HandleFunc("/pause", c.handle(http.MethodPost, func(w http.ResponseWriter, _ *http.Request) {
+		c.pause()
+		log.Info("verification paused by the control API")
+		writeAPIResponse(w, http.StatusOK, map[string]string{"state": c.state()})
+	}))
+	mux.HandleFunc("/resume", c.handle(http.MethodPost, func(w http.ResponseWriter, _ *http.Request) {
+		c.resume()
+		log.Info("verification resumed by the control API")
+		writeAPIResponse(w, http.StatusOK, map[string]string{"state": c.state()})
+	}))
+	mux.HandleFunc("/reset-counters", c.handle(http.MethodPost, func(w http.ResponseWriter, _ *http.Request) {
+		c.resetCounters()
+		writeAPIResponse(w, http.StatusOK, c.status())
+	}))
+	mux.HandleFunc("/reload-filters", c.handle(http.MethodPost, func(w http.ResponseWriter, r *http.Request) {
+		var req reloadFiltersRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeAPIError(w, http.StatusBadRequest, err)
+			return
+		}
+		if err := c.reloadFilters(req); err != nil {
+			writeAPIError(w, http.StatusBadRequest, err)
+			return
+		}
+		writeAPIResponse(w, http.StatusOK, c.status())
+	}))
+	return mux
+}
+
+// handle checks the method and the token before the handler.
+func (c *controller) handle(method string, handler http.HandlerFunc) http.HandlerFunc {
+	return authorizedHandler(c.token, method, handler)
+}
+
+// authorizedHandler checks the method and the token before the handler, the token is not checked if empty.
+func authorizedHandler(apiToken, method string, handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if apiToken != "" {
+			token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+			if subtle.ConstantTimeCompare([]byte(token), []byte(apiToken)) != 1 {
+				writeAPIError(w, http.StatusUnauthorized, errors.New("invalid api token"))
+				return
+			}
+		}
+		if r.Method != method {
+			w.Header().Set("Allow", method)
+			writeAPIError(w, http.StatusMethodNotAllowed, errors.New("method should be "+method))
+			return
+		}
+		handler(w, r)
+	}
+}
+
+func writeAPIResponse(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+func writeAPIError(w http.ResponseWriter, code int, err error) {
+	writeAPIResponse(w, code, map[string]string{"error": err.Error()})
+}
+
+// runServe runs the verifier consuming the messages continuously, along with the control API.
+func runServe(args []string) int {
+	cfg := newDefaultConfig()
+	serveCfg := &serveConfig{}
+	fs := flag.NewFlagSet(commandServe, flag.ExitOnError)
+	cfg.bindFlags(fs)
+	serveCfg.bindFlags(fs)
+	_ = fs.Parse(args)
+	if err := cfg.validate(); err != nil {
+		log.Fatal("invalid configuration", zap.Error(err))
+	}
+	if err := serveCfg.validate(cfg); err != nil {
+		log.Fatal("invalid configuration", zap.Error(err))
+	}
+	token, err := serveCfg.token()
+	if err != nil {
+		log.Fatal("read api token failed", zap.String("file", serveCfg.tokenFile), zap.Error(err))
+	}
+
+	ctx, cancel := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer cancel()
+
+	listener, err := net.Listen("tcp", serveCfg.listenAddr)
+	if err != nil {
+		log.Error("listen the control API failed", zap.String("addr", serveCfg.listenAddr), zap.Error(err))
+		return exitCodeInfraError
+	}
+	if host, _, _ := net.SplitHostPort(serveCfg.listenAddr); token == "" && !isLoopback(host) {
+		log.Warn("the control API is exposed beyond the localhost without the api token",
+			zap.String("addr", serveCfg.listenAddr))
+	}
+
+	v, err := newVerifier(ctx, cfg)
+	if err != nil {
+		_ = listener.Close()
+		log.Error("create verifier failed", zap.Error(err))
+		return exitCodeOf(err)
+	}
+	defer v.close()
+
+	server := &http.Server{Handler: newController(v, token).handler(), ReadHeaderTimeout: 10 * time.Second}
+	go func() {
+		if err := server.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Warn("control API stopped", zap.Error(err))
+		}
+	}()
+	log.Info("control API started", zap.String("addr", listener.Addr().String()))
+
+	err = v.run(ctx)
+	if err != nil {
+		log.Error("verification stopped", zap.Error(err))
+	}
+	shutdownCtx, shutdownCancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer shutdownCancel()
+	_ = server.Shutdown(shutdownCtx)
+	return v.finish(err)
+}
+
+func isLoopback(host string) bool {
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
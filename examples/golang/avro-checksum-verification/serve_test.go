@@ -0,0 +1,116 @@
+// Copyright 2023 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+	"github.com/stretchr/testify/require"
+)
+
+func callTestAPI(t *testing.T, server *httptest.Server, method, path, token, body string) (int, map[string]interface{}) {
+	req, err := http.NewRequest(method, server.URL+path, strings.NewReader(body))
+	require.NoError(t, err)
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	var result map[string]interface{}
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&result))
+	return resp.StatusCode, result
+}
+
+func TestServeControl(t *testing.T) {
+	t.Parallel()
+
+	registry := newTestRegistry(t, map[int]string{testSchemaID: testValueSchema})
+	cfg := newDefaultConfig()
+	cfg.schemaRegistryURL = registry.URL
+	first, second := newVerifiedTestMessage(t, 0, 1, "a"), newVerifiedTestMessage(t, 1, 2, "b")
+	first.HighWaterMark, second.HighWaterMark = 2, 2
+	reader := &fakeReader{messages: []kafka.Message{first, second}}
+	v := newTestVerifier(cfg, reader)
+	c := newController(v, "secret")
+	server := httptest.NewServer(c.handler())
+	t.Cleanup(server.Close)
+
+	code, _ := callTestAPI(t, server, http.MethodGet, "/status", "", "")
+	require.Equal(t, http.StatusUnauthorized, code)
+	code, _ = callTestAPI(t, server, http.MethodGet, "/pause", "secret", "")
+	require.Equal(t, http.StatusMethodNotAllowed, code)
+
+	// the message fetched while paused is not verified until resumed.
+	code, result := callTestAPI(t, server, http.MethodPost, "/pause", "secret", "")
+	require.Equal(t, http.StatusOK, code)
+	require.Equal(t, serveStatePaused, result["state"])
+	done := make(chan error, 1)
+	go func() { done <- v.run(context.Background()) }()
+	require.Never(t, func() bool { return len(reader.committedOffsets()) > 0 }, 100*time.Millisecond, 10*time.Millisecond)
+	_, result = callTestAPI(t, server, http.MethodGet, "/status", "secret", "")
+	require.Equal(t, serveStatePaused, result["state"])
+	require.Equal(t, float64(0), result["counters"].(map[string]interface{})["messages"])
+
+	// the second message is filtered out by the reloaded filter.
+	code, result = callTestAPI(t, server, http.MethodPost, "/reload-filters", "secret", `{"includeTables":"test"}`)
+	require.Equal(t, http.StatusBadRequest, code)
+	require.Contains(t, result["error"], "should be `db.table`")
+	code, _ = callTestAPI(t, server, http.MethodPost, "/reload-filters", "secret", `{"excludeTables":"test.*"}`)
+	require.Equal(t, http.StatusOK, code)
+	code, _ = callTestAPI(t, server, http.MethodPost, "/resume", "secret", "")
+	require.Equal(t, http.StatusOK, code)
+	require.NoError(t, <-done)
+	require.Equal(t, []int64{0, 1}, reader.committedOffsets())
+
+	status := c.status()
+	require.Equal(t, serveStateRunning, status.State)
+	require.Equal(t, uint64(2), status.Counters.Messages)
+	require.Equal(t, uint64(2), status.Counters.Filtered)
+	require.Equal(t, "test.*", status.ExcludeTables)
+	require.Equal(t, &partitionLag{Offset: 1, Lag: 0}, status.Partitions[0])
+
+	code, result = callTestAPI(t, server, http.MethodPost, "/reset-counters", "secret", "")
+	require.Equal(t, http.StatusOK, code)
+	require.Equal(t, float64(0), result["counters"].(map[string]interface{})["messages"])
+	require.Equal(t, counters{}, c.status().Counters)
+}
+
+func TestServeConfigValidate(t *testing.T) {
+	t.Parallel()
+
+	cfg := newDefaultConfig()
+	s := &serveConfig{listenAddr: "127.0.0.1:9099"}
+	require.NoError(t, s.validate(cfg))
+	token, err := s.token()
+	require.NoError(t, err)
+	require.Empty(t, token)
+	s.listenAddr = "9099"
+	require.Error(t, s.validate(cfg))
+	s.listenAddr = ":9099"
+	cfg.storageDir = "output"
+	require.ErrorContains(t, s.validate(cfg), "cannot be served")
+
+	require.True(t, isLoopback("localhost"))
+	require.True(t, isLoopback("::1"))
+	require.False(t, isLoopback(""))
+	require.False(t, isLoopback("0.0.0.0"))
+}
@@ -0,0 +1,486 @@
+// Copyright 2023 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	_ "embed"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"avro-checksum-sample/checksum"
+	"github.com/linkedin/goavro/v2"
+	"github.com/pingcap/log"
+	"github.com/pingcap/tidb/pkg/parser/mysql"
+	parsertypes "github.com/pingcap/tidb/pkg/parser/types"
+	"github.com/segmentio/kafka-go"
+	"go.uber.org/zap"
+)
+
+const (
+	simpleEncodingJSON = "json"
+	simpleEncodingAvro = "avro"
+)
+
+const (
+	simpleTypeWatermark = "WATERMARK"
+	simpleTypeBootstrap = "BOOTSTRAP"
+	simpleTypeInsert    = "INSERT"
+	simpleTypeUpdate    = "UPDATE"
+	simpleTypeDelete    = "DELETE"
+)
+
+// maxSimplePendingRows is the maximum number of rows awaiting the bootstrap message,
+// the verification stops if exceeded, since the bootstrap message is not sent by the changefeed.
+const maxSimplePendingRows = 10000
+
+// simpleAvroSchema is the avro schema of the simple protocol, the same as the one used by TiCDC.
+//
+//go:embed simple_message.json
+var simpleAvroSchema string
+
+// simpleMessage is the message of the simple protocol, only fields used by the verification are decoded.
+type simpleMessage struct {
+	Schema   string `json:"database"`
+	Table    string `json:"table"`
+	Type     string `json:"type"`
+	SQL      string `json:"sql"`
+	CommitTs uint64 `json:"commitTs"`
+	// SchemaVersion is the version of the table schema used to encode the row.
+	SchemaVersion uint64 `json:"schemaVersion"`
+
+	ClaimCheckLocation string `json:"claimCheckLocation"`
+	HandleKeyOnly      bool   `json:"handleKeyOnly"`
+
+	// Checksum is only available if the row level checksum is enabled by the changefeed,
+	// Current is the checksum of the `data`, Previous is the checksum of the `old`.
+	Checksum *rowChecksum `json:"checksum"`
+	// Data is available for the insert and update event.
+	Data map[string]interface{} `json:"data"`
+	// Old is available for the update and delete event.
+	Old map[string]interface{} `json:"old"`
+
+	// TableSchema is available for the bootstrap and DDL event.
+	TableSchema    *simpleTableSchema `json:"tableSchema"`
+	PreTableSchema *simpleTableSchema `json:"preTableSchema"`
+}
+
+func (m *simpleMessage) isRow() bool {
+	switch m.Type {
+	case simpleTypeInsert, simpleTypeUpdate, simpleTypeDelete:
+		return true
+	}
+	return false
+}
+
+// simpleVerifier verifies the message encoded by the simple protocol, the row only refers to the table schema
+// by the version, the schema itself is carried by the bootstrap message, which is sent periodically.
+// Rows arrive before the bootstrap of their schema are kept pending, and verified once the bootstrap arrives.
+type simpleVerifier struct {
+	encoding string
+	codec    *goavro.Codec
+
+	store   *simpleSchemaStore
+	pending []*simpleMessage
+	filter  *tableFilter
+	window  *commitTsWindow
+	ops     opFilter
+}
+
+func (s *simpleVerifier) setTableFilter(filter *tableFilter) { s.filter = filter }
+
+func newSimpleVerifier(encoding string, schemaCacheSize int) (*simpleVerifier, error) {
+	v := &simpleVerifier{encoding: encoding, store: newSimpleSchemaStore(schemaCacheSize)}
+	if encoding == simpleEncodingAvro {
+		codec, err := goavro.NewCodec(simpleAvroSchema)
+		if err != nil {
+			return nil, err
+		}
+		v.codec = codec
+	}
+	return v, nil
+}
+
+// pendingRows returns the number of rows awaiting the bootstrap message,
+// messages are not committed until no row is pending.
+func (s *simpleVerifier) pendingRows() int {
+	return len(s.pending)
+}
+
+func (s *simpleVerifier) verify(message kafka.Message) (messageResult, error) {
+	var result messageResult
+	m, err := s.decode(message.Value)
+	if err != nil {
+		return result, err
+	}
+
+	if !m.isRow() {
+		if m.Type == simpleTypeWatermark {
+			result.add(outcomeSkippedNonRow, 0)
+			result.resolve(m.CommitTs)
+			return result, nil
+		}
+		if m.Type != simpleTypeBootstrap {
+			log.Info("DDL message received, skip", zap.String("DDL", m.SQL))
+		}
+		s.store.put(m.TableSchema)
+		s.store.put(m.PreTableSchema)
+		result.add(outcomeSkippedNonRow, 0)
+		return result, s.verifyPending(&result)
+	}
+
+	if s.filter.filtered(m.Schema + "." + m.Table) {
+		result.add(outcomeFiltered, m.CommitTs)
+		return result, nil
+	}
+	op := simpleOp(m.Type)
+	result.addOp(op)
+	if s.ops.filtered(op) {
+		result.add(outcomeFiltered, m.CommitTs)
+		return result, nil
+	}
+	if outside, err := s.window.outside(&result, m.CommitTs); err != nil || outside {
+		return result, err
+	}
+	if m.HandleKeyOnly || m.ClaimCheckLocation != "" {
+		// the checksum is calculated by all columns, cannot be verified by the handle key columns.
+		result.add(outcomeSkippedHandleKeyOnly, m.CommitTs)
+		return result, nil
+	}
+	if m.Checksum == nil {
+		result.add(outcomeSkippedNoChecksum, m.CommitTs)
+		return result, nil
+	}
+
+	schema := s.store.get(m.Schema, m.Table, m.SchemaVersion)
+	if schema == nil {
+		if len(s.pending) >= maxSimplePendingRows {
+			return result, fmt.Errorf("too many rows awaiting the bootstrap message, "+
+				"table schema not found, schema: %s, table: %s, version: %d", m.Schema, m.Table, m.SchemaVersion)
+		}
+		log.Warn("table schema not found, wait for the bootstrap message",
+			zap.String("schema", m.Schema), zap.String("table", m.Table), zap.Uint64("version", m.SchemaVersion))
+		s.pending = append(s.pending, m)
+		result.add(outcomeDeferred, m.CommitTs)
+		return result, nil
+	}
+	if err := s.verifyRow(m, schema); err != nil {
+		return result, err
+	}
+	result.add(outcomeVerified, m.CommitTs)
+	return result, nil
+}
+
+// verifyPending verifies the pending rows whose table schema is available now,
+// the result is merged into the message which makes them verifiable.
+func (s *simpleVerifier) verifyPending(result *messageResult) error {
+	var (
+		remains    []*simpleMessage
+		mismatched int
+	)
+	for _, m := range s.pending {
+		schema := s.store.get(m.Schema, m.Table, m.SchemaVersion)
+		if schema == nil {
+			remains = append(remains, m)
+			continue
+		}
+		err := s.verifyRow(m, schema)
+		if errors.Is(err, errChecksumMismatch) {
+			mismatched++
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		result.add(outcomeVerified, m.CommitTs)
+	}
+	s.pending = remains
+	if mismatched > 0 {
+		return fmt.Errorf("%d pending rows: %w", mismatched, errChecksumMismatch)
+	}
+	return nil
+}
+
+func (s *simpleVerifier) verifyRow(m *simpleMessage, schema *simpleTableSchema) error {
+	if m.Data != nil {
+		if err := s.verifyColumns(m, schema, m.Data, m.Checksum.Current); err != nil {
+			return err
+		}
+	}
+	if m.Old != nil {
+		return s.verifyColumns(m, schema, m.Old, m.Checksum.Previous)
+	}
+	return nil
+}
+
+func (s *simpleVerifier) verifyColumns(
+	m *simpleMessage, schema *simpleTableSchema, data map[string]interface{}, expected uint64,
+) error {
+	fields := make([]checksum.FieldMeta, 0, len(schema.Columns))
+	values := make([]interface{}, 0, len(schema.Columns))
+	for _, column := range schema.Columns {
+		value, ok := data[column.Name]
+		if !ok {
+			return errors.New("value not found for the column " + column.Name)
+		}
+		mysqlType := parsertypes.StrToType(column.DataType.MySQLType)
+		value, err := simpleColumnValue(value, column, mysqlType)
+		if err != nil {
+			return fmt.Errorf("invalid value of the column %s: %w", column.Name, err)
+		}
+		fields = append(fields, checksum.FieldMeta{Name: column.Name, MySQLType: mysqlType})
+		values = append(values, value)
+	}
+
+	actual, err := checksum.CalculateVersion(m.Checksum.Version, fields, values)
+	if err != nil {
+		return err
+	}
+	if actual != expected {
+		log.Error("checksum mismatch",
+			zap.String("schema", m.Schema), zap.String("table", m.Table),
+			zap.Uint64("version", m.SchemaVersion), zap.Uint64("commitTs", m.CommitTs),
+			zap.Uint64("expected", expected), zap.Uint64("actual", actual))
+		return errChecksumMismatch
+	}
+	log.Info("checksum verified", zap.Uint64("checksum", actual))
+	return nil
+}
+
+// simpleColumnValue converts the value in the message to the value accepted by the checksum calculation,
+// by follow the simple protocol decoder of TiCDC.
+// The JSON encoding encodes all values as the string, the avro encoding keeps the value type.
+func simpleColumnValue(value interface{}, column *simpleColumnSchema, mysqlType byte) (interface{}, error) {
+	if value == nil {
+		return nil, nil
+	}
+
+	switch v := value.(type) {
+	// the timestamp is encoded along with its location, and the unsigned bigint is wrapped for avro.
+	case map[string]interface{}:
+		if mysqlType == mysql.TypeTimestamp {
+			location, _ := v["location"].(string)
+			timestamp, _ := v["value"].(string)
+			return simpleTimestampValue(timestamp, location), nil
+		}
+		if number, ok := v["value"].(int64); ok {
+			return uint64(number), nil
+		}
+		return nil, errors.New("unexpected value of the map type")
+	case []byte:
+		return v, nil
+	case int64:
+		switch mysqlType {
+		case mysql.TypeEnum, mysql.TypeSet, mysql.TypeBit:
+			return uint64(v), nil
+		}
+		if column.DataType.Unsigned {
+			return uint64(v), nil
+		}
+		return v, nil
+	case float32, float64:
+		return v, nil
+	case string:
+		return simpleStringValue(v, column, mysqlType)
+	}
+	return nil, fmt.Errorf("unexpected value %v", value)
+}
+
+func simpleStringValue(data string, column *simpleColumnSchema, mysqlType byte) (interface{}, error) {
+	// the binary value is encoded by base64.
+	lowerType := strings.ToLower(column.DataType.MySQLType)
+	if strings.Contains(lowerType, "blob") || strings.Contains(lowerType, "binary") {
+		return base64.StdEncoding.DecodeString(data)
+	}
+
+	switch mysqlType {
+	case mysql.TypeTiny, mysql.TypeShort, mysql.TypeLong, mysql.TypeInt24, mysql.TypeLonglong, mysql.TypeYear:
+		if column.DataType.Unsigned {
+			return strconv.ParseUint(data, 10, 64)
+		}
+		return strconv.ParseInt(data, 10, 64)
+	// enum and set are encoded as the ordinal number, bit is encoded as the number.
+	case mysql.TypeEnum, mysql.TypeSet, mysql.TypeBit:
+		return strconv.ParseUint(data, 10, 64)
+	case mysql.TypeFloat:
+		v, err := strconv.ParseFloat(data, 32)
+		if err != nil {
+			return nil, err
+		}
+		return float32(v), nil
+	case mysql.TypeDouble:
+		return strconv.ParseFloat(data, 64)
+	}
+	return data, nil
+}
+
+// simpleTimestampValue converts the timestamp in the given location to the local time zone,
+// which is expected by the checksum calculation.
+func simpleTimestampValue(timestamp, location string) string {
+	loc, err := time.LoadLocation(location)
+	if err != nil {
+		return timestamp
+	}
+	t, err := checksum.ParseTimestamp(timestamp, loc)
+	if err != nil {
+		return timestamp
+	}
+	return t.In(time.Local).Format("2006-01-02 15:04:05")
+}
+
+func (s *simpleVerifier) decode(value []byte) (*simpleMessage, error) {
+	m := new(simpleMessage)
+	if s.encoding == simpleEncodingJSON {
+		if err := json.Unmarshal(value, m); err != nil {
+			return nil, err
+		}
+		return m, nil
+	}
+
+	native, _, err := s.codec.NativeFromBinary(value)
+	if err != nil {
+		return nil, err
+	}
+	if err := newSimpleMessageFromAvroNative(native, m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// newSimpleMessageFromAvroNative converts the avro native value to the message,
+// by follow the simple protocol avro decoder of TiCDC.
+func newSimpleMessageFromAvroNative(native interface{}, m *simpleMessage) (err error) {
+	// the native value is decoded by the schema, a panic means the message is malformed.
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("malformed simple avro message: %v", r)
+		}
+	}()
+
+	rawValues, ok := native.(map[string]interface{})["com.pingcap.simple.avro.Message"].(map[string]interface{})
+	if !ok {
+		return errors.New("cannot convert the avro message to map")
+	}
+	rawPayload, ok := rawValues["payload"].(map[string]interface{})
+	if !ok {
+		return errors.New("cannot convert the avro payload to map")
+	}
+
+	if rawMessage := rawPayload["com.pingcap.simple.avro.Watermark"]; rawMessage != nil {
+		rawValues = rawMessage.(map[string]interface{})
+		m.Type = simpleTypeWatermark
+		m.CommitTs = uint64(rawValues["commitTs"].(int64))
+		return nil
+	}
+
+	if rawMessage := rawPayload["com.pingcap.simple.avro.Bootstrap"]; rawMessage != nil {
+		rawValues = rawMessage.(map[string]interface{})
+		m.Type = simpleTypeBootstrap
+		m.TableSchema = newSimpleTableSchemaFromAvroNative(rawValues["tableSchema"].(map[string]interface{}))
+		return nil
+	}
+
+	if rawMessage := rawPayload["com.pingcap.simple.avro.DDL"]; rawMessage != nil {
+		rawValues = rawMessage.(map[string]interface{})
+		m.Type = rawValues["type"].(string)
+		m.SQL = rawValues["sql"].(string)
+		m.CommitTs = uint64(rawValues["commitTs"].(int64))
+		if raw := rawValues["tableSchema"]; raw != nil {
+			raw := raw.(map[string]interface{})["com.pingcap.simple.avro.TableSchema"].(map[string]interface{})
+			m.TableSchema = newSimpleTableSchemaFromAvroNative(raw)
+		}
+		if raw := rawValues["preTableSchema"]; raw != nil {
+			raw := raw.(map[string]interface{})["com.pingcap.simple.avro.TableSchema"].(map[string]interface{})
+			m.PreTableSchema = newSimpleTableSchemaFromAvroNative(raw)
+		}
+		return nil
+	}
+
+	rawValues = rawPayload["com.pingcap.simple.avro.DML"].(map[string]interface{})
+	m.Type = rawValues["type"].(string)
+	m.CommitTs = uint64(rawValues["commitTs"].(int64))
+	m.Schema = rawValues["database"].(string)
+	m.Table = rawValues["table"].(string)
+	m.SchemaVersion = uint64(rawValues["schemaVersion"].(int64))
+	if raw := rawValues["handleKeyOnly"]; raw != nil {
+		m.HandleKeyOnly = raw.(map[string]interface{})["boolean"].(bool)
+	}
+	if raw := rawValues["claimCheckLocation"]; raw != nil {
+		m.ClaimCheckLocation = raw.(map[string]interface{})["string"].(string)
+	}
+	if raw := rawValues["checksum"]; raw != nil {
+		raw := raw.(map[string]interface{})["com.pingcap.simple.avro.Checksum"].(map[string]interface{})
+		m.Checksum = &rowChecksum{
+			Version:   int(raw["version"].(int32)),
+			Corrupted: raw["corrupted"].(bool),
+			Current:   uint64(uint32(raw["current"].(int64))),
+			Previous:  uint64(uint32(raw["previous"].(int64))),
+		}
+	}
+	m.Data = newSimpleDataFromAvroNative(rawValues["data"])
+	m.Old = newSimpleDataFromAvroNative(rawValues["old"])
+	return nil
+}
+
+func newSimpleTableSchemaFromAvroNative(native map[string]interface{}) *simpleTableSchema {
+	rawColumns := native["columns"].([]interface{})
+	columns := make([]*simpleColumnSchema, 0, len(rawColumns))
+	for _, raw := range rawColumns {
+		raw := raw.(map[string]interface{})
+		rawDataType := raw["dataType"].(map[string]interface{})
+		var unsigned bool
+		if rawDataType["unsigned"] != nil {
+			unsigned = rawDataType["unsigned"].(map[string]interface{})["boolean"].(bool)
+		}
+		columns = append(columns, &simpleColumnSchema{
+			Name:     raw["name"].(string),
+			Nullable: raw["nullable"].(bool),
+			DataType: simpleDataType{
+				MySQLType: rawDataType["mysqlType"].(string),
+				Charset:   rawDataType["charset"].(string),
+				Unsigned:  unsigned,
+			},
+		})
+	}
+	return &simpleTableSchema{
+		Schema:  native["database"].(string),
+		Table:   native["table"].(string),
+		TableID: native["tableID"].(int64),
+		Version: uint64(native["version"].(int64)),
+		Columns: columns,
+	}
+}
+
+// newSimpleDataFromAvroNative unwraps the union of each column value.
+func newSimpleDataFromAvroNative(native interface{}) map[string]interface{} {
+	if native == nil {
+		return nil
+	}
+	rawData := native.(map[string]interface{})["map"].(map[string]interface{})
+	data := make(map[string]interface{}, len(rawData))
+	for name, value := range rawData {
+		if value == nil {
+			data[name] = nil
+			continue
+		}
+		for _, v := range value.(map[string]interface{}) {
+			data[name] = v
+		}
+	}
+	return data
+}
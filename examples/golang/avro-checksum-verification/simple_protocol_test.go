@@ -0,0 +1,281 @@
+// Copyright 2023 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/linkedin/goavro/v2"
+	"github.com/segmentio/kafka-go"
+	"github.com/stretchr/testify/require"
+)
+
+// testSimpleBootstrap is the bootstrap message of the table `test`.`s` (id INT, name VARCHAR(32), data BLOB).
+func testSimpleBootstrap(version uint64) string {
+	return fmt.Sprintf(`{"version":1,"type":"BOOTSTRAP","buildTs":1,"tableSchema":{"database":"test","table":"s",`+
+		`"tableID":100,"version":%d,"columns":[`+
+		`{"name":"id","dataType":{"mysqlType":"int","charset":"binary","collate":"binary","length":11},"nullable":false},`+
+		`{"name":"name","dataType":{"mysqlType":"varchar","charset":"utf8mb4","collate":"utf8mb4_bin","length":32},"nullable":true},`+
+		`{"name":"data","dataType":{"mysqlType":"blob","charset":"binary","collate":"binary","length":65535},"nullable":true}],`+
+		`"indexes":[{"name":"primary","unique":true,"primary":true,"nullable":false,"columns":["id"]}]}}`, version)
+}
+
+// newTestSimpleRow returns the row message of the table `test`.`s`, the blob value is base64 encoded.
+func newTestSimpleRow(eventType string, version uint64, data, old string, checksum string) string {
+	return fmt.Sprintf(`{"version":1,"database":"test","table":"s","tableID":100,"type":"%s","commitTs":100,`+
+		`"buildTs":1,"schemaVersion":%d,"data":%s,"old":%s,"checksum":%s}`, eventType, version, data, old, checksum)
+}
+
+func TestSimpleJSONVerify(t *testing.T) {
+	t.Parallel()
+
+	current := testCanalJSONChecksum(1, "b", []byte{0xe9, 0x01})
+	previous := testCanalJSONChecksum(1, "a", []byte{0xe9, 0x01})
+	// the column order of the data is not relevant, the order of the table schema is used.
+	data := `{"name":"b","id":"1","data":"6QE="}`
+	old := `{"id":"1","name":"a","data":"6QE="}`
+
+	cases := []struct {
+		name    string
+		value   string
+		outcome outcome
+		err     error
+	}{
+		{
+			name:    "insert",
+			value:   newTestSimpleRow("INSERT", 1, data, `null`, fmt.Sprintf(`{"current":%d}`, current)),
+			outcome: outcomeVerified,
+		},
+		{
+			name: "update",
+			value: newTestSimpleRow("UPDATE", 1, data, old,
+				fmt.Sprintf(`{"current":%d,"previous":%d}`, current, previous)),
+			outcome: outcomeVerified,
+		},
+		{
+			name:    "delete",
+			value:   newTestSimpleRow("DELETE", 1, `null`, old, fmt.Sprintf(`{"previous":%d}`, previous)),
+			outcome: outcomeVerified,
+		},
+		{
+			name:  "mismatch",
+			value: newTestSimpleRow("INSERT", 1, old, `null`, fmt.Sprintf(`{"current":%d}`, current)),
+			err:   errChecksumMismatch,
+		},
+		{
+			name:    "checksum not enabled",
+			value:   newTestSimpleRow("INSERT", 1, data, `null`, `null`),
+			outcome: outcomeSkippedNoChecksum,
+		},
+		{
+			name: "handle key only",
+			value: `{"version":1,"database":"test","table":"s","type":"INSERT","commitTs":100,"schemaVersion":1,` +
+				`"handleKeyOnly":true,"data":{"id":"1"},"checksum":{"current":1}}`,
+			outcome: outcomeSkippedHandleKeyOnly,
+		},
+		{
+			name:    "watermark",
+			value:   `{"version":1,"type":"WATERMARK","commitTs":100,"buildTs":1}`,
+			outcome: outcomeSkippedNonRow,
+		},
+	}
+
+	v, err := newSimpleVerifier(simpleEncodingJSON, 16)
+	require.NoError(t, err)
+	result, err := v.verify(kafka.Message{Value: []byte(testSimpleBootstrap(1))})
+	require.NoError(t, err)
+	require.Equal(t, outcomeSkippedNonRow, result.outcome)
+
+	for _, c := range cases {
+		result, err := v.verify(kafka.Message{Value: []byte(c.value)})
+		if c.err != nil {
+			require.ErrorIs(t, err, c.err, c.name)
+			continue
+		}
+		require.NoError(t, err, c.name)
+		require.Equal(t, c.outcome, result.outcome, c.name)
+	}
+	require.Equal(t, 0, v.pendingRows())
+}
+
+func TestSimpleAwaitBootstrap(t *testing.T) {
+	t.Parallel()
+
+	current := testCanalJSONChecksum(1, "b", []byte{0xe9, 0x01})
+	verified := newTestSimpleRow("INSERT", 2, `{"id":"1","name":"b","data":"6QE="}`, `null`,
+		fmt.Sprintf(`{"current":%d}`, current))
+	mismatch := newTestSimpleRow("INSERT", 2, `{"id":"1","name":"c","data":"6QE="}`, `null`,
+		fmt.Sprintf(`{"current":%d}`, current))
+
+	v, err := newSimpleVerifier(simpleEncodingJSON, 16)
+	require.NoError(t, err)
+	result, err := v.verify(kafka.Message{Value: []byte(verified)})
+	require.NoError(t, err)
+	require.Equal(t, outcomeDeferred, result.outcome)
+	require.Equal(t, 1, v.pendingRows())
+
+	// the bootstrap of another version does not resolve the pending row.
+	_, err = v.verify(kafka.Message{Value: []byte(testSimpleBootstrap(1))})
+	require.NoError(t, err)
+	require.Equal(t, 1, v.pendingRows())
+
+	result, err = v.verify(kafka.Message{Value: []byte(testSimpleBootstrap(2))})
+	require.NoError(t, err)
+	require.Equal(t, outcomeVerified, result.outcome)
+	require.Equal(t, uint64(100), result.commitTs)
+	require.Equal(t, 0, v.pendingRows())
+
+	// the mismatch of the pending row is reported by the bootstrap message.
+	v, err = newSimpleVerifier(simpleEncodingJSON, 16)
+	require.NoError(t, err)
+	_, err = v.verify(kafka.Message{Value: []byte(mismatch)})
+	require.NoError(t, err)
+	_, err = v.verify(kafka.Message{Value: []byte(testSimpleBootstrap(2))})
+	require.ErrorIs(t, err, errChecksumMismatch)
+	require.Equal(t, 0, v.pendingRows())
+}
+
+func TestSimpleHoldCommitUntilBootstrap(t *testing.T) {
+	t.Parallel()
+
+	current := testCanalJSONChecksum(1, "b", []byte{0xe9, 0x01})
+	verified := newTestSimpleRow("INSERT", 1, `{"id":"1","name":"b","data":"6QE="}`, `null`,
+		fmt.Sprintf(`{"current":%d}`, current))
+	mismatch := newTestSimpleRow("INSERT", 2, `{"id":"1","name":"c","data":"6QE="}`, `null`,
+		fmt.Sprintf(`{"current":%d}`, current))
+
+	cfg := newDefaultConfig()
+	cfg.protocol = protocolSimple
+	cfg.failFast = true
+	reader := &fakeReader{messages: []kafka.Message{
+		{Offset: 0, Value: []byte(verified)},
+		{Offset: 1, Value: []byte(testSimpleBootstrap(1))},
+		{Offset: 2, Value: []byte(mismatch)},
+		{Offset: 3, Value: []byte(verified)},
+		{Offset: 4, Value: []byte(testSimpleBootstrap(2))},
+	}}
+	v := newTestVerifier(cfg, reader)
+	err := v.run(context.Background())
+	require.Equal(t, exitCodeMismatch, v.finish(err))
+	// the messages since the pending row are not committed, since the pending row mismatches.
+	require.Equal(t, []int64{0, 1}, reader.committedOffsets())
+	require.Equal(t, counters{Messages: 5, Verified: 2, Deferred: 2, Mismatches: 1}, v.counters)
+}
+
+func TestSimpleSchemaStoreEviction(t *testing.T) {
+	t.Parallel()
+
+	store := newSimpleSchemaStore(2)
+	for version := uint64(1); version <= 3; version++ {
+		store.put(&simpleTableSchema{Schema: "test", Table: "s", Version: version})
+		if version == 2 {
+			// refresh the version 1, so that the version 2 is the least recently used one.
+			require.NotNil(t, store.get("test", "s", 1))
+		}
+	}
+	require.Equal(t, 2, store.len())
+	require.NotNil(t, store.get("test", "s", 1))
+	require.Nil(t, store.get("test", "s", 2))
+	require.NotNil(t, store.get("test", "s", 3))
+
+	// the evicted schema is stored again by the next bootstrap.
+	store.put(&simpleTableSchema{Schema: "test", Table: "s", Version: 2})
+	require.NotNil(t, store.get("test", "s", 2))
+	require.Equal(t, 2, store.len())
+}
+
+func TestSimpleAvroVerify(t *testing.T) {
+	t.Parallel()
+
+	codec, err := goavro.NewCodec(simpleAvroSchema)
+	require.NoError(t, err)
+	encode := func(payloadType string, name string, payload map[string]interface{}) []byte {
+		native := map[string]interface{}{
+			"com.pingcap.simple.avro.Message": map[string]interface{}{
+				"type":    payloadType,
+				"payload": map[string]interface{}{name: payload},
+			},
+		}
+		value, err := codec.BinaryFromNative(nil, native)
+		require.NoError(t, err)
+		return value
+	}
+
+	column := func(name, mysqlType, charset string) map[string]interface{} {
+		return map[string]interface{}{
+			"name":     name,
+			"nullable": true,
+			"default":  nil,
+			"dataType": map[string]interface{}{
+				"mysqlType": mysqlType, "charset": charset, "collate": charset, "length": int64(32),
+			},
+		}
+	}
+	bootstrap := encode("BOOTSTRAP", "com.pingcap.simple.avro.Bootstrap", map[string]interface{}{
+		"version": int32(1),
+		"buildTs": int64(1),
+		"tableSchema": map[string]interface{}{
+			"database": "test",
+			"table":    "s",
+			"tableID":  int64(100),
+			"version":  int64(1),
+			"columns": []interface{}{
+				column("id", "int", "binary"), column("name", "varchar", "utf8mb4"), column("data", "blob", "binary"),
+			},
+			"indexes": []interface{}{},
+		},
+	})
+
+	newRow := func(name string) []byte {
+		return encode("DML", "com.pingcap.simple.avro.DML", map[string]interface{}{
+			"version":       int32(1),
+			"database":      "test",
+			"table":         "s",
+			"tableID":       int64(100),
+			"type":          "INSERT",
+			"commitTs":      int64(100),
+			"buildTs":       int64(1),
+			"schemaVersion": int64(1),
+			"checksum": goavro.Union("com.pingcap.simple.avro.Checksum", map[string]interface{}{
+				"version":   int32(0),
+				"corrupted": false,
+				"current":   int64(testCanalJSONChecksum(1, "b", []byte{0xe9, 0x01})),
+				"previous":  int64(0),
+			}),
+			"data": goavro.Union("map", map[string]interface{}{
+				"id":   goavro.Union("long", int64(1)),
+				"name": goavro.Union("string", name),
+				"data": goavro.Union("bytes", []byte{0xe9, 0x01}),
+			}),
+		})
+	}
+
+	v, err := newSimpleVerifier(simpleEncodingAvro, 16)
+	require.NoError(t, err)
+	_, err = v.verify(kafka.Message{Value: bootstrap})
+	require.NoError(t, err)
+
+	result, err := v.verify(kafka.Message{Value: newRow("b")})
+	require.NoError(t, err)
+	require.Equal(t, outcomeVerified, result.outcome)
+
+	_, err = v.verify(kafka.Message{Value: newRow("c")})
+	require.ErrorIs(t, err, errChecksumMismatch)
+
+	// the malformed message is a decode error, instead of a panic.
+	_, err = v.verify(kafka.Message{Value: []byte{0xff}})
+	require.Error(t, err)
+}
@@ -0,0 +1,105 @@
+// Copyright 2023 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"container/list"
+
+	"github.com/pingcap/log"
+	"go.uber.org/zap"
+)
+
+// simpleTableSchema is the table schema carried by the bootstrap and DDL messages of the simple protocol,
+// only fields used by the verification are kept.
+type simpleTableSchema struct {
+	Schema  string `json:"database"`
+	Table   string `json:"table"`
+	TableID int64  `json:"tableID"`
+	Version uint64 `json:"version"`
+	// Columns are sorted by the column ID, which is the order of the checksum calculation.
+	Columns []*simpleColumnSchema `json:"columns"`
+}
+
+type simpleColumnSchema struct {
+	Name     string         `json:"name"`
+	DataType simpleDataType `json:"dataType"`
+	Nullable bool           `json:"nullable"`
+}
+
+type simpleDataType struct {
+	// MySQLType is the type string, such as `varchar`, `varbinary` and `longblob`.
+	MySQLType string `json:"mysqlType"`
+	Charset   string `json:"charset"`
+	Unsigned  bool   `json:"unsigned,omitempty"`
+}
+
+type simpleSchemaKey struct {
+	schema  string
+	table   string
+	version uint64
+}
+
+// simpleSchemaStore keeps the table schemas received from the bootstrap messages, keyed by (schema, table, version).
+// It evicts the least recently used schema once the capacity is reached, which is safe,
+// since the bootstrap message is sent periodically, rows of the evicted schema wait for the next one.
+type simpleSchemaStore struct {
+	capacity int
+	lru      *list.List
+	entries  map[simpleSchemaKey]*list.Element
+}
+
+func newSimpleSchemaStore(capacity int) *simpleSchemaStore {
+	return &simpleSchemaStore{
+		capacity: capacity,
+		lru:      list.New(),
+		entries:  make(map[simpleSchemaKey]*list.Element),
+	}
+}
+
+func (s *simpleSchemaStore) put(schema *simpleTableSchema) {
+	if schema == nil {
+		return
+	}
+	key := simpleSchemaKey{schema: schema.Schema, table: schema.Table, version: schema.Version}
+	if element, ok := s.entries[key]; ok {
+		// the schema of the same version never changes, only refresh it.
+		s.lru.MoveToFront(element)
+		return
+	}
+	s.entries[key] = s.lru.PushFront(schema)
+	log.Info("table schema stored", zap.String("schema", schema.Schema),
+		zap.String("table", schema.Table), zap.Uint64("version", schema.Version))
+
+	for s.lru.Len() > s.capacity {
+		oldest := s.lru.Back()
+		evicted := s.lru.Remove(oldest).(*simpleTableSchema)
+		delete(s.entries, simpleSchemaKey{schema: evicted.Schema, table: evicted.Table, version: evicted.Version})
+		log.Info("table schema evicted", zap.String("schema", evicted.Schema),
+			zap.String("table", evicted.Table), zap.Uint64("version", evicted.Version))
+	}
+}
+
+// get returns the table schema of the exact version, nil if not received yet or evicted.
+func (s *simpleSchemaStore) get(schema, table string, version uint64) *simpleTableSchema {
+	element, ok := s.entries[simpleSchemaKey{schema: schema, table: table, version: version}]
+	if !ok {
+		return nil
+	}
+	s.lru.MoveToFront(element)
+	return element.Value.(*simpleTableSchema)
+}
+
+func (s *simpleSchemaStore) len() int {
+	return s.lru.Len()
+}
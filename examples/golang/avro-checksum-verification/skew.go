@@ -0,0 +1,166 @@
+// Copyright 2023 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+	"go.uber.org/zap"
+)
+
+const (
+	// timestampCreateTime is the kafka message timestamp set by the producer, which is kept by the relays copying it.
+	timestampCreateTime = "create-time"
+	// timestampLogAppendTime is the kafka message timestamp set by the broker once the message is appended.
+	timestampLogAppendTime = "log-append-time"
+)
+
+// skewStats is the skew of the kafka message timestamp against the physical time of the commit ts.
+type skewStats struct {
+	count      uint64
+	sumMs      int64
+	minMs      int64
+	maxMs      int64
+	violations uint64
+}
+
+func (s *skewStats) observe(ms int64) {
+	if s.count == 0 || ms < s.minMs {
+		s.minMs = ms
+	}
+	if s.count == 0 || ms > s.maxMs {
+		s.maxMs = ms
+	}
+	s.count++
+	s.sumMs += ms
+}
+
+// skewSummary is the skew in milliseconds, negative if the kafka timestamp is earlier than the commit.
+type skewSummary struct {
+	Count uint64 `json:"count"`
+	MinMs int64  `json:"minMs"`
+	AvgMs int64  `json:"avgMs"`
+	MaxMs int64  `json:"maxMs"`
+	// Violations is the number of events whose skew is negative or beyond --max-skew, 0 if the check is disabled.
+	Violations uint64 `json:"violations,omitempty"`
+}
+
+func (s *skewStats) summary() *skewSummary {
+	summary := &skewSummary{Count: s.count, MinMs: s.minMs, MaxMs: s.maxMs, Violations: s.violations}
+	if s.count > 0 {
+		summary.AvgMs = s.sumMs / int64(s.count)
+	}
+	return summary
+}
+
+// skewReport is the skew of the kafka message timestamp against the commit of the events.
+type skewReport struct {
+	*skewSummary
+	// TimestampType is the type of the kafka message timestamp set by --kafka-timestamp-type, which states the skew,
+	// `create-time` is from the commit to the producer, `log-append-time` is to the broker the verifier consumes.
+	TimestampType string `json:"timestampType"`
+	// MaxSkew is the threshold of the check, empty if the check is disabled.
+	MaxSkew string `json:"maxSkew,omitempty"`
+	// Tables are the skew of each table, keyed by `schema.table`.
+	Tables map[string]*skewSummary `json:"tables,omitempty"`
+}
+
+// skewTracker records the skew of the kafka message timestamp against the physical time of the commit ts,
+// overall and of each table, and checks it's bounded, so that the messages delayed or reordered by the relays are found.
+type skewTracker struct {
+	timestampType string
+	// maxSkew is the skew allowed, the check is disabled if 0.
+	maxSkew time.Duration
+	total   skewStats
+	tables  map[string]*skewStats
+}
+
+func newSkewTracker(timestampType string, maxSkew time.Duration) *skewTracker {
+	return &skewTracker{timestampType: timestampType, maxSkew: maxSkew, tables: make(map[string]*skewStats)}
+}
+
+// observe records the skew of the event, the event without the commit ts or not carrying any row is not counted.
+// It returns the errOrderingViolation if the kafka timestamp is earlier than the commit,
+// or later by more than the max skew, only if the check is enabled.
+func (t *skewTracker) observe(message kafka.Message, result messageResult) error {
+	if result.commitTs == 0 || message.Time.IsZero() ||
+		result.outcome == outcomeSkippedNonRow || result.outcome == outcomeFiltered {
+		return nil
+	}
+	committed := physicalTime(result.commitTs)
+	skew := message.Time.Sub(committed)
+	ms := skew.Milliseconds()
+	t.total.observe(ms)
+	var table *skewStats
+	if result.table != "" {
+		var ok bool
+		if table, ok = t.tables[result.table]; !ok {
+			table = &skewStats{}
+			t.tables[result.table] = table
+		}
+		table.observe(ms)
+	}
+	if t.maxSkew == 0 || (skew >= 0 && skew <= t.maxSkew) {
+		return nil
+	}
+	t.total.violations++
+	if table != nil {
+		table.violations++
+	}
+	if skew < 0 {
+		return fmt.Errorf("%w: kafka timestamp %s is earlier than the commit %s by %s", errOrderingViolation,
+			message.Time.UTC().Format(time.RFC3339Nano), committed.UTC().Format(time.RFC3339Nano), -skew)
+	}
+	return fmt.Errorf("%w: kafka timestamp %s is later than the commit %s by %s, beyond the max skew %s",
+		errOrderingViolation, message.Time.UTC().Format(time.RFC3339Nano), committed.UTC().Format(time.RFC3339Nano),
+		skew, t.maxSkew)
+}
+
+// snapshot returns the report of the skew, nil if no event is counted.
+func (t *skewTracker) snapshot() *skewReport {
+	if t.total.count == 0 {
+		return nil
+	}
+	r := &skewReport{skewSummary: t.total.summary(), TimestampType: t.timestampType}
+	if t.maxSkew > 0 {
+		r.MaxSkew = t.maxSkew.String()
+	}
+	if len(t.tables) > 0 {
+		r.Tables = make(map[string]*skewSummary, len(t.tables))
+		for table, s := range t.tables {
+			r.Tables[table] = s.summary()
+		}
+	}
+	return r
+}
+
+// fields returns the skew overall and of each table, to be logged.
+func (t *skewTracker) fields() []zap.Field {
+	if t.total.count == 0 {
+		return nil
+	}
+	tables := make(map[string]string, len(t.tables))
+	for table, s := range t.tables {
+		summary := s.summary()
+		tables[table] = fmt.Sprintf("min=%dms avg=%dms max=%dms", summary.MinMs, summary.AvgMs, summary.MaxMs)
+	}
+	summary := t.total.summary()
+	return []zap.Field{
+		zap.String("kafkaTimestampType", t.timestampType), zap.Int64("skewMinMs", summary.MinMs),
+		zap.Int64("skewAvgMs", summary.AvgMs), zap.Int64("skewMaxMs", summary.MaxMs),
+		zap.Uint64("skewViolations", summary.Violations), zap.Any("tableSkew", tables),
+	}
+}
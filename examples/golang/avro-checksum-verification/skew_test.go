@@ -0,0 +1,114 @@
+// Copyright 2023 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSkewTracker(t *testing.T) {
+	t.Parallel()
+
+	committed := time.Date(2023, 5, 1, 0, 0, 0, 0, time.UTC)
+	at := func(d time.Duration) kafka.Message { return kafka.Message{Time: committed.Add(d)} }
+	result := func(table string) messageResult {
+		return messageResult{outcome: outcomeVerified, table: table, commitTs: commitTsAt(committed)}
+	}
+
+	tracker := newSkewTracker(timestampCreateTime, 0)
+	require.Nil(t, tracker.snapshot())
+	require.NoError(t, tracker.observe(at(100*time.Millisecond), result("test.t1")))
+	require.NoError(t, tracker.observe(at(300*time.Millisecond), result("test.t1")))
+	// the check is disabled, the negative skew is only recorded.
+	require.NoError(t, tracker.observe(at(-time.Second), result("test.t2")))
+	// the events without the kafka timestamp, the commit ts or any row are excluded.
+	require.NoError(t, tracker.observe(kafka.Message{}, result("test.t1")))
+	require.NoError(t, tracker.observe(at(time.Hour), messageResult{outcome: outcomeVerified, table: "test.t1"}))
+	require.NoError(t, tracker.observe(at(time.Hour),
+		messageResult{outcome: outcomeSkippedNonRow, commitTs: commitTsAt(committed)}))
+
+	r := tracker.snapshot()
+	require.Equal(t, &skewSummary{Count: 3, MinMs: -1000, AvgMs: -200, MaxMs: 300}, r.skewSummary)
+	require.Equal(t, timestampCreateTime, r.TimestampType)
+	require.Empty(t, r.MaxSkew)
+	require.Equal(t, map[string]*skewSummary{
+		"test.t1": {Count: 2, MinMs: 100, AvgMs: 200, MaxMs: 300},
+		"test.t2": {Count: 1, MinMs: -1000, AvgMs: -1000, MaxMs: -1000},
+	}, r.Tables)
+
+	tracker = newSkewTracker(timestampLogAppendTime, time.Minute)
+	require.NoError(t, tracker.observe(at(time.Minute), result("test.t1")))
+	err := tracker.observe(at(-time.Millisecond), result("test.t1"))
+	require.True(t, errors.Is(err, errOrderingViolation))
+	require.ErrorContains(t, err, "kafka timestamp 2023-04-30T23:59:59.999Z is earlier than the commit 2023-05-01T00:00:00Z by 1ms")
+	err = tracker.observe(at(2*time.Minute), result("test.t2"))
+	require.True(t, errors.Is(err, errOrderingViolation))
+	require.ErrorContains(t, err, "later than the commit 2023-05-01T00:00:00Z by 2m0s, beyond the max skew 1m0s")
+
+	r = tracker.snapshot()
+	require.Equal(t, uint64(2), r.Violations)
+	require.Equal(t, "1m0s", r.MaxSkew)
+	require.Equal(t, uint64(1), r.Tables["test.t1"].Violations)
+	require.Equal(t, uint64(1), r.Tables["test.t2"].Violations)
+}
+
+func TestVerifierSkew(t *testing.T) {
+	t.Parallel()
+
+	registry := newTestRegistry(t, map[int]string{testSchemaID: testValueSchema})
+	cfg := newDefaultConfig()
+	cfg.schemaRegistryURL = registry.URL
+	cfg.maxSkew = 10 * time.Second
+	messages := []kafka.Message{
+		newVerifiedTestMessage(t, 0, 1, "a"), newVerifiedTestMessage(t, 1, 2, "b"), newVerifiedTestMessage(t, 2, 3, "c"),
+	}
+	messages[0].Time = physicalTime(400000000000000000).Add(time.Second)
+	// delayed by a relay.
+	messages[1].Time = physicalTime(400000000000000001).Add(time.Hour)
+	messages[2].Time = physicalTime(400000000000000002).Add(2 * time.Second)
+	reader := &fakeReader{messages: messages}
+	v := newTestVerifier(cfg, reader)
+	err := v.run(context.Background())
+	// the skew violation is tolerated as the other ordering violations, the row itself is verified.
+	require.Equal(t, exitCodeOrderingError, v.finish(err))
+	require.Equal(t, uint64(3), v.counters.Verified)
+	require.Equal(t, uint64(1), v.counters.OrderingErrors)
+	require.Equal(t, []int64{0, 1, 2}, reader.committedOffsets())
+	require.Len(t, v.report.Failures, 1)
+	require.Equal(t, int64(1), v.report.Failures[0].Offset)
+	require.Equal(t, uint64(3), v.report.KafkaSkew.Count)
+	require.Equal(t, int64(1000), v.report.KafkaSkew.MinMs)
+	require.Equal(t, uint64(1), v.report.KafkaSkew.Tables["test.t"].Violations)
+}
+
+func TestSkewConfig(t *testing.T) {
+	t.Parallel()
+
+	cfg := newDefaultConfig()
+	cfg.kafkaTimestampType = "append-time"
+	require.ErrorContains(t, cfg.validate(), "unknown kafka timestamp type: append-time")
+	cfg.kafkaTimestampType = timestampLogAppendTime
+	cfg.maxSkew = -time.Second
+	require.ErrorContains(t, cfg.validate(), "max skew must not be negative")
+	cfg.maxSkew = time.Minute
+	require.NoError(t, cfg.validate())
+	cfg.replay = "./dump"
+	require.ErrorContains(t, cfg.validate(), "max skew is not supported by the replay")
+}
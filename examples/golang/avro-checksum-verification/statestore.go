@@ -0,0 +1,268 @@
+// Copyright 2023 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"os"
+	"path/filepath"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// stateStore is the key-value store of the tracking state, so that the ordering and dedup checks
+// are not bounded by the memory, and survive the restart.
+type stateStore interface {
+	// Get returns the value of the key, false if it's absent.
+	Get(key []byte) ([]byte, bool, error)
+	Put(key, value []byte) error
+	Delete(key []byte) error
+	// Iterate calls fn for the keys with the prefix in order, until fn returns false.
+	// The keys may be put or deleted by fn.
+	Iterate(prefix []byte, fn func(key, value []byte) bool) error
+	// Flush commits the pending writes, so that they survive the crash.
+	Flush() error
+	Close() error
+}
+
+const (
+	stateFileName = "state.db"
+	// stateBatchSize is the number of writes committed in one transaction, so that the fsync of each write
+	// does not dominate the verification. The pending writes are also committed before the kafka offsets,
+	// only the writes of the messages not committed, which are consumed again, are lost on crash.
+	stateBatchSize = 4096
+	// stateCompactInterval is the interval to remove the entries not seen within the TTL.
+	stateCompactInterval = time.Hour
+)
+
+var (
+	stateBucket   = []byte("state")
+	stateTopicKey = []byte("meta/topic")
+)
+
+// boltStateStore is the stateStore in a bbolt file under the state dir.
+type boltStateStore struct {
+	db *bolt.DB
+	// pending are the writes not committed yet, the nil value is a deletion.
+	pending map[string][]byte
+	// iterating defers the commit until the iteration finishes, since the write transaction
+	// cannot be started inside the read one.
+	iterating bool
+}
+
+// openStateStore opens the state store in the dir, it fails if the dir is used by another topic,
+// or by another running verifier.
+func openStateStore(dir, topic string) (*boltStateStore, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	db, err := bolt.Open(filepath.Join(dir, stateFileName), 0o600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		if errors.Is(err, bolt.ErrTimeout) {
+			return nil, errors.New("state dir is used by another verifier: " + dir)
+		}
+		return nil, err
+	}
+	// the freelist is rebuilt on open instead, which saves a write of each commit.
+	db.NoFreelistSync = true
+	err = db.Update(func(tx *bolt.Tx) error {
+		bucket, err := tx.CreateBucketIfNotExists(stateBucket)
+		if err != nil {
+			return err
+		}
+		previous := bucket.Get(stateTopicKey)
+		if previous == nil {
+			return bucket.Put(stateTopicKey, []byte(topic))
+		}
+		if string(previous) != topic {
+			return errors.New("state dir belongs to another topic: " + string(previous))
+		}
+		return nil
+	})
+	if err != nil {
+		_ = db.Close()
+		return nil, err
+	}
+	return &boltStateStore{db: db, pending: make(map[string][]byte)}, nil
+}
+
+func (s *boltStateStore) Get(key []byte) ([]byte, bool, error) {
+	if value, ok := s.pending[string(key)]; ok {
+		return value, value != nil, nil
+	}
+	var value []byte
+	err := s.db.View(func(tx *bolt.Tx) error {
+		// the value is only valid in the transaction.
+		if v := tx.Bucket(stateBucket).Get(key); v != nil {
+			value = append([]byte{}, v...)
+		}
+		return nil
+	})
+	return value, value != nil, err
+}
+
+func (s *boltStateStore) Put(key, value []byte) error {
+	s.pending[string(key)] = append([]byte{}, value...)
+	return s.maybeFlush()
+}
+
+func (s *boltStateStore) Delete(key []byte) error {
+	s.pending[string(key)] = nil
+	return s.maybeFlush()
+}
+
+func (s *boltStateStore) maybeFlush() error {
+	if len(s.pending) < stateBatchSize || s.iterating {
+		return nil
+	}
+	return s.Flush()
+}
+
+func (s *boltStateStore) Flush() error {
+	if len(s.pending) == 0 {
+		return nil
+	}
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(stateBucket)
+		for key, value := range s.pending {
+			var err error
+			if value == nil {
+				err = bucket.Delete([]byte(key))
+			} else {
+				err = bucket.Put([]byte(key), value)
+			}
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	s.pending = make(map[string][]byte)
+	return nil
+}
+
+func (s *boltStateStore) Iterate(prefix []byte, fn func(key, value []byte) bool) error {
+	if err := s.Flush(); err != nil {
+		return err
+	}
+	s.iterating = true
+	err := s.db.View(func(tx *bolt.Tx) error {
+		cursor := tx.Bucket(stateBucket).Cursor()
+		for key, value := cursor.Seek(prefix); key != nil && bytes.HasPrefix(key, prefix); key, value = cursor.Next() {
+			if !fn(key, value) {
+				return nil
+			}
+		}
+		return nil
+	})
+	s.iterating = false
+	if err != nil {
+		return err
+	}
+	return s.maybeFlush()
+}
+
+func (s *boltStateStore) Close() error {
+	if err := s.Flush(); err != nil {
+		_ = s.db.Close()
+		return err
+	}
+	return s.db.Close()
+}
+
+// trackerState is the stateStore used by a tracker, the keys are under the prefix of the tracker,
+// and each value carries the time it's last seen, so that the ones not seen within the TTL are removed.
+type trackerState struct {
+	store  stateStore
+	prefix string
+	ttl    time.Duration
+	// lastCompact is the time the expired entries are last removed.
+	lastCompact time.Time
+	// expired is the number of entries removed by the TTL.
+	expired uint64
+	now     func() time.Time
+}
+
+func newTrackerState(store stateStore, prefix string, ttl time.Duration) *trackerState {
+	return &trackerState{store: store, prefix: prefix, ttl: ttl, now: time.Now}
+}
+
+// get returns the value of the key without the seen time, false if it's absent or expired.
+func (s *trackerState) get(key []byte) ([]byte, bool, error) {
+	value, ok, err := s.store.Get(append([]byte(s.prefix), key...))
+	if err != nil || !ok || len(value) < 8 {
+		return nil, false, err
+	}
+	if s.expiredAt(value, s.now()) {
+		return nil, false, nil
+	}
+	return value[8:], true, nil
+}
+
+// touch refreshes the seen time of the value returned by get, it's only written if the time is half way
+// to be expired, so that the key seen frequently does not write on every event.
+func (s *trackerState) touch(key, value []byte) error {
+	stored, ok, err := s.store.Get(append([]byte(s.prefix), key...))
+	if err != nil || !ok || len(stored) < 8 {
+		return err
+	}
+	seen := time.Unix(0, int64(binary.BigEndian.Uint64(stored)))
+	if s.now().Sub(seen) < s.ttl/2 {
+		return nil
+	}
+	return s.put(key, value)
+}
+
+// put writes the value of the key with the current time.
+func (s *trackerState) put(key, value []byte) error {
+	data := binary.BigEndian.AppendUint64(make([]byte, 0, 8+len(value)), uint64(s.now().UnixNano()))
+	return s.store.Put(append([]byte(s.prefix), key...), append(data, value...))
+}
+
+func (s *trackerState) expiredAt(value []byte, now time.Time) bool {
+	return now.Sub(time.Unix(0, int64(binary.BigEndian.Uint64(value)))) > s.ttl
+}
+
+// compact removes the entries not seen within the TTL, at most once in the compact interval,
+// since it scans all entries of the tracker.
+func (s *trackerState) compact() error {
+	now := s.now()
+	if now.Sub(s.lastCompact) < stateCompactInterval {
+		return nil
+	}
+	s.lastCompact = now
+	var expired [][]byte
+	err := s.store.Iterate([]byte(s.prefix), func(key, value []byte) bool {
+		if len(value) < 8 || s.expiredAt(value, now) {
+			expired = append(expired, append([]byte{}, key...))
+		}
+		return true
+	})
+	if err != nil {
+		return err
+	}
+	for _, key := range expired {
+		if err := s.store.Delete(key); err != nil {
+			return err
+		}
+	}
+	s.expired += uint64(len(expired))
+	return nil
+}
@@ -0,0 +1,230 @@
+// Copyright 2023 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStateStore(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	store, err := openStateStore(dir, "topic")
+	require.NoError(t, err)
+	require.NoError(t, store.Put([]byte("a/1"), []byte("x")))
+	require.NoError(t, store.Put([]byte("a/2"), []byte("y")))
+	require.NoError(t, store.Put([]byte("b/1"), []byte("z")))
+	require.NoError(t, store.Delete([]byte("a/2")))
+
+	value, ok, err := store.Get([]byte("a/1"))
+	require.NoError(t, err)
+	require.True(t, ok)
+	require.Equal(t, []byte("x"), value)
+	_, ok, err = store.Get([]byte("a/2"))
+	require.NoError(t, err)
+	require.False(t, ok)
+
+	// the dir is locked by the running store.
+	_, err = openStateStore(dir, "topic")
+	require.ErrorContains(t, err, "used by another verifier")
+
+	// the pending writes are committed on close, and survive the restart.
+	require.NoError(t, store.Close())
+	store, err = openStateStore(dir, "topic")
+	require.NoError(t, err)
+	var keys []string
+	require.NoError(t, store.Iterate([]byte("a/"), func(key, value []byte) bool {
+		keys = append(keys, string(key)+"="+string(value))
+		return true
+	}))
+	require.Equal(t, []string{"a/1=x"}, keys)
+	require.NoError(t, store.Close())
+
+	_, err = openStateStore(dir, "another")
+	require.ErrorContains(t, err, "belongs to another topic: topic")
+}
+
+func TestTrackerStateTTL(t *testing.T) {
+	t.Parallel()
+
+	store, err := openStateStore(t.TempDir(), "topic")
+	require.NoError(t, err)
+	defer store.Close()
+	now := time.Unix(1700000000, 0)
+	state := newTrackerState(store, "t/", time.Hour)
+	state.now = func() time.Time { return now }
+
+	require.NoError(t, state.put([]byte("a"), []byte("1")))
+	require.NoError(t, state.put([]byte("b"), []byte("2")))
+	require.NoError(t, state.compact())
+	value, ok, err := state.get([]byte("a"))
+	require.NoError(t, err)
+	require.True(t, ok)
+	require.Equal(t, []byte("1"), value)
+
+	// the key seen again is refreshed once it's half way to be expired.
+	now = now.Add(40 * time.Minute)
+	require.NoError(t, state.touch([]byte("a"), value))
+	now = now.Add(40 * time.Minute)
+	_, ok, err = state.get([]byte("b"))
+	require.NoError(t, err)
+	require.False(t, ok)
+
+	// the expired entries are removed by the compaction, at most once in the interval.
+	require.NoError(t, state.compact())
+	require.Equal(t, uint64(1), state.expired)
+	_, ok, err = store.Get([]byte("t/b"))
+	require.NoError(t, err)
+	require.False(t, ok)
+	now = now.Add(30 * time.Minute)
+	require.NoError(t, state.compact())
+	require.Equal(t, uint64(1), state.expired)
+	now = now.Add(30 * time.Minute)
+	require.NoError(t, state.compact())
+	require.Equal(t, uint64(2), state.expired)
+}
+
+func TestStateTrackersSurviveRestart(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	key := encodeTestMessage(t, testKeySchemaID, testKeySchema, map[string]interface{}{"id": int64(1)})
+	event := messageResult{outcome: outcomeVerified, commitTs: 100 << 18, checksum: 1, ops: map[rowOp]int{opInsert: 1}}
+	open := func() (*boltStateStore, *dedupTracker, *keyPartitionChecker, *commitTsLRU) {
+		store, err := openStateStore(dir, "topic")
+		require.NoError(t, err)
+		d := newDedupTracker(time.Minute, 1)
+		d.state = newTrackerState(store, "dedup/", time.Hour)
+		c := newKeyPartitionChecker(1)
+		c.state = newTrackerState(store, "partition/", time.Hour)
+		l := newCommitTsLRU(1)
+		l.state = newTrackerState(store, "commitTs/", time.Hour)
+		return store, d, c, l
+	}
+
+	store, d, c, l := open()
+	duplicate, err := d.observe(kafka.Message{Key: key, Offset: 1}, event)
+	require.NoError(t, err)
+	require.False(t, duplicate)
+	require.NoError(t, c.observe(kafka.Message{Key: key, Offset: 1}, event))
+	last, err := l.advance("k", 100)
+	require.NoError(t, err)
+	require.Zero(t, last)
+	require.NoError(t, store.Close())
+
+	store, d, c, l = open()
+	defer store.Close()
+	// the message not committed before the restart is consumed again, it's not a duplicate.
+	duplicate, err = d.observe(kafka.Message{Key: key, Offset: 1}, event)
+	require.NoError(t, err)
+	require.False(t, duplicate)
+	duplicate, err = d.observe(kafka.Message{Key: key, Offset: 2}, event)
+	require.NoError(t, err)
+	require.True(t, duplicate)
+	conflict := event
+	conflict.checksum = 2
+	_, err = d.observe(kafka.Message{Key: key, Offset: 3}, conflict)
+	require.ErrorIs(t, err, errDuplicateConflict)
+
+	require.ErrorIs(t, c.observe(kafka.Message{Key: key, Partition: 1, Offset: 1}, event), errOrderingViolation)
+	last, err = l.advance("k", 99)
+	require.NoError(t, err)
+	require.Equal(t, uint64(100), last)
+	report := c.snapshot()
+	require.Zero(t, report.TrackedKeys)
+	require.Equal(t, keyPartitionStateNote, report.Note)
+}
+
+func TestStateFlushedBeforeCommit(t *testing.T) {
+	t.Parallel()
+
+	registry := newTestRegistry(t, map[int]string{testSchemaID: testValueSchema, testKeySchemaID: testKeySchema})
+	cfg := newDefaultConfig()
+	cfg.schemaRegistryURL = registry.URL
+	cfg.dedupWindow = time.Minute
+	cfg.stateDir = t.TempDir()
+	require.NoError(t, cfg.validate())
+	message := newVerifiedTestMessage(t, 0, 1, "a")
+	message.Key = encodeTestMessage(t, testKeySchemaID, testKeySchema, map[string]interface{}{"id": int64(1)})
+	run := func(message kafka.Message) *verifier {
+		reader := &fakeReader{messages: []kafka.Message{message}}
+		v := newTestVerifier(cfg, reader)
+		v.dedup = newDedupTracker(cfg.dedupWindow, cfg.dedupCapacity)
+		require.NoError(t, v.openState())
+		err := v.run(context.Background())
+		require.Equal(t, exitCodeClean, v.finish(err))
+		require.Equal(t, []int64{message.Offset}, reader.committedOffsets())
+		return v
+	}
+
+	v := run(message)
+	// the process is dropped without closing the verifier, the writes not flushed are lost.
+	require.NoError(t, v.state.db.Close())
+
+	// the committed message is not consumed again, the event delivered again is still found as a duplicate.
+	message.Offset = 1
+	v = run(message)
+	defer v.state.Close()
+	require.Equal(t, counters{Messages: 1, Verified: 1, Duplicates: 1}, v.counters)
+}
+
+func TestStateDirConfig(t *testing.T) {
+	t.Parallel()
+
+	cfg := newDefaultConfig()
+	cfg.stateDir = t.TempDir()
+	require.ErrorContains(t, cfg.validate(), "state dir is only used by")
+	cfg.dedupWindow = time.Minute
+	require.NoError(t, cfg.validate())
+	cfg.stateTTL = 0
+	require.ErrorContains(t, cfg.validate(), "state TTL must be positive")
+}
+
+// BenchmarkDedupTracker compares the dedup tracking in memory and in the state store.
+func BenchmarkDedupTracker(b *testing.B) {
+	key := make([]byte, 13)
+	key[0] = magicByte
+	run := func(b *testing.B, d *dedupTracker) {
+		for i := 0; i < b.N; i++ {
+			binary.BigEndian.PutUint64(key[5:], uint64(i%(1<<16)))
+			result := messageResult{
+				outcome: outcomeVerified, commitTs: uint64(i) << 18, checksum: uint64(i), ops: map[rowOp]int{opInsert: 1},
+			}
+			if _, err := d.observe(kafka.Message{Key: key, Offset: int64(i)}, result); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+	b.Run("memory", func(b *testing.B) {
+		run(b, newDedupTracker(time.Hour, 1<<20))
+	})
+	b.Run("disk", func(b *testing.B) {
+		store, err := openStateStore(b.TempDir(), fmt.Sprintf("bench-%d", b.N))
+		if err != nil {
+			b.Fatal(err)
+		}
+		defer store.Close()
+		d := newDedupTracker(time.Hour, 1<<20)
+		d.state = newTrackerState(store, "dedup/", time.Hour)
+		run(b, d)
+	})
+}
@@ -0,0 +1,378 @@
+// Copyright 2023 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/pingcap/log"
+	"github.com/segmentio/kafka-go"
+	"go.uber.org/zap"
+)
+
+const (
+	// storageMetaDir is the directory keeping the schema files of the table, and the index file of the data files.
+	storageMetaDir   = "meta"
+	storageIndexFile = "CDC.index"
+)
+
+var (
+	// the data file is `CDC{num}.json`, the number contains at least 6 digits, such as `CDC000001.json`.
+	storageDataFileRE = regexp.MustCompile(`^CDC(\d{6,})\.json$`)
+	// the schema file is `schema_{tableVersion}_{checksum}.json`.
+	storageSchemaFileRE = regexp.MustCompile(`^schema_(\d+)_\d{10}\.json$`)
+)
+
+// storageTableDefinition is the table schema file written by the storage sink,
+// only fields used by the verification are decoded.
+type storageTableDefinition struct {
+	Table        string `json:"Table"`
+	Schema       string `json:"Schema"`
+	TableVersion uint64 `json:"TableVersion"`
+	// Columns are in the order of the table definition, which is the order of the checksum calculation.
+	Columns []storageTableColumn `json:"TableColumns"`
+}
+
+type storageTableColumn struct {
+	Name string `json:"ColumnName"`
+	// Tp is the type string in upper case, such as `VARCHAR`, `INT UNSIGNED` and `BLOB`.
+	Tp string `json:"ColumnType"`
+}
+
+type storageTableKey struct {
+	schema       string
+	table        string
+	tableVersion uint64
+}
+
+// storageDataFile is a data file with all its content persisted, which is recorded by the index file.
+type storageDataFile struct {
+	// path is relative to the storage directory, separated by slashes.
+	path  string
+	dir   string
+	index uint64
+	key   storageTableKey
+	// definition is the schema file of the table version, nil if not found.
+	definition *storageTableDefinition
+}
+
+// storageLayout is the result of walking the storage directory.
+type storageLayout struct {
+	// files are ordered by the table, the table version, the directory and the file index.
+	files []*storageDataFile
+	// inProgress are the data files not recorded by the index file yet, they may be still written.
+	inProgress []string
+}
+
+// scanStorage walks the output directory of the storage sink, which is laid out as
+// `<schema>/<table>/<tableVersion>/[<partitionID>/][<date>/]CDC{num}.json`,
+// and pairs each data file with the schema file `<schema>/<table>/meta/schema_{tableVersion}_{checksum}.json`.
+func scanStorage(root string) (*storageLayout, error) {
+	definitions := make(map[storageTableKey]*storageTableDefinition)
+	var candidates []*storageDataFile
+	err := filepath.WalkDir(root, func(name string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			return nil
+		}
+		rel, err := filepath.Rel(root, name)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		parts := strings.Split(rel, "/")
+
+		// the database schema file `<schema>/meta/schema_*.json` is not relevant.
+		if len(parts) == 4 && parts[2] == storageMetaDir {
+			matches := storageSchemaFileRE.FindStringSubmatch(parts[3])
+			if matches == nil {
+				return nil
+			}
+			definition, err := loadStorageTableDefinition(name)
+			if err != nil {
+				return fmt.Errorf("load schema file %s failed: %w", rel, err)
+			}
+			tableVersion, _ := strconv.ParseUint(matches[1], 10, 64)
+			key := storageTableKey{schema: parts[0], table: parts[1], tableVersion: tableVersion}
+			definitions[key] = definition
+			return nil
+		}
+
+		matches := storageDataFileRE.FindStringSubmatch(parts[len(parts)-1])
+		if len(parts) < 4 || matches == nil {
+			return nil
+		}
+		tableVersion, err := strconv.ParseUint(parts[2], 10, 64)
+		if err != nil {
+			log.Warn("unexpected data file path, ignore it", zap.String("path", rel))
+			return nil
+		}
+		index, _ := strconv.ParseUint(matches[1], 10, 64)
+		candidates = append(candidates, &storageDataFile{
+			path:  rel,
+			dir:   path.Dir(rel),
+			index: index,
+			key:   storageTableKey{schema: parts[0], table: parts[1], tableVersion: tableVersion},
+		})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(candidates, func(i, j int) bool {
+		a, b := candidates[i], candidates[j]
+		if a.key.schema != b.key.schema {
+			return a.key.schema < b.key.schema
+		}
+		if a.key.table != b.key.table {
+			return a.key.table < b.key.table
+		}
+		if a.key.tableVersion != b.key.tableVersion {
+			return a.key.tableVersion < b.key.tableVersion
+		}
+		if a.dir != b.dir {
+			return a.dir < b.dir
+		}
+		return a.index < b.index
+	})
+
+	layout := &storageLayout{}
+	indexes := make(map[string]uint64)
+	for _, file := range candidates {
+		last, ok := indexes[file.dir]
+		if !ok {
+			last, err = loadStorageIndex(filepath.Join(root, filepath.FromSlash(file.dir)))
+			if err != nil {
+				return nil, err
+			}
+			indexes[file.dir] = last
+		}
+		// the index file is updated after the data file is written, files beyond it are still in progress.
+		if file.index > last {
+			log.Info("data file is in progress, skip it", zap.String("path", file.path))
+			layout.inProgress = append(layout.inProgress, file.path)
+			continue
+		}
+		file.definition = definitions[file.key]
+		layout.files = append(layout.files, file)
+	}
+	return layout, nil
+}
+
+func loadStorageTableDefinition(name string) (*storageTableDefinition, error) {
+	content, err := os.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	definition := &storageTableDefinition{}
+	if err := json.Unmarshal(content, definition); err != nil {
+		return nil, err
+	}
+	return definition, nil
+}
+
+// loadStorageIndex returns the index of the last data file recorded by the index file in the directory,
+// 0 if the index file is not written yet, then all data files in the directory are in progress.
+func loadStorageIndex(dir string) (uint64, error) {
+	content, err := os.ReadFile(filepath.Join(dir, storageMetaDir, storageIndexFile))
+	if errors.Is(err, fs.ErrNotExist) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	matches := storageDataFileRE.FindStringSubmatch(strings.TrimSpace(string(content)))
+	if matches == nil {
+		return 0, fmt.Errorf("invalid index file in %s: %q", dir, content)
+	}
+	return strconv.ParseUint(matches[1], 10, 64)
+}
+
+// storageReader reads the data files one by one, each canal-json message is returned as a kafka message,
+// the topic is the path of the data file, and the offset is the line number in the file.
+// Nothing is committed, since the files are verified from scratch each time.
+type storageReader struct {
+	root  string
+	files []*storageDataFile
+
+	next  int
+	path  string
+	lines [][]byte
+	line  int
+}
+
+func newStorageReader(root string, files []*storageDataFile) *storageReader {
+	return &storageReader{root: root, files: files}
+}
+
+// FetchMessage returns the next message, io.EOF if all files are consumed.
+func (r *storageReader) FetchMessage(ctx context.Context) (kafka.Message, error) {
+	for {
+		if err := ctx.Err(); err != nil {
+			return kafka.Message{}, err
+		}
+		for r.line < len(r.lines) {
+			value := bytes.TrimSpace(r.lines[r.line])
+			r.line++
+			if len(value) != 0 {
+				return kafka.Message{Topic: r.path, Offset: int64(r.line), Value: value}, nil
+			}
+		}
+		if r.next >= len(r.files) {
+			return kafka.Message{}, io.EOF
+		}
+
+		file := r.files[r.next]
+		r.next++
+		content, err := os.ReadFile(filepath.Join(r.root, filepath.FromSlash(file.path)))
+		if err != nil {
+			return kafka.Message{}, err
+		}
+		log.Info("verify data file", zap.String("path", file.path))
+		// each message is terminated by the `\r\n` or `\n`.
+		r.path, r.lines, r.line = file.path, bytes.Split(content, []byte("\n")), 0
+	}
+}
+
+func (r *storageReader) CommitMessages(_ context.Context, _ ...kafka.Message) error {
+	return nil
+}
+
+func (r *storageReader) Close() error {
+	return nil
+}
+
+// storageVerifier verifies the canal-json messages in the data files,
+// the column order and types are taken from the schema file of the table version.
+type storageVerifier struct {
+	canal *canalJSONVerifier
+	files map[string]*storageDataFile
+}
+
+func newStorageVerifier(canal *canalJSONVerifier, files []*storageDataFile) *storageVerifier {
+	s := &storageVerifier{canal: canal, files: make(map[string]*storageDataFile, len(files))}
+	for _, file := range files {
+		s.files[file.path] = file
+	}
+	return s
+}
+
+func (s *storageVerifier) verify(message kafka.Message) (messageResult, error) {
+	file, ok := s.files[message.Topic]
+	if !ok {
+		return messageResult{}, errors.New("unknown data file: " + message.Topic)
+	}
+	result := messageResult{table: file.key.schema + "." + file.key.table}
+	// the table is known by the path, the line is not decoded if filtered.
+	if s.canal.filter.filtered(result.table) {
+		result.add(outcomeFiltered, 0)
+		return result, nil
+	}
+	if file.definition == nil {
+		return result, fmt.Errorf("schema file of the table version %d not found", file.key.tableVersion)
+	}
+
+	var m canalJSONMessage
+	if err := json.Unmarshal(message.Value, &m); err != nil {
+		return result, err
+	}
+	if !m.IsDDL && m.EventType != canalJSONTypeWatermark {
+		if err := applyStorageTableDefinition(&m, file.definition); err != nil {
+			return result, err
+		}
+	}
+	return result, s.canal.verifyAndCollect(&m, &result)
+}
+
+// applyStorageTableDefinition sorts the columns of the row by the table definition, and takes the column types from it,
+// so that a row which does not match the table version is reported, instead of verified by the wrong schema.
+func applyStorageTableDefinition(m *canalJSONMessage, definition *storageTableDefinition) error {
+	names := make([]string, 0, len(definition.Columns))
+	m.MySQLType = make(map[string]string, len(definition.Columns))
+	for _, column := range definition.Columns {
+		names = append(names, column.Name)
+		m.MySQLType[column.Name] = column.Tp
+	}
+	for i := range m.Data {
+		row := &m.Data[i]
+		if len(row.names) != len(names) {
+			return fmt.Errorf("row carries %d columns, but the table version %d has %d",
+				len(row.names), definition.TableVersion, len(names))
+		}
+		for _, name := range names {
+			if _, ok := row.values[name]; !ok {
+				return fmt.Errorf("column %s of the table version %d not found in the row",
+					name, definition.TableVersion)
+			}
+		}
+		row.names = names
+	}
+	return nil
+}
+
+// localStorageDir returns the local directory of the storage sink output, which is a path or a `file://` URI.
+// The external storage, such as `s3://`, `gcs://` and `azure://`, is not supported,
+// the bucket prefix should be synced to the local disk first.
+func localStorageDir(dir string) (string, error) {
+	u, err := url.Parse(dir)
+	if err != nil || u.Scheme == "" || len(u.Scheme) == 1 {
+		// a path which cannot be parsed as the URI, or the drive letter on Windows.
+		return dir, nil
+	}
+	if u.Scheme != "file" {
+		return "", fmt.Errorf("unsupported storage %s, only the local directory is supported, "+
+			"sync the bucket prefix to the local disk first", u.Scheme+"://")
+	}
+	if u.Host != "" && u.Host != "localhost" {
+		return "", errors.New("the file URI of the storage directory must not carry a remote host: " + dir)
+	}
+	return u.Path, nil
+}
+
+// newOfflineVerifier verifies the files in the storage directory, instead of consuming kafka.
+func newOfflineVerifier(cfg *config, v *verifier) (*verifier, error) {
+	dir, err := localStorageDir(cfg.storageDir)
+	if err != nil {
+		return nil, err
+	}
+	layout, err := scanStorage(dir)
+	if err != nil {
+		log.Error("scan storage directory failed", zap.String("dir", dir), zap.Error(err))
+		return nil, newInfraError(err)
+	}
+	log.Info("start verifying the storage directory ...", zap.String("dir", dir),
+		zap.Int("files", len(layout.files)), zap.Int("inProgressFiles", len(layout.inProgress)))
+
+	v.reader = newStorageReader(dir, layout.files)
+	v.messageVerifier = newStorageVerifier(v.messageVerifier.(*canalJSONVerifier), layout.files)
+	v.report.SkippedFiles = layout.inProgress
+	return v, nil
+}
@@ -0,0 +1,149 @@
+// Copyright 2023 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/segmentio/kafka-go"
+	"github.com/stretchr/testify/require"
+)
+
+// testStorageSchema returns the schema file of the table `test`.`c` (id INT, name VARCHAR(32), data BLOB),
+// columns are in the given order.
+func testStorageSchema(tableVersion uint64, columns ...string) string {
+	definitions := make([]string, 0, len(columns))
+	for _, column := range columns {
+		tp := map[string]string{"id": "INT", "name": "VARCHAR", "data": "BLOB"}[column]
+		definitions = append(definitions, fmt.Sprintf(`{"ColumnName":"%s","ColumnType":"%s"}`, column, tp))
+	}
+	return fmt.Sprintf(`{"Table":"c","Schema":"test","Version":1,"TableVersion":%d,"Query":"",`+
+		`"TableColumns":[%s],"TableColumnsTotal":%d}`, tableVersion, strings.Join(definitions, ","), len(columns))
+}
+
+func writeTestStorageFile(t *testing.T, root, name, content string) {
+	name = filepath.Join(root, filepath.FromSlash(name))
+	require.NoError(t, os.MkdirAll(filepath.Dir(name), 0o755))
+	require.NoError(t, os.WriteFile(name, []byte(content), 0o644))
+}
+
+func newTestStorageRow(id int64, name string, checksum uint64) string {
+	return newTestCanalJSONMessage("INSERT", fmt.Sprintf(`[{"id":"%d","name":"%s","data":"é\u0001"}]`, id, name),
+		`null`, fmt.Sprintf(`{"commitTs":100,"_checksum":{"current":%d}}`, checksum))
+}
+
+func TestStorageVerify(t *testing.T) {
+	t.Parallel()
+
+	root := t.TempDir()
+	verified := newTestStorageRow(1, "b", testCanalJSONChecksum(1, "b", []byte{0xe9, 0x01}))
+
+	writeTestStorageFile(t, root, "test/meta/schema_100_0000000001.json", `{"Table":"","Schema":"test"}`)
+	writeTestStorageFile(t, root, "test/c/meta/schema_100_0000000001.json", testStorageSchema(100, "id", "name", "data"))
+	writeTestStorageFile(t, root, "test/c/meta/schema_200_0000000002.json", testStorageSchema(200, "name", "id", "data"))
+
+	writeTestStorageFile(t, root, "test/c/100/CDC000001.json", verified+"\r\n"+verified+"\r\n")
+	writeTestStorageFile(t, root, "test/c/100/meta/CDC.index", "CDC000001.json\n")
+	// the file is not recorded by the index file yet.
+	writeTestStorageFile(t, root, "test/c/100/CDC000002.json", `{"truncated`)
+	// the columns are reordered by the table version 200, the checksum is calculated in the new order.
+	writeTestStorageFile(t, root, "test/c/200/2023-12-01/CDC000001.json", verified+"\n")
+	writeTestStorageFile(t, root, "test/c/200/2023-12-01/meta/CDC.index", "CDC000001.json\n")
+	// the index file is not written yet.
+	writeTestStorageFile(t, root, "test/c/200/2023-12-02/CDC000001.json", verified+"\n")
+
+	layout, err := scanStorage(root)
+	require.NoError(t, err)
+	paths := make([]string, 0, len(layout.files))
+	for _, file := range layout.files {
+		paths = append(paths, file.path)
+	}
+	require.Equal(t, []string{"test/c/100/CDC000001.json", "test/c/200/2023-12-01/CDC000001.json"}, paths)
+	require.Equal(t, []string{"test/c/100/CDC000002.json", "test/c/200/2023-12-02/CDC000001.json"}, layout.inProgress)
+
+	cfg := newDefaultConfig()
+	cfg.protocol = protocolCanalJSON
+	cfg.storageDir = root
+	cfg.mismatchBudget = 1
+	require.NoError(t, cfg.validate())
+	v, err := newVerifier(context.Background(), cfg)
+	require.NoError(t, err)
+	err = v.run(context.Background())
+	require.Equal(t, exitCodeMismatch, v.finish(err))
+
+	// the row of the table version 200 is verified by the reordered columns, so it mismatches.
+	expected := counters{Messages: 3, Verified: 2, Mismatches: 1}
+	require.Equal(t, expected, v.report.Counters)
+	require.Equal(t, &expected, v.report.Tables["test.c"])
+	require.Len(t, v.report.Failures, 1)
+	require.Equal(t, "test/c/200/2023-12-01/CDC000001.json", v.report.Failures[0].Topic)
+	require.Equal(t, int64(1), v.report.Failures[0].Offset)
+	require.Equal(t, layout.inProgress, v.report.SkippedFiles)
+}
+
+func TestStorageRowNotMatchSchema(t *testing.T) {
+	t.Parallel()
+
+	root := t.TempDir()
+	writeTestStorageFile(t, root, "test/c/meta/schema_100_0000000001.json", testStorageSchema(100, "id", "name"))
+	writeTestStorageFile(t, root, "test/c/100/CDC000001.json", newTestStorageRow(1, "b", 1)+"\n")
+	writeTestStorageFile(t, root, "test/c/100/meta/CDC.index", "CDC000001.json\n")
+	// the schema file of the table version 300 is missing.
+	writeTestStorageFile(t, root, "test/c/300/CDC000001.json", newTestStorageRow(1, "b", 1)+"\n")
+	writeTestStorageFile(t, root, "test/c/300/meta/CDC.index", "CDC000001.json\n")
+
+	layout, err := scanStorage(root)
+	require.NoError(t, err)
+	v := newStorageVerifier(&canalJSONVerifier{}, layout.files)
+	for _, file := range layout.files {
+		content, err := os.ReadFile(filepath.Join(root, filepath.FromSlash(file.path)))
+		require.NoError(t, err)
+		_, err = v.verify(kafka.Message{Topic: file.path, Value: bytes.TrimSpace(content)})
+		require.Error(t, err)
+		require.NotErrorIs(t, err, errChecksumMismatch)
+	}
+}
+
+func TestLocalStorageDir(t *testing.T) {
+	t.Parallel()
+
+	for dir, expected := range map[string]string{
+		"./output":                "./output",
+		"/data/output":            "/data/output",
+		"file:///data/output":     "/data/output",
+		"file://localhost/output": "/output",
+	} {
+		actual, err := localStorageDir(dir)
+		require.NoError(t, err, dir)
+		require.Equal(t, expected, actual, dir)
+	}
+
+	for _, dir := range []string{"s3://bucket/prefix", "gcs://bucket/prefix", "azure://container/prefix"} {
+		_, err := localStorageDir(dir)
+		require.ErrorContains(t, err, "only the local directory is supported", dir)
+
+		cfg := newDefaultConfig()
+		cfg.protocol = protocolCanalJSON
+		cfg.storageDir = dir
+		require.ErrorContains(t, cfg.validate(), "sync the bucket prefix to the local disk first", dir)
+	}
+	_, err := localStorageDir("file://remote/output")
+	require.ErrorContains(t, err, "remote host")
+}
@@ -0,0 +1,174 @@
+// Copyright 2023 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pingcap/tidb/pkg/parser/mysql"
+)
+
+// the avro logical types of the temporal columns, which are encoded as the string by default.
+const (
+	logicalDate            = "date"
+	logicalTimeMillis      = "time-millis"
+	logicalTimeMicros      = "time-micros"
+	logicalTimestampMillis = "timestamp-millis"
+	logicalTimestampMicros = "timestamp-micros"
+)
+
+// temporalEncoding is how the temporal column is encoded by the avro logical type.
+type temporalEncoding struct {
+	logicalType string
+	// fsp is the fractional seconds precision of the column, -1 if unknown.
+	fsp int
+}
+
+// detectTemporalEncoding returns the encoding of the temporal column, nil if it's encoded as the string.
+func detectTemporalEncoding(tidbType string, field, holder map[string]interface{}) (*temporalEncoding, error) {
+	var allowed []string
+	switch tidbType {
+	case "DATE":
+		allowed = []string{logicalDate}
+	case "DATETIME", "TIMESTAMP":
+		allowed = []string{logicalTimestampMillis, logicalTimestampMicros}
+	case "TIME":
+		allowed = []string{logicalTimeMillis, logicalTimeMicros}
+	default:
+		return nil, nil
+	}
+	fieldType := avroFieldType(field)
+	avroType, _ := fieldType["type"].(string)
+	if avroType == "" || avroType == "string" {
+		return nil, nil
+	}
+	logicalType, _ := fieldType["logicalType"].(string)
+	for _, t := range allowed {
+		if t == logicalType {
+			fsp, err := temporalFsp(holder)
+			if err != nil {
+				return nil, err
+			}
+			return &temporalEncoding{logicalType: logicalType, fsp: fsp}, nil
+		}
+	}
+	return nil, fmt.Errorf("%s encoded as the avro %q with the logical type %q is not supported",
+		tidbType, avroType, logicalType)
+}
+
+// temporalFsp returns the `fsp` of the connect.parameters, -1 if it's absent.
+func temporalFsp(holder map[string]interface{}) (int, error) {
+	value, ok := holder["fsp"].(string)
+	if !ok {
+		return -1, nil
+	}
+	fsp, err := strconv.Atoi(value)
+	if err != nil || fsp < 0 || fsp > 6 {
+		return 0, fmt.Errorf("invalid fsp %q in the connect.parameters", value)
+	}
+	return fsp, nil
+}
+
+// precision returns the number of the fractional digits of the value, which is the fsp of the column if known,
+// otherwise 0 if the value has no fraction, or the precision of the logical type.
+func (e *temporalEncoding) precision(nanos int64) int {
+	switch {
+	case e.fsp >= 0:
+		return e.fsp
+	case nanos == 0:
+		return 0
+	case e.logicalType == logicalTimeMillis || e.logicalType == logicalTimestampMillis:
+		return 3
+	}
+	return 6
+}
+
+// temporalString converts the value decoded by the logical type to the string TiDB uses in the checksum calculation,
+// the DATETIME is in UTC since it has no time zone, and the TIMESTAMP is in loc, which is the local one if nil.
+func temporalString(value interface{}, mysqlType byte, e *temporalEncoding, loc *time.Location) (interface{}, error) {
+	var t time.Time
+	switch v := value.(type) {
+	case nil:
+		return nil, nil
+	case time.Time:
+		t = v
+	case time.Duration:
+		return durationString(v, e.precision(int64(v%time.Second))), nil
+	// the logical type is not converted by the decoder.
+	case int32:
+		switch e.logicalType {
+		case logicalDate:
+			t = time.Date(1970, 1, 1, 0, 0, 0, 0, time.UTC).AddDate(0, 0, int(v))
+		case logicalTimeMillis:
+			d := time.Duration(v) * time.Millisecond
+			return durationString(d, e.precision(int64(d%time.Second))), nil
+		default:
+			return nil, fmt.Errorf("unexpected int value of the %s logical type", e.logicalType)
+		}
+	case int64:
+		switch e.logicalType {
+		case logicalTimestampMillis:
+			t = time.UnixMilli(v)
+		case logicalTimestampMicros:
+			t = time.UnixMicro(v)
+		case logicalTimeMicros:
+			d := time.Duration(v) * time.Microsecond
+			return durationString(d, e.precision(int64(d%time.Second))), nil
+		default:
+			return nil, fmt.Errorf("unexpected long value of the %s logical type", e.logicalType)
+		}
+	default:
+		return nil, fmt.Errorf("unknown golang type %T of the %s logical type", value, e.logicalType)
+	}
+
+	switch mysqlType {
+	case mysql.TypeDate:
+		return t.UTC().Format("2006-01-02"), nil
+	case mysql.TypeTimestamp:
+		if loc == nil {
+			loc = time.Local
+		}
+		t = t.In(loc)
+	default:
+		t = t.UTC()
+	}
+	return t.Format(timeLayout("2006-01-02 15:04:05", e.precision(int64(t.Nanosecond())))), nil
+}
+
+// timeLayout appends the fractional seconds of fsp digits to the layout, padded by zeros.
+func timeLayout(layout string, fsp int) string {
+	if fsp == 0 {
+		return layout
+	}
+	return layout + "." + strings.Repeat("0", fsp)
+}
+
+// durationString formats the duration as the TIME of TiDB, such as `-838:59:59.000000`.
+func durationString(d time.Duration, fsp int) string {
+	var b strings.Builder
+	if d < 0 {
+		b.WriteByte('-')
+		d = -d
+	}
+	fmt.Fprintf(&b, "%02d:%02d:%02d", int64(d/time.Hour), int64(d/time.Minute%60), int64(d/time.Second%60))
+	if fsp > 0 {
+		fraction := fmt.Sprintf("%09d", int64(d%time.Second))
+		b.WriteByte('.')
+		b.WriteString(fraction[:fsp])
+	}
+	return b.String()
+}
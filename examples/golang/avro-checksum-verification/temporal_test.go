@@ -0,0 +1,152 @@
+// Copyright 2023 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"strconv"
+	"testing"
+	"time"
+
+	"avro-checksum-sample/checksum"
+	"github.com/linkedin/goavro/v2"
+	"github.com/pingcap/tidb/pkg/parser/mysql"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTemporalString(t *testing.T) {
+	t.Parallel()
+
+	shanghai, err := time.LoadLocation("Asia/Shanghai")
+	require.NoError(t, err)
+	epoch := time.Unix(0, 0).UTC()
+	date := &temporalEncoding{logicalType: logicalDate, fsp: -1}
+	micros := func(fsp int) *temporalEncoding {
+		return &temporalEncoding{logicalType: logicalTimestampMicros, fsp: fsp}
+	}
+	cases := []struct {
+		value     interface{}
+		mysqlType byte
+		encoding  *temporalEncoding
+		loc       *time.Location
+		expected  interface{}
+	}{
+		{nil, mysql.TypeDate, date, nil, nil},
+		{epoch, mysql.TypeDate, date, nil, "1970-01-01"},
+		{epoch.AddDate(-1, 0, 0), mysql.TypeDate, date, nil, "1969-01-01"},
+		// the logical type is not converted by the decoder.
+		{int32(-1), mysql.TypeDate, date, nil, "1969-12-31"},
+		{int32(19723), mysql.TypeDate, date, nil, "2024-01-01"},
+		{epoch, mysql.TypeDatetime, micros(-1), nil, "1970-01-01 00:00:00"},
+		{epoch, mysql.TypeDatetime, micros(3), nil, "1970-01-01 00:00:00.000"},
+		{time.UnixMicro(1123456).UTC(), mysql.TypeDatetime, micros(6), nil, "1970-01-01 00:00:01.123456"},
+		{time.UnixMicro(1120000).UTC(), mysql.TypeDatetime, micros(3), nil, "1970-01-01 00:00:01.120"},
+		{time.UnixMicro(1120000).UTC(), mysql.TypeDatetime, micros(-1), nil, "1970-01-01 00:00:01.120000"},
+		{int64(-1), mysql.TypeDatetime, micros(6), nil, "1969-12-31 23:59:59.999999"},
+		{int64(-1), mysql.TypeDatetime, &temporalEncoding{logicalType: logicalTimestampMillis, fsp: -1}, nil,
+			"1969-12-31 23:59:59.999"},
+		// the TIMESTAMP is in the configured time zone, the DATETIME has none.
+		{epoch, mysql.TypeTimestamp, micros(0), shanghai, "1970-01-01 08:00:00"},
+		{epoch, mysql.TypeDatetime, micros(0), shanghai, "1970-01-01 00:00:00"},
+		{-1500 * time.Millisecond, mysql.TypeDuration, &temporalEncoding{logicalType: logicalTimeMicros, fsp: 1}, nil,
+			"-00:00:01.5"},
+		{int32(500*3600*1000 + 59*1000), mysql.TypeDuration,
+			&temporalEncoding{logicalType: logicalTimeMillis, fsp: -1}, nil, "500:00:59"},
+		{int64(1), mysql.TypeDuration, &temporalEncoding{logicalType: logicalTimeMicros, fsp: 6}, nil,
+			"00:00:00.000001"},
+	}
+	for i, c := range cases {
+		value, err := temporalString(c.value, c.mysqlType, c.encoding, c.loc)
+		require.NoError(t, err, i)
+		require.Equal(t, c.expected, value, i)
+	}
+
+	_, err = temporalString("2024-01-01", mysql.TypeDate, date, nil)
+	require.ErrorContains(t, err, "unknown golang type string of the date logical type")
+	_, err = temporalString(int64(1), mysql.TypeDate, date, nil)
+	require.ErrorContains(t, err, "unexpected long value")
+}
+
+func TestDetectTemporalEncoding(t *testing.T) {
+	t.Parallel()
+
+	field := func(fieldType string) map[string]interface{} {
+		var result map[string]interface{}
+		require.NoError(t, json.Unmarshal([]byte(`{"name": "c", "type": `+fieldType+`}`), &result))
+		return result
+	}
+	detect := func(tidbType, fieldType string) (*temporalEncoding, error) {
+		f := field(fieldType)
+		return detectTemporalEncoding(tidbType, f, avroParameters(f))
+	}
+
+	e, err := detect("DATE", `{"type": "string", "connect.parameters": {"tidb_type": "DATE"}}`)
+	require.NoError(t, err)
+	require.Nil(t, e)
+	e, err = detect("DATE", `["null", {"type": "int", "logicalType": "date", "connect.parameters": {"tidb_type": "DATE"}}]`)
+	require.NoError(t, err)
+	require.Equal(t, &temporalEncoding{logicalType: logicalDate, fsp: -1}, e)
+	e, err = detect("DATETIME",
+		`{"type": "long", "logicalType": "timestamp-micros", "connect.parameters": {"tidb_type": "DATETIME", "fsp": "3"}}`)
+	require.NoError(t, err)
+	require.Equal(t, &temporalEncoding{logicalType: logicalTimestampMicros, fsp: 3}, e)
+
+	_, err = detect("DATE", `{"type": "long", "connect.parameters": {"tidb_type": "DATE"}}`)
+	require.ErrorContains(t, err, `DATE encoded as the avro "long" with the logical type "" is not supported`)
+	_, err = detect("TIMESTAMP", `{"type": "int", "logicalType": "date", "connect.parameters": {"tidb_type": "TIMESTAMP"}}`)
+	require.Error(t, err)
+	_, err = detect("DATETIME",
+		`{"type": "long", "logicalType": "timestamp-micros", "connect.parameters": {"tidb_type": "DATETIME", "fsp": "7"}}`)
+	require.ErrorContains(t, err, `invalid fsp "7"`)
+}
+
+func TestAvroLogicalTypeChecksum(t *testing.T) {
+	t.Parallel()
+
+	schema := `{
+  "type": "record",
+  "name": "t",
+  "namespace": "default.test",
+  "fields": [
+    {"name": "d", "type": {"type": "int", "logicalType": "date", "connect.parameters": {"tidb_type": "DATE"}}},
+    {"name": "dt", "type": ["null", {"type": "long", "logicalType": "timestamp-micros",
+      "connect.parameters": {"tidb_type": "DATETIME", "fsp": "6"}}], "default": null},
+    {"name": "ts", "type": {"type": "long", "logicalType": "timestamp-millis",
+      "connect.parameters": {"tidb_type": "TIMESTAMP", "fsp": "3"}}},
+    {"name": "_tidb_op", "type": "string", "default": ""},
+    {"name": "_tidb_row_level_checksum", "type": "string", "default": ""}
+  ]
+}`
+	dt := time.Date(1969, 7, 20, 20, 17, 40, 123456000, time.UTC)
+	ts := time.Date(2024, 2, 29, 23, 59, 59, 5000000, time.UTC)
+	expected, err := checksum.Calculate([]checksum.FieldMeta{
+		{Name: "d", MySQLType: mysql.TypeDate},
+		{Name: "dt", MySQLType: mysql.TypeDatetime},
+		{Name: "ts", MySQLType: mysql.TypeTimestamp},
+	}, []interface{}{"1969-07-20", "1969-07-20 20:17:40.123456", ts.Local().Format("2006-01-02 15:04:05.000")})
+	require.NoError(t, err)
+
+	codec, err := goavro.NewCodec(schema)
+	require.NoError(t, err)
+	binary, err := codec.BinaryFromNative(nil, map[string]interface{}{
+		"d": time.Date(1969, 7, 20, 0, 0, 0, 0, time.UTC), "dt": goavro.Union("long.timestamp-micros", dt), "ts": ts, "_tidb_op": "c",
+		"_tidb_row_level_checksum": strconv.FormatUint(uint64(expected), 10),
+	})
+	require.NoError(t, err)
+	native, _, err := codec.NativeFromBinary(binary)
+	require.NoError(t, err)
+	var valueSchema map[string]interface{}
+	require.NoError(t, json.Unmarshal([]byte(schema), &valueSchema))
+	require.NoError(t, CalculateAndVerifyChecksum(native.(map[string]interface{}), valueSchema))
+}
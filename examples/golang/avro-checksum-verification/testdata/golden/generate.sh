@@ -0,0 +1,10 @@
+#!/bin/sh
+# Regenerate the golden messages by TestDumpGoldenMessages of pkg/sink/codec/avro, the rows are written by TiDB
+# along with the row level checksum, and encoded by the avro encoder of TiCDC, the expected checksums are the ones
+# of TiDB and the expected bytes of each column are encoded by the rowcodec of TiDB, never by the verifier.
+# The TIMESTAMP values are converted in the local time zone, so it runs in UTC.
+set -e
+dir="$(cd "$(dirname "$0")" && pwd)"
+cd "$dir/../../../../.."
+rm -rf "$dir/messages" "$dir/expected.json"
+TZ=UTC AVRO_CHECKSUM_GOLDEN_DIR="$dir" go test --tags=intest -count=1 -run TestDumpGoldenMessages ./pkg/sink/codec/avro/
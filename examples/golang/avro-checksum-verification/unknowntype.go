@@ -0,0 +1,155 @@
+// Copyright 2023 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"errors"
+	"sort"
+
+	"avro-checksum-sample/checksum"
+	"github.com/pingcap/log"
+	"go.uber.org/zap"
+)
+
+const (
+	// unknownTypeFail fails the message carrying the column of the unknown TiDB type as a decode error.
+	unknownTypeFail = "fail"
+	// unknownTypeSkipColumn leaves the column of the unknown TiDB type out of the checksum calculation.
+	unknownTypeSkipColumn = "skip-column"
+	// unknownTypeSkipTable filters out the table having any column of the unknown TiDB type.
+	unknownTypeSkipTable = "skip-table"
+)
+
+// errUnknownTiDBType is returned if the TiDB type of the column is not handled by the verifier,
+// such as the one added by a newer TiDB.
+var errUnknownTiDBType = errors.New("unknown TiDB type")
+
+// unknownType is a column of the TiDB type the verifier cannot handle.
+type unknownType struct {
+	Table    string `json:"table"`
+	Column   string `json:"column"`
+	TiDBType string `json:"tidbType"`
+	// Events is the number of the events affected, which are handled by the policy.
+	Events uint64 `json:"events"`
+}
+
+// unknownTypeTracker records the columns of the unknown TiDB types found in the value schemas,
+// each column is warned once by the table.
+type unknownTypeTracker struct {
+	policy string
+	found  map[[2]string]*unknownType
+}
+
+func newUnknownTypeTracker(policy string) *unknownTypeTracker {
+	return &unknownTypeTracker{policy: policy, found: make(map[[2]string]*unknownType)}
+}
+
+// observe records the event of the table affected by the columns of the unknown TiDB types.
+func (t *unknownTypeTracker) observe(table string, columns []columnError) {
+	for _, c := range columns {
+		key := [2]string{table, c.Column}
+		found, ok := t.found[key]
+		if !ok {
+			found = &unknownType{Table: table, Column: c.Column, TiDBType: c.TiDBType}
+			t.found[key] = found
+			switch t.policy {
+			case unknownTypeSkipColumn:
+				log.Warn("column of the unknown TiDB type is left out of the checksum calculation, "+
+					"the events of the table are verified with caveats", zap.String("table", table),
+					zap.String("column", c.Column), zap.String("tidbType", c.TiDBType))
+			case unknownTypeSkipTable:
+				log.Warn("table having the column of the unknown TiDB type is skipped", zap.String("table", table),
+					zap.String("column", c.Column), zap.String("tidbType", c.TiDBType))
+			default:
+				log.Error("column of the unknown TiDB type cannot be verified, "+
+					"set --on-unknown-type to skip the column or the table", zap.String("table", table),
+					zap.String("column", c.Column), zap.String("tidbType", c.TiDBType))
+			}
+		}
+		// the type of the column may change by the DDL.
+		found.TiDBType = c.TiDBType
+		found.Events++
+	}
+}
+
+// snapshot returns the unknown types found, sorted by the table and the column.
+func (t *unknownTypeTracker) snapshot() []unknownType {
+	result := make([]unknownType, 0, len(t.found))
+	for _, found := range t.found {
+		result = append(result, *found)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].Table != result[j].Table {
+			return result[i].Table < result[j].Table
+		}
+		return result[i].Column < result[j].Column
+	})
+	return result
+}
+
+// unknownTypeVerifier is implemented by the message verifier tracking the columns of the unknown TiDB types.
+type unknownTypeVerifier interface {
+	unknownTypes() []unknownType
+}
+
+func (a *avroVerifier) unknownTypes() []unknownType { return a.unknown.snapshot() }
+
+// skipUnknownTable returns true if the table of the value has any column of the unknown TiDB type,
+// only by the skip-table policy, so that the message is filtered without decoding the value.
+func (a *avroVerifier) skipUnknownTable(value []byte, table string) (bool, error) {
+	if a.unknown.policy != unknownTypeSkipTable {
+		return false, nil
+	}
+	schemaID, _, err := extractSchemaIDAndBinaryData(value)
+	if err != nil {
+		return false, err
+	}
+	valueSchema, ok := a.valueSchemas[schemaID]
+	if !ok {
+		return false, nil
+	}
+	_, unknown, err := a.columnsOf(value, valueSchema)
+	if err != nil || len(unknown) == 0 {
+		// the schema which cannot be parsed fails once the value is verified.
+		return false, nil
+	}
+	a.unknown.observe(table, unknown)
+	return true, nil
+}
+
+// inconclusiveRow reports the row whose checksum mismatches without the columns skipped as not computable,
+// since the checksum calculated by TiDB may involve them, the columns skipped are reported along with the raw values.
+func (a *avroVerifier) inconclusiveRow(
+	result messageResult, valueMap map[string]interface{}, unknown []columnError,
+) messageResult {
+	columns := make([]columnError, 0, len(unknown))
+	for _, c := range unknown {
+		columns = append(columns, c.withRawValue(valueMap))
+	}
+	log.Warn("checksum mismatches without the columns of the unknown TiDB types, it's not computable",
+		zap.String("table", result.table), zap.Uint64("commitTs", result.commitTs), zap.Any("columns", columns))
+	result.outcome, result.columnErrors = outcomeNotComputable, columns
+	return result
+}
+
+// rowColumns is checksumColumns, but the columns of the unknown TiDB types are left out by the skip-column policy.
+func (a *avroVerifier) rowColumns(
+	valueMap, valueSchema map[string]interface{},
+) ([]checksum.FieldMeta, []interface{}, error) {
+	columns, _, err := parseAvroColumnsSkipping(valueSchema, a.unknown.policy == unknownTypeSkipColumn)
+	if err != nil {
+		return nil, nil, err
+	}
+	return avroColumnValues(valueMap, columns)
+}
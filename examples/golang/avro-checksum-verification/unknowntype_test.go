@@ -0,0 +1,159 @@
+// Copyright 2023 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"strconv"
+	"testing"
+
+	"github.com/segmentio/kafka-go"
+	"github.com/stretchr/testify/require"
+)
+
+// testVectorSchema is the value schema of the table `test`.`v` (id BIGINT PRIMARY KEY, name TEXT, embedding VECTOR),
+// the VECTOR type is unknown to the verifier.
+const testVectorSchema = `{
+  "type": "record",
+  "name": "v",
+  "namespace": "default.test",
+  "fields": [
+    {"name": "id", "type": {"type": "long", "connect.parameters": {"tidb_type": "BIGINT"}}},
+    {"name": "name", "type": ["null", {"type": "string", "connect.parameters": {"tidb_type": "TEXT"}}], "default": null},
+    {"name": "embedding", "type": {"type": "string", "connect.parameters": {"tidb_type": "VECTOR"}}},
+    {"name": "_tidb_op", "type": "string", "default": ""},
+    {"name": "_tidb_commit_ts", "type": "long", "default": 0},
+    {"name": "_tidb_commit_physical_time", "type": "long", "default": 0},
+    {"name": "_tidb_row_level_checksum", "type": "string", "default": ""},
+    {"name": "_tidb_corrupted", "type": "boolean", "default": false},
+    {"name": "_tidb_checksum_version", "type": "int", "default": 0}
+  ]
+}`
+
+const testVectorSchemaID = 5
+
+// newVectorTestMessage returns a message of the table `test`.`v`, the checksum is calculated without the embedding,
+// and is wrong if mismatch is set.
+func newVectorTestMessage(t *testing.T, offset int64, id int64, name string, mismatch bool) kafka.Message {
+	checksum := testRowChecksum(id, &name)
+	if mismatch {
+		checksum++
+	}
+	row := newTestRow(id, &name, 400000000000000000+offset, strconv.FormatUint(uint64(checksum), 10))
+	row["embedding"] = "[1,2]"
+	value := encodeTestMessage(t, testVectorSchemaID, testVectorSchema, row)
+	return kafka.Message{Topic: "test", Offset: offset, Value: value}
+}
+
+func newUnknownTypeTestVerifier(t *testing.T, policy string, messages ...kafka.Message) *verifier {
+	registry := newTestRegistry(t, map[int]string{testSchemaID: testValueSchema, testVectorSchemaID: testVectorSchema})
+	cfg := newDefaultConfig()
+	cfg.schemaRegistryURL, cfg.onUnknownType = registry.URL, policy
+	require.NoError(t, cfg.validate())
+	return newTestVerifier(cfg, &fakeReader{messages: messages})
+}
+
+func TestUnknownTypeFail(t *testing.T) {
+	t.Parallel()
+
+	v := newUnknownTypeTestVerifier(t, unknownTypeFail,
+		newVerifiedTestMessage(t, 0, 1, "a"), newVectorTestMessage(t, 1, 2, "b", false))
+	err := v.run(context.Background())
+	require.Equal(t, exitCodeDecodeError, v.finish(err))
+	require.Equal(t, uint64(1), v.counters.Verified)
+	require.Equal(t, uint64(1), v.counters.DecodeErrors)
+	require.Contains(t, v.report.Failures[0].Error, "column embedding: unknown TiDB type VECTOR")
+	require.Equal(t, []unknownType{{Table: "test.v", Column: "embedding", TiDBType: "VECTOR", Events: 1}},
+		v.report.UnknownTypes)
+}
+
+func TestUnknownTypeSkipColumn(t *testing.T) {
+	t.Parallel()
+
+	v := newUnknownTypeTestVerifier(t, unknownTypeSkipColumn,
+		newVerifiedTestMessage(t, 0, 1, "a"),
+		newVectorTestMessage(t, 1, 2, "b", false),
+		// the mismatch may be caused by the column skipped, it's not conclusive.
+		newVectorTestMessage(t, 2, 3, "c", true))
+	err := v.run(context.Background())
+	require.Equal(t, exitCodeDecodeError, v.finish(err))
+	require.Equal(t, uint64(1), v.counters.Verified)
+	require.Equal(t, uint64(1), v.counters.VerifiedWithCaveats)
+	require.Equal(t, uint64(1), v.counters.NotComputable)
+	require.Zero(t, v.counters.Mismatches)
+	require.Equal(t, &counters{Messages: 2, VerifiedWithCaveats: 1, NotComputable: 1}, v.report.Tables["test.v"])
+	require.Len(t, v.report.Failures, 1)
+	require.Equal(t, failureKindNotComputable, v.report.Failures[0].Kind)
+	require.Equal(t, []columnError{{
+		Column: "embedding", TiDBType: "VECTOR", RawType: "string", RawValue: "[1,2]",
+		Error: "column embedding: unknown TiDB type VECTOR",
+	}}, v.report.Failures[0].Columns)
+	require.Equal(t, []unknownType{{Table: "test.v", Column: "embedding", TiDBType: "VECTOR", Events: 2}},
+		v.report.UnknownTypes)
+
+	// the row is decoded without the column skipped, such as for the export.
+	a := v.messageVerifier.(*avroVerifier)
+	schema := make(map[string]interface{})
+	require.NoError(t, json.Unmarshal([]byte(testVectorSchema), &schema))
+	native := newTestRow(2, nil, 0, "")
+	native["embedding"] = "[1,2]"
+	metas, values, err := a.rowColumns(native, schema)
+	require.NoError(t, err)
+	require.Len(t, metas, 2)
+	require.Equal(t, []interface{}{int64(2), nil}, values)
+}
+
+func TestUnknownTypeSkipTable(t *testing.T) {
+	t.Parallel()
+
+	v := newUnknownTypeTestVerifier(t, unknownTypeSkipTable,
+		newVectorTestMessage(t, 0, 1, "a", false),
+		newVerifiedTestMessage(t, 1, 2, "b"),
+		newVectorTestMessage(t, 2, 3, "c", true))
+	err := v.run(context.Background())
+	require.Equal(t, exitCodeClean, v.finish(err))
+	require.Equal(t, uint64(1), v.counters.Verified)
+	require.Equal(t, uint64(2), v.counters.Filtered)
+	require.NotContains(t, v.report.Tables, "test.v")
+	require.Equal(t, []unknownType{{Table: "test.v", Column: "embedding", TiDBType: "VECTOR", Events: 2}},
+		v.report.UnknownTypes)
+}
+
+func TestUnknownTypeConfig(t *testing.T) {
+	t.Parallel()
+
+	cfg := newDefaultConfig()
+	cfg.onUnknownType = "ignore"
+	require.ErrorContains(t, cfg.validate(), "unknown policy of the unknown TiDB type: ignore")
+	cfg.onUnknownType, cfg.protocol = unknownTypeSkipColumn, protocolCanalJSON
+	require.ErrorContains(t, cfg.validate(), "only the avro protocol supports skipping the unknown TiDB types")
+	cfg.onUnknownType = unknownTypeFail
+	require.NoError(t, cfg.validate())
+
+	// the audit takes the column skipped as a caveat.
+	registry := newTestAuditRegistry(t)
+	var out bytes.Buffer
+	code := runAudit([]string{
+		"--schema-registry-url", registry.URL, "--topic", "test", "--on-unknown-type", unknownTypeSkipColumn,
+	}, &out)
+	require.Equal(t, exitCodeClean, code)
+	var result auditResult
+	require.NoError(t, json.Unmarshal(out.Bytes(), &result))
+	require.Equal(t, schemaAudit{
+		SchemaID: 12, Source: "test-value@2", Table: "test.v", Verdict: verdictCaveats,
+		Caveats: []auditIssue{{Column: "embedding", Reason: "unknown TiDB type VECTOR, skipped by the skip-column policy"}},
+	}, result.Schemas[1])
+}
@@ -0,0 +1,294 @@
+// Copyright 2023 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"avro-checksum-sample/checksum"
+	gomysql "github.com/go-sql-driver/mysql"
+	"github.com/pingcap/log"
+	"github.com/pingcap/tidb/pkg/parser/mysql"
+	"go.uber.org/zap"
+)
+
+// errno of TiDB, returned if the snapshot is older than the GC safe point.
+const (
+	errnoSnapshotTooOld = 8055
+	errnoGCTooEarly     = 9006
+)
+
+const (
+	upstreamConclusionMatched       = "the event matches the expected checksum"
+	upstreamConclusionWrongChecksum = "the event matches the upstream, the expected checksum is wrong"
+	upstreamConclusionMangled       = "the upstream matches the expected checksum, the event data is mangled"
+	upstreamConclusionBothDiffer    = "neither the event nor the upstream matches the expected checksum"
+	upstreamConclusionEventDiffers  = "the event matches the expected checksum, but not the upstream"
+)
+
+// upstreamComparison is the three-way comparison of the row, among the event, the upstream snapshot
+// and the checksum carried by the event, bytes are those accumulated by the checksum calculation in hex.
+type upstreamComparison struct {
+	ReadTs           uint64 `json:"readTs"`
+	ExpectedChecksum uint64 `json:"expectedChecksum"`
+	EventChecksum    uint64 `json:"eventChecksum"`
+	EventBytes       string `json:"eventBytes"`
+	UpstreamChecksum uint64 `json:"upstreamChecksum,omitempty"`
+	UpstreamBytes    string `json:"upstreamBytes,omitempty"`
+	Conclusion       string `json:"conclusion,omitempty"`
+	// Error is the reason the upstream row cannot be read, such as the snapshot is garbage collected.
+	Error string `json:"error,omitempty"`
+}
+
+// upstreamChecker reads the row from the upstream TiDB as of the commit ts of the event,
+// and recomputes the checksum from the SQL values, to tell whether the data or the checksum is wrong.
+type upstreamChecker struct {
+	db *sql.DB
+	// sampleRate is the ratio of the verified rows to be compared for calibration, mismatches are always compared.
+	sampleRate float64
+	random     *rand.Rand
+	// timeZone is the session time zone, the same as the one used to convert the TIMESTAMP value by the checksum.
+	timeZone string
+}
+
+func newUpstreamChecker(ctx context.Context, cfg *config) (*upstreamChecker, error) {
+	db, err := sql.Open("mysql", cfg.upstreamDSN)
+	if err != nil {
+		return nil, err
+	}
+	if err := db.PingContext(ctx); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return newUpstreamCheckerWithDB(db, cfg), nil
+}
+
+func newUpstreamCheckerWithDB(db *sql.DB, cfg *config) *upstreamChecker {
+	return &upstreamChecker{
+		db:         db,
+		sampleRate: cfg.upstreamSampleRate,
+		random:     rand.New(rand.NewSource(time.Now().UnixNano())),
+		timeZone:   localTimeZone(os.Getenv("TZ"), "/etc/localtime"),
+	}
+}
+
+// localTimeZone returns the IANA name of the local time zone, such as `Asia/Shanghai`,
+// so that the upstream converts the TIMESTAMP value by the same daylight saving rules.
+// The name is resolved from the TZ environment variable or the zoneinfo file linked by localtime,
+// the fixed offset of now is returned if neither is available.
+func localTimeZone(tz string, localtime string) string {
+	tz = strings.TrimPrefix(tz, ":")
+	if tz != "" {
+		if _, err := time.LoadLocation(tz); err == nil {
+			return tz
+		}
+	}
+	if tz == "" {
+		if target, err := filepath.EvalSymlinks(localtime); err == nil {
+			if i := strings.LastIndex(target, "zoneinfo/"); i >= 0 {
+				name := target[i+len("zoneinfo/"):]
+				if _, err := time.LoadLocation(name); err == nil {
+					return name
+				}
+			}
+		}
+	}
+	offset := time.Now().Format("-07:00")
+	log.Warn("the name of the local time zone is unknown, use the fixed offset for the upstream session, "+
+		"the TIMESTAMP value across the daylight saving time may be compared wrongly, set TZ to fix it",
+		zap.String("offset", offset))
+	return offset
+}
+
+func (u *upstreamChecker) sampled() bool {
+	return u.sampleRate > 0 && (u.sampleRate >= 1 || u.random.Float64() < u.sampleRate)
+}
+
+// compare returns the three-way comparison of the row, it never fails,
+// the reason is recorded in the comparison if the upstream row cannot be read.
+func (u *upstreamChecker) compare(ctx context.Context, row *rowEvent) *upstreamComparison {
+	result := &upstreamComparison{ReadTs: row.readTs, ExpectedChecksum: row.expected}
+	// the event and the upstream row are calculated by the checksum version carried by the event.
+	sum, err := checksum.New(row.checksumVersion)
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	fields := make([]checksum.FieldMeta, 0, len(row.columns))
+	values := make([]interface{}, 0, len(row.columns))
+	for _, column := range row.columns {
+		fields = append(fields, checksum.FieldMeta{Name: column.name, MySQLType: column.mysqlType})
+		values = append(values, column.value)
+	}
+	eventBytes, err := checksum.Bytes(fields, values)
+	if err != nil {
+		result.Error = "encode the event failed: " + err.Error()
+		return result
+	}
+	result.EventBytes = hex.EncodeToString(eventBytes)
+	if result.EventChecksum, err = checksum.CalculateBy(sum, fields, values); err != nil {
+		result.Error = "calculate the event checksum failed: " + err.Error()
+		return result
+	}
+
+	handles := row.handleColumns()
+	if len(handles) == 0 {
+		result.Error = "row has no handle key"
+		return result
+	}
+	upstream, err := u.read(ctx, row, handles)
+	if err != nil {
+		result.Error = err.Error()
+		log.Warn("read upstream snapshot failed", zap.String("schema", row.schema),
+			zap.String("table", row.table), zap.Uint64("readTs", row.readTs), zap.Error(err))
+		return result
+	}
+	upstreamBytes, err := checksum.Bytes(fields, upstream)
+	if err != nil {
+		result.Error = "encode the upstream row failed: " + err.Error()
+		return result
+	}
+	result.UpstreamBytes = hex.EncodeToString(upstreamBytes)
+	if result.UpstreamChecksum, err = checksum.CalculateBy(sum, fields, upstream); err != nil {
+		result.Error = "calculate the upstream checksum failed: " + err.Error()
+		return result
+	}
+
+	switch {
+	case result.EventChecksum == result.ExpectedChecksum && bytes.Equal(eventBytes, upstreamBytes):
+		result.Conclusion = upstreamConclusionMatched
+	case result.EventChecksum == result.ExpectedChecksum:
+		result.Conclusion = upstreamConclusionEventDiffers
+	case bytes.Equal(eventBytes, upstreamBytes):
+		result.Conclusion = upstreamConclusionWrongChecksum
+	case result.UpstreamChecksum == result.ExpectedChecksum:
+		result.Conclusion = upstreamConclusionMangled
+	default:
+		result.Conclusion = upstreamConclusionBothDiffer
+	}
+	return result
+}
+
+// read returns the values of the row as of the read ts, in the form accepted by the checksum calculation.
+func (u *upstreamChecker) read(ctx context.Context, row *rowEvent, handles []rowColumn) ([]interface{}, error) {
+	conn, err := u.db.Conn(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	// the TIMESTAMP value is converted from the local time zone by the checksum calculation.
+	if _, err := conn.ExecContext(ctx, "SET @@time_zone = ?", u.timeZone); err != nil {
+		return nil, err
+	}
+	if _, err := conn.ExecContext(ctx, "SET @@tidb_snapshot = ?", strconv.FormatUint(row.readTs, 10)); err != nil {
+		return nil, snapshotError(row.readTs, err)
+	}
+	defer func() {
+		if _, err := conn.ExecContext(context.Background(), "SET @@tidb_snapshot = ''"); err != nil {
+			// the connection may be reused by others with the stale snapshot, discard it.
+			_ = conn.Raw(func(interface{}) error { return driver.ErrBadConn })
+		}
+	}()
+
+	query, args := downstreamQuery(row, handles)
+	rows, err := conn.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, snapshotError(row.readTs, err)
+	}
+	defer rows.Close()
+	if !rows.Next() {
+		if err := rows.Err(); err != nil {
+			return nil, snapshotError(row.readTs, err)
+		}
+		return nil, fmt.Errorf("row not found in the upstream snapshot at ts %d", row.readTs)
+	}
+
+	raw := make([]sql.RawBytes, len(row.columns))
+	dest := make([]interface{}, len(raw))
+	for i := range raw {
+		dest[i] = &raw[i]
+	}
+	if err := rows.Scan(dest...); err != nil {
+		return nil, err
+	}
+	values := make([]interface{}, 0, len(raw))
+	for i, column := range row.columns {
+		value, err := upstreamColumnValue(raw[i], column)
+		if err != nil {
+			return nil, fmt.Errorf("invalid upstream value of the column %s: %w", column.name, err)
+		}
+		values = append(values, value)
+	}
+	return values, nil
+}
+
+// snapshotError makes the error of the garbage collected snapshot readable.
+func snapshotError(readTs uint64, err error) error {
+	var mysqlErr *gomysql.MySQLError
+	if errors.As(err, &mysqlErr) && (mysqlErr.Number == errnoGCTooEarly || mysqlErr.Number == errnoSnapshotTooOld) {
+		return fmt.Errorf("snapshot at ts %d is garbage collected by the upstream, "+
+			"increase tidb_gc_life_time to keep it for the comparison: %w", readTs, err)
+	}
+	return err
+}
+
+// upstreamColumnValue converts the SQL value to the one accepted by the checksum calculation,
+// the type follows the value decoded from the event of the same column.
+func upstreamColumnValue(raw sql.RawBytes, column rowColumn) (interface{}, error) {
+	if raw == nil {
+		return nil, nil
+	}
+	data := string(raw)
+	switch column.mysqlType {
+	case mysql.TypeTiny, mysql.TypeShort, mysql.TypeLong, mysql.TypeInt24, mysql.TypeLonglong, mysql.TypeYear:
+		if v, err := strconv.ParseInt(data, 10, 64); err == nil {
+			return v, nil
+		}
+		return strconv.ParseUint(data, 10, 64)
+	// enum, set and bit are selected as numbers.
+	case mysql.TypeEnum, mysql.TypeSet, mysql.TypeBit:
+		return strconv.ParseUint(data, 10, 64)
+	case mysql.TypeFloat:
+		v, err := strconv.ParseFloat(data, 32)
+		if err != nil {
+			return nil, err
+		}
+		return float32(v), nil
+	case mysql.TypeDouble:
+		return strconv.ParseFloat(data, 64)
+	}
+	if _, ok := column.value.([]byte); ok {
+		return []byte(data), nil
+	}
+	return data, nil
+}
+
+func (u *upstreamChecker) close() {
+	if err := u.db.Close(); err != nil {
+		log.Warn("close upstream failed", zap.Error(err))
+	}
+}
@@ -0,0 +1,175 @@
+// Copyright 2023 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	gomysql "github.com/go-sql-driver/mysql"
+	"github.com/segmentio/kafka-go"
+	"github.com/stretchr/testify/require"
+)
+
+// expectTestSnapshotRead expects reading the row of the table `test`.`c` from the snapshot at the read ts.
+func expectTestSnapshotRead(mock sqlmock.Sqlmock, readTs string, rows *sqlmock.Rows) {
+	mock.ExpectExec(regexp.QuoteMeta("SET @@time_zone = ?")).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(regexp.QuoteMeta("SET @@tidb_snapshot = ?")).WithArgs(readTs).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectQuery(regexp.QuoteMeta(testDownstreamQuery)).WithArgs(int64(1)).WillReturnRows(rows)
+	mock.ExpectExec(regexp.QuoteMeta("SET @@tidb_snapshot = ''")).WillReturnResult(sqlmock.NewResult(0, 0))
+}
+
+func TestUpstreamCompare(t *testing.T) {
+	t.Parallel()
+
+	db, mock, err := sqlmock.New()
+	require.NoError(t, err)
+	checker := newUpstreamCheckerWithDB(db, newDefaultConfig())
+	columns := []string{"id", "name", "data"}
+
+	current := testCanalJSONChecksum(1, "b", []byte{0xe9, 0x01})
+	value := newTestCanalJSONMessage("INSERT", `[{"id":"1","name":"c","data":"é\u0001"}]`, `null`,
+		fmt.Sprintf(`{"commitTs":100,"_checksum":{"current":%d}}`, current))
+	result, err := (&canalJSONVerifier{collectRows: true}).verify(kafka.Message{Value: []byte(value)})
+	require.ErrorIs(t, err, errChecksumMismatch)
+	require.NotNil(t, result.mismatch)
+	row := result.mismatch
+	require.Equal(t, uint64(100), row.readTs)
+	require.Equal(t, current, row.expected)
+
+	// the upstream matches the checksum, the event is mangled.
+	expectTestSnapshotRead(mock, "100", sqlmock.NewRows(columns).AddRow("1", "b", []byte{0xe9, 0x01}))
+	comparison := checker.compare(context.Background(), row)
+	require.Empty(t, comparison.Error)
+	require.Equal(t, upstreamConclusionMangled, comparison.Conclusion)
+	require.Equal(t, current, comparison.UpstreamChecksum)
+	require.NotEqual(t, comparison.EventBytes, comparison.UpstreamBytes)
+
+	// the upstream is the same as the event, the checksum is wrong.
+	expectTestSnapshotRead(mock, "100", sqlmock.NewRows(columns).AddRow("1", "c", []byte{0xe9, 0x01}))
+	comparison = checker.compare(context.Background(), row)
+	require.Equal(t, upstreamConclusionWrongChecksum, comparison.Conclusion)
+	require.Equal(t, comparison.EventBytes, comparison.UpstreamBytes)
+
+	// the snapshot is garbage collected.
+	mock.ExpectExec(regexp.QuoteMeta("SET @@time_zone = ?")).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(regexp.QuoteMeta("SET @@tidb_snapshot = ?")).WithArgs("100").
+		WillReturnError(&gomysql.MySQLError{Number: errnoGCTooEarly, Message: "GC life time is shorter than transaction duration"})
+	comparison = checker.compare(context.Background(), row)
+	require.Contains(t, comparison.Error, "snapshot at ts 100 is garbage collected")
+	require.Empty(t, comparison.Conclusion)
+	require.NotEmpty(t, comparison.EventBytes)
+
+	// the checksum version not registered is never compared by the crc32 one, the upstream is not read.
+	row.checksumVersion = 1
+	comparison = checker.compare(context.Background(), row)
+	require.Equal(t, "unsupported checksum version: 1", comparison.Error)
+	require.Empty(t, comparison.EventBytes)
+	require.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestUpstreamMismatchedOldValue(t *testing.T) {
+	t.Parallel()
+
+	current := testCanalJSONChecksum(1, "b", []byte{0xe9, 0x01})
+	previous := testCanalJSONChecksum(1, "a", []byte{0xe9, 0x01})
+	value := newTestCanalJSONMessage("UPDATE", `[{"id":"1","name":"b","data":"é\u0001"}]`, `[{"name":"x"}]`,
+		fmt.Sprintf(`{"commitTs":100,"_checksum":{"current":%d,"previous":%d}}`, current, previous))
+	result, err := (&canalJSONVerifier{collectRows: true}).verify(kafka.Message{Value: []byte(value)})
+	require.ErrorIs(t, err, errChecksumMismatch)
+	// the old value is read from the snapshot just before the commit ts.
+	require.Equal(t, uint64(99), result.mismatch.readTs)
+	require.Equal(t, previous, result.mismatch.expected)
+	require.Equal(t, "x", result.mismatch.columns[1].value)
+}
+
+func TestUpstreamComparisonReported(t *testing.T) {
+	t.Parallel()
+
+	db, mock, err := sqlmock.New()
+	require.NoError(t, err)
+	cfg := newDefaultConfig()
+	cfg.protocol = protocolCanalJSON
+	cfg.upstreamDSN = "root@tcp(127.0.0.1:4000)/"
+	require.NoError(t, cfg.validate())
+
+	current := testCanalJSONChecksum(1, "b", []byte{0xe9, 0x01})
+	value := newTestCanalJSONMessage("INSERT", `[{"id":"1","name":"c","data":"é\u0001"}]`, `null`,
+		fmt.Sprintf(`{"commitTs":100,"_checksum":{"current":%d}}`, current))
+	reader := &fakeReader{messages: []kafka.Message{{Topic: "test", Offset: 0, Value: []byte(value)}}}
+	v := newTestVerifier(cfg, reader)
+	v.upstream = newUpstreamCheckerWithDB(db, cfg)
+	expectTestSnapshotRead(mock, "100", sqlmock.NewRows([]string{"id", "name", "data"}).AddRow("1", "b", []byte{0xe9, 0x01}))
+
+	err = v.run(context.Background())
+	require.Equal(t, exitCodeMismatch, v.finish(err))
+	require.Len(t, v.report.Failures, 1)
+	require.NotNil(t, v.report.Failures[0].Upstream)
+	require.Equal(t, upstreamConclusionMangled, v.report.Failures[0].Upstream.Conclusion)
+	require.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestAvroUpstreamComparisonReported(t *testing.T) {
+	t.Parallel()
+
+	db, mock, err := sqlmock.New()
+	require.NoError(t, err)
+	registry := newTestRegistry(t, map[int]string{testSchemaID: testValueSchema, testKeySchemaID: testKeySchema})
+	cfg := newDefaultConfig()
+	cfg.schemaRegistryURL = registry.URL
+	cfg.upstreamDSN = "root@tcp(127.0.0.1:4000)/"
+	require.NoError(t, cfg.validate())
+
+	message := newMismatchTestMessage(t, 0, 1, "a")
+	message.Key = encodeTestMessage(t, testKeySchemaID, testKeySchema, map[string]interface{}{"id": int64(1)})
+	reader := &fakeReader{messages: []kafka.Message{message}}
+	v := newTestVerifier(cfg, reader)
+	v.upstream = newUpstreamCheckerWithDB(db, cfg)
+	mock.ExpectExec(regexp.QuoteMeta("SET @@time_zone = ?")).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(regexp.QuoteMeta("SET @@tidb_snapshot = ?")).WithArgs("400000000000000000").
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT `id`, `name` FROM `test`.`t` WHERE `id` = ?")).WithArgs(int64(1)).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "name"}).AddRow("1", "a"))
+	mock.ExpectExec(regexp.QuoteMeta("SET @@tidb_snapshot = ''")).WillReturnResult(sqlmock.NewResult(0, 0))
+
+	err = v.run(context.Background())
+	require.Equal(t, exitCodeMismatch, v.finish(err))
+	require.Len(t, v.report.Failures, 1)
+	require.NotNil(t, v.report.Failures[0].Upstream)
+	require.Equal(t, upstreamConclusionWrongChecksum, v.report.Failures[0].Upstream.Conclusion)
+	require.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestLocalTimeZone(t *testing.T) {
+	t.Parallel()
+
+	require.Equal(t, "America/New_York", localTimeZone("America/New_York", ""))
+	require.Equal(t, "Asia/Shanghai", localTimeZone(":Asia/Shanghai", ""))
+
+	dir := t.TempDir()
+	localtime := filepath.Join(dir, "localtime")
+	require.NoError(t, os.Symlink("/usr/share/zoneinfo/Europe/Berlin", localtime))
+	if _, err := time.LoadLocation("Europe/Berlin"); err == nil {
+		require.Equal(t, "Europe/Berlin", localTimeZone("", localtime))
+	}
+	// the offset is used if the name is unknown.
+	require.Regexp(t, `^[+-]\d\d:\d\d$`, localTimeZone("", filepath.Join(dir, "missing")))
+}
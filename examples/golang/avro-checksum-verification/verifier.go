@@ -0,0 +1,861 @@
+// Copyright 2023 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/pingcap/log"
+	"github.com/segmentio/kafka-go"
+	"go.uber.org/zap"
+)
+
+// counters records the cumulative verification result.
+type counters struct {
+	Messages          uint64 `json:"messages"`
+	Verified          uint64 `json:"verified"`
+	SkippedNoChecksum uint64 `json:"skippedNoChecksum"`
+	SkippedDelete     uint64 `json:"skippedDelete"`
+	// SkippedLegacyFormat is the number of messages carrying none of the TiDB extension fields, such as of the older
+	// TiCDC avro format, which never carry the checksum.
+	SkippedLegacyFormat uint64 `json:"skippedLegacyFormat,omitempty"`
+	// NotComputable is the number of messages whose checksum is not computable, since some columns cannot be handled,
+	// only counted by the salvage mode, otherwise they are the decode errors.
+	NotComputable uint64 `json:"notComputable,omitempty"`
+	// VerifiedWithCaveats is the number of messages verified without the columns of the unknown TiDB types,
+	// only counted by the skip-column policy.
+	VerifiedWithCaveats uint64 `json:"verifiedWithCaveats,omitempty"`
+	// SkippedHandleKeyOnly is the number of messages only carrying the handle key columns.
+	SkippedHandleKeyOnly uint64 `json:"skippedHandleKeyOnly"`
+	// SkippedNonRow is the number of messages not carrying any row, such as DDL and watermark.
+	SkippedNonRow uint64 `json:"skippedNonRow"`
+	// Filtered is the number of messages filtered out by the include and exclude table patterns,
+	// the key filter or the operations.
+	Filtered uint64 `json:"filtered,omitempty"`
+	// Duplicates is the number of events delivered more than once, only counted if the dedup tracker is enabled.
+	Duplicates uint64 `json:"duplicates,omitempty"`
+	// Unsampled is the number of messages not sampled, they are committed without verification.
+	Unsampled uint64 `json:"unsampled,omitempty"`
+	// OutOfRange is the number of messages whose commit ts is outside the window to verify.
+	OutOfRange uint64 `json:"outOfRange,omitempty"`
+	// Deferred is the number of messages whose verification is deferred, such as awaiting the table schema,
+	// the deferred rows are counted again once verified.
+	Deferred     uint64 `json:"deferred"`
+	Mismatches   uint64 `json:"mismatches"`
+	DecodeErrors uint64 `json:"decodeErrors"`
+	// DownstreamChecked is the number of rows cross-checked against the downstream database.
+	DownstreamChecked uint64 `json:"downstreamChecked,omitempty"`
+	DownstreamDiffs   uint64 `json:"downstreamDiffs,omitempty"`
+	// DownstreamSuperseded is the number of rows different from the downstream, but superseded by a later event.
+	DownstreamSuperseded uint64 `json:"downstreamSuperseded,omitempty"`
+	// OrderingErrors is the number of messages carrying a commit ts smaller than the resolved ts of the partition.
+	OrderingErrors uint64 `json:"orderingErrors,omitempty"`
+	// OpInconsistencies is the number of events whose operation is unknown, or inconsistent with the message shape.
+	OpInconsistencies uint64 `json:"opInconsistencies,omitempty"`
+}
+
+func (c *counters) addOutcome(o outcome) {
+	switch o {
+	case outcomeVerified:
+		c.Verified++
+	case outcomeSkippedDelete:
+		c.SkippedDelete++
+	case outcomeSkippedNoChecksum:
+		c.SkippedNoChecksum++
+	case outcomeSkippedHandleKeyOnly:
+		c.SkippedHandleKeyOnly++
+	case outcomeSkippedNonRow:
+		c.SkippedNonRow++
+	case outcomeDeferred:
+		c.Deferred++
+	case outcomeFiltered:
+		c.Filtered++
+	case outcomeOutOfRange:
+		c.OutOfRange++
+	case outcomeUnsampled:
+		c.Unsampled++
+	case outcomeSkippedLegacyFormat:
+		c.SkippedLegacyFormat++
+	case outcomeNotComputable:
+		c.NotComputable++
+	case outcomeVerifiedWithCaveats:
+		c.VerifiedWithCaveats++
+	}
+}
+
+func (c *counters) addFailure(err error) {
+	switch exitCodeOf(err) {
+	case exitCodeMismatch:
+		c.Mismatches++
+	case exitCodeDecodeError:
+		c.DecodeErrors++
+	case exitCodeDownstreamDiff:
+		c.DownstreamDiffs++
+	case exitCodeOrderingError:
+		c.OrderingErrors++
+	case exitCodeOpInconsistent:
+		c.OpInconsistencies++
+	}
+}
+
+type verifier struct {
+	cfg *config
+
+	reader          messageReader
+	messageVerifier messageVerifier
+	checkpointer    *checkpointer
+	// downstream cross-checks the verified rows against the downstream database, nil if disabled.
+	downstream *downstreamChecker
+	// upstream compares the mismatched rows against the upstream snapshot, nil if disabled.
+	upstream *upstreamChecker
+	// ddl consumes the DDL topic into the ddlHistory, nil if disabled.
+	ddl        *ddlConsumer
+	ddlHistory *ddlHistory
+	// resolved tracks the resolved ts of each partition, to check the ordering and detect the stalls.
+	resolved *resolvedTracker
+	// keyPartitions checks all events of a key are sent to the same partition, nil if disabled.
+	keyPartitions *keyPartitionChecker
+	// dedup counts the duplicate events, nil if disabled.
+	dedup *dedupTracker
+	// state keeps the tracking on disk, nil if the state dir is not set.
+	state *boltStateStore
+	// exporter writes the decoded rows, nil if disabled.
+	exporter *exporter
+	// latency records the end-to-end latency of the events, nil in the offline mode and the replay.
+	latency *latencyTracker
+	// skew records the skew of the kafka message timestamps against the commit, nil in the offline mode and the replay.
+	skew *skewTracker
+	// replay reads the dumped messages, nil if not replaying, the ordering is not checked then.
+	replay *replayReader
+	// partitions are the partitions of the topic in the bounded run, pastEnd are those past the end commit ts.
+	partitions []int
+	pastEnd    map[int]struct{}
+	endTs      uint64
+
+	// mu guards the state below against the control API, the message is verified and committed under it.
+	mu       sync.Mutex
+	counters counters
+	report   *report
+	// control is the control API of the serve mode, nil otherwise.
+	control *controller
+
+	// held are the messages handled but not committed yet, since some rows are pending,
+	// or a preceding message of the partition is not settled by the guard.
+	held  []heldMessage
+	guard *commitGuard
+}
+
+type heldMessage struct {
+	message    kafka.Message
+	commitTs   uint64
+	resolvedTs uint64
+}
+
+func newVerifier(ctx context.Context, cfg *config) (*verifier, error) {
+	messageVerifier, err := newMessageVerifier(cfg)
+	if err != nil {
+		return nil, err
+	}
+	v := &verifier{
+		cfg: cfg, messageVerifier: messageVerifier, report: newReport(),
+		resolved: newResolvedTracker(cfg.resolvedTsStall, cfg.resolvedTsJump, nil, time.Now()), guard: newCommitGuard(),
+	}
+	if cfg.downstreamDSN != "" {
+		v.downstream, err = newDownstreamChecker(ctx, cfg)
+		if err != nil {
+			log.Error("connect downstream failed", zap.Error(err))
+			return nil, newInfraError(err)
+		}
+	}
+	if cfg.upstreamDSN != "" {
+		v.upstream, err = newUpstreamChecker(ctx, cfg)
+		if err != nil {
+			log.Error("connect upstream failed", zap.Error(err))
+			return nil, newInfraError(err)
+		}
+	}
+	if cfg.checkKeyPartition {
+		v.keyPartitions = newKeyPartitionChecker(cfg.keyPartitionCapacity)
+	}
+	if cfg.dedupWindow > 0 {
+		v.dedup = newDedupTracker(cfg.dedupWindow, cfg.dedupCapacity)
+	}
+	if cfg.stateDir != "" {
+		if err := v.openState(); err != nil {
+			log.Error("open state dir failed", zap.String("dir", cfg.stateDir), zap.Error(err))
+			return nil, err
+		}
+	}
+	if cfg.export != "" {
+		v.exporter = newExporter(cfg.export, cfg.exportFile, cfg.exportRotateSize)
+	}
+	if cfg.storageDir != "" {
+		return newOfflineVerifier(cfg, v)
+	}
+	if cfg.replay != "" {
+		return newReplayVerifier(cfg, v)
+	}
+	v.latency = newLatencyTracker()
+	v.skew = newSkewTracker(cfg.kafkaTimestampType, cfg.maxSkew)
+	if cfg.bounded {
+		if err := v.initBounded(ctx); err != nil {
+			log.Error("read partitions failed", zap.String("topic", cfg.topic), zap.Error(err))
+			return nil, newInfraError(err)
+		}
+	}
+	if cfg.ddlTopic != "" {
+		v.ddlHistory = newDDLHistory()
+		v.ddl, err = newDDLConsumer(ctx, cfg, v.ddlHistory)
+		if err != nil {
+			log.Error("create DDL topic reader failed", zap.String("topic", cfg.ddlTopic), zap.Error(err))
+			return nil, newInfraError(err)
+		}
+	}
+
+	state := newCheckpoint(cfg.topic)
+	if cfg.resume {
+		previous, err := loadCheckpoint(cfg.checkpointFile)
+		if err != nil {
+			log.Error("load checkpoint file failed", zap.String("file", cfg.checkpointFile), zap.Error(err))
+			return nil, err
+		}
+		switch {
+		case previous == nil:
+			log.Warn("checkpoint file not found, start from scratch", zap.String("file", cfg.checkpointFile))
+		case previous.Topic != cfg.topic:
+			return nil, errors.New("checkpoint file belongs to another topic: " + previous.Topic)
+		default:
+			log.Info("resume from the checkpoint file",
+				zap.String("file", cfg.checkpointFile),
+				zap.Any("partitions", previous.Partitions),
+				zap.Any("counters", previous.Counters))
+			state = previous
+			v.counters = previous.Counters
+			v.resolved = newResolvedTracker(cfg.resolvedTsStall, cfg.resolvedTsJump, previous, time.Now())
+		}
+	}
+	if cfg.checkpointFile != "" {
+		v.checkpointer = newCheckpointer(cfg.checkpointFile, cfg.checkpointInterval, state)
+	}
+
+	reader, err := newMessageReader(ctx, cfg, state)
+	if err != nil {
+		return nil, newInfraError(err)
+	}
+	v.reader = reader
+	return v, nil
+}
+
+// openState opens the state store, and moves the tracking of the enabled checks into it.
+func (v *verifier) openState() error {
+	store, err := openStateStore(v.cfg.stateDir, v.cfg.topic)
+	if err != nil {
+		return err
+	}
+	v.state = store
+	if v.dedup != nil {
+		v.dedup.state = newTrackerState(store, "dedup/", v.cfg.stateTTL)
+	}
+	if v.keyPartitions != nil {
+		v.keyPartitions.state = newTrackerState(store, "partition/", v.cfg.stateTTL)
+	}
+	if d, ok := v.messageVerifier.(*debeziumVerifier); ok {
+		d.lastCommitTs.state = newTrackerState(store, "commitTs/", v.cfg.stateTTL)
+	}
+	return nil
+}
+
+// initBounded reads the partitions of the topic, the verification stops once all of them are past the end commit ts.
+func (v *verifier) initBounded(ctx context.Context) error {
+	window, err := v.cfg.commitTsWindow()
+	if err != nil {
+		return err
+	}
+	partitions, err := readPartitions(ctx, v.cfg, v.cfg.topic)
+	if err != nil {
+		return err
+	}
+	for _, p := range partitions {
+		v.partitions = append(v.partitions, p.ID)
+	}
+	v.pastEnd = make(map[int]struct{}, len(partitions))
+	v.endTs = window.end
+	return nil
+}
+
+// reachEnd records whether the partition is past the end commit ts by the message,
+// and returns true if all partitions are, only in the bounded run.
+func (v *verifier) reachEnd(partition int, result messageResult) bool {
+	if v.pastEnd == nil {
+		return false
+	}
+	if result.commitTs > v.endTs || result.resolvedTs >= v.endTs {
+		if _, ok := v.pastEnd[partition]; !ok {
+			log.Info("partition is past the end commit ts", zap.Int("partition", partition),
+				zap.Uint64("commitTs", result.commitTs), zap.Uint64("resolvedTs", result.resolvedTs))
+		}
+		v.pastEnd[partition] = struct{}{}
+	}
+	return len(v.partitions) > 0 && len(v.pastEnd) >= len(v.partitions)
+}
+
+func newMessageReader(ctx context.Context, cfg *config, state *checkpoint) (messageReader, error) {
+	if !cfg.explicitOffset() {
+		log.Info("start consuming ...", zap.String("kafka", cfg.kafkaAddr),
+			zap.String("topic", cfg.topic), zap.String("groupID", cfg.consumerGroupID))
+		return newGroupReader(cfg), nil
+	}
+
+	defaultOffset, err := parseStartOffset(cfg.startOffset)
+	if err != nil {
+		return nil, err
+	}
+	reader, err := newPartitionReader(ctx, cfg, cfg.topic, state.startOffsets(), defaultOffset)
+	if err != nil {
+		log.Error("create partition reader failed", zap.String("topic", cfg.topic), zap.Error(err))
+		return nil, err
+	}
+	log.Info("start consuming ...", zap.String("kafka", cfg.kafkaAddr), zap.String("topic", cfg.topic))
+	return reader, nil
+}
+
+func (v *verifier) run(ctx context.Context) error {
+	defer v.flushCheckpoint()
+	if v.ddl != nil {
+		ddlCtx, cancel := context.WithCancel(ctx)
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			v.ddl.run(ddlCtx)
+		}()
+		defer func() {
+			cancel()
+			<-done
+		}()
+	}
+	if v.downstream != nil {
+		v.downstream.start(ctx)
+		defer func() {
+			v.downstream.stop()
+			// the verification is stopped already, the differences found since then are only reported.
+			v.mu.Lock()
+			_ = v.reportDownstream()
+			v.mu.Unlock()
+		}()
+	}
+	if v.cfg.progressInterval > 0 {
+		progressCtx, cancel := context.WithCancel(ctx)
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			v.logProgress(progressCtx)
+		}()
+		defer func() {
+			cancel()
+			<-done
+		}()
+	}
+	if v.cfg.resolvedTsStall > 0 {
+		stallCtx, cancel := context.WithCancel(ctx)
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			v.detectStalls(stallCtx)
+		}()
+		defer func() {
+			cancel()
+			<-done
+		}()
+	}
+
+	for {
+		message, err := v.reader.FetchMessage(ctx)
+		if err != nil {
+			// io.EOF is returned by the offline reader once all files are consumed.
+			if errors.Is(err, context.Canceled) || errors.Is(err, io.EOF) {
+				if pending := v.pendingRows(); pending > 0 {
+					log.Warn("rows are still pending, messages since the first pending one are not committed",
+						zap.Int("pendingRows", pending), zap.Int("heldMessages", len(v.held)))
+				} else if len(v.held) > 0 {
+					log.Warn("messages are not committed, since a preceding message is not settled",
+						zap.Int("heldMessages", len(v.held)))
+				}
+				if errors.Is(err, io.EOF) {
+					log.Info("all messages consumed", zap.Any("counters", v.counters))
+				} else {
+					log.Info("verification canceled", zap.Any("counters", v.counters))
+				}
+				return nil
+			}
+			log.Error("read kafka message failed", zap.Error(err))
+			return newInfraError(err)
+		}
+
+		// the message fetched while paused is held until resumed, it's verified again after restart if canceled.
+		if v.control != nil {
+			if err := v.control.waitResumed(ctx); err != nil {
+				log.Info("verification canceled while paused", zap.Any("counters", v.counters))
+				return nil
+			}
+		}
+		reachedEnd, err := v.process(ctx, message)
+		if err != nil {
+			return err
+		}
+		if reachedEnd {
+			log.Info("all partitions are past the end commit ts, stop the bounded run",
+				zap.Uint64("endCommitTs", v.endTs), zap.Any("counters", v.counters))
+			return nil
+		}
+	}
+}
+
+// process verifies the message and commits it once no row is pending,
+// it returns true if all partitions are past the end commit ts in the bounded run.
+// The state of the verifier is only changed under the lock, so that it's consistent to the control API.
+func (v *verifier) process(ctx context.Context, message kafka.Message) (bool, error) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if v.control != nil {
+		v.control.observe(message)
+	}
+	if err := v.reportDownstream(); err != nil {
+		return false, err
+	}
+	v.guard.dispatch(message)
+	result, err := v.handleMessage(message)
+	if v.latency != nil {
+		v.latency.observe(result, time.Now())
+	}
+	if v.exporter != nil && result.decoded != nil {
+		if exportErr := v.exporter.write(message, result, err); exportErr != nil {
+			log.Error("export the decoded row failed", zap.String("file", v.cfg.exportFile), zap.Error(exportErr))
+			return false, newInfraError(exportErr)
+		}
+	}
+	// the dump may not be in the order of the topic, the ordering is not checked by the replay.
+	if v.replay != nil && errors.Is(err, errOrderingViolation) {
+		err = nil
+	}
+	if err == nil && v.replay == nil {
+		err = v.resolved.observe(message.Partition, result, time.Now())
+	}
+	if err == nil && v.skew != nil {
+		err = v.skew.observe(message, result)
+	}
+	if err == nil && v.keyPartitions != nil {
+		err = v.keyPartitions.observe(message, result)
+	}
+	if err == nil && v.dedup != nil {
+		err = v.countDuplicate(message, result)
+	}
+	if err == nil && v.downstream != nil {
+		err = v.crossCheck(ctx, message, result)
+	}
+	if v.upstream != nil {
+		v.compareUpstream(ctx, &result)
+	}
+	if err != nil {
+		// the message is not committed if the verification stops,
+		// so that it can be verified again after restart.
+		if err := v.handleFailure(message, result, err); err != nil {
+			v.guard.fail(message)
+			return false, err
+		}
+	}
+	// the failure tolerated by the policy is released, the message is committed and skipped.
+	v.guard.settle(message)
+
+	reachedEnd := v.reachEnd(message.Partition, result)
+	// committing the message would skip the pending rows after restart, hold it until no row is pending.
+	v.held = append(v.held, heldMessage{message: message, commitTs: result.commitTs, resolvedTs: result.resolvedTs})
+	if v.pendingRows() > 0 {
+		return false, nil
+	}
+	if err := v.commitHeld(ctx); err != nil {
+		return false, err
+	}
+	return reachedEnd, nil
+}
+
+// countDuplicate counts the event if it's delivered more than once.
+func (v *verifier) countDuplicate(message kafka.Message, result messageResult) error {
+	duplicate, err := v.dedup.observe(message, result)
+	if !duplicate {
+		return err
+	}
+	v.counters.Duplicates++
+	if table := v.report.tableCounters(result.table); table != nil {
+		table.Duplicates++
+	}
+	return nil
+}
+
+// detectStalls checks the resolved ts of each partition periodically until the context is done.
+func (v *verifier) detectStalls(ctx context.Context) {
+	ticker := time.NewTicker(v.resolved.checkInterval())
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			v.resolved.detectStalls(now)
+		}
+	}
+}
+
+// logProgress logs the counters, the latency and the skew periodically until the context is done.
+func (v *verifier) logProgress(ctx context.Context) {
+	ticker := time.NewTicker(v.cfg.progressInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			v.mu.Lock()
+			fields := []zap.Field{zap.Any("counters", v.counters)}
+			if v.latency != nil {
+				fields = append(fields, v.latency.fields()...)
+			}
+			if v.skew != nil {
+				fields = append(fields, v.skew.fields()...)
+			}
+			v.mu.Unlock()
+			log.Info("verification progress", fields...)
+		}
+	}
+}
+
+// crossCheck checks the sampled rows of the message against the downstream database,
+// it returns on the first difference found at once, the others are reported by reportDownstream later.
+func (v *verifier) crossCheck(ctx context.Context, message kafka.Message, result messageResult) error {
+	for _, row := range result.rows {
+		// the row being rechecked may be different since the downstream has applied this event.
+		v.downstream.supersede(row)
+		if !v.downstream.sampled() {
+			continue
+		}
+		checked, err := v.downstream.check(ctx, message, result.table, row)
+		if checked {
+			v.counters.DownstreamChecked++
+			if table := v.report.tableCounters(result.table); table != nil {
+				table.DownstreamChecked++
+			}
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// reportDownstream reports the results of the downstream rechecks finished so far,
+// it returns the error if the verification should stop on any of them.
+func (v *verifier) reportDownstream() error {
+	if v.downstream == nil {
+		return nil
+	}
+	for _, r := range v.downstream.takeResults() {
+		result := messageResult{table: r.table, commitTs: r.commitTs}
+		if r.superseded {
+			v.counters.DownstreamSuperseded++
+			if table := v.report.tableCounters(r.table); table != nil {
+				table.DownstreamSuperseded++
+			}
+			continue
+		}
+		if err := v.handleFailure(r.message, result, r.err); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// compareUpstream compares the mismatched row against the upstream snapshot, the comparison is reported with the failure,
+// and compares the sampled verified rows for calibration.
+func (v *verifier) compareUpstream(ctx context.Context, result *messageResult) {
+	if result.mismatch != nil {
+		result.upstream = v.upstream.compare(ctx, result.mismatch)
+		log.Info("mismatched row compared against the upstream", zap.Any("comparison", result.upstream))
+		return
+	}
+	for _, row := range result.rows {
+		if !v.upstream.sampled() {
+			continue
+		}
+		comparison := v.upstream.compare(ctx, row)
+		if comparison.Conclusion != upstreamConclusionMatched {
+			log.Warn("verified row is different from the upstream", zap.String("schema", row.schema),
+				zap.String("table", row.table), zap.Any("comparison", comparison))
+		}
+	}
+}
+
+func (v *verifier) pendingRows() int {
+	if d, ok := v.messageVerifier.(deferringVerifier); ok {
+		return d.pendingRows()
+	}
+	return 0
+}
+
+// commitHeld commits the held messages allowed by the guard, and advances the checkpoint,
+// the others are held until the preceding messages of the partition are settled.
+func (v *verifier) commitHeld(ctx context.Context) error {
+	committing, held := v.committable()
+	if len(committing) == 0 {
+		return nil
+	}
+	messages := make([]kafka.Message, 0, len(committing))
+	for _, c := range committing {
+		messages = append(messages, c.message)
+	}
+	// the tracking state of the messages is durable before their offsets and the checkpoint,
+	// otherwise it's lost on crash while the messages are never consumed again.
+	if v.state != nil {
+		if err := v.state.Flush(); err != nil {
+			log.Error("flush state store failed", zap.String("dir", v.cfg.stateDir), zap.Error(err))
+			return newInfraError(err)
+		}
+	}
+	if err := v.reader.CommitMessages(ctx, messages...); err != nil {
+		log.Error("commit kafka message failed", zap.Error(err))
+		return newInfraError(err)
+	}
+
+	if v.checkpointer != nil {
+		for _, c := range committing {
+			v.checkpointer.advance(c.message.Partition, c.message.Offset, c.commitTs, c.resolvedTs, v.counters)
+		}
+		if err := v.checkpointer.maybeFlush(time.Now()); err != nil {
+			log.Warn("save checkpoint file failed", zap.String("file", v.cfg.checkpointFile), zap.Error(err))
+		}
+	}
+	v.held = held
+	return nil
+}
+
+// committable splits the held messages into those can be committed and the others,
+// once a message of the partition is not committable, neither are the following ones.
+func (v *verifier) committable() ([]heldMessage, []heldMessage) {
+	// the difference found by the recheck stops the verification if fail fast,
+	// the messages since the first one being rechecked are not committed then.
+	var rechecking map[partitionKey]int64
+	if v.downstream != nil && v.cfg.failFast {
+		rechecking = v.downstream.pendingOffsets()
+	}
+	var committing, held []heldMessage
+	blocked := make(map[partitionKey]struct{})
+	for _, h := range v.held {
+		key := partitionKeyOf(h.message)
+		if _, ok := blocked[key]; !ok && v.guard.committable(h.message) {
+			if offset, ok := rechecking[key]; !ok || h.message.Offset < offset {
+				committing = append(committing, h)
+				continue
+			}
+		}
+		blocked[key] = struct{}{}
+		held = append(held, h)
+	}
+	return committing, held
+}
+
+// handleMessage verifies the message, and returns the result carrying the event metadata.
+func (v *verifier) handleMessage(message kafka.Message) (messageResult, error) {
+	v.counters.Messages++
+
+	result, err := v.messageVerifier.verify(message)
+	if result.outcome != outcomeFiltered && result.outcome != outcomeUnsampled {
+		result.key = v.keyText(message.Key)
+	}
+	v.report.addOps(result.ops)
+	if result.schemaDrift != nil {
+		v.report.addSchemaDrift(message, result)
+	}
+	var table *counters
+	// the filtered tables are not reported.
+	if result.outcome != outcomeFiltered {
+		table = v.report.tableCounters(result.table)
+	}
+	if table != nil {
+		table.Messages++
+	}
+	// the row is verified even if it's out of order, or its operation is inconsistent,
+	// the outcome is counted besides the violation.
+	if err != nil && !errors.Is(err, errOrderingViolation) && !errors.Is(err, errOpInconsistent) {
+		log.Error("verify kafka message failed", zap.String("topic", message.Topic),
+			zap.Int("partition", message.Partition), zap.Int64("offset", message.Offset),
+			zap.String("key", result.key), zap.ByteString("value", message.Value), zap.Error(err))
+		return result, newDecodeError(err)
+	}
+
+	v.counters.addOutcome(result.outcome)
+	if table != nil {
+		table.addOutcome(result.outcome)
+	}
+	v.report.addRows(result)
+	if result.outcome == outcomeNotComputable {
+		v.report.addNotComputable(message, result)
+	}
+	return result, err
+}
+
+// keyText renders the key of the message in a human-readable form by the message verifier,
+// or as the hex prefix if the verifier does not support it.
+func (v *verifier) keyText(key []byte) string {
+	if r, ok := v.messageVerifier.(keyRenderingVerifier); ok {
+		return r.keyText(key)
+	}
+	return hexKeyPrefix(key)
+}
+
+// handleFailure records the failed message, and decides whether the verification should go on.
+// It returns nil if the failure is tolerated, then the message is committed and skipped,
+// otherwise the error is returned and the verification stops.
+func (v *verifier) handleFailure(message kafka.Message, result messageResult, err error) error {
+	v.counters.addFailure(err)
+	if table := v.report.tableCounters(result.table); table != nil {
+		table.addFailure(err)
+	}
+	v.report.addFailure(message, result, err)
+
+	if v.cfg.failFast {
+		log.Error("fail fast on the first failure", zap.String("topic", message.Topic),
+			zap.Int("partition", message.Partition), zap.Int64("offset", message.Offset), zap.String("key", result.key),
+			zap.Error(err))
+		return err
+	}
+	if errors.Is(err, errOrderingViolation) {
+		// the row itself is verified, keep verifying the following ones.
+		log.Warn("ordering violation tolerated", zap.String("topic", message.Topic),
+			zap.Int("partition", message.Partition), zap.Int64("offset", message.Offset), zap.String("key", result.key),
+			zap.Uint64("orderingErrors", v.counters.OrderingErrors))
+		return nil
+	}
+	if errors.Is(err, errOpInconsistent) {
+		log.Warn("operation inconsistency tolerated", zap.String("topic", message.Topic),
+			zap.Int("partition", message.Partition), zap.Int64("offset", message.Offset), zap.String("key", result.key),
+			zap.Uint64("opInconsistencies", v.counters.OpInconsistencies), zap.Error(err))
+		return nil
+	}
+	if errors.Is(err, errDownstreamDiff) {
+		// the downstream applies the events asynchronously, the difference may be transient, never stop on it.
+		log.Warn("downstream difference tolerated", zap.String("topic", message.Topic),
+			zap.Int("partition", message.Partition), zap.Int64("offset", message.Offset), zap.String("key", result.key),
+			zap.Uint64("downstreamDiffs", v.counters.DownstreamDiffs))
+		return nil
+	}
+	// the mismatch is tolerated only if the budget is set explicitly, the budget 0 stops on the first one.
+	if errors.Is(err, errChecksumMismatch) && (v.cfg.mismatchBudget == unlimitedMismatchBudget ||
+		v.counters.Mismatches <= uint64(v.cfg.mismatchBudget)) {
+		log.Warn("checksum mismatch tolerated by the budget", zap.String("topic", message.Topic),
+			zap.Int("partition", message.Partition), zap.Int64("offset", message.Offset), zap.String("key", result.key),
+			zap.Uint64("mismatches", v.counters.Mismatches), zap.Int("budget", v.cfg.mismatchBudget))
+		return nil
+	}
+	return err
+}
+
+// finish writes the final report, and returns the exit code.
+func (v *verifier) finish(stopErr error) int {
+	if v.ddlHistory != nil {
+		v.report.addDDLs(v.ddlHistory)
+	}
+	v.report.addResolved(v.resolved)
+	if v.keyPartitions != nil {
+		v.report.KeyPartition = v.keyPartitions.snapshot()
+	}
+	if v.latency != nil {
+		v.report.Latency = v.latency.snapshot()
+	}
+	if v.skew != nil {
+		v.report.KafkaSkew = v.skew.snapshot()
+	}
+	if v.replay != nil {
+		v.report.Replay = v.replay.snapshot()
+	}
+	if m, ok := v.messageVerifier.(mappingVerifier); ok {
+		v.report.SchemaTables = m.schemaTables()
+	}
+	if u, ok := v.messageVerifier.(unknownTypeVerifier); ok {
+		if v.report.UnknownTypes = u.unknownTypes(); len(v.report.UnknownTypes) > 0 {
+			log.Warn("some columns are of the unknown TiDB types", zap.String("policy", v.cfg.onUnknownType),
+				zap.Any("unknownTypes", v.report.UnknownTypes))
+		}
+	}
+	if r, ok := v.messageVerifier.(refreshingVerifier); ok {
+		if v.report.SchemaRefresh = r.schemaRefreshes(); v.report.SchemaRefresh != nil {
+			log.Warn("some schemas are fetched again since the cached ones fail to decode",
+				zap.Any("schemaRefresh", v.report.SchemaRefresh))
+		}
+	}
+	if n, ok := v.messageVerifier.(notingVerifier); ok {
+		v.report.ChecksumNote = n.checksumNote()
+	}
+	v.report.finish(stopErr, v.counters)
+	if v.report.Sampling = newSamplingReport(v.cfg, v.counters); v.report.Sampling != nil {
+		log.Warn("only the sampled messages are verified", zap.Any("sampling", v.report.Sampling))
+	}
+	log.Info("verification finished",
+		zap.Any("counters", v.report.Counters),
+		zap.Uint64("rows", v.report.Rows),
+		zap.Int("failures", len(v.report.Failures)),
+		zap.Any("latency", v.report.Latency),
+		zap.Int("exitCode", v.report.ExitCode))
+	if v.cfg.reportFile != "" {
+		if err := v.report.writeFile(v.cfg.reportFile); err != nil {
+			log.Warn("write report file failed", zap.String("file", v.cfg.reportFile), zap.Error(err))
+		}
+	}
+	return v.report.ExitCode
+}
+
+func (v *verifier) flushCheckpoint() {
+	if v.checkpointer == nil {
+		return
+	}
+	if err := v.checkpointer.flush(time.Now()); err != nil {
+		log.Warn("save checkpoint file failed", zap.String("file", v.cfg.checkpointFile), zap.Error(err))
+	}
+}
+
+func (v *verifier) close() {
+	if err := v.reader.Close(); err != nil {
+		log.Warn("close kafka reader failed", zap.Error(err))
+	}
+	if v.downstream != nil {
+		v.downstream.close()
+	}
+	if v.upstream != nil {
+		v.upstream.close()
+	}
+	if v.ddl != nil {
+		v.ddl.close()
+	}
+	if v.exporter != nil {
+		if err := v.exporter.close(); err != nil {
+			log.Warn("close export files failed", zap.String("file", v.cfg.exportFile), zap.Error(err))
+		}
+	}
+	if v.state != nil {
+		if err := v.state.Close(); err != nil {
+			log.Warn("close state store failed", zap.String("dir", v.cfg.stateDir), zap.Error(err))
+		}
+	}
+}
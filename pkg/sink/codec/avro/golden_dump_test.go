@@ -0,0 +1,266 @@
+// Copyright 2023 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package avro
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/pingcap/tidb/pkg/kv"
+	"github.com/pingcap/tidb/pkg/parser/mysql"
+	"github.com/pingcap/tidb/pkg/tablecodec"
+	"github.com/pingcap/tidb/pkg/types"
+	"github.com/pingcap/tidb/pkg/util/rowcodec"
+	"github.com/pingcap/tiflow/cdc/entry"
+	"github.com/pingcap/tiflow/cdc/model"
+	"github.com/pingcap/tiflow/pkg/config"
+	"github.com/pingcap/tiflow/pkg/integrity"
+	"github.com/pingcap/tiflow/pkg/sink/codec/common"
+	"github.com/pingcap/tiflow/pkg/spanz"
+	"github.com/stretchr/testify/require"
+)
+
+// goldenDirEnv is the directory to dump the golden messages of examples/golang/avro-checksum-verification,
+// the dump is skipped if it's not set, run testdata/golden/generate.sh of the example instead.
+const goldenDirEnv = "AVRO_CHECKSUM_GOLDEN_DIR"
+
+const goldenCreateTable = `create table golden.all_types (
+	id           bigint primary key,
+	c_int        int null,
+	c_uint       int unsigned null,
+	c_bigint     bigint null,
+	c_ubigint    bigint unsigned null,
+	c_float      float null,
+	c_double     double null,
+	c_decimal_0  decimal(65, 0) null,
+	c_decimal_2  decimal(10, 2) null,
+	c_decimal_10 decimal(20, 10) null,
+	c_bit        bit(64) null,
+	c_text       text null,
+	c_blob       blob null,
+	c_enum       enum('a', 'b,c', 'it''s') null,
+	c_set        set('x', 'y', 'z') null,
+	c_json       json null,
+	c_date       date null,
+	c_datetime   datetime null,
+	c_datetime_3 datetime(3) null,
+	c_datetime_6 datetime(6) null,
+	c_timestamp  timestamp null,
+	c_time       time null,
+	c_time_1     time(1) null,
+	c_time_6     time(6) null,
+	c_year       year null,
+	c_required   text not null
+)`
+
+// goldenInserts are in the ascending order of the handle,
+// so that the row just inserted is always the last one of the table.
+var goldenInserts = []string{
+	`insert into golden.all_types values (
+		-9223372036854775808, -2147483648, 0, -9223372036854775808, 0,
+		-3.402823466e38, -1.7976931348623157e308,
+		-99999999999999999999999999999999999999999999999999999999999999999, -0.01, -0.0000000001,
+		b'0', '', '', 'b,c', '', '[]',
+		'1000-01-01', '1000-01-01 00:00:00', '1000-01-01 00:00:00.000', '1000-01-01 00:00:00.000000',
+		'1970-01-01 00:00:01', '-838:59:59', '-838:59:59.0', '-838:59:59.000000', 1901, '')`,
+	`insert into golden.all_types values (
+		0, 0, 0, 0, 0, 0, 0, 0, 0.00, 0.0000000000, b'1', ' ', ' ', 'a', 'y', '"string"',
+		'2024-02-29', '2024-02-29 12:30:45', '2024-02-29 12:30:45.100', '2024-02-29 12:30:45.000100',
+		'2024-02-29 12:30:45', '00:00:00', '-00:00:00.1', '00:00:00.999999', 0, 'zero')`,
+	`insert into golden.all_types values (
+		1, 1, 1, 1, 1, 3.1415927, 2.718281828459045, 1, 12.34, 1.2345678900,
+		b'101', 'hello', 'world', 'a', 'x,z', '{"a": 1, "b": [true, null]}',
+		'2023-12-01', '2023-12-01 10:00:00', '2023-12-01 10:00:00.123', '2023-12-01 10:00:00.123456',
+		'2023-12-01 10:00:00', '10:00:00', '10:00:00.5', '10:00:00.000001', 2023, 'r')`,
+	`insert into golden.all_types (id, c_required) values (4, 'all null')`,
+	`insert into golden.all_types values (
+		9223372036854775807, 2147483647, 4294967295, 9223372036854775807, 18446744073709551615,
+		3.402823466e38, 1.7976931348623157e308,
+		99999999999999999999999999999999999999999999999999999999999999999, 99999999.99, 9999999999.9999999999,
+		18446744073709551615, '中文テキスト 🙂', x'0001ff', 'it''s', 'x,y,z', '{"nested": {"k": "v"}, "n": 1.5}',
+		'9999-12-31', '9999-12-31 23:59:59', '9999-12-31 23:59:59.999', '9999-12-31 23:59:59.999999',
+		'2038-01-19 03:14:07', '838:59:59', '838:59:59.0', '838:59:59.000000', 2155, 'max')`,
+}
+
+// goldenColumn is the bytes of a column accumulated by the checksum calculation of TiDB.
+type goldenColumn struct {
+	Name     string `json:"name"`
+	TiDBType string `json:"tidbType"`
+	Value    string `json:"value"`
+	Bytes    string `json:"bytes"`
+}
+
+// goldenMessage is the expected checksum of a golden message.
+type goldenMessage struct {
+	File     string         `json:"file"`
+	Table    string         `json:"table"`
+	CommitTs uint64         `json:"commitTs"`
+	Checksum uint64         `json:"checksum"`
+	Columns  []goldenColumn `json:"columns"`
+}
+
+type goldenFile struct {
+	TimeZone string          `json:"timeZone"`
+	Messages []goldenMessage `json:"messages"`
+}
+
+// TestDumpGoldenMessages writes the messages encoded from the rows written by TiDB with the row level checksum,
+// along with their schemas, and the checksum and the bytes of each column calculated by TiDB.
+func TestDumpGoldenMessages(t *testing.T) {
+	dir := os.Getenv(goldenDirEnv)
+	if dir == "" {
+		t.Skipf("%s is not set", goldenDirEnv)
+	}
+	// the TIMESTAMP values are converted in the local time zone by the mounter.
+	zone, _ := time.Now().Zone()
+	require.Equal(t, "UTC", zone, "dump the golden messages with TZ=UTC")
+
+	replicaConfig := config.GetDefaultReplicaConfig()
+	replicaConfig.Integrity.IntegrityCheckLevel = integrity.CheckLevelCorrectness
+	replicaConfig.Integrity.CorruptionHandleLevel = integrity.CorruptionHandleLevelError
+	helper := entry.NewSchemaTestHelperWithReplicaConfig(t, replicaConfig)
+	defer helper.Close()
+	helper.Tk().MustExec("set time_zone = 'UTC'")
+	_ = helper.DDL2Event("create database golden")
+	_ = helper.DDL2Event(goldenCreateTable)
+
+	codecConfig := common.NewConfig(config.ProtocolAvro)
+	codecConfig.EnableTiDBExtension = true
+	codecConfig.EnableRowChecksum = true
+	codecConfig.AvroDecimalHandlingMode = "string"
+	codecConfig.AvroBigintUnsignedHandlingMode = "string"
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	encoder, err := SetupEncoderAndSchemaRegistry4Testing(ctx, codecConfig)
+	defer TeardownEncoderAndSchemaRegistry4Testing()
+	require.NoError(t, err)
+
+	schemaDir := filepath.Join(dir, "messages", "schemas")
+	require.NoError(t, os.MkdirAll(schemaDir, 0o755))
+	golden := goldenFile{TimeZone: "UTC"}
+	for i, insert := range goldenInserts {
+		event := helper.DML2Event(insert, "golden", "all_types")
+		// the mounter has verified the checksum written by TiDB.
+		require.NotNil(t, event.Checksum)
+		require.False(t, event.Checksum.Corrupted)
+		columns := dumpGoldenColumns(t, helper.Storage(), event)
+
+		require.NoError(t, encoder.AppendRowChangedEvent(ctx, "golden", event, nil))
+		messages := encoder.Build()
+		require.Len(t, messages, 1)
+		name := fmt.Sprintf("%08d", i)
+		for suffix, content := range map[string][]byte{".key": messages[0].Key, ".value": messages[0].Value} {
+			require.NoError(t, os.WriteFile(filepath.Join(dir, "messages", name+suffix), content, 0o644))
+			dumpGoldenSchema(t, schemaDir, content)
+		}
+		golden.Messages = append(golden.Messages, goldenMessage{
+			File:     name + ".value",
+			Table:    event.TableInfo.GetSchemaName() + "." + event.TableInfo.GetTableName(),
+			CommitTs: event.CommitTs,
+			Checksum: uint64(event.Checksum.Current),
+			Columns:  columns,
+		})
+	}
+	content, err := json.MarshalIndent(golden, "", "  ")
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "expected.json"), append(content, '\n'), 0o644))
+}
+
+// dumpGoldenColumns decodes the row of the event from the store, and encodes each column by the rowcodec of TiDB,
+// the bytes must make up the checksum of the event, so that they are exactly what TiDB accumulates.
+func dumpGoldenColumns(t *testing.T, store kv.Storage, event *model.RowChangedEvent) []goldenColumn {
+	tableInfo := event.TableInfo
+	key, value := getLastKeyValue(t, store, tableInfo.ID)
+	handle, err := tablecodec.DecodeRowKey(key)
+	require.NoError(t, err)
+	handleColIDs, handleColFt, reqCols := tableInfo.GetRowColInfos()
+	datums, err := rowcodec.NewDatumMapDecoder(reqCols, time.Local).DecodeToDatumMap(value, nil)
+	require.NoError(t, err)
+	datums, err = tablecodec.DecodeHandleToDatumMap(handle, handleColIDs, handleColFt, time.Local, datums)
+	require.NoError(t, err)
+
+	tidbTypes := make(map[string]string)
+	for _, col := range event.GetColumns() {
+		if col != nil {
+			tidbTypes[col.Name] = getTiDBTypeFromColumn(col)
+		}
+	}
+	row := rowcodec.RowData{}
+	for _, colInfo := range tableInfo.Columns {
+		datum := datums[colInfo.ID]
+		row.Cols = append(row.Cols, rowcodec.ColData{ColumnInfo: colInfo, Datum: &datum})
+	}
+	sort.Sort(row)
+	checksum, err := row.Checksum(time.Local)
+	require.NoError(t, err)
+	require.Equal(t, event.Checksum.Current, checksum, "the columns do not make up the checksum of TiDB")
+
+	columns := make([]goldenColumn, 0, len(row.Cols))
+	for _, col := range row.Cols {
+		bytes, err := col.Encode(time.Local, nil)
+		require.NoError(t, err)
+		value := "NULL"
+		if !col.Datum.IsNull() {
+			if types.IsBinaryStr(&col.FieldType) || col.GetType() == mysql.TypeBit {
+				value = "0x" + hex.EncodeToString(col.Datum.GetBytes())
+			} else {
+				value, err = col.Datum.ToString()
+				require.NoError(t, err)
+			}
+		}
+		columns = append(columns, goldenColumn{
+			Name: col.Name.O, TiDBType: tidbTypes[col.Name.O], Value: value, Bytes: hex.EncodeToString(bytes),
+		})
+	}
+	return columns
+}
+
+// dumpGoldenSchema writes the schema of the message registered in the testing registry as `{id}.avsc`.
+func dumpGoldenSchema(t *testing.T, dir string, message []byte) {
+	id, _, err := extractConfluentSchemaIDAndBinaryData(message)
+	require.NoError(t, err)
+	resp, err := http.Get(fmt.Sprintf("http://127.0.0.1:8081/schemas/ids/%d", id))
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	var schema lookupResponse
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&schema))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, fmt.Sprintf("%d.avsc", id)), []byte(schema.Schema), 0o644))
+}
+
+func getLastKeyValue(t *testing.T, store kv.Storage, tableID int64) (key, value []byte) {
+	txn, err := store.Begin()
+	require.NoError(t, err)
+	defer txn.Rollback() //nolint:errcheck
+
+	start, end := spanz.GetTableRange(tableID)
+	iter, err := txn.Iter(start, end)
+	require.NoError(t, err)
+	defer iter.Close()
+	for iter.Valid() {
+		key = iter.Key()
+		value = iter.Value()
+		err = iter.Next()
+		require.NoError(t, err)
+	}
+	return key, value
+}